@@ -0,0 +1,147 @@
+// Package alerting evaluates operational conditions of the node (disk space, database,
+// queues, authentication failures) at an interval and notifies the operator through
+// webhooks, email or stdout when one starts or stops firing, so small deployments get
+// alerts without a monitoring stack.
+package alerting
+
+import (
+	"context"
+	"sync"
+	"time"
+	"wave_capacitor/logging"
+)
+
+// Alert states
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+)
+
+// checkTimeout bounds one evaluation of a condition
+const checkTimeout = 10 * time.Second
+
+// logger logs alerts and notifier failures
+var logger = logging.Component("alerting")
+
+// Alert is one notification about a condition
+type Alert struct {
+	Name    string    `json:"name"`
+	Status  string    `json:"status"`
+	Message string    `json:"message"`
+	Node    string    `json:"node,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// Check evaluates a condition and describes the problem, or returns "" while it is fine
+type Check func(ctx context.Context) string
+
+// Notifier delivers alerts
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// Options configures a Manager
+type Options struct {
+	Interval       time.Duration // between evaluations
+	RepeatInterval time.Duration // firing alerts are sent again this often; 0 sends them once
+	Node           string        // identifies the node in alerts, e.g. its hostname
+}
+
+// condition is a named check and its last state
+type condition struct {
+	name     string
+	check    Check
+	firing   bool
+	message  string
+	notified time.Time
+}
+
+// Manager evaluates the conditions and sends their alerts to every notifier
+type Manager struct {
+	opts       Options
+	conditions []*condition
+	notifiers  []Notifier
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewManager creates a manager; add conditions and notifiers, then call Start
+func NewManager(opts Options) *Manager {
+	return &Manager{opts: opts, stop: make(chan struct{})}
+}
+
+// Add registers a condition
+func (m *Manager) Add(name string, check Check) {
+	m.conditions = append(m.conditions, &condition{name: name, check: check})
+}
+
+// AddNotifier registers a notifier
+func (m *Manager) AddNotifier(notifier Notifier) {
+	m.notifiers = append(m.notifiers, notifier)
+}
+
+// Start evaluates the conditions every interval until Stop is called
+func (m *Manager) Start() {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		ticker := time.NewTicker(m.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.Evaluate()
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the evaluation, waiting for a running one to finish
+func (m *Manager) Stop() {
+	close(m.stop)
+	m.wg.Wait()
+}
+
+// Evaluate checks every condition once and sends the alerts that are due. Conditions are
+// checked one after the other, so checks may keep state between evaluations.
+func (m *Manager) Evaluate() {
+	for _, c := range m.conditions {
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		message := c.check(ctx)
+		cancel()
+
+		now := time.Now()
+		switch {
+		case message != "" && !c.firing:
+			c.firing, c.message, c.notified = true, message, now
+			m.send(Alert{Name: c.name, Status: StatusFiring, Message: message, Node: m.opts.Node, At: now})
+		case message != "" && m.opts.RepeatInterval > 0 && now.Sub(c.notified) >= m.opts.RepeatInterval:
+			c.message, c.notified = message, now
+			m.send(Alert{Name: c.name, Status: StatusFiring, Message: message, Node: m.opts.Node, At: now})
+		case message == "" && c.firing:
+			c.firing, c.notified = false, now
+			m.send(Alert{Name: c.name, Status: StatusResolved, Message: "resolved: " + c.message, Node: m.opts.Node, At: now})
+		}
+	}
+}
+
+// send delivers an alert to every notifier; failures are logged
+func (m *Manager) send(alert Alert) {
+	if alert.Status == StatusFiring {
+		logger.Warn(context.Background(), "alert firing", "alert", alert.Name, "message", alert.Message)
+	} else {
+		logger.Info(context.Background(), "alert resolved", "alert", alert.Name)
+	}
+
+	for _, notifier := range m.notifiers {
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		if err := notifier.Notify(ctx, alert); err != nil {
+			logger.Error(ctx, "sending alert failed", "alert", alert.Name, "notifier", notifier.Name(), "error", err)
+		}
+		cancel()
+	}
+}
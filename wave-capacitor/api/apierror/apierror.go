@@ -0,0 +1,128 @@
+// Package apierror defines the body of every failed API request and the catalog of
+// machine-readable error codes in it, so clients can branch on codes rather than messages.
+// It is shared by the handlers and the middleware in front of them.
+package apierror
+
+import (
+	"wave_capacitor/logging"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Error codes; messages may change, codes don't
+const (
+	InvalidRequest       = "invalid_request"
+	Unauthorized         = "unauthorized"
+	InvalidCredentials   = "invalid_credentials"
+	TokenRevoked         = "token_revoked"
+	RecoveryProof        = "recovery_proof_required"
+	Forbidden            = "forbidden"
+	AccountDisabled      = "account_disabled"
+	NotFound             = "not_found"
+	Conflict             = "conflict"
+	UsernameTaken        = "username_taken"
+	KeyInUse             = "key_in_use"
+	SessionConflict      = "session_conflict"
+	RestorePlanChanged   = "restore_plan_changed"
+	LimitExceeded        = "limit_exceeded"
+	IdempotencyInFlight  = "idempotency_in_flight"
+	IdempotencyKeyReused = "idempotency_key_reused"
+	PayloadTooLarge      = "payload_too_large"
+	RateLimited          = "rate_limited"
+	Internal             = "internal_error"
+	NotSupported         = "not_supported"
+	Unavailable          = "unavailable"
+	Maintenance          = "maintenance"
+	StorageFull          = "storage_full"
+	UpstreamUnavailable  = "upstream_unavailable"
+	FederationLoop       = "federation_loop"
+)
+
+// Entry documents one error code
+type Entry struct {
+	Code        string `json:"code"`
+	Statuses    []int  `json:"statuses" doc:"HTTP statuses the code comes with"`
+	Description string `json:"description"`
+}
+
+// Catalog lists every code the API returns
+var Catalog = []Entry{
+	{InvalidRequest, []int{fiber.StatusBadRequest}, "The request could not be decoded or failed validation; details lists the invalid fields"},
+	{Unauthorized, []int{fiber.StatusUnauthorized}, "Missing, invalid or expired credentials"},
+	{InvalidCredentials, []int{fiber.StatusUnauthorized}, "Wrong username or password"},
+	{TokenRevoked, []int{fiber.StatusUnauthorized}, "The token was revoked by a logout, password change or operator; log in again"},
+	{RecoveryProof, []int{fiber.StatusUnauthorized}, "Restoring into an existing account needs a token of the account or the answer to a recovery challenge from POST /recover_account/challenge, and restoring keys the account never had needs the answer to a challenge for them"},
+	{Forbidden, []int{fiber.StatusForbidden}, "The credentials don't allow this operation"},
+	{AccountDisabled, []int{fiber.StatusForbidden}, "An operator disabled the account"},
+	{NotFound, []int{fiber.StatusNotFound}, "The resource does not exist, or the feature is not enabled on this node"},
+	{Conflict, []int{fiber.StatusConflict}, "Conflict with the current state, e.g. an operation that is already running"},
+	{UsernameTaken, []int{fiber.StatusBadRequest, fiber.StatusConflict}, "The username belongs to another account"},
+	{KeyInUse, []int{fiber.StatusConflict}, "The public key is, or was, the key of another account"},
+	{SessionConflict, []int{fiber.StatusConflict}, "The session was modified by another device; details.current_version has its version"},
+	{RestorePlanChanged, []int{fiber.StatusConflict}, "A confirmed restore no longer matches its dry run; details has the new plan to review"},
+	{LimitExceeded, []int{fiber.StatusBadRequest, fiber.StatusConflict}, "A per-user limit, such as the number of prekeys or webhooks, was reached"},
+	{IdempotencyInFlight, []int{fiber.StatusConflict}, "A request with the same Idempotency-Key is still being processed; retry after Retry-After"},
+	{IdempotencyKeyReused, []int{fiber.StatusUnprocessableEntity}, "The Idempotency-Key was already used for a different request"},
+	{PayloadTooLarge, []int{fiber.StatusRequestEntityTooLarge}, "The request body is too large"},
+	{RateLimited, []int{fiber.StatusTooManyRequests}, "Rate limit exceeded; retry after Retry-After"},
+	{Internal, []int{fiber.StatusInternalServerError}, "Unexpected error on the node; quote request_id when reporting it"},
+	{NotSupported, []int{fiber.StatusNotImplemented}, "The feature is disabled or not supported by this node's configuration"},
+	{Unavailable, []int{fiber.StatusServiceUnavailable}, "A dependency of the node is temporarily unavailable; retry later"},
+	{Maintenance, []int{fiber.StatusServiceUnavailable}, "The node is in read-only maintenance mode; retry after Retry-After"},
+	{StorageFull, []int{fiber.StatusInsufficientStorage}, "The node is out of storage space"},
+	{UpstreamUnavailable, []int{fiber.StatusBadGateway}, "The capacitor hosting the recipient could not be reached; retry later"},
+	{FederationLoop, []int{fiber.StatusLoopDetected}, "A forwarded message came back to a capacitor it passed through, or was relayed too often"},
+}
+
+// Response is the body of every failed request
+type Response struct {
+	Success   bool        `json:"success" doc:"Always false"`
+	Code      string      `json:"code" doc:"Machine-readable error code, see GET /errors"`
+	Message   string      `json:"message" doc:"Human readable error message"`
+	Error     string      `json:"error" doc:"Same as message, kept for older clients"`
+	Details   interface{} `json:"details,omitempty" doc:"Code-specific details, e.g. the invalid fields of invalid_request"`
+	RequestID string      `json:"request_id" doc:"ID of the request (also sent as X-Request-ID), quote it when reporting problems"`
+}
+
+// ForStatus returns the generic code of an HTTP status, for errors without a specific one
+func ForStatus(status int) string {
+	switch status {
+	case fiber.StatusBadRequest:
+		return InvalidRequest
+	case fiber.StatusUnauthorized:
+		return Unauthorized
+	case fiber.StatusForbidden:
+		return Forbidden
+	case fiber.StatusNotFound:
+		return NotFound
+	case fiber.StatusConflict:
+		return Conflict
+	case fiber.StatusRequestEntityTooLarge:
+		return PayloadTooLarge
+	case fiber.StatusTooManyRequests:
+		return RateLimited
+	case fiber.StatusNotImplemented:
+		return NotSupported
+	case fiber.StatusServiceUnavailable:
+		return Unavailable
+	case fiber.StatusInsufficientStorage:
+		return StorageFull
+	default:
+		return Internal
+	}
+}
+
+// Respond writes an error response; an empty code is derived from the status
+func Respond(c *fiber.Ctx, status int, code, message string, details interface{}) error {
+	if code == "" {
+		code = ForStatus(status)
+	}
+	return c.Status(status).JSON(Response{
+		Success:   false,
+		Code:      code,
+		Message:   message,
+		Error:     message,
+		Details:   details,
+		RequestID: logging.RequestID(c.UserContext()),
+	})
+}
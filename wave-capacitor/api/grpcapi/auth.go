@@ -0,0 +1,131 @@
+package grpcapi
+
+import (
+	"context"
+	"strings"
+	"wave_capacitor/logging"
+	"wave_capacitor/middleware"
+	wavev1 "wave_capacitor/proto/wave/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// publicMethods can be called without a token
+var publicMethods = map[string]bool{
+	wavev1.AuthService_Register_FullMethodName:         true,
+	wavev1.AuthService_Login_FullMethodName:            true,
+	wavev1.BackupService_RecoverAccount_FullMethodName: true,
+}
+
+// writeMethods are refused while the node is in read-only maintenance mode
+var writeMethods = map[string]bool{
+	wavev1.AuthService_Register_FullMethodName:         true,
+	wavev1.BackupService_RecoverAccount_FullMethodName: true,
+	wavev1.MessageService_SendMessage_FullMethodName:   true,
+	wavev1.MessageService_MarkRead_FullMethodName:      true,
+	wavev1.ContactService_AddContact_FullMethodName:    true,
+	wavev1.ContactService_RemoveContact_FullMethodName: true,
+}
+
+type usernameKey struct{}
+
+// usernameFrom returns the authenticated username of the call
+func usernameFrom(ctx context.Context) string {
+	username, _ := ctx.Value(usernameKey{}).(string)
+	return username
+}
+
+// authenticate applies the same checks as the REST middleware chain: rate limits,
+// maintenance mode, token validation and revocation, and notes the account as seen. It
+// returns the context carrying the username.
+func authenticate(ctx context.Context, method string) (context.Context, error) {
+	if err := limitPeer(ctx, method); err != nil {
+		return nil, err
+	}
+	if writeMethods[method] {
+		if maintenance := middleware.Maintenance(); maintenance.Enabled {
+			return nil, status.Error(codes.Unavailable, maintenance.Message)
+		}
+	}
+
+	// Public methods can be called with a token too, e.g. RecoverAccount by the account's owner
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 && publicMethods[method] {
+		return ctx, nil
+	}
+	if len(values) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "Missing token")
+	}
+	username, issuedAt, err := middleware.ParseToken(strings.TrimPrefix(values[0], "Bearer "))
+	if err != nil {
+		middleware.RecordAuthFailure()
+		return nil, status.Error(codes.Unauthenticated, "Invalid or expired token")
+	}
+
+	revoked, err := middleware.TokenRevoked(ctx, username, issuedAt)
+	if err != nil {
+		logging.Errorf(ctx, "Error checking token revocation for %s: %v", username, err)
+		return nil, status.Error(codes.Unavailable, "Unable to verify token, please try again later")
+	}
+	if revoked {
+		middleware.RecordAuthFailure()
+		return nil, status.Error(codes.Unauthenticated, "Token has been revoked")
+	}
+	middleware.NoteSeen(username)
+	if err := limitUser(ctx, method, username); err != nil {
+		return nil, err
+	}
+
+	return context.WithValue(logging.WithUser(ctx, username), usernameKey{}, username), nil
+}
+
+// requestIDKey is the metadata key carrying the request ID, as the X-Request-ID header does over HTTP
+const requestIDKey = "x-request-id"
+
+// withRequestID attaches the caller's request ID (or a new one) to the context and
+// returns it to the caller in the response header
+func withRequestID(ctx context.Context) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(requestIDKey); len(values) > 0 {
+			id = values[0]
+		}
+	}
+	if !logging.ValidRequestID(id) {
+		id = logging.NewRequestID()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, id))
+	return logging.WithRequestID(ctx, id)
+}
+
+// unaryAuth authenticates unary calls
+func unaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := authenticate(withRequestID(ctx), info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// contextStream overrides the stream context, e.g. with the authenticated one
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// streamAuth authenticates streaming calls
+func streamAuth(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := authenticate(withRequestID(stream.Context()), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+}
@@ -0,0 +1,60 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"wave_capacitor/api/handlers"
+	"wave_capacitor/logging"
+
+	"github.com/gofiber/fiber/v2"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/protoadapt"
+)
+
+// statusCodes maps the HTTP statuses of service errors to gRPC codes
+var statusCodes = map[int]codes.Code{
+	fiber.StatusBadRequest:          codes.InvalidArgument,
+	fiber.StatusUnauthorized:        codes.Unauthenticated,
+	fiber.StatusForbidden:           codes.PermissionDenied,
+	fiber.StatusNotFound:            codes.NotFound,
+	fiber.StatusConflict:            codes.AlreadyExists,
+	fiber.StatusNotImplemented:      codes.Unimplemented,
+	fiber.StatusBadGateway:          codes.Unavailable,
+	fiber.StatusServiceUnavailable:  codes.Unavailable,
+	fiber.StatusInsufficientStorage: codes.ResourceExhausted,
+	fiber.StatusLoopDetected:        codes.Aborted,
+}
+
+// errorDomain is the ErrorInfo domain of API error codes
+const errorDomain = "wave_capacitor"
+
+// toStatus converts a service error into a gRPC status error
+func toStatus(ctx context.Context, err error) error {
+	var serviceErr *handlers.ServiceError
+	if !errors.As(err, &serviceErr) {
+		logging.Errorf(ctx, "Error handling gRPC call: %v", err)
+		return status.Error(codes.Internal, "Internal server error")
+	}
+	code, ok := statusCodes[serviceErr.Status]
+	if !ok {
+		code = codes.Internal
+	}
+	st := status.New(code, serviceErr.Message)
+
+	// The API error code travels as the reason of an ErrorInfo detail
+	details := []protoadapt.MessageV1{&errdetails.ErrorInfo{Reason: serviceErr.ErrorCode(), Domain: errorDomain}}
+	if len(serviceErr.Fields) > 0 {
+		// Invalid request fields travel as a BadRequest detail, the gRPC counterpart of "details"
+		violations := make([]*errdetails.BadRequest_FieldViolation, len(serviceErr.Fields))
+		for i, field := range serviceErr.Fields {
+			violations[i] = &errdetails.BadRequest_FieldViolation{Field: field.Field, Description: field.Message, Reason: field.Code}
+		}
+		details = append(details, &errdetails.BadRequest{FieldViolations: violations})
+	}
+	if detailed, err := st.WithDetails(details...); err == nil {
+		return detailed.Err()
+	}
+	return st.Err()
+}
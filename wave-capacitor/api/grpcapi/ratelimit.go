@@ -0,0 +1,78 @@
+package grpcapi
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/middleware"
+	wavev1 "wave_capacitor/proto/wave/v1"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Calls count against the budgets of the REST rate limiting middleware, sharing their
+// counters: every call against the global budget of its peer address, the credential
+// methods (publicMethods) against the auth budget of the address, and authenticated
+// calls against the budget of their user, SendMessage against the send budget too.
+
+// retryAfterKey is the metadata key telling when a refused call can be retried, as the
+// Retry-After header does over HTTP
+const retryAfterKey = "retry-after"
+
+// peerIP returns the address of the caller without its port
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// limitPeer counts a call against the budgets of its peer address
+func limitPeer(ctx context.Context, method string) error {
+	ip := peerIP(ctx)
+	if reset, exceeded := middleware.GlobalLimitExceeded(ctx, ip); exceeded {
+		return rateLimited(ctx, reset)
+	}
+	if publicMethods[method] {
+		if reset, exceeded := middleware.AuthLimitExceeded(ctx, ip); exceeded {
+			return rateLimited(ctx, reset)
+		}
+	}
+	return nil
+}
+
+// limitUser counts an authenticated call against the budgets of its user
+func limitUser(ctx context.Context, method, username string) error {
+	if reset, exceeded := middleware.UserLimitExceeded(ctx, username); exceeded {
+		return rateLimited(ctx, reset)
+	}
+	if method == wavev1.MessageService_SendMessage_FullMethodName {
+		if reset, exceeded := middleware.SendLimitExceeded(ctx, username); exceeded {
+			return rateLimited(ctx, reset)
+		}
+	}
+	return nil
+}
+
+// rateLimited returns the error refusing a call over budget, telling the caller when the
+// budget resets
+func rateLimited(ctx context.Context, reset time.Duration) error {
+	grpc.SetHeader(ctx, metadata.Pairs(retryAfterKey, strconv.Itoa(int((reset+time.Second-1)/time.Second))))
+	st := status.New(codes.ResourceExhausted, "Too many requests, please slow down")
+	if detailed, err := st.WithDetails(&errdetails.ErrorInfo{Reason: apierror.RateLimited, Domain: errorDomain}); err == nil {
+		return detailed.Err()
+	}
+	return st.Err()
+}
@@ -0,0 +1,35 @@
+package grpcapi
+
+import (
+	"context"
+	"wave_capacitor/crashreport"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errPanicked is returned for calls whose handler panicked
+var errPanicked = status.Error(codes.Internal, "Internal server error")
+
+// unaryRecover turns a panic in a unary handler into an Internal error
+func unaryRecover(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			crashreport.Recovered(ctx, recovered, map[string]string{"method": info.FullMethod})
+			resp, err = nil, errPanicked
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// streamRecover turns a panic in a streaming handler into an Internal error
+func streamRecover(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			crashreport.Recovered(stream.Context(), recovered, map[string]string{"method": info.FullMethod})
+			err = errPanicked
+		}
+	}()
+	return handler(srv, stream)
+}
@@ -0,0 +1,30 @@
+// Package grpcapi serves the capacitor API over gRPC. The services are thin adapters over
+// the same service functions the REST handlers use.
+package grpcapi
+
+//go:generate sh -c "cd ../../proto && buf generate"
+
+import (
+	wavev1 "wave_capacitor/proto/wave/v1"
+
+	"google.golang.org/grpc"
+)
+
+// maxMessageSize bounds request and response sizes; backups may carry many messages
+const maxMessageSize = 64 * 1024 * 1024
+
+// NewServer creates a gRPC server with all capacitor services registered
+func NewServer() *grpc.Server {
+	server := grpc.NewServer(
+		grpc.MaxRecvMsgSize(maxMessageSize),
+		grpc.MaxSendMsgSize(maxMessageSize),
+		grpc.ChainUnaryInterceptor(unaryTrace, unaryRecover, unaryAuth),
+		grpc.ChainStreamInterceptor(streamTrace, streamRecover, streamAuth),
+	)
+
+	wavev1.RegisterAuthServiceServer(server, &authService{})
+	wavev1.RegisterMessageServiceServer(server, &messageService{})
+	wavev1.RegisterContactServiceServer(server, &contactService{})
+	wavev1.RegisterBackupServiceServer(server, &backupService{})
+	return server
+}
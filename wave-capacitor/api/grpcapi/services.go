@@ -0,0 +1,212 @@
+package grpcapi
+
+import (
+	"context"
+	"encoding/json"
+	"wave_capacitor/api/handlers"
+	wavev1 "wave_capacitor/proto/wave/v1"
+	"wave_capacitor/utils"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// authService implements wavev1.AuthServiceServer
+type authService struct {
+	wavev1.UnimplementedAuthServiceServer
+}
+
+func (s *authService) Register(ctx context.Context, req *wavev1.RegisterRequest) (*wavev1.RegisterResponse, error) {
+	resp, err := handlers.RegisterAccount(ctx, handlers.RegisterRequest{Username: req.Username, Password: req.Password})
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+	return &wavev1.RegisterResponse{Token: resp.Token, PublicKey: resp.PublicKey}, nil
+}
+
+func (s *authService) Login(ctx context.Context, req *wavev1.LoginRequest) (*wavev1.LoginResponse, error) {
+	resp, err := handlers.Authenticate(ctx, handlers.LoginRequest{Username: req.Username, Password: req.Password})
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+	return &wavev1.LoginResponse{Token: resp.Token, Username: resp.User.Username, PublicKey: resp.User.PublicKey}, nil
+}
+
+// messageService implements wavev1.MessageServiceServer
+type messageService struct {
+	wavev1.UnimplementedMessageServiceServer
+}
+
+func (s *messageService) SendMessage(ctx context.Context, req *wavev1.SendMessageRequest) (*wavev1.SendMessageResponse, error) {
+	resp, err := handlers.DeliverMessage(ctx, usernameFrom(ctx), handlers.SendMessageRequest{
+		RecipientPublicKey:  req.RecipientPublicKey,
+		CiphertextKEM:       req.CiphertextKem,
+		CiphertextMsg:       req.CiphertextMsg,
+		Nonce:               req.Nonce,
+		SenderCiphertextKEM: req.SenderCiphertextKem,
+		SenderCiphertextMsg: req.SenderCiphertextMsg,
+		SenderNonce:         req.SenderNonce,
+	})
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+	return &wavev1.SendMessageResponse{MessageId: resp.MessageID, Timestamp: timestamppb.New(resp.Timestamp)}, nil
+}
+
+func (s *messageService) GetMessages(ctx context.Context, req *wavev1.GetMessagesRequest) (*wavev1.GetMessagesResponse, error) {
+	if req.Limit < 0 {
+		return nil, status.Error(codes.InvalidArgument, "limit must not be negative")
+	}
+	resp, err := handlers.ListMessages(ctx, usernameFrom(ctx), int(req.Limit), req.Before)
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+
+	messages := make([]*wavev1.Message, 0, len(resp.Messages))
+	for _, message := range resp.Messages {
+		messages = append(messages, toProtoMessage(message))
+	}
+	return &wavev1.GetMessagesResponse{Messages: messages, NextCursor: resp.NextCursor}, nil
+}
+
+func (s *messageService) StreamMessages(req *wavev1.StreamMessagesRequest, stream grpc.ServerStreamingServer[wavev1.Message]) error {
+	ctx := stream.Context()
+	resp, err := handlers.ListMessages(ctx, usernameFrom(ctx), 0, "")
+	if err != nil {
+		return toStatus(ctx, err)
+	}
+	for _, message := range resp.Messages {
+		if err := stream.Send(toProtoMessage(message)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *messageService) GetUnreadCount(ctx context.Context, req *wavev1.GetUnreadCountRequest) (*wavev1.GetUnreadCountResponse, error) {
+	count, err := handlers.CountUnread(ctx, usernameFrom(ctx))
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+	return &wavev1.GetUnreadCountResponse{Unread: int32(count)}, nil
+}
+
+func (s *messageService) MarkRead(ctx context.Context, req *wavev1.MarkReadRequest) (*wavev1.MarkReadResponse, error) {
+	updated, err := handlers.MarkRead(ctx, usernameFrom(ctx), req.MessageIds)
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+	return &wavev1.MarkReadResponse{Updated: int32(updated)}, nil
+}
+
+// toProtoMessage converts a stored message to its protobuf form
+func toProtoMessage(message handlers.Message) *wavev1.Message {
+	return &wavev1.Message{
+		MessageId:           message.MessageID,
+		SenderPublicKey:     message.SenderPublicKey,
+		RecipientPublicKey:  message.RecipientPublicKey,
+		CiphertextKem:       message.CiphertextKEM,
+		CiphertextMsg:       message.CiphertextMsg,
+		Nonce:               message.Nonce,
+		SenderCiphertextKem: message.SenderCiphertextKEM,
+		SenderCiphertextMsg: message.SenderCiphertextMsg,
+		SenderNonce:         message.SenderNonce,
+		Timestamp:           timestamppb.New(message.Timestamp),
+	}
+}
+
+// contactService implements wavev1.ContactServiceServer
+type contactService struct {
+	wavev1.UnimplementedContactServiceServer
+}
+
+func (s *contactService) AddContact(ctx context.Context, req *wavev1.AddContactRequest) (*wavev1.AddContactResponse, error) {
+	_, err := handlers.SaveContact(ctx, usernameFrom(ctx), handlers.AddContactRequest{
+		ContactPublicKey: req.ContactPublicKey,
+		Nickname:         req.Nickname,
+	})
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+	return &wavev1.AddContactResponse{}, nil
+}
+
+func (s *contactService) ListContacts(ctx context.Context, req *wavev1.ListContactsRequest) (*wavev1.ListContactsResponse, error) {
+	contacts, err := handlers.ListContacts(ctx, usernameFrom(ctx))
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+
+	resp := &wavev1.ListContactsResponse{Contacts: make([]*wavev1.Contact, 0, len(contacts))}
+	for publicKey, contact := range contacts {
+		entry := &wavev1.Contact{PublicKey: publicKey, Nickname: contact.Nickname}
+		if !contact.CreatedAt.IsZero() {
+			entry.CreatedAt = timestamppb.New(contact.CreatedAt)
+		}
+		resp.Contacts = append(resp.Contacts, entry)
+	}
+	return resp, nil
+}
+
+func (s *contactService) RemoveContact(ctx context.Context, req *wavev1.RemoveContactRequest) (*wavev1.RemoveContactResponse, error) {
+	if err := handlers.DeleteContact(ctx, usernameFrom(ctx), req.ContactPublicKey); err != nil {
+		return nil, toStatus(ctx, err)
+	}
+	return &wavev1.RemoveContactResponse{}, nil
+}
+
+// Metadata keys of the recovery challenge answered by a RecoverAccount call
+const (
+	recoveryChallengeKey = "x-recovery-challenge"
+	recoveryProofKey     = "x-recovery-proof"
+)
+
+// backupService implements wavev1.BackupServiceServer
+type backupService struct {
+	wavev1.UnimplementedBackupServiceServer
+}
+
+func (s *backupService) CreateBackup(ctx context.Context, req *wavev1.CreateBackupRequest) (*wavev1.CreateBackupResponse, error) {
+	backup, err := handlers.CreateBackup(ctx, usernameFrom(ctx), req.Passphrase)
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+	data, err := json.Marshal(backup)
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+	return &wavev1.CreateBackupResponse{Backup: data, Encrypted: req.Passphrase != ""}, nil
+}
+
+func (s *backupService) RecoverAccount(ctx context.Context, req *wavev1.RecoverAccountRequest) (*wavev1.RecoverAccountResponse, error) {
+	var recover handlers.RecoverRequest
+	if req.Passphrase != "" {
+		// An encrypted archive as returned by CreateBackup with a passphrase
+		recover.EncryptedBackup = &utils.EncryptedBackup{}
+		recover.Passphrase = req.Passphrase
+		if err := json.Unmarshal(req.Backup, recover.EncryptedBackup); err != nil {
+			return nil, status.Error(codes.InvalidArgument, "Invalid encrypted backup format")
+		}
+	} else if err := json.Unmarshal(req.Backup, &recover); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "Invalid backup format")
+	}
+
+	// Callers without a token of the account pass the answer to a recovery challenge,
+	// obtained from POST /recover_account/challenge, in the call's metadata
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(recoveryChallengeKey); len(values) > 0 {
+		recover.ChallengeID = values[0]
+	}
+	if values := md.Get(recoveryProofKey); len(values) > 0 {
+		recover.Proof = values[0]
+	}
+
+	resp, err := handlers.RestoreAccount(ctx, recover, usernameFrom(ctx))
+	if err != nil {
+		return nil, toStatus(ctx, err)
+	}
+	return &wavev1.RecoverAccountResponse{Token: resp.Token}, nil
+}
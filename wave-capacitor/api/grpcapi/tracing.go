@@ -0,0 +1,52 @@
+package grpcapi
+
+import (
+	"context"
+	"wave_capacitor/tracing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// startCallSpan starts the server span of a call, continuing the caller's trace from its
+// traceparent metadata
+func startCallSpan(ctx context.Context, method string) (context.Context, *tracing.Span) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(tracing.TraceParentHeader); len(values) > 0 {
+			ctx = tracing.Extract(ctx, values[0])
+		}
+	}
+	ctx, span := tracing.Start(ctx, method, tracing.KindServer)
+	span.SetAttribute("rpc.system", "grpc")
+	span.SetAttribute("rpc.method", method)
+	return ctx, span
+}
+
+// endCallSpan records the status code of a call and ends its span
+func endCallSpan(span *tracing.Span, err error) {
+	span.SetAttribute("rpc.grpc.status_code", int(status.Code(err)))
+	span.End(err)
+}
+
+// unaryTrace traces unary calls
+func unaryTrace(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !tracing.Enabled() {
+		return handler(ctx, req)
+	}
+	ctx, span := startCallSpan(ctx, info.FullMethod)
+	resp, err := handler(ctx, req)
+	endCallSpan(span, err)
+	return resp, err
+}
+
+// streamTrace traces streaming calls for as long as the stream is open
+func streamTrace(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if !tracing.Enabled() {
+		return handler(srv, stream)
+	}
+	ctx, span := startCallSpan(stream.Context(), info.FullMethod)
+	err := handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+	endCallSpan(span, err)
+	return err
+}
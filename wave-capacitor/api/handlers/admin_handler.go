@@ -0,0 +1,466 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/config"
+	"wave_capacitor/logging"
+	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+	"wave_capacitor/storage"
+	"wave_capacitor/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// MaintenanceRequest defines the structure for switching maintenance mode
+type MaintenanceRequest struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message" validate:"max=500"` // Shown to clients whose writes are rejected
+}
+
+// GetMaintenance reports whether the node is in read-only maintenance mode
+func GetMaintenance(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success":     true,
+		"maintenance": middleware.Maintenance(),
+	})
+}
+
+// SetMaintenance switches read-only maintenance mode on or off at runtime.
+// The setting is per node and is not persisted across restarts (see MAINTENANCE_MODE).
+func SetMaintenance(c *fiber.Ctx) error {
+	var req MaintenanceRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+
+	status := middleware.SetMaintenanceMode(req.Enabled, req.Message)
+	if status.Enabled {
+		logging.Infof(c.UserContext(), "🚧 Maintenance mode enabled: %s", status.Message)
+	} else {
+		logging.Infof(c.UserContext(), "✅ Maintenance mode disabled")
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success":     true,
+		"maintenance": status,
+	})
+}
+
+// nodeConfig is the configuration reported by GET /api/admin/config, set at startup
+var nodeConfig *config.Config
+
+// SetConfig configures the configuration reported by AdminGetConfig
+func SetConfig(cfg *config.Config) {
+	nodeConfig = cfg
+}
+
+// AdminGetConfig returns the effective configuration of the node with the source of each
+// setting, secrets redacted
+func AdminGetConfig(c *fiber.Ctx) error {
+	if nodeConfig == nil {
+		return respondError(c, serviceError(fiber.StatusNotFound, "Configuration not available"))
+	}
+	return c.Status(fiber.StatusOK).JSON(AdminConfigResponse{
+		Success:  true,
+		Profile:  nodeConfig.Profile,
+		Settings: nodeConfig.Effective(),
+	})
+}
+
+// UserSearchQuery defines the query parameters of the admin user listing
+type UserSearchQuery struct {
+	Query string `query:"q" validate:"max=255"` // Substring of the username; empty lists all users
+	After string `query:"after"`                // Last username of the previous page
+	Limit int    `query:"limit" validate:"min=1,max=200"`
+}
+
+// defaultUserPageSize is the page size of the admin user listing when none is given
+const defaultUserPageSize = 50
+
+// AdminListUsers lists or searches accounts by username, a page at a time
+func AdminListUsers(c *fiber.Ctx) error {
+	var query UserSearchQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+	if query.Limit == 0 {
+		query.Limit = defaultUserPageSize
+	}
+
+	users, err := models.SearchUsers(c.UserContext(), query.Query, query.After, query.Limit)
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error searching users: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to list users"))
+	}
+
+	resp := AdminUsersResponse{Success: true, Users: users}
+	if len(users) == query.Limit {
+		resp.NextAfter = users[len(users)-1].Username
+	}
+	return c.Status(fiber.StatusOK).JSON(resp)
+}
+
+// AccountUsage is what an account stores on the node
+type AccountUsage struct {
+	Messages    models.MessageUsage `json:"messages"`
+	Contacts    int                 `json:"contacts"`
+	Prekeys     int                 `json:"prekeys"`
+	RetiredKeys int                 `json:"retired_keys"`
+	Webhooks    int                 `json:"webhooks"`
+}
+
+// AdminGetUser returns an account with its storage usage
+func AdminGetUser(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	summary, err := models.GetUserSummary(ctx, c.Params("username"))
+	if errors.Is(err, models.ErrUserNotFound) {
+		return respondError(c, serviceError(fiber.StatusNotFound, "User not found"))
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving user: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to retrieve user"))
+	}
+
+	usage, err := accountUsage(ctx, summary)
+	if err != nil {
+		logging.Errorf(ctx, "Error measuring usage of %s: %v", summary.Username, err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to measure storage usage"))
+	}
+	return c.Status(fiber.StatusOK).JSON(AdminUserResponse{Success: true, User: *summary, Usage: *usage})
+}
+
+// accountUsage counts the messages, contacts, keys and webhooks stored for an account
+func accountUsage(ctx context.Context, summary *models.UserSummary) (*AccountUsage, error) {
+	user := &models.User{Username: summary.Username, PublicKey: summary.PublicKey}
+	_, hashes := ownerHashes(ctx, user)
+	messages, err := models.GetMessageUsage(ctx, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &AccountUsage{Messages: *messages, RetiredKeys: len(hashes) - 1}
+	contacts, err := contactStore.ListContacts(ctx, user.Username)
+	if err != nil {
+		return nil, err
+	}
+	usage.Contacts = len(contacts)
+	if usage.Prekeys, err = models.CountPrekeys(ctx, user.Username); err != nil {
+		return nil, err
+	}
+	hooks, err := models.ListWebhooks(ctx, user.Username)
+	if err != nil {
+		return nil, err
+	}
+	usage.Webhooks = len(hooks)
+	return usage, nil
+}
+
+// DisableUserRequest defines the structure for disabling an account
+type DisableUserRequest struct {
+	Reason string `json:"reason" validate:"max=500"` // Kept for operators, not shown to the user
+}
+
+// AdminDisableUser disables an account: its tokens are revoked and it can no longer log in
+// or recover. Stored data is kept and messages can still be delivered to it.
+func AdminDisableUser(c *fiber.Ctx) error {
+	var req DisableUserRequest
+	if len(c.Body()) > 0 {
+		if err := parseBody(c, &req); err != nil {
+			return respondError(c, err)
+		}
+	}
+	return setUserDisabled(c, true, req.Reason)
+}
+
+// AdminEnableUser re-enables a disabled account
+func AdminEnableUser(c *fiber.Ctx) error {
+	return setUserDisabled(c, false, "")
+}
+
+func setUserDisabled(c *fiber.Ctx, disabled bool, reason string) error {
+	username := c.Params("username")
+	err := models.SetUserDisabled(c.UserContext(), username, disabled, reason)
+	if errors.Is(err, models.ErrUserNotFound) {
+		return respondError(c, serviceError(fiber.StatusNotFound, "User not found"))
+	}
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error updating status of %s: %v", username, err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to update account status"))
+	}
+
+	if disabled {
+		middleware.NoteRevocation(username)
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"success": true,
+			"message": "Account disabled",
+		})
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+		"message": "Account re-enabled",
+	})
+}
+
+// errAccountDisabled is returned when a disabled account tries to log in or recover
+var errAccountDisabled = codedError(fiber.StatusForbidden, apierror.AccountDisabled, "This account has been disabled")
+
+// checkAccountEnabled fails with errAccountDisabled for accounts an operator disabled
+func checkAccountEnabled(ctx context.Context, username string) error {
+	disabled, err := models.UserDisabled(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error checking status of %s: %v", username, err)
+		return serviceError(fiber.StatusInternalServerError, "Database error")
+	}
+	if disabled {
+		return errAccountDisabled
+	}
+	return nil
+}
+
+// AdminCheckKeys verifies an account's key log: the current and retired public keys must be
+// valid Kyber512 keys owned by no other account, and their validity windows must not overlap
+func AdminCheckKeys(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	username := c.Params("username")
+	user, err := models.GetUserSummary(ctx, username)
+	if errors.Is(err, models.ErrUserNotFound) {
+		return respondError(c, serviceError(fiber.StatusNotFound, "User not found"))
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving user %s: %v", username, err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to check keys"))
+	}
+	history, err := models.GetKeyHistory(ctx, user.Username)
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving key history of %s: %v", user.Username, err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to check keys"))
+	}
+
+	problems := []string{}
+	keys := []string{user.PublicKey}
+	seen := map[string]bool{user.PublicKey: true}
+	if err := utils.ValidateKyber512PublicKey(user.PublicKey); err != nil {
+		problems = append(problems, fmt.Sprintf("current key: %v", err))
+	}
+	for i, record := range history {
+		name := fmt.Sprintf("retired key %d", i+1)
+		if err := utils.ValidateKyber512PublicKey(record.PublicKey); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+		if seen[record.PublicKey] {
+			problems = append(problems, name+": duplicates a newer key")
+		} else {
+			keys = append(keys, record.PublicKey)
+			seen[record.PublicKey] = true
+		}
+		if record.ValidUntil.Before(record.ValidFrom) {
+			problems = append(problems, name+": valid_until is before valid_from")
+		}
+		// History is newest first, so each window must end before the newer one began
+		if i > 0 && record.ValidUntil.After(history[i-1].ValidFrom) {
+			problems = append(problems, name+": validity overlaps the next key")
+		}
+	}
+	for _, key := range keys {
+		owner, err := models.GetUserByPublicKey(ctx, key)
+		if errors.Is(err, models.ErrUserNotFound) {
+			problems = append(problems, "a key of this account does not resolve to it")
+			continue
+		}
+		if err != nil {
+			logging.Errorf(ctx, "Error resolving key of %s: %v", user.Username, err)
+			return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to check keys"))
+		}
+		if owner.Username != user.Username {
+			problems = append(problems, fmt.Sprintf("a key of this account resolves to %s", owner.Username))
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(KeyCheckResponse{
+		Success:  true,
+		Username: user.Username,
+		Keys:     len(keys),
+		OK:       len(problems) == 0,
+		Problems: problems,
+	})
+}
+
+// AdminJob is a maintenance task operators can start through the admin API. The result
+// is reported in the job's status.
+type AdminJob func(ctx context.Context) (interface{}, error)
+
+// AdminJobStatus reports the current or last run of an admin job
+type AdminJobStatus struct {
+	Name       string      `json:"name"`
+	Running    bool        `json:"running"`
+	StartedAt  time.Time   `json:"started_at,omitempty"`
+	FinishedAt time.Time   `json:"finished_at,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+var (
+	adminJobsMu sync.Mutex
+	adminJobs   = make(map[string]AdminJob)
+	adminRuns   = make(map[string]*AdminJobStatus)
+)
+
+// RegisterAdminJob makes a job available under name; call it before the server starts
+func RegisterAdminJob(name string, job AdminJob) {
+	adminJobsMu.Lock()
+	defer adminJobsMu.Unlock()
+	adminJobs[name] = job
+	adminRuns[name] = &AdminJobStatus{Name: name}
+}
+
+// GetAdminJobs lists the jobs this node offers with the status of their last run, and
+// the capacitor that runs the scheduled singleton jobs
+func GetAdminJobs(c *fiber.Ctx) error {
+	adminJobsMu.Lock()
+	jobs := make([]AdminJobStatus, 0, len(adminRuns))
+	for _, status := range adminRuns {
+		jobs = append(jobs, *status)
+	}
+	adminJobsMu.Unlock()
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+	leader, err := LeaderName(c.UserContext())
+	if err != nil {
+		logging.Warnf(c.UserContext(), "Error looking up the cluster leader: %v", err)
+	}
+	return c.Status(fiber.StatusOK).JSON(AdminJobsResponse{Success: true, Jobs: jobs, Leader: leader})
+}
+
+// RunAdminJob starts a job in the background; poll GET /api/admin/jobs for the result
+func RunAdminJob(c *fiber.Ctx) error {
+	started, err := startAdminJob(logging.Detach(c.UserContext()), c.Params("name"))
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(AdminJobResponse{Success: true, Job: started})
+}
+
+var (
+	errUnknownAdminJob = serviceError(fiber.StatusNotFound, "Unknown job or not available on this node")
+	errAdminJobRunning = serviceError(fiber.StatusConflict, "Job is already running")
+)
+
+// adminJobRunning reports whether the named job is running
+func adminJobRunning(name string) bool {
+	adminJobsMu.Lock()
+	defer adminJobsMu.Unlock()
+	status, ok := adminRuns[name]
+	return ok && status.Running
+}
+
+// startAdminJob runs the named job in the background with ctx and returns its status
+func startAdminJob(ctx context.Context, name string) (AdminJobStatus, error) {
+	adminJobsMu.Lock()
+	job, ok := adminJobs[name]
+	if !ok {
+		adminJobsMu.Unlock()
+		return AdminJobStatus{}, errUnknownAdminJob
+	}
+	status := adminRuns[name]
+	if status.Running {
+		adminJobsMu.Unlock()
+		return AdminJobStatus{}, errAdminJobRunning
+	}
+	*status = AdminJobStatus{Name: name, Running: true, StartedAt: time.Now()}
+	started := *status
+	adminJobsMu.Unlock()
+
+	logging.Infof(ctx, "🔧 Admin job %s started", name)
+	go func() {
+		result, err := job(ctx)
+
+		adminJobsMu.Lock()
+		defer adminJobsMu.Unlock()
+		status.Running = false
+		status.FinishedAt = time.Now()
+		status.Result = result
+		if err != nil {
+			status.Error = err.Error()
+			logging.Errorf(ctx, "Admin job %s failed: %v", name, err)
+		} else {
+			logging.Infof(ctx, "✅ Admin job %s finished in %s", name, status.FinishedAt.Sub(status.StartedAt).Round(time.Millisecond))
+		}
+	}()
+
+	return started, nil
+}
+
+// ShardCountRequest defines the structure for changing the shard count at runtime
+type ShardCountRequest struct {
+	NumShards int `json:"num_shards" validate:"min=1,max=256"`
+}
+
+// reshardableStore returns the file store whose shard count can change at runtime, or nil
+func reshardableStore() *storage.FileMessageStore {
+	switch store := messageStore.(type) {
+	case *storage.FileMessageStore:
+		return store
+	case *storage.TieredMessageStore:
+		return store.Hot()
+	default:
+		return nil
+	}
+}
+
+// AdminGetShards reports the shard count and, while rebalancing after a change, the previous one
+func AdminGetShards(c *fiber.Ctx) error {
+	store := reshardableStore()
+	if store == nil {
+		return respondError(c, serviceError(fiber.StatusNotImplemented, "Resharding requires the file storage backend"))
+	}
+	return c.Status(fiber.StatusOK).JSON(ShardsResponse{Success: true, Shards: store.ShardStatus()})
+}
+
+// AdminSetShards changes the shard count and starts the rebalance job moving the message
+// folders. Messages are read from the folders of both counts until the rebalance finished
+// without errors; rerun the rebalance job after errors. The change is not persisted, so
+// set NUM_SHARDS to the new count before the node is restarted.
+func AdminSetShards(c *fiber.Ctx) error {
+	store := reshardableStore()
+	if store == nil {
+		return respondError(c, serviceError(fiber.StatusNotImplemented, "Resharding requires the file storage backend"))
+	}
+	if nodeConfig != nil && nodeConfig.HTTPPrefork {
+		// Each prefork child has its own view of the shard count
+		return respondError(c, serviceError(fiber.StatusNotImplemented, "Resharding at runtime is not available with HTTP_PREFORK"))
+	}
+
+	var req ShardCountRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+	if adminJobRunning("rebalance") {
+		return respondError(c, serviceError(fiber.StatusConflict, "A rebalance is already running"))
+	}
+
+	previous := store.ShardStatus().NumShards
+	if err := store.SetNumShards(req.NumShards); err != nil {
+		if errors.Is(err, storage.ErrReshardInProgress) {
+			return respondError(c, serviceError(fiber.StatusConflict, "The previous shard count change is still being rebalanced, run the rebalance job first"))
+		}
+		logging.Errorf(c.UserContext(), "Error changing the shard count: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to change the shard count"))
+	}
+	if nodeConfig != nil {
+		nodeConfig.SetNumShards(req.NumShards)
+	}
+	logging.Infof(c.UserContext(), "🔀 Shard count changed from %d to %d", previous, req.NumShards)
+
+	job, err := startAdminJob(logging.Detach(c.UserContext()), "rebalance")
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(ShardsResponse{Success: true, Shards: store.ShardStatus(), Job: &job})
+}
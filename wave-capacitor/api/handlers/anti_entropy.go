@@ -0,0 +1,415 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+	"wave_capacitor/api/validate"
+	"wave_capacitor/logging"
+	"wave_capacitor/models"
+	"wave_capacitor/storage"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Anti-entropy compares each mailbox hosted here with its replicas through a two-level
+// Merkle tree: every message is hashed, by the tag of its sealed replica (see
+// replica_seal.go), the messages are split into buckets by the hash of their ID, and the
+// root hashes the buckets. The tags of the messages here are computed from the hashes the
+// index keeps, so only messages indexed without one are read. Replicas whose root
+// matches are in sync; otherwise only the buckets that differ are listed, message by
+// message, and repaired: messages missing or different on the replica are pushed to it
+// and those deleted here are deleted from it. Messages the index still lists but that
+// were lost here, or can't be read any more, are fetched back from the replicas instead.
+//
+// Unlike reconciliation, which lists every message of every replica, a pass over
+// replicas in sync costs one request per replica, so it runs often enough to repair
+// replicas shortly after a partition heals.
+
+// replicaDigestBuckets is how many buckets the messages of a mailbox are split into
+const replicaDigestBuckets = 16
+
+// ReplicaDigestQuery names the mailbox, and for the hashes of its messages the bucket,
+// of a replica digest
+type ReplicaDigestQuery struct {
+	OwnerKey string `query:"owner_key" validate:"required"`
+	Bucket   string `query:"bucket" validate:"max=1"`
+}
+
+// mailboxDigest holds the hash of every message of a mailbox, by bucket
+type mailboxDigest [replicaDigestBuckets]map[string]string
+
+// digestBucket returns the bucket of a message ID
+func digestBucket(messageID string) int {
+	sum := sha256.Sum256([]byte(messageID))
+	return int(sum[0]) % replicaDigestBuckets
+}
+
+// add records the hash of a message
+func (d *mailboxDigest) add(messageID, hash string) {
+	bucket := digestBucket(messageID)
+	if d[bucket] == nil {
+		d[bucket] = make(map[string]string)
+	}
+	d[bucket][messageID] = hash
+}
+
+// bucketHash hashes the message IDs and hashes of a bucket in ID order
+func (d *mailboxDigest) bucketHash(bucket int) string {
+	ids := make([]string, 0, len(d[bucket]))
+	for id := range d[bucket] {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	h := sha256.New()
+	for _, id := range ids {
+		h.Write([]byte(id + " " + d[bucket][id] + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// bucketHashes returns the hash of every bucket
+func (d *mailboxDigest) bucketHashes() []string {
+	hashes := make([]string, replicaDigestBuckets)
+	for i := range hashes {
+		hashes[i] = d.bucketHash(i)
+	}
+	return hashes
+}
+
+// root hashes the bucket hashes
+func (d *mailboxDigest) root() string {
+	h := sha256.New()
+	for _, hash := range d.bucketHashes() {
+		h.Write([]byte(hash + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// digestMailbox hashes the messages of a mailbox in store with hashOf, only those of
+// bucket unless it is negative. The IDs of messages that can't be read are returned apart.
+func digestMailbox(store storage.MessageStore, ownerKey string, bucket int, hashOf func(messageID string, data []byte) (string, error)) (*mailboxDigest, []string, error) {
+	ids, err := store.List(ownerKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	var digest mailboxDigest
+	var unreadable []string
+	for _, id := range ids {
+		if bucket >= 0 && digestBucket(id) != bucket {
+			continue
+		}
+		data, err := store.Read(ownerKey, id)
+		if errors.Is(err, storage.ErrMessageNotFound) {
+			continue // Deleted since it was listed
+		}
+		if err != nil {
+			unreadable = append(unreadable, id)
+			continue
+		}
+		hash, err := hashOf(id, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		digest.add(id, hash)
+	}
+	return &digest, unreadable, nil
+}
+
+// localDigest digests a mailbox stored here by the tags of its sealed replicas, computed
+// from the hashes of the message index; messages indexed without a hash are read to hash
+// them. The IDs of those that can't be read are returned apart.
+func localDigest(ctx context.Context, ownerKey string) (*mailboxDigest, []string, error) {
+	ids, err := messageStore.List(ownerKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes, err := models.ListMessageHashes(ctx, RecipientHash(ownerKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	var digest mailboxDigest
+	var unreadable []string
+	for _, id := range ids {
+		hash := hashes[id]
+		if hash == "" {
+			data, err := messageStore.Read(ownerKey, id)
+			if errors.Is(err, storage.ErrMessageNotFound) {
+				continue // Deleted since it was listed
+			}
+			if err != nil {
+				unreadable = append(unreadable, id)
+				continue
+			}
+			hash = MessageHash(data)
+		}
+		tag, err := replicaDigestHash(ownerKey, id, hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		digest.add(id, tag)
+	}
+	return &digest, unreadable, nil
+}
+
+// sealedReplicaDigest digests the replicas kept here by the hashes they were sealed with
+func sealedReplicaDigest(_ string, data []byte) (string, error) {
+	return sealedReplicaHash(data), nil
+}
+
+// localDigestHasher digests the messages of a mailbox stored here by the tags their
+// sealed replicas carry
+func localDigestHasher(ownerKey string) func(messageID string, data []byte) (string, error) {
+	return func(messageID string, data []byte) (string, error) {
+		return replicaDigestHash(ownerKey, messageID, MessageHash(data))
+	}
+}
+
+// GetReplicaDigest returns the root and bucket hashes of the replicas of a mailbox, or
+// with bucket the hash of each of its messages in that bucket
+func GetReplicaDigest(c *fiber.Ctx) error {
+	var query ReplicaDigestQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+	bucket := -1
+	if query.Bucket != "" {
+		parsed, err := strconv.ParseUint(query.Bucket, 16, 8)
+		if err != nil || parsed >= replicaDigestBuckets {
+			return respondError(c, fieldError("bucket", validate.CodeFormat, "must be a hex digit"))
+		}
+		bucket = int(parsed)
+	}
+	if err := authorizeReplica(c, query.OwnerKey, ""); err != nil {
+		return respondError(c, err)
+	}
+
+	ctx := c.UserContext()
+	// Unreadable replicas are left out, so the primary pushes them again
+	digest, _, err := digestMailbox(replicaStore, query.OwnerKey, bucket, sealedReplicaDigest)
+	if err != nil {
+		logging.Errorf(ctx, "Error computing replica digest: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to compute replica digest"))
+	}
+	resp := ReplicaDigestResponse{Success: true}
+	if bucket >= 0 {
+		resp.Messages = digest[bucket]
+		if resp.Messages == nil {
+			resp.Messages = map[string]string{}
+		}
+	} else {
+		resp.Root = digest.root()
+		resp.Buckets = digest.bucketHashes()
+	}
+	return c.Status(fiber.StatusOK).JSON(resp)
+}
+
+// ReplicaAntiEntropyReport summarizes an anti-entropy pass over the mailboxes hosted here
+type ReplicaAntiEntropyReport struct {
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	Mailboxes int           `json:"mailboxes"`
+	Replicas  int           `json:"replicas"` // replicas compared
+	InSync    int           `json:"in_sync"`  // replicas whose root matched
+	Buckets   int           `json:"buckets"`  // buckets that differed and were repaired
+	Restored  int           `json:"restored"` // messages lost or unreadable here, fetched from a replica
+	Pushed    int           `json:"pushed"`   // messages missing on a replica
+	Repaired  int           `json:"repaired"` // messages that differed on a replica
+	Deleted   int           `json:"deleted"`  // replicas of messages deleted here
+	Errors    int           `json:"errors"`
+}
+
+// RunReplicaAntiEntropy compares every mailbox hosted here with its replicas and repairs
+// the replicas that diverged
+func RunReplicaAntiEntropy(ctx context.Context) (ReplicaAntiEntropyReport, error) {
+	report := ReplicaAntiEntropyReport{StartedAt: time.Now()}
+	if replicaCount <= 0 {
+		return report, errors.New("mailbox replication is off")
+	}
+	users, err := models.ListUsers(ctx)
+	if err != nil {
+		return report, err
+	}
+	for i := range users {
+		for _, key := range ownerKeys(ctx, &users[i]) {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			antiEntropyMailbox(ctx, key, &report)
+			report.Mailboxes++
+		}
+	}
+	report.Duration = time.Since(report.StartedAt)
+	return report, nil
+}
+
+// antiEntropyMailbox compares a mailbox with each of its replicas, repairing the buckets
+// that differ
+func antiEntropyMailbox(ctx context.Context, ownerKey string, report *ReplicaAntiEntropyReport) {
+	hashOf := localDigestHasher(ownerKey)
+	local, unreadable, err := localDigest(ctx, ownerKey)
+	if err != nil {
+		logging.Errorf(ctx, "Error computing mailbox digest: %v", err)
+		report.Errors++
+		return
+	}
+	// Messages that can't be read here are never deleted from the replicas
+	kept := make(map[string]bool, len(unreadable))
+	for _, id := range unreadable {
+		data, err := readReplica(ctx, ownerKey, id, storage.ErrMessageNotFound)
+		if err == nil {
+			var hash string
+			if hash, err = hashOf(id, data); err == nil {
+				local.add(id, hash)
+				report.Restored++
+				continue
+			}
+		}
+		kept[id] = true
+		report.Errors++
+	}
+
+	root := local.root()
+	hashes := local.bucketHashes()
+	for _, peer := range replicaTargets(ownerKey) {
+		var remote ReplicaDigestResponse
+		if err := replicaRequest(ctx, http.MethodGet, peer, "/digest?owner_key="+url.QueryEscape(ownerKey), nil, &remote); err != nil {
+			logging.Warnf(ctx, "Error getting replica digest from %s: %v", peer, err)
+			report.Errors++
+			continue
+		}
+		report.Replicas++
+		if remote.Root == root {
+			report.InSync++
+			continue
+		}
+		for bucket, hash := range hashes {
+			if bucket < len(remote.Buckets) && remote.Buckets[bucket] == hash {
+				continue
+			}
+			report.Buckets++
+			repairBucket(ctx, peer, ownerKey, bucket, local, kept, hashOf, report)
+		}
+	}
+}
+
+// repairBucket brings a bucket of a replica in line with the mailbox here
+func repairBucket(ctx context.Context, peer, ownerKey string, bucket int, local *mailboxDigest, kept map[string]bool, hashOf func(string, []byte) (string, error), report *ReplicaAntiEntropyReport) {
+	var remote ReplicaDigestResponse
+	query := "/digest?owner_key=" + url.QueryEscape(ownerKey) + "&bucket=" + strconv.FormatInt(int64(bucket), 16)
+	if err := replicaRequest(ctx, http.MethodGet, peer, query, nil, &remote); err != nil {
+		logging.Warnf(ctx, "Error getting replica digest from %s: %v", peer, err)
+		report.Errors++
+		return
+	}
+
+	var extra []string
+	for id := range remote.Messages {
+		if _, ok := local[bucket][id]; !ok && !kept[id] {
+			extra = append(extra, id)
+		}
+	}
+	if len(extra) > 0 {
+		// Messages the index still lists were lost here rather than deleted
+		indexed, err := models.IndexedMessageIDs(ctx, RecipientHash(ownerKey), extra)
+		if err != nil {
+			logging.Errorf(ctx, "Error looking up message index for anti-entropy: %v", err)
+			report.Errors++
+			return
+		}
+		for _, id := range extra {
+			if indexed[id] {
+				data, err := readReplica(ctx, ownerKey, id, storage.ErrMessageNotFound)
+				if err == nil {
+					var hash string
+					if hash, err = hashOf(id, data); err == nil {
+						local.add(id, hash)
+						report.Restored++
+						continue
+					}
+				}
+				report.Errors++
+				continue
+			}
+			if err := replicaRequest(ctx, http.MethodPost, peer, "/delete", ReplicaDeleteRequest{OwnerKey: ownerKey, MessageID: id}, nil); err != nil && !errors.Is(err, storage.ErrMessageNotFound) {
+				logging.Warnf(ctx, "Error deleting replica of message %s on %s: %v", id, peer, err)
+				report.Errors++
+				continue
+			}
+			report.Deleted++
+		}
+	}
+
+	for id, hash := range local[bucket] {
+		remoteHash, onReplica := remote.Messages[id]
+		if remoteHash == hash {
+			continue
+		}
+		data, err := messageStore.Read(ownerKey, id)
+		if err != nil {
+			if !errors.Is(err, storage.ErrMessageNotFound) {
+				report.Errors++
+			}
+			continue
+		}
+		if err := pushReplica(ctx, peer, ownerKey, id, data); err != nil {
+			logging.Warnf(ctx, "Error pushing replica of message %s to %s: %v", id, peer, err)
+			report.Errors++
+			continue
+		}
+		if onReplica {
+			report.Repaired++
+		} else {
+			report.Pushed++
+		}
+	}
+}
+
+// StartReplicaAntiEntropy runs anti-entropy every interval while this capacitor leads
+// the cluster (see leader.go), until the returned function is called, which cancels a
+// pass in progress
+func StartReplicaAntiEntropy(interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if !isLeader() {
+				continue
+			}
+
+			report, err := RunReplicaAntiEntropy(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				logging.Errorf(ctx, "Error running replica anti-entropy: %v", err)
+				continue
+			}
+			if report.InSync == report.Replicas && report.Restored == 0 && report.Errors == 0 {
+				continue // Nothing to report on every pass
+			}
+			logging.Infof(ctx, "🌳 Anti-entropy over %d mailboxes: %d of %d replicas in sync, %d buckets repaired, %d restored, %d pushed, %d repaired, %d deleted, %d errors in %s",
+				report.Mailboxes, report.InSync, report.Replicas, report.Buckets, report.Restored, report.Pushed, report.Repaired, report.Deleted, report.Errors, report.Duration.Round(time.Millisecond))
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
@@ -1,140 +1,138 @@
 package handlers
 
 import (
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/logging"
 	"wave_capacitor/middleware"
 	"wave_capacitor/models"
+	"wave_capacitor/storage"
 	"wave_capacitor/utils"
+	"wave_capacitor/webhooks"
 
 	"github.com/gofiber/fiber/v2"
 )
 
 // RegisterRequest defines the structure for registration requests
 type RegisterRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username string `json:"username" validate:"required,username"`
+	Password string `json:"password" validate:"required,max=1024"`
 }
 
 // LoginRequest defines the structure for login requests
 type LoginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username string `json:"username" validate:"required"`
+	Password string `json:"password" validate:"required"`
 }
 
 // RegisterUser handles user registration, generating a Kyber512 keypair
 func RegisterUser(c *fiber.Ctx) error {
 	// Parse request body
 	var req RegisterRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"success": false,
-			"error":   "Invalid request format",
-		})
+	if err := decodeBody(c, &req); err != nil {
+		return respondError(c, err)
 	}
 
-	// Validate inputs
-	if req.Username == "" || req.Password == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"success": false,
-			"error":   "Username and password are required",
-		})
+	resp, err := RegisterAccount(c.UserContext(), req)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(resp)
+}
+
+// RegisterAccount creates an account with a fresh Kyber512 key pair and returns its first token
+func RegisterAccount(ctx context.Context, req RegisterRequest) (*RegisterResponse, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
 	}
 
 	// Check if user already exists
-	exists, err := models.UserExists(req.Username)
+	exists, err := models.UserExists(ctx, req.Username)
 	if err != nil {
-		log.Printf("Error checking if user exists: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Database error",
-		})
+		logging.Errorf(ctx, "Error checking if user exists: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Database error")
 	}
 	if exists {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"success": false,
-			"error":   "Username already exists",
-		})
+		return nil, codedError(fiber.StatusBadRequest, apierror.UsernameTaken, "Username already exists")
 	}
 
 	// Generate Kyber512 key pair
 	pubKey, privKey, err := utils.GenerateKyber512Keys()
 	if err != nil {
-		log.Printf("Error generating key pair: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to generate cryptographic keys",
-		})
+		logging.Errorf(ctx, "Error generating key pair: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to generate cryptographic keys")
 	}
+	// Wipe the raw private key once it has been wrapped
+	defer utils.Zeroize(privKey)
 
 	// Encrypt the private key
 	// In a real implementation, we would use the user's password here
 	encryptedPrivKey, err := utils.EncryptPrivateKey(privKey)
 	if err != nil {
-		log.Printf("Error encrypting private key: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to secure private key",
-		})
+		logging.Errorf(ctx, "Error encrypting private key: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to secure private key")
 	}
 
 	// Store user in database
-	err = models.CreateUser(req.Username, pubKey, []byte(encryptedPrivKey))
+	err = models.CreateUser(ctx, req.Username, pubKey, []byte(encryptedPrivKey))
 	if err != nil {
-		log.Printf("Error creating user: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to create user account",
-		})
+		logging.Errorf(ctx, "Error creating user: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to create user account")
 	}
+	webhookDispatcher.Emit(ctx, req.Username, webhooks.EventAccountCreated, fiber.Map{
+		"public_key": base64.StdEncoding.EncodeToString(pubKey),
+	})
+	publishRouteLater(ctx, base64.StdEncoding.EncodeToString(pubKey))
 
 	// Generate JWT token
 	token, err := middleware.GenerateToken(req.Username)
 	if err != nil {
-		log.Printf("Error generating token: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to generate authentication token",
-		})
+		logging.Errorf(ctx, "Error generating token: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to generate authentication token")
 	}
 
 	// Return success with token and public key
-	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
-		"success":    true,
-		"message":    "User registered successfully",
-		"token":      token,
-		"public_key": base64.StdEncoding.EncodeToString(pubKey),
-	})
+	return &RegisterResponse{
+		Success:   true,
+		Message:   "User registered successfully",
+		Token:     token,
+		PublicKey: base64.StdEncoding.EncodeToString(pubKey),
+	}, nil
 }
 
 // LoginUser authenticates a user and returns their JWT token
 func LoginUser(c *fiber.Ctx) error {
 	// Parse request body
 	var req LoginRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"success": false,
-			"error":   "Invalid request format",
-		})
+	if err := decodeBody(c, &req); err != nil {
+		return respondError(c, err)
 	}
 
-	// Validate inputs
-	if req.Username == "" || req.Password == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"success": false,
-			"error":   "Username and password are required",
-		})
+	resp, err := Authenticate(c.UserContext(), req)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(resp)
+}
+
+// Authenticate checks a user's credentials and issues a token
+func Authenticate(ctx context.Context, req LoginRequest) (*LoginResponse, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
 	}
 
 	// Check if user exists
-	user, err := models.GetUser(req.Username)
+	user, err := models.GetUser(ctx, req.Username)
 	if err != nil {
-		log.Printf("Login failed - user not found: %s", req.Username)
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"success": false,
-			"error":   "Invalid username or password",
-		})
+		logging.Warnf(ctx, "Login failed - user not found: %s", req.Username)
+		middleware.RecordAuthFailure()
+		return nil, codedError(fiber.StatusUnauthorized, apierror.InvalidCredentials, "Invalid username or password")
+	}
+	if err := checkAccountEnabled(ctx, user.Username); err != nil {
+		return nil, err
 	}
 
 	// In a real implementation, we would verify the password here
@@ -142,23 +140,20 @@ func LoginUser(c *fiber.Ctx) error {
 	// Generate JWT token
 	token, err := middleware.GenerateToken(req.Username)
 	if err != nil {
-		log.Printf("Error generating token: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to generate authentication token",
-		})
+		logging.Errorf(ctx, "Error generating token: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to generate authentication token")
 	}
 
 	// Return success with token
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"success": true,
-		"message": fmt.Sprintf("Welcome back, %s", req.Username),
-		"token":   token,
-		"user": fiber.Map{
-			"username":   user.Username,
-			"public_key": user.PublicKey,
+	return &LoginResponse{
+		Success: true,
+		Message: fmt.Sprintf("Welcome back, %s", req.Username),
+		Token:   token,
+		User: UserInfo{
+			Username:  user.Username,
+			PublicKey: user.PublicKey,
 		},
-	})
+	}, nil
 }
 
 // LogoutUser handles user logout (mostly a placeholder as JWT is stateless)
@@ -169,22 +164,74 @@ func LogoutUser(c *fiber.Ctx) error {
 	})
 }
 
-// DeleteAccount removes a user account and all associated data
+// DeleteAccount removes a user account and all associated data: database records,
+// contacts, stored messages under current and retired keys, and outstanding tokens
 func DeleteAccount(c *fiber.Ctx) error {
 	// Get username from JWT
 	username := middleware.ExtractUsername(c)
 
-	// Delete user from database
-	err := models.DeleteUser(username)
+	// Collect the keys the user's messages are stored under before the records go away
+	user, err := models.GetUser(c.UserContext(), username)
 	if err != nil {
-		log.Printf("Error deleting user %s: %v", username, err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to delete account",
-		})
+		logging.Errorf(c.UserContext(), "Error retrieving user %s for deletion: %v", username, err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to delete account"))
+	}
+	byHash, hashes := ownerHashes(c.UserContext(), user)
+	var storedBackups []models.StoredBackup
+	if storedBackupStore != nil {
+		if storedBackups, err = models.ListStoredBackups(c.UserContext(), username); err != nil {
+			logging.Errorf(c.UserContext(), "Error listing stored backups of %s for deletion: %v", username, err)
+			return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to delete account"))
+		}
+	}
+
+	// Delete the account and its records in one transaction; this also revokes tokens
+	summary, err := models.DeleteUserCascade(c.UserContext(), username, hashes)
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error deleting user %s: %v", username, err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to delete account"))
+	}
+	middleware.NoteRevocation(username)
+
+	// The account is gone at this point, so storage cleanup failures are logged, not returned
+	if err := contactStore.DeleteContacts(c.UserContext(), username); err != nil {
+		logging.Errorf(c.UserContext(), "Error deleting contacts of %s: %v", username, err)
+	}
+
+	deletedMessages := 0
+	for _, key := range byHash {
+		ids, err := storeList(c.UserContext(), key)
+		if err != nil {
+			logging.Errorf(c.UserContext(), "Error listing messages of %s: %v", username, err)
+			continue
+		}
+		for _, id := range ids {
+			if err := storeDelete(c.UserContext(), key, id); err != nil && !errors.Is(err, storage.ErrMessageNotFound) {
+				logging.Errorf(c.UserContext(), "Error deleting message %s of %s: %v", id, username, err)
+				continue
+			}
+			deletedMessages++
+		}
+
+		// Remove the folders themselves, including variants left by a shard count change
+		if remover, ok := messageStore.(interface{ RemoveOwnerFolders(string) error }); ok {
+			if err := remover.RemoveOwnerFolders(key); err != nil {
+				logging.Errorf(c.UserContext(), "Error removing message folders of %s: %v", username, err)
+			}
+		}
 	}
 
-	// In a real implementation, we would also delete messages, contacts, etc.
+	for _, backup := range storedBackups {
+		deleteStoredBackupBlob(c, backup.ID)
+	}
+
+	// Nothing user-specific is published to the DHT yet; only the capacitor service is registered
+
+	// The user's own webhooks went with the account, so only the node-wide endpoint hears of it
+	webhookDispatcher.Emit(c.UserContext(), username, webhooks.EventAccountDeleted, nil)
+
+	logging.Infof(c.UserContext(), "🗑️ Account '%s' deleted: %d messages, %d contacts, %d prekeys, %d sessions, %d retired keys",
+		username, deletedMessages, summary.Contacts, summary.Prekeys, summary.Sessions, summary.KeyHistory)
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"success": true,
@@ -1,14 +1,18 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"os"
-	"path/filepath"
+	"io"
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/logging"
 	"wave_capacitor/middleware"
 	"wave_capacitor/models"
+	"wave_capacitor/storage"
+	"wave_capacitor/utils"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -18,178 +22,619 @@ type BackupData struct {
 	Username            string                 `json:"username"`
 	PublicKey           string                 `json:"public_key"`
 	EncryptedPrivateKey interface{}            `json:"encrypted_private_key"`
-	Contacts            map[string]interface{} `json:"contacts"`
+	Contacts            ContactsData           `json:"contacts"`
 	Messages            []interface{}          `json:"messages"`
+	Manifest            *BackupManifest        `json:"manifest,omitempty"`
 }
 
+// Types of the records of a streamed backup
+const (
+	BackupRecordAccount        = "account"
+	BackupRecordMessage        = "message"
+	BackupRecordMessageDeleted = "message_deleted"
+	BackupRecordContacts       = "contacts"
+	BackupRecordEnd            = "end"
+)
+
+// BackupRecord is one line of a streamed backup: an "account" record with the keys and
+// contacts, a "message" record per message and an "end" record with the message count and
+// the manifest, whose entries hash each line. A stream without the end record was cut off.
+//
+// An incremental backup (since > 0) holds the changes after the backup with that ID
+// instead, oldest first: its account record carries the keys but no contacts, then come
+// "message" records for added messages, "message_deleted" records for deleted ones and,
+// if the contacts changed, one "contacts" record with all of them.
+type BackupRecord struct {
+	Type                string       `json:"type" doc:"account, message, message_deleted, contacts or end"`
+	Username            string       `json:"username,omitempty"`
+	PublicKey           string       `json:"public_key,omitempty"`
+	EncryptedPrivateKey interface{}  `json:"encrypted_private_key,omitempty"`
+	BackupID            int64        `json:"backup_id,omitempty" doc:"on the account record; pass as ?since= for an incremental backup of the changes after this one"`
+	Since               int64        `json:"since,omitempty" doc:"on the account record of an incremental backup, the backup ID it follows"`
+	Contacts            ContactsData `json:"contacts,omitempty"`
+	Message             *Message     `json:"message,omitempty"`
+	MessageID           string       `json:"message_id,omitempty" doc:"on message_deleted records"`
+	Messages            *int            `json:"messages,omitempty" doc:"number of message records, on the end record"`
+	Manifest            *BackupManifest `json:"manifest,omitempty" doc:"on the end record"`
+}
+
+// BackupStreamQuery defines the query parameters of GET /backup_account/stream
+type BackupStreamQuery struct {
+	Since int64 `query:"since" validate:"min=0"`
+}
+
+// changeBatchSize is how many changes an incremental backup reads at a time
+const changeBatchSize = 500
+
+// BackupPageQuery defines the query parameters of GET /backup_account/page
+type BackupPageQuery struct {
+	Limit  int    `query:"limit" validate:"min=1,max=200"` // max is maxMessagePageSize
+	Before string `query:"before"`
+}
+
+// backupPageSize is the page size of GET /backup_account/page without ?limit=
+const backupPageSize = 100
+
 // RecoverRequest defines the structure for account recovery requests
 type RecoverRequest struct {
-	Username            string                 `json:"username"`
-	PublicKey           string                 `json:"public_key"`
-	EncryptedPrivateKey interface{}            `json:"encrypted_private_key"`
-	Contacts            map[string]interface{} `json:"contacts"`
+	Username            string                 `json:"username" validate:"required"`
+	PublicKey           string                 `json:"public_key" validate:"required"`
+	EncryptedPrivateKey interface{}            `json:"encrypted_private_key" validate:"required"`
+	Contacts            ContactsData           `json:"contacts"`
 	Messages            []interface{}          `json:"messages"`
+	Manifest            *BackupManifest        `json:"manifest,omitempty"` // checked by backup_account/verify, not on restore
+
+	// Passphrase-encrypted backup (alternative to the plain fields above)
+	EncryptedBackup *utils.EncryptedBackup `json:"encrypted_backup,omitempty"`
+	Passphrase      string                 `json:"passphrase,omitempty"`
+
+	// A dry run only reports the restore plan; confirm restores only if the plan still
+	// has the plan_id of the dry run
+	DryRun  bool   `json:"dry_run,omitempty"`
+	Confirm string `json:"confirm,omitempty"`
+
+	// Restoring into an existing account without its token, or restoring keys the account
+	// never had, needs the answer to a challenge from POST /recover_account/challenge
+	ChallengeID string `json:"challenge_id,omitempty"`
+	Proof       string `json:"proof,omitempty" doc:"base64 HMAC-SHA256 of challenge_id under the secret encapsulated in the challenge's ciphertext"`
+
+	// Scopes limits the restore to keys, contacts and/or messages, and messages to those
+	// timestamped from MessagesSince up to MessagesUntil; the rest of the backup is ignored
+	Scopes        []string   `json:"scopes,omitempty" validate:"max=3" doc:"keys, contacts or messages; empty restores all"`
+	MessagesSince *time.Time `json:"messages_since,omitempty"`
+	MessagesUntil *time.Time `json:"messages_until,omitempty" doc:"exclusive"`
+}
+
+// BackupOptions defines the optional body of a POST backup request
+type BackupOptions struct {
+	Passphrase string `json:"passphrase" validate:"max=1024"`
 }
 
 // BackupAccount handles creating a complete backup of a user's account data
 func BackupAccount(c *fiber.Ctx) error {
+	// A POST body may request a passphrase-encrypted archive
+	var opts BackupOptions
+	if c.Method() == fiber.MethodPost && len(c.Body()) > 0 {
+		if err := parseBody(c, &opts); err != nil {
+			return respondError(c, err)
+		}
+	}
+
 	// Get username from JWT
 	username := middleware.ExtractUsername(c)
 
+	backup, err := CreateBackup(c.UserContext(), username, opts.Passphrase)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(backup)
+}
+
+// CreateBackup collects the user's keys, contacts and messages. The result is a *BackupData,
+// or a *utils.EncryptedBackup when a passphrase is given.
+func CreateBackup(ctx context.Context, username, passphrase string) (interface{}, error) {
 	// Get user data from database
-	user, err := models.GetUser(username)
+	user, err := models.GetUser(ctx, username)
 	if err != nil {
-		log.Printf("Error retrieving user for backup: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to retrieve user information",
-		})
+		logging.Errorf(ctx, "Error retrieving user for backup: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to retrieve user information")
 	}
 
 	// Load contacts
-	contacts := make(map[string]interface{})
-	contactsFile := filepath.Join("./data/contacts", username+".json")
-	if _, err := os.Stat(contactsFile); err == nil {
-		data, err := ioutil.ReadFile(contactsFile)
-		if err != nil {
-			log.Printf("Error reading contacts file: %v", err)
-		} else {
-			json.Unmarshal(data, &contacts)
-		}
+	contacts, err := loadContacts(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error reading contacts file: %v", err)
+		contacts = make(ContactsData)
 	}
 
 	// Load messages
 	messages := []interface{}{}
-	messageFolder := GetMessageFolder(user.PublicKey)
-	if _, err := os.Stat(messageFolder); err == nil {
-		files, err := ioutil.ReadDir(messageFolder)
+	loaded, err := loadMessages(ctx, user)
+	if err != nil {
+		logging.Errorf(ctx, "Error reading messages folder: %v", err)
+	} else {
+		for _, msg := range loaded {
+			messages = append(messages, msg)
+		}
+	}
+
+	// Create backup data
+	backupData := &BackupData{
+		Username:            username,
+		PublicKey:           user.PublicKey,
+		EncryptedPrivateKey: user.EncryptedPrivKey,
+		Contacts:            contacts,
+		Messages:            messages,
+	}
+	if backupData.Manifest, err = newBackupManifest(backupData); err != nil {
+		logging.Errorf(ctx, "Error creating backup manifest: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to create backup")
+	}
+
+	if passphrase == "" {
+		return backupData, nil
+	}
+
+	// Wrap the backup in a passphrase-encrypted archive
+	plaintext, err := json.Marshal(backupData)
+	if err != nil {
+		logging.Errorf(ctx, "Error marshaling backup: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to create backup")
+	}
+
+	encrypted, err := utils.EncryptBackup(plaintext, passphrase)
+	if err != nil {
+		logging.Errorf(ctx, "Error encrypting backup: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to encrypt backup")
+	}
+	return encrypted, nil
+}
+
+// StreamBackupAccount streams the user's backup as NDJSON (see BackupRecord) while it is
+// read from storage. Messages are read as the client consumes them, so accounts with any
+// amount of history are exported in constant memory.
+func StreamBackupAccount(c *fiber.Ctx) error {
+	var query BackupStreamQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+
+	ctx := c.UserContext()
+	write, err := OpenBackupStream(ctx, middleware.ExtractUsername(c), query.Since)
+	if err != nil {
+		return respondError(c, err)
+	}
+
+	// The pipe blocks the writer until the connection takes more; an error aborts the
+	// stream, which the client detects from the missing end record
+	reader, writer := io.Pipe()
+	go func() {
+		err := write(writer)
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			logging.Errorf(ctx, "Error streaming backup: %v", err)
+		}
+		writer.CloseWithError(err)
+	}()
+
+	c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	return c.SendStream(reader)
+}
+
+// OpenBackupStream looks up the user and returns a function writing their backup to w as
+// NDJSON, one message at a time. A non-zero since writes an incremental backup of the
+// changes after the backup with that ID.
+func OpenBackupStream(ctx context.Context, username string, since int64) (func(w io.Writer) error, error) {
+	user, err := models.GetUser(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving user for backup: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to retrieve user information")
+	}
+
+	// Read before the messages, so changes made while they are exported fall into the
+	// next incremental backup rather than none
+	backupID, prunedThrough, err := models.ChangeSequence(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error reading change sequence for backup: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to retrieve user information")
+	}
+	if since > 0 {
+		switch {
+		case since > backupID:
+			return nil, serviceError(fiber.StatusBadRequest, "Unknown backup ID")
+		case since < prunedThrough:
+			return nil, serviceError(fiber.StatusGone, "The changes since this backup are no longer tracked, take a full backup")
+		}
+		return func(w io.Writer) error {
+			return writeIncrementalBackup(ctx, w, user, since, backupID)
+		}, nil
+	}
+
+	contacts, err := loadContacts(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error reading contacts file: %v", err)
+		contacts = make(ContactsData)
+	}
+
+	return func(w io.Writer) error {
+		stream := newBackupStreamWriter(w, username)
+		err := stream.write(BackupRecord{
+			Type:                BackupRecordAccount,
+			Username:            username,
+			PublicKey:           user.PublicKey,
+			EncryptedPrivateKey: user.EncryptedPrivKey,
+			BackupID:            backupID,
+			Contacts:            contacts,
+		})
 		if err != nil {
-			log.Printf("Error reading messages folder: %v", err)
-		} else {
-			for _, file := range files {
-				if filepath.Ext(file.Name()) != ".json" {
+			return err
+		}
+
+		err = eachMessage(ctx, user, func(message Message) error {
+			return stream.write(BackupRecord{Type: BackupRecordMessage, Message: &message})
+		})
+		if err != nil {
+			return err
+		}
+		return stream.end()
+	}, nil
+}
+
+// writeIncrementalBackup writes the changes after since up to backupID, reading each
+// added message from storage. Messages deleted again since are skipped, as their
+// deletion follows.
+func writeIncrementalBackup(ctx context.Context, w io.Writer, user *models.User, since, backupID int64) error {
+	stream := newBackupStreamWriter(w, user.Username)
+	err := stream.write(BackupRecord{
+		Type:                BackupRecordAccount,
+		Username:            user.Username,
+		PublicKey:           user.PublicKey,
+		EncryptedPrivateKey: user.EncryptedPrivKey,
+		BackupID:            backupID,
+		Since:               since,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Changes refer to messages by recipient hash
+	keys := make(map[string]string)
+	for _, key := range ownerKeys(ctx, user) {
+		keys[RecipientHash(key)] = key
+	}
+
+	contactsChanged := false
+	after := since
+pages:
+	for after < backupID {
+		changes, err := models.ListChanges(ctx, user.Username, after, changeBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if change.Seq > backupID {
+				break pages
+			}
+			after = change.Seq
+
+			switch change.Kind {
+			case models.ChangeContacts:
+				contactsChanged = true
+			case models.ChangeMessageDeleted:
+				if err := stream.write(BackupRecord{Type: BackupRecordMessageDeleted, MessageID: change.MessageID}); err != nil {
+					return err
+				}
+			case models.ChangeMessageAdded:
+				key, ok := keys[change.RecipientHash]
+				if !ok {
+					continue
+				}
+				data, err := storeRead(ctx, key, change.MessageID)
+				if errors.Is(err, storage.ErrMessageNotFound) {
 					continue
 				}
-
-				path := filepath.Join(messageFolder, file.Name())
-				data, err := ioutil.ReadFile(path)
 				if err != nil {
-					log.Printf("Error reading message file %s: %v", file.Name(), err)
+					logging.Errorf(ctx, "Error reading message %s: %v", change.MessageID, err)
 					continue
 				}
-
-				var msg interface{}
-				if err := json.Unmarshal(data, &msg); err != nil {
-					log.Printf("Error unmarshaling message %s: %v", file.Name(), err)
+				var message Message
+				if err := json.Unmarshal(data, &message); err != nil {
+					logging.Errorf(ctx, "Error unmarshaling message %s: %v", change.MessageID, err)
 					continue
 				}
-
-				messages = append(messages, msg)
+				if err := stream.write(BackupRecord{Type: BackupRecordMessage, Message: &message}); err != nil {
+					return err
+				}
 			}
 		}
+		if len(changes) < changeBatchSize {
+			break
+		}
 	}
 
-	// Create backup data
-	backupData := BackupData{
-		Username:            username,
-		PublicKey:           user.PublicKey,
-		EncryptedPrivateKey: user.EncryptedPrivKey,
-		Contacts:            contacts,
-		Messages:            messages,
+	if contactsChanged {
+		contacts, err := loadContacts(ctx, user.Username)
+		if err != nil {
+			return err
+		}
+		if err := stream.write(BackupRecord{Type: BackupRecordContacts, Contacts: contacts}); err != nil {
+			return err
+		}
+	}
+	return stream.end()
+}
+
+// BackupAccountPage returns the user's backup one page of messages at a time, newest
+// first. The first page also carries the keys and contacts; together the pages hold the
+// same data as GET /backup_account.
+func BackupAccountPage(c *fiber.Ctx) error {
+	var query BackupPageQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+
+	resp, err := BackupPage(c.UserContext(), middleware.ExtractUsername(c), query.Limit, query.Before)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(resp)
+}
+
+// BackupPage returns one page of the user's backup; before is the next_cursor of the
+// previous page, empty for the first
+func BackupPage(ctx context.Context, username string, limit int, before string) (*BackupPageResponse, error) {
+	if limit == 0 {
+		limit = backupPageSize
 	}
 
-	return c.Status(fiber.StatusOK).JSON(backupData)
+	user, err := models.GetUser(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving user for backup: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to retrieve user information")
+	}
+
+	page, err := messagePage(ctx, user, limit, before)
+	if err != nil {
+		return nil, err
+	}
+	resp := &BackupPageResponse{Success: true, Messages: page.messages(ctx), NextCursor: page.nextCursor}
+
+	if before == "" {
+		contacts, err := loadContacts(ctx, username)
+		if err != nil {
+			logging.Errorf(ctx, "Error reading contacts file: %v", err)
+			contacts = make(ContactsData)
+		}
+		resp.Username = username
+		resp.PublicKey = user.PublicKey
+		resp.EncryptedPrivateKey = user.EncryptedPrivKey
+		resp.Contacts = contacts
+	}
+	return resp, nil
 }
 
 // RecoverAccount handles restoring an account from a backup
 func RecoverAccount(c *fiber.Ctx) error {
 	// Parse request body
 	var req RecoverRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"success": false,
-			"error":   "Invalid request format",
-		})
+	if err := decodeBody(c, &req); err != nil {
+		return respondError(c, err)
 	}
 
-	// Validate required fields
-	if req.Username == "" || req.PublicKey == "" || req.EncryptedPrivateKey == nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"success": false,
-			"error":   "Username, public key, and encrypted private key are required",
-		})
+	resp, err := RestoreAccount(c.UserContext(), req, middleware.AuthenticatedUsername(c))
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(resp)
+}
+
+// RestoreAccount restores keys, contacts and messages from a plain or encrypted backup,
+// or only the scopes the request selects, and issues a token for the account. The
+// response reports what was created, overwritten and skipped, in total and per scope,
+// and which entries failed; a dry run reports the same without restoring.
+//
+// caller is the username of the request's token, "" without one. Restoring into an
+// existing account needs the caller to be that account or to answer a recovery
+// challenge for its current key; without either, a restore can only create an account
+// that doesn't exist, and dry runs are refused so that plans tell nothing about other
+// accounts. Restoring keys other than the account's current or former ones, which
+// includes creating an account, needs the answer to a challenge for the backup's key.
+func RestoreAccount(ctx context.Context, req RecoverRequest, caller string) (*RecoverResponse, error) {
+	// Check the challenge before spending anything on the backup; its proof is checked
+	// once the backup names its key
+	var challenge *recoveryChallenge
+	if req.ChallengeID != "" {
+		var err error
+		if challenge, err = parseRecoveryChallenge(ctx, req.ChallengeID); err != nil {
+			return nil, err
+		}
+	}
+	if caller == "" && challenge == nil && req.DryRun {
+		return nil, errRecoveryProofRequired
+	}
+
+	// Decrypt passphrase-protected backups into a regular recovery payload
+	if req.EncryptedBackup != nil {
+		plaintext, err := utils.DecryptBackup(req.EncryptedBackup, req.Passphrase)
+		if err != nil {
+			return nil, serviceError(fiber.StatusBadRequest, "Failed to decrypt backup: "+err.Error())
+		}
+
+		var decrypted RecoverRequest
+		if err := json.Unmarshal(plaintext, &decrypted); err != nil {
+			return nil, serviceError(fiber.StatusBadRequest, "Decrypted backup has an invalid format")
+		}
+		decrypted.DryRun, decrypted.Confirm = req.DryRun, req.Confirm
+		decrypted.Scopes, decrypted.MessagesSince, decrypted.MessagesUntil = req.Scopes, req.MessagesSince, req.MessagesUntil
+		req = decrypted
+	}
+
+	// Validate required fields (of the decrypted payload for encrypted backups)
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+	selected, err := req.selectedScopes()
+	if err != nil {
+		return nil, err
+	}
+
+	// Backups made before a username change carry the old name
+	if resolved, err := models.ResolveUsername(ctx, req.Username); err != nil {
+		logging.Errorf(ctx, "Error resolving username %s: %v", req.Username, err)
+	} else {
+		req.Username = resolved
+	}
+	if (caller != "" && caller != req.Username) || (challenge != nil && challenge.username != req.Username) {
+		return nil, serviceError(fiber.StatusForbidden, "The backup belongs to another account")
+	}
+
+	user, err := models.GetUser(ctx, req.Username)
+	if err != nil && !errors.Is(err, models.ErrUserNotFound) {
+		logging.Errorf(ctx, "Error retrieving user for restore: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to retrieve user information")
+	}
+	exists := err == nil
+
+	// A challenge proves holding the backup's key or the account's current one, and the
+	// latter proves owning the account
+	owner, provenKey := caller, ""
+	if challenge != nil {
+		publicKeys := []string{req.PublicKey}
+		if exists {
+			publicKeys = append(publicKeys, user.PublicKey)
+		}
+		if provenKey, err = verifyRecoveryProof(ctx, challenge, req.Proof, publicKeys...); err != nil {
+			return nil, err
+		}
+		if exists && provenKey == user.PublicKey {
+			owner = req.Username
+		}
+	}
+
+	// Without a proof of ownership only new accounts are restored, and only with a proven
+	// key. Messages restored without the keys scope go to the account's current key
+	// rather than one the backup names.
+	switch {
+	case exists && owner == "":
+		return nil, errRecoveryProofRequired
+	case exists && !selected[RestoreScopeKeys]:
+		req.PublicKey = user.PublicKey
+	case exists && req.PublicKey != user.PublicKey && req.PublicKey != provenKey:
+		if err := checkFormerKey(ctx, req.Username, req.PublicKey); err != nil {
+			return nil, err
+		}
+	case !exists && req.PublicKey != provenKey:
+		return nil, errKeyProofRequired
+	}
+	if err := checkAccountEnabled(ctx, req.Username); err != nil {
+		return nil, err
 	}
 
-	// Update user keys in database
-	err := models.UpdateUserKeys(req.Username, req.PublicKey, req.EncryptedPrivateKey)
+	plan, messages, err := planRestore(ctx, req, selected)
 	if err != nil {
-		log.Printf("Error updating user keys: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to update user keys",
-		})
+		return nil, err
+	}
+	if req.DryRun {
+		return &RecoverResponse{Success: true, Message: "Dry run, nothing was restored", DryRun: true, Plan: plan}, nil
+	}
+	if req.Confirm != "" && req.Confirm != plan.PlanID {
+		return nil, errRestorePlanChanged(plan)
 	}
 
-	// Restore contacts if provided
-	if req.Contacts != nil && len(req.Contacts) > 0 {
-		contactsFile := filepath.Join("./data/contacts", req.Username+".json")
-		os.MkdirAll("./data/contacts", 0755)
+	// Refuse restores while the data volume is nearly full
+	if err := diskGuard.Check(); err != nil {
+		logging.Warnf(ctx, "Refusing account recovery: %v", err)
+		return nil, errInsufficientStorage
+	}
 
-		contactsData, err := json.MarshalIndent(req.Contacts, "", "  ")
-		if err != nil {
-			log.Printf("Error marshaling contacts data: %v", err)
-		} else {
-			if err := ioutil.WriteFile(contactsFile, contactsData, 0644); err != nil {
-				log.Printf("Error writing contacts file: %v", err)
+	// Update user keys in database; an account restored without a proof must still not exist
+	if selected[RestoreScopeKeys] {
+		if owner == "" {
+			err = models.CreateUserWithKeys(ctx, req.Username, req.PublicKey, req.EncryptedPrivateKey)
+			if errors.Is(err, models.ErrUsernameTaken) {
+				return nil, errRecoveryProofRequired
 			}
+		} else {
+			err = models.UpdateUserKeys(ctx, req.Username, req.PublicKey, req.EncryptedPrivateKey)
+		}
+		if errors.Is(err, models.ErrKeyInUse) {
+			return nil, codedError(fiber.StatusConflict, apierror.KeyInUse, "The public key of the backup belongs to another account")
+		}
+		if err != nil {
+			logging.Errorf(ctx, "Error updating user keys: %v", err)
+			return nil, serviceError(fiber.StatusInternalServerError, "Failed to update user keys")
 		}
 	}
 
-	// Restore messages if provided
-	if req.Messages != nil && len(req.Messages) > 0 {
-		messageFolder := GetMessageFolder(req.PublicKey)
-		os.MkdirAll(messageFolder, 0755)
+	// Restore contacts if provided
+	if selected[RestoreScopeContacts] && len(req.Contacts) > 0 {
+		if err := saveContacts(ctx, req.Username, req.Contacts); err != nil {
+			logging.Errorf(ctx, "Error writing contacts file: %v", err)
+			plan.fail("contacts")
+		} else {
+			recordChange(ctx, req.Username, models.ChangeContacts, "", "")
+		}
+	}
 
-		for i, msgData := range req.Messages {
-			// Generate a message ID if not present
-			msgMap, ok := msgData.(map[string]interface{})
-			if !ok {
-				log.Printf("Invalid message data format at index %d", i)
-				continue
-			}
+	// Restore the messages the plan kept, malformed ones were skipped
+	for _, message := range messages {
+		msgMap, msgID := message.Data, message.ID
+		msgMap["message_id"] = msgID
 
-			msgID, ok := msgMap["message_id"].(string)
-			if !ok || msgID == "" {
-				msgID = fmt.Sprintf("recovered_%d", i)
-				msgMap["message_id"] = msgID
-			}
+		messageData, err := json.Marshal(msgMap)
+		if err != nil {
+			logging.Errorf(ctx, "Error marshaling message data: %v", err)
+			plan.fail("message/" + msgID)
+			continue
+		}
 
-			messageData, err := json.MarshalIndent(msgMap, "", "  ")
-			if err != nil {
-				log.Printf("Error marshaling message data: %v", err)
-				continue
-			}
+		hash, err := storeWrite(ctx, req.PublicKey, msgID, messageData)
+		if err != nil {
+			logging.Errorf(ctx, "Error writing message file: %v", err)
+			plan.fail("message/" + msgID)
+			continue
+		}
 
-			messagePath := filepath.Join(messageFolder, msgID+".json")
-			if err := ioutil.WriteFile(messagePath, messageData, 0644); err != nil {
-				log.Printf("Error writing message file: %v", err)
+		// Restored messages keep their original timestamp in the index
+		timestamp := time.Now()
+		if ts, ok := msgMap["timestamp"].(string); ok {
+			if parsed, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+				timestamp = parsed
 			}
 		}
+		indexMessage(ctx, req.PublicKey, msgID, timestamp, len(messageData), hash)
+		recordChange(ctx, req.Username, models.ChangeMessageAdded, req.PublicKey, msgID)
 	}
 
 	// Generate JWT token for the recovered account
 	token, err := middleware.GenerateToken(req.Username)
 	if err != nil {
-		log.Printf("Error generating token for recovered account: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to generate authentication token",
-		})
+		logging.Errorf(ctx, "Error generating token for recovered account: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to generate authentication token")
 	}
 
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"success": true,
-		"message": "Account recovered successfully",
-		"token":   token,
-	})
+	message := "Account recovered successfully"
+	if len(plan.Failed) > 0 {
+		message = fmt.Sprintf("Account recovered, %d entries failed to be restored", len(plan.Failed))
+	}
+	return &RecoverResponse{
+		Success: true,
+		Message: message,
+		Token:   token,
+		Plan:    plan,
+	}, nil
+}
+
+// checkFormerKey returns errKeyProofRequired unless publicKey is a retired key of the user
+func checkFormerKey(ctx context.Context, username, publicKey string) error {
+	history, err := models.GetKeyHistory(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving key history for restore: %v", err)
+		return serviceError(fiber.StatusInternalServerError, "Failed to retrieve user information")
+	}
+	for _, record := range history {
+		if record.PublicKey == publicKey {
+			return nil
+		}
+	}
+	return errKeyProofRequired
 }
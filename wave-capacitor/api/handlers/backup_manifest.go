@@ -0,0 +1,479 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"wave_capacitor/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// backupManifestVersion is the version of the manifest format written by this node
+const backupManifestVersion = 1
+
+// ManifestEntry is the checksum of one entry of a backup
+type ManifestEntry struct {
+	Name   string `json:"name" doc:"account, contacts, message/<id> or message_deleted/<id>"`
+	SHA256 string `json:"sha256" doc:"hex-encoded"`
+}
+
+// BackupManifest lists the SHA-256 checksum of every entry of a backup and is signed
+// with the node's backup signing key. In a JSON backup each entry is hashed in canonical
+// form (keys sorted, no whitespace); in a streamed backup each line is hashed as written,
+// and the manifest comes with the end record.
+type BackupManifest struct {
+	Version   int             `json:"version"`
+	Username  string          `json:"username"`
+	CreatedAt time.Time       `json:"created_at"`
+	Entries   []ManifestEntry `json:"entries"`
+	SignerKey string          `json:"signer_key,omitempty" doc:"base64 Ed25519 public key of the node that made the backup"`
+	Signature string          `json:"signature,omitempty" doc:"base64 Ed25519 signature of the manifest serialized without this field"`
+}
+
+// backupSigningKey signs the manifests; without one they are left unsigned. Set with
+// SetBackupSigningKey.
+var backupSigningKey ed25519.PrivateKey
+
+// SetBackupSigningKey sets the key signing backup manifests
+func SetBackupSigningKey(key ed25519.PrivateKey) {
+	backupSigningKey = key
+}
+
+// sign signs the manifest with the node's backup signing key, if there is one
+func (m *BackupManifest) sign() error {
+	if backupSigningKey == nil {
+		return nil
+	}
+	m.SignerKey = base64.StdEncoding.EncodeToString(backupSigningKey.Public().(ed25519.PublicKey))
+	m.Signature = ""
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	m.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(backupSigningKey, data))
+	return nil
+}
+
+// verifySignature checks the manifest's signature against the key it names
+func (m BackupManifest) verifySignature() bool {
+	key, err := base64.StdEncoding.DecodeString(m.SignerKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	signature, err := base64.StdEncoding.DecodeString(m.Signature)
+	if err != nil {
+		return false
+	}
+	m.Signature = ""
+	data, err := json.Marshal(m)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(key), data, signature)
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalJSON serializes v with sorted keys and numbers as written, so an entry hashes
+// the same when it is created from the store and when it is read back from a file
+func canonicalJSON(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return json.Marshal(generic)
+}
+
+// backupEntries computes the manifest entries of a JSON backup: the account (username
+// and keys), the contacts and each message
+func backupEntries(username, publicKey string, encryptedPrivateKey, contacts interface{}, messages []interface{}) ([]ManifestEntry, error) {
+	account, err := canonicalJSON(map[string]interface{}{
+		"username":              username,
+		"public_key":            publicKey,
+		"encrypted_private_key": encryptedPrivateKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	contactsData, err := canonicalJSON(contacts)
+	if err != nil {
+		return nil, err
+	}
+	entries := []ManifestEntry{
+		{Name: "account", SHA256: checksum(account)},
+		{Name: "contacts", SHA256: checksum(contactsData)},
+	}
+
+	for i, message := range messages {
+		data, err := canonicalJSON(message)
+		if err != nil {
+			return nil, err
+		}
+		// Messages without an ID are named by position, as restoring names them
+		var id struct {
+			MessageID string `json:"message_id"`
+		}
+		json.Unmarshal(data, &id)
+		name := "message/" + id.MessageID
+		if id.MessageID == "" {
+			name = fmt.Sprintf("message/#%d", i)
+		}
+		entries = append(entries, ManifestEntry{Name: name, SHA256: checksum(data)})
+	}
+	return entries, nil
+}
+
+// newBackupManifest creates the signed manifest of a JSON backup
+func newBackupManifest(backup *BackupData) (*BackupManifest, error) {
+	entries, err := backupEntries(backup.Username, backup.PublicKey, backup.EncryptedPrivateKey, backup.Contacts, backup.Messages)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &BackupManifest{Version: backupManifestVersion, Username: backup.Username, CreatedAt: time.Now().UTC(), Entries: entries}
+	if err := manifest.sign(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// streamEntryName names the entry of a streamed backup record; the end record has none
+func streamEntryName(recordType, messageID string) string {
+	switch recordType {
+	case BackupRecordAccount, BackupRecordContacts:
+		return recordType
+	case BackupRecordMessage, BackupRecordMessageDeleted:
+		return recordType + "/" + messageID
+	}
+	return ""
+}
+
+// backupStreamWriter writes the records of a streamed backup, collecting the checksum of
+// every line for the manifest written with the end record. The manifest grows by an
+// entry per record, about a hundred bytes per message.
+type backupStreamWriter struct {
+	w        *bufio.Writer
+	manifest BackupManifest
+	messages int
+}
+
+func newBackupStreamWriter(w io.Writer, username string) *backupStreamWriter {
+	return &backupStreamWriter{
+		w:        bufio.NewWriterSize(w, 64*1024),
+		manifest: BackupManifest{Version: backupManifestVersion, Username: username, CreatedAt: time.Now().UTC(), Entries: []ManifestEntry{}},
+	}
+}
+
+// write writes one record and adds it to the manifest
+func (s *backupStreamWriter) write(record BackupRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	messageID := record.MessageID
+	if record.Message != nil {
+		messageID = record.Message.MessageID
+		s.messages++
+	}
+	s.manifest.Entries = append(s.manifest.Entries, ManifestEntry{Name: streamEntryName(record.Type, messageID), SHA256: checksum(line)})
+
+	if _, err := s.w.Write(line); err != nil {
+		return err
+	}
+	return s.w.WriteByte('\n')
+}
+
+// end writes the end record with the message count and the signed manifest
+func (s *backupStreamWriter) end() error {
+	if err := s.manifest.sign(); err != nil {
+		return err
+	}
+	line, err := json.Marshal(BackupRecord{Type: BackupRecordEnd, Messages: &s.messages, Manifest: &s.manifest})
+	if err != nil {
+		return err
+	}
+	if _, err := s.w.Write(line); err != nil {
+		return err
+	}
+	if err := s.w.WriteByte('\n'); err != nil {
+		return err
+	}
+	return s.w.Flush()
+}
+
+// Formats of a verified backup
+const (
+	BackupFormatJSON      = "json"
+	BackupFormatEncrypted = "encrypted"
+	BackupFormatNDJSON    = "ndjson"
+)
+
+// BackupVerification is the outcome of checking a backup against its manifest
+type BackupVerification struct {
+	Valid          bool     `json:"valid" doc:"every entry matches the manifest, which carries a valid signature"`
+	Format         string   `json:"format" doc:"json, encrypted or ndjson"`
+	Username       string   `json:"username,omitempty"`
+	Entries        int      `json:"entries" doc:"entries listed in the manifest"`
+	Corrupted      []string `json:"corrupted,omitempty" doc:"entries whose checksum doesn't match"`
+	Missing        []string `json:"missing,omitempty" doc:"entries of the manifest missing from the backup"`
+	Unexpected     []string `json:"unexpected,omitempty" doc:"entries of the backup missing from the manifest"`
+	Signed         bool     `json:"signed"`
+	SignatureValid bool     `json:"signature_valid"`
+	SignerKey      string   `json:"signer_key,omitempty"`
+	TrustedSigner  bool     `json:"trusted_signer" doc:"signed with this node's backup signing key rather than another node's"`
+	Problems       []string `json:"problems,omitempty" doc:"why the backup is invalid, beyond the entries listed"`
+}
+
+// problem records a reason the backup is invalid
+func (v *BackupVerification) problem(format string, args ...interface{}) {
+	v.Problems = append(v.Problems, fmt.Sprintf(format, args...))
+}
+
+// check compares the entries found in the backup with its manifest and sets Valid
+func (v *BackupVerification) check(manifest *BackupManifest, username string, found []ManifestEntry) {
+	v.Username = username
+	if manifest == nil {
+		v.problem("backup has no manifest")
+		return
+	}
+	v.Entries = len(manifest.Entries)
+	if manifest.Username != username {
+		v.problem("manifest is for %q, not %q", manifest.Username, username)
+	}
+
+	actual := make(map[string]string, len(found))
+	for _, entry := range found {
+		actual[entry.Name] = entry.SHA256
+	}
+	expected := make(map[string]string, len(manifest.Entries))
+	for _, entry := range manifest.Entries {
+		expected[entry.Name] = entry.SHA256
+		sum, ok := actual[entry.Name]
+		switch {
+		case !ok:
+			v.Missing = append(v.Missing, entry.Name)
+		case sum != entry.SHA256:
+			v.Corrupted = append(v.Corrupted, entry.Name)
+		}
+	}
+	for _, entry := range found {
+		if _, ok := expected[entry.Name]; !ok {
+			v.Unexpected = append(v.Unexpected, entry.Name)
+		}
+	}
+
+	v.Signed = manifest.Signature != ""
+	v.SignerKey = manifest.SignerKey
+	switch {
+	case !v.Signed:
+		v.problem("manifest is not signed")
+	case !manifest.verifySignature():
+		v.problem("manifest signature is invalid")
+	default:
+		v.SignatureValid = true
+		if backupSigningKey != nil {
+			own := base64.StdEncoding.EncodeToString(backupSigningKey.Public().(ed25519.PublicKey))
+			v.TrustedSigner = manifest.SignerKey == own
+		}
+	}
+
+	v.Valid = len(v.Problems) == 0 && len(v.Corrupted) == 0 && len(v.Missing) == 0 && len(v.Unexpected) == 0
+}
+
+// errBackupPassphraseRequired is returned when verifying an encrypted backup without its passphrase
+var errBackupPassphraseRequired = serviceError(fiber.StatusBadRequest, "Encrypted backup requires its passphrase")
+
+// VerifyBackupFile checks a backup in any of the exported formats against its manifest
+// without restoring it: a JSON backup, an encrypted backup (opened with passphrase or
+// the passphrase of a recovery request wrapping it) or a streamed NDJSON backup, read
+// line by line. Errors are returned for input that isn't a backup at all; damage to a
+// backup is reported in the result.
+func VerifyBackupFile(r io.Reader, passphrase string) (*BackupVerification, error) {
+	reader := bufio.NewReaderSize(r, 64*1024)
+	first, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	// Every line of a streamed backup is a record with a type
+	var record struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(first, &record) == nil && record.Type != "" {
+		return verifyBackupStream(io.MultiReader(bytes.NewReader(first), reader))
+	}
+
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return verifyBackupDocument(append(first, rest...), passphrase)
+}
+
+// backupDocument reads a JSON backup, an encrypted one or a recovery request, keeping
+// the entries as decoded so they hash as written
+type backupDocument struct {
+	Username            string          `json:"username"`
+	PublicKey           string          `json:"public_key"`
+	EncryptedPrivateKey interface{}     `json:"encrypted_private_key"`
+	Contacts            interface{}     `json:"contacts"`
+	Messages            []interface{}   `json:"messages"`
+	Manifest            *BackupManifest `json:"manifest"`
+
+	Format          string                 `json:"format"`
+	EncryptedBackup *utils.EncryptedBackup `json:"encrypted_backup"`
+	Passphrase      string                 `json:"passphrase"`
+}
+
+func decodeBackupDocument(data []byte) (*backupDocument, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc backupDocument
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, serviceError(fiber.StatusBadRequest, "Backup is not valid JSON")
+	}
+	return &doc, nil
+}
+
+func verifyBackupDocument(data []byte, passphrase string) (*BackupVerification, error) {
+	doc, err := decodeBackupDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	result := &BackupVerification{Format: BackupFormatJSON}
+
+	encrypted := doc.EncryptedBackup
+	if encrypted == nil && doc.Format == utils.EncryptedBackupFormat {
+		encrypted = new(utils.EncryptedBackup)
+		if err := json.Unmarshal(data, encrypted); err != nil {
+			return nil, serviceError(fiber.StatusBadRequest, "Encrypted backup has an invalid format")
+		}
+	}
+	if encrypted != nil {
+		if passphrase == "" {
+			passphrase = doc.Passphrase
+		}
+		if passphrase == "" {
+			return nil, errBackupPassphraseRequired
+		}
+		// A wrong passphrase and a tampered archive look the same to GCM
+		plaintext, err := utils.DecryptBackup(encrypted, passphrase)
+		if err != nil {
+			return nil, serviceError(fiber.StatusBadRequest, "Failed to decrypt backup: "+err.Error())
+		}
+		if doc, err = decodeBackupDocument(plaintext); err != nil {
+			return nil, serviceError(fiber.StatusBadRequest, "Decrypted backup has an invalid format")
+		}
+		result.Format = BackupFormatEncrypted
+	}
+
+	if doc.Username == "" && doc.Manifest == nil {
+		return nil, serviceError(fiber.StatusBadRequest, "Body is not an account backup")
+	}
+	entries, err := backupEntries(doc.Username, doc.PublicKey, doc.EncryptedPrivateKey, doc.Contacts, doc.Messages)
+	if err != nil {
+		return nil, err
+	}
+	result.check(doc.Manifest, doc.Username, entries)
+	return result, nil
+}
+
+// verifyBackupStream hashes each line of a streamed backup and checks them against the
+// manifest of the end record
+func verifyBackupStream(r io.Reader) (*BackupVerification, error) {
+	result := &BackupVerification{Format: BackupFormatNDJSON}
+	reader := bufio.NewReaderSize(r, 64*1024)
+
+	var (
+		entries  []ManifestEntry
+		username string
+		manifest *BackupManifest
+		messages int
+		counted  *int
+		ended    bool
+	)
+	for number := 1; ; number++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		if len(line) > 0 {
+			if ended {
+				result.problem("line %d follows the end record", number)
+				break
+			}
+			var record struct {
+				Type      string `json:"type"`
+				Username  string `json:"username"`
+				MessageID string `json:"message_id"`
+				Message   *struct {
+					ID string `json:"message_id"`
+				} `json:"message"`
+				Messages *int            `json:"messages"`
+				Manifest *BackupManifest `json:"manifest"`
+			}
+			if json.Unmarshal(line, &record) != nil {
+				result.problem("line %d is not valid JSON", number)
+			} else if record.Type == BackupRecordEnd {
+				ended = true
+				manifest, counted = record.Manifest, record.Messages
+			} else {
+				if record.Type == BackupRecordAccount {
+					username = record.Username
+				}
+				messageID := record.MessageID
+				if record.Message != nil {
+					messageID = record.Message.ID
+					messages++
+				}
+				entries = append(entries, ManifestEntry{Name: streamEntryName(record.Type, messageID), SHA256: checksum(line)})
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+
+	switch {
+	case !ended:
+		result.problem("backup has no end record, it was cut off")
+	case counted == nil || *counted != messages:
+		result.problem("end record doesn't match the %d message records", messages)
+	}
+	result.check(manifest, username, entries)
+	return result, nil
+}
+
+// VerifyBackup checks an uploaded backup against its manifest without restoring it: a
+// JSON backup, a recovery request wrapping an encrypted one with its passphrase, or a
+// streamed backup sent as application/x-ndjson
+func VerifyBackup(c *fiber.Ctx) error {
+	if !c.Is("json") && !strings.HasPrefix(c.Get(fiber.HeaderContentType), "application/x-ndjson") {
+		return respondError(c, serviceError(fiber.StatusBadRequest, "Content-Type must be application/json or application/x-ndjson"))
+	}
+
+	result, err := VerifyBackupFile(bytes.NewReader(c.Body()), "")
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(VerifyBackupResponse{Success: true, Verification: *result})
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/logging"
+	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Users block public keys. The node then keeps messages from the accounts behind them,
+// under any key they held, out of the user's mailbox, and hides the user from their
+// lookups.
+
+// BlockRequest names the public key to block or unblock
+type BlockRequest struct {
+	PublicKey string `json:"public_key" validate:"required"`
+}
+
+// BlockKey handles adding a public key to the user's blocklist
+func BlockKey(c *fiber.Ctx) error {
+	var req BlockRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+
+	ctx := c.UserContext()
+	err := models.BlockKey(ctx, middleware.ExtractUsername(c), req.PublicKey, blocklistMaxPerUser())
+	if errors.Is(err, models.ErrBlocklistFull) {
+		return respondError(c, codedError(fiber.StatusConflict, apierror.LimitExceeded,
+			fmt.Sprintf("At most %d keys can be blocked", blocklistMaxPerUser())))
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error blocking key: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to block key"))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+		"message": "Key blocked successfully",
+	})
+}
+
+// UnblockKey handles removing a public key from the user's blocklist
+func UnblockKey(c *fiber.Ctx) error {
+	var req BlockRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+
+	ctx := c.UserContext()
+	err := models.UnblockKey(ctx, middleware.ExtractUsername(c), req.PublicKey)
+	if errors.Is(err, models.ErrBlockNotFound) {
+		return respondError(c, serviceError(fiber.StatusNotFound, "Key not blocked"))
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error unblocking key: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to unblock key"))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+		"message": "Key unblocked successfully",
+	})
+}
+
+// GetBlocklist handles listing the user's blocked keys
+func GetBlocklist(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	keys, err := models.ListBlockedKeys(ctx, middleware.ExtractUsername(c))
+	if err != nil {
+		logging.Errorf(ctx, "Error listing blocked keys: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to list blocked keys"))
+	}
+	return c.Status(fiber.StatusOK).JSON(BlocklistResponse{Success: true, Keys: keys, Limit: blocklistMaxPerUser()})
+}
+
+// blocklistMaxPerUser returns how many keys a user may block
+func blocklistMaxPerUser() int {
+	if nodeConfig == nil {
+		return 1000
+	}
+	return nodeConfig.BlocklistMaxPerUser
+}
+
+// rejectBlockedMessages reports whether messages from blocked senders are refused rather
+// than silently dropped
+func rejectBlockedMessages() bool {
+	return nodeConfig != nil && nodeConfig.BlockedMessages == "reject"
+}
+
+// hiddenFrom reports whether owner blocked requester, in which case lookups of owner by
+// requester answer as if owner didn't exist. A failed check is logged and hides nothing.
+func hiddenFrom(ctx context.Context, owner, requester string) bool {
+	blocked, err := models.IsBlocked(ctx, owner, requester)
+	if err != nil {
+		logging.Errorf(ctx, "Error checking blocklist: %v", err)
+		return false
+	}
+	return blocked
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+	"time"
+	"wave_capacitor/logging"
+	"wave_capacitor/models"
+)
+
+// changePurgeInterval is the least time between two purges of the change log
+const changePurgeInterval = time.Hour
+
+var (
+	changePurgeMu   sync.Mutex
+	lastChangePurge time.Time
+)
+
+// recordChange adds a change to the user's log for incremental backups. ownerKey is the
+// key a message is stored under, empty for contact changes. Like indexing, failures are
+// logged rather than failing the request; the next full backup covers what was missed.
+func recordChange(ctx context.Context, username, kind, ownerKey, messageID string) {
+	hash := ""
+	if ownerKey != "" {
+		hash = RecipientHash(ownerKey)
+	}
+	if err := models.RecordChange(ctx, username, kind, hash, messageID); err != nil {
+		logging.Errorf(ctx, "Error recording %s change of %s: %v", kind, username, err)
+	}
+	purgeChanges(ctx)
+}
+
+// recordKeyChange is like recordChange for the account holding publicKey, the key the
+// message is stored under
+func recordKeyChange(ctx context.Context, publicKey, kind, messageID string) {
+	if err := models.RecordKeyChange(ctx, publicKey, kind, RecipientHash(publicKey), messageID); err != nil {
+		logging.Errorf(ctx, "Error recording %s change: %v", kind, err)
+	}
+	purgeChanges(ctx)
+}
+
+// purgeChanges deletes changes past CHANGE_LOG_RETENTION_DAYS in the background at most
+// once per interval
+func purgeChanges(ctx context.Context) {
+	if nodeConfig == nil || nodeConfig.ChangeLogRetentionDays <= 0 {
+		return
+	}
+	changePurgeMu.Lock()
+	defer changePurgeMu.Unlock()
+	if time.Since(lastChangePurge) < changePurgeInterval {
+		return
+	}
+	lastChangePurge = time.Now()
+
+	ctx = logging.Detach(ctx)
+	before := time.Now().Add(-time.Duration(nodeConfig.ChangeLogRetentionDays) * 24 * time.Hour)
+	go func() {
+		if _, err := models.PurgeAccountChanges(ctx, before); err != nil {
+			logging.Errorf(ctx, "Error purging account changes: %v", err)
+		}
+	}()
+}
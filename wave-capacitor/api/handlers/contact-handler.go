@@ -1,137 +1,175 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
-	"io/ioutil"
-	"log"
-	"os"
-	"path/filepath"
-	"wave_capacitor/config"
+	"errors"
+	"sort"
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/api/validate"
+	"wave_capacitor/logging"
 	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+	"wave_capacitor/storage"
+	"wave_capacitor/utils"
+	"wave_capacitor/webhooks"
 
 	"github.com/gofiber/fiber/v2"
 )
 
 // Contact represents a contact entry
-type Contact struct {
-	PublicKey string `json:"public_key"`
-	Nickname  string `json:"nickname"`
-}
+type Contact = storage.Contact
 
-// ContactsData represents the structure of contacts storage
+// ContactsData represents a contact list keyed by public key, as returned to clients
 type ContactsData map[string]Contact
 
 // AddContactRequest defines the structure for adding a contact
 type AddContactRequest struct {
-	ContactPublicKey string `json:"contact_public_key"`
-	Nickname         string `json:"nickname"`
+	ContactPublicKey string `json:"contact_public_key" doc:"Required unless contact_handle is given"`
+	ContactHandle    string `json:"contact_handle,omitempty" validate:"max=320" doc:"username@domain of the contact; when contact_public_key is given too, the handle must resolve to it"`
+	Nickname         string `json:"nickname" validate:"required,max=256"`
 }
 
 // RemoveContactRequest defines the structure for removing a contact
 type RemoveContactRequest struct {
-	ContactPublicKey string `json:"contact_public_key"`
+	ContactPublicKey string `json:"contact_public_key" validate:"required"`
+}
+
+// VerifyContactRequest defines the structure for marking a contact verified or not
+type VerifyContactRequest struct {
+	ContactPublicKey string `json:"contact_public_key" validate:"required"`
+	Verification     string `json:"verification" validate:"required,oneof=verified unverified"`
 }
 
-// getContactsFile returns the path to a user's contacts file
-func getContactsFile(username string) string {
-	return filepath.Join(config.ContactsDir, username+".json")
+// ContactView is a contact as listed to its owner
+type ContactView struct {
+	Contact
+	SafetyNumber     string `json:"safety_number,omitempty" doc:"Compare out of band with the contact's; equal numbers verify both keys"`
+	CurrentPublicKey string `json:"current_public_key,omitempty" doc:"Key the contact rotated to, when verification is changed"`
 }
 
-// loadContacts loads contacts from a user's contacts file
-func loadContacts(username string) (ContactsData, error) {
-	contactsFile := getContactsFile(username)
-	contacts := make(ContactsData)
+// contactStore persists contact lists; it is configured at startup via SetContactStore
+var contactStore storage.ContactStore
 
-	// Check if file exists
-	if _, err := os.Stat(contactsFile); os.IsNotExist(err) {
-		return contacts, nil // Return empty contacts if file doesn't exist
-	}
+// SetContactStore configures the store used to persist contact lists
+func SetContactStore(store storage.ContactStore) {
+	contactStore = store
+}
+
+// loadContacts loads a user's contacts from the contact store
+func loadContacts(ctx context.Context, username string) (ContactsData, error) {
+	contacts, _, err := loadCheckedContacts(ctx, username)
+	return contacts, err
+}
 
-	// Read contacts file
-	data, err := ioutil.ReadFile(contactsFile)
+// loadCheckedContacts loads a user's contacts and marks those whose owner rotated away
+// from the listed key as changed. It also returns the current key of each such contact.
+func loadCheckedContacts(ctx context.Context, username string) (ContactsData, map[string]string, error) {
+	list, err := contactStore.ListContacts(ctx, username)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Unmarshal contacts
-	if len(data) > 0 {
-		if err := json.Unmarshal(data, &contacts); err != nil {
-			return nil, err
+	contacts := make(ContactsData, len(list))
+	publicKeys := make([]string, 0, len(list))
+	for _, contact := range list {
+		if contact.Verification == "" {
+			contact.Verification = storage.ContactUnverified
 		}
+		contacts[contact.PublicKey] = contact
+		publicKeys = append(publicKeys, contact.PublicKey)
 	}
 
-	return contacts, nil
-}
-
-// saveContacts saves contacts to a user's contacts file
-func saveContacts(username string, contacts ContactsData) error {
-	// Ensure directory exists
-	if err := os.MkdirAll(config.ContactsDir, 0755); err != nil {
-		return err
-	}
-
-	// Marshal contacts to JSON
-	data, err := json.MarshalIndent(contacts, "", "  ")
+	// Failing to check only delays the change until the next load
+	rotated, err := models.CurrentKeysOfRetired(ctx, publicKeys)
 	if err != nil {
-		return err
+		logging.Warnf(ctx, "Error checking contacts for rotated keys: %v", err)
+		return contacts, nil, nil
+	}
+	changed := false
+	for publicKey := range rotated {
+		contact, ok := contacts[publicKey]
+		if !ok || contact.Verification == storage.ContactChanged {
+			continue
+		}
+		if err := contactStore.SetVerification(ctx, username, publicKey, storage.ContactChanged); err != nil {
+			logging.Warnf(ctx, "Error marking contact as changed: %v", err)
+			continue
+		}
+		contact.Verification = storage.ContactChanged
+		contacts[publicKey] = contact
+		changed = true
+	}
+	if changed {
+		recordChange(ctx, username, models.ChangeContacts, "", "")
 	}
+	return contacts, rotated, nil
+}
 
-	// Write contacts file
-	contactsFile := getContactsFile(username)
-	return ioutil.WriteFile(contactsFile, data, 0644)
+// saveContacts replaces a user's contacts in the contact store
+func saveContacts(ctx context.Context, username string, contacts ContactsData) error {
+	list := make([]Contact, 0, len(contacts))
+	for publicKey, contact := range contacts {
+		contact.PublicKey = publicKey
+		list = append(list, contact)
+	}
+	return contactStore.ReplaceContacts(ctx, username, list)
 }
 
 // AddContact handles adding a new contact
 func AddContact(c *fiber.Ctx) error {
 	// Parse request body
 	var req AddContactRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"success": false,
-			"error":   "Invalid request format",
-		})
-	}
-
-	// Validate required fields
-	if req.ContactPublicKey == "" || req.Nickname == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"success": false,
-			"error":   "Contact public key and nickname are required",
-		})
+	if err := decodeBody(c, &req); err != nil {
+		return respondError(c, err)
 	}
 
 	// Get username from JWT
 	username := middleware.ExtractUsername(c)
 
-	// Load existing contacts
-	contacts, err := loadContacts(username)
+	publicKey, err := SaveContact(c.UserContext(), username, req)
 	if err != nil {
-		log.Printf("Error loading contacts: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to load contacts",
-		})
+		return respondError(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(AddContactResponse{
+		Success:          true,
+		Message:          "Contact added successfully",
+		ContactPublicKey: publicKey,
+	})
+}
+
+// SaveContact adds or updates a contact of the user and returns its public key, which
+// a contact added by handle is resolved to
+func SaveContact(ctx context.Context, username string, req AddContactRequest) (string, error) {
+	if err := validateRequest(req); err != nil {
+		return "", err
+	}
+	if req.ContactHandle != "" {
+		publicKey, err := recipientByHandle(ctx, "contact_handle", req.ContactHandle, req.ContactPublicKey)
+		if err != nil {
+			return "", err
+		}
+		req.ContactPublicKey = publicKey
+	}
+	if req.ContactPublicKey == "" {
+		return "", fieldError("contact_public_key", validate.CodeRequired, "is required")
 	}
 
 	// Add or update contact
-	contacts[req.ContactPublicKey] = Contact{
+	contact := Contact{
 		PublicKey: req.ContactPublicKey,
 		Nickname:  req.Nickname,
 	}
-
-	// Save contacts
-	if err := saveContacts(username, contacts); err != nil {
-		log.Printf("Error saving contacts: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to save contact",
-		})
+	if err := contactStore.PutContact(ctx, username, contact); err != nil {
+		logging.Errorf(ctx, "Error saving contact: %v", err)
+		return "", serviceError(fiber.StatusInternalServerError, "Failed to save contact")
 	}
-
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"success": true,
-		"message": "Contact added successfully",
-	})
+	recordChange(ctx, username, models.ChangeContacts, "", "")
+	// Nicknames stay out of events, the node-wide endpoint may belong to someone else
+	webhookDispatcher.Emit(ctx, username, webhooks.EventContactAdded, fiber.Map{"contact_public_key": contact.PublicKey})
+	return contact.PublicKey, nil
 }
 
 // GetContacts handles retrieving all contacts for a user
@@ -139,14 +177,15 @@ func GetContacts(c *fiber.Ctx) error {
 	// Get username from JWT
 	username := middleware.ExtractUsername(c)
 
-	// Load contacts
-	contacts, err := loadContacts(username)
+	contacts, err := ListContacts(c.UserContext(), username)
 	if err != nil {
-		log.Printf("Error loading contacts: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to load contacts",
-		})
+		return respondError(c, err)
+	}
+
+	// Map keys are marshaled in sorted order, so equal contact lists hash equally
+	data, err := json.Marshal(contacts)
+	if err == nil && notModified(c, weakETag(string(data))) {
+		return c.SendStatus(fiber.StatusNotModified)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
@@ -155,56 +194,182 @@ func GetContacts(c *fiber.Ctx) error {
 	})
 }
 
-// RemoveContact handles removing a contact
-func RemoveContact(c *fiber.Ctx) error {
-	// Parse request body
-	var req RemoveContactRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"success": false,
-			"error":   "Invalid request format",
-		})
+// ListContacts returns the user's contacts keyed by public key, with their safety numbers
+func ListContacts(ctx context.Context, username string) (map[string]ContactView, error) {
+	contacts, rotated, err := loadCheckedContacts(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error loading contacts: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to load contacts")
+	}
+	user, err := models.GetUser(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving user: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to load contacts")
 	}
 
-	// Validate required fields
-	if req.ContactPublicKey == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"success": false,
-			"error":   "Contact public key is required",
-		})
+	views := make(map[string]ContactView, len(contacts))
+	for publicKey, contact := range contacts {
+		views[publicKey] = ContactView{
+			Contact:          contact,
+			SafetyNumber:     utils.SafetyNumber(user.PublicKey, publicKey),
+			CurrentPublicKey: rotated[publicKey],
+		}
 	}
+	return views, nil
+}
 
-	// Get username from JWT
-	username := middleware.ExtractUsername(c)
+// VerifyContact handles marking a contact verified, after its owner compared safety
+// numbers with it, or unverified again
+func VerifyContact(c *fiber.Ctx) error {
+	var req VerifyContactRequest
+	if err := decodeBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
 
-	// Load existing contacts
-	contacts, err := loadContacts(username)
+	contact, err := SetContactVerification(c.UserContext(), middleware.ExtractUsername(c), req)
 	if err != nil {
-		log.Printf("Error loading contacts: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to load contacts",
-		})
+		return respondError(c, err)
 	}
 
-	// Check if contact exists
-	if _, exists := contacts[req.ContactPublicKey]; !exists {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"success": false,
-			"error":   "Contact not found",
-		})
+	return c.Status(fiber.StatusOK).JSON(ContactResponse{Success: true, Contact: contact})
+}
+
+// SetContactVerification sets the verification state of one contact of the user. A key
+// its owner rotated away from can't be verified; the current key has to be added instead.
+func SetContactVerification(ctx context.Context, username string, req VerifyContactRequest) (ContactView, error) {
+	if err := validateRequest(req); err != nil {
+		return ContactView{}, err
 	}
 
-	// Remove contact
-	delete(contacts, req.ContactPublicKey)
+	rotated, err := models.CurrentKeysOfRetired(ctx, []string{req.ContactPublicKey})
+	if err != nil {
+		logging.Errorf(ctx, "Error checking contact key: %v", err)
+		return ContactView{}, serviceError(fiber.StatusInternalServerError, "Failed to update contact")
+	}
+	if _, ok := rotated[req.ContactPublicKey]; ok && req.Verification == storage.ContactVerified {
+		return ContactView{}, codedError(fiber.StatusConflict, apierror.Conflict,
+			"The contact rotated its key since it was added, add the current key to verify it")
+	}
 
-	// Save contacts
-	if err := saveContacts(username, contacts); err != nil {
-		log.Printf("Error saving contacts: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to remove contact",
+	err = contactStore.SetVerification(ctx, username, req.ContactPublicKey, req.Verification)
+	if errors.Is(err, storage.ErrContactNotFound) {
+		return ContactView{}, serviceError(fiber.StatusNotFound, "Contact not found")
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error updating contact: %v", err)
+		return ContactView{}, serviceError(fiber.StatusInternalServerError, "Failed to update contact")
+	}
+	recordChange(ctx, username, models.ChangeContacts, "", "")
+
+	contacts, err := ListContacts(ctx, username)
+	if err != nil {
+		return ContactView{}, err
+	}
+	contact, ok := contacts[req.ContactPublicKey]
+	if !ok {
+		return ContactView{}, serviceError(fiber.StatusNotFound, "Contact not found")
+	}
+	return contact, nil
+}
+
+// ContactsSyncQuery selects the contact changes to return
+type ContactsSyncQuery struct {
+	Since string `query:"since"` // next_since of the previous sync; omitted returns the whole list
+}
+
+// SyncContacts handles returning the changes to the user's contacts since the client's
+// previous sync
+func SyncContacts(c *fiber.Ctx) error {
+	var query ContactsSyncQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+	var since time.Time
+	if query.Since != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, query.Since); err != nil {
+			return respondError(c, fieldError("since", validate.CodeFormat, "must be an RFC 3339 timestamp"))
+		}
+	}
+
+	resp, err := ContactChangesSince(c.UserContext(), middleware.ExtractUsername(c), since)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(resp)
+}
+
+// ContactChangesSince returns the contacts of the user added, changed or removed after
+// since. A zero since, or one older than the tombstones kept, returns the whole list.
+func ContactChangesSince(ctx context.Context, username string, since time.Time) (ContactsSyncResponse, error) {
+	resp := ContactsSyncResponse{Success: true, NextSince: since}
+	if since.IsZero() || since.Before(contactTombstoneCutoff()) {
+		resp.Full = true
+		resp.NextSince = time.Now().UTC()
+	}
+
+	// Listing first marks contacts that rotated their key as changed
+	views, err := ListContacts(ctx, username)
+	if err != nil {
+		return resp, err
+	}
+	if resp.Full {
+		resp.Contacts = make([]ContactView, 0, len(views))
+		for _, view := range views {
+			resp.Contacts = append(resp.Contacts, view)
+		}
+		sort.Slice(resp.Contacts, func(i, j int) bool {
+			if !resp.Contacts[i].CreatedAt.Equal(resp.Contacts[j].CreatedAt) {
+				return resp.Contacts[i].CreatedAt.Before(resp.Contacts[j].CreatedAt)
+			}
+			return resp.Contacts[i].PublicKey < resp.Contacts[j].PublicKey
 		})
+	} else {
+		changes, err := contactStore.ContactChanges(ctx, username, since)
+		if err != nil {
+			logging.Errorf(ctx, "Error loading contact changes: %v", err)
+			return resp, serviceError(fiber.StatusInternalServerError, "Failed to load contacts")
+		}
+		resp.Contacts = make([]ContactView, 0, len(changes))
+		for _, contact := range changes {
+			view, ok := views[contact.PublicKey]
+			if contact.Deleted || !ok {
+				view = ContactView{Contact: contact}
+			}
+			resp.Contacts = append(resp.Contacts, view)
+		}
+	}
+
+	for _, contact := range resp.Contacts {
+		if contact.ModifiedAt.After(resp.NextSince) {
+			resp.NextSince = contact.ModifiedAt
+		}
+	}
+	return resp, nil
+}
+
+// contactTombstoneCutoff returns the time before which tombstones of removed contacts
+// are purged, following CHANGE_LOG_RETENTION_DAYS; zero keeps them forever
+func contactTombstoneCutoff() time.Time {
+	if nodeConfig == nil || nodeConfig.ChangeLogRetentionDays <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(-time.Duration(nodeConfig.ChangeLogRetentionDays) * 24 * time.Hour)
+}
+
+// RemoveContact handles removing a contact
+func RemoveContact(c *fiber.Ctx) error {
+	// Parse request body
+	var req RemoveContactRequest
+	if err := decodeBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+
+	// Get username from JWT
+	username := middleware.ExtractUsername(c)
+
+	if err := DeleteContact(c.UserContext(), username, req.ContactPublicKey); err != nil {
+		return respondError(c, err)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
@@ -212,3 +377,26 @@ func RemoveContact(c *fiber.Ctx) error {
 		"message": "Contact removed successfully",
 	})
 }
+
+// DeleteContact removes one contact of the user
+func DeleteContact(ctx context.Context, username, contactPublicKey string) error {
+	if err := validateRequest(RemoveContactRequest{ContactPublicKey: contactPublicKey}); err != nil {
+		return err
+	}
+
+	if err := contactStore.DeleteContact(ctx, username, contactPublicKey); err != nil {
+		if errors.Is(err, storage.ErrContactNotFound) {
+			return serviceError(fiber.StatusNotFound, "Contact not found")
+		}
+		logging.Errorf(ctx, "Error removing contact: %v", err)
+		return serviceError(fiber.StatusInternalServerError, "Failed to remove contact")
+	}
+	if cutoff := contactTombstoneCutoff(); !cutoff.IsZero() {
+		if err := contactStore.PurgeTombstones(ctx, username, cutoff); err != nil {
+			logging.Warnf(ctx, "Error purging contact tombstones: %v", err)
+		}
+	}
+	recordChange(ctx, username, models.ChangeContacts, "", "")
+	webhookDispatcher.Emit(ctx, username, webhooks.EventContactRemoved, fiber.Map{"contact_public_key": contactPublicKey})
+	return nil
+}
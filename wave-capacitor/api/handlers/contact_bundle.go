@@ -0,0 +1,387 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+	"wave_capacitor/api/validate"
+	"wave_capacitor/logging"
+	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+	"wave_capacitor/storage"
+	"wave_capacitor/webhooks"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Contact lists move between capacitors and clients as bundles, JSON or CSV, signed with
+// the node's backup signing key so an import can tell a bundle altered on the way.
+
+// Format and version of contact bundles
+const (
+	ContactBundleFormat  = "wave-contacts"
+	ContactBundleVersion = 1
+)
+
+// Strategies for imported contacts that are already listed
+const (
+	ContactImportSkip      = "skip"      // keep the listed contact as it is
+	ContactImportOverwrite = "overwrite" // take the nickname of the bundle
+)
+
+// csvSignaturePrefix starts the last line of a signed CSV bundle; the signature covers
+// every byte before that line
+const csvSignaturePrefix = "# signature="
+
+// maxInvalidReported bounds the invalid entries an import lists
+const maxInvalidReported = 20
+
+// BundledContact is a contact in a bundle
+type BundledContact struct {
+	PublicKey    string    `json:"public_key"`
+	Nickname     string    `json:"nickname"`
+	Verification string    `json:"verification,omitempty" doc:"unverified, verified or changed; only signed bundles carry verified contacts over"`
+	CreatedAt    time.Time `json:"created_at,omitzero"`
+}
+
+// ContactBundle is an exported contact list in JSON. As CSV the bundle is a header
+// comment, a public_key,nickname,verification,created_at table and a signature comment.
+type ContactBundle struct {
+	Format     string           `json:"format" doc:"always wave-contacts"`
+	Version    int              `json:"version"`
+	Username   string           `json:"username"`
+	ExportedAt time.Time        `json:"exported_at"`
+	Contacts   []BundledContact `json:"contacts"`
+	SignerKey  string           `json:"signer_key,omitempty" doc:"base64 Ed25519 public key of the node that exported the bundle"`
+	Signature  string           `json:"signature,omitempty" doc:"base64 Ed25519 signature of the bundle serialized without this field"`
+}
+
+// ExportContactsQuery selects the format of an export
+type ExportContactsQuery struct {
+	Format string `query:"format" validate:"oneof=json csv"` // json unless set
+}
+
+// ImportContactsQuery says what happens to imported contacts that are already listed
+type ImportContactsQuery struct {
+	Strategy string `query:"strategy" validate:"oneof=skip overwrite"` // skip unless set
+}
+
+// ExportContacts handles exporting the user's contacts as a signed bundle
+func ExportContacts(c *fiber.Ctx) error {
+	var query ExportContactsQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+
+	ctx := c.UserContext()
+	username := middleware.ExtractUsername(c)
+	contacts, err := loadContacts(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error loading contacts: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to load contacts"))
+	}
+
+	bundle := ContactBundle{
+		Format:     ContactBundleFormat,
+		Version:    ContactBundleVersion,
+		Username:   username,
+		ExportedAt: time.Now().UTC(),
+		Contacts:   make([]BundledContact, 0, len(contacts)),
+	}
+	for _, contact := range sortedContacts(contacts) {
+		bundle.Contacts = append(bundle.Contacts, BundledContact{
+			PublicKey:    contact.PublicKey,
+			Nickname:     contact.Nickname,
+			Verification: contact.Verification,
+			CreatedAt:    contact.CreatedAt,
+		})
+	}
+
+	var data []byte
+	extension := "json"
+	if query.Format == "csv" {
+		data, err = bundle.encodeCSV()
+		extension = "csv"
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	} else {
+		data, err = bundle.encodeJSON()
+		c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error encoding contact bundle: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to export contacts"))
+	}
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="wave-contacts-%s-%s.%s"`,
+		username, bundle.ExportedAt.Format("20060102"), extension))
+	return c.Status(fiber.StatusOK).Send(data)
+}
+
+// ImportContacts handles merging a bundle, JSON or CSV by Content-Type, into the user's
+// contacts. Bundles whose signature doesn't match are refused; unsigned ones, e.g.
+// written by other clients, are imported without verification states.
+func ImportContacts(c *fiber.Ctx) error {
+	var query ImportContactsQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+
+	var bundle *ContactBundle
+	var err error
+	switch {
+	case c.Is("json"):
+		bundle, err = decodeJSONBundle(c.Body())
+	case c.Is("csv"):
+		bundle, err = decodeCSVBundle(c.Body())
+	default:
+		return respondError(c, serviceError(fiber.StatusUnsupportedMediaType, "Content-Type must be application/json or text/csv"))
+	}
+	if err != nil {
+		return respondError(c, err)
+	}
+
+	result, err := MergeContacts(c.UserContext(), middleware.ExtractUsername(c), bundle, query.Strategy)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(result)
+}
+
+// MergeContacts adds the contacts of bundle to the user's list. Contacts already listed
+// are skipped, or get the bundle's nickname with the overwrite strategy; either way they
+// keep their verification state.
+func MergeContacts(ctx context.Context, username string, bundle *ContactBundle, strategy string) (*ContactImportResponse, error) {
+	existing, err := loadContacts(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error loading contacts: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to import contacts")
+	}
+
+	result := &ContactImportResponse{Success: true, Signed: bundle.Signature != ""}
+	if result.Signed && backupSigningKey != nil {
+		result.TrustedSigner = bundle.SignerKey == base64.StdEncoding.EncodeToString(backupSigningKey.Public().(ed25519.PublicKey))
+	}
+	seen := make(map[string]bool, len(bundle.Contacts))
+	for i, entry := range bundle.Contacts {
+		req := AddContactRequest{ContactPublicKey: entry.PublicKey, Nickname: entry.Nickname}
+		err := validateRequest(req)
+		if err == nil && entry.PublicKey == "" {
+			err = fieldError("contact_public_key", validate.CodeRequired, "is required")
+		}
+		if err != nil {
+			result.invalid(i, err.Error())
+			continue
+		}
+		if seen[entry.PublicKey] {
+			result.invalid(i, "public key listed twice")
+			continue
+		}
+		seen[entry.PublicKey] = true
+
+		current, listed := existing[entry.PublicKey]
+		switch {
+		case listed && (strategy != ContactImportOverwrite || current.Nickname == entry.Nickname):
+			result.Skipped++
+			continue
+		case listed:
+			result.Updated++
+		default:
+			result.Added++
+		}
+
+		contact := Contact{PublicKey: entry.PublicKey, Nickname: entry.Nickname, CreatedAt: entry.CreatedAt}
+		// A state someone could have edited into an unsigned bundle is not taken over
+		if !listed && result.Signed && entry.Verification == storage.ContactVerified {
+			contact.Verification = storage.ContactVerified
+		}
+		if err := contactStore.PutContact(ctx, username, contact); err != nil {
+			logging.Errorf(ctx, "Error importing contact: %v", err)
+			return nil, serviceError(fiber.StatusInternalServerError, "Failed to import contacts")
+		}
+		if !listed {
+			webhookDispatcher.Emit(ctx, username, webhooks.EventContactAdded, fiber.Map{"contact_public_key": contact.PublicKey})
+		}
+	}
+	if result.Added > 0 || result.Updated > 0 {
+		recordChange(ctx, username, models.ChangeContacts, "", "")
+	}
+	return result, nil
+}
+
+// invalid records an entry of the bundle that was not imported
+func (r *ContactImportResponse) invalid(index int, reason string) {
+	r.Invalid++
+	if len(r.InvalidEntries) < maxInvalidReported {
+		r.InvalidEntries = append(r.InvalidEntries, fmt.Sprintf("contacts[%d]: %s", index, reason))
+	}
+}
+
+// encodeJSON signs the bundle and serializes it
+func (b *ContactBundle) encodeJSON() ([]byte, error) {
+	b.SignerKey, b.Signature = "", ""
+	if backupSigningKey != nil {
+		b.SignerKey = base64.StdEncoding.EncodeToString(backupSigningKey.Public().(ed25519.PublicKey))
+		data, err := json.Marshal(b)
+		if err != nil {
+			return nil, err
+		}
+		b.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(backupSigningKey, data))
+	}
+	return json.MarshalIndent(b, "", "  ")
+}
+
+// encodeCSV writes the bundle as CSV, signed in a last comment line
+func (b *ContactBundle) encodeCSV() ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# format=%s version=%d username=%s exported_at=%s\n",
+		b.Format, b.Version, b.Username, b.ExportedAt.Format(time.RFC3339))
+	writer := csv.NewWriter(&buf)
+	if err := writer.Write([]string{"public_key", "nickname", "verification", "created_at"}); err != nil {
+		return nil, err
+	}
+	for _, contact := range b.Contacts {
+		createdAt := ""
+		if !contact.CreatedAt.IsZero() {
+			createdAt = contact.CreatedAt.UTC().Format(time.RFC3339Nano)
+		}
+		if err := writer.Write([]string{contact.PublicKey, contact.Nickname, contact.Verification, createdAt}); err != nil {
+			return nil, err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, err
+	}
+
+	if backupSigningKey != nil {
+		signerKey := base64.StdEncoding.EncodeToString(backupSigningKey.Public().(ed25519.PublicKey))
+		signature := base64.StdEncoding.EncodeToString(ed25519.Sign(backupSigningKey, buf.Bytes()))
+		fmt.Fprintf(&buf, "%s%s signer_key=%s\n", csvSignaturePrefix, signature, signerKey)
+	}
+	return buf.Bytes(), nil
+}
+
+// errInvalidBundleSignature is returned when importing a bundle altered since it was signed
+var errInvalidBundleSignature = fieldError("signature", validate.CodeFormat, "does not match the bundle, which was altered since it was exported")
+
+// decodeJSONBundle parses a JSON bundle and checks its signature
+func decodeJSONBundle(data []byte) (*ContactBundle, error) {
+	var bundle ContactBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fieldError("body", validate.CodeSyntax, "is not a JSON contact bundle: "+err.Error())
+	}
+	if bundle.Format != ContactBundleFormat {
+		return nil, fieldError("format", validate.CodeOneOf, "must be "+ContactBundleFormat)
+	}
+	if bundle.Version > ContactBundleVersion {
+		return nil, fieldError("version", validate.CodeMax, fmt.Sprintf("must be at most %d, update the node", ContactBundleVersion))
+	}
+	if bundle.Signature != "" {
+		unsigned := bundle
+		unsigned.Signature = ""
+		signed, err := json.Marshal(unsigned)
+		if err != nil || !verifyBundleSignature(bundle.SignerKey, bundle.Signature, signed) {
+			return nil, errInvalidBundleSignature
+		}
+	}
+	return &bundle, nil
+}
+
+// decodeCSVBundle parses a CSV bundle and checks its signature. Exports of other clients
+// are accepted too: comment lines are optional and only the public_key column required.
+func decodeCSVBundle(data []byte) (*ContactBundle, error) {
+	bundle := &ContactBundle{Format: ContactBundleFormat, Version: ContactBundleVersion}
+
+	body := data
+	if i := bytes.LastIndex(data, []byte("\n"+csvSignaturePrefix)); i >= 0 {
+		body = data[:i+1]
+		line := strings.TrimSpace(string(data[i+1+len(csvSignaturePrefix):]))
+		signature, signerKey, _ := strings.Cut(line, " signer_key=")
+		if !verifyBundleSignature(signerKey, signature, body) {
+			return nil, errInvalidBundleSignature
+		}
+		bundle.SignerKey, bundle.Signature = signerKey, signature
+	}
+
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return bundle, nil
+	}
+	if err != nil {
+		return nil, fieldError("body", validate.CodeSyntax, "is not CSV: "+err.Error())
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["public_key"]; !ok {
+		return nil, fieldError("body", validate.CodeRequired, "needs a public_key column")
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fieldError("body", validate.CodeSyntax, "is not CSV: "+err.Error())
+		}
+		contact := BundledContact{
+			PublicKey:    field(record, "public_key"),
+			Nickname:     field(record, "nickname"),
+			Verification: field(record, "verification"),
+		}
+		if createdAt := field(record, "created_at"); createdAt != "" {
+			if contact.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt); err != nil {
+				line, _ := reader.FieldPos(0)
+				return nil, fieldError("body", validate.CodeFormat, fmt.Sprintf("line %d: created_at must be an RFC 3339 timestamp", line))
+			}
+		}
+		bundle.Contacts = append(bundle.Contacts, contact)
+	}
+	return bundle, nil
+}
+
+// verifyBundleSignature checks a base64 Ed25519 signature of data by the base64 key
+func verifyBundleSignature(signerKey, signature string, data []byte) bool {
+	key, err := base64.StdEncoding.DecodeString(signerKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(key), data, sig)
+}
+
+// sortedContacts returns the contacts oldest first, as the contact stores list them
+func sortedContacts(contacts ContactsData) []Contact {
+	list := make([]Contact, 0, len(contacts))
+	for _, contact := range contacts {
+		list = append(list, contact)
+	}
+	slices.SortFunc(list, func(a, b Contact) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.PublicKey, b.PublicKey)
+	})
+	return list
+}
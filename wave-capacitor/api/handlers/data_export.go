@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+	"wave_capacitor/logging"
+	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+	"wave_capacitor/version"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Format and version of data exports; the version changes when a file is removed or
+// changes meaning, not when fields are added
+const (
+	DataExportFormat  = "wave-data-export"
+	DataExportVersion = 1
+)
+
+// exportDeliveryLimit bounds the delivery log exported per webhook; older attempts are
+// purged by the node anyway
+const exportDeliveryLimit = 1000
+
+// DataExportFile describes one file of a data export
+type DataExportFile struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// dataExportFiles lists the files of a data export in archive order, after export.json
+// and README.md
+var dataExportFiles = []DataExportFile{
+	{"account.json", "The account: username, public key, encrypted private key, creation and update times, whether and why it was disabled, when its tokens were last revoked and its former usernames"},
+	{"contacts.json", "The contact list, keyed by public key"},
+	{"messages.ndjson", "Every stored message sent to or by the account, one JSON object per line, still end-to-end encrypted"},
+	{"key_history.json", "Public keys the account used before rotating them, with the time each was valid"},
+	{"prekeys.json", "One-time prekeys not claimed yet and the signed prekey, as uploaded by the account's devices"},
+	{"sessions.json", "Ratchet session states stored by the account's devices, per device and peer, still encrypted by the devices. Logins are stateless tokens, so the node keeps no list of them"},
+	{"webhooks.json", "Registered webhooks without their secrets, each with its latest delivery attempts"},
+	{"stored_backups.json", "Backups the account stored on the node: label, size, checksum and time; the encrypted backups themselves are retrieved from the node"},
+	{"blocklist.json", "Public keys the account blocked, with the time each was blocked"},
+	{"discovery.json", "The blinded identifier the account opted in to contact discovery with and when, or null when it didn't"},
+	{"audit.ndjson", "The account's change log, one entry per line: messages added and deleted and contact list changes, oldest first, as far back as the node retains it"},
+}
+
+// DataExport is export.json, the first file of a data export
+type DataExport struct {
+	Format     string           `json:"format" doc:"always wave-data-export"`
+	Version    int              `json:"version"`
+	Username   string           `json:"username"`
+	ExportedAt time.Time        `json:"exported_at"`
+	Node       version.Info     `json:"node"`
+	Files      []DataExportFile `json:"files"`
+}
+
+// ExportedChange is one line of audit.ndjson
+type ExportedChange struct {
+	Seq       int64     `json:"seq"`
+	Kind      string    `json:"kind" doc:"message, message_deleted or contacts"`
+	MessageID string    `json:"message_id,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// ExportedWebhook is one entry of webhooks.json
+type ExportedWebhook struct {
+	models.Webhook
+	Deliveries []models.WebhookDelivery `json:"deliveries" doc:"newest first"`
+}
+
+// dataExportReadme is README.md, documenting the archive for whoever receives it
+const dataExportReadme = `# Wave data export
+
+This archive holds everything this Wave node stores about one account, as required for
+data access requests. It is meant to be read, not restored: use a backup to move an
+account to another node.
+
+export.json names the format (wave-data-export), its version, the account, the time of
+the export and the node's version, and lists the files below. All times are UTC in
+RFC 3339. Files ending in .ndjson hold one JSON object per line.
+
+Messages, session states and the private key are end-to-end encrypted by the account's
+devices; the node never had the keys to decrypt them, so they are exported as stored.
+
+`
+
+// ExportData streams a zip archive of everything the node holds about the user, in the
+// documented format of DataExportFormat. Unlike a backup it is not meant to be restored.
+// Messages are read as the client consumes them; an error cuts the archive short, which
+// fails to open.
+func ExportData(c *fiber.Ctx) error {
+	ctx := c.UserContext()
+	username := middleware.ExtractUsername(c)
+
+	account, err := models.GetAccountRecord(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving account for data export: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to retrieve user information"))
+	}
+	user, err := models.GetUser(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving user for data export: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to retrieve user information"))
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		err := writeDataExport(ctx, writer, account, user)
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			logging.Errorf(ctx, "Error streaming data export: %v", err)
+		}
+		writer.CloseWithError(err)
+	}()
+
+	now := time.Now().UTC()
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="wave-export-%s-%s.zip"`, username, now.Format("20060102")))
+	return c.SendStream(reader)
+}
+
+// writeDataExport writes the archive's files in the order of dataExportFiles
+func writeDataExport(ctx context.Context, w io.Writer, account *models.AccountRecord, user *models.User) error {
+	buffered := bufio.NewWriterSize(w, 64*1024)
+	archive := zip.NewWriter(buffered)
+
+	export := DataExport{
+		Format:     DataExportFormat,
+		Version:    DataExportVersion,
+		Username:   account.Username,
+		ExportedAt: time.Now().UTC(),
+		Node:       version.Get(),
+		Files:      dataExportFiles,
+	}
+	if err := writeExportJSON(archive, "export.json", export); err != nil {
+		return err
+	}
+	readme, err := archive.Create("README.md")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(readme, dataExportReadme); err != nil {
+		return err
+	}
+	for _, file := range dataExportFiles {
+		fmt.Fprintf(readme, "- %s: %s\n", file.Name, file.Description)
+	}
+
+	if err := writeExportJSON(archive, "account.json", account); err != nil {
+		return err
+	}
+
+	contacts, err := loadContacts(ctx, user.Username)
+	if err != nil {
+		return fmt.Errorf("contacts: %v", err)
+	}
+	if err := writeExportJSON(archive, "contacts.json", contacts); err != nil {
+		return err
+	}
+
+	messages, err := archive.Create("messages.ndjson")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(messages)
+	err = eachMessage(ctx, user, func(message Message) error {
+		return encoder.Encode(message)
+	})
+	if err != nil {
+		return fmt.Errorf("messages: %v", err)
+	}
+
+	history, err := models.GetKeyHistory(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	if err := writeExportJSON(archive, "key_history.json", history); err != nil {
+		return err
+	}
+
+	prekeys, err := models.ListStoredPrekeys(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	if err := writeExportJSON(archive, "prekeys.json", prekeys); err != nil {
+		return err
+	}
+
+	sessions, err := models.ListAllSessionBlobs(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	if err := writeExportJSON(archive, "sessions.json", sessions); err != nil {
+		return err
+	}
+
+	webhooks, err := models.ListWebhooks(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	exported := make([]ExportedWebhook, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		deliveries, err := models.ListWebhookDeliveries(ctx, webhook.ID, exportDeliveryLimit)
+		if err != nil {
+			return err
+		}
+		exported = append(exported, ExportedWebhook{Webhook: webhook, Deliveries: deliveries})
+	}
+	if err := writeExportJSON(archive, "webhooks.json", exported); err != nil {
+		return err
+	}
+
+	storedBackups, err := models.ListStoredBackups(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	if err := writeExportJSON(archive, "stored_backups.json", storedBackups); err != nil {
+		return err
+	}
+
+	blocked, err := models.ListBlockedKeys(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	if err := writeExportJSON(archive, "blocklist.json", blocked); err != nil {
+		return err
+	}
+
+	discovery, err := models.GetDiscoveryIdentity(ctx, user.Username)
+	if errors.Is(err, models.ErrNotDiscoverable) {
+		discovery, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := writeExportJSON(archive, "discovery.json", discovery); err != nil {
+		return err
+	}
+
+	audit, err := archive.Create("audit.ndjson")
+	if err != nil {
+		return err
+	}
+	encoder = json.NewEncoder(audit)
+	for after := int64(0); ; {
+		changes, err := models.ListChanges(ctx, user.Username, after, changeBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			err := encoder.Encode(ExportedChange{Seq: change.Seq, Kind: change.Kind, MessageID: change.MessageID, ChangedAt: change.ChangedAt.UTC()})
+			if err != nil {
+				return err
+			}
+			after = change.Seq
+		}
+		if len(changes) < changeBatchSize {
+			break
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+// writeExportJSON adds an indented JSON file to the archive
+func writeExportJSON(archive *zip.Writer, name string, value interface{}) error {
+	file, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
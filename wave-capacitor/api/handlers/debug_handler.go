@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	rpprof "runtime/pprof"
+	"strings"
+	"time"
+	"wave_capacitor/crashreport"
+	"wave_capacitor/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+)
+
+// startedAt is used to report the process uptime
+var startedAt = time.Now()
+
+// openConnections counts the open HTTP connections; set by SetConnectionCounter
+var openConnections func() int32
+
+// SetConnectionCounter configures how GetRuntimeStats counts open HTTP connections
+func SetConnectionCounter(count func() int32) {
+	openConnections = count
+}
+
+// RuntimeStats is a snapshot of the Go runtime of the node
+type RuntimeStats struct {
+	GoVersion     string  `json:"go_version"`
+	UptimeSeconds int64   `json:"uptime_seconds"`
+	NumCPU        int     `json:"num_cpu"`
+	GOMAXPROCS    int     `json:"gomaxprocs"`
+	Goroutines    int     `json:"goroutines"`
+	HeapAlloc     uint64  `json:"heap_alloc_bytes"`
+	HeapInuse     uint64  `json:"heap_inuse_bytes"`
+	HeapObjects   uint64  `json:"heap_objects"`
+	Sys           uint64  `json:"sys_bytes"`
+	NumGC         uint32  `json:"num_gc"`
+	LastGCPauseMs float64 `json:"last_gc_pause_ms"`
+	Panics        int64   `json:"panics" doc:"panics recovered while serving requests since the node started"`
+
+	OpenFDs         int   `json:"open_fds" doc:"-1 where the platform doesn't expose them"`
+	OpenConnections int32 `json:"open_connections" doc:"HTTP/1.1 connections; not counted when serving HTTP/2"`
+	WebhookQueue    int   `json:"webhook_queue" doc:"webhook deliveries waiting for a worker"`
+
+	FederationQueue           int   `json:"federation_queue" doc:"messages queued for capacitors that can't be reached"`
+	FederationQueueAgeSeconds int64 `json:"federation_queue_age_seconds" doc:"how long the oldest queued message has waited"`
+
+	UserCache   models.UserCacheStats    `json:"user_cache" doc:"accounts cached in process and the lookups they answered"`
+	WriteBehind []models.WriteBatchStats `json:"write_behind" doc:"updates queued to be written in batches, by kind, and how many were written, dropped or failed"`
+}
+
+// GetRuntimeStats reports goroutine, heap, GC, file descriptor, connection and queue
+// figures of the running node
+func GetRuntimeStats(c *fiber.Ctx) error {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	stats := RuntimeStats{
+		GoVersion:     runtime.Version(),
+		UptimeSeconds: int64(time.Since(startedAt).Seconds()),
+		NumCPU:        runtime.NumCPU(),
+		GOMAXPROCS:    runtime.GOMAXPROCS(0),
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAlloc:     mem.HeapAlloc,
+		HeapInuse:     mem.HeapInuse,
+		HeapObjects:   mem.HeapObjects,
+		Sys:           mem.Sys,
+		NumGC:         mem.NumGC,
+		Panics:        crashreport.Count(),
+		OpenFDs:       openFileDescriptors(),
+		WebhookQueue:  webhookDispatcher.QueueLength(),
+		UserCache:     models.GetUserCacheStats(),
+		WriteBehind:   models.GetWriteBehindStats(),
+	}
+	if openConnections != nil {
+		stats.OpenConnections = openConnections()
+	}
+	if federationQueue != nil {
+		if queued, err := federationQueueStats(); err == nil {
+			for _, destination := range queued {
+				stats.FederationQueue += destination.Depth
+				stats.FederationQueueAgeSeconds = max(stats.FederationQueueAgeSeconds, destination.OldestAgeSeconds)
+			}
+		}
+	}
+	if mem.NumGC > 0 {
+		stats.LastGCPauseMs = float64(mem.PauseNs[(mem.NumGC+255)%256]) / float64(time.Millisecond)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(RuntimeResponse{Success: true, Runtime: stats})
+}
+
+// openFileDescriptors counts the process's open file descriptors, or returns -1 where the
+// platform doesn't list them (Linux has /proc/self/fd, macOS and FreeBSD /dev/fd)
+func openFileDescriptors() int {
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		if entries, err := os.ReadDir(dir); err == nil {
+			// Reading the directory opened one more
+			return len(entries) - 1
+		}
+	}
+	return -1
+}
+
+// pprofHandlers are the net/http/pprof endpoints that are not named runtime profiles
+var pprofHandlers = map[string]http.Handler{
+	"":        http.HandlerFunc(pprof.Index),
+	"cmdline": http.HandlerFunc(pprof.Cmdline),
+	"profile": http.HandlerFunc(pprof.Profile),
+	"symbol":  http.HandlerFunc(pprof.Symbol),
+	"trace":   http.HandlerFunc(pprof.Trace),
+}
+
+// Pprof serves net/http/pprof below the debug route: the profile index, named profiles
+// (heap, goroutine, allocs, block, mutex, threadcreate), a CPU profile (profile?seconds=N)
+// and an execution trace. Fetch them with the admin token and inspect with go tool pprof:
+//
+//	curl -H "Authorization: Bearer $ADMIN_TOKEN" -o cpu.prof .../admin/debug/pprof/profile?seconds=30
+func Pprof(c *fiber.Ctx) error {
+	name := c.Params("profile")
+	if name == "" && !strings.HasSuffix(c.Path(), "/") {
+		// The index links to the profiles relative to the current path
+		return c.Redirect(c.Path()+"/", fiber.StatusMovedPermanently)
+	}
+
+	handler, ok := pprofHandlers[name]
+	if !ok {
+		if rpprof.Lookup(name) == nil {
+			return respondError(c, serviceError(fiber.StatusNotFound, "Unknown profile"))
+		}
+		handler = pprof.Handler(name)
+	}
+	return adaptor.HTTPHandler(handler)(c)
+}
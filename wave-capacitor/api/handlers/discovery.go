@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"wave_capacitor/api/validate"
+	"wave_capacitor/logging"
+	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+	"wave_capacitor/storage"
+	"wave_capacitor/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Users who opt in to discovery find the capacitor and public key of contacts who opted in
+// too, through the DHT, without any node answering who its users are. A user opts in with
+// a blinded identifier their client derives from something their contacts know them by
+// (see utils.DiscoveryIdentifier). A lookup publishes, for the pair of the user's
+// identifier and each contact's, a record sealed with a key only that pair derives under
+// a DHT key hashed from the pair, then reads the record the contact published for the
+// same pair; each side finds the other only once both looked each other up.
+//
+// Anyone who knows both identifiers can publish a record for their pair, so clients
+// compare safety numbers before trusting a key found this way.
+
+// DHTValues publishes values under 160-bit keys and finds them again; the DHT provides it
+type DHTValues interface {
+	StoreValue(ctx context.Context, key [20]byte, slot string, value []byte, ttl time.Duration) error
+	FindValues(ctx context.Context, key [20]byte) ([][]byte, error)
+}
+
+var (
+	discoveryNetwork   DHTValues // nil disables discovery
+	discoveryCapacitor string    // address published as the users' capacitor
+)
+
+// SetDiscovery configures the network discovery records are published on and the address
+// they give for this capacitor; a nil network disables discovery
+func SetDiscovery(network DHTValues, capacitor string) {
+	discoveryNetwork = network
+	discoveryCapacitor = capacitor
+}
+
+// errDiscoveryDisabled is returned by the discovery endpoints when the node has it off
+var errDiscoveryDisabled = serviceError(fiber.StatusNotImplemented, "Discovery is disabled on this node")
+
+// DiscoveryOptInRequest opts the user in to discovery
+type DiscoveryOptInRequest struct {
+	IdentifierHash string `json:"identifier_hash" validate:"required" doc:"hex SHA-256 of wave-discovery-id-v1, a NUL byte and the identifier, computed by the client"`
+}
+
+// DiscoveryLookupRequest names the contacts to look for
+type DiscoveryLookupRequest struct {
+	ContactHashes []string `json:"contact_hashes" validate:"required,max=50" doc:"Blinded identifiers of at most 50 contacts, computed like identifier_hash"`
+}
+
+// DiscoveryRecord is what a user publishes for one pair of identifiers, readable only by
+// someone who knows both
+type DiscoveryRecord struct {
+	IdentifierHash string    `json:"identifier_hash"`
+	PublicKey      string    `json:"public_key"`
+	Capacitor      string    `json:"capacitor" doc:"host:port of the capacitor holding the account"`
+	PublishedAt    time.Time `json:"published_at"`
+}
+
+// GetDiscovery reports whether the user opted in to discovery
+func GetDiscovery(c *fiber.Ctx) error {
+	if discoveryNetwork == nil {
+		return respondError(c, errDiscoveryDisabled)
+	}
+
+	ctx := c.UserContext()
+	identity, err := models.GetDiscoveryIdentity(ctx, middleware.ExtractUsername(c))
+	if err != nil && !errors.Is(err, models.ErrNotDiscoverable) {
+		logging.Errorf(ctx, "Error retrieving discovery identity: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to retrieve discovery status"))
+	}
+	return c.Status(fiber.StatusOK).JSON(DiscoveryResponse{
+		Success:        true,
+		OptedIn:        identity != nil,
+		Identity:       identity,
+		RecordTTLHours: discoveryTTLHours(),
+	})
+}
+
+// OptInDiscovery opts the user in to discovery, or changes the identifier they opted in with
+func OptInDiscovery(c *fiber.Ctx) error {
+	if discoveryNetwork == nil {
+		return respondError(c, errDiscoveryDisabled)
+	}
+	var req DiscoveryOptInRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+	if !validDiscoveryHash(req.IdentifierHash) {
+		return respondError(c, fieldError("identifier_hash", validate.CodeFormat, "must be 64 lowercase hex digits"))
+	}
+
+	ctx := c.UserContext()
+	identity, err := models.SetDiscoveryIdentity(ctx, middleware.ExtractUsername(c), req.IdentifierHash)
+	if err != nil {
+		logging.Errorf(ctx, "Error opting in to discovery: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to opt in to discovery"))
+	}
+	return c.Status(fiber.StatusOK).JSON(DiscoveryResponse{
+		Success:        true,
+		OptedIn:        true,
+		Identity:       identity,
+		RecordTTLHours: discoveryTTLHours(),
+	})
+}
+
+// OptOutDiscovery opts the user out of discovery. Records already published can't be
+// withdrawn and expire after DISCOVERY_TTL_HOURS.
+func OptOutDiscovery(c *fiber.Ctx) error {
+	if discoveryNetwork == nil {
+		return respondError(c, errDiscoveryDisabled)
+	}
+
+	ctx := c.UserContext()
+	err := models.DeleteDiscoveryIdentity(ctx, middleware.ExtractUsername(c))
+	if errors.Is(err, models.ErrNotDiscoverable) {
+		return respondError(c, serviceError(fiber.StatusNotFound, "Not opted in to discovery"))
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error opting out of discovery: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to opt out of discovery"))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+		"message": "Opted out of discovery successfully",
+	})
+}
+
+// LookupDiscovery publishes the user's record for each named contact and returns the
+// contacts that published theirs for the user. Keys the user blocked are left out.
+func LookupDiscovery(c *fiber.Ctx) error {
+	if discoveryNetwork == nil {
+		return respondError(c, errDiscoveryDisabled)
+	}
+	var req DiscoveryLookupRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+	for i, hash := range req.ContactHashes {
+		if !validDiscoveryHash(hash) {
+			return respondError(c, fieldError(fmt.Sprintf("contact_hashes[%d]", i), validate.CodeFormat, "must be 64 lowercase hex digits"))
+		}
+	}
+
+	ctx := c.UserContext()
+	username := middleware.ExtractUsername(c)
+	identity, err := models.GetDiscoveryIdentity(ctx, username)
+	if errors.Is(err, models.ErrNotDiscoverable) {
+		return respondError(c, serviceError(fiber.StatusConflict, "Opt in to discovery before looking up contacts"))
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving discovery identity: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to look up contacts"))
+	}
+	user, err := models.GetUser(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving user for discovery: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to look up contacts"))
+	}
+	record, err := json.Marshal(DiscoveryRecord{
+		IdentifierHash: identity.IdentifierHash,
+		PublicKey:      user.PublicKey,
+		Capacitor:      discoveryCapacitor,
+		PublishedAt:    time.Now().UTC(),
+	})
+	if err != nil {
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to look up contacts"))
+	}
+
+	response := DiscoveryLookupResponse{Success: true, Matches: []DiscoveryRecord{}}
+	seen := make(map[string]bool)
+	for _, hash := range req.ContactHashes {
+		if hash == identity.IdentifierHash || seen[hash] {
+			continue
+		}
+		seen[hash] = true
+
+		match, err := discoverPair(ctx, identity.IdentifierHash, hash, record)
+		if err != nil {
+			logging.Errorf(ctx, "Error looking up discovery pair: %v", err)
+			response.Failed++
+			continue
+		}
+		if match == nil {
+			response.Pending++
+			continue
+		}
+		if blocked, err := models.IsKeyBlocked(ctx, username, match.PublicKey); err != nil {
+			logging.Errorf(ctx, "Error checking blocklist: %v", err)
+		} else if blocked {
+			continue
+		}
+		response.Matches = append(response.Matches, *match)
+	}
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// discoverPair publishes record for the pair of own and contact, and returns the record
+// the contact published for it, or nil if it hasn't. Records that fail to open or name
+// another identifier are ignored; of several valid ones the latest wins.
+func discoverPair(ctx context.Context, own, contact string, record []byte) (*DiscoveryRecord, error) {
+	lookup, seal := utils.DiscoveryPairKeys(own, contact)
+	encryptor, err := storage.NewEncryptor(seal[:])
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := encryptor.Seal(record, lookup[:])
+	if err != nil {
+		return nil, err
+	}
+	ttl := time.Duration(discoveryTTLHours()) * time.Hour
+	if err := discoveryNetwork.StoreValue(ctx, lookup, utils.DiscoverySlot(seal, own), sealed, ttl); err != nil {
+		return nil, fmt.Errorf("error publishing discovery record: %v", err)
+	}
+
+	values, err := discoveryNetwork.FindValues(ctx, lookup)
+	if err != nil {
+		return nil, fmt.Errorf("error finding discovery records: %v", err)
+	}
+	var match *DiscoveryRecord
+	for _, value := range values {
+		// Open passes unsealed data through, which no pair member published
+		if !storage.IsEncrypted(value) {
+			continue
+		}
+		opened, err := encryptor.Open(value, lookup[:])
+		if err != nil {
+			continue
+		}
+		var found DiscoveryRecord
+		if err := json.Unmarshal(opened, &found); err != nil || found.IdentifierHash != contact || found.PublicKey == "" {
+			continue
+		}
+		if match == nil || found.PublishedAt.After(match.PublishedAt) {
+			match = &found
+		}
+	}
+	return match, nil
+}
+
+// validDiscoveryHash reports whether hash is a blinded identifier: a hex SHA-256 digest
+func validDiscoveryHash(hash string) bool {
+	decoded, err := hex.DecodeString(hash)
+	return err == nil && len(decoded) == 32 && hash == hex.EncodeToString(decoded)
+}
+
+// discoveryTTLHours returns how long published discovery records are kept
+func discoveryTTLHours() int {
+	if nodeConfig == nil {
+		return 168
+	}
+	return nodeConfig.DiscoveryTTLHours
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"wave_capacitor/doctor"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// doctorChecks are the diagnostics run by GET /api/admin/doctor, set at startup
+var doctorChecks []doctor.Check
+
+// SetDoctorChecks configures the diagnostics run by AdminDoctor
+func SetDoctorChecks(checks []doctor.Check) {
+	doctorChecks = checks
+}
+
+// AdminDoctor runs the node's diagnostics and reports each as pass, warn or fail. The
+// response is 200 whatever the results; the report's status is the worst of them.
+func AdminDoctor(c *fiber.Ctx) error {
+	if doctorChecks == nil {
+		return respondError(c, serviceError(fiber.StatusNotFound, "Diagnostics not available"))
+	}
+	report := doctor.Run(c.UserContext(), doctorChecks)
+	return c.Status(fiber.StatusOK).JSON(DoctorResponse{Success: true, Report: report})
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Polling clients send back the ETag of their last response in If-None-Match and get an
+// empty 304 while nothing changed. The tags are weak: they are derived from a cheap
+// version of the data (message IDs, the stored contact list) rather than the response bytes.
+
+// weakETag hashes the given parts into a weak entity tag
+func weakETag(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return `W/"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// notModified sets the ETag of the response and reports whether the request's
+// If-None-Match already names it, in which case the handler should answer 304
+func notModified(c *fiber.Ctx, etag string) bool {
+	c.Set(fiber.HeaderETag, etag)
+	// Responses are per account: let clients revalidate but keep shared caches out
+	c.Set(fiber.HeaderCacheControl, "private, no-cache")
+
+	header := c.Get(fiber.HeaderIfNoneMatch)
+	if header == "" {
+		return false
+	}
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	// If-None-Match uses the weak comparison, so the W/ prefix is ignored on both sides
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,417 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/api/validate"
+	"wave_capacitor/logging"
+	"wave_capacitor/models"
+	"wave_capacitor/nodehttp"
+	"wave_capacitor/storage"
+	"wave_capacitor/webhooks"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// A message for an account hosted on another capacitor is forwarded to it through
+// POST /federation/deliver, in an envelope the sending capacitor signs with its backup
+// signing key. The receiver only accepts the envelope when the route record of the
+// sender's public key (see routing.go) names that key, so a capacitor can only send for
+// the accounts it hosts, and answers with a receipt signed with its own key. Envelopes
+// are only taken from trusted capacitors (see node_auth.go).
+//
+// A capacitor that doesn't host the recipient relays the envelope to the one that does,
+// adding itself to the envelope's hops. An envelope that comes back to a capacitor it
+// passed through, or has been relayed maxFederationHops times, is refused.
+
+// maxFederationHops is how many times an envelope may be relayed
+const maxFederationHops = 3
+
+// federationMaxSkew is how far an envelope's sent_at may be from the receiver's clock
+const federationMaxSkew = 10 * time.Minute
+
+// federationClient forwards envelopes to other capacitors, and makes the other calls to
+// their node endpoints, over the transport shared with the DHT
+var federationClient = nodehttp.NewClient(30 * time.Second)
+
+// federationScheme is the scheme of other capacitors' APIs, as published in route records
+// without one
+var federationScheme = "https://"
+
+// SetFederationTLS selects whether other capacitors are reached over HTTPS, as they are
+// unless it is turned off
+func SetFederationTLS(useTLS bool) {
+	federationScheme = "http://"
+	if useTLS {
+		federationScheme = "https://"
+	}
+}
+
+// SetNodeTLS makes requests to other capacitors' node endpoints, shard transfers included,
+// present this node's certificate for mutual TLS; call it before the server starts
+func SetNodeTLS(config *tls.Config) {
+	nodehttp.SetTLS(config)
+	transferTransport.TLSClientConfig = config
+}
+
+// errFederationDisabled is returned by the federation endpoints when the node has it off
+var errFederationDisabled = serviceError(fiber.StatusNotImplemented, "Federation is disabled on this node")
+
+// FederatedMessage is the envelope of a message forwarded between capacitors
+type FederatedMessage struct {
+	Message   Message   `json:"message"`
+	Origin    string    `json:"origin" validate:"required" doc:"host:port of the sending capacitor"`
+	SentAt    time.Time `json:"sent_at" validate:"required"`
+	SignerKey string    `json:"signer_key" validate:"required" doc:"base64 Ed25519 public key of the sending capacitor"`
+	Signature string    `json:"signature" validate:"required" doc:"base64 Ed25519 signature of the envelope serialized without this field and hops"`
+	Hops      []string  `json:"hops,omitempty" doc:"Signer keys of the capacitors that relayed the envelope"`
+}
+
+// FederationReceipt acknowledges that the recipient's capacitor took a message
+type FederationReceipt struct {
+	MessageID          string    `json:"message_id"`
+	RecipientPublicKey string    `json:"recipient_public_key"`
+	Capacitor          string    `json:"capacitor" doc:"host:port of the recipient's capacitor"`
+	ReceivedAt         time.Time `json:"received_at"`
+	Duplicate          bool      `json:"duplicate,omitempty" doc:"The message had been received before"`
+	SignerKey          string    `json:"signer_key" doc:"base64 Ed25519 public key of the recipient's capacitor"`
+	Signature          string    `json:"signature" doc:"base64 Ed25519 signature of the receipt serialized without this field"`
+}
+
+// federationError is a failure answered by another capacitor
+type federationError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *federationError) Error() string {
+	return fmt.Sprintf("capacitor answered %d: %s", e.Status, e.Message)
+}
+
+// federationEnabled reports whether messages are forwarded to and accepted from other
+// capacitors
+func federationEnabled() bool {
+	return nodeConfig == nil || nodeConfig.FederationEnabled
+}
+
+// DeliverFederated accepts a message another capacitor forwards for an account hosted
+// here, or relays it to the capacitor hosting the account
+func DeliverFederated(c *fiber.Ctx) error {
+	if !federationEnabled() {
+		return respondError(c, errFederationDisabled)
+	}
+	var envelope FederatedMessage
+	if err := parseBody(c, &envelope); err != nil {
+		return respondError(c, err)
+	}
+	if !nodeTrusted(c, envelope.SignerKey) {
+		return respondError(c, errNodeNotTrusted)
+	}
+
+	receipt, err := acceptFederated(c.UserContext(), envelope)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(FederationDeliverResponse{Success: true, Receipt: *receipt})
+}
+
+// acceptFederated checks an envelope and delivers its message to the recipient hosted
+// here, or relays it
+func acceptFederated(ctx context.Context, envelope FederatedMessage) (*FederationReceipt, error) {
+	own := ownSignerKey()
+	if own == "" {
+		return nil, serviceError(fiber.StatusNotImplemented, "This node has no signing key for federation")
+	}
+	if envelope.SignerKey == own || slices.Contains(envelope.Hops, own) {
+		return nil, codedError(fiber.StatusLoopDetected, apierror.FederationLoop, "The message already passed through this capacitor")
+	}
+	if len(envelope.Hops) >= maxFederationHops {
+		return nil, codedError(fiber.StatusLoopDetected, apierror.FederationLoop, "The message was relayed too many times")
+	}
+	if skew := time.Since(envelope.SentAt); skew > federationMaxSkew || skew < -federationMaxSkew {
+		return nil, serviceError(fiber.StatusBadRequest, "sent_at is too far from this capacitor's clock")
+	}
+	message := envelope.Message
+	if _, err := uuid.Parse(message.MessageID); err != nil {
+		return nil, fieldError("message.message_id", validate.CodeFormat, "must be a UUID")
+	}
+	if message.SenderPublicKey == "" || message.RecipientPublicKey == "" || message.CiphertextMsg == "" {
+		return nil, serviceError(fiber.StatusBadRequest, "The message is incomplete")
+	}
+	if !envelope.valid() {
+		return nil, serviceError(fiber.StatusUnauthorized, "Invalid envelope signature")
+	}
+	if err := routedTo(ctx, message.SenderPublicKey, envelope.SignerKey); err != nil {
+		return nil, err
+	}
+
+	recipient, err := models.GetUserByPublicKey(ctx, message.RecipientPublicKey)
+	if errors.Is(err, models.ErrUserNotFound) {
+		return relayFederated(ctx, envelope)
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving federated recipient: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to deliver message")
+	}
+
+	// Retries of an envelope are acknowledged again without storing the message twice
+	if _, err := messageStore.Read(message.RecipientPublicKey, message.MessageID); err == nil {
+		return newReceipt(message, true)
+	} else if !errors.Is(err, storage.ErrMessageNotFound) {
+		logging.Errorf(ctx, "Error checking for federated message %s: %v", message.MessageID, err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to deliver message")
+	}
+
+	blocked, err := models.IsKeyBlocked(ctx, recipient.Username, message.SenderPublicKey)
+	if err != nil {
+		logging.Errorf(ctx, "Error checking recipient blocklist: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to deliver message")
+	}
+	if blocked {
+		if rejectBlockedMessages() {
+			return nil, codedError(fiber.StatusForbidden, apierror.Forbidden, "The recipient does not accept messages from the sender")
+		}
+		return newReceipt(message, false)
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to process message")
+	}
+	if err := storeRecipientCopy(ctx, message, data); err != nil {
+		return nil, err
+	}
+	return newReceipt(message, false)
+}
+
+// routedTo checks that the route record of publicKey names the capacitor signing with
+// signerKey, e.g. the sender of a forwarded message. A cached route that disagrees is
+// looked up again, in case the account moved.
+func routedTo(ctx context.Context, publicKey, signerKey string) error {
+	for attempt := 0; attempt < 2; attempt++ {
+		route, source, err := LookupRoute(ctx, publicKey)
+		if errors.Is(err, ErrRouteNotFound) {
+			return serviceError(fiber.StatusForbidden, "No capacitor hosts the public key")
+		}
+		if err != nil {
+			logging.Errorf(ctx, "Error looking up route: %v", err)
+			return serviceError(fiber.StatusInternalServerError, "Failed to authenticate capacitor")
+		}
+		if source == RouteLocal {
+			return serviceError(fiber.StatusForbidden, "The public key is hosted on this capacitor")
+		}
+		if route.SignerKey == signerKey {
+			return nil
+		}
+		if source != RouteCache {
+			break
+		}
+		forgetRoute(publicKey)
+	}
+	return serviceError(fiber.StatusForbidden, "The public key is not hosted by the signing capacitor")
+}
+
+// relayFederated forwards an envelope for an account not hosted here to the capacitor
+// hosting it
+func relayFederated(ctx context.Context, envelope FederatedMessage) (*FederationReceipt, error) {
+	route, source, err := LookupRoute(ctx, envelope.Message.RecipientPublicKey)
+	if errors.Is(err, ErrRouteNotFound) || (err == nil && source == RouteLocal) {
+		return nil, serviceError(fiber.StatusNotFound, "No capacitor hosts the recipient")
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error looking up route of federated recipient: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to deliver message")
+	}
+
+	envelope.Hops = append(envelope.Hops, ownSignerKey())
+	receipt, err := sendEnvelope(ctx, route, envelope)
+	if err != nil {
+		return nil, forwardingError(ctx, err)
+	}
+	return receipt, nil
+}
+
+// storeRecipientCopy stores a message for its recipient, hosted here, and lets the
+// recipient's devices and webhooks know
+func storeRecipientCopy(ctx context.Context, message Message, data []byte) error {
+	hash, err := storeWrite(ctx, message.RecipientPublicKey, message.MessageID, data)
+	if err != nil {
+		logging.Errorf(ctx, "Error writing recipient message: %v", err)
+		if errors.Is(err, storage.ErrInsufficientStorage) {
+			return errInsufficientStorage
+		}
+		return serviceError(fiber.StatusInternalServerError, "Failed to store message for recipient")
+	}
+
+	messagesDelivered.Add(1)
+	indexMessage(ctx, message.RecipientPublicKey, message.MessageID, message.Timestamp, len(data), hash)
+	recordKeyChange(ctx, message.RecipientPublicKey, models.ChangeMessageAdded, message.MessageID)
+	webhookDispatcher.EmitForKey(ctx, message.RecipientPublicKey, webhooks.EventMessageReceived, fiber.Map{
+		"message_id":           message.MessageID,
+		"sender_public_key":    message.SenderPublicKey,
+		"recipient_public_key": message.RecipientPublicKey,
+		"timestamp":            message.Timestamp,
+	})
+	return nil
+}
+
+// remoteRoute returns the route of a recipient hosted on another capacitor, or nil when
+// the recipient is hosted here, no capacitor claims it or federation is off
+func remoteRoute(ctx context.Context, publicKey string) (*RouteRecord, error) {
+	if !federationEnabled() {
+		return nil, nil
+	}
+	route, source, err := LookupRoute(ctx, publicKey)
+	if errors.Is(err, ErrRouteNotFound) || (err == nil && source == RouteLocal) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return route, nil
+}
+
+// forwardMessage sends a message to the capacitor hosting its recipient and returns the
+// checked receipt
+func forwardMessage(ctx context.Context, route *RouteRecord, message Message) (*FederationReceipt, error) {
+	envelope := FederatedMessage{Message: message, Origin: routeCapacitor, SentAt: time.Now().UTC()}
+	if err := envelope.sign(); err != nil {
+		return nil, err
+	}
+	return sendEnvelope(ctx, route, envelope)
+}
+
+// sendEnvelope posts an envelope to the capacitor of route and returns its receipt once
+// the signature checks out. A receipt signed by another capacitor than the route names
+// means the recipient moved; the cached route is dropped so the next lookup finds it.
+func sendEnvelope(ctx context.Context, route *RouteRecord, envelope FederatedMessage) (*FederationReceipt, error) {
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := federationScheme + strings.TrimSuffix(route.Capacitor, "/") + "/api/v1/federation/deliver"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	logging.Propagate(ctx, req.Header)
+
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure apierror.Response
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&failure)
+		return nil, &federationError{Status: resp.StatusCode, Code: failure.Code, Message: failure.Message}
+	}
+
+	var result FederationDeliverResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding receipt: %v", err)
+	}
+	receipt := result.Receipt
+	if receipt.MessageID != envelope.Message.MessageID || receipt.RecipientPublicKey != envelope.Message.RecipientPublicKey || !receipt.valid() {
+		return nil, errors.New("capacitor answered with an invalid receipt")
+	}
+	if receipt.SignerKey != route.SignerKey {
+		forgetRoute(envelope.Message.RecipientPublicKey)
+	}
+	return &receipt, nil
+}
+
+// forwardingError turns a failure to forward a message into the error answered to the
+// sender: refusals of the recipient's capacitor are passed on, anything else is a 502
+func forwardingError(ctx context.Context, err error) error {
+	var remote *federationError
+	if errors.As(err, &remote) {
+		switch remote.Status {
+		case fiber.StatusForbidden, fiber.StatusNotFound, fiber.StatusRequestEntityTooLarge, fiber.StatusInsufficientStorage, fiber.StatusLoopDetected:
+			return codedError(remote.Status, remote.Code, "Recipient's capacitor refused the message: "+remote.Message)
+		}
+	}
+	logging.Errorf(ctx, "Error forwarding message: %v", err)
+	return codedError(fiber.StatusBadGateway, apierror.UpstreamUnavailable, "The recipient's capacitor could not be reached, please try again later")
+}
+
+// newReceipt returns the signed receipt of a message received here
+func newReceipt(message Message, duplicate bool) (*FederationReceipt, error) {
+	receipt := FederationReceipt{
+		MessageID:          message.MessageID,
+		RecipientPublicKey: message.RecipientPublicKey,
+		Capacitor:          routeCapacitor,
+		ReceivedAt:         time.Now().UTC(),
+		Duplicate:          duplicate,
+		SignerKey:          ownSignerKey(),
+	}
+	data, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, err
+	}
+	receipt.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(backupSigningKey, data))
+	return &receipt, nil
+}
+
+// valid reports whether the receipt carries a matching signature
+func (r FederationReceipt) valid() bool {
+	if r.Signature == "" {
+		return false
+	}
+	signature := r.Signature
+	r.Signature = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return false
+	}
+	return verifyBundleSignature(r.SignerKey, signature, data)
+}
+
+// sign signs the envelope with the node's backup signing key
+func (e *FederatedMessage) sign() error {
+	if backupSigningKey == nil {
+		return errors.New("no signing key for federation")
+	}
+	e.SignerKey = ownSignerKey()
+	data, err := e.signedData()
+	if err != nil {
+		return err
+	}
+	e.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(backupSigningKey, data))
+	return nil
+}
+
+// valid reports whether the envelope carries a matching signature
+func (e FederatedMessage) valid() bool {
+	if e.Signature == "" {
+		return false
+	}
+	data, err := e.signedData()
+	if err != nil {
+		return false
+	}
+	return verifyBundleSignature(e.SignerKey, e.Signature, data)
+}
+
+// signedData returns what the envelope's signature covers: everything but the signature
+// and the hops relays add
+func (e FederatedMessage) signedData() ([]byte, error) {
+	e.Signature = ""
+	e.Hops = nil
+	return json.Marshal(e)
+}
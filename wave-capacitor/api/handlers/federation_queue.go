@@ -0,0 +1,346 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wave_capacitor/logging"
+	"wave_capacitor/models"
+	"wave_capacitor/outbox"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// A message for a capacitor that can't be reached is queued on disk for it (see the
+// outbox package) and the sender told it was queued, so a network partition doesn't lose
+// messages this capacitor accepted. The queue of each capacitor is sent in order, high
+// priority first, and stays untouched after a failure until its backoff passes; messages
+// sent while a capacitor backs off are queued behind the others. Envelopes are signed
+// again when sent, so a queued message isn't refused for an old sent_at. Messages left
+// undelivered for FEDERATION_QUEUE_MAX_AGE_HOURS are dropped. The queue of a capacitor is
+// bounded (FEDERATION_QUEUE_MAX_DEPTH, FEDERATION_QUEUE_MAX_MB): once full, messages for
+// it are refused with a 502 as if queueing were off, so one dead capacitor can't fill the disk.
+//
+// Relays don't queue: a capacitor relaying an envelope answers the failure, and the
+// message stays in the queue of its origin.
+
+const (
+	// federationQueueInterval is how often the queue is looked at for capacitors to retry
+	federationQueueInterval = 2 * time.Second
+
+	// federationQueueBatch is how many queued messages of a capacitor are read at a time
+	federationQueueBatch = 100
+
+	// federationBackoffMin and federationBackoffMax bound how long a capacitor that
+	// couldn't be reached is left alone, doubling from the first to the second
+	federationBackoffMin = 5 * time.Second
+	federationBackoffMax = 5 * time.Minute
+)
+
+var (
+	federationQueue       *outbox.Queue // nil answers unreachable capacitors with 502
+	federationQueueMaxAge time.Duration
+
+	federationBackoffMu sync.Mutex
+	federationBackoff   = make(map[string]backoffState) // by capacitor
+
+	federationQueueExpired atomic.Int64
+)
+
+// backoffState is when an unreachable capacitor is tried again, and how long it waited
+type backoffState struct {
+	until time.Time
+	delay time.Duration
+}
+
+// SetFederationQueue queues the messages for unreachable capacitors in queue, dropping
+// those still undelivered after maxAge; nil disables queueing
+func SetFederationQueue(queue *outbox.Queue, maxAge time.Duration) {
+	federationQueue = queue
+	federationQueueMaxAge = maxAge
+}
+
+// FederationQueueExpired returns how many queued messages were dropped undelivered
+func FederationQueueExpired() int64 {
+	return federationQueueExpired.Load()
+}
+
+// FederationQueueDestination is the queue of one capacitor
+type FederationQueueDestination struct {
+	Capacitor        string     `json:"capacitor"`
+	Depth            int        `json:"depth" doc:"Messages queued"`
+	OldestAgeSeconds int64      `json:"oldest_age_seconds" doc:"How long the oldest message has been queued"`
+	RetryAt          *time.Time `json:"retry_at,omitempty" doc:"When the capacitor is tried again, while it backs off"`
+}
+
+// federationQueueStats returns the queue of every capacitor with messages queued
+func federationQueueStats() ([]FederationQueueDestination, error) {
+	stats, err := federationQueue.Stats()
+	if err != nil {
+		return nil, err
+	}
+
+	federationBackoffMu.Lock()
+	defer federationBackoffMu.Unlock()
+	destinations := make([]FederationQueueDestination, 0, len(stats))
+	for _, entry := range stats {
+		destination := FederationQueueDestination{
+			Capacitor:        entry.Destination,
+			Depth:            entry.Depth,
+			OldestAgeSeconds: int64(time.Since(entry.OldestAt).Seconds()),
+		}
+		if backoff, ok := federationBackoff[entry.Destination]; ok && time.Now().Before(backoff.until) {
+			retryAt := backoff.until
+			destination.RetryAt = &retryAt
+		}
+		destinations = append(destinations, destination)
+	}
+	return destinations, nil
+}
+
+// GetFederationQueue reports the messages queued for unreachable capacitors
+func GetFederationQueue(c *fiber.Ctx) error {
+	if federationQueue == nil {
+		return respondError(c, serviceError(fiber.StatusNotImplemented, "The federation queue is disabled on this node"))
+	}
+	destinations, err := federationQueueStats()
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error reading federation queue: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to read the federation queue"))
+	}
+	return c.Status(fiber.StatusOK).JSON(FederationQueueResponse{
+		Success:      true,
+		Destinations: destinations,
+		Expired:      FederationQueueExpired(),
+	})
+}
+
+// forwardOrQueue forwards a message to the capacitor of route, or queues it when the
+// capacitor can't be reached. It returns the receipt of a forwarded message, nil for a
+// queued one.
+func forwardOrQueue(ctx context.Context, route *RouteRecord, message Message, priority outbox.Priority) (*FederationReceipt, error) {
+	if federationQueue != nil && backingOff(route.Capacitor) {
+		return nil, queueMessage(ctx, route.Capacitor, message, priority)
+	}
+	receipt, err := forwardMessage(ctx, route, message)
+	if err == nil {
+		return receipt, nil
+	}
+	if federationQueue == nil || refusedByCapacitor(err) {
+		return nil, forwardingError(ctx, err)
+	}
+
+	logging.Warnf(ctx, "Queueing message %s, %s can't be reached: %v", message.MessageID, route.Capacitor, err)
+	backOff(route.Capacitor)
+	return nil, queueMessage(ctx, route.Capacitor, message, priority)
+}
+
+// queueMessage queues a message for capacitor
+func queueMessage(ctx context.Context, capacitor string, message Message, priority outbox.Priority) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return serviceError(fiber.StatusInternalServerError, "Failed to process message")
+	}
+	err = federationQueue.Enqueue(capacitor, priority, message.MessageID, data)
+	if errors.Is(err, outbox.ErrFull) {
+		logging.Warnf(ctx, "Refusing message %s, the queue of %s is full: %v", message.MessageID, capacitor, err)
+		return serviceError(fiber.StatusBadGateway, "The recipient's capacitor could not be reached and has too many messages queued, please try again later")
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error queueing message %s: %v", message.MessageID, err)
+		return serviceError(fiber.StatusBadGateway, "The recipient's capacitor could not be reached, please try again later")
+	}
+	return nil
+}
+
+// refusedByCapacitor reports whether a capacitor answered a forwarded message with a
+// refusal that sending it again won't change, as opposed to being unreachable or failing
+func refusedByCapacitor(err error) bool {
+	var remote *federationError
+	return errors.As(err, &remote) && (remote.Status < 500 || remote.Status == fiber.StatusLoopDetected)
+}
+
+// backingOff reports whether capacitor failed recently and isn't to be tried yet
+func backingOff(capacitor string) bool {
+	federationBackoffMu.Lock()
+	defer federationBackoffMu.Unlock()
+	backoff, ok := federationBackoff[capacitor]
+	return ok && time.Now().Before(backoff.until)
+}
+
+// backOff leaves capacitor alone for twice as long as after its previous failure
+func backOff(capacitor string) {
+	federationBackoffMu.Lock()
+	defer federationBackoffMu.Unlock()
+	delay := min(max(federationBackoff[capacitor].delay*2, federationBackoffMin), federationBackoffMax)
+	federationBackoff[capacitor] = backoffState{until: time.Now().Add(delay), delay: delay}
+}
+
+// reachable forgets the failures of capacitor
+func reachable(capacitor string) {
+	federationBackoffMu.Lock()
+	defer federationBackoffMu.Unlock()
+	delete(federationBackoff, capacitor)
+}
+
+// drainFederationQueue sends the queued messages of every capacitor not backing off and
+// drops the messages queued for longer than FEDERATION_QUEUE_MAX_AGE_HOURS
+func drainFederationQueue(ctx context.Context) {
+	expired, err := federationQueue.Expire(time.Now().Add(-federationQueueMaxAge))
+	for _, item := range expired {
+		logging.Warnf(ctx, "Dropped message %s queued for %s since %s, %d attempts: %s",
+			item.ID, item.Destination, item.QueuedAt.Format(time.RFC3339), item.Attempts, item.LastError)
+	}
+	federationQueueExpired.Add(int64(len(expired)))
+	if err != nil {
+		logging.Errorf(ctx, "Error expiring federation queue: %v", err)
+	}
+
+	destinations, err := federationQueue.Destinations()
+	if err != nil {
+		logging.Errorf(ctx, "Error reading federation queue: %v", err)
+		return
+	}
+	for _, capacitor := range destinations {
+		if ctx.Err() != nil {
+			return
+		}
+		if !backingOff(capacitor) {
+			drainDestination(ctx, capacitor)
+		}
+	}
+}
+
+// drainDestination sends the queued messages of capacitor in order, stopping at the
+// first it can't reach capacitor with
+func drainDestination(ctx context.Context, capacitor string) {
+	for {
+		items, err := federationQueue.Pending(capacitor, federationQueueBatch)
+		if err != nil {
+			logging.Errorf(ctx, "Error reading federation queue of %s: %v", capacitor, err)
+			return
+		}
+		for _, item := range items {
+			if ctx.Err() != nil {
+				return
+			}
+			if !sendQueued(ctx, item) {
+				backOff(capacitor)
+				return
+			}
+		}
+		if len(items) < federationQueueBatch {
+			if len(items) > 0 {
+				reachable(capacitor)
+			}
+			return
+		}
+	}
+}
+
+// sendQueued sends a queued message, or hands it to the capacitor now hosting its
+// recipient. It returns false when the capacitor couldn't be reached, leaving the message
+// queued.
+func sendQueued(ctx context.Context, item outbox.Item) bool {
+	var message Message
+	if err := json.Unmarshal(item.Payload, &message); err != nil {
+		logging.Errorf(ctx, "Dropping unreadable queued message %s: %v", item.ID, err)
+		return federationQueue.Done(item) == nil
+	}
+
+	route, err := remoteRoute(ctx, message.RecipientPublicKey)
+	if err != nil {
+		logging.Warnf(ctx, "Error looking up route of queued message %s: %v", item.ID, err)
+		return false
+	}
+	if route == nil {
+		return deliverQueuedLocally(ctx, item, message)
+	}
+	if route.Capacitor != item.Destination {
+		if err := federationQueue.Move(item, route.Capacitor); err != nil {
+			logging.Errorf(ctx, "Error moving queued message %s to %s: %v", item.ID, route.Capacitor, err)
+			return false
+		}
+		logging.Infof(ctx, "Queued message %s moved to %s, its recipient's capacitor", item.ID, route.Capacitor)
+		return true
+	}
+
+	receipt, err := forwardMessage(ctx, route, message)
+	switch {
+	case err == nil:
+		logging.Infof(ctx, "Delivered queued message %s to %s after %s", item.ID, receipt.Capacitor, time.Since(item.QueuedAt).Round(time.Second))
+	case refusedByCapacitor(err):
+		logging.Warnf(ctx, "Dropping queued message %s, %s refused it: %v", item.ID, item.Destination, err)
+	default:
+		if err := federationQueue.Failed(item, err); err != nil {
+			logging.Errorf(ctx, "Error recording failure of queued message %s: %v", item.ID, err)
+		}
+		return false
+	}
+	if err := federationQueue.Done(item); err != nil {
+		logging.Errorf(ctx, "Error removing queued message %s: %v", item.ID, err)
+	}
+	return true
+}
+
+// deliverQueuedLocally stores a queued message whose recipient is no longer routed to
+// another capacitor: hosted here now, or gone, in which case the message is dropped as
+// it is when the recipient blocked the sender
+func deliverQueuedLocally(ctx context.Context, item outbox.Item, message Message) bool {
+	recipient, err := models.GetUserByPublicKey(ctx, message.RecipientPublicKey)
+	if err != nil && !errors.Is(err, models.ErrUserNotFound) {
+		logging.Errorf(ctx, "Error retrieving recipient of queued message %s: %v", item.ID, err)
+		return false
+	}
+	blocked := false
+	if recipient != nil {
+		if blocked, err = models.IsKeyBlocked(ctx, recipient.Username, message.SenderPublicKey); err != nil {
+			logging.Errorf(ctx, "Error checking recipient blocklist: %v", err)
+			return false
+		}
+	}
+	if recipient == nil {
+		logging.Warnf(ctx, "Dropping queued message %s, no capacitor hosts its recipient any more", item.ID)
+	} else if !blocked {
+		data, err := json.Marshal(message)
+		if err != nil {
+			return false
+		}
+		if err := storeRecipientCopy(ctx, message, data); err != nil {
+			return false
+		}
+	}
+	if err := federationQueue.Done(item); err != nil {
+		logging.Errorf(ctx, "Error removing queued message %s: %v", item.ID, err)
+	}
+	return true
+}
+
+// StartFederationQueue sends the queued messages until the returned function is called,
+// which cancels the sending in progress
+func StartFederationQueue() (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(federationQueueInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				drainFederationQueue(ctx)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
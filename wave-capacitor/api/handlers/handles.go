@@ -0,0 +1,485 @@
+package handlers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/api/validate"
+	"wave_capacitor/logging"
+	"wave_capacitor/models"
+	"wave_capacitor/nodehttp"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// A handle addresses an account as username@domain, like an email address. The domain is
+// the capacitor hosting the account: its host:port, or the HANDLE_DOMAIN, that the
+// capacitor publishes to the DHT in signed domain records, or a domain serving the
+// capacitor's host:port at https://<domain>/.well-known/wave-capacitor. A domain record
+// for a HANDLE_DOMAIN is only believed when the domain resolves to the capacitor's host.
+// The capacitor answers GET /federation/handle with the account's public key in a record
+// it signs, naming itself, and that key's route record (see routing.go) must name the
+// same capacitor, so a capacitor can only answer for the accounts it hosts.
+//
+// Handles come from users, so the hosts they name are only reached at public addresses
+// (see nodehttp.NewPublicClient), never at this node's loopback or private network.
+
+// handleCacheMaxEntries bounds the cache of resolved handles; it is emptied when full
+const handleCacheMaxEntries = 10000
+
+// handleWellKnownPath is where a domain serves the address of the capacitor of its handles
+const handleWellKnownPath = "/.well-known/wave-capacitor"
+
+// handleClient reaches the hosts handles name, at public addresses only
+var handleClient = nodehttp.NewPublicClient(30 * time.Second)
+
+var (
+	handleDomain string // domain of the handles of this capacitor's accounts, besides its address
+
+	handleCacheMu sync.Mutex
+	handleCache   = make(map[string]cachedHandle)
+)
+
+type cachedHandle struct {
+	resolved  ResolvedHandle
+	fetchedAt time.Time
+}
+
+// errHandleNotFound is returned for handles no account has
+var errHandleNotFound = serviceError(fiber.StatusNotFound, "No account has the handle")
+
+// SetHandleDomain sets the domain the accounts hosted here are addressed under, in
+// addition to the capacitor's address
+func SetHandleDomain(domain string) {
+	handleDomain = strings.ToLower(domain)
+}
+
+// ResolveHandleQuery names the handle to resolve
+type ResolveHandleQuery struct {
+	Handle string `query:"handle" validate:"required,max=320"`
+}
+
+// HandleQuery names the account whose handle record is asked for
+type HandleQuery struct {
+	Username string `query:"username" validate:"required,username"`
+}
+
+// ResolvedHandle is the account a handle addresses
+type ResolvedHandle struct {
+	Handle    string `json:"handle"`
+	PublicKey string `json:"public_key"`
+	Capacitor string `json:"capacitor" doc:"host:port of the capacitor hosting the account"`
+	Local     bool   `json:"local,omitempty" doc:"The account is hosted on this capacitor"`
+}
+
+// HandleRecord is a capacitor's signed statement of the public key of an account it hosts
+type HandleRecord struct {
+	Username  string    `json:"username"`
+	PublicKey string    `json:"public_key"`
+	Capacitor string    `json:"capacitor" doc:"host:port of the capacitor's API"`
+	IssuedAt  time.Time `json:"issued_at"`
+	SignerKey string    `json:"signer_key" doc:"base64 Ed25519 public key of the capacitor"`
+	Signature string    `json:"signature" doc:"base64 Ed25519 signature of the record serialized without this field"`
+}
+
+// WellKnownCapacitor is served at /.well-known/wave-capacitor of a handle domain
+type WellKnownCapacitor struct {
+	Capacitor string `json:"capacitor" doc:"host:port of the capacitor hosting the domain's accounts"`
+}
+
+// HandleDomainRecord names the capacitor whose accounts' handles are under a domain
+type HandleDomainRecord struct {
+	Domain    string    `json:"domain"`
+	Capacitor string    `json:"capacitor"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	SignerKey string    `json:"signer_key"`
+	Signature string    `json:"signature"`
+}
+
+// ResolveHandle answers GET /resolve_handle?handle=
+func ResolveHandle(c *fiber.Ctx) error {
+	var query ResolveHandleQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+	resolved, err := resolveHandle(c.UserContext(), "handle", query.Handle)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(ResolveHandleResponse{Success: true, Handle: *resolved})
+}
+
+// GetWellKnownCapacitor answers /.well-known/wave-capacitor with this capacitor's
+// address, for HANDLE_DOMAIN pointed at it
+func GetWellKnownCapacitor(c *fiber.Ctx) error {
+	if handleDomain == "" || routeCapacitor == "" {
+		return respondError(c, serviceError(fiber.StatusNotFound, "This capacitor has no handle domain"))
+	}
+	return c.Status(fiber.StatusOK).JSON(WellKnownCapacitor{Capacitor: routeCapacitor})
+}
+
+// GetHandle returns the signed handle record of an account hosted here to a trusted
+// capacitor, which signs the request
+func GetHandle(c *fiber.Ctx) error {
+	if !federationEnabled() {
+		return respondError(c, errFederationDisabled)
+	}
+	var query HandleQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+	if _, err := nodeSigner(c); err != nil {
+		return respondError(c, err)
+	}
+
+	ctx := c.UserContext()
+	user, err := models.GetUser(ctx, query.Username)
+	if errors.Is(err, models.ErrUserNotFound) {
+		return respondError(c, errHandleNotFound)
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving user for handle: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to look up handle"))
+	}
+	if backupSigningKey == nil {
+		return respondError(c, serviceError(fiber.StatusNotImplemented, "This node has no signing key for federation"))
+	}
+
+	record := HandleRecord{
+		Username:  user.Username,
+		PublicKey: user.PublicKey,
+		Capacitor: routeCapacitor,
+		IssuedAt:  time.Now().UTC(),
+		SignerKey: ownSignerKey(),
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to look up handle"))
+	}
+	record.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(backupSigningKey, data))
+	return c.Status(fiber.StatusOK).JSON(HandleResponse{Success: true, Record: record})
+}
+
+// resolveHandle returns the account a handle, given in field of the request, addresses,
+// hosted here or on the capacitor of its domain
+func resolveHandle(ctx context.Context, field, handle string) (*ResolvedHandle, error) {
+	at := strings.LastIndex(handle, "@")
+	if at <= 0 || at == len(handle)-1 || !validate.ValidUsername(handle[:at]) {
+		return nil, fieldError(field, validate.CodeFormat, "must be username@domain")
+	}
+	username, domain := handle[:at], strings.ToLower(handle[at+1:])
+	handle = username + "@" + domain
+
+	if ownHandleDomain(domain) {
+		user, err := models.GetUser(ctx, username)
+		if errors.Is(err, models.ErrUserNotFound) {
+			return nil, errHandleNotFound
+		}
+		if err != nil {
+			logging.Errorf(ctx, "Error retrieving user for handle: %v", err)
+			return nil, serviceError(fiber.StatusInternalServerError, "Failed to resolve handle")
+		}
+		return &ResolvedHandle{Handle: handle, PublicKey: user.PublicKey, Capacitor: routeCapacitor, Local: true}, nil
+	}
+	if !federationEnabled() {
+		return nil, errFederationDisabled
+	}
+	if resolved, ok := cachedHandleFor(handle); ok {
+		return &resolved, nil
+	}
+
+	capacitor, err := resolveHandleDomain(ctx, domain)
+	if err != nil {
+		logging.Warnf(ctx, "Error resolving handle domain %s: %v", domain, err)
+		return nil, codedError(fiber.StatusNotFound, apierror.NotFound, "No capacitor found for the handle's domain")
+	}
+	record, err := fetchHandle(ctx, capacitor, username)
+	if err != nil {
+		var remote *federationError
+		if errors.As(err, &remote) && remote.Status == fiber.StatusNotFound {
+			return nil, errHandleNotFound
+		}
+		logging.Warnf(ctx, "Error fetching handle %s from %s: %v", handle, capacitor, err)
+		return nil, codedError(fiber.StatusBadGateway, apierror.UpstreamUnavailable, "The handle's capacitor could not be reached, please try again later")
+	}
+	if !strings.EqualFold(record.Capacitor, capacitor) {
+		logging.Warnf(ctx, "Handle %s answered by %s for another capacitor, %s", handle, capacitor, record.Capacitor)
+		return nil, codedError(fiber.StatusBadGateway, apierror.UpstreamUnavailable, "The handle's capacitor answered for another capacitor")
+	}
+	if err := routedTo(ctx, record.PublicKey, record.SignerKey); err != nil {
+		logging.Warnf(ctx, "Handle %s answered by %s with a key not routed to it: %v", handle, capacitor, err)
+		return nil, codedError(fiber.StatusBadGateway, apierror.UpstreamUnavailable, "The handle's capacitor answered with a key it doesn't host")
+	}
+
+	resolved := ResolvedHandle{Handle: handle, PublicKey: record.PublicKey, Capacitor: record.Capacitor}
+	cacheHandle(handle, resolved)
+	return &resolved, nil
+}
+
+// ownHandleDomain reports whether domain addresses the accounts hosted here
+func ownHandleDomain(domain string) bool {
+	return (handleDomain != "" && domain == handleDomain) || domain == strings.ToLower(routeCapacitor)
+}
+
+// resolveHandleDomain returns the capacitor a handle domain names: the capacitor of its
+// domain record in the DHT or, for a domain name, the one it serves at
+// handleWellKnownPath. A host:port names a capacitor only through the record it published.
+func resolveHandleDomain(ctx context.Context, domain string) (string, error) {
+	capacitor, dhtErr := lookupHandleDomain(ctx, domain)
+	if dhtErr == nil {
+		return capacitor, nil
+	}
+	if _, _, err := net.SplitHostPort(domain); err == nil || net.ParseIP(domain) != nil {
+		return "", dhtErr
+	}
+	capacitor, err := fetchWellKnownCapacitor(ctx, domain)
+	if err != nil {
+		return "", fmt.Errorf("%v; %v", dhtErr, err)
+	}
+	return capacitor, nil
+}
+
+// lookupHandleDomain returns the capacitor of the latest valid domain record of domain in
+// the DHT, once the domain is checked to point at it
+func lookupHandleDomain(ctx context.Context, domain string) (string, error) {
+	if routeNetwork == nil {
+		return "", errors.New("no DHT to look the domain up in")
+	}
+	values, err := routeNetwork.FindValues(ctx, handleDomainKey(domain))
+	if err != nil {
+		return "", err
+	}
+	var found *HandleDomainRecord
+	now := time.Now()
+	for _, value := range values {
+		var record HandleDomainRecord
+		if err := json.Unmarshal(value, &record); err != nil || !record.valid(domain, now) || !routeSignerTrusted(record.SignerKey) {
+			continue
+		}
+		if found == nil || record.IssuedAt.After(found.IssuedAt) {
+			found = &record
+		}
+	}
+	if found == nil {
+		return "", errors.New("no domain record in the DHT")
+	}
+	if err := domainPointsTo(ctx, domain, found.Capacitor); err != nil {
+		return "", err
+	}
+	return found.Capacitor, nil
+}
+
+// fetchWellKnownCapacitor asks the domain, over HTTPS, for the capacitor of its handles
+func fetchWellKnownCapacitor(ctx context.Context, domain string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+domain+handleWellKnownPath, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := handleClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s answered %d", handleWellKnownPath, resp.StatusCode)
+	}
+	var wellKnown WellKnownCapacitor
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4*1024)).Decode(&wellKnown); err != nil {
+		return "", fmt.Errorf("error decoding %s: %v", handleWellKnownPath, err)
+	}
+	if _, _, err := net.SplitHostPort(wellKnown.Capacitor); err != nil {
+		return "", fmt.Errorf("%s names no host:port", handleWellKnownPath)
+	}
+	return wellKnown.Capacitor, nil
+}
+
+// domainPointsTo checks that domain resolves to the host of capacitor, which anyone can
+// claim the domain for in the DHT. A host:port domain must be the capacitor itself.
+func domainPointsTo(ctx context.Context, domain, capacitor string) error {
+	if _, _, err := net.SplitHostPort(domain); err == nil {
+		if !strings.EqualFold(domain, capacitor) {
+			return fmt.Errorf("%s claims %s, which isn't its address", capacitor, domain)
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(capacitor)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(host, domain) {
+		return nil
+	}
+	domainAddrs, err := net.DefaultResolver.LookupHost(ctx, domain)
+	if err != nil {
+		return err
+	}
+	hostAddrs := []string{host}
+	if net.ParseIP(host) == nil {
+		if hostAddrs, err = net.DefaultResolver.LookupHost(ctx, host); err != nil {
+			return err
+		}
+	}
+	for _, addr := range hostAddrs {
+		if slices.Contains(domainAddrs, addr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s claims %s, which doesn't resolve to it", capacitor, domain)
+}
+
+// fetchHandle asks capacitor for the handle record of username and checks its signature
+func fetchHandle(ctx context.Context, capacitor, username string) (*HandleRecord, error) {
+	endpoint := federationScheme + strings.TrimSuffix(capacitor, "/") + "/api/v1/federation/handle?username=" + url.QueryEscape(username)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := signNodeRequest(req, nil); err != nil {
+		return nil, err
+	}
+	logging.Propagate(ctx, req.Header)
+
+	resp, err := handleClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure apierror.Response
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&failure)
+		return nil, &federationError{Status: resp.StatusCode, Code: failure.Code, Message: failure.Message}
+	}
+
+	var result HandleResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("error decoding handle record: %v", err)
+	}
+	record := result.Record
+	if record.Username != username || record.PublicKey == "" || !record.valid() {
+		return nil, errors.New("capacitor answered with an invalid handle record")
+	}
+	return &record, nil
+}
+
+// valid reports whether the record carries a matching signature
+func (r HandleRecord) valid() bool {
+	if r.Signature == "" {
+		return false
+	}
+	signature := r.Signature
+	r.Signature = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return false
+	}
+	return verifyBundleSignature(r.SignerKey, signature, data)
+}
+
+// PublishHandleDomain publishes the domain records naming this capacitor for its address
+// and HANDLE_DOMAIN
+func PublishHandleDomain(ctx context.Context) error {
+	if routeNetwork == nil || routeCapacitor == "" {
+		return nil
+	}
+	if backupSigningKey == nil {
+		return errors.New("no signing key for the handle domain record")
+	}
+	domains := []string{strings.ToLower(routeCapacitor)}
+	if handleDomain != "" {
+		domains = append(domains, handleDomain)
+	}
+	for _, domain := range domains {
+		now := time.Now().UTC()
+		record := HandleDomainRecord{
+			Domain:    domain,
+			Capacitor: routeCapacitor,
+			IssuedAt:  now,
+			ExpiresAt: now.Add(routeRecordTTL()),
+			SignerKey: ownSignerKey(),
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		record.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(backupSigningKey, data))
+		if data, err = json.Marshal(record); err != nil {
+			return err
+		}
+		if err := routeNetwork.StoreValue(ctx, handleDomainKey(domain), record.SignerKey, data, routeRecordTTL()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// valid reports whether the record names a capacitor for domain, hasn't expired at now
+// and carries a matching signature
+func (r HandleDomainRecord) valid(domain string, now time.Time) bool {
+	if r.Domain != domain || r.Capacitor == "" || !now.Before(r.ExpiresAt) || r.Signature == "" {
+		return false
+	}
+	signature := r.Signature
+	r.Signature = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return false
+	}
+	return verifyBundleSignature(r.SignerKey, signature, data)
+}
+
+// handleDomainKey is the DHT key the domain records of domain are stored under
+func handleDomainKey(domain string) [20]byte {
+	var key [20]byte
+	sum := sha256.Sum256([]byte("wave-handle-domain-v1\x00" + domain))
+	copy(key[:], sum[:])
+	return key
+}
+
+// cachedHandleFor returns the cached resolution of handle; ok is false when there is none
+// or it is stale
+func cachedHandleFor(handle string) (ResolvedHandle, bool) {
+	handleCacheMu.Lock()
+	defer handleCacheMu.Unlock()
+	cached, found := handleCache[handle]
+	if !found || time.Since(cached.fetchedAt) >= routeCacheTTL() {
+		return ResolvedHandle{}, false
+	}
+	return cached.resolved, true
+}
+
+// cacheHandle remembers the resolution of handle
+func cacheHandle(handle string, resolved ResolvedHandle) {
+	handleCacheMu.Lock()
+	defer handleCacheMu.Unlock()
+	if len(handleCache) >= handleCacheMaxEntries {
+		handleCache = make(map[string]cachedHandle)
+	}
+	handleCache[handle] = cachedHandle{resolved: resolved, fetchedAt: time.Now()}
+}
+
+// recipientByHandle returns the public key of a message recipient or contact named by a
+// handle, checking it against the public key given along, if any
+func recipientByHandle(ctx context.Context, field, handle, publicKey string) (string, error) {
+	resolved, err := resolveHandle(ctx, field, handle)
+	if err != nil {
+		return "", err
+	}
+	if publicKey != "" && publicKey != resolved.PublicKey {
+		return "", codedError(fiber.StatusConflict, apierror.Conflict, "The handle resolves to another public key")
+	}
+	return resolved.PublicKey, nil
+}
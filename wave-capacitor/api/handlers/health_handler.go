@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"wave_capacitor/health"
+	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+	"wave_capacitor/version"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// healthMonitor backs the readiness and liveness probes; nil reports the node healthy
+var healthMonitor *health.Monitor
+
+// SetHealthMonitor configures the monitor whose checks the probes report
+func SetHealthMonitor(monitor *health.Monitor) {
+	healthMonitor = monitor
+}
+
+// Healthz reports that the process is up and serving HTTP
+func Healthz(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(ProbeResponse{Status: "ok", Components: []health.Component{}})
+}
+
+// Readyz reports whether the node can serve traffic: database reachable, storage
+// writable and DHT bootstrapped. It fails with 503 while a component is down.
+func Readyz(c *fiber.Ctx) error {
+	if healthMonitor == nil {
+		return Healthz(c)
+	}
+	return respondProbe(c, healthMonitor.Readiness())
+}
+
+// Livez reports whether the node should keep running; it fails with 503 when the node
+// should be restarted
+func Livez(c *fiber.Ctx) error {
+	if healthMonitor == nil {
+		return Healthz(c)
+	}
+	return respondProbe(c, healthMonitor.Liveness())
+}
+
+// respondProbe writes a probe report, failing with 503 when the node is unhealthy
+func respondProbe(c *fiber.Ctx, report health.Report) error {
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	if !report.Healthy {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(ProbeResponse{Status: "unavailable", Components: report.Components})
+	}
+	return c.Status(fiber.StatusOK).JSON(ProbeResponse{Status: "ok", Components: report.Components})
+}
+
+// GetStatus summarizes the node for /api/status; status is "degraded" while the node is unready
+func GetStatus(c *fiber.Ctx) error {
+	resp := StatusResponse{
+		Status:      "ok",
+		Message:     "Wave Capacitor is running",
+		Version:     version.Version,
+		Region:      models.ServingRegion(),
+		Maintenance: middleware.Maintenance().Enabled,
+	}
+	if healthMonitor != nil {
+		report := healthMonitor.Readiness()
+		resp.Components = report.Components
+		if !report.Healthy {
+			resp.Status = "degraded"
+			resp.Message = "Wave Capacitor is running with failing components"
+		}
+	}
+	return c.Status(fiber.StatusOK).JSON(resp)
+}
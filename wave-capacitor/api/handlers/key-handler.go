@@ -1,9 +1,14 @@
 package handlers
 
 import (
-	"log"
+	"errors"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/api/validate"
+	"wave_capacitor/logging"
 	"wave_capacitor/middleware"
 	"wave_capacitor/models"
+	"wave_capacitor/utils"
+	"wave_capacitor/webhooks"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -13,14 +18,15 @@ func GetPublicKey(c *fiber.Ctx) error {
 	// Get username from JWT
 	username := middleware.ExtractUsername(c)
 
-	// Get user from database
-	user, err := models.GetUser(username)
+	// Get user from database; a slightly stale replica read is fine for the public key
+	user, err := models.GetUserFollowerRead(c.UserContext(), username)
 	if err != nil {
-		log.Printf("Error retrieving user for public key: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to retrieve user information",
-		})
+		logging.Errorf(c.UserContext(), "Error retrieving user for public key: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to retrieve user information"))
+	}
+
+	if notModified(c, weakETag(user.PublicKey)) {
+		return c.SendStatus(fiber.StatusNotModified)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
@@ -35,13 +41,10 @@ func GetEncryptedPrivateKey(c *fiber.Ctx) error {
 	username := middleware.ExtractUsername(c)
 
 	// Get user from database
-	user, err := models.GetUser(username)
+	user, err := models.GetUser(c.UserContext(), username)
 	if err != nil {
-		log.Printf("Error retrieving user for encrypted private key: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to retrieve user information",
-		})
+		logging.Errorf(c.UserContext(), "Error retrieving user for encrypted private key: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to retrieve user information"))
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
@@ -49,3 +52,108 @@ func GetEncryptedPrivateKey(c *fiber.Ctx) error {
 		"encrypted_private_key": user.EncryptedPrivKey,
 	})
 }
+
+// RotateKeysRequest defines the structure for key rotation requests
+type RotateKeysRequest struct {
+	PublicKey           string      `json:"public_key" validate:"required"`
+	EncryptedPrivateKey interface{} `json:"encrypted_private_key" validate:"required"`
+}
+
+// RotateKeys replaces the authenticated user's key pair. The retired public key is kept
+// in the key history so messages addressed to it remain retrievable.
+func RotateKeys(c *fiber.Ctx) error {
+	// Parse request body
+	var req RotateKeysRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+
+	if err := utils.ValidateKyber512PublicKey(req.PublicKey); err != nil {
+		return respondError(c, fieldError("public_key", validate.CodeFormat, err.Error()))
+	}
+
+	encPrivKeyStr, err := models.EncodeEncryptedPrivateKey(req.EncryptedPrivateKey)
+	if err != nil {
+		return respondError(c, fieldError("encrypted_private_key", validate.CodeType, "must be a string or an object"))
+	}
+
+	// Get username from JWT
+	username := middleware.ExtractUsername(c)
+
+	oldPublicKey, err := models.RotateUserKeys(c.UserContext(), username, req.PublicKey, encPrivKeyStr)
+	switch {
+	case errors.Is(err, models.ErrUserNotFound):
+		return respondError(c, serviceError(fiber.StatusNotFound, "User not found"))
+	case errors.Is(err, models.ErrSameKey):
+		return respondError(c, fieldError("public_key", validate.CodeFormat, "must differ from the current public key"))
+	case errors.Is(err, models.ErrKeyInUse):
+		return respondError(c, codedError(fiber.StatusConflict, apierror.KeyInUse, "The public key belongs to another account"))
+	case err != nil:
+		logging.Errorf(c.UserContext(), "Error rotating keys for %s: %v", username, err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to rotate keys"))
+	}
+
+	webhookDispatcher.Emit(c.UserContext(), username, webhooks.EventKeysRotated, fiber.Map{
+		"public_key":     req.PublicKey,
+		"old_public_key": oldPublicKey,
+	})
+	publishRouteLater(c.UserContext(), req.PublicKey)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success":        true,
+		"message":        "Keys rotated successfully",
+		"public_key":     req.PublicKey,
+		"old_public_key": oldPublicKey,
+	})
+}
+
+// GetKeyHistory returns the authenticated user's retired public keys
+func GetKeyHistory(c *fiber.Ctx) error {
+	// Get username from JWT
+	username := middleware.ExtractUsername(c)
+
+	history, err := models.GetKeyHistory(c.UserContext(), username)
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error retrieving key history: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to retrieve key history"))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+		"keys":    history,
+	})
+}
+
+// ResolveKeyQuery defines the query parameters of resolve_key
+type ResolveKeyQuery struct {
+	PublicKey string `query:"pubkey" validate:"required"`
+}
+
+// ResolveKey maps a public key to the account hosted on this capacitor that owns it.
+// Retired keys resolve too, with "current" set to false.
+func ResolveKey(c *fiber.Ctx) error {
+	var query ResolveKeyQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+	publicKey := query.PublicKey
+
+	user, err := models.GetUserByPublicKey(c.UserContext(), publicKey)
+	if err != nil {
+		if errors.Is(err, models.ErrUserNotFound) {
+			return respondError(c, serviceError(fiber.StatusNotFound, "No account found for this public key"))
+		}
+		logging.Errorf(c.UserContext(), "Error resolving public key: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to resolve public key"))
+	}
+	if hiddenFrom(c.UserContext(), user.Username, middleware.ExtractUsername(c)) {
+		return respondError(c, serviceError(fiber.StatusNotFound, "No account found for this public key"))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success":    true,
+		"username":   user.Username,
+		"public_key": user.PublicKey,
+		"current":    user.PublicKey == publicKey,
+	})
+}
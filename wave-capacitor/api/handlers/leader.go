@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+	"wave_capacitor/logging"
+	"wave_capacitor/models"
+)
+
+// Capacitors sharing a database elect one of them to run the scheduled jobs that act on
+// what they share: retention sweeps, snapshots, republishing route records and replica
+// reconciliation. The leader is whoever holds the singleton jobs lease; every capacitor
+// tries to take or renew it every third of its TTL, so when the leader goes away another
+// takes over once its lease expires. Admin jobs started by hand run wherever they are asked.
+
+// singletonJobsLease is the lease the leader holds
+const singletonJobsLease = "singleton_jobs"
+
+var (
+	leaseHolder string        // this capacitor's name in the lease; "" runs singleton jobs everywhere
+	leaseTTL    time.Duration // how long a lease lasts without being renewed
+
+	// leaderUntil is when this capacitor's lease runs out by its own clock (Unix nanoseconds),
+	// counted from before it was renewed so it never outlasts the lease in the database
+	leaderUntil atomic.Int64
+)
+
+// SetLeaderElection makes singleton jobs run only while holder has the lease, renewed
+// for ttl at a time; without it they run on every capacitor
+func SetLeaderElection(holder string, ttl time.Duration) {
+	leaseHolder = holder
+	leaseTTL = ttl
+}
+
+// isLeader reports whether this capacitor should run singleton jobs now
+func isLeader() bool {
+	return leaseHolder == "" || time.Now().UnixNano() < leaderUntil.Load()
+}
+
+// LeaderName returns the capacitor currently holding the singleton jobs lease, or "" when
+// none does or leader election is off
+func LeaderName(ctx context.Context) (string, error) {
+	if leaseHolder == "" {
+		return "", nil
+	}
+	return models.LeaseHolder(ctx, singletonJobsLease)
+}
+
+// StartLeaderElection takes part in the election until the returned function is called,
+// which releases the lease if this capacitor has it. The first attempt is made before it
+// returns, so jobs started afterwards know whether to run.
+func StartLeaderElection() (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	renewLeadership(ctx)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(leaseTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				renewLeadership(ctx)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-stopped
+		if leaderUntil.Swap(0) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := models.ReleaseLease(ctx, singletonJobsLease, leaseHolder); err != nil {
+			logging.Warnf(ctx, "Error handing over leadership: %v", err)
+		}
+	}
+}
+
+// renewLeadership takes or renews the lease. If the database can't be reached the lease
+// is only counted on until it would have expired.
+func renewLeadership(ctx context.Context) {
+	until := time.Now().Add(leaseTTL).UnixNano()
+	acquired, err := models.AcquireLease(ctx, singletonJobsLease, leaseHolder, leaseTTL)
+	if err != nil {
+		if ctx.Err() == nil {
+			logging.Warnf(ctx, "Error renewing the singleton jobs lease: %v", err)
+		}
+		return
+	}
+
+	was := isLeader()
+	if acquired {
+		leaderUntil.Store(until)
+	} else {
+		leaderUntil.Store(0)
+	}
+	switch {
+	case acquired && !was:
+		logging.Infof(ctx, "👑 Leading the cluster, singleton jobs run on this capacitor")
+	case !acquired && was:
+		logging.Infof(ctx, "Another capacitor leads the cluster, singleton jobs stop here")
+	}
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"wave_capacitor/logging"
+	"wave_capacitor/storage"
+
+	"github.com/google/uuid"
+)
+
+// Messages of at least LOCKER_OFFLOAD_KB have their ciphertexts uploaded to the locker
+// nodes when stored; the local message file keeps the rest of the message and a pointer
+// to the blob, and reading the message fetches the ciphertexts back through it. Every
+// store call of the handlers passes through here (see store_tracing.go), so listings,
+// exports and backups see whole messages.
+//
+// Lockers only receive ciphertexts the clients encrypted end to end, under random blob
+// keys that don't name the account; a blob not matching the pointer's checksum is refused.
+// Each blob goes to several lockers, and the ciphertexts are only dropped from the local
+// message once all of them took their copy, so losing a locker loses no message.
+
+// lockerBlobPrefix is where offloaded ciphertexts are kept on the lockers
+const lockerBlobPrefix = "messages/"
+
+// lockerPointer locates the offloaded ciphertexts of a message
+type lockerPointer struct {
+	Key    string `json:"key"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// offloadedCiphertexts is the blob uploaded to a locker
+type offloadedCiphertexts struct {
+	CiphertextMsg       string `json:"ciphertext_msg"`
+	SenderCiphertextMsg string `json:"sender_ciphertext_msg,omitempty"`
+}
+
+// storedMessage is a message as stored; when Locker is set, its ciphertexts are on a
+// locker and left empty here
+type storedMessage struct {
+	Message
+	Locker *lockerPointer `json:"locker,omitempty"`
+}
+
+// lockerPointerField is looked for before parsing a message, so messages kept locally
+// aren't decoded twice; JSON escapes the quotes of string values, so it only matches the key
+var lockerPointerField = []byte(`"locker":`)
+
+var (
+	messageLockers  *storage.LockerBlobStore // nil keeps every message local
+	lockerOffloadAt int                      // bytes; 0 stops offloading new messages
+	lockerCopies    int                      // lockers each blob is stored on
+)
+
+// SetMessageLockers configures the lockers message ciphertexts are offloaded to, on copies
+// of them, once a message reaches threshold bytes. With a threshold of 0, messages
+// offloaded earlier are still fetched from the lockers but new ones stay local.
+func SetMessageLockers(lockers *storage.LockerBlobStore, threshold, copies int) {
+	messageLockers = lockers
+	lockerOffloadAt = threshold
+	lockerCopies = copies
+}
+
+// offloadMessage returns the message to store locally for data, with its ciphertexts
+// moved to the lockers when it is large enough. Unless every copy is stored, the message
+// is kept whole, the copies made are deleted and the failure logged.
+func offloadMessage(ctx context.Context, data []byte) []byte {
+	if messageLockers == nil || lockerOffloadAt <= 0 || len(data) < lockerOffloadAt {
+		return data
+	}
+	var message Message
+	if err := json.Unmarshal(data, &message); err != nil {
+		return data
+	}
+
+	blob, err := json.Marshal(offloadedCiphertexts{
+		CiphertextMsg:       message.CiphertextMsg,
+		SenderCiphertextMsg: message.SenderCiphertextMsg,
+	})
+	if err != nil {
+		return data
+	}
+	sum := sha256.Sum256(blob)
+	pointer := &lockerPointer{Key: lockerBlobPrefix + uuid.New().String(), Size: len(blob), SHA256: hex.EncodeToString(sum[:])}
+	holders, err := messageLockers.PutBlobCopies(pointer.Key, blob, lockerCopies)
+	if err != nil {
+		logging.Warnf(ctx, "Error offloading message %s to the lockers, keeping it local: %v", message.MessageID, err)
+		if err := messageLockers.DeleteBlobFrom(pointer.Key, holders); err != nil {
+			logging.Warnf(ctx, "Error deleting partial copies of locker blob %s: %v", pointer.Key, err)
+		}
+		return data
+	}
+
+	message.CiphertextMsg = ""
+	message.SenderCiphertextMsg = ""
+	stored, err := json.Marshal(storedMessage{Message: message, Locker: pointer})
+	if err != nil {
+		deleteOffloaded(ctx, pointer)
+		return data
+	}
+	return stored
+}
+
+// fetchOffloaded returns data with the ciphertexts of an offloaded message fetched back
+// from the lockers; messages kept locally are returned as they are
+func fetchOffloaded(data []byte) ([]byte, error) {
+	pointer := offloadPointer(data)
+	if pointer == nil {
+		return data, nil
+	}
+	if messageLockers == nil {
+		return nil, errors.New("message is offloaded to a locker, but no lockers are configured")
+	}
+
+	r, err := messageLockers.GetBlob(pointer.Key)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching message from locker: %v", err)
+	}
+	defer r.Close()
+	blob, err := io.ReadAll(io.LimitReader(r, int64(pointer.Size)+1))
+	if err != nil {
+		return nil, fmt.Errorf("error fetching message from locker: %v", err)
+	}
+	sum := sha256.Sum256(blob)
+	if len(blob) != pointer.Size || hex.EncodeToString(sum[:]) != pointer.SHA256 {
+		return nil, fmt.Errorf("locker blob %s doesn't match its checksum", pointer.Key)
+	}
+	var ciphertexts offloadedCiphertexts
+	if err := json.Unmarshal(blob, &ciphertexts); err != nil {
+		return nil, fmt.Errorf("error decoding locker blob %s: %v", pointer.Key, err)
+	}
+
+	var stored storedMessage
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	stored.CiphertextMsg = ciphertexts.CiphertextMsg
+	stored.SenderCiphertextMsg = ciphertexts.SenderCiphertextMsg
+	return json.Marshal(stored.Message)
+}
+
+// offloadPointer returns the locker pointer of a stored message, or nil if it is local
+func offloadPointer(data []byte) *lockerPointer {
+	if !bytes.Contains(data, lockerPointerField) {
+		return nil
+	}
+	var stored storedMessage
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil
+	}
+	return stored.Locker
+}
+
+// deleteOffloaded deletes offloaded ciphertexts from the lockers; failures are logged and
+// leave the blob behind
+func deleteOffloaded(ctx context.Context, pointer *lockerPointer) {
+	if messageLockers == nil {
+		return
+	}
+	if err := messageLockers.DeleteBlob(pointer.Key); err != nil && !errors.Is(err, storage.ErrBlobNotFound) {
+		logging.Warnf(ctx, "Error deleting locker blob %s: %v", pointer.Key, err)
+	}
+}
@@ -1,18 +1,27 @@
 package handlers
 
 import (
+	"bufio"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"os"
-	"path/filepath"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/api/validate"
 	"wave_capacitor/config"
+	"wave_capacitor/logging"
 	"wave_capacitor/middleware"
 	"wave_capacitor/models"
+	"wave_capacitor/outbox"
+	"wave_capacitor/storage"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
@@ -20,13 +29,15 @@ import (
 
 // SendMessageRequest defines the structure for sending message requests
 type SendMessageRequest struct {
-	RecipientPublicKey  string `json:"recipient_pubkey"`
-	CiphertextKEM       string `json:"ciphertext_kem"`
-	CiphertextMsg       string `json:"ciphertext_msg"`
-	Nonce               string `json:"nonce"`
-	SenderCiphertextKEM string `json:"sender_ciphertext_kem"`
-	SenderCiphertextMsg string `json:"sender_ciphertext_msg"`
-	SenderNonce         string `json:"sender_nonce"`
+	RecipientPublicKey  string `json:"recipient_pubkey" doc:"Required unless recipient_handle is given"`
+	RecipientHandle     string `json:"recipient_handle,omitempty" validate:"max=320" doc:"username@domain of the recipient; when recipient_pubkey is given too, the handle must resolve to it"`
+	CiphertextKEM       string `json:"ciphertext_kem" validate:"required"`
+	CiphertextMsg       string `json:"ciphertext_msg" validate:"required"`
+	Nonce               string `json:"nonce" validate:"required"`
+	SenderCiphertextKEM string `json:"sender_ciphertext_kem" validate:"required"`
+	SenderCiphertextMsg string `json:"sender_ciphertext_msg" validate:"required"`
+	SenderNonce         string `json:"sender_nonce" validate:"required"`
+	Priority            string `json:"priority,omitempty" validate:"oneof=high normal low" doc:"Order among the messages queued for the recipient's capacitor while it can't be reached; normal by default"`
 }
 
 // Message represents the structure of a stored message
@@ -43,25 +54,226 @@ type Message struct {
 	Timestamp           time.Time `json:"timestamp"`
 }
 
-// GetMessageFolder calculates the folder path for a user's messages based on their public key
-// This implements the obfuscation layer using a hash with a confusion salt
-func GetMessageFolder(publicKey string) string {
-	// Combine public key with confusion salt
-	data := publicKey + config.ConfusionSalt
-	hash := sha256.Sum256([]byte(data))
-	hashStr := hex.EncodeToString(hash[:])
-
-	// Get the configured number of shards
-	numShards := config.GetNumShards()
-	
-	if numShards <= 1 {
-		// If no sharding, just use the first 16 chars of the hash
-		return filepath.Join(config.MessagesDir, hashStr[:16])
-	} else {
-		// With sharding, calculate shard index based on the first byte of the hash
-		shardIndex := int(hash[0]) % numShards
-		folderName := fmt.Sprintf("%s_%d", hashStr[:16], shardIndex)
-		return filepath.Join(config.MessagesDir, folderName)
+// messageStore persists message files; it is configured at startup via SetMessageStore
+var messageStore storage.MessageStore
+
+// SetMessageStore configures the storage backend used by the message handlers
+func SetMessageStore(store storage.MessageStore) {
+	messageStore = store
+}
+
+// messageReadWorkers is how many messages readMessageRefs reads at the same time
+var messageReadWorkers = 1
+
+// SetMessageReadWorkers sets how many messages are read at the same time when listing them
+func SetMessageReadWorkers(workers int) {
+	messageReadWorkers = max(workers, 1)
+}
+
+// diskGuard reports when the data volume is nearly full; nil disables the check
+var diskGuard *storage.DiskGuard
+
+// SetDiskGuard configures the free-space check used to refuse writes with 507
+func SetDiskGuard(guard *storage.DiskGuard) {
+	diskGuard = guard
+}
+
+// messagesDelivered counts the messages DeliverMessage stored since the process started
+var messagesDelivered atomic.Int64
+
+// MessagesDelivered returns how many messages this process delivered since it started
+func MessagesDelivered() int64 {
+	return messagesDelivered.Load()
+}
+
+// ownerKeys returns every public key a user's messages may be stored under:
+// the current key followed by keys retired through rotation
+func ownerKeys(ctx context.Context, user *models.User) []string {
+	keys := []string{user.PublicKey}
+
+	history, err := models.GetKeyHistory(ctx, user.Username)
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving key history for %s: %v", user.Username, err)
+		return keys
+	}
+	for _, record := range history {
+		keys = append(keys, record.PublicKey)
+	}
+	return keys
+}
+
+// loadMessages reads and decodes all messages stored for a user across their current and retired keys
+func loadMessages(ctx context.Context, user *models.User) ([]Message, error) {
+	messages := []Message{}
+	err := eachMessage(ctx, user, func(message Message) error {
+		messages = append(messages, message)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// eachMessage calls fn with each of the user's messages, one at a time, so callers can
+// stream them without holding all in memory. Unreadable messages are logged and skipped;
+// an error from fn stops the iteration and is returned.
+func eachMessage(ctx context.Context, user *models.User, fn func(Message) error) error {
+	refs, err := listMessageRefs(ctx, user)
+	if err != nil {
+		return err
+	}
+	return readMessageRefs(ctx, refs, fn)
+}
+
+// messageRef locates a stored message
+type messageRef struct {
+	ownerKey  string
+	messageID string
+}
+
+// listMessageRefs lists the messages stored for a user under their current and retired
+// keys. A message stored under several keys is listed under each.
+func listMessageRefs(ctx context.Context, user *models.User) ([]messageRef, error) {
+	var refs []messageRef
+	for _, key := range ownerKeys(ctx, user) {
+		messageIDs, err := storeList(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		for _, messageID := range messageIDs {
+			refs = append(refs, messageRef{ownerKey: key, messageID: messageID})
+		}
+	}
+	return refs, nil
+}
+
+// readMessageRefs calls fn with each message of refs, in order. Up to messageReadWorkers
+// messages are read at the same time, and about twice that many held ahead of fn, so slow
+// disks and network filesystems serve several reads at once without the whole mailbox
+// being held in memory. Unreadable messages are logged and skipped, as are messages
+// already read under another key; an error from fn stops the iteration and is returned.
+func readMessageRefs(ctx context.Context, refs []messageRef, fn func(Message) error) error {
+	seen := make(map[string]bool)
+	deliver := func(ref messageRef, message *Message) error {
+		if message == nil || seen[ref.messageID] {
+			return nil
+		}
+		seen[ref.messageID] = true
+		return fn(*message)
+	}
+
+	workers := min(messageReadWorkers, len(refs))
+	if workers <= 1 {
+		for _, ref := range refs {
+			if seen[ref.messageID] {
+				continue
+			}
+			if err := deliver(ref, readMessage(ctx, ref)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Each read answers on a channel of its own, queued in the order of refs
+	type read struct {
+		ref    messageRef
+		result chan *Message
+	}
+	reads := make(chan read)
+	queued := make(chan read, 2*workers)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range reads {
+				r.result <- readMessage(ctx, r.ref)
+			}
+		}()
+	}
+	go func() {
+		defer close(queued)
+		defer close(reads)
+		for _, ref := range refs {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			r := read{ref: ref, result: make(chan *Message, 1)}
+			select {
+			case queued <- r:
+			case <-done:
+				return
+			}
+			select {
+			case reads <- r:
+			case <-done:
+				return
+			}
+		}
+	}()
+	defer wg.Wait()
+	defer close(done)
+
+	for r := range queued {
+		if err := deliver(r.ref, <-r.result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMessage reads and decodes a message, or logs why it can't and returns nil
+func readMessage(ctx context.Context, ref messageRef) *Message {
+	// Read message (decrypted by the store if needed)
+	data, err := storeRead(ctx, ref.ownerKey, ref.messageID)
+	if err != nil {
+		logging.Errorf(ctx, "Error reading message %s: %v", ref.messageID, err)
+		return nil
+	}
+
+	// Unmarshal message
+	var message Message
+	if err := json.Unmarshal(data, &message); err != nil {
+		logging.Errorf(ctx, "Error unmarshaling message %s: %v", ref.messageID, err)
+		return nil
+	}
+	return &message
+}
+
+// RecipientHash returns the salted hash identifying a message owner in the message index,
+// so the database never stores which public keys hold messages
+func RecipientHash(publicKey string) string {
+	hash := sha256.Sum256([]byte(publicKey + config.ConfusionSalt))
+	return hex.EncodeToString(hash[:])
+}
+
+// previousRecipientHash returns the key's hash under PREVIOUS_CONFUSION_SALT while the
+// salt is rotated, or "" when there is no previous salt
+func previousRecipientHash(publicKey string) string {
+	if config.PreviousConfusionSalt == "" || config.PreviousConfusionSalt == config.ConfusionSalt {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(publicKey + config.PreviousConfusionSalt))
+	return hex.EncodeToString(hash[:])
+}
+
+// indexMessage records a stored message in the metadata index. The message store stays
+// authoritative, so indexing failures are logged rather than failing the request.
+func indexMessage(ctx context.Context, ownerKey, messageID string, timestamp time.Time, size int, hash string) {
+	meta := models.MessageMeta{
+		RecipientHash: RecipientHash(ownerKey),
+		MessageID:     messageID,
+		Timestamp:     timestamp,
+		Size:          size,
+		Hash:          hash,
+	}
+	if err := models.IndexMessage(ctx, meta); err != nil {
+		logging.Errorf(ctx, "Error indexing message %s: %v", messageID, err)
 	}
 }
 
@@ -69,38 +281,56 @@ func GetMessageFolder(publicKey string) string {
 func SendMessage(c *fiber.Ctx) error {
 	// Parse request body
 	var req SendMessageRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"success": false,
-			"error":   "Invalid request format",
-		})
-	}
-
-	// Validate required fields
-	if req.RecipientPublicKey == "" || req.CiphertextKEM == "" || 
-	   req.CiphertextMsg == "" || req.Nonce == "" ||
-	   req.SenderCiphertextKEM == "" || req.SenderCiphertextMsg == "" || 
-	   req.SenderNonce == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"success": false,
-			"error":   "Missing required message fields",
-		})
+	if err := decodeBody(c, &req); err != nil {
+		return respondError(c, err)
 	}
 
 	// Get sender username from JWT
 	username := middleware.ExtractUsername(c)
 
+	resp, err := DeliverMessage(c.UserContext(), username, req)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(resp)
+}
+
+// DeliverMessage stores an encrypted message from username for the recipient, and a copy for the sender.
+// Messages to a recipient who blocked the sender are dropped or rejected, see BLOCKED_MESSAGES.
+func DeliverMessage(ctx context.Context, username string, req SendMessageRequest) (*SendMessageResponse, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+	if req.RecipientHandle != "" {
+		publicKey, err := recipientByHandle(ctx, "recipient_handle", req.RecipientHandle, req.RecipientPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		req.RecipientPublicKey = publicKey
+	}
+	if req.RecipientPublicKey == "" {
+		return nil, fieldError("recipient_pubkey", validate.CodeRequired, "is required")
+	}
+
 	// Get sender's public key from database
-	user, err := models.GetUser(username)
+	user, err := models.GetUser(ctx, username)
 	if err != nil {
-		log.Printf("Error retrieving sender user: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to retrieve sender information",
-		})
+		logging.Errorf(ctx, "Error retrieving sender user: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to retrieve sender information")
 	}
 	senderPublicKey := user.PublicKey
 
+	// A recipient who blocked the sender doesn't get the message; unless the node rejects
+	// it, the sender is answered as if it was delivered
+	blocked, err := models.IsBlockedByKey(ctx, req.RecipientPublicKey, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error checking recipient blocklist: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to deliver message")
+	}
+	if blocked && rejectBlockedMessages() {
+		return nil, codedError(fiber.StatusForbidden, apierror.Forbidden, "The recipient does not accept messages from you")
+	}
+
 	// Generate message ID and timestamp
 	messageID := uuid.New().String()
 	timestamp := time.Now()
@@ -122,117 +352,356 @@ func SendMessage(c *fiber.Ctx) error {
 	// Marshal message to JSON
 	messageJSON, err := json.Marshal(message)
 	if err != nil {
-		log.Printf("Error marshaling message: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to process message",
-		})
+		logging.Errorf(ctx, "Error marshaling message: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to process message")
 	}
 
-	// Store message for recipient
-	recipientFolder := GetMessageFolder(req.RecipientPublicKey)
-	if err := os.MkdirAll(recipientFolder, 0755); err != nil {
-		log.Printf("Error creating recipient folder: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to store message for recipient",
-		})
+	// A recipient hosted on another capacitor gets the message from there; its blocklist
+	// is checked by that capacitor
+	route, err := remoteRoute(ctx, req.RecipientPublicKey)
+	if err != nil {
+		logging.Errorf(ctx, "Error looking up recipient route: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to deliver message")
 	}
-	recipientFilePath := filepath.Join(recipientFolder, messageID+".json")
-	if err := ioutil.WriteFile(recipientFilePath, messageJSON, 0644); err != nil {
-		log.Printf("Error writing recipient message: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to store message for recipient",
-		})
+	var receipt *FederationReceipt
+	if route != nil {
+		if receipt, err = forwardOrQueue(ctx, route, message, outbox.ParsePriority(req.Priority)); err != nil {
+			return nil, err
+		}
+	} else if !blocked {
+		if err := storeRecipientCopy(ctx, message, messageJSON); err != nil {
+			return nil, err
+		}
 	}
 
 	// Store a copy for sender
-	senderFolder := GetMessageFolder(senderPublicKey)
-	if err := os.MkdirAll(senderFolder, 0755); err != nil {
-		log.Printf("Error creating sender folder: %v", err)
+	if hash, err := storeWrite(ctx, senderPublicKey, messageID, messageJSON); err != nil {
+		logging.Errorf(ctx, "Error writing sender message: %v", err)
 		// Continue anyway as the message is already stored for the recipient
 	} else {
-		senderFilePath := filepath.Join(senderFolder, messageID+".json")
-		if err := ioutil.WriteFile(senderFilePath, messageJSON, 0644); err != nil {
-			log.Printf("Error writing sender message: %v", err)
-			// Continue anyway as the message is already stored for the recipient
+		// The sender's own copy starts out read
+		meta := models.MessageMeta{
+			RecipientHash: RecipientHash(senderPublicKey),
+			MessageID:     messageID,
+			Timestamp:     timestamp,
+			Size:          len(messageJSON),
+			State:         models.MessageRead,
+			Hash:          hash,
+		}
+		if err := models.IndexMessage(ctx, meta); err != nil {
+			logging.Errorf(ctx, "Error indexing message %s: %v", messageID, err)
 		}
+		recordChange(ctx, username, models.ChangeMessageAdded, senderPublicKey, messageID)
 	}
 
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"success":    true,
-		"message":    "Message sent successfully",
-		"message_id": messageID,
-		"timestamp":  timestamp,
-	})
+	resp := &SendMessageResponse{
+		Success:   true,
+		Message:   "Message sent successfully",
+		MessageID: messageID,
+		Timestamp: timestamp,
+		Receipt:   receipt,
+	}
+	if route != nil && receipt == nil {
+		resp.Message = "Message queued for the recipient's capacitor"
+		resp.Queued = true
+	}
+	return resp, nil
+}
+
+// MessagesQuery defines the query parameters of get_messages
+type MessagesQuery struct {
+	Limit  int    `query:"limit" validate:"min=1,max=200"` // max is maxMessagePageSize
+	Before string `query:"before"`
 }
 
-// GetMessages retrieves all messages for the authenticated user
+// GetMessages retrieves all messages for the authenticated user. The messages are
+// streamed, read as the client consumes them; an error once the response has started
+// cuts it short, which fails to parse.
 func GetMessages(c *fiber.Ctx) error {
 	// Get username from JWT
 	username := middleware.ExtractUsername(c)
 
+	// A page size switches to index-backed pagination
+	var query MessagesQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+
+	ctx := c.UserContext()
+	listing, err := listMessages(ctx, username, query.Limit, query.Before)
+	if err != nil {
+		return respondError(c, err)
+	}
+
+	// Answer polls that saw the same set of messages without reading any message bodies
+	if notModified(c, listing.etag()) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		err := listing.writeJSON(ctx, writer)
+		if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			logging.Errorf(ctx, "Error streaming messages: %v", err)
+		}
+		writer.CloseWithError(err)
+	}()
+
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Status(fiber.StatusOK).SendStream(reader)
+}
+
+// maxMessagePageSize caps the limit of a paginated get_messages request
+const maxMessagePageSize = 200
+
+// errInvalidPageSize is returned for a page size outside 1..maxMessagePageSize
+var errInvalidPageSize = fieldError("limit", validate.CodeMax, fmt.Sprintf("must be between 1 and %d", maxMessagePageSize))
+
+// ListMessages returns the user's messages. A limit of 0 returns all messages; otherwise one
+// page, newest first, starting before the cursor (empty for the first page).
+func ListMessages(ctx context.Context, username string, limit int, before string) (*MessagesResponse, error) {
+	listing, err := listMessages(ctx, username, limit, before)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MessagesResponse{Success: true, Messages: listing.messages(ctx), NextCursor: listing.nextCursor}, nil
+}
+
+// messageListing lists the messages of a ListMessages result without reading them, so
+// that they can be read as they are written out
+type messageListing struct {
+	refs       []messageRef
+	nextCursor string
+	etagParts  []string
+}
+
+// listMessages lists the messages ListMessages returns for the same arguments
+func listMessages(ctx context.Context, username string, limit int, before string) (*messageListing, error) {
 	// Get user's public key from database
-	user, err := models.GetUser(username)
+	user, err := models.GetUser(ctx, username)
 	if err != nil {
-		log.Printf("Error retrieving user for messages: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to retrieve user information",
-		})
+		logging.Errorf(ctx, "Error retrieving user for messages: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to retrieve user information")
 	}
 
-	// Calculate the user's message folder
-	folder := GetMessageFolder(user.PublicKey)
-	
-	// Check if folder exists
-	if _, err := os.Stat(folder); os.IsNotExist(err) {
-		// Return empty messages array if folder doesn't exist
-		return c.Status(fiber.StatusOK).JSON(fiber.Map{
-			"success":  true,
-			"messages": []Message{},
-		})
+	if limit != 0 {
+		return messagePage(ctx, user, limit, before)
 	}
 
-	// Read message files from folder
-	files, err := ioutil.ReadDir(folder)
+	// List messages stored under the current key and any rotated keys
+	refs, err := listMessageRefs(ctx, user)
 	if err != nil {
-		log.Printf("Error reading message directory: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"success": false,
-			"error":   "Failed to retrieve messages",
-		})
+		logging.Errorf(ctx, "Error reading message directory: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to retrieve messages")
 	}
 
-	// Process each message file
-	messages := []Message{}
-	for _, file := range files {
-		if filepath.Ext(file.Name()) != ".json" {
-			continue // Skip non-JSON files
+	listing := &messageListing{refs: refs, etagParts: []string{strconv.Itoa(limit), before}}
+	owner := ""
+	for _, ref := range refs {
+		if ref.ownerKey != owner {
+			owner = ref.ownerKey
+			listing.etagParts = append(listing.etagParts, owner)
 		}
+		listing.etagParts = append(listing.etagParts, ref.messageID)
+	}
+	return listing, nil
+}
+
+// messages reads the messages of the listing
+func (l *messageListing) messages(ctx context.Context) []Message {
+	messages := []Message{}
+	readMessageRefs(ctx, l.refs, func(message Message) error {
+		messages = append(messages, message)
+		return nil
+	})
+	return messages
+}
 
-		// Read message file
-		filePath := filepath.Join(folder, file.Name())
-		data, err := ioutil.ReadFile(filePath)
+// etag returns the entity tag of the listing. Stored messages never change, so the tag
+// only covers the IDs of the messages listed: the store listing for all messages, the
+// index entries of the page otherwise.
+func (l *messageListing) etag() string {
+	return weakETag(l.etagParts...)
+}
+
+// writeJSON writes the listing as a MessagesResponse, reading each message as it goes
+func (l *messageListing) writeJSON(ctx context.Context, w io.Writer) error {
+	buffered := bufio.NewWriterSize(w, 32*1024)
+	buffered.WriteString(`{"success":true,"messages":[`)
+	first := true
+	err := readMessageRefs(ctx, l.refs, func(message Message) error {
+		data, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		if !first {
+			buffered.WriteByte(',')
+		}
+		first = false
+		_, err = buffered.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	buffered.WriteByte(']')
+	if l.nextCursor != "" {
+		cursor, err := json.Marshal(l.nextCursor)
 		if err != nil {
-			log.Printf("Error reading message file %s: %v", file.Name(), err)
-			continue // Skip this file and try the next one
+			return err
 		}
+		buffered.WriteString(`,"next_cursor":`)
+		buffered.Write(cursor)
+	}
+	buffered.WriteByte('}')
+	return buffered.Flush()
+}
 
-		// Unmarshal message
-		var message Message
-		if err := json.Unmarshal(data, &message); err != nil {
-			log.Printf("Error unmarshaling message %s: %v", file.Name(), err)
-			continue // Skip this file and try the next one
+// ownerHashes maps the index hash of each of the user's keys back to the key. During a
+// salt rotation, the hashes under the previous salt are included until they are rehashed.
+func ownerHashes(ctx context.Context, user *models.User) (map[string]string, []string) {
+	byHash := make(map[string]string)
+	hashes := []string{}
+	for _, key := range ownerKeys(ctx, user) {
+		for _, hash := range []string{RecipientHash(key), previousRecipientHash(key)} {
+			if _, ok := byHash[hash]; hash != "" && !ok {
+				byHash[hash] = key
+				hashes = append(hashes, hash)
+			}
 		}
+	}
+	return byHash, hashes
+}
 
-		// Add message to array
-		messages = append(messages, message)
+// messagePage lists one page of messages, newest first, using the metadata index.
+// The returned next_cursor is passed back as ?before= to fetch the following page.
+func messagePage(ctx context.Context, user *models.User, limit int, cursor string) (*messageListing, error) {
+	if limit <= 0 || limit > maxMessagePageSize {
+		return nil, errInvalidPageSize
+	}
+
+	var before time.Time
+	var beforeID string
+	if cursor != "" {
+		var err error
+		before, beforeID, err = parseMessageCursor(cursor)
+		if err != nil {
+			return nil, serviceError(fiber.StatusBadRequest, "Invalid cursor")
+		}
+	}
+
+	byHash, hashes := ownerHashes(ctx, user)
+	entries, err := models.ListMessageIndex(ctx, hashes, before, beforeID, limit)
+	if err != nil {
+		logging.Errorf(ctx, "Error listing message index: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to retrieve messages")
+	}
+
+	listing := &messageListing{etagParts: []string{strconv.Itoa(limit), cursor}}
+	for _, entry := range entries {
+		listing.refs = append(listing.refs, messageRef{ownerKey: byHash[entry.RecipientHash], messageID: entry.MessageID})
+		listing.etagParts = append(listing.etagParts, entry.RecipientHash, entry.MessageID)
+	}
+	if len(entries) == limit {
+		last := entries[len(entries)-1]
+		listing.nextCursor = formatMessageCursor(last.Timestamp, last.MessageID)
+	}
+	return listing, nil
+}
+
+// formatMessageCursor encodes a page position as "<unix nanoseconds>:<message id>"
+func formatMessageCursor(timestamp time.Time, messageID string) string {
+	return strconv.FormatInt(timestamp.UnixNano(), 10) + ":" + messageID
+}
+
+// parseMessageCursor decodes a cursor produced by formatMessageCursor
+func parseMessageCursor(cursor string) (time.Time, string, error) {
+	nanos, messageID, ok := strings.Cut(cursor, ":")
+	if !ok || messageID == "" {
+		return time.Time{}, "", errors.New("malformed cursor")
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	return time.Unix(0, n), messageID, nil
+}
+
+// GetUnreadCount returns how many of the authenticated user's messages are unread
+func GetUnreadCount(c *fiber.Ctx) error {
+	username := middleware.ExtractUsername(c)
+
+	count, err := CountUnread(c.UserContext(), username)
+	if err != nil {
+		return respondError(c, err)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"success":  true,
-		"messages": messages,
+		"success": true,
+		"unread":  count,
 	})
 }
+
+// CountUnread returns how many of the user's messages are unread
+func CountUnread(ctx context.Context, username string) (int, error) {
+	user, err := models.GetUser(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving user for unread count: %v", err)
+		return 0, serviceError(fiber.StatusInternalServerError, "Failed to retrieve user information")
+	}
+
+	_, hashes := ownerHashes(ctx, user)
+	count, err := models.CountUnreadMessages(ctx, hashes)
+	if err != nil {
+		logging.Errorf(ctx, "Error counting unread messages: %v", err)
+		return 0, serviceError(fiber.StatusInternalServerError, "Failed to count unread messages")
+	}
+	return count, nil
+}
+
+// MarkReadRequest defines the structure for marking messages as read
+type MarkReadRequest struct {
+	MessageIDs []string `json:"message_ids" validate:"required"`
+}
+
+// MarkMessagesRead marks the given messages of the authenticated user as read
+func MarkMessagesRead(c *fiber.Ctx) error {
+	var req MarkReadRequest
+	if err := decodeBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+
+	username := middleware.ExtractUsername(c)
+
+	updated, err := MarkRead(c.UserContext(), username, req.MessageIDs)
+	if err != nil {
+		return respondError(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+		"updated": updated,
+	})
+}
+
+// MarkRead marks the given messages of the user as read and returns how many changed
+func MarkRead(ctx context.Context, username string, messageIDs []string) (int, error) {
+	if err := validateRequest(MarkReadRequest{MessageIDs: messageIDs}); err != nil {
+		return 0, err
+	}
+
+	user, err := models.GetUser(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving user for mark read: %v", err)
+		return 0, serviceError(fiber.StatusInternalServerError, "Failed to retrieve user information")
+	}
+
+	_, hashes := ownerHashes(ctx, user)
+	updated, err := models.SetMessageState(ctx, hashes, messageIDs, models.MessageRead)
+	if err != nil {
+		logging.Errorf(ctx, "Error marking messages read: %v", err)
+		return 0, serviceError(fiber.StatusInternalServerError, "Failed to update messages")
+	}
+	return updated, nil
+}
@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+	"wave_capacitor/storage"
+	"wave_capacitor/utils"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// testDatabaseEnv names the CockroachDB URL the tests needing a database run against;
+// they are skipped without it
+const testDatabaseEnv = "WAVE_TEST_DATABASE_URL"
+
+// testDatabase connects to the test database and migrates it
+func testDatabase(t *testing.T) {
+	url := os.Getenv(testDatabaseEnv)
+	if url == "" {
+		t.Skipf("%s not set", testDatabaseEnv)
+	}
+	models.SetDBOptions(models.DBOptions{ConnectionString: url, MaxOpenConns: 16, MaxIdleConns: 16})
+	if err := models.InitializeDB(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Accounts are stored with wrapped private keys
+	wrapKey, err := utils.GenerateRandomBytes(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := utils.SetPrivateKeyWrapKeys(wrapKey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testAccount creates an account with a fresh key pair and returns its public key,
+// deleting it when the test ends
+func testAccount(t *testing.T, username string) string {
+	publicKey, privateKey, err := utils.GenerateKyber512Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := utils.EncryptPrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(publicKey)
+	if err := models.CreateUserWithKeys(context.Background(), username, encoded, wrapped); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		models.DeleteUserCascade(context.Background(), username, []string{RecipientHash(encoded)})
+	})
+	return encoded
+}
+
+// TestConcurrentSendMessage sends messages to one mailbox in parallel and checks that
+// every one of them is stored whole and indexed with the hash of what was stored
+func TestConcurrentSendMessage(t *testing.T) {
+	testDatabase(t)
+	middleware.SetJWTSecret(bytes.Repeat([]byte("s"), 32))
+	SetMessageStore(storage.NewFileMessageStore(t.TempDir(), nil))
+
+	sender := "sender-" + uuid.New().String()[:8]
+	testAccount(t, sender)
+	recipientKey := testAccount(t, "recipient-"+uuid.New().String()[:8])
+	token, err := middleware.GenerateToken(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Post("/send_message", middleware.JWTMiddleware, SendMessage)
+
+	const senders = 32
+	ids := make([]string, senders)
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body, _ := json.Marshal(SendMessageRequest{
+				RecipientPublicKey:  recipientKey,
+				CiphertextKEM:       "kem",
+				CiphertextMsg:       base64.StdEncoding.EncodeToString([]byte(uuid.New().String())),
+				Nonce:               "nonce",
+				SenderCiphertextKEM: "sender-kem",
+				SenderCiphertextMsg: "sender-msg",
+				SenderNonce:         "sender-nonce",
+			})
+			req := httptest.NewRequest(fiber.MethodPost, "/send_message", bytes.NewReader(body))
+			req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			var sent SendMessageResponse
+			if err := json.NewDecoder(resp.Body).Decode(&sent); err != nil || resp.StatusCode != fiber.StatusOK {
+				t.Errorf("send_message: status %d, %v", resp.StatusCode, err)
+				return
+			}
+			ids[i] = sent.MessageID
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	stored, err := messageStore.List(recipientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != senders {
+		t.Fatalf("%d messages stored, want %d", len(stored), senders)
+	}
+	hashes, err := models.ListMessageHashes(context.Background(), RecipientHash(recipientKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hashes) != senders {
+		t.Fatalf("%d messages indexed, want %d", len(hashes), senders)
+	}
+	for _, id := range ids {
+		data, err := messageStore.Read(recipientKey, id)
+		if err != nil {
+			t.Fatalf("message %s: %v", id, err)
+		}
+		var message Message
+		if err := json.Unmarshal(data, &message); err != nil || message.MessageID != id {
+			t.Fatalf("message %s is damaged: %v", id, err)
+		}
+		if hashes[id] != MessageHash(data) {
+			t.Fatalf("message %s is indexed with hash %q, stored as %q", id, hashes[id], MessageHash(data))
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	"wave_capacitor/nodeca"
+	"wave_capacitor/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Requests between capacitors that don't carry a signed envelope are signed in headers,
+// over the method, the path with its query, the time, a nonce and a hash of the body,
+// with the sending capacitor's backup signing key; the receiver knows the sender by that
+// key, and takes each signature once.
+// Only trusted capacitors get through: those whose key is on the node allowlist, or with
+// node mutual TLS on, those that presented a certificate of the node CA.
+
+const (
+	nodeKeyHeader       = "X-Node-Key"
+	nodeTimestampHeader = "X-Node-Timestamp"
+	nodeSignatureHeader = "X-Node-Signature"
+	nodeNonceHeader     = "X-Node-Nonce"
+)
+
+// usedNodeSignatures refuses a node request signed the same way as one taken before
+var usedNodeSignatures = newReplayCache()
+
+// errNodeSignature is returned for node requests without a valid signature
+var errNodeSignature = serviceError(fiber.StatusUnauthorized, "Missing or invalid node signature")
+
+// errNodeNotTrusted is returned for requests of capacitors this node doesn't trust
+var errNodeNotTrusted = serviceError(fiber.StatusForbidden, "This capacitor is not trusted by this node")
+
+// nodeAllowlist holds the signing keys of the capacitors trusted without a node certificate
+var nodeAllowlist map[string]bool
+
+// SetNodeAllowlist sets the signing keys of the capacitors trusted without a node
+// certificate; call it before the server starts
+func SetNodeAllowlist(keys []string) {
+	nodeAllowlist = make(map[string]bool, len(keys))
+	for _, key := range keys {
+		nodeAllowlist[key] = true
+	}
+}
+
+// nodeTrusted reports whether the capacitor signing with key, over the connection of c,
+// is trusted: its key is allowlisted or the connection presented a node certificate
+func nodeTrusted(c *fiber.Ctx, key string) bool {
+	return nodeAllowlist[key] || nodeca.PeerName(c.Context().TLSConnectionState()) != ""
+}
+
+// routeSignerTrusted reports whether route records signed with key are accepted from the
+// DHT. With an allowlist only its capacitors are; without one, node mutual TLS keeps
+// other nodes out of the DHT.
+func routeSignerTrusted(key string) bool {
+	return len(nodeAllowlist) == 0 || nodeAllowlist[key]
+}
+
+// nodeRequestData returns what the signature of a node request covers
+func nodeRequestData(method, uri, timestamp, nonce string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(method + "\n" + uri + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(sum[:]))
+}
+
+// signNodeRequest signs req, sent with body, with the node's backup signing key
+func signNodeRequest(req *http.Request, body []byte) error {
+	if backupSigningKey == nil {
+		return errors.New("no signing key for node requests")
+	}
+	// Requests alike sent in the same second differ by their nonce
+	nonce, err := utils.GenerateRandomBytes(16)
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	encodedNonce := hex.EncodeToString(nonce)
+	signature := ed25519.Sign(backupSigningKey, nodeRequestData(req.Method, req.URL.RequestURI(), timestamp, encodedNonce, body))
+	req.Header.Set(nodeKeyHeader, ownSignerKey())
+	req.Header.Set(nodeTimestampHeader, timestamp)
+	req.Header.Set(nodeNonceHeader, encodedNonce)
+	req.Header.Set(nodeSignatureHeader, base64.StdEncoding.EncodeToString(signature))
+	return nil
+}
+
+// nodeSigner returns the key of the trusted capacitor that signed the request. Requests
+// signed more than federationMaxSkew away from this node's clock are refused, and so are
+// signatures taken before within that window, to stop replays.
+func nodeSigner(c *fiber.Ctx) (string, error) {
+	key, timestamp, signature := c.Get(nodeKeyHeader), c.Get(nodeTimestampHeader), c.Get(nodeSignatureHeader)
+	nonce := c.Get(nodeNonceHeader)
+	if key == "" || signature == "" || nonce == "" {
+		return "", errNodeSignature
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errNodeSignature
+	}
+	signedAt := time.Unix(unix, 0)
+	if skew := time.Since(signedAt); skew > federationMaxSkew || skew < -federationMaxSkew {
+		return "", serviceError(fiber.StatusUnauthorized, "Node signature is too far from this capacitor's clock")
+	}
+	if !verifyBundleSignature(key, signature, nodeRequestData(c.Method(), c.OriginalURL(), timestamp, nonce, c.Body())) {
+		return "", errNodeSignature
+	}
+	if !usedNodeSignatures.first(key+"\n"+timestamp+"\n"+signature, signedAt.Add(federationMaxSkew)) {
+		return "", serviceError(fiber.StatusUnauthorized, "Node signature was already used")
+	}
+	if !nodeTrusted(c, key) {
+		return "", errNodeNotTrusted
+	}
+	return key, nil
+}
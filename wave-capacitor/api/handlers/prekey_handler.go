@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/api/validate"
+	"wave_capacitor/logging"
+	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// maxPrekeyBatch limits how many one-time prekeys can be uploaded per request
+	maxPrekeyBatch = 100
+
+	// maxStoredPrekeys limits how many unclaimed one-time prekeys a user may hold
+	maxStoredPrekeys = 500
+
+	// prekeyLowWatermark triggers a replenishment warning when fewer prekeys remain
+	prekeyLowWatermark = 10
+)
+
+// UploadPrekeysRequest defines the structure for uploading prekeys
+type UploadPrekeysRequest struct {
+	SignedPrekey *models.SignedPrekey `json:"signed_prekey"`
+	Prekeys      []models.Prekey      `json:"prekeys" validate:"max=100"` // max is maxPrekeyBatch
+}
+
+// ClaimPrekeyRequest defines the structure for claiming a prekey bundle
+type ClaimPrekeyRequest struct {
+	RecipientPublicKey string `json:"recipient_pubkey" validate:"required"`
+}
+
+// UploadPrekeys stores a batch of one-time prekeys and optionally a new signed prekey
+func UploadPrekeys(c *fiber.Ctx) error {
+	// Parse request body
+	var req UploadPrekeysRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+
+	if len(req.Prekeys) == 0 && req.SignedPrekey == nil {
+		return respondError(c, fieldError("prekeys", validate.CodeRequired, "at least one prekey or a signed prekey is required"))
+	}
+
+	// Get username from JWT
+	username := middleware.ExtractUsername(c)
+
+	// Enforce the per-user cap
+	count, err := models.CountPrekeys(c.UserContext(), username)
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error counting prekeys: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Database error"))
+	}
+	if count+len(req.Prekeys) > maxStoredPrekeys {
+		return respondError(c, codedError(fiber.StatusBadRequest, apierror.LimitExceeded, "Prekey limit exceeded"))
+	}
+
+	if req.SignedPrekey != nil {
+		if err := models.SetSignedPrekey(c.UserContext(), username, *req.SignedPrekey); err != nil {
+			logging.Errorf(c.UserContext(), "Error storing signed prekey: %v", err)
+			return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to store signed prekey"))
+		}
+	}
+
+	stored := 0
+	if len(req.Prekeys) > 0 {
+		stored, err = models.StorePrekeys(c.UserContext(), username, req.Prekeys)
+		if err != nil {
+			logging.Errorf(c.UserContext(), "Error storing prekeys: %v", err)
+			return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to store prekeys"))
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success":   true,
+		"stored":    stored,
+		"remaining": count + stored,
+	})
+}
+
+// ClaimPrekey returns a prekey bundle for the recipient, consuming one one-time prekey
+func ClaimPrekey(c *fiber.Ctx) error {
+	// Parse request body
+	var req ClaimPrekeyRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+
+	// A recipient who blocked the requester is hidden before any prekey is used up
+	blocked, err := models.IsBlockedByKey(c.UserContext(), req.RecipientPublicKey, middleware.ExtractUsername(c))
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error checking recipient blocklist: %v", err)
+	}
+	if blocked {
+		return respondError(c, serviceError(fiber.StatusNotFound, "Recipient not found"))
+	}
+
+	bundle, owner, remaining, err := models.ClaimPrekeyBundle(c.UserContext(), req.RecipientPublicKey)
+	if err == models.ErrPrekeyUserNotFound {
+		return respondError(c, serviceError(fiber.StatusNotFound, "Recipient not found"))
+	}
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error claiming prekey: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to claim prekey"))
+	}
+
+	if remaining < prekeyLowWatermark {
+		logging.Warnf(c.UserContext(), "⚠️ User '%s' is running low on prekeys (%d remaining)", owner, remaining)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+		"bundle":  bundle,
+	})
+}
+
+// GetPrekeyStatus reports how many one-time prekeys the authenticated user has left
+func GetPrekeyStatus(c *fiber.Ctx) error {
+	// Get username from JWT
+	username := middleware.ExtractUsername(c)
+
+	count, err := models.CountPrekeys(c.UserContext(), username)
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error counting prekeys: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Database error"))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success":        true,
+		"remaining":      count,
+		"low_watermark":  prekeyLowWatermark,
+		"needs_refill":   count < prekeyLowWatermark,
+		"max_batch_size": maxPrekeyBatch,
+	})
+}
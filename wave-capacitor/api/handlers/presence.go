@@ -0,0 +1,473 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/logging"
+	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// With PRESENCE_ENABLED a user is online while any of their devices sends heartbeats,
+// each keeping the device online for PRESENCE_TIMEOUT_SECONDS. Only the user's contacts
+// see it, and not those the user blocked: when the user comes online, goes offline, and
+// again every timeout while online, each capacitor hosting some of those contacts is told
+// which of them may see it, in an update signed in headers (see node_auth.go). An update
+// that isn't renewed expires, so a capacitor that stops gossiping can't leave its users
+// online elsewhere. Presence is kept in memory and starts out offline after a restart.
+
+const (
+	// presenceSweepInterval is how often expired devices are looked for
+	presenceSweepInterval = 5 * time.Second
+
+	// presenceRetention is how long the last seen time of users offline is kept
+	presenceRetention = 24 * time.Hour
+
+	// maxPresenceDevices bounds the devices a user has online at the same time
+	maxPresenceDevices = 32
+
+	// maxPresenceTTL bounds how long an update from another capacitor is trusted
+	maxPresenceTTL = time.Hour
+)
+
+// presenceTimeout is how long a heartbeat keeps a device online; 0 disables presence
+var presenceTimeout time.Duration
+
+var (
+	presenceMu     sync.Mutex
+	localPresence  = make(map[string]*userPresence) // by username, for accounts hosted here
+	remotePresence = make(map[string]*remoteStatus) // by public key, gossiped by other capacitors
+)
+
+// userPresence is the presence of an account hosted here
+type userPresence struct {
+	publicKey  string
+	devices    map[string]time.Time // device ID to when it goes offline
+	lastSeen   time.Time
+	gossipedAt time.Time
+}
+
+// remoteStatus is the presence of an account hosted on another capacitor
+type remoteStatus struct {
+	online    bool
+	lastSeen  time.Time
+	updatedAt time.Time
+	expires   time.Time
+	audience  map[string]bool
+}
+
+// errPresenceDisabled is returned by the presence endpoints when the node has it off
+var errPresenceDisabled = serviceError(fiber.StatusNotImplemented, "Presence is disabled on this node")
+
+// SetPresence enables presence, a heartbeat keeping a device online for timeout; 0
+// disables it
+func SetPresence(timeout time.Duration) {
+	presenceTimeout = timeout
+}
+
+// PresenceHeartbeatRequest keeps a device of the user online
+type PresenceHeartbeatRequest struct {
+	DeviceID string `json:"device_id" validate:"required,max=255"`
+}
+
+// PresenceLookupRequest names the accounts whose presence is asked for
+type PresenceLookupRequest struct {
+	PublicKeys []string `json:"public_keys" validate:"required,max=100" doc:"Public keys of at most 100 contacts"`
+}
+
+// PresenceStatus is the presence of one account as the requester may see it
+type PresenceStatus struct {
+	PublicKey string     `json:"public_key"`
+	Online    bool       `json:"online"`
+	LastSeen  *time.Time `json:"last_seen,omitempty" doc:"Last heartbeat of the account; left out for accounts that don't share their presence with the requester"`
+}
+
+// PresenceUpdate is what a capacitor gossips about the presence of an account it hosts
+type PresenceUpdate struct {
+	PublicKey  string    `json:"public_key" validate:"required"`
+	Online     bool      `json:"online"`
+	LastSeen   time.Time `json:"last_seen" validate:"required"`
+	UpdatedAt  time.Time `json:"updated_at" validate:"required" doc:"When the update was made; older ones than the last received are ignored"`
+	TTLSeconds int       `json:"ttl_seconds" validate:"min=1" doc:"How long the update holds unless renewed, at most an hour"`
+	Audience   []string  `json:"audience" validate:"required,max=10000" doc:"Public keys hosted on the receiving capacitor that may see the presence"`
+}
+
+// SendPresenceHeartbeat keeps the device of the user online for PRESENCE_TIMEOUT_SECONDS
+func SendPresenceHeartbeat(c *fiber.Ctx) error {
+	if presenceTimeout == 0 {
+		return respondError(c, errPresenceDisabled)
+	}
+	var req PresenceHeartbeatRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+
+	ctx := c.UserContext()
+	username := middleware.ExtractUsername(c)
+	user, err := models.GetUser(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving user for presence: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to update presence"))
+	}
+
+	now := time.Now().UTC()
+	presenceMu.Lock()
+	entry := localPresence[username]
+	if entry == nil {
+		entry = &userPresence{devices: make(map[string]time.Time)}
+		localPresence[username] = entry
+	}
+	if _, ok := entry.devices[req.DeviceID]; !ok && len(entry.devices) >= maxPresenceDevices {
+		presenceMu.Unlock()
+		return respondError(c, codedError(fiber.StatusConflict, apierror.Conflict, "Too many devices online"))
+	}
+	cameOnline := len(entry.devices) == 0
+	entry.publicKey = user.PublicKey
+	entry.devices[req.DeviceID] = now.Add(presenceTimeout)
+	entry.lastSeen = now
+	if cameOnline {
+		entry.gossipedAt = now
+	}
+	presenceMu.Unlock()
+
+	if cameOnline {
+		go gossipPresence(logging.Detach(ctx), username, user.PublicKey, true, now)
+	}
+	return c.Status(fiber.StatusOK).JSON(PresenceHeartbeatResponse{
+		Success:        true,
+		TimeoutSeconds: int(presenceTimeout / time.Second),
+	})
+}
+
+// EndPresence takes the device in ?device_id= offline, and the user with it once no other
+// device is online
+func EndPresence(c *fiber.Ctx) error {
+	if presenceTimeout == 0 {
+		return respondError(c, errPresenceDisabled)
+	}
+	var query DeviceQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+
+	ctx := c.UserContext()
+	username := middleware.ExtractUsername(c)
+	now := time.Now().UTC()
+	presenceMu.Lock()
+	entry := localPresence[username]
+	if entry == nil {
+		presenceMu.Unlock()
+		return respondError(c, serviceError(fiber.StatusNotFound, "Device is not online"))
+	}
+	if _, ok := entry.devices[query.DeviceID]; !ok {
+		presenceMu.Unlock()
+		return respondError(c, serviceError(fiber.StatusNotFound, "Device is not online"))
+	}
+	delete(entry.devices, query.DeviceID)
+	wentOffline := len(entry.devices) == 0
+	if wentOffline {
+		entry.lastSeen = now
+	}
+	publicKey := entry.publicKey
+	presenceMu.Unlock()
+
+	if wentOffline {
+		go gossipPresence(logging.Detach(ctx), username, publicKey, false, now)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+		"message": "Device is offline",
+	})
+}
+
+// LookupPresence returns the presence of the named accounts. Accounts that don't list the
+// user as a contact, or blocked them, and unknown ones are reported offline without a
+// last seen time, so the answer doesn't tell them apart.
+func LookupPresence(c *fiber.Ctx) error {
+	if presenceTimeout == 0 {
+		return respondError(c, errPresenceDisabled)
+	}
+	var req PresenceLookupRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+
+	ctx := c.UserContext()
+	user, err := models.GetUser(ctx, middleware.ExtractUsername(c))
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving user for presence: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to look up presence"))
+	}
+
+	response := PresenceResponse{Success: true, Presence: make([]PresenceStatus, 0, len(req.PublicKeys))}
+	for _, publicKey := range req.PublicKeys {
+		status, err := presenceOf(ctx, publicKey, user.PublicKey)
+		if err != nil {
+			logging.Errorf(ctx, "Error looking up presence: %v", err)
+			return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to look up presence"))
+		}
+		response.Presence = append(response.Presence, status)
+	}
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// presenceOf returns the presence of publicKey as the account of requesterKey may see it
+func presenceOf(ctx context.Context, publicKey, requesterKey string) (PresenceStatus, error) {
+	status := PresenceStatus{PublicKey: publicKey}
+	subject, err := models.GetUserByPublicKey(ctx, publicKey)
+	if errors.Is(err, models.ErrUserNotFound) {
+		presenceMu.Lock()
+		defer presenceMu.Unlock()
+		remote := remotePresence[publicKey]
+		if remote == nil || !remote.audience[requesterKey] {
+			return status, nil
+		}
+		lastSeen := remote.lastSeen
+		status.Online = remote.online && time.Now().Before(remote.expires)
+		status.LastSeen = &lastSeen
+		return status, nil
+	}
+	if err != nil {
+		return status, err
+	}
+
+	if publicKey != requesterKey {
+		visible, err := presenceVisible(ctx, subject.Username, requesterKey)
+		if err != nil || !visible {
+			return status, err
+		}
+	}
+	presenceMu.Lock()
+	defer presenceMu.Unlock()
+	if entry := localPresence[subject.Username]; entry != nil {
+		lastSeen := entry.lastSeen
+		status.Online = len(entry.devices) > 0
+		status.LastSeen = &lastSeen
+	}
+	return status, nil
+}
+
+// presenceVisible reports whether the user shares their presence with the account of
+// requesterKey: whether it's one of their contacts and not blocked
+func presenceVisible(ctx context.Context, username, requesterKey string) (bool, error) {
+	contacts, err := contactStore.ListContacts(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	for _, contact := range contacts {
+		if contact.PublicKey == requesterKey && !contact.Deleted {
+			blocked, err := models.IsKeyBlocked(ctx, username, requesterKey)
+			return err == nil && !blocked, err
+		}
+	}
+	return false, nil
+}
+
+// ReceivePresence takes the presence of an account another capacitor hosts, from the
+// capacitor its public key is routed to
+func ReceivePresence(c *fiber.Ctx) error {
+	if presenceTimeout == 0 || !federationEnabled() {
+		return respondError(c, errPresenceDisabled)
+	}
+	var update PresenceUpdate
+	if err := parseBody(c, &update); err != nil {
+		return respondError(c, err)
+	}
+	signer, err := nodeSigner(c)
+	if err != nil {
+		return respondError(c, err)
+	}
+	if err := routedTo(c.UserContext(), update.PublicKey, signer); err != nil {
+		return respondError(c, err)
+	}
+
+	ttl := min(time.Duration(update.TTLSeconds)*time.Second, maxPresenceTTL)
+	audience := make(map[string]bool, len(update.Audience))
+	for _, key := range update.Audience {
+		audience[key] = true
+	}
+
+	presenceMu.Lock()
+	defer presenceMu.Unlock()
+	if current := remotePresence[update.PublicKey]; current != nil && current.updatedAt.After(update.UpdatedAt) {
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{"success": true})
+	}
+	remotePresence[update.PublicKey] = &remoteStatus{
+		online:    update.Online,
+		lastSeen:  update.LastSeen,
+		updatedAt: update.UpdatedAt,
+		expires:   time.Now().Add(ttl),
+		audience:  audience,
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"success": true})
+}
+
+// gossipPresence tells each capacitor hosting contacts of the user their presence, and
+// which of those contacts may see it; failures are logged and made up for by the next
+// update
+func gossipPresence(ctx context.Context, username, publicKey string, online bool, lastSeen time.Time) {
+	audiences, err := presenceAudiences(ctx, username)
+	if err != nil {
+		logging.Warnf(ctx, "Error listing contacts to gossip presence to: %v", err)
+		return
+	}
+	for capacitor, audience := range audiences {
+		update := PresenceUpdate{
+			PublicKey:  publicKey,
+			Online:     online,
+			LastSeen:   lastSeen,
+			UpdatedAt:  time.Now().UTC(),
+			TTLSeconds: int(3 * presenceTimeout / time.Second),
+			Audience:   audience,
+		}
+		if err := sendPresence(ctx, capacitor, update); err != nil && ctx.Err() == nil {
+			logging.Warnf(ctx, "Error gossiping presence to %s: %v", capacitor, err)
+		}
+	}
+}
+
+// presenceAudiences groups the contacts of the user hosted on other capacitors by
+// capacitor, leaving out those the user blocked
+func presenceAudiences(ctx context.Context, username string) (map[string][]string, error) {
+	contacts, err := contactStore.ListContacts(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	blocked, err := models.ListBlockedKeys(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	skip := make(map[string]bool, len(blocked))
+	for _, entry := range blocked {
+		skip[entry.PublicKey] = true
+	}
+
+	audiences := make(map[string][]string)
+	for _, contact := range contacts {
+		if contact.Deleted || skip[contact.PublicKey] {
+			continue
+		}
+		route, err := remoteRoute(ctx, contact.PublicKey)
+		if err != nil {
+			logging.Warnf(ctx, "Error looking up route of contact for presence: %v", err)
+			continue
+		}
+		if route != nil {
+			audiences[route.Capacitor] = append(audiences[route.Capacitor], contact.PublicKey)
+		}
+	}
+	return audiences, nil
+}
+
+// sendPresence posts a signed presence update to capacitor
+func sendPresence(ctx context.Context, capacitor string, update PresenceUpdate) error {
+	body, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	endpoint := federationScheme + strings.TrimSuffix(capacitor, "/") + "/api/v1/federation/presence"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := signNodeRequest(req, body); err != nil {
+		return err
+	}
+	logging.Propagate(ctx, req.Header)
+
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure apierror.Response
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&failure)
+		return &federationError{Status: resp.StatusCode, Code: failure.Code, Message: failure.Message}
+	}
+	return nil
+}
+
+// pendingPresence is a presence update to gossip after a sweep
+type pendingPresence struct {
+	username  string
+	publicKey string
+	online    bool
+	lastSeen  time.Time
+}
+
+// sweepPresence takes devices whose heartbeats stopped offline, renews the updates of
+// users online once every timeout, and forgets users offline for presenceRetention
+func sweepPresence(ctx context.Context) {
+	now := time.Now().UTC()
+	var pending []pendingPresence
+
+	presenceMu.Lock()
+	for username, entry := range localPresence {
+		wasOnline := len(entry.devices) > 0
+		for device, expires := range entry.devices {
+			if now.After(expires) {
+				delete(entry.devices, device)
+			}
+		}
+		switch {
+		case wasOnline && len(entry.devices) == 0:
+			pending = append(pending, pendingPresence{username, entry.publicKey, false, entry.lastSeen})
+		case len(entry.devices) > 0 && now.Sub(entry.gossipedAt) >= presenceTimeout:
+			entry.gossipedAt = now
+			pending = append(pending, pendingPresence{username, entry.publicKey, true, entry.lastSeen})
+		case len(entry.devices) == 0 && now.Sub(entry.lastSeen) > presenceRetention:
+			delete(localPresence, username)
+		}
+	}
+	for publicKey, remote := range remotePresence {
+		if now.Sub(remote.expires) > presenceRetention {
+			delete(remotePresence, publicKey)
+		}
+	}
+	presenceMu.Unlock()
+
+	for _, update := range pending {
+		if ctx.Err() != nil {
+			return
+		}
+		gossipPresence(ctx, update.username, update.publicKey, update.online, update.lastSeen)
+	}
+}
+
+// StartPresenceSweeps sweeps presence every presenceSweepInterval until the returned
+// function is called, which cancels the gossip in progress
+func StartPresenceSweeps() (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(presenceSweepInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				sweepPresence(ctx)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/api/validate"
+	"wave_capacitor/logging"
+	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+	"wave_capacitor/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Restoring a backup into an existing account needs proof that the caller owns it: a
+// token of the account, or the answer to a recovery challenge. Kyber keys can't sign, so
+// the challenge is an encapsulation to the account's public key, which only the holder
+// of its private key (kept in every backup) can open, and the answer is an HMAC of the
+// challenge ID under the encapsulated secret. Challenges aren't stored: the ID carries
+// the username, a hash of the key and the expiry under a MAC and the encapsulation is
+// derived from the ID, so any capacitor sharing the JWT secret can check the answer.
+//
+// A challenge can also name the public key of a backup instead, so that answering it
+// proves holding that key's private key. Restoring a backup's keys needs this whenever
+// they aren't the account's current or former keys, including into a new account;
+// otherwise anyone could bind a published key to an account and read its mailbox.
+
+// recoveryChallengeTTL is how long a recovery challenge can be answered
+const recoveryChallengeTTL = 5 * time.Minute
+
+// recoveryChallengeKeyPurpose derives the key of recovery challenges from the JWT secret
+const recoveryChallengeKeyPurpose = "wave-recovery-challenge-v1"
+
+// recoveryChallengeHeader is the size of the expiry, nonce and key hash leading a challenge ID
+const recoveryChallengeHeader = 8 + 16 + sha256.Size
+
+// RecoveryChallengeRequest defines the body of POST /recover_account/challenge
+type RecoveryChallengeRequest struct {
+	Username  string `json:"username" validate:"required"`
+	PublicKey string `json:"public_key,omitempty" doc:"public key of the backup to prove; defaults to the account's current key"`
+}
+
+// RecoveryChallengeResponse carries a challenge proving ownership of an account
+type RecoveryChallengeResponse struct {
+	Success     bool      `json:"success"`
+	ChallengeID string    `json:"challenge_id" doc:"pass as challenge_id of recover_account"`
+	Ciphertext  string    `json:"ciphertext" doc:"base64 Kyber512 encapsulation to the public key; decapsulate it with the private key and pass base64(HMAC-SHA256(secret, challenge_id)) as proof"`
+	ExpiresAt   time.Time `json:"expires_at" doc:"each challenge can be answered once, until then"`
+}
+
+// usedRecoveryChallenges refuses a challenge answered before
+var usedRecoveryChallenges = newReplayCache()
+
+// errRecoveryProofRequired refuses a restore into an account the caller hasn't proven to own
+var errRecoveryProofRequired = codedError(fiber.StatusUnauthorized, apierror.RecoveryProof,
+	"Restoring an existing account needs a token of the account or the proof of a recovery challenge")
+
+// errKeyProofRequired refuses restoring keys the caller hasn't proven to hold
+var errKeyProofRequired = codedError(fiber.StatusUnauthorized, apierror.RecoveryProof,
+	"Restoring the keys of a backup needs the proof of a recovery challenge for its public key")
+
+// RecoveryChallenge handles issuing a recovery challenge for an account
+func RecoveryChallenge(c *fiber.Ctx) error {
+	var req RecoveryChallengeRequest
+	if err := decodeBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+
+	resp, err := NewRecoveryChallenge(c.UserContext(), req)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(resp)
+}
+
+// NewRecoveryChallenge issues a challenge for the account, encapsulated to the request's
+// public key or else to the account's current one. An unknown username without a public
+// key gets random bytes of the same size, so that challenges don't tell which accounts exist.
+func NewRecoveryChallenge(ctx context.Context, req RecoveryChallengeRequest) (*RecoveryChallengeResponse, error) {
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+	if req.PublicKey != "" {
+		if err := utils.ValidateKyber512PublicKey(req.PublicKey); err != nil {
+			return nil, fieldError("public_key", validate.CodeFormat, err.Error())
+		}
+	}
+
+	// Backups made before a username change carry the old name
+	username := req.Username
+	if resolved, err := models.ResolveUsername(ctx, username); err != nil {
+		logging.Errorf(ctx, "Error resolving username %s: %v", username, err)
+	} else {
+		username = resolved
+	}
+
+	publicKey := req.PublicKey
+	if publicKey == "" {
+		user, err := models.GetUser(ctx, username)
+		switch {
+		case err == nil:
+			publicKey = user.PublicKey
+		case !errors.Is(err, models.ErrUserNotFound):
+			logging.Errorf(ctx, "Error retrieving user for a recovery challenge: %v", err)
+			return nil, serviceError(fiber.StatusInternalServerError, "Failed to create a recovery challenge")
+		}
+	}
+
+	key, err := middleware.DerivedKey(recoveryChallengeKeyPurpose)
+	if err != nil {
+		logging.Errorf(ctx, "Error deriving the recovery challenge key: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to create a recovery challenge")
+	}
+	nonce, err := utils.GenerateRandomBytes(16)
+	if err != nil {
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to create a recovery challenge")
+	}
+	expires := time.Now().Add(recoveryChallengeTTL).Truncate(time.Second)
+	keyHash := sha256.Sum256([]byte(publicKey))
+	payload := binary.BigEndian.AppendUint64(make([]byte, 0, recoveryChallengeHeader+len(username)), uint64(expires.Unix()))
+	payload = append(append(append(payload, nonce...), keyHash[:]...), username...)
+	challengeID := base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(recoveryMAC(key, "id", payload))
+
+	var ciphertext []byte
+	if publicKey == "" {
+		ciphertext, err = utils.GenerateRandomBytes(utils.KyberCiphertextSize())
+	} else {
+		ciphertext, _, err = recoveryEncapsulation(key, challengeID, publicKey)
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error creating a recovery challenge: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to create a recovery challenge")
+	}
+
+	return &RecoveryChallengeResponse{
+		Success:     true,
+		ChallengeID: challengeID,
+		Ciphertext:  base64.StdEncoding.EncodeToString(ciphertext),
+		ExpiresAt:   expires,
+	}, nil
+}
+
+// recoveryChallenge is a challenge ID whose MAC and expiry were checked
+type recoveryChallenge struct {
+	id       string
+	username string
+	keyHash  []byte
+	expires  time.Time
+}
+
+// parseRecoveryChallenge checks the MAC and expiry of a challenge ID. It is cheap, so
+// restores call it before decrypting a backup and check the proof once the backup
+// names its key.
+func parseRecoveryChallenge(ctx context.Context, challengeID string) (*recoveryChallenge, error) {
+	key, err := middleware.DerivedKey(recoveryChallengeKeyPurpose)
+	if err != nil {
+		logging.Errorf(ctx, "Error deriving the recovery challenge key: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to check the recovery challenge")
+	}
+
+	encodedPayload, encodedMAC, _ := strings.Cut(challengeID, ".")
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil || len(payload) <= recoveryChallengeHeader {
+		return nil, errRecoveryProofRequired
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil || !hmac.Equal(mac, recoveryMAC(key, "id", payload)) {
+		return nil, errRecoveryProofRequired
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)
+	if time.Now().After(expires) {
+		return nil, codedError(fiber.StatusUnauthorized, apierror.RecoveryProof, "The recovery challenge expired, request a new one")
+	}
+	return &recoveryChallenge{
+		id:       challengeID,
+		username: string(payload[recoveryChallengeHeader:]),
+		keyHash:  payload[8+16 : recoveryChallengeHeader],
+		expires:  expires,
+	}, nil
+}
+
+// verifyRecoveryProof checks the answer to a recovery challenge and returns which of the
+// given public keys it proves holding. A challenge is accepted once.
+func verifyRecoveryProof(ctx context.Context, challenge *recoveryChallenge, proof string, publicKeys ...string) (string, error) {
+	publicKey := ""
+	for _, candidate := range publicKeys {
+		if hash := sha256.Sum256([]byte(candidate)); candidate != "" && hmac.Equal(hash[:], challenge.keyHash) {
+			publicKey = candidate
+			break
+		}
+	}
+	if publicKey == "" {
+		return "", codedError(fiber.StatusUnauthorized, apierror.RecoveryProof,
+			"The recovery challenge is for another public key, request one for the key of the backup")
+	}
+
+	key, err := middleware.DerivedKey(recoveryChallengeKeyPurpose)
+	if err != nil {
+		logging.Errorf(ctx, "Error deriving the recovery challenge key: %v", err)
+		return "", serviceError(fiber.StatusInternalServerError, "Failed to check the recovery challenge")
+	}
+	answer, err := base64.StdEncoding.DecodeString(proof)
+	if err != nil {
+		return "", errRecoveryProofRequired
+	}
+	_, secret, err := recoveryEncapsulation(key, challenge.id, publicKey)
+	if err != nil {
+		logging.Errorf(ctx, "Error checking a recovery challenge: %v", err)
+		return "", serviceError(fiber.StatusInternalServerError, "Failed to check the recovery challenge")
+	}
+	defer utils.Zeroize(secret)
+	if !hmac.Equal(answer, recoveryMAC(secret, "", []byte(challenge.id))) {
+		middleware.RecordAuthFailure()
+		return "", errRecoveryProofRequired
+	}
+
+	if !usedRecoveryChallenges.first(challenge.id, challenge.expires) {
+		return "", codedError(fiber.StatusUnauthorized, apierror.RecoveryProof, "The recovery challenge was already answered, request a new one")
+	}
+	return publicKey, nil
+}
+
+// recoveryEncapsulation derives the encapsulation of a challenge to a base64 public key
+func recoveryEncapsulation(key []byte, challengeID, publicKey string) ([]byte, []byte, error) {
+	publicKeyBytes, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return utils.EncapsulateWithKyberSeed(publicKeyBytes, recoveryMAC(key, "seed", []byte(challengeID)))
+}
+
+// recoveryMAC returns the HMAC-SHA256 of data under key; label separates the uses of one key
+func recoveryMAC(key []byte, label string, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	if label != "" {
+		mac.Write([]byte(label + "\x00"))
+	}
+	mac.Write(data)
+	return mac.Sum(nil)
+}
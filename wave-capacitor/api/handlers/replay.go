@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// replaySweepInterval is how often a replay cache drops the values that expired
+const replaySweepInterval = time.Minute
+
+// replayCache remembers values until they expire, so that a signed request or an
+// answered challenge is accepted once. It is kept per process: values it refuses are
+// also refused for their age, which bounds what another process could still accept.
+type replayCache struct {
+	mu    sync.Mutex
+	seen  map[string]time.Time // expiry by value
+	swept time.Time
+}
+
+// newReplayCache returns an empty replay cache
+func newReplayCache() *replayCache {
+	return &replayCache{seen: make(map[string]time.Time)}
+}
+
+// first reports whether value is seen for the first time, remembering it until expires
+func (r *replayCache) first(value string, expires time.Time) bool {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.swept) > replaySweepInterval {
+		for seen, expiry := range r.seen {
+			if now.After(expiry) {
+				delete(r.seen, seen)
+			}
+		}
+		r.swept = now
+	}
+	if expiry, ok := r.seen[value]; ok && !now.After(expiry) {
+		return false
+	}
+	r.seen[value] = expires
+	return true
+}
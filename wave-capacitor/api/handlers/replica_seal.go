@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"wave_capacitor/middleware"
+	"wave_capacitor/utils"
+)
+
+// Replicas are sealed before they leave this capacitor, so that the peers keeping them
+// learn nothing of the messages but their size. A sealed replica is replicaSealPrefix, a
+// tag, then the message under AES-256-GCM with the owner key and message ID as associated
+// data. The tag is a MAC of the owner key, the message ID and the hash of the message the
+// index caches when it is stored (see MessageHash); peers digest replicas by their tag,
+// so this capacitor can compute what they should hold without reading its messages.
+//
+// The keys are derived from the JWT secret, which the capacitors of a cluster share.
+// Replicas sealed under a previous secret no longer open, and anti-entropy replaces them
+// as their tags no longer match.
+
+// replicaSealPrefix starts every sealed replica
+const replicaSealPrefix = "WVR1"
+
+// replicaTagSize is the size of the tag following the prefix
+const replicaTagSize = sha256.Size
+
+// Purposes of the keys derived from the JWT secret for replicas
+const (
+	replicaSealKeyPurpose = "wave-replica-seal-v1"
+	replicaTagKeyPurpose  = "wave-replica-tag-v1"
+)
+
+// errReplicaMismatch is returned for a replica that doesn't open or doesn't match the
+// hash the index holds of the message
+var errReplicaMismatch = errors.New("replica doesn't match the message stored here")
+
+// MessageHash returns the hex SHA-256 of a message as stored, which the message index
+// caches to check the copies replicas hold
+func MessageHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// replicaTag returns the tag of the replica of a message with hash
+func replicaTag(ownerKey, messageID, hash string) ([]byte, error) {
+	key, err := middleware.DerivedKey(replicaTagKeyPurpose)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(ownerKey + "\x00" + messageID + "\x00" + hash))
+	return mac.Sum(nil), nil
+}
+
+// replicaDigestHash returns the hex tag of the replica of a message with hash, which is
+// what peers digest it by
+func replicaDigestHash(ownerKey, messageID, hash string) (string, error) {
+	tag, err := replicaTag(ownerKey, messageID, hash)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(tag), nil
+}
+
+// replicaAssociatedData binds a sealed replica to its mailbox and message
+func replicaAssociatedData(ownerKey, messageID string) []byte {
+	return []byte(replicaSealPrefix + "\x00" + ownerKey + "\x00" + messageID)
+}
+
+// sealReplica seals a message as stored for its replicas
+func sealReplica(ownerKey, messageID string, data []byte) ([]byte, error) {
+	tag, err := replicaTag(ownerKey, messageID, MessageHash(data))
+	if err != nil {
+		return nil, err
+	}
+	key, err := middleware.DerivedKey(replicaSealKeyPurpose)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.Zeroize(key)
+	aead, err := utils.NewAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed := append([]byte(replicaSealPrefix), tag...)
+	return aead.SealTo(sealed, data, replicaAssociatedData(ownerKey, messageID))
+}
+
+// openReplica opens a sealed replica. The message must match hash, the hash the index
+// holds of it, unless that is empty for messages indexed before hashes were kept.
+func openReplica(ownerKey, messageID, hash string, sealed []byte) ([]byte, error) {
+	header := len(replicaSealPrefix) + replicaTagSize
+	if len(sealed) < header || !bytes.HasPrefix(sealed, []byte(replicaSealPrefix)) {
+		return nil, errReplicaMismatch
+	}
+	key, err := middleware.DerivedKey(replicaSealKeyPurpose)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.Zeroize(key)
+	aead, err := utils.NewAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := aead.Open(sealed[header:], replicaAssociatedData(ownerKey, messageID))
+	if err != nil {
+		return nil, errReplicaMismatch
+	}
+
+	actual := MessageHash(data)
+	if hash != "" && actual != hash {
+		return nil, errReplicaMismatch
+	}
+	tag, err := replicaTag(ownerKey, messageID, actual)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(tag, sealed[len(replicaSealPrefix):header]) {
+		return nil, errReplicaMismatch
+	}
+	return data, nil
+}
+
+// sealedReplicaHash returns what a replica kept here is digested by: the tag of sealed
+// replicas, the SHA-256 of others
+func sealedReplicaHash(data []byte) string {
+	header := len(replicaSealPrefix) + replicaTagSize
+	if len(data) >= header && bytes.HasPrefix(data, []byte(replicaSealPrefix)) {
+		return hex.EncodeToString(data[len(replicaSealPrefix):header])
+	}
+	return MessageHash(data)
+}
@@ -0,0 +1,535 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/api/validate"
+	"wave_capacitor/logging"
+	"wave_capacitor/models"
+	"wave_capacitor/storage"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// With MAILBOX_REPLICAS set, every message stored in or deleted from a mailbox here is
+// copied in the background to that many peer capacitors: the MAILBOX_REPLICA_PEERS, or
+// else the capacitors closest to the owner's key in the DHT. Peers that accept replicas
+// (MAILBOX_REPLICA_ACCEPT) keep them in a store apart from their own mailboxes, and only
+// take them from the capacitor the owner's key is routed to. Replicas are sealed so those
+// peers can't read them (see replica_seal.go).
+//
+// A message that can't be read here but that the index still lists is fetched back from
+// a replica and stored again, once it matches the hash the index keeps of it.
+// The reconciliation job restores indexed messages missing here, pushes what replicas
+// miss and deletes from them what was deleted here: the mailboxes and index of this
+// node are authoritative. In between, anti-entropy (see anti_entropy.go) compares digests
+// to repair the replicas that diverged.
+
+// replicationQueueSize bounds the writes and deletes waiting to be replicated; beyond
+// it they are dropped and left to the reconciliation job
+const replicationQueueSize = 10000
+
+// replicationWorkers is how many replica operations are sent at the same time
+const replicationWorkers = 4
+
+// maxReplicaResponse bounds what is read from a replica's answer
+const maxReplicaResponse = 64 * 1024 * 1024
+
+// replicaIndexPage is how many index entries are compared per query while reconciling
+const replicaIndexPage = 500
+
+// ReplicaWriteRequest stores the replica of a message
+type ReplicaWriteRequest struct {
+	OwnerKey  string `json:"owner_key" validate:"required"`
+	MessageID string `json:"message_id" validate:"required"`
+	Data      []byte `json:"data" validate:"required" doc:"base64 message sealed by the primary capacitor"`
+}
+
+// ReplicaDeleteRequest deletes the replica of a message
+type ReplicaDeleteRequest struct {
+	OwnerKey  string `json:"owner_key" validate:"required"`
+	MessageID string `json:"message_id" validate:"required"`
+}
+
+// ReplicaQuery names the mailbox, and for single messages the message, of a replica read
+type ReplicaQuery struct {
+	OwnerKey  string `query:"owner_key" validate:"required"`
+	MessageID string `query:"message_id"`
+}
+
+// replicaOp is a write or delete waiting to be replicated
+type replicaOp struct {
+	delete    bool
+	ownerKey  string
+	messageID string
+	data      []byte
+}
+
+var (
+	replicaCount int                            // 0 disables replication
+	replicaPeers func(ownerKey string) []string // peers that may hold a mailbox, best first
+	replicaQueue chan replicaOp                 // nil until StartReplication
+
+	replicaStore storage.MessageStore // replicas kept for other capacitors; nil refuses them
+
+	replicasDropped atomic.Int64
+)
+
+// errReplicasRefused is returned by the replica endpoints when the node doesn't accept them
+var errReplicasRefused = serviceError(fiber.StatusNotImplemented, "This node does not accept mailbox replicas")
+
+// SetReplication replicates every mailbox to count of the peers returned by peers
+func SetReplication(count int, peers func(ownerKey string) []string) {
+	replicaCount = count
+	replicaPeers = peers
+}
+
+// SetReplicaStore configures the store of the replicas other capacitors send; nil refuses them
+func SetReplicaStore(store storage.MessageStore) {
+	replicaStore = store
+}
+
+// ReplicasDropped returns how many replica operations were dropped on a full queue
+func ReplicasDropped() int64 {
+	return replicasDropped.Load()
+}
+
+// StartReplication sends queued replica operations until the returned function is
+// called; operations still queued then are left to the reconciliation job
+func StartReplication() (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	replicaQueue = make(chan replicaOp, replicationQueueSize)
+	var wg sync.WaitGroup
+	for i := 0; i < replicationWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case op := <-replicaQueue:
+					sendReplicaOp(ctx, op)
+				}
+			}
+		}()
+	}
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// replicate queues a write or delete for the replicas of its mailbox
+func replicate(op replicaOp) {
+	if replicaQueue == nil {
+		return
+	}
+	select {
+	case replicaQueue <- op:
+	default:
+		replicasDropped.Add(1)
+	}
+}
+
+// sendReplicaOp applies op on every replica of its mailbox; failures are logged and left
+// to the reconciliation job
+func sendReplicaOp(ctx context.Context, op replicaOp) {
+	for _, peer := range replicaTargets(op.ownerKey) {
+		var err error
+		if op.delete {
+			err = replicaRequest(ctx, http.MethodPost, peer, "/delete", ReplicaDeleteRequest{OwnerKey: op.ownerKey, MessageID: op.messageID}, nil)
+			if errors.Is(err, storage.ErrMessageNotFound) {
+				err = nil
+			}
+		} else {
+			err = pushReplica(ctx, peer, op.ownerKey, op.messageID, op.data)
+		}
+		if err != nil && ctx.Err() == nil {
+			logging.Warnf(ctx, "Error replicating message %s to %s: %v", op.messageID, peer, err)
+		}
+	}
+}
+
+// replicaTargets returns the peers holding the replicas of a mailbox
+func replicaTargets(ownerKey string) []string {
+	if replicaCount <= 0 || replicaPeers == nil {
+		return nil
+	}
+	var targets []string
+	for _, peer := range replicaPeers(ownerKey) {
+		if peer != routeCapacitor {
+			targets = append(targets, peer)
+		}
+		if len(targets) == replicaCount {
+			break
+		}
+	}
+	return targets
+}
+
+// replicaRequest sends a signed request to the replica endpoints of peer, decoding the
+// answer into out. A 404 is returned as storage.ErrMessageNotFound.
+func replicaRequest(ctx context.Context, method, peer, path string, body, out interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, federationScheme+peer+"/api/v1/replicas"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if err := signNodeRequest(req, data); err != nil {
+		return err
+	}
+	logging.Propagate(ctx, req.Header)
+
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return storage.ErrMessageNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure apierror.Response
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&failure)
+		return &federationError{Status: resp.StatusCode, Code: failure.Code, Message: failure.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxReplicaResponse)).Decode(out)
+}
+
+// pushReplica seals a message as stored here and writes it to the replica on peer
+func pushReplica(ctx context.Context, peer, ownerKey, messageID string, data []byte) error {
+	sealed, err := sealReplica(ownerKey, messageID, data)
+	if err != nil {
+		return err
+	}
+	return replicaRequest(ctx, http.MethodPost, peer, "/write", ReplicaWriteRequest{OwnerKey: ownerKey, MessageID: messageID, Data: sealed}, nil)
+}
+
+// readReplica fetches a message that can't be read here from the replicas of its mailbox
+// and stores it here again. Only messages the index lists are fetched, and only a replica
+// matching the hash the index keeps of the message is taken. Without one, localErr is
+// returned.
+func readReplica(ctx context.Context, ownerKey, messageID string, localErr error) ([]byte, error) {
+	hash, err := models.GetMessageHash(ctx, RecipientHash(ownerKey), messageID)
+	if errors.Is(err, models.ErrMessageNotIndexed) {
+		return nil, localErr // Deleted, or never stored here
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error looking up message index for replica read: %v", err)
+		return nil, localErr
+	}
+
+	query := "/message?owner_key=" + url.QueryEscape(ownerKey) + "&message_id=" + url.QueryEscape(messageID)
+	for _, peer := range replicaTargets(ownerKey) {
+		var resp ReplicaMessageResponse
+		if err := replicaRequest(ctx, http.MethodGet, peer, query, nil, &resp); err != nil {
+			if !errors.Is(err, storage.ErrMessageNotFound) {
+				logging.Warnf(ctx, "Error reading replica of message %s from %s: %v", messageID, peer, err)
+			}
+			continue
+		}
+		data, err := openReplica(ownerKey, messageID, hash, resp.Data)
+		if err != nil {
+			logging.Warnf(ctx, "Refusing replica of message %s from %s: %v", messageID, peer, err)
+			continue
+		}
+		if err := messageStore.Write(ownerKey, messageID, data); err != nil {
+			logging.Warnf(ctx, "Error restoring message %s from its replica: %v", messageID, err)
+		} else {
+			logging.Infof(ctx, "Restored message %s from its replica on %s", messageID, peer)
+		}
+		return data, nil
+	}
+	return nil, localErr
+}
+
+// authorizeReplica checks that a replica request comes from the capacitor the mailbox's
+// owner key is routed to
+func authorizeReplica(c *fiber.Ctx, ownerKey, messageID string) error {
+	if replicaStore == nil {
+		return errReplicasRefused
+	}
+	if messageID != "" {
+		if _, err := uuid.Parse(messageID); err != nil {
+			return fieldError("message_id", validate.CodeFormat, "must be a UUID")
+		}
+	}
+	signer, err := nodeSigner(c)
+	if err != nil {
+		return err
+	}
+	return routedTo(c.UserContext(), ownerKey, signer)
+}
+
+// WriteReplica stores the replica of a message for the capacitor hosting its mailbox
+func WriteReplica(c *fiber.Ctx) error {
+	var req ReplicaWriteRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+	if err := authorizeReplica(c, req.OwnerKey, req.MessageID); err != nil {
+		return respondError(c, err)
+	}
+
+	ctx := c.UserContext()
+	if err := replicaStore.Write(req.OwnerKey, req.MessageID, req.Data); err != nil {
+		logging.Errorf(ctx, "Error writing replica: %v", err)
+		if errors.Is(err, storage.ErrInsufficientStorage) {
+			return respondError(c, errInsufficientStorage)
+		}
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to store replica"))
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"success": true})
+}
+
+// DeleteReplica deletes the replica of a message
+func DeleteReplica(c *fiber.Ctx) error {
+	var req ReplicaDeleteRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+	if err := authorizeReplica(c, req.OwnerKey, req.MessageID); err != nil {
+		return respondError(c, err)
+	}
+
+	ctx := c.UserContext()
+	err := replicaStore.Delete(req.OwnerKey, req.MessageID)
+	if errors.Is(err, storage.ErrMessageNotFound) {
+		return respondError(c, serviceError(fiber.StatusNotFound, "No replica of the message"))
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error deleting replica: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to delete replica"))
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"success": true})
+}
+
+// GetReplica returns the replica of a message
+func GetReplica(c *fiber.Ctx) error {
+	var query ReplicaQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+	if query.MessageID == "" {
+		return respondError(c, fieldError("message_id", validate.CodeRequired, "is required"))
+	}
+	if err := authorizeReplica(c, query.OwnerKey, query.MessageID); err != nil {
+		return respondError(c, err)
+	}
+
+	ctx := c.UserContext()
+	data, err := replicaStore.Read(query.OwnerKey, query.MessageID)
+	if errors.Is(err, storage.ErrMessageNotFound) {
+		return respondError(c, serviceError(fiber.StatusNotFound, "No replica of the message"))
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error reading replica: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to read replica"))
+	}
+	return c.Status(fiber.StatusOK).JSON(ReplicaMessageResponse{Success: true, Data: data})
+}
+
+// ListReplicas returns the IDs of the replicated messages of a mailbox
+func ListReplicas(c *fiber.Ctx) error {
+	var query ReplicaQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+	if err := authorizeReplica(c, query.OwnerKey, ""); err != nil {
+		return respondError(c, err)
+	}
+
+	ctx := c.UserContext()
+	ids, err := replicaStore.List(query.OwnerKey)
+	if err != nil {
+		logging.Errorf(ctx, "Error listing replicas: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to list replicas"))
+	}
+	return c.Status(fiber.StatusOK).JSON(ReplicaListResponse{Success: true, MessageIDs: ids})
+}
+
+// ReplicaReconcileReport summarizes a pass comparing the mailboxes here with their replicas
+type ReplicaReconcileReport struct {
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	Mailboxes int           `json:"mailboxes"`
+	Restored  int           `json:"restored"` // indexed messages missing here, fetched from a replica
+	Missing   int           `json:"missing"`  // indexed messages missing here and on every replica
+	Pushed    int           `json:"pushed"`
+	Deleted   int           `json:"deleted"`
+	Errors    int           `json:"errors"`
+	Dropped   int64         `json:"dropped"` // replica operations dropped on a full queue since startup
+}
+
+// RunReplicaReconciliation compares every mailbox hosted here with its replicas
+func RunReplicaReconciliation(ctx context.Context) (ReplicaReconcileReport, error) {
+	report := ReplicaReconcileReport{StartedAt: time.Now(), Dropped: ReplicasDropped()}
+	if replicaCount <= 0 {
+		return report, errors.New("mailbox replication is off")
+	}
+	users, err := models.ListUsers(ctx)
+	if err != nil {
+		return report, err
+	}
+	for i := range users {
+		for _, key := range ownerKeys(ctx, &users[i]) {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			reconcileMailbox(ctx, key, &report)
+			report.Mailboxes++
+		}
+	}
+	report.Duration = time.Since(report.StartedAt)
+	return report, nil
+}
+
+// reconcileMailbox restores the indexed messages of a mailbox missing here, then brings
+// each replica in line with the mailbox
+func reconcileMailbox(ctx context.Context, ownerKey string, report *ReplicaReconcileReport) {
+	ids, err := messageStore.List(ownerKey)
+	if err != nil {
+		logging.Errorf(ctx, "Error listing mailbox to reconcile: %v", err)
+		report.Errors++
+		return
+	}
+	local := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		local[id] = true
+	}
+	restoreIndexed(ctx, ownerKey, local, report)
+
+	for _, peer := range replicaTargets(ownerKey) {
+		var listed ReplicaListResponse
+		if err := replicaRequest(ctx, http.MethodGet, peer, "/list?owner_key="+url.QueryEscape(ownerKey), nil, &listed); err != nil {
+			logging.Warnf(ctx, "Error listing replicas on %s: %v", peer, err)
+			report.Errors++
+			continue
+		}
+		remote := make(map[string]bool, len(listed.MessageIDs))
+		for _, id := range listed.MessageIDs {
+			remote[id] = true
+			if local[id] {
+				continue
+			}
+			if err := replicaRequest(ctx, http.MethodPost, peer, "/delete", ReplicaDeleteRequest{OwnerKey: ownerKey, MessageID: id}, nil); err != nil && !errors.Is(err, storage.ErrMessageNotFound) {
+				logging.Warnf(ctx, "Error deleting replica of message %s on %s: %v", id, peer, err)
+				report.Errors++
+				continue
+			}
+			report.Deleted++
+		}
+		for id := range local {
+			if remote[id] {
+				continue
+			}
+			data, err := messageStore.Read(ownerKey, id)
+			if err != nil {
+				report.Errors++
+				continue
+			}
+			if err := pushReplica(ctx, peer, ownerKey, id, data); err != nil {
+				logging.Warnf(ctx, "Error pushing replica of message %s to %s: %v", id, peer, err)
+				report.Errors++
+				continue
+			}
+			report.Pushed++
+		}
+	}
+}
+
+// restoreIndexed fetches the messages of a mailbox that the index lists but are missing
+// here from the replicas, adding them to local
+func restoreIndexed(ctx context.Context, ownerKey string, local map[string]bool, report *ReplicaReconcileReport) {
+	hashes := []string{RecipientHash(ownerKey)}
+	var before time.Time
+	var beforeID string
+	for {
+		entries, err := models.ListMessageIndex(ctx, hashes, before, beforeID, replicaIndexPage)
+		if err != nil {
+			logging.Errorf(ctx, "Error listing message index to reconcile: %v", err)
+			report.Errors++
+			return
+		}
+		for _, entry := range entries {
+			if local[entry.MessageID] {
+				continue
+			}
+			if _, err := readReplica(ctx, ownerKey, entry.MessageID, storage.ErrMessageNotFound); err != nil {
+				report.Missing++
+				continue
+			}
+			local[entry.MessageID] = true
+			report.Restored++
+		}
+		if len(entries) < replicaIndexPage {
+			return
+		}
+		last := entries[len(entries)-1]
+		before, beforeID = last.Timestamp, last.MessageID
+	}
+}
+
+// StartReplicaReconciliation reconciles every mailbox with its replicas every interval
+// while this capacitor leads the cluster (see leader.go), until the returned function is
+// called, which cancels a pass in progress
+func StartReplicaReconciliation(interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if !isLeader() {
+				continue
+			}
+
+			report, err := RunReplicaReconciliation(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				logging.Errorf(ctx, "Error reconciling replicas: %v", err)
+				continue
+			}
+			logging.Infof(ctx, "🪞 Reconciled %d mailboxes with their replicas: %d restored, %d missing, %d pushed, %d deleted, %d errors in %s",
+				report.Mailboxes, report.Restored, report.Missing, report.Pushed, report.Deleted, report.Errors, report.Duration.Round(time.Millisecond))
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
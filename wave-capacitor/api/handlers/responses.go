@@ -0,0 +1,483 @@
+package handlers
+
+import (
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/config"
+	"wave_capacitor/doctor"
+	"wave_capacitor/health"
+	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+	"wave_capacitor/storage"
+	"wave_capacitor/version"
+)
+
+// Response bodies of the API. The service functions return them directly; handlers that
+// still build a fiber.Map must keep it in sync with the type documented here. Failed
+// requests return apierror.Response.
+
+// ErrorCatalogResponse lists the error codes of the API
+type ErrorCatalogResponse struct {
+	Success bool             `json:"success"`
+	Codes   []apierror.Entry `json:"codes"`
+}
+
+// SuccessResponse is returned by endpoints that only confirm the operation
+type SuccessResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// UserInfo identifies an account
+type UserInfo struct {
+	Username  string `json:"username"`
+	PublicKey string `json:"public_key"`
+}
+
+// RegisterResponse is returned by /api/register
+type RegisterResponse struct {
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+	Token     string `json:"token" doc:"JWT for the protected endpoints, valid for 24 hours"`
+	PublicKey string `json:"public_key" doc:"Base64 encoded public key generated for the account"`
+}
+
+// LoginResponse is returned by /api/login
+type LoginResponse struct {
+	Success bool     `json:"success"`
+	Message string   `json:"message"`
+	Token   string   `json:"token" doc:"JWT for the protected endpoints, valid for 24 hours"`
+	User    UserInfo `json:"user"`
+}
+
+// TokenResponse is returned by /api/recover_account
+type TokenResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Token   string `json:"token"`
+}
+
+// RecoverResponse is returned by /api/recover_account
+type RecoverResponse struct {
+	Success bool         `json:"success"`
+	Message string       `json:"message"`
+	Token   string       `json:"token,omitempty" doc:"absent on a dry run"`
+	DryRun  bool         `json:"dry_run,omitempty"`
+	Plan    *RestorePlan `json:"plan"`
+}
+
+// ChangeUsernameResponse is returned by /api/change_username
+type ChangeUsernameResponse struct {
+	Success  bool   `json:"success"`
+	Message  string `json:"message"`
+	Username string `json:"username"`
+	Token    string `json:"token" doc:"New token issued for the new username"`
+}
+
+// PublicKeyResponse is returned by /api/get_public_key
+type PublicKeyResponse struct {
+	Success   bool   `json:"success"`
+	PublicKey string `json:"public_key"`
+}
+
+// EncryptedPrivateKeyResponse is returned by /api/get_encrypted_private_key
+type EncryptedPrivateKeyResponse struct {
+	Success             bool   `json:"success"`
+	EncryptedPrivateKey string `json:"encrypted_private_key"`
+}
+
+// RotateKeysResponse is returned by /api/rotate_keys
+type RotateKeysResponse struct {
+	Success      bool   `json:"success"`
+	Message      string `json:"message"`
+	PublicKey    string `json:"public_key"`
+	OldPublicKey string `json:"old_public_key" doc:"Retired key, still accepted for decrypting older messages"`
+}
+
+// KeyHistoryResponse is returned by /api/key_history
+type KeyHistoryResponse struct {
+	Success bool               `json:"success"`
+	Keys    []models.KeyRecord `json:"keys"`
+}
+
+// ResolveKeyResponse is returned by /api/resolve_key
+type ResolveKeyResponse struct {
+	Success   bool   `json:"success"`
+	Username  string `json:"username"`
+	PublicKey string `json:"public_key" doc:"Current public key of the account"`
+	Current   bool   `json:"current" doc:"False when the queried key was retired by rotation"`
+}
+
+// SendMessageResponse is returned by /api/send_message
+type SendMessageResponse struct {
+	Success   bool               `json:"success"`
+	Message   string             `json:"message"`
+	MessageID string             `json:"message_id"`
+	Timestamp time.Time          `json:"timestamp"`
+	Receipt   *FederationReceipt `json:"receipt,omitempty" doc:"Set when the recipient is hosted on another capacitor, which acknowledged the message"`
+	Queued    bool               `json:"queued,omitempty" doc:"The recipient's capacitor couldn't be reached; the message is forwarded once it can be"`
+}
+
+// ResolveHandleResponse is returned by /api/resolve_handle
+type ResolveHandleResponse struct {
+	Success bool           `json:"success"`
+	Handle  ResolvedHandle `json:"handle"`
+}
+
+// HandleResponse is returned by /api/federation/handle
+type HandleResponse struct {
+	Success bool         `json:"success"`
+	Record  HandleRecord `json:"record"`
+}
+
+// FederationQueueResponse is returned by /api/admin/federation/queue
+type FederationQueueResponse struct {
+	Success      bool                         `json:"success"`
+	Destinations []FederationQueueDestination `json:"destinations"`
+	Expired      int64                        `json:"expired" doc:"Messages dropped undelivered since the node started"`
+}
+
+// FederationDeliverResponse is returned by /api/federation/deliver
+type FederationDeliverResponse struct {
+	Success bool              `json:"success"`
+	Receipt FederationReceipt `json:"receipt"`
+}
+
+// MessagesResponse is returned by /api/get_messages
+type MessagesResponse struct {
+	Success    bool      `json:"success"`
+	Messages   []Message `json:"messages"`
+	NextCursor string    `json:"next_cursor,omitempty" doc:"Pass as ?before= to fetch the next page; absent on the last page"`
+}
+
+// UnreadCountResponse is returned by /api/unread_count
+type UnreadCountResponse struct {
+	Success bool `json:"success"`
+	Unread  int  `json:"unread"`
+}
+
+// MarkReadResponse is returned by /api/mark_read
+type MarkReadResponse struct {
+	Success bool `json:"success"`
+	Updated int  `json:"updated" doc:"Number of messages that were unread"`
+}
+
+// AddContactResponse is returned by /api/add_contact
+type AddContactResponse struct {
+	Success          bool   `json:"success"`
+	Message          string `json:"message"`
+	ContactPublicKey string `json:"contact_public_key" doc:"Public key of the contact, resolved from contact_handle when one was given"`
+}
+
+// ContactsResponse is returned by /api/get_contacts
+type ContactsResponse struct {
+	Success  bool                   `json:"success"`
+	Contacts map[string]ContactView `json:"contacts" doc:"Contacts keyed by public key"`
+}
+
+// BlocklistResponse is returned by /api/blocklist
+type BlocklistResponse struct {
+	Success bool                `json:"success"`
+	Keys    []models.BlockedKey `json:"keys"`
+	Limit   int                 `json:"limit" doc:"How many keys can be blocked"`
+}
+
+// DiscoveryResponse is returned by /api/discovery
+type DiscoveryResponse struct {
+	Success        bool                      `json:"success"`
+	OptedIn        bool                      `json:"opted_in"`
+	Identity       *models.DiscoveryIdentity `json:"identity,omitempty"`
+	RecordTTLHours int                       `json:"record_ttl_hours" doc:"How long published records last; look contacts up again before they expire"`
+}
+
+// DiscoveryLookupResponse is returned by /api/discovery/lookup
+type DiscoveryLookupResponse struct {
+	Success bool              `json:"success"`
+	Matches []DiscoveryRecord `json:"matches" doc:"Contacts that looked the user up as well"`
+	Pending int               `json:"pending" doc:"Contacts the user's record was published for that haven't looked the user up yet"`
+	Failed  int               `json:"failed" doc:"Contacts that couldn't be looked up; try again later"`
+}
+
+// PresenceHeartbeatResponse is returned by POST /api/presence
+type PresenceHeartbeatResponse struct {
+	Success        bool `json:"success"`
+	TimeoutSeconds int  `json:"timeout_seconds" doc:"How long the device stays online without another heartbeat"`
+}
+
+// PresenceResponse is returned by /api/presence/lookup
+type PresenceResponse struct {
+	Success  bool             `json:"success"`
+	Presence []PresenceStatus `json:"presence" doc:"One entry per public key asked for, in order"`
+}
+
+// ReplicaMessageResponse is returned by /api/replicas/message
+type ReplicaMessageResponse struct {
+	Success bool   `json:"success"`
+	Data    []byte `json:"data" doc:"base64 message as stored by the primary capacitor"`
+}
+
+// ReplicaListResponse is returned by /api/replicas/list
+type ReplicaListResponse struct {
+	Success    bool     `json:"success"`
+	MessageIDs []string `json:"message_ids"`
+}
+
+// ReplicaDigestResponse is returned by /api/replicas/digest
+type ReplicaDigestResponse struct {
+	Success  bool              `json:"success"`
+	Root     string            `json:"root,omitempty" doc:"Hash of the bucket hashes; set without bucket"`
+	Buckets  []string          `json:"buckets,omitempty" doc:"Hash of each bucket, in order; set without bucket"`
+	Messages map[string]string `json:"messages,omitempty" doc:"SHA-256 of each message of the bucket asked for, keyed by message ID"`
+}
+
+// RouteResponse is returned by /api/internal/route
+type RouteResponse struct {
+	Success bool        `json:"success"`
+	Route   RouteRecord `json:"route"`
+	Source  string      `json:"source" doc:"local when this node hosts the account, otherwise cache or dht"`
+}
+
+// RouteProofResponse proves a capacitor holds the private key of an account it routes
+type RouteProofResponse struct {
+	Success bool   `json:"success"`
+	Proof   string `json:"proof" doc:"base64 HMAC-SHA256, under the encapsulated secret, of the public key and this capacitor's signing key"`
+}
+
+// ContactImportResponse is returned by /api/import_contacts
+type ContactImportResponse struct {
+	Success        bool     `json:"success"`
+	Added          int      `json:"added"`
+	Updated        int      `json:"updated" doc:"Listed contacts whose nickname the overwrite strategy replaced"`
+	Skipped        int      `json:"skipped" doc:"Listed contacts left as they were"`
+	Invalid        int      `json:"invalid" doc:"Entries without a public key or with a nickname over 256 characters, or listed twice"`
+	InvalidEntries []string `json:"invalid_entries,omitempty" doc:"The first invalid entries and why"`
+	Signed         bool     `json:"signed" doc:"The bundle was signed, and the signature matched"`
+	TrustedSigner  bool     `json:"trusted_signer" doc:"signed with this node's key rather than another node's"`
+}
+
+// ContactsSyncResponse is returned by /api/contacts_sync
+type ContactsSyncResponse struct {
+	Success   bool          `json:"success"`
+	Full      bool          `json:"full" doc:"The contacts are the whole list, replacing the client's, rather than changes"`
+	Contacts  []ContactView `json:"contacts" doc:"Changed contacts and tombstones of removed ones, in the order they changed"`
+	NextSince time.Time     `json:"next_since" doc:"Pass as since to the next sync"`
+}
+
+// ContactResponse is returned by /api/verify_contact
+type ContactResponse struct {
+	Success bool        `json:"success"`
+	Contact ContactView `json:"contact"`
+}
+
+// UploadPrekeysResponse is returned by /api/upload_prekeys
+type UploadPrekeysResponse struct {
+	Success   bool `json:"success"`
+	Stored    int  `json:"stored"`
+	Remaining int  `json:"remaining"`
+}
+
+// ClaimPrekeyResponse is returned by /api/claim_prekey
+type ClaimPrekeyResponse struct {
+	Success bool                `json:"success"`
+	Bundle  models.PrekeyBundle `json:"bundle"`
+}
+
+// PrekeyStatusResponse is returned by /api/prekey_status
+type PrekeyStatusResponse struct {
+	Success      bool `json:"success"`
+	Remaining    int  `json:"remaining"`
+	LowWatermark int  `json:"low_watermark"`
+	NeedsRefill  bool `json:"needs_refill"`
+	MaxBatchSize int  `json:"max_batch_size"`
+}
+
+// SessionResponse is returned by GET /api/session
+type SessionResponse struct {
+	Success bool               `json:"success"`
+	Session models.SessionBlob `json:"session"`
+}
+
+// SessionsResponse is returned by /api/sessions
+type SessionsResponse struct {
+	Success  bool                 `json:"success"`
+	Sessions []models.SessionBlob `json:"sessions"`
+}
+
+// PutSessionResponse is returned by PUT /api/session
+type PutSessionResponse struct {
+	Success bool `json:"success"`
+	Version int  `json:"version" doc:"New version, pass as expected_version on the next update"`
+}
+
+// WebhookCreatedResponse is returned by POST /api/webhooks
+type WebhookCreatedResponse struct {
+	Success bool           `json:"success"`
+	Webhook models.Webhook `json:"webhook"`
+	Secret  string         `json:"secret" doc:"Signs the Wave-Signature header of deliveries; only returned once"`
+}
+
+// WebhooksResponse is returned by GET /api/webhooks
+type WebhooksResponse struct {
+	Success    bool             `json:"success"`
+	Webhooks   []models.Webhook `json:"webhooks"`
+	EventTypes []string         `json:"event_types" doc:"Event types a webhook can subscribe to"`
+}
+
+// StoredBackupResponse is returned by POST /api/stored_backups
+type StoredBackupResponse struct {
+	Success bool                `json:"success"`
+	Backup  models.StoredBackup `json:"backup"`
+}
+
+// StoredBackupsResponse is returned by GET /api/stored_backups
+type StoredBackupsResponse struct {
+	Success bool                  `json:"success"`
+	Backups []models.StoredBackup `json:"backups" doc:"oldest first"`
+	Limit   int                   `json:"limit" doc:"how many backups a user can store"`
+}
+
+// WebhookDeliveriesResponse is returned by the webhook delivery log endpoints
+type WebhookDeliveriesResponse struct {
+	Success    bool                     `json:"success"`
+	Deliveries []models.WebhookDelivery `json:"deliveries" doc:"Latest attempts, newest first"`
+}
+
+// ShardImportStartedResponse is returned by POST /api/shards/import
+type ShardImportStartedResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+	Cursor  string `json:"cursor" doc:"Resume point the import starts from"`
+}
+
+// ShardImportStatusResponse is returned by GET /api/shards/import
+type ShardImportStatusResponse struct {
+	Success bool              `json:"success"`
+	Import  ShardImportStatus `json:"import"`
+}
+
+// MaintenanceResponse is returned by the maintenance admin endpoints
+type MaintenanceResponse struct {
+	Success     bool                         `json:"success"`
+	Maintenance middleware.MaintenanceStatus `json:"maintenance"`
+}
+
+// AdminUsersResponse is returned by GET /api/admin/users
+type AdminUsersResponse struct {
+	Success   bool                 `json:"success"`
+	Users     []models.UserSummary `json:"users"`
+	NextAfter string               `json:"next_after,omitempty" doc:"Pass as ?after= to fetch the next page; absent on the last page"`
+}
+
+// AdminUserResponse is returned by GET /api/admin/users/{username}
+type AdminUserResponse struct {
+	Success bool               `json:"success"`
+	User    models.UserSummary `json:"user"`
+	Usage   AccountUsage       `json:"usage"`
+}
+
+// KeyCheckResponse is returned by POST /api/admin/users/{username}/check_keys
+type KeyCheckResponse struct {
+	Success  bool     `json:"success"`
+	Username string   `json:"username"`
+	Keys     int      `json:"keys" doc:"Current and retired keys checked"`
+	OK       bool     `json:"ok"`
+	Problems []string `json:"problems"`
+}
+
+// AdminConfigResponse is returned by GET /api/admin/config
+type AdminConfigResponse struct {
+	Success  bool             `json:"success"`
+	Profile  string           `json:"profile"`
+	Settings []config.Setting `json:"settings"`
+}
+
+// AdminJobsResponse is returned by GET /api/admin/jobs
+type AdminJobsResponse struct {
+	Success bool             `json:"success"`
+	Jobs    []AdminJobStatus `json:"jobs"`
+	Leader  string           `json:"leader,omitempty"` // capacitor running the scheduled singleton jobs
+}
+
+// AdminJobResponse is returned when an admin job is started
+type AdminJobResponse struct {
+	Success bool           `json:"success"`
+	Job     AdminJobStatus `json:"job"`
+}
+
+// ShardsResponse is returned by the /api/admin/shards endpoints; Job is the rebalance
+// started by a change of the shard count
+type ShardsResponse struct {
+	Success bool                `json:"success"`
+	Shards  storage.ShardStatus `json:"shards"`
+	Job     *AdminJobStatus     `json:"job,omitempty"`
+}
+
+// BackupPageResponse is returned by GET /api/backup_account/page
+type BackupPageResponse struct {
+	Success             bool         `json:"success"`
+	Username            string       `json:"username,omitempty" doc:"first page only"`
+	PublicKey           string       `json:"public_key,omitempty" doc:"first page only"`
+	EncryptedPrivateKey interface{}  `json:"encrypted_private_key,omitempty" doc:"first page only"`
+	Contacts            ContactsData `json:"contacts,omitempty" doc:"first page only"`
+	Messages            []Message    `json:"messages"`
+	NextCursor          string       `json:"next_cursor,omitempty" doc:"Pass as ?before= to fetch the next page; absent on the last page"`
+}
+
+// VerifyBackupResponse is returned by POST /api/backup_account/verify
+type VerifyBackupResponse struct {
+	Success      bool               `json:"success"`
+	Verification BackupVerification `json:"verification"`
+}
+
+// SnapshotsResponse is returned by GET /api/admin/snapshots
+type SnapshotsResponse struct {
+	Success bool            `json:"success"`
+	Sinks   []SinkSnapshots `json:"sinks"`
+}
+
+// DoctorResponse is returned by GET /api/admin/doctor
+type DoctorResponse struct {
+	Success bool          `json:"success"`
+	Report  doctor.Report `json:"report"`
+}
+
+// RuntimeResponse is returned by the runtime debug endpoint
+type RuntimeResponse struct {
+	Success bool         `json:"success"`
+	Runtime RuntimeStats `json:"runtime"`
+}
+
+// VersionResponse is returned by GET /api/version
+type VersionResponse struct {
+	Success bool `json:"success"`
+	version.Info
+	Features Features `json:"features"`
+}
+
+// Features lists the optional features the node runs with
+type Features struct {
+	TLS            bool   `json:"tls" doc:"served over HTTPS, directly or behind a TLS-terminating proxy"`
+	HTTP2          bool   `json:"http2"`
+	DHT            bool   `json:"dht"`
+	StorageBackend string `json:"storage_backend" doc:"file, s3 or sqlite"`
+	ColdStorage    string `json:"cold_storage,omitempty" doc:"backend old messages move to; absent without tiering"`
+	EncryptAtRest  bool   `json:"encrypt_at_rest"`
+	Webhooks       bool   `json:"webhooks"`
+	StoredBackups  bool   `json:"stored_backups"`
+}
+
+// StatusResponse is returned by /api/status
+type StatusResponse struct {
+	Status      string             `json:"status" doc:"ok, or degraded while a component is down"`
+	Message     string             `json:"message"`
+	Version     string             `json:"version"`
+	Region      string             `json:"region"`
+	Maintenance bool               `json:"maintenance"`
+	Components  []health.Component `json:"components,omitempty"`
+}
+
+// ProbeResponse is returned by /healthz, /readyz and /livez
+type ProbeResponse struct {
+	Status     string             `json:"status" doc:"ok, or unavailable with status 503"`
+	Components []health.Component `json:"components"`
+}
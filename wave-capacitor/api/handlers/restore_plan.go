@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/api/validate"
+	"wave_capacitor/logging"
+	"wave_capacitor/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Actions of a restore plan
+const (
+	RestoreCreate    = "create"
+	RestoreOverwrite = "overwrite"
+	RestoreSkip      = "skip"
+)
+
+// Reasons given with the actions of a restore plan
+const (
+	RestoreKeyMismatch     = "key_mismatch"     // the backup's keys replace different ones
+	RestoreExistingMessage = "existing_message" // a stored message with the same ID is replaced
+	RestoreDuplicateID     = "duplicate_id"     // the backup holds the ID more than once, the last copy wins
+	RestoreMalformed       = "malformed"        // the message is not a JSON object
+	RestoreGeneratedID     = "generated_id"     // the message has no ID and is given one
+	RestoreNoContacts      = "no_contacts"      // the backup holds no contacts, the stored ones are kept
+)
+
+// Scopes a restore can be limited to; a request without scopes restores all of them
+const (
+	RestoreScopeKeys     = "keys"     // the account's public key and encrypted private key
+	RestoreScopeContacts = "contacts" // the contact list
+	RestoreScopeMessages = "messages" // stored messages, optionally within a date range
+)
+
+// restoreScopes lists the scopes in the order they are reported
+var restoreScopes = []string{RestoreScopeKeys, RestoreScopeContacts, RestoreScopeMessages}
+
+// indexLookupBatch is how many message IDs are looked up in the index at a time
+const indexLookupBatch = 1000
+
+// RestoreItem is what a restore does with one entry of the backup
+type RestoreItem struct {
+	Entry  string `json:"entry" doc:"account, contacts or message/<id>; a message that isn't a JSON object is message/#<index>"`
+	Action string `json:"action" doc:"create, overwrite or skip"`
+	Reason string `json:"reason,omitempty" doc:"key_mismatch, existing_message, duplicate_id, malformed, generated_id or no_contacts"`
+}
+
+// RestoreScopeResult reports what a restore does within one scope
+type RestoreScopeResult struct {
+	Scope     string `json:"scope" doc:"keys, contacts or messages"`
+	Selected  bool   `json:"selected" doc:"false when the request left the scope out"`
+	Create    int    `json:"create"`
+	Overwrite int    `json:"overwrite"`
+	Skip      int    `json:"skip"`
+	Excluded  int    `json:"excluded" doc:"entries of the backup left out by the scopes or the message date range; they are neither listed nor counted as skipped"`
+	Failed    int    `json:"failed" doc:"entries that failed to be written, on a restore"`
+}
+
+// RestorePlan reports what restoring a backup creates, overwrites and skips, in total and
+// per scope. Items list the account, the contacts and every message that isn't simply
+// created, within the selected scopes.
+type RestorePlan struct {
+	PlanID    string               `json:"plan_id" doc:"pass as confirm to restore only if the plan and the backup are unchanged since this dry run"`
+	Username  string               `json:"username"`
+	Create    int                  `json:"create"`
+	Overwrite int                  `json:"overwrite"`
+	Skip      int                  `json:"skip"`
+	Scopes    []RestoreScopeResult `json:"scopes" doc:"keys, contacts and messages, in this order"`
+	Items     []RestoreItem        `json:"items"`
+	Failed    []string             `json:"failed,omitempty" doc:"entries that failed to be written, on a restore; the node's log has the errors"`
+}
+
+// scope returns the result of the scope an entry belongs to
+func (p *RestorePlan) scope(entry string) *RestoreScopeResult {
+	name := RestoreScopeMessages
+	switch entry {
+	case "account":
+		name = RestoreScopeKeys
+	case "contacts":
+		name = RestoreScopeContacts
+	}
+	for i := range p.Scopes {
+		if p.Scopes[i].Scope == name {
+			return &p.Scopes[i]
+		}
+	}
+	return nil
+}
+
+// add records the action taken on an entry; created messages are only counted
+func (p *RestorePlan) add(entry, action, reason string) {
+	scope := p.scope(entry)
+	switch action {
+	case RestoreCreate:
+		p.Create++
+		scope.Create++
+	case RestoreOverwrite:
+		p.Overwrite++
+		scope.Overwrite++
+	case RestoreSkip:
+		p.Skip++
+		scope.Skip++
+	}
+	if action != RestoreCreate || reason != "" || entry == "account" || entry == "contacts" {
+		p.Items = append(p.Items, RestoreItem{Entry: entry, Action: action, Reason: reason})
+	}
+}
+
+// exclude counts an entry left out by the request's scopes or date range
+func (p *RestorePlan) exclude(entry string) {
+	p.scope(entry).Excluded++
+}
+
+// fail records an entry that failed to be written
+func (p *RestorePlan) fail(entry string) {
+	p.Failed = append(p.Failed, entry)
+	p.scope(entry).Failed++
+}
+
+// selectedScopes returns the scopes req restores, checking its scopes and date range
+func (req *RecoverRequest) selectedScopes() (map[string]bool, error) {
+	selected := make(map[string]bool, len(restoreScopes))
+	for i, scope := range req.Scopes {
+		if !slices.Contains(restoreScopes, scope) {
+			return nil, fieldError(fmt.Sprintf("scopes[%d]", i), validate.CodeOneOf, "must be keys, contacts or messages")
+		}
+		selected[scope] = true
+	}
+	if len(req.Scopes) == 0 {
+		for _, scope := range restoreScopes {
+			selected[scope] = true
+		}
+	}
+	if req.MessagesSince != nil && req.MessagesUntil != nil && !req.MessagesUntil.After(*req.MessagesSince) {
+		return nil, fieldError("messages_until", validate.CodeMin, "must be after messages_since")
+	}
+	return selected, nil
+}
+
+// inMessageRange reports whether a backed-up message falls in the request's date range;
+// with a range, messages without a readable timestamp are left out
+func (req *RecoverRequest) inMessageRange(message map[string]interface{}) bool {
+	if req.MessagesSince == nil && req.MessagesUntil == nil {
+		return true
+	}
+	ts, _ := message["timestamp"].(string)
+	timestamp, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return false
+	}
+	if req.MessagesSince != nil && timestamp.Before(*req.MessagesSince) {
+		return false
+	}
+	return req.MessagesUntil == nil || timestamp.Before(*req.MessagesUntil)
+}
+
+// restoreMessage is a message the plan writes
+type restoreMessage struct {
+	ID   string
+	Data map[string]interface{}
+}
+
+// planRestore works out what restoring the selected scopes of req does to the account
+// without changing it, and returns the messages to write in backup order
+func planRestore(ctx context.Context, req RecoverRequest, selected map[string]bool) (*RestorePlan, []restoreMessage, error) {
+	plan := &RestorePlan{Username: req.Username, Items: []RestoreItem{}}
+	for _, scope := range restoreScopes {
+		plan.Scopes = append(plan.Scopes, RestoreScopeResult{Scope: scope, Selected: selected[scope]})
+	}
+
+	exists, err := models.UserExists(ctx, req.Username)
+	if err != nil {
+		logging.Errorf(ctx, "Error checking user for restore: %v", err)
+		return nil, nil, serviceError(fiber.StatusInternalServerError, "Failed to retrieve user information")
+	}
+	switch {
+	case !exists && !selected[RestoreScopeKeys]:
+		return nil, nil, fieldError("scopes", validate.CodeRequired, "must include keys to restore an account that doesn't exist")
+	case !selected[RestoreScopeKeys]:
+		plan.exclude("account")
+	case !exists:
+		plan.add("account", RestoreCreate, "")
+	default:
+		user, err := models.GetUser(ctx, req.Username)
+		if err != nil {
+			logging.Errorf(ctx, "Error retrieving user for restore: %v", err)
+			return nil, nil, serviceError(fiber.StatusInternalServerError, "Failed to retrieve user information")
+		}
+		reason := ""
+		if user.PublicKey != req.PublicKey {
+			reason = RestoreKeyMismatch
+		}
+		plan.add("account", RestoreOverwrite, reason)
+	}
+
+	switch {
+	case !selected[RestoreScopeContacts]:
+		plan.exclude("contacts")
+	case len(req.Contacts) == 0:
+		plan.add("contacts", RestoreSkip, RestoreNoContacts)
+	case !exists:
+		plan.add("contacts", RestoreCreate, "")
+	default:
+		existing, err := loadContacts(ctx, req.Username)
+		if err != nil {
+			logging.Errorf(ctx, "Error reading contacts for restore: %v", err)
+		}
+		if len(existing) > 0 {
+			plan.add("contacts", RestoreOverwrite, "")
+		} else {
+			plan.add("contacts", RestoreCreate, "")
+		}
+	}
+
+	// Messages without an ID get one from their position, as they always have
+	messages := make([]restoreMessage, 0, len(req.Messages))
+	generated := make(map[string]bool)
+	for i, msgData := range req.Messages {
+		entry := fmt.Sprintf("message/#%d", i)
+		if !selected[RestoreScopeMessages] {
+			plan.exclude(entry)
+			continue
+		}
+		msgMap, ok := msgData.(map[string]interface{})
+		if !ok {
+			plan.add(entry, RestoreSkip, RestoreMalformed)
+			continue
+		}
+		if !req.inMessageRange(msgMap) {
+			plan.exclude(entry)
+			continue
+		}
+		msgID, ok := msgMap["message_id"].(string)
+		if !ok || msgID == "" {
+			msgID = fmt.Sprintf("recovered_%d", i)
+			generated[msgID] = true
+		}
+		messages = append(messages, restoreMessage{ID: msgID, Data: msgMap})
+	}
+
+	indexed := make(map[string]bool)
+	if exists {
+		ids := make([]string, len(messages))
+		for i, message := range messages {
+			ids[i] = message.ID
+		}
+		for start := 0; start < len(ids); start += indexLookupBatch {
+			end := min(start+indexLookupBatch, len(ids))
+			found, err := models.IndexedMessageIDs(ctx, RecipientHash(req.PublicKey), ids[start:end])
+			if err != nil {
+				logging.Errorf(ctx, "Error looking up messages for restore: %v", err)
+				return nil, nil, serviceError(fiber.StatusInternalServerError, "Failed to look up existing messages")
+			}
+			for id := range found {
+				indexed[id] = true
+			}
+		}
+	}
+
+	seen := make(map[string]bool, len(messages))
+	for _, message := range messages {
+		entry := "message/" + message.ID
+		switch {
+		case seen[message.ID]:
+			plan.add(entry, RestoreOverwrite, RestoreDuplicateID)
+		case indexed[message.ID]:
+			plan.add(entry, RestoreOverwrite, RestoreExistingMessage)
+		case generated[message.ID]:
+			plan.add(entry, RestoreCreate, RestoreGeneratedID)
+		default:
+			plan.add(entry, RestoreCreate, "")
+		}
+		seen[message.ID] = true
+	}
+
+	if plan.PlanID, err = restorePlanID(req, plan); err != nil {
+		logging.Errorf(ctx, "Error hashing restore plan: %v", err)
+		return nil, nil, serviceError(fiber.StatusInternalServerError, "Failed to plan the restore")
+	}
+	return plan, messages, nil
+}
+
+// restorePlanID hashes the plan together with the backup, so a confirmed restore fails
+// when either the account or the uploaded backup changed since the dry run
+func restorePlanID(req RecoverRequest, plan *RestorePlan) (string, error) {
+	backup, err := canonicalJSON(map[string]interface{}{
+		"username":              req.Username,
+		"public_key":            req.PublicKey,
+		"encrypted_private_key": req.EncryptedPrivateKey,
+		"contacts":              req.Contacts,
+		"messages":              req.Messages,
+	})
+	if err != nil {
+		return "", err
+	}
+	planData, err := json.Marshal(plan)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	hash.Write(backup)
+	hash.Write(planData)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// errRestorePlanChanged refuses a confirmed restore whose plan no longer matches the dry
+// run; the details carry the current plan
+func errRestorePlanChanged(plan *RestorePlan) error {
+	return &ServiceError{
+		Status:  fiber.StatusConflict,
+		Code:    apierror.RestorePlanChanged,
+		Message: "The account or the backup changed since the dry run, review the new plan",
+		Details: plan,
+	}
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+	"wave_capacitor/logging"
+	"wave_capacitor/models"
+	"wave_capacitor/storage"
+)
+
+// retentionBatchSize is how many expired index entries are handled per query
+const retentionBatchSize = 500
+
+// retentionMu keeps scheduled and admin-triggered sweeps from running at the same time
+var retentionMu sync.Mutex
+
+// RetentionReport summarizes one retention sweep
+type RetentionReport struct {
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	Deleted   int           `json:"deleted"`
+	Orphaned  int           `json:"orphaned"` // index entries of keys no account owns any more
+	Errors    int           `json:"errors"`
+}
+
+// RunRetention deletes messages older than maxAge along with their index entries.
+// Expired messages are found through the metadata index, so unindexed messages are kept
+// (see the reindex-messages command).
+func RunRetention(ctx context.Context, maxAge time.Duration) (RetentionReport, error) {
+	retentionMu.Lock()
+	defer retentionMu.Unlock()
+
+	report := RetentionReport{StartedAt: time.Now()}
+	cutoff := report.StartedAt.Add(-maxAge)
+
+	var owners map[string]messageOwner // by recipient hash, loaded once something expired
+	for {
+		entries, err := models.ListMessagesBefore(ctx, cutoff, retentionBatchSize)
+		if err != nil {
+			return report, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if owners == nil {
+			if owners, err = recipientKeys(ctx); err != nil {
+				return report, err
+			}
+		}
+
+		// Entries that failed stay in the index; stop once a whole batch fails
+		progress := false
+		for _, entry := range entries {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+
+			owner, ok := owners[entry.RecipientHash]
+			if ok {
+				err := storeDelete(ctx, owner.Key, entry.MessageID)
+				if err != nil && !errors.Is(err, storage.ErrMessageNotFound) {
+					logging.Errorf(ctx, "Error deleting expired message %s: %v", entry.MessageID, err)
+					report.Errors++
+					continue
+				}
+			}
+			if err := models.DeleteMessageIndex(ctx, entry.RecipientHash, entry.MessageID); err != nil {
+				logging.Errorf(ctx, "Error deleting index entry of expired message %s: %v", entry.MessageID, err)
+				report.Errors++
+				continue
+			}
+			if ok {
+				recordChange(ctx, owner.Username, models.ChangeMessageDeleted, owner.Key, entry.MessageID)
+				report.Deleted++
+			} else {
+				report.Orphaned++
+			}
+			progress = true
+		}
+		if !progress || len(entries) < retentionBatchSize {
+			break
+		}
+	}
+
+	report.Duration = time.Since(report.StartedAt)
+	return report, nil
+}
+
+// messageOwner is the account and key a recipient hash belongs to
+type messageOwner struct {
+	Username string
+	Key      string
+}
+
+// recipientKeys maps the recipient hash of every current and retired key to the key and
+// its account, including the hashes under the previous salt during a rotation
+func recipientKeys(ctx context.Context) (map[string]messageOwner, error) {
+	users, err := models.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]messageOwner)
+	for i := range users {
+		for _, key := range ownerKeys(ctx, &users[i]) {
+			owner := messageOwner{Username: users[i].Username, Key: key}
+			keys[RecipientHash(key)] = owner
+			if previous := previousRecipientHash(key); previous != "" {
+				keys[previous] = owner
+			}
+		}
+	}
+	return keys, nil
+}
+
+// StartRetentionSweeps runs RunRetention every interval while this capacitor leads the
+// cluster (see leader.go), until the returned function is called
+func StartRetentionSweeps(maxAge, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if !isLeader() {
+					continue
+				}
+				report, err := RunRetention(context.Background(), maxAge)
+				if err != nil {
+					logging.Errorf(context.Background(), "Error running retention sweep: %v", err)
+					continue
+				}
+				logging.Infof(context.Background(), "🗑️ Retention sweep: %d deleted, %d orphaned, %d errors in %s",
+					report.Deleted, report.Orphaned, report.Errors, report.Duration.Round(time.Millisecond))
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,507 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/api/validate"
+	"wave_capacitor/logging"
+	"wave_capacitor/models"
+	"wave_capacitor/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Every capacitor publishes to the DHT, for each account it hosts, a route record naming
+// itself as the home of the account's public key, signed with its backup signing key.
+// LookupRoute answers which capacitor hosts a public key from the local database, from
+// earlier answers it cached or from the DHT; /internal/route serves the answer to other
+// nodes, which check the signature themselves.
+//
+// A capacitor's signature only says what it claims, so a record found in the DHT is also
+// checked against the account's key before it is used: the account's public key is a
+// Kyber key, which can't sign, so the capacitor the record names is sent an encapsulation
+// to it, through /internal/route/proof, and has to answer with a MAC under the
+// encapsulated secret, which only the holder of the account's private key can open. The
+// MAC covers the answering capacitor's signing key, so a node claiming the account can't
+// pass off the answer of the capacitor really hosting it.
+
+// Sources of a route found by LookupRoute
+const (
+	RouteLocal = "local" // the account is hosted here
+	RouteCache = "cache" // found in the DHT earlier
+	RouteDHT   = "dht"
+)
+
+// routeNotFoundTTL is how long a public key no capacitor claimed is remembered as unknown
+const routeNotFoundTTL = time.Minute
+
+// routeCacheMaxEntries bounds the route cache; it is emptied when full
+const routeCacheMaxEntries = 10000
+
+// routeProofAttempts is how many of the records found for a public key, latest first,
+// are checked against the account's key before giving up
+const routeProofAttempts = 3
+
+// routeProofLabel separates the MACs proving route records from other uses of a secret
+const routeProofLabel = "wave-route-proof-v1\x00"
+
+// ErrRouteNotFound is returned when no capacitor claims the public key
+var ErrRouteNotFound = errors.New("no capacitor hosts the public key")
+
+// RouteRecord states which capacitor hosts the account holding a public key
+type RouteRecord struct {
+	PublicKey string    `json:"public_key"`
+	Capacitor string    `json:"capacitor" doc:"host:port of the capacitor's API"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	SignerKey string    `json:"signer_key,omitempty" doc:"base64 Ed25519 public key of the capacitor"`
+	Signature string    `json:"signature,omitempty" doc:"base64 Ed25519 signature of the record serialized without this field"`
+}
+
+type cachedRoute struct {
+	route     *RouteRecord // nil when no capacitor claimed the key
+	fetchedAt time.Time
+}
+
+var (
+	routeNetwork   DHTValues // nil answers from the local database only
+	routeCapacitor string    // address this capacitor's records give
+
+	routeCacheMu sync.Mutex
+	routeCache   = make(map[string]cachedRoute)
+)
+
+// SetRouting configures the network route records are published on and the address they
+// give for this capacitor; a nil network answers lookups from the local database only
+func SetRouting(network DHTValues, capacitor string) {
+	routeNetwork = network
+	routeCapacitor = capacitor
+}
+
+// RouteQuery names the public key to route
+type RouteQuery struct {
+	PublicKey string `query:"public_key" validate:"required"`
+}
+
+// RouteProofRequest asks a capacitor to prove it holds the private key of an account it
+// publishes the route record of
+type RouteProofRequest struct {
+	PublicKey  string `json:"public_key" validate:"required"`
+	Ciphertext string `json:"ciphertext" validate:"required" doc:"base64 Kyber512 encapsulation to the public key"`
+}
+
+// GetRoute returns the signed route record of the capacitor hosting the account of a
+// public key
+func GetRoute(c *fiber.Ctx) error {
+	var query RouteQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+
+	ctx := c.UserContext()
+	route, source, err := LookupRoute(ctx, query.PublicKey)
+	if errors.Is(err, ErrRouteNotFound) {
+		return respondError(c, serviceError(fiber.StatusNotFound, "No capacitor hosts the public key"))
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error looking up route: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to look up route"))
+	}
+	return c.Status(fiber.StatusOK).JSON(RouteResponse{Success: true, Route: *route, Source: source})
+}
+
+// LookupRoute returns the route record of the capacitor hosting the account of publicKey
+// and where it was found, or ErrRouteNotFound. Records from the DHT are only accepted
+// when their signature matches and they haven't expired; of several, the latest wins.
+func LookupRoute(ctx context.Context, publicKey string) (*RouteRecord, string, error) {
+	if _, err := models.GetUserByPublicKey(ctx, publicKey); err == nil {
+		route, err := localRoute(publicKey)
+		return route, RouteLocal, err
+	} else if !errors.Is(err, models.ErrUserNotFound) {
+		return nil, "", err
+	}
+	if routeNetwork == nil {
+		return nil, "", ErrRouteNotFound
+	}
+
+	if route, ok := cachedRouteFor(publicKey); ok {
+		if route == nil {
+			return nil, "", ErrRouteNotFound
+		}
+		return route, RouteCache, nil
+	}
+
+	values, err := routeNetwork.FindValues(ctx, routeKey(publicKey))
+	if err != nil {
+		return nil, "", err
+	}
+	var candidates []RouteRecord
+	now := time.Now()
+	for _, value := range values {
+		var route RouteRecord
+		if err := json.Unmarshal(value, &route); err != nil || !route.valid(publicKey, now) {
+			continue
+		}
+		// This node knows which accounts it hosts; its own records of others are stale
+		if route.SignerKey == ownSignerKey() || !routeSignerTrusted(route.SignerKey) {
+			continue
+		}
+		candidates = append(candidates, route)
+	}
+	slices.SortFunc(candidates, func(a, b RouteRecord) int { return b.IssuedAt.Compare(a.IssuedAt) })
+
+	var found *RouteRecord
+	for i := range candidates[:min(len(candidates), routeProofAttempts)] {
+		if err := proveRoute(ctx, &candidates[i]); err != nil {
+			logging.Warnf(ctx, "Route record of %s by %s failed the account key check: %v", publicKey, candidates[i].Capacitor, err)
+			continue
+		}
+		found = &candidates[i]
+		break
+	}
+	cacheRoute(publicKey, found)
+	if found == nil {
+		return nil, "", ErrRouteNotFound
+	}
+	return found, RouteDHT, nil
+}
+
+// ProveRoute answers the encapsulation another capacitor sends to the public key of an
+// account hosted here, proving this capacitor holds the account's private key
+func ProveRoute(c *fiber.Ctx) error {
+	if _, err := nodeSigner(c); err != nil {
+		return respondError(c, err)
+	}
+	var req RouteProofRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(req.Ciphertext)
+	if err != nil {
+		return respondError(c, fieldError("ciphertext", validate.CodeFormat, "must be base64"))
+	}
+
+	ctx := c.UserContext()
+	user, err := models.GetUserByPublicKey(ctx, req.PublicKey)
+	// Retired keys are still looked up by, but only the current one is held here
+	if errors.Is(err, models.ErrUserNotFound) || (err == nil && user.PublicKey != req.PublicKey) {
+		return respondError(c, serviceError(fiber.StatusNotFound, "The public key is not hosted here"))
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving account for route proof: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to prove route"))
+	}
+	privateKey, err := utils.DecryptPrivateKey(user.EncryptedPrivKey)
+	if err != nil {
+		logging.Errorf(ctx, "Error unwrapping private key for route proof: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to prove route"))
+	}
+	defer utils.Zeroize(privateKey)
+	secret, err := utils.DecryptWithKyber(privateKey, ciphertext)
+	if err != nil {
+		return respondError(c, fieldError("ciphertext", validate.CodeFormat, "must be a Kyber512 encapsulation"))
+	}
+	defer utils.Zeroize(secret)
+
+	proof := routeProof(secret, req.PublicKey, ownSignerKey())
+	return c.Status(fiber.StatusOK).JSON(RouteProofResponse{Success: true, Proof: base64.StdEncoding.EncodeToString(proof)})
+}
+
+// proveRoute checks that the capacitor a route record names holds the private key of the
+// account it routes, and answers for the key the record is signed with
+func proveRoute(ctx context.Context, route *RouteRecord) error {
+	publicKey, err := base64.StdEncoding.DecodeString(route.PublicKey)
+	if err != nil {
+		return err
+	}
+	ciphertext, secret, err := utils.EncryptWithKyber(publicKey)
+	if err != nil {
+		return err
+	}
+	defer utils.Zeroize(secret)
+
+	body, err := json.Marshal(RouteProofRequest{PublicKey: route.PublicKey, Ciphertext: base64.StdEncoding.EncodeToString(ciphertext)})
+	if err != nil {
+		return err
+	}
+	endpoint := federationScheme + strings.TrimSuffix(route.Capacitor, "/") + "/api/v1/internal/route/proof"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := signNodeRequest(req, body); err != nil {
+		return err
+	}
+	logging.Propagate(ctx, req.Header)
+
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var failure apierror.Response
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&failure)
+		return &federationError{Status: resp.StatusCode, Code: failure.Code, Message: failure.Message}
+	}
+	var result RouteProofResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result); err != nil {
+		return fmt.Errorf("error decoding route proof: %v", err)
+	}
+	proof, err := base64.StdEncoding.DecodeString(result.Proof)
+	if err != nil || !hmac.Equal(proof, routeProof(secret, route.PublicKey, route.SignerKey)) {
+		return errors.New("the capacitor doesn't hold the account's key")
+	}
+	return nil
+}
+
+// routeProof returns the MAC proving the capacitor signing with signerKey opened an
+// encapsulation to publicKey
+func routeProof(secret []byte, publicKey, signerKey string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(routeProofLabel + publicKey + "\x00" + signerKey))
+	return mac.Sum(nil)
+}
+
+// PublishRoute publishes the route record of a public key hosted here
+func PublishRoute(ctx context.Context, publicKey string) error {
+	if routeNetwork == nil {
+		return nil
+	}
+	if backupSigningKey == nil {
+		return errors.New("no signing key for route records")
+	}
+	route, err := localRoute(publicKey)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(route)
+	if err != nil {
+		return err
+	}
+	// One slot per capacitor, so republishing replaces the record
+	return routeNetwork.StoreValue(ctx, routeKey(publicKey), route.SignerKey, data, routeRecordTTL())
+}
+
+// publishRouteLater publishes the route record of a public key in the background, so
+// requests don't wait for the DHT; a failure is logged and left to the next republish
+func publishRouteLater(ctx context.Context, publicKey string) {
+	if routeNetwork == nil {
+		return
+	}
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		if err := PublishRoute(ctx, publicKey); err != nil {
+			logging.Errorf(ctx, "Error publishing route record: %v", err)
+		}
+	}()
+}
+
+// RoutePublishReport summarizes a pass publishing the route records of every account
+type RoutePublishReport struct {
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	Published int           `json:"published"`
+	Errors    int           `json:"errors"`
+}
+
+// RunRoutePublishing publishes the route record of every account hosted here, and the
+// HANDLE_DOMAIN record, before the records published earlier expire
+func RunRoutePublishing(ctx context.Context) (RoutePublishReport, error) {
+	report := RoutePublishReport{StartedAt: time.Now()}
+	if backupSigningKey == nil {
+		return report, errors.New("no signing key for route records")
+	}
+	users, err := models.ListUsers(ctx)
+	if err != nil {
+		return report, err
+	}
+	for _, user := range users {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if err := PublishRoute(ctx, user.PublicKey); err != nil {
+			logging.Errorf(ctx, "Error publishing route record of %s: %v", user.Username, err)
+			report.Errors++
+			continue
+		}
+		report.Published++
+	}
+	if err := PublishHandleDomain(ctx); err != nil {
+		logging.Errorf(ctx, "Error publishing handle domain record: %v", err)
+		report.Errors++
+	}
+	report.Duration = time.Since(report.StartedAt)
+	return report, nil
+}
+
+// StartRoutePublishing publishes every account's route record now and then every interval
+// while this capacitor leads the cluster (see leader.go), until the returned function is
+// called, which cancels a pass in progress
+func StartRoutePublishing(interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if isLeader() {
+				report, err := RunRoutePublishing(ctx)
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					logging.Errorf(ctx, "Error publishing route records: %v", err)
+				} else {
+					logging.Infof(ctx, "🧭 Published %d route records, %d errors in %s",
+						report.Published, report.Errors, report.Duration.Round(time.Millisecond))
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-stopped
+	}
+}
+
+// localRoute returns a fresh route record naming this capacitor, signed if it has a key
+func localRoute(publicKey string) (*RouteRecord, error) {
+	now := time.Now().UTC()
+	route := RouteRecord{
+		PublicKey: publicKey,
+		Capacitor: routeCapacitor,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(routeRecordTTL()),
+	}
+	if err := route.sign(); err != nil {
+		return nil, err
+	}
+	return &route, nil
+}
+
+// sign signs the record with the node's backup signing key, if there is one
+func (r *RouteRecord) sign() error {
+	if backupSigningKey == nil {
+		return nil
+	}
+	r.SignerKey = ownSignerKey()
+	r.Signature = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	r.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(backupSigningKey, data))
+	return nil
+}
+
+// valid reports whether the record routes publicKey, hasn't expired at now and carries a
+// matching signature
+func (r RouteRecord) valid(publicKey string, now time.Time) bool {
+	if r.PublicKey != publicKey || r.Capacitor == "" || !now.Before(r.ExpiresAt) || r.Signature == "" {
+		return false
+	}
+	signature := r.Signature
+	r.Signature = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return false
+	}
+	return verifyBundleSignature(r.SignerKey, signature, data)
+}
+
+// ownSignerKey returns the base64 public half of the node's backup signing key, or ""
+func ownSignerKey() string {
+	if backupSigningKey == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(backupSigningKey.Public().(ed25519.PublicKey))
+}
+
+// routeKey is the DHT key the route records of publicKey are stored under
+func routeKey(publicKey string) [20]byte {
+	var key [20]byte
+	sum := sha256.Sum256([]byte("wave-route-v1\x00" + publicKey))
+	copy(key[:], sum[:])
+	return key
+}
+
+// cachedRouteFor returns the cached route of publicKey; ok is false when there is none or
+// it is stale
+func cachedRouteFor(publicKey string) (route *RouteRecord, ok bool) {
+	routeCacheMu.Lock()
+	cached, found := routeCache[publicKey]
+	routeCacheMu.Unlock()
+	if !found {
+		return nil, false
+	}
+
+	ttl := routeNotFoundTTL
+	if cached.route != nil {
+		ttl = routeCacheTTL()
+		if !time.Now().Before(cached.route.ExpiresAt) {
+			return nil, false
+		}
+	}
+	if time.Since(cached.fetchedAt) >= ttl {
+		return nil, false
+	}
+	return cached.route, true
+}
+
+// forgetRoute drops the cached route of publicKey, e.g. when it turned out to be stale
+func forgetRoute(publicKey string) {
+	routeCacheMu.Lock()
+	defer routeCacheMu.Unlock()
+	delete(routeCache, publicKey)
+}
+
+// cacheRoute remembers the route found for publicKey, nil when none was
+func cacheRoute(publicKey string, route *RouteRecord) {
+	routeCacheMu.Lock()
+	defer routeCacheMu.Unlock()
+	if len(routeCache) >= routeCacheMaxEntries {
+		routeCache = make(map[string]cachedRoute)
+	}
+	routeCache[publicKey] = cachedRoute{route: route, fetchedAt: time.Now()}
+}
+
+// routeRecordTTL returns how long published route records last
+func routeRecordTTL() time.Duration {
+	if nodeConfig == nil {
+		return 24 * time.Hour
+	}
+	return time.Duration(nodeConfig.RouteTTLHours) * time.Hour
+}
+
+// routeCacheTTL returns how long routes found in the DHT are reused
+func routeCacheTTL() time.Duration {
+	if nodeConfig == nil {
+		return 5 * time.Minute
+	}
+	return time.Duration(nodeConfig.RouteCacheSeconds) * time.Second
+}
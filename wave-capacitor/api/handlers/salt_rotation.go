@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+	"wave_capacitor/logging"
+	"wave_capacitor/models"
+	"wave_capacitor/storage"
+)
+
+// saltRotationMu keeps the rehash command and admin job from running at the same time
+var saltRotationMu sync.Mutex
+
+// SaltRotationReport summarizes one pass moving messages to the current confusion salt
+type SaltRotationReport struct {
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	Keys      int           `json:"keys"`
+	Moved     int           `json:"moved"`    // messages moved to the current salt's folder
+	Indexed   int           `json:"indexed"`  // index entries moved to the current hash
+	Contacts  int           `json:"contacts"` // contacts files moved to the current salt's folder
+	Errors    int           `json:"errors"`
+}
+
+// RunSaltRotation moves every key's messages and index entries, and every user's contacts
+// file, from PREVIOUS_CONFUSION_SALT to CONFUSION_SALT. It can be rerun after errors; once a pass reports no errors, the
+// previous salt can be removed from the configuration.
+func RunSaltRotation(ctx context.Context) (SaltRotationReport, error) {
+	saltRotationMu.Lock()
+	defer saltRotationMu.Unlock()
+
+	report := SaltRotationReport{StartedAt: time.Now()}
+	rotator, ok := messageStore.(storage.SaltRotator)
+	if !ok {
+		return report, errors.New("the message store does not support salt rotation")
+	}
+
+	users, err := models.ListUsers(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	contactRehasher, _ := contactStore.(storage.ContactRehasher)
+	done := make(map[string]bool)
+	for i := range users {
+		if contactRehasher != nil {
+			moved, err := contactRehasher.RehashContacts(users[i].Username)
+			if moved {
+				report.Contacts++
+			}
+			if err != nil {
+				logging.Errorf(ctx, "Error moving contacts of %s to the current salt: %v", users[i].Username, err)
+				report.Errors++
+			}
+		}
+		for _, key := range ownerKeys(ctx, &users[i]) {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			previous := previousRecipientHash(key)
+			if previous == "" || done[key] {
+				continue
+			}
+			done[key] = true
+			report.Keys++
+
+			// Messages first: the index entries point to messages readable under both salts
+			moved, err := rotator.RehashOwner(key)
+			report.Moved += moved
+			if err != nil {
+				logging.Errorf(ctx, "Error moving messages of %s to the current salt: %v", users[i].Username, err)
+				report.Errors++
+				continue
+			}
+			indexed, err := models.RehashMessageIndex(ctx, previous, RecipientHash(key))
+			report.Indexed += indexed
+			if err != nil {
+				logging.Errorf(ctx, "Error rehashing message index of %s: %v", users[i].Username, err)
+				report.Errors++
+			}
+		}
+	}
+
+	report.Duration = time.Since(report.StartedAt)
+	return report, nil
+}
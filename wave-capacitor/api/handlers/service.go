@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"errors"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/api/validate"
+	"wave_capacitor/logging"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The exported service functions next to each Fiber handler hold the request logic
+// shared by the REST and gRPC APIs. They take a context and an authenticated username
+// instead of a fiber.Ctx and report expected failures as *ServiceError.
+
+// ServiceError is an expected failure of a service call with the HTTP status it maps to
+type ServiceError struct {
+	Status  int
+	Code    string // apierror code; empty for the generic code of Status
+	Message string
+	Fields  validate.Errors // Invalid request fields, if any
+	Details interface{}     // Code-specific details, if any
+}
+
+func (e *ServiceError) Error() string {
+	return e.Message
+}
+
+// ErrorCode returns the apierror code of the error
+func (e *ServiceError) ErrorCode() string {
+	if e.Code != "" {
+		return e.Code
+	}
+	return apierror.ForStatus(e.Status)
+}
+
+// serviceError creates a ServiceError for the given status with its generic code
+func serviceError(status int, message string) error {
+	return &ServiceError{Status: status, Message: message}
+}
+
+// codedError creates a ServiceError with a specific apierror code
+func codedError(status int, code, message string) error {
+	return &ServiceError{Status: status, Code: code, Message: message}
+}
+
+// errInsufficientStorage is returned when a write was refused for lack of disk space
+var errInsufficientStorage = serviceError(fiber.StatusInsufficientStorage, "Server storage is full, please try again later")
+
+// invalidRequest reports a request that failed decoding or validation
+func invalidRequest(message string, err error) error {
+	var fields validate.Errors
+	errors.As(err, &fields)
+	return &ServiceError{Status: fiber.StatusBadRequest, Message: message, Fields: fields}
+}
+
+// fieldError reports a single invalid field found beyond the validate tags
+func fieldError(field, code, message string) error {
+	return invalidRequest(field+": "+message, validate.Errors{{Field: field, Code: code, Message: message}})
+}
+
+// validateRequest checks req against its validate tags
+func validateRequest(req interface{}) error {
+	if err := validate.Struct(req); err != nil {
+		return invalidRequest(err.Error(), err)
+	}
+	return nil
+}
+
+// decodeBody parses the JSON request body into out without validating it, for handlers
+// whose service function validates the request itself. Decoding is strict: unknown
+// fields and values of the wrong type are rejected rather than silently ignored.
+func decodeBody(c *fiber.Ctx, out interface{}) error {
+	if !c.Is("json") {
+		return invalidRequest("Content-Type must be application/json", validate.Errors{{Code: validate.CodeSyntax, Message: "Request body must be JSON"}})
+	}
+	if err := validate.DecodeJSON(c.Body(), out); err != nil {
+		return invalidRequest("Invalid request format", err)
+	}
+	return nil
+}
+
+// parseBody parses the JSON request body into out and validates it
+func parseBody(c *fiber.Ctx, out interface{}) error {
+	if err := decodeBody(c, out); err != nil {
+		return err
+	}
+	return validateRequest(out)
+}
+
+// parseQuery parses the query string into out (fields tagged `query`) and validates it
+func parseQuery(c *fiber.Ctx, out interface{}) error {
+	if err := c.QueryParser(out); err != nil {
+		return invalidRequest("Invalid query parameters", validate.Errors{{Code: validate.CodeType, Message: err.Error()}})
+	}
+	return validateRequest(out)
+}
+
+// respondError writes err in the standard error format. Unexpected errors are logged
+// and reported as a generic 500.
+func respondError(c *fiber.Ctx, err error) error {
+	var serviceErr *ServiceError
+	if !errors.As(err, &serviceErr) {
+		logging.Errorf(c.UserContext(), "Error handling %s %s: %v", c.Method(), c.Path(), err)
+		serviceErr = &ServiceError{Status: fiber.StatusInternalServerError, Message: "Internal server error"}
+	}
+	details := serviceErr.Details
+	if len(serviceErr.Fields) > 0 {
+		details = serviceErr.Fields
+	}
+	return apierror.Respond(c, serviceErr.Status, serviceErr.ErrorCode(), serviceErr.Message, details)
+}
+
+// GetErrorCatalog lists the error codes of the API, for clients branching on them
+func GetErrorCatalog(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(ErrorCatalogResponse{Success: true, Codes: apierror.Catalog})
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/logging"
+	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// maxSessionBlobSize limits the size of a stored session blob (base64 characters)
+const maxSessionBlobSize = 64 * 1024
+
+// PutSessionRequest defines the structure for storing a session blob
+type PutSessionRequest struct {
+	PeerKey         string `json:"peer_key" validate:"required"`
+	DeviceID        string `json:"device_id" validate:"required"`
+	ExpectedVersion int    `json:"expected_version" validate:"min=0"`
+	Blob            string `json:"blob" validate:"required"`
+}
+
+// SessionQuery identifies a stored session in the query string
+type SessionQuery struct {
+	PeerKey  string `query:"peer_key" validate:"required"`
+	DeviceID string `query:"device_id" validate:"required"`
+}
+
+// DeviceQuery selects the sessions of one device in the query string
+type DeviceQuery struct {
+	DeviceID string `query:"device_id" validate:"required"`
+}
+
+// GetSession returns a stored session blob for ?peer_key=&device_id=
+func GetSession(c *fiber.Ctx) error {
+	var query SessionQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+	peerKey, deviceID := query.PeerKey, query.DeviceID
+
+	// Get username from JWT
+	username := middleware.ExtractUsername(c)
+
+	session, err := models.GetSessionBlob(c.UserContext(), username, peerKey, deviceID)
+	if err == models.ErrSessionNotFound {
+		return respondError(c, serviceError(fiber.StatusNotFound, "Session not found"))
+	}
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error retrieving session: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to retrieve session"))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+		"session": session,
+	})
+}
+
+// ListSessions returns session metadata for ?device_id=
+func ListSessions(c *fiber.Ctx) error {
+	var query DeviceQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+	deviceID := query.DeviceID
+
+	// Get username from JWT
+	username := middleware.ExtractUsername(c)
+
+	sessions, err := models.ListSessionBlobs(c.UserContext(), username, deviceID)
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error listing sessions: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to list sessions"))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success":  true,
+		"sessions": sessions,
+	})
+}
+
+// PutSession stores a session blob, rejecting writes based on a stale version with 409
+func PutSession(c *fiber.Ctx) error {
+	// Parse request body
+	var req PutSessionRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+
+	if len(req.Blob) > maxSessionBlobSize {
+		return respondError(c, serviceError(fiber.StatusRequestEntityTooLarge, "Session blob too large"))
+	}
+
+	// Get username from JWT
+	username := middleware.ExtractUsername(c)
+
+	version, err := models.PutSessionBlob(c.UserContext(), username, req.PeerKey, req.DeviceID, req.ExpectedVersion, req.Blob)
+	if err == models.ErrSessionConflict {
+		return respondError(c, &ServiceError{
+			Status:  fiber.StatusConflict,
+			Code:    apierror.SessionConflict,
+			Message: "Session was modified by another device",
+			Details: fiber.Map{"current_version": version},
+		})
+	}
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error storing session: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to store session"))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+		"version": version,
+	})
+}
+
+// DeleteSession removes a stored session for ?peer_key=&device_id=
+func DeleteSession(c *fiber.Ctx) error {
+	var query SessionQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+	peerKey, deviceID := query.PeerKey, query.DeviceID
+
+	// Get username from JWT
+	username := middleware.ExtractUsername(c)
+
+	err := models.DeleteSessionBlob(c.UserContext(), username, peerKey, deviceID)
+	if err == models.ErrSessionNotFound {
+		return respondError(c, serviceError(fiber.StatusNotFound, "Session not found"))
+	}
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error deleting session: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to delete session"))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+		"message": "Session deleted successfully",
+	})
+}
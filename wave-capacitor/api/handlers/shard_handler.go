@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"wave_capacitor/config"
+	"wave_capacitor/logging"
+	"wave_capacitor/storage"
+	"wave_capacitor/tracing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ImportShardRequest defines the structure for starting a shard import
+type ImportShardRequest struct {
+	Source      string `json:"source" validate:"required,url"` // Base URL of the capacitor to pull from
+	Shard       int    `json:"shard" validate:"min=0"`         // Shard index to move
+	SourceToken string `json:"source_token"`                   // Transfer token of the source; defaults to this node's
+	Restart     bool   `json:"restart"`                        // Ignore any saved resume point
+}
+
+// ShardImportStatus reports the progress of the current or last shard import
+type ShardImportStatus struct {
+	Running    bool      `json:"running"`
+	Source     string    `json:"source,omitempty"`
+	Shard      int       `json:"shard"`
+	Cursor     string    `json:"cursor,omitempty"`
+	Messages   int       `json:"messages"`
+	Keys       int       `json:"keys"`
+	Complete   bool      `json:"complete"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at,omitempty"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+}
+
+// shardImportState is persisted so an interrupted import resumes where it stopped
+type shardImportState struct {
+	Source string `json:"source"`
+	Cursor string `json:"cursor"`
+}
+
+// cursorSaveInterval is how many imported messages pass between resume point saves
+const cursorSaveInterval = 100
+
+var (
+	shardImportMu     sync.Mutex
+	shardImportStatus ShardImportStatus
+)
+
+// transferTransport carries shard exports between capacitors
+var transferTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	ResponseHeaderTimeout: 30 * time.Second,
+}
+
+// transferClient streams shard exports; no overall timeout since shards can be large
+var transferClient = &http.Client{
+	Transport: tracing.Transport(transferTransport),
+}
+
+// ExportShard streams all messages of a shard as a tar archive, resuming after ?after=
+func ExportShard(c *fiber.Ctx) error {
+	store, ok := messageStore.(*storage.FileMessageStore)
+	if !ok {
+		return respondError(c, serviceError(fiber.StatusNotImplemented, "Shard export requires the file storage backend"))
+	}
+
+	shard, err := c.ParamsInt("shard")
+	if err != nil || shard < 0 {
+		return respondError(c, serviceError(fiber.StatusBadRequest, "Invalid shard index"))
+	}
+
+	// Stream the archive as it is produced; an error aborts the stream,
+	// which the importer detects from the missing manifest
+	after := strings.Clone(c.Query("after")) // Fiber reuses the request buffer after the handler returns
+	reader, writer := io.Pipe()
+	go func() {
+		err := store.ExportShard(writer, shard, after)
+		if err != nil {
+			logging.Errorf(c.UserContext(), "Error exporting shard %d: %v", shard, err)
+		}
+		writer.CloseWithError(err)
+	}()
+
+	c.Set(fiber.HeaderContentType, "application/x-tar")
+	return c.SendStream(reader)
+}
+
+// ImportShard starts pulling a shard from another capacitor in the background
+func ImportShard(c *fiber.Ctx) error {
+	store, ok := messageStore.(*storage.FileMessageStore)
+	if !ok {
+		return respondError(c, serviceError(fiber.StatusNotImplemented, "Shard import requires the file storage backend"))
+	}
+
+	var req ImportShardRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+
+	if req.SourceToken == "" {
+		req.SourceToken = strings.Clone(strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer "))
+	}
+
+	shardImportMu.Lock()
+	if shardImportStatus.Running {
+		shardImportMu.Unlock()
+		return respondError(c, serviceError(fiber.StatusConflict, "A shard import is already running"))
+	}
+
+	// Resume from the saved cursor when retrying the same source
+	cursor := ""
+	if state, err := loadShardImportState(req.Shard); err == nil && state.Source == req.Source && !req.Restart {
+		cursor = state.Cursor
+	}
+
+	shardImportStatus = ShardImportStatus{
+		Running:   true,
+		Source:    req.Source,
+		Shard:     req.Shard,
+		Cursor:    cursor,
+		StartedAt: time.Now(),
+	}
+	shardImportMu.Unlock()
+
+	// The import outlives the request but keeps its ID for logging and the calls to the source
+	go runShardImport(logging.Detach(c.UserContext()), store, req, cursor)
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"success": true,
+		"message": "Shard import started",
+		"cursor":  cursor,
+	})
+}
+
+// GetShardImportStatus returns the progress of the current or last shard import
+func GetShardImportStatus(c *fiber.Ctx) error {
+	shardImportMu.Lock()
+	status := shardImportStatus
+	shardImportMu.Unlock()
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+		"import":  status,
+	})
+}
+
+// runShardImport pulls the export stream from the source and records progress
+func runShardImport(ctx context.Context, store *storage.FileMessageStore, req ImportShardRequest, cursor string) {
+	stats, err := pullShard(ctx, store, req, cursor)
+
+	shardImportMu.Lock()
+	defer shardImportMu.Unlock()
+
+	shardImportStatus.Running = false
+	shardImportStatus.FinishedAt = time.Now()
+	shardImportStatus.Complete = stats.Complete
+	if err != nil {
+		shardImportStatus.Error = err.Error()
+		logging.Warnf(ctx, "⚠️ Shard %d import from %s stopped at %q: %v", req.Shard, req.Source, shardImportStatus.Cursor, err)
+		return
+	}
+
+	if err := os.Remove(shardImportStatePath(req.Shard)); err != nil && !os.IsNotExist(err) {
+		logging.Errorf(ctx, "Error removing shard import state: %v", err)
+	}
+	logging.Infof(ctx, "✅ Imported shard %d from %s: %d messages, %d keys", req.Shard, req.Source, shardImportStatus.Messages, shardImportStatus.Keys)
+}
+
+// pullShard requests the export stream and imports it, saving the cursor as it goes
+func pullShard(ctx context.Context, store *storage.FileMessageStore, req ImportShardRequest, cursor string) (storage.ShardImportStats, error) {
+	exportURL := fmt.Sprintf("%s/api/shards/%d/export?after=%s", strings.TrimSuffix(req.Source, "/"), req.Shard, url.QueryEscape(cursor))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, exportURL, nil)
+	if err != nil {
+		return storage.ShardImportStats{}, err
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+req.SourceToken)
+	logging.Propagate(ctx, httpReq.Header)
+
+	resp, err := transferClient.Do(httpReq)
+	if err != nil {
+		return storage.ShardImportStats{}, fmt.Errorf("failed to contact source: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return storage.ShardImportStats{}, fmt.Errorf("source returned status %d", resp.StatusCode)
+	}
+
+	imported := 0
+	stats, err := store.ImportShard(resp.Body, func(newCursor string) {
+		imported++
+
+		shardImportMu.Lock()
+		shardImportStatus.Cursor = newCursor
+		shardImportStatus.Messages++
+		shardImportMu.Unlock()
+
+		if imported%cursorSaveInterval == 0 {
+			saveShardImportState(ctx, req.Shard, shardImportState{Source: req.Source, Cursor: newCursor})
+		}
+	})
+
+	shardImportMu.Lock()
+	shardImportStatus.Keys += stats.Keys
+	shardImportMu.Unlock()
+
+	// Always keep the latest resume point so a retry continues from here
+	if stats.Cursor != "" {
+		saveShardImportState(ctx, req.Shard, shardImportState{Source: req.Source, Cursor: stats.Cursor})
+	}
+	return stats, err
+}
+
+// shardImportStatePath returns the resume state file for a shard import
+func shardImportStatePath(shard int) string {
+	return filepath.Join(config.ConfigDir, fmt.Sprintf("shard-import-%d.json", shard))
+}
+
+// maxShardImportStateSize caps the resume state file read back, a small JSON object
+const maxShardImportStateSize = 64 * 1024
+
+// loadShardImportState reads the saved resume point for a shard import
+func loadShardImportState(shard int) (shardImportState, error) {
+	var state shardImportState
+	data, err := storage.ReadFileLimited(shardImportStatePath(shard), maxShardImportStateSize)
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+// saveShardImportState persists the resume point for a shard import
+func saveShardImportState(ctx context.Context, shard int, state shardImportState) {
+	data, err := json.Marshal(state)
+	if err == nil {
+		err = os.WriteFile(shardImportStatePath(shard), data, 0600)
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error saving shard import state: %v", err)
+	}
+}
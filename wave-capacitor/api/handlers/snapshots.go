@@ -0,0 +1,281 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"sync"
+	"time"
+	"wave_capacitor/config"
+	"wave_capacitor/logging"
+	"wave_capacitor/models"
+	"wave_capacitor/storage"
+	"wave_capacitor/version"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// snapshotIndexKey is the blob listing the retained snapshots; blob stores can't list
+// their contents, so retention works from this index
+const snapshotIndexKey = "snapshots/index.json"
+
+// snapshotMu keeps scheduled and admin-triggered snapshots from running at the same time
+var snapshotMu sync.Mutex
+
+// SnapshotSink is a named blob store receiving every snapshot, such as a directory, an
+// S3 bucket, an SFTP server or the locker nodes
+type SnapshotSink struct {
+	Name  string
+	Store storage.BlobStore
+}
+
+// snapshotSinks receive the snapshots; none disables them. Set with SetSnapshotSinks.
+var (
+	snapshotSinks []SnapshotSink
+	snapshotKeep  int
+)
+
+// SetSnapshotSinks configures where snapshots are written and how many each sink keeps
+func SetSnapshotSinks(sinks []SnapshotSink, keep int) {
+	snapshotSinks = sinks
+	snapshotKeep = keep
+}
+
+// Snapshot describes one node snapshot: snapshots/<id>/node.json with the node's
+// metadata and snapshots/<id>/users/<username>.ndjson per account, in the format of
+// GET /backup_account/stream
+type Snapshot struct {
+	ID        string    `json:"id"`
+	StartedAt time.Time `json:"started_at"`
+	Duration  string    `json:"duration"`
+	Users     []string  `json:"users"`
+	Failed    []string  `json:"failed,omitempty" doc:"accounts whose backup failed and is missing"`
+}
+
+// SnapshotReport summarizes one snapshot run on one sink
+type SnapshotReport struct {
+	Sink     string   `json:"sink"`
+	Snapshot Snapshot `json:"snapshot"`
+	Error    string   `json:"error,omitempty" doc:"why the snapshot is missing or incomplete on this sink"`
+	Pruned   []string `json:"pruned,omitempty" doc:"IDs of the snapshots deleted to keep the configured number"`
+}
+
+// snapshotNode is the node metadata stored with every snapshot
+type snapshotNode struct {
+	Version   version.Info     `json:"version"`
+	CreatedAt time.Time        `json:"created_at"`
+	Users     int              `json:"users"`
+	Config    []config.Setting `json:"config,omitempty" doc:"effective configuration, secrets redacted"`
+}
+
+// RunSnapshot backs up every account and the node's metadata to each sink in turn,
+// then deletes the oldest snapshots of the sink beyond the configured number. Accounts
+// that fail are listed in the snapshot and the run goes on; a sink that fails doesn't
+// keep the others from taking the snapshot.
+func RunSnapshot(ctx context.Context) ([]SnapshotReport, error) {
+	if len(snapshotSinks) == 0 {
+		return nil, errors.New("snapshots are not configured")
+	}
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	started := time.Now()
+	users, err := models.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]SnapshotReport, 0, len(snapshotSinks))
+	var errs []error
+	for _, sink := range snapshotSinks {
+		report, err := snapshotSink(ctx, sink, users, started)
+		report.Sink = sink.Name
+		if err != nil {
+			logging.Errorf(ctx, "Error taking snapshot on %s: %v", sink.Name, err)
+			report.Error = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", sink.Name, err))
+		}
+		reports = append(reports, report)
+	}
+	return reports, errors.Join(errs...)
+}
+
+// snapshotSink takes the snapshot on one sink
+func snapshotSink(ctx context.Context, sink SnapshotSink, users []models.User, started time.Time) (SnapshotReport, error) {
+	snapshot := Snapshot{ID: started.UTC().Format("20060102-150405"), StartedAt: started, Users: []string{}}
+	prefix := path.Join("snapshots", snapshot.ID)
+
+	node := snapshotNode{Version: version.Get(), CreatedAt: started, Users: len(users)}
+	if nodeConfig != nil {
+		node.Config = nodeConfig.Effective()
+	}
+	if err := putJSONBlob(sink.Store, path.Join(prefix, "node.json"), node); err != nil {
+		return SnapshotReport{}, err
+	}
+
+	for _, user := range users {
+		if err := ctx.Err(); err != nil {
+			return SnapshotReport{}, err
+		}
+		if err := snapshotUser(ctx, sink.Store, prefix, user.Username); err != nil {
+			logging.Errorf(ctx, "Error backing up %s for snapshot %s on %s: %v", user.Username, snapshot.ID, sink.Name, err)
+			snapshot.Failed = append(snapshot.Failed, user.Username)
+			continue
+		}
+		snapshot.Users = append(snapshot.Users, user.Username)
+	}
+	snapshot.Duration = time.Since(started).Round(time.Millisecond).String()
+
+	// The snapshot only counts as taken once it is in the index
+	index, err := readSnapshotIndex(sink.Store)
+	if err != nil {
+		return SnapshotReport{Snapshot: snapshot}, err
+	}
+	index = append(index, snapshot)
+	report := SnapshotReport{Snapshot: snapshot}
+	var expired []Snapshot
+	if snapshotKeep > 0 && len(index) > snapshotKeep {
+		expired = index[:len(index)-snapshotKeep]
+		index = index[len(index)-snapshotKeep:]
+	}
+	if err := putJSONBlob(sink.Store, snapshotIndexKey, index); err != nil {
+		return report, err
+	}
+
+	for _, old := range expired {
+		deleteSnapshot(ctx, sink.Store, old)
+		report.Pruned = append(report.Pruned, old.ID)
+	}
+	return report, nil
+}
+
+// snapshotUser streams one account's backup into the snapshot
+func snapshotUser(ctx context.Context, store storage.BlobStore, prefix, username string) error {
+	write, err := OpenBackupStream(ctx, username, 0)
+	if err != nil {
+		return err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(write(writer))
+	}()
+	err = store.PutBlob(path.Join(prefix, "users", username+".ndjson"), reader, -1)
+	reader.CloseWithError(err) // unblocks the writer if the upload stopped early
+	return err
+}
+
+// deleteSnapshot removes the blobs of a snapshot; blobs that fail to delete are logged
+func deleteSnapshot(ctx context.Context, store storage.BlobStore, snapshot Snapshot) {
+	prefix := path.Join("snapshots", snapshot.ID)
+	keys := []string{path.Join(prefix, "node.json")}
+	for _, username := range snapshot.Users {
+		keys = append(keys, path.Join(prefix, "users", username+".ndjson"))
+	}
+	for _, key := range keys {
+		if err := store.DeleteBlob(key); err != nil && !errors.Is(err, storage.ErrBlobNotFound) {
+			logging.Errorf(ctx, "Error deleting %s of expired snapshot: %v", key, err)
+		}
+	}
+}
+
+// SinkSnapshots lists the snapshots retained on one sink
+type SinkSnapshots struct {
+	Sink      string     `json:"sink"`
+	Snapshots []Snapshot `json:"snapshots" doc:"oldest first"`
+	Error     string     `json:"error,omitempty" doc:"why the sink's index couldn't be read"`
+}
+
+// ListSnapshots returns the retained snapshots of each sink, oldest first. A sink whose
+// index can't be read reports the error instead.
+func ListSnapshots() []SinkSnapshots {
+	list := make([]SinkSnapshots, 0, len(snapshotSinks))
+	for _, sink := range snapshotSinks {
+		entry := SinkSnapshots{Sink: sink.Name, Snapshots: []Snapshot{}}
+		snapshots, err := readSnapshotIndex(sink.Store)
+		if err != nil {
+			entry.Error = err.Error()
+		} else {
+			entry.Snapshots = snapshots
+		}
+		list = append(list, entry)
+	}
+	return list
+}
+
+// readSnapshotIndex reads the snapshot index of a sink; a missing index is empty
+func readSnapshotIndex(store storage.BlobStore) ([]Snapshot, error) {
+	blob, err := store.GetBlob(snapshotIndexKey)
+	if errors.Is(err, storage.ErrBlobNotFound) {
+		return []Snapshot{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	var index []Snapshot
+	if err := json.NewDecoder(blob).Decode(&index); err != nil {
+		return nil, err
+	}
+	sort.Slice(index, func(i, j int) bool { return index[i].StartedAt.Before(index[j].StartedAt) })
+	return index, nil
+}
+
+func putJSONBlob(store storage.BlobStore, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return store.PutBlob(key, bytes.NewReader(data), int64(len(data)))
+}
+
+// AdminListSnapshots lists the retained snapshots of each sink, oldest first; the status
+// of the current or last run is reported by GET /api/admin/jobs as the "snapshot" job
+func AdminListSnapshots(c *fiber.Ctx) error {
+	if len(snapshotSinks) == 0 {
+		return respondError(c, serviceError(fiber.StatusNotFound, "Snapshots are not configured"))
+	}
+	return c.Status(fiber.StatusOK).JSON(SnapshotsResponse{Success: true, Sinks: ListSnapshots()})
+}
+
+// StartSnapshots runs the "snapshot" admin job at every time next returns, so scheduled
+// runs show up in GET /api/admin/jobs like manual ones, until the returned function is
+// called. Times that come while another capacitor leads the cluster are skipped. A zero
+// time from next stops scheduling.
+func StartSnapshots(next func(time.Time) time.Time) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			at := next(time.Now())
+			if at.IsZero() {
+				return
+			}
+			timer := time.NewTimer(time.Until(at))
+			select {
+			case <-done:
+				timer.Stop()
+				return
+			case <-timer.C:
+				if !isLeader() {
+					continue
+				}
+				if _, err := startAdminJob(context.Background(), "snapshot"); err != nil {
+					logging.Warnf(context.Background(), "Skipping scheduled snapshot: %v", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"wave_capacitor/storage"
+	"wave_capacitor/tracing"
+)
+
+// The message store takes no context, so its calls are traced here as children of the
+// request's span. Large messages are offloaded to the lockers on the way (see
+// locker_offload.go), and writes and deletes are replicated (see replication.go).
+
+// storeWrite stores a message and returns the hash of what was stored, for the index
+func storeWrite(ctx context.Context, ownerKey, messageID string, data []byte) (string, error) {
+	_, span := tracing.Start(ctx, "storage.Write", tracing.KindInternal)
+	span.SetAttribute("message.size", len(data))
+	stored := offloadMessage(ctx, data)
+	err := messageStore.Write(ownerKey, messageID, stored)
+	var hash string
+	if err == nil {
+		hash = MessageHash(stored)
+		replicate(replicaOp{ownerKey: ownerKey, messageID: messageID, data: stored})
+	}
+	span.End(err)
+	return hash, err
+}
+
+// storeRead reads a message, from its replicas when it was lost here but the index
+// still lists it
+func storeRead(ctx context.Context, ownerKey, messageID string) ([]byte, error) {
+	_, span := tracing.Start(ctx, "storage.Read", tracing.KindInternal)
+	data, err := messageStore.Read(ownerKey, messageID)
+	if err != nil && replicaCount > 0 {
+		data, err = readReplica(ctx, ownerKey, messageID, err)
+	}
+	if err == nil {
+		data, err = fetchOffloaded(data)
+	}
+	span.End(err)
+	return data, err
+}
+
+func storeList(ctx context.Context, ownerKey string) ([]string, error) {
+	_, span := tracing.Start(ctx, "storage.List", tracing.KindInternal)
+	ids, err := messageStore.List(ownerKey)
+	span.SetAttribute("messages", len(ids))
+	span.End(err)
+	return ids, err
+}
+
+func storeDelete(ctx context.Context, ownerKey, messageID string) error {
+	_, span := tracing.Start(ctx, "storage.Delete", tracing.KindInternal)
+	var pointer *lockerPointer
+	if messageLockers != nil {
+		if data, err := messageStore.Read(ownerKey, messageID); err == nil {
+			pointer = offloadPointer(data)
+		}
+	}
+	err := messageStore.Delete(ownerKey, messageID)
+	if err == nil && pointer != nil {
+		deleteOffloaded(ctx, pointer)
+	}
+	if err == nil || errors.Is(err, storage.ErrMessageNotFound) {
+		replicate(replicaOp{delete: true, ownerKey: ownerKey, messageID: messageID})
+	}
+	span.End(err)
+	return err
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/api/validate"
+	"wave_capacitor/logging"
+	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+	"wave_capacitor/storage"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Users can keep backups they encrypted on their devices on the node. The node stores the
+// uploaded bytes as they are and never sees a key, so it can't read or verify them beyond
+// their checksum.
+
+var (
+	storedBackupStore       storage.BlobStore // nil disables stored backups
+	maxStoredBackupsPerUser int
+)
+
+// SetStoredBackups configures the blob store keeping stored backups and how many a user
+// may keep; a nil store disables them
+func SetStoredBackups(store storage.BlobStore, maxPerUser int) {
+	storedBackupStore = store
+	maxStoredBackupsPerUser = maxPerUser
+}
+
+// errStoredBackupsDisabled is returned by the stored backup endpoints when the node has them off
+var errStoredBackupsDisabled = serviceError(fiber.StatusNotImplemented, "Stored backups are disabled on this node")
+
+// PushStoredBackupQuery describes a backup being stored
+type PushStoredBackupQuery struct {
+	Label  string `query:"label" validate:"max=255" doc:"Shown when listing the stored backups"`
+	SHA256 string `query:"sha256" doc:"hex SHA-256 of the body; when given, an upload damaged on the way is refused"`
+}
+
+// PushStoredBackup stores the request body, a backup the client encrypted, as one of the
+// user's stored backups
+func PushStoredBackup(c *fiber.Ctx) error {
+	if storedBackupStore == nil {
+		return respondError(c, errStoredBackupsDisabled)
+	}
+	var query PushStoredBackupQuery
+	if err := parseQuery(c, &query); err != nil {
+		return respondError(c, err)
+	}
+	body := c.Body()
+	if len(body) == 0 {
+		return respondError(c, fieldError("body", validate.CodeRequired, "must hold the encrypted backup"))
+	}
+
+	sum := sha256.Sum256(body)
+	checksum := hex.EncodeToString(sum[:])
+	if query.SHA256 != "" && !strings.EqualFold(query.SHA256, checksum) {
+		return respondError(c, fieldError("sha256", validate.CodeFormat, "does not match the body, which was damaged on the way"))
+	}
+	if err := diskGuard.Check(); err != nil {
+		logging.Warnf(c.UserContext(), "Refusing stored backup: %v", err)
+		return respondError(c, errInsufficientStorage)
+	}
+
+	ctx := c.UserContext()
+	backup := models.StoredBackup{
+		ID:       uuid.New().String(),
+		Username: middleware.ExtractUsername(c),
+		Label:    query.Label,
+		Size:     int64(len(body)),
+		SHA256:   checksum,
+	}
+	// The blob is written first, so a recorded backup can always be retrieved
+	if err := storedBackupStore.PutBlob(backup.ID, bytes.NewReader(body), backup.Size); err != nil {
+		logging.Errorf(ctx, "Error writing stored backup: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to store backup"))
+	}
+	err := models.CreateStoredBackup(ctx, &backup, maxStoredBackupsPerUser)
+	if err != nil {
+		if deleteErr := storedBackupStore.DeleteBlob(backup.ID); deleteErr != nil {
+			logging.Errorf(ctx, "Error removing unrecorded stored backup %s: %v", backup.ID, deleteErr)
+		}
+	}
+	if errors.Is(err, models.ErrStoredBackupLimit) {
+		return respondError(c, codedError(fiber.StatusConflict, apierror.LimitExceeded,
+			fmt.Sprintf("At most %d backups can be stored, delete one first", maxStoredBackupsPerUser)))
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error recording stored backup: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to store backup"))
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(StoredBackupResponse{Success: true, Backup: backup})
+}
+
+// GetStoredBackups lists the authenticated user's stored backups
+func GetStoredBackups(c *fiber.Ctx) error {
+	if storedBackupStore == nil {
+		return respondError(c, errStoredBackupsDisabled)
+	}
+
+	backups, err := models.ListStoredBackups(c.UserContext(), middleware.ExtractUsername(c))
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error listing stored backups: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to list stored backups"))
+	}
+	return c.Status(fiber.StatusOK).JSON(StoredBackupsResponse{Success: true, Backups: backups, Limit: maxStoredBackupsPerUser})
+}
+
+// GetStoredBackup returns the bytes of one of the user's stored backups as uploaded. The
+// ETag is the backup's checksum, so a client holding it gets an empty 304.
+func GetStoredBackup(c *fiber.Ctx) error {
+	if storedBackupStore == nil {
+		return respondError(c, errStoredBackupsDisabled)
+	}
+
+	ctx := c.UserContext()
+	backup, err := models.GetStoredBackup(ctx, middleware.ExtractUsername(c), c.Params("id"))
+	if errors.Is(err, models.ErrStoredBackupNotFound) {
+		return respondError(c, serviceError(fiber.StatusNotFound, "Stored backup not found"))
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error retrieving stored backup: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to retrieve stored backup"))
+	}
+	if notModified(c, `"`+backup.SHA256+`"`) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	blob, err := storedBackupStore.GetBlob(backup.ID)
+	if err != nil {
+		logging.Errorf(ctx, "Error opening stored backup %s: %v", backup.ID, err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to retrieve stored backup"))
+	}
+	c.Set(fiber.HeaderContentType, fiber.MIMEOctetStream)
+	return c.SendStream(blob, int(backup.Size))
+}
+
+// RemoveStoredBackup deletes one of the user's stored backups
+func RemoveStoredBackup(c *fiber.Ctx) error {
+	if storedBackupStore == nil {
+		return respondError(c, errStoredBackupsDisabled)
+	}
+
+	ctx := c.UserContext()
+	id := c.Params("id")
+	err := models.DeleteStoredBackup(ctx, middleware.ExtractUsername(c), id)
+	if errors.Is(err, models.ErrStoredBackupNotFound) {
+		return respondError(c, serviceError(fiber.StatusNotFound, "Stored backup not found"))
+	}
+	if err != nil {
+		logging.Errorf(ctx, "Error deleting stored backup: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to delete stored backup"))
+	}
+	deleteStoredBackupBlob(c, id)
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+		"message": "Stored backup deleted successfully",
+	})
+}
+
+// deleteStoredBackupBlob removes the blob of a backup whose record is gone; a failure
+// only leaves an unreachable blob behind, so it is logged
+func deleteStoredBackupBlob(c *fiber.Ctx, id string) {
+	err := storedBackupStore.DeleteBlob(id)
+	if err != nil && !errors.Is(err, storage.ErrBlobNotFound) {
+		logging.Errorf(c.UserContext(), "Error deleting stored backup blob %s: %v", id, err)
+	}
+}
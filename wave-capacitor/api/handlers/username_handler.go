@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"errors"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/api/validate"
+	"wave_capacitor/logging"
+	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+	"wave_capacitor/webhooks"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ChangeUsernameRequest defines the structure for username change requests
+type ChangeUsernameRequest struct {
+	NewUsername string `json:"new_username" validate:"required,username"`
+}
+
+// ChangeUsername renames the authenticated account. The contacts list moves to the new
+// name and the old name is kept as an alias so backups and pending relays still resolve.
+func ChangeUsername(c *fiber.Ctx) error {
+	// Parse request body
+	var req ChangeUsernameRequest
+	if err := parseBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+
+	// Get username from JWT
+	username := middleware.ExtractUsername(c)
+
+	if req.NewUsername == username {
+		return respondError(c, fieldError("new_username", validate.CodeFormat, "must differ from the current username"))
+	}
+
+	// Database contacts are renamed inside the username transaction and stay sealed under
+	// the user ID, which the rename keeps. Other backends get
+	// a copy under the new name first, which is discarded if the rename fails.
+	_, contactsInDB := contactStore.(*models.DBContactStore)
+	var contacts []Contact
+	if !contactsInDB {
+		var err error
+		contacts, err = contactStore.ListContacts(c.UserContext(), username)
+		if err != nil {
+			logging.Errorf(c.UserContext(), "Error loading contacts for rename: %v", err)
+			return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to load contacts"))
+		}
+	}
+	if len(contacts) > 0 {
+		if err := contactStore.ReplaceContacts(c.UserContext(), req.NewUsername, contacts); err != nil {
+			logging.Errorf(c.UserContext(), "Error copying contacts for rename: %v", err)
+			return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to move contacts"))
+		}
+	}
+
+	if err := models.ChangeUsername(c.UserContext(), username, req.NewUsername); err != nil {
+		if len(contacts) > 0 {
+			if err := contactStore.DeleteContacts(c.UserContext(), req.NewUsername); err != nil {
+				logging.Errorf(c.UserContext(), "Error discarding copied contacts for %s: %v", req.NewUsername, err)
+			}
+		}
+		if errors.Is(err, models.ErrUsernameTaken) {
+			return respondError(c, codedError(fiber.StatusConflict, apierror.UsernameTaken, "Username already exists"))
+		}
+		logging.Errorf(c.UserContext(), "Error changing username for %s: %v", username, err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to change username"))
+	}
+
+	// The old list is only dropped once the new name is committed
+	if !contactsInDB {
+		if err := contactStore.DeleteContacts(c.UserContext(), username); err != nil {
+			logging.Errorf(c.UserContext(), "Error removing old contacts for %s: %v", username, err)
+		}
+	}
+
+	webhookDispatcher.Emit(c.UserContext(), req.NewUsername, webhooks.EventUsernameChanged, fiber.Map{"old_username": username})
+
+	// Tokens carry the username, so the client needs a fresh one
+	token, err := middleware.GenerateToken(req.NewUsername)
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error generating token after username change: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Username changed, but failed to generate a new token; please log in again"))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success":  true,
+		"message":  "Username changed successfully",
+		"username": req.NewUsername,
+		"token":    token,
+	})
+}
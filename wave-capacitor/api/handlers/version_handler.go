@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"wave_capacitor/version"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetVersion reports the build of the node and which optional features it runs with
+func GetVersion(c *fiber.Ctx) error {
+	resp := VersionResponse{Success: true, Info: version.Get()}
+	if nodeConfig != nil {
+		resp.Features = Features{
+			TLS:            nodeConfig.UseTLS || nodeConfig.UseAutoCert || nodeConfig.TLSOffloaded,
+			HTTP2:          nodeConfig.HTTP2Enabled,
+			DHT:            nodeConfig.EnableDHT,
+			StorageBackend: nodeConfig.StorageBackend,
+			ColdStorage:    nodeConfig.ColdStorageBackend,
+			EncryptAtRest:  nodeConfig.EncryptAtRest,
+			Webhooks:       nodeConfig.WebhooksEnabled,
+			StoredBackups:  nodeConfig.StoredBackupMaxPerUser > 0,
+		}
+	}
+	return c.Status(fiber.StatusOK).JSON(resp)
+}
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/api/validate"
+	"wave_capacitor/logging"
+	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+	"wave_capacitor/webhooks"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// webhookDeliveryLogSize is the number of attempts returned from the delivery log
+const webhookDeliveryLogSize = 100
+
+var (
+	webhookDispatcher  *webhooks.Dispatcher // nil disables webhooks
+	maxWebhooksPerUser int
+)
+
+// SetWebhooks configures the dispatcher events are emitted to and how many webhooks
+// a user may register; a nil dispatcher disables webhooks
+func SetWebhooks(dispatcher *webhooks.Dispatcher, maxPerUser int) {
+	webhookDispatcher = dispatcher
+	maxWebhooksPerUser = maxPerUser
+}
+
+// errWebhooksDisabled is returned by the webhook endpoints when the node has webhooks off
+var errWebhooksDisabled = serviceError(fiber.StatusNotImplemented, "Webhooks are disabled on this node")
+
+// CreateWebhookRequest defines the structure for registering a webhook
+type CreateWebhookRequest struct {
+	URL    string   `json:"url" validate:"required,url,max=2048"`
+	Events []string `json:"events" validate:"max=16" doc:"Event types to deliver; empty for all"`
+}
+
+// CreateWebhook registers a webhook for the authenticated user
+func CreateWebhook(c *fiber.Ctx) error {
+	var req CreateWebhookRequest
+	if err := decodeBody(c, &req); err != nil {
+		return respondError(c, err)
+	}
+
+	resp, err := RegisterWebhook(c.UserContext(), middleware.ExtractUsername(c), req)
+	if err != nil {
+		return respondError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(resp)
+}
+
+// RegisterWebhook stores a webhook of the user with a fresh signing secret, which is only
+// returned here
+func RegisterWebhook(ctx context.Context, username string, req CreateWebhookRequest) (*WebhookCreatedResponse, error) {
+	if webhookDispatcher == nil {
+		return nil, errWebhooksDisabled
+	}
+	if err := validateRequest(req); err != nil {
+		return nil, err
+	}
+	for i, event := range req.Events {
+		if !webhooks.ValidEventType(event) {
+			return nil, fieldError(fmt.Sprintf("events[%d]", i), validate.CodeOneOf, "must be a known event type")
+		}
+	}
+
+	existing, err := models.ListWebhooks(ctx, username)
+	if err != nil {
+		logging.Errorf(ctx, "Error listing webhooks: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to register webhook")
+	}
+	if len(existing) >= maxWebhooksPerUser {
+		return nil, codedError(fiber.StatusConflict, apierror.LimitExceeded, fmt.Sprintf("At most %d webhooks can be registered", maxWebhooksPerUser))
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		logging.Errorf(ctx, "Error generating webhook secret: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to register webhook")
+	}
+	hook := models.Webhook{
+		ID:       uuid.New().String(),
+		Username: username,
+		URL:      req.URL,
+		Secret:   hex.EncodeToString(secret),
+		Events:   req.Events,
+	}
+	if err := models.CreateWebhook(ctx, &hook); err != nil {
+		logging.Errorf(ctx, "Error creating webhook: %v", err)
+		return nil, serviceError(fiber.StatusInternalServerError, "Failed to register webhook")
+	}
+
+	return &WebhookCreatedResponse{Success: true, Webhook: hook, Secret: hook.Secret}, nil
+}
+
+// GetWebhooks lists the authenticated user's webhooks
+func GetWebhooks(c *fiber.Ctx) error {
+	if webhookDispatcher == nil {
+		return respondError(c, errWebhooksDisabled)
+	}
+
+	hooks, err := models.ListWebhooks(c.UserContext(), middleware.ExtractUsername(c))
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error listing webhooks: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to list webhooks"))
+	}
+	return c.Status(fiber.StatusOK).JSON(WebhooksResponse{Success: true, Webhooks: hooks, EventTypes: webhooks.EventTypes})
+}
+
+// RemoveWebhook deletes one of the authenticated user's webhooks
+func RemoveWebhook(c *fiber.Ctx) error {
+	err := models.DeleteWebhook(c.UserContext(), middleware.ExtractUsername(c), c.Params("id"))
+	if errors.Is(err, models.ErrWebhookNotFound) {
+		return respondError(c, serviceError(fiber.StatusNotFound, "Webhook not found"))
+	}
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error deleting webhook: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to delete webhook"))
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"success": true,
+		"message": "Webhook deleted successfully",
+	})
+}
+
+// GetWebhookDeliveries returns the latest delivery attempts of one of the user's webhooks
+func GetWebhookDeliveries(c *fiber.Ctx) error {
+	hooks, err := models.ListWebhooks(c.UserContext(), middleware.ExtractUsername(c))
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error listing webhooks: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to load delivery log"))
+	}
+
+	id := c.Params("id")
+	for _, hook := range hooks {
+		if hook.ID == id {
+			return respondDeliveries(c, id)
+		}
+	}
+	return respondError(c, serviceError(fiber.StatusNotFound, "Webhook not found"))
+}
+
+// GetDeploymentWebhookDeliveries returns the latest delivery attempts of the node-wide webhook
+func GetDeploymentWebhookDeliveries(c *fiber.Ctx) error {
+	return respondDeliveries(c, models.DeploymentWebhookID)
+}
+
+// respondDeliveries writes the delivery log of a webhook
+func respondDeliveries(c *fiber.Ctx, webhookID string) error {
+	deliveries, err := models.ListWebhookDeliveries(c.UserContext(), webhookID, webhookDeliveryLogSize)
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error listing webhook deliveries: %v", err)
+		return respondError(c, serviceError(fiber.StatusInternalServerError, "Failed to load delivery log"))
+	}
+	return c.Status(fiber.StatusOK).JSON(WebhookDeliveriesResponse{Success: true, Deliveries: deliveries})
+}
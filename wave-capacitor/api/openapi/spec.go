@@ -0,0 +1,294 @@
+// Package openapi builds an OpenAPI 3 document from route descriptions and the Go types
+// of their request and response bodies.
+package openapi
+
+import (
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Version of the OpenAPI specification the generated documents follow
+const Version = "3.0.3"
+
+// Auth schemes an operation can require
+const (
+	AuthNone     = ""
+	AuthJWT      = "bearerAuth"
+	AuthTransfer = "transferToken"
+	AuthAdmin    = "adminToken"
+)
+
+// Param describes a query or path parameter
+type Param struct {
+	Name        string
+	In          string // "query" or "path"
+	Description string
+	Required    bool
+	Type        string // JSON schema type, defaults to "string"
+}
+
+// Route describes one API endpoint. Request and Response are zero values of the body
+// types (nil for none); ErrorCodes lists the non-2xx statuses the handler returns.
+// A ContentType without a Response describes a binary stream.
+type Route struct {
+	Method      string
+	Path        string // Fiber style, e.g. /api/shards/:shard/export
+	Tag         string
+	Summary     string
+	Description string
+	Auth        string
+	Params      []Param
+	Request     interface{}
+	Status      int // Success status, defaults to 200
+	Response    interface{}
+	ContentType string // Response content type, defaults to application/json
+	ErrorCodes  []int
+	// Conditional routes return an ETag and answer a matching If-None-Match with 304
+	Conditional bool
+	// Idempotent routes replay their first response when retried with the same Idempotency-Key
+	Idempotent bool
+}
+
+// Document is the subset of the OpenAPI 3 document model the capacitor uses
+type Document struct {
+	OpenAPI    string                          `json:"openapi"`
+	Info       Info                            `json:"info"`
+	Servers    []Server                        `json:"servers,omitempty"`
+	Paths      map[string]map[string]Operation `json:"paths"`
+	Components Components                      `json:"components"`
+}
+
+// Info describes the API as a whole
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// Server is a base URL the paths are relative to
+type Server struct {
+	URL string `json:"url"`
+}
+
+// Operation describes a single method on a path
+type Operation struct {
+	Tags        []string              `json:"tags,omitempty"`
+	Summary     string                `json:"summary,omitempty"`
+	Description string                `json:"description,omitempty"`
+	OperationID string                `json:"operationId"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]Response   `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+// Parameter describes a query or path parameter
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required"`
+	Schema      *Schema `json:"schema"`
+}
+
+// RequestBody describes the body an operation accepts
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+// Response describes one response status of an operation
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+// MediaType holds the schema of a body
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Components holds the reusable schemas and security schemes
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes"`
+}
+
+// SecurityScheme describes how a request authenticates
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+// errorDescriptions are the response descriptions of the error statuses handlers use
+var errorDescriptions = map[int]string{
+	400: "Invalid request",
+	401: "Missing or invalid credentials",
+	403: "Forbidden",
+	404: "Not found",
+	409: "Conflict with the current state",
+	413: "Request body too large",
+	422: "Idempotency-Key already used for a different request",
+	429: "Rate limit exceeded, retry after the Retry-After seconds",
+	500: "Internal error",
+	501: "Not supported by this node's storage backend",
+	503: "Unavailable, e.g. read-only maintenance mode",
+	507: "Insufficient storage on the node",
+}
+
+// Build generates the document for routes, whose paths are relative to basePath. errorBody
+// is the body type of error responses.
+func Build(info Info, basePath string, routes []Route, errorBody interface{}) *Document {
+	schemas := newSchemaRegistry()
+	doc := &Document{
+		OpenAPI: Version,
+		Info:    info,
+		Servers: []Server{{URL: basePath}},
+		Paths:   make(map[string]map[string]Operation),
+		Components: Components{
+			SecuritySchemes: map[string]SecurityScheme{
+				AuthJWT:      {Type: "http", Scheme: "bearer", BearerFormat: "JWT", Description: "Token returned by register, login or recover_account"},
+				AuthTransfer: {Type: "http", Scheme: "bearer", Description: "Shared SHARD_TRANSFER_TOKEN of the capacitors"},
+				AuthAdmin:    {Type: "http", Scheme: "bearer", Description: "Operator ADMIN_TOKEN of the node"},
+			},
+		},
+	}
+
+	for _, route := range routes {
+		path, pathParams := convertPath(route.Path)
+		op := Operation{
+			Summary:     route.Summary,
+			Description: route.Description,
+			OperationID: operationID(route.Method, path),
+			Responses:   make(map[string]Response),
+		}
+		if route.Tag != "" {
+			op.Tags = []string{route.Tag}
+		}
+		if route.Auth != AuthNone {
+			op.Security = []map[string][]string{{route.Auth: {}}}
+		}
+
+		params := route.Params
+		for _, name := range pathParams {
+			if !hasParam(params, name) {
+				params = append(params, Param{Name: name, In: "path", Required: true})
+			}
+		}
+		for _, p := range params {
+			typ := p.Type
+			if typ == "" {
+				typ = "string"
+			}
+			op.Parameters = append(op.Parameters, Parameter{
+				Name:        p.Name,
+				In:          p.In,
+				Description: p.Description,
+				Required:    p.Required || p.In == "path",
+				Schema:      &Schema{Type: typ},
+			})
+		}
+
+		if route.Conditional {
+			op.Parameters = append(op.Parameters, Parameter{
+				Name:        "If-None-Match",
+				In:          "header",
+				Description: "ETag of a previous response",
+				Schema:      &Schema{Type: "string"},
+			})
+			op.Responses["304"] = Response{Description: "Not modified since the response tagged If-None-Match"}
+		}
+
+		errorCodes := route.ErrorCodes
+		if route.Idempotent {
+			op.Parameters = append(op.Parameters, Parameter{
+				Name:        "Idempotency-Key",
+				In:          "header",
+				Description: "Unique key of the request, at most 255 characters; retries with the same key replay the first response",
+				Schema:      &Schema{Type: "string"},
+			})
+			for _, code := range []int{409, 422} {
+				if !slices.Contains(errorCodes, code) {
+					errorCodes = append(errorCodes, code)
+				}
+			}
+		}
+
+		if route.Request != nil {
+			// Every body is subject to the body limit of its route group
+			if !slices.Contains(errorCodes, 413) {
+				errorCodes = append(errorCodes, 413)
+			}
+			op.RequestBody = &RequestBody{
+				Required: true,
+				Content:  map[string]MediaType{"application/json": {Schema: schemas.schemaFor(reflect.TypeOf(route.Request))}},
+			}
+		}
+
+		status := route.Status
+		if status == 0 {
+			status = 200
+		}
+		success := Response{Description: "Success"}
+		switch {
+		case route.Response != nil:
+			contentType := route.ContentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			success.Content = map[string]MediaType{contentType: {Schema: schemas.schemaFor(reflect.TypeOf(route.Response))}}
+		case route.ContentType != "":
+			// Streamed bodies such as archives
+			success.Content = map[string]MediaType{route.ContentType: {Schema: &Schema{Type: "string", Format: "binary"}}}
+		}
+		op.Responses[strconv.Itoa(status)] = success
+
+		for _, code := range errorCodes {
+			op.Responses[strconv.Itoa(code)] = Response{
+				Description: errorDescriptions[code],
+				Content:     map[string]MediaType{"application/json": {Schema: schemas.schemaFor(reflect.TypeOf(errorBody))}},
+			}
+		}
+
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]Operation)
+		}
+		doc.Paths[path][strings.ToLower(route.Method)] = op
+	}
+
+	doc.Components.Schemas = schemas.schemas
+	return doc
+}
+
+// convertPath turns Fiber's ":param" segments into OpenAPI "{param}" ones
+func convertPath(path string) (string, []string) {
+	var params []string
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			name := strings.TrimSuffix(segment[1:], "?")
+			params = append(params, name)
+			segments[i] = "{" + name + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+// operationID derives a stable identifier such as "post_api_send_message"
+func operationID(method, path string) string {
+	replacer := strings.NewReplacer("/", "_", "{", "", "}", "", "-", "_")
+	return strings.ToLower(method) + strings.TrimRight(replacer.Replace(path), "_")
+}
+
+func hasParam(params []Param, name string) bool {
+	for _, p := range params {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,295 @@
+// Package validate checks request DTOs against their `validate` struct tags and reports
+// every violation as a machine-readable FieldError.
+//
+// Rules are comma separated:
+//
+//	required   the value must not be empty (zero value, nil, or empty string/slice/map)
+//	min=N      minimum length of strings and slices, minimum value of numbers
+//	max=N      maximum length of strings and slices, maximum value of numbers
+//	oneof=a b  the string must be one of the space separated values
+//	url        an absolute http or https URL
+//	base64     standard base64
+//	username   1 to 64 characters that are safe in file names
+//
+// Rules other than required are skipped for empty values. Nested structs, pointers to
+// structs and slices of structs are validated recursively.
+package validate
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Error codes of FieldError
+const (
+	CodeRequired = "required"
+	CodeMin      = "min"
+	CodeMax      = "max"
+	CodeOneOf    = "oneof"
+	CodeFormat   = "format"
+	CodeType     = "type"
+	CodeSyntax   = "syntax"
+	CodeUnknown  = "unknown"
+)
+
+// FieldError describes one invalid field; Field is the JSON path, e.g. prekeys[2].key_id
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code" doc:"required, min, max, oneof, format, type, syntax or unknown"`
+	Message string `json:"message"`
+}
+
+// Errors are all violations found in a request
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, fe := range e {
+		if fe.Field == "" {
+			messages[i] = fe.Message
+		} else {
+			messages[i] = fe.Field + ": " + fe.Message
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// usernamePattern restricts usernames to characters that are safe in file names
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]{0,63}$`)
+
+// ValidUsername reports whether name satisfies the username rule
+func ValidUsername(name string) bool {
+	return usernamePattern.MatchString(name)
+}
+
+// Struct validates v, a struct or pointer to struct. It returns nil when v is valid.
+func Struct(v interface{}) error {
+	var errs Errors
+	walk(reflect.ValueOf(v), "", &errs)
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// DecodeJSON strictly decodes a JSON request body into out: unknown fields, values of the
+// wrong type and anything after the JSON value are rejected as Errors
+func DecodeJSON(data []byte, out interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(out); err != nil {
+		return DecodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return Errors{{Code: CodeSyntax, Message: "Request body must be a single JSON value"}}
+	}
+	return nil
+}
+
+// DecodeError converts a body parsing error into a FieldError, naming the offending
+// field when the JSON decoder reports it
+func DecodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return Errors{{Field: typeErr.Field, Code: CodeType, Message: "must be of type " + jsonType(typeErr.Type)}}
+	}
+	// encoding/json has no error type for unknown fields
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		return Errors{{Field: strings.Trim(field, `"`), Code: CodeUnknown, Message: "is not a known field"}}
+	}
+	return Errors{{Code: CodeSyntax, Message: "Request body is not valid JSON"}}
+}
+
+// walk validates the fields of a struct value
+func walk(v reflect.Value, path string, errs *Errors) {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := fieldName(field)
+		if name == "-" {
+			continue
+		}
+		fieldPath := name
+		if path != "" {
+			fieldPath = path + "." + name
+		}
+
+		value := v.Field(i)
+		if rules := field.Tag.Get("validate"); rules != "" {
+			check(value, fieldPath, rules, errs)
+		}
+		nested(value, fieldPath, errs)
+	}
+}
+
+// nested descends into struct fields and slices of structs
+func nested(v reflect.Value, path string, errs *Errors) {
+	switch v.Kind() {
+	case reflect.Struct, reflect.Pointer:
+		walk(v, path, errs)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			walk(v.Index(i), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	}
+}
+
+// check applies the rules of one field
+func check(v reflect.Value, path, rules string, errs *Errors) {
+	empty := isEmpty(v)
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		if name == "required" {
+			if empty {
+				*errs = append(*errs, FieldError{Field: path, Code: CodeRequired, Message: "is required"})
+				return
+			}
+			continue
+		}
+		if empty {
+			continue
+		}
+
+		if fe := apply(v, name, arg); fe != nil {
+			fe.Field = path
+			*errs = append(*errs, *fe)
+			return
+		}
+	}
+}
+
+// apply evaluates a single non-required rule
+func apply(v reflect.Value, name, arg string) *FieldError {
+	for v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+
+	switch name {
+	case "min", "max":
+		limit, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			panic(fmt.Sprintf("validate: invalid %s argument %q", name, arg))
+		}
+		size, isLength := measure(v)
+		if (name == "min" && size >= limit) || (name == "max" && size <= limit) {
+			return nil
+		}
+		bound := map[string]string{"min": "at least", "max": "at most"}[name]
+		if isLength {
+			return &FieldError{Code: name, Message: fmt.Sprintf("must have %s %s %s", bound, arg, unit(v))}
+		}
+		return &FieldError{Code: name, Message: fmt.Sprintf("must be %s %s", bound, arg)}
+	case "oneof":
+		options := strings.Fields(arg)
+		for _, option := range options {
+			if v.String() == option {
+				return nil
+			}
+		}
+		return &FieldError{Code: CodeOneOf, Message: "must be one of " + strings.Join(options, ", ")}
+	case "url":
+		u, err := url.Parse(v.String())
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return &FieldError{Code: CodeFormat, Message: "must be an http or https URL"}
+		}
+	case "base64":
+		if _, err := base64.StdEncoding.DecodeString(v.String()); err != nil {
+			return &FieldError{Code: CodeFormat, Message: "must be base64 encoded"}
+		}
+	case "username":
+		if !ValidUsername(v.String()) {
+			return &FieldError{Code: CodeFormat, Message: "must be 1-64 letters, digits, '_', '-' or '.', not starting with '.'"}
+		}
+	default:
+		panic(fmt.Sprintf("validate: unknown rule %q", name))
+	}
+	return nil
+}
+
+// measure returns the length of strings and collections or the value of numbers
+func measure(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(len(v.String())), true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), false
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), false
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), false
+	}
+	panic(fmt.Sprintf("validate: min/max not supported on %s", v.Kind()))
+}
+
+// unit names what the length of v counts
+func unit(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return "characters"
+	}
+	return "items"
+}
+
+// isEmpty reports whether v holds no value
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
+
+// fieldName returns the JSON name of a struct field, falling back to its query tag
+func fieldName(field reflect.StructField) string {
+	for _, key := range []string{"json", "query"} {
+		if tag := field.Tag.Get(key); tag != "" {
+			if name, _, _ := strings.Cut(tag, ","); name != "" {
+				return name
+			}
+		}
+	}
+	return field.Name
+}
+
+// jsonType names a Go type the way API clients see it
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	}
+	return "object"
+}
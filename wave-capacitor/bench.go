@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+	"wave_capacitor/config"
+	"wave_capacitor/dht/dht"
+	"wave_capacitor/storage"
+
+	"github.com/google/uuid"
+)
+
+// benchmark is a micro-benchmark of one hot path, run by the "bench" command
+type benchmark struct {
+	name string
+	run  func(b *testing.B)
+}
+
+// benchmarkResult is the outcome of one benchmark
+type benchmarkResult struct {
+	Name        string  `json:"name"`
+	Iterations  int     `json:"iterations"`
+	NsPerOp     int64   `json:"ns_per_op"`
+	MBPerSecond float64 `json:"mb_per_second,omitempty"`
+	BytesPerOp  int64   `json:"bytes_per_op"`
+	AllocsPerOp int64   `json:"allocs_per_op"`
+}
+
+// benchMessageSize is the size of the messages written and read by the benchmarks, a
+// short text message once encrypted by the client and encoded
+const benchMessageSize = 2048
+
+// runBench runs the micro-benchmarks of the hot paths in process, against temporary
+// folders, so that changes to them can be compared on the hardware of a node, where the
+// Go toolchain that runs the Benchmark functions of storage and dht/dht isn't installed.
+// Each benchmark runs for about a second.
+func runBench(cfg *config.Config, args []string) {
+	flags := commandFlags("bench")
+	filter := flags.String("run", "", "Only run the benchmarks whose name matches this regular expression")
+	asJSON := flags.Bool("json", false, "Print the results as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	pattern, err := regexp.Compile(*filter)
+	if err != nil {
+		log.Fatalf("❌ --run: %v", err)
+	}
+
+	dir, err := os.MkdirTemp("", "capacitor-bench-")
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var results []benchmarkResult
+	for _, bench := range benchmarks(dir) {
+		if !pattern.MatchString(bench.name) {
+			continue
+		}
+		result := testing.Benchmark(bench.run)
+		if result.N == 0 {
+			log.Printf("❌ %s failed", bench.name)
+			continue
+		}
+		entry := benchmarkResult{
+			Name:        bench.name,
+			Iterations:  result.N,
+			NsPerOp:     result.NsPerOp(),
+			BytesPerOp:  result.AllocedBytesPerOp(),
+			AllocsPerOp: result.AllocsPerOp(),
+		}
+		if result.Bytes > 0 && result.T > 0 {
+			entry.MBPerSecond = float64(result.Bytes) * float64(result.N) / 1e6 / result.T.Seconds()
+		}
+		results = append(results, entry)
+		if !*asJSON {
+			fmt.Printf("%-36s %s\t%s\n", bench.name, result.String(), result.MemString())
+		}
+	}
+	if *asJSON {
+		out, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Println(string(out))
+	}
+}
+
+// benchmarks returns the benchmarks, writing their files under dir
+func benchmarks(dir string) []benchmark {
+	return []benchmark{
+		{"shard/folder_for_key", benchFolderForKey(dir)},
+		{"message_store/write", benchMessageWrite(dir, "plain", nil)},
+		{"message_store/read", benchMessageRead(dir, "plain", nil)},
+		{"message_store/write_encrypted", benchMessageWrite(dir, "encrypted", benchEncryptor())},
+		{"message_store/read_encrypted", benchMessageRead(dir, "encrypted", benchEncryptor())},
+		{"routing_table/add_contact", benchRoutingAdd},
+		{"routing_table/closest_contacts", benchRoutingClosest},
+	}
+}
+
+// benchEncryptor returns an encryptor under a random master key
+func benchEncryptor() *storage.Encryptor {
+	key := make([]byte, 32)
+	rand.Read(key)
+	encryptor, err := storage.NewEncryptor(key)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	return encryptor
+}
+
+// benchMessage returns a message of benchMessageSize bytes
+func benchMessage() []byte {
+	data := make([]byte, benchMessageSize)
+	for i := range data {
+		data[i] = 'a' + byte(i%26)
+	}
+	return data
+}
+
+// benchOwnerKeys returns owner keys shaped like public keys, spread over the shards
+func benchOwnerKeys(count int) []string {
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = uuid.New().String() + uuid.New().String()
+	}
+	return keys
+}
+
+// benchFolderForKey times hashing an owner key to its message folder, done on every
+// message read and write
+func benchFolderForKey(dir string) func(b *testing.B) {
+	return func(b *testing.B) {
+		shards := storage.NewShardManager(dir)
+		keys := benchOwnerKeys(1024)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			shards.GetFolderForKey(keys[i%len(keys)])
+		}
+	}
+}
+
+// benchMessageWrite times storing a message for one of a few owners
+func benchMessageWrite(dir, name string, encryptor *storage.Encryptor) func(b *testing.B) {
+	return func(b *testing.B) {
+		store := storage.NewFileMessageStore(fmt.Sprintf("%s/write-%s-%d", dir, name, time.Now().UnixNano()), encryptor)
+		owners := benchOwnerKeys(16)
+		data := benchMessage()
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := store.Write(owners[i%len(owners)], uuid.New().String(), data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// benchMessageRead times reading back stored messages, written once before the first run
+func benchMessageRead(dir, name string, encryptor *storage.Encryptor) func(b *testing.B) {
+	var store *storage.FileMessageStore
+	owners := benchOwnerKeys(16)
+	ids := make([]string, 256)
+	data := benchMessage()
+	return func(b *testing.B) {
+		if store == nil {
+			store = storage.NewFileMessageStore(fmt.Sprintf("%s/read-%s", dir, name), encryptor)
+			for i := range ids {
+				ids[i] = uuid.New().String()
+				if err := store.Write(owners[i%len(owners)], ids[i], data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			j := i % len(ids)
+			if _, err := store.Read(owners[j%len(owners)], ids[j]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// benchContacts returns contacts with random IDs
+func benchContacts(count int) []dht.Contact {
+	contacts := make([]dht.Contact, count)
+	for i := range contacts {
+		rand.Read(contacts[i].ID[:])
+		contacts[i].Address = fmt.Sprintf("10.0.%d.%d:4000", i/256%256, i%256)
+		contacts[i].LastSeen = time.Now()
+	}
+	return contacts
+}
+
+// benchRoutingAdd times adding contacts to a routing table, most of them to full buckets
+func benchRoutingAdd(b *testing.B) {
+	var local dht.NodeID
+	rand.Read(local[:])
+	table := dht.NewRoutingTable(local)
+	contacts := benchContacts(4096)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.AddContact(contacts[i%len(contacts)])
+	}
+}
+
+// benchRoutingClosest times finding the contacts closest to a target, done by every DHT
+// lookup and the FIND_NODE requests of peers
+func benchRoutingClosest(b *testing.B) {
+	var local dht.NodeID
+	rand.Read(local[:])
+	table := dht.NewRoutingTable(local)
+	for _, contact := range benchContacts(4096) {
+		table.AddContact(contact)
+	}
+	targets := benchContacts(256)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.GetClosestContacts(targets[i%len(targets)].ID, dht.K)
+	}
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"wave_capacitor/api/handlers"
+	"wave_capacitor/config"
+	"wave_capacitor/doctor"
+	"wave_capacitor/models"
+	"wave_capacitor/nodeca"
+	"wave_capacitor/secrets"
+	"wave_capacitor/storage"
+	"wave_capacitor/utils"
+)
+
+// command is an operator subcommand run instead of the server, e.g. "capacitor migrate"
+type command struct {
+	usage       string // arguments after the command name
+	description string
+	run         func(cfg *config.Config, args []string)
+}
+
+// commands lists every subcommand; without one, or with "serve", the node is served
+var commands map[string]command
+
+// The commands' flag sets print their usage from commands, so it is filled in at init
+func init() {
+	commands = map[string]command{
+		"migrate": {
+			usage:       "[status]",
+			description: "Apply pending database migrations, or list them",
+			run: func(cfg *config.Config, args []string) {
+				runMigrate(args)
+			},
+		},
+		"rebalance-shards": {
+			description: "Move message folders to their shard under the current NUM_SHARDS (file storage only)",
+			run: func(cfg *config.Config, args []string) {
+				runRebalanceShards(cfg)
+			},
+		},
+		"rehash-salt": {
+			description: "Move messages and index entries from PREVIOUS_CONFUSION_SALT to CONFUSION_SALT",
+			run: func(cfg *config.Config, args []string) {
+				runRehashSalt(cfg)
+			},
+		},
+		"backup": {
+			usage:       "[--out DIR] [--passphrase-file FILE | --ndjson [--since ID]] (--all | USERNAME...)",
+			description: "Write account backups as one JSON or NDJSON file per user",
+			run:         runBackup,
+		},
+		"verify-backup": {
+			usage:       "[--passphrase-file FILE] [--json] FILE",
+			description: "Check a JSON, encrypted or NDJSON backup against its manifest and signature without restoring it",
+			run:         runVerifyBackup,
+		},
+		"node-backup": {
+			usage:       "[--out FILE]",
+			description: "Write the whole node (database tables at one consistency point, message shards, keys, certificates, configuration and DHT storage) to one archive",
+			run:         runNodeBackup,
+		},
+		"node-restore": {
+			usage:       "[--force] FILE",
+			description: "Rebuild a node from a node-backup archive, then reindex its messages",
+			run:         runNodeRestore,
+		},
+		"node-ca": {
+			usage:       "(init | issue | rotate | revoke | list) [--dir DIR] [--days N] [--revoke-previous] [NAME [HOST...] | SERIAL]",
+			description: "Run the CA of node-to-node mutual TLS (NODE_MTLS): issue, rotate and revoke node certificates",
+			run:         runNodeCA,
+		},
+		"user": {
+			usage:       "(disable [--reason TEXT] | enable) USERNAME",
+			description: "Disable an account and revoke its tokens, or re-enable it",
+			run:         runUser,
+		},
+		"encrypt-contacts": {
+			description: "Encrypt plaintext contacts files with the node master key",
+			run: func(cfg *config.Config, args []string) {
+				runEncryptContacts(cfg)
+			},
+		},
+		"rewrap-keys": {
+			description: "Re-wrap per-file data keys after a master key rotation",
+			run: func(cfg *config.Config, args []string) {
+				runRewrapKeys(cfg)
+			},
+		},
+		"import-contacts": {
+			description: "Move contacts files into the database",
+			run: func(cfg *config.Config, args []string) {
+				runImportContacts(cfg)
+			},
+		},
+		"doctor": {
+			usage:       "[--json]",
+			description: "Check the database, storage, DHT bootstrap nodes, certificates, clock and configuration",
+			run:         runDoctor,
+		},
+		"bench": {
+			usage:       "[--run REGEXP] [--json]",
+			description: "Run micro-benchmarks of the hot paths (shard hashing, message store writes and reads, DHT routing table) in temporary folders",
+			run:         runBench,
+		},
+		"loadtest": {
+			usage:       "[--url URL] [--users N] [--duration D] [--rate R] [--fetch-ratio F] [--size BYTES] [--insecure] [--keep] [--json]",
+			description: "Simulate users sending and fetching messages against a running node and report latency percentiles",
+			run:         runLoadTest,
+		},
+		"reindex-messages": {
+			description: "Rebuild the message metadata index from the message store",
+			run: func(cfg *config.Config, args []string) {
+				runReindexMessages(cfg)
+			},
+		},
+	}
+}
+
+// usage prints the global flags and the subcommands
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [serve | COMMAND [ARGS]]\n\nFlags:\n", filepath.Base(os.Args[0]))
+	flag.PrintDefaults()
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(out, "\nCommands:\n  serve\n    \tServe the node (default)\n")
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s %s\n    \t%s\n", name, commands[name].usage, commands[name].description)
+	}
+}
+
+// runCommand runs the named subcommand, exiting with status 2 on an unknown one
+func runCommand(cfg *config.Config, name string, args []string) {
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(flag.CommandLine.Output(), "Unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+	cmd.run(cfg, args)
+}
+
+// commandFlags returns the flag set of a subcommand; its usage shows the command's arguments
+func commandFlags(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s %s\n", filepath.Base(os.Args[0]), name, commands[name].usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// runRebalanceShards moves message folders named for a previous shard count. Run it while
+// the node is stopped; a running node does the same through the admin "rebalance" job.
+func runRebalanceShards(cfg *config.Config) {
+	keyRing, err := initializeKeyRing(cfg)
+	if err != nil {
+		log.Fatalf("❌ At-rest encryption initialization failed: %v", err)
+	}
+	if keyRing != nil {
+		defer keyRing.Destroy()
+	}
+
+	fileStore := fileMessageStore(initializeMessageStore(cfg, keyRing, nil))
+	if fileStore == nil {
+		log.Fatalf("❌ Only the file storage backend keeps messages in shard folders")
+	}
+
+	report := fileStore.Rebalance()
+	if report.Errors > 0 {
+		log.Fatalf("❌ Rebalanced %d folders with %d errors, moved %d messages", report.Folders, report.Errors, report.Moved)
+	}
+	log.Printf("✅ Rebalanced %d folders, moved %d messages in %s", report.Folders, report.Moved, report.Duration.Round(time.Millisecond))
+}
+
+// runRehashSalt finishes a confusion salt rotation, like the admin "rehash" job. The node
+// can keep serving meanwhile, since messages are found under both salts until moved.
+func runRehashSalt(cfg *config.Config) {
+	if config.PreviousConfusionSalt == "" || config.PreviousConfusionSalt == config.ConfusionSalt {
+		log.Fatalf("❌ Set PREVIOUS_CONFUSION_SALT to the salt being rotated away from")
+	}
+
+	keyRing, err := initializeKeyRing(cfg)
+	if err != nil {
+		log.Fatalf("❌ At-rest encryption initialization failed: %v", err)
+	}
+	if keyRing != nil {
+		defer keyRing.Destroy()
+	}
+	if err := models.ConnectDB(); err != nil {
+		log.Fatalf("❌ Database connection failed: %v", err)
+	}
+
+	messageStore := initializeMessageStore(cfg, keyRing, nil)
+	if tiered, ok := messageStore.(*storage.TieredMessageStore); ok {
+		defer tiered.Stop()
+	}
+	handlers.SetMessageStore(messageStore)
+	handlers.SetContactStore(initializeContactStore(cfg, messageStore, keyRing))
+
+	report, err := handlers.RunSaltRotation(context.Background())
+	if err != nil {
+		log.Fatalf("❌ Salt rotation failed: %v", err)
+	}
+	if report.Errors > 0 {
+		log.Fatalf("❌ Rehashed %d keys with %d errors, moved %d messages; run it again", report.Keys, report.Errors, report.Moved)
+	}
+	log.Printf("✅ Rehashed %d keys, moved %d messages, %d index entries and %d contacts files in %s; PREVIOUS_CONFUSION_SALT can be removed",
+		report.Keys, report.Moved, report.Indexed, report.Contacts, report.Duration.Round(time.Millisecond))
+}
+
+// runBackup writes the backup of the given users, or of every user with --all, to
+// <out>/<username>.json. With --passphrase-file the backups are encrypted with the
+// passphrase in that file, as with the backup_account endpoint. With --ndjson they are
+// streamed to <out>/<username>.ndjson as by backup_account/stream, for large accounts;
+// --since then exports only the changes after the backup with that ID.
+func runBackup(cfg *config.Config, args []string) {
+	flags := commandFlags("backup")
+	all := flags.Bool("all", false, "Back up every account")
+	out := flags.String("out", "", "Output directory (default <data-dir>/backups/<time>)")
+	passphraseFile := flags.String("passphrase-file", "", "File holding the passphrase encrypting the backups")
+	ndjson := flags.Bool("ndjson", false, "Stream plaintext backups as NDJSON without holding them in memory")
+	since := flags.Int64("since", 0, "With --ndjson, export only the changes after the backup with this ID")
+	flags.Parse(args)
+
+	usernames := flags.Args()
+	if *all == (len(usernames) > 0) || (*ndjson && *passphraseFile != "") || (*since != 0 && (!*ndjson || *all || len(usernames) != 1)) {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	passphrase := ""
+	if *passphraseFile != "" {
+		var err error
+		if passphrase, err = secrets.ReadSecretFile(*passphraseFile); err != nil {
+			log.Fatalf("❌ Backup passphrase: %v", err)
+		}
+	}
+	if *out == "" {
+		*out = filepath.Join(config.DataDir, "backups", time.Now().UTC().Format("20060102-150405"))
+	}
+	if err := os.MkdirAll(*out, 0700); err != nil {
+		log.Fatalf("❌ Failed to create backup directory: %v", err)
+	}
+
+	keyRing, err := initializeKeyRing(cfg)
+	if err != nil {
+		log.Fatalf("❌ At-rest encryption initialization failed: %v", err)
+	}
+	if keyRing != nil {
+		defer keyRing.Destroy()
+	}
+	if err := models.ConnectDB(); err != nil {
+		log.Fatalf("❌ Database connection failed: %v", err)
+	}
+
+	messageStore := initializeMessageStore(cfg, keyRing, nil)
+	if tiered, ok := messageStore.(*storage.TieredMessageStore); ok {
+		defer tiered.Stop()
+	}
+	handlers.SetMessageStore(messageStore)
+	handlers.SetContactStore(initializeContactStore(cfg, messageStore, keyRing))
+	initializeBackupSigningKey(cfg)
+
+	ctx := context.Background()
+	if *all {
+		users, err := models.ListUsers(ctx)
+		if err != nil {
+			log.Fatalf("❌ Failed to list users: %v", err)
+		}
+		for _, user := range users {
+			usernames = append(usernames, user.Username)
+		}
+	}
+
+	failed := 0
+	for _, username := range usernames {
+		var err error
+		if *ndjson {
+			err = writeBackupStream(ctx, *out, username, *since)
+		} else {
+			err = writeBackup(ctx, *out, username, passphrase)
+		}
+		if err != nil {
+			log.Printf("❌ Backup of %s failed: %v", username, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("❌ %d of %d backups failed", failed, len(usernames))
+	}
+	log.Printf("✅ Backed up %d accounts to %s", len(usernames), *out)
+}
+
+// writeBackup writes one account's backup; the file is only created once it is complete
+func writeBackup(ctx context.Context, dir, username, passphrase string) error {
+	backup, err := handlers.CreateBackup(ctx, username, passphrase)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(backup)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, username+".json")
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// runVerifyBackup checks a backup file like POST /backup_account/verify and exits with
+// status 1 when it is invalid. The node's signing key is only read, to tell whether the
+// backup was signed by this node.
+func runVerifyBackup(cfg *config.Config, args []string) {
+	flags := commandFlags("verify-backup")
+	passphraseFile := flags.String("passphrase-file", "", "File holding the passphrase of an encrypted backup")
+	asJSON := flags.Bool("json", false, "Print the result as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	passphrase := ""
+	if *passphraseFile != "" {
+		var err error
+		if passphrase, err = secrets.ReadSecretFile(*passphraseFile); err != nil {
+			log.Fatalf("❌ Backup passphrase: %v", err)
+		}
+	}
+	if key, err := utils.LoadSigningKey(cfg.BackupSigningKeyFile); err == nil {
+		handlers.SetBackupSigningKey(key)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("⚠️ Backup signing key: %v", err)
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	defer file.Close()
+	result, err := handlers.VerifyBackupFile(file, passphrase)
+	if err != nil {
+		log.Fatalf("❌ %s: %v", flags.Arg(0), err)
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		for _, name := range result.Corrupted {
+			log.Printf("❌ %s: checksum mismatch", name)
+		}
+		for _, name := range result.Missing {
+			log.Printf("❌ %s: missing", name)
+		}
+		for _, name := range result.Unexpected {
+			log.Printf("❌ %s: not in the manifest", name)
+		}
+		for _, problem := range result.Problems {
+			log.Printf("❌ %s", problem)
+		}
+		if result.SignatureValid && !result.TrustedSigner {
+			log.Printf("⚠️ Signed by another node's key %s", result.SignerKey)
+		}
+		if result.Valid {
+			log.Printf("✅ %s backup of %s is intact: %d entries match the signed manifest", result.Format, result.Username, result.Entries)
+		}
+	}
+	if !result.Valid {
+		os.Exit(1)
+	}
+}
+
+// runDoctor runs the diagnostics of GET /api/admin/doctor and exits with status 1 when
+// one of them fails
+func runDoctor(cfg *config.Config, args []string) {
+	flags := commandFlags("doctor")
+	asJSON := flags.Bool("json", false, "Print the report as JSON")
+	flags.Parse(args)
+
+	// A database that is down is one of the findings, not a reason to stop
+	if err := models.ConnectDB(); err != nil {
+		log.Printf("⚠️ Database connection failed: %v", err)
+	}
+	keyRing, err := initializeKeyRing(cfg)
+	if err != nil {
+		log.Fatalf("❌ At-rest encryption initialization failed: %v", err)
+	}
+	if keyRing != nil {
+		defer keyRing.Destroy()
+	}
+	messageStore := initializeMessageStore(cfg, keyRing, nil)
+	if tiered, ok := messageStore.(*storage.TieredMessageStore); ok {
+		defer tiered.Stop()
+	}
+
+	report := doctor.Run(context.Background(), doctorChecks(cfg, config.LoadDHTConfig(), messageStore))
+	if *asJSON {
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		for _, result := range report.Results {
+			switch result.Status {
+			case doctor.StatusPass:
+				log.Printf("✅ %s: %s", result.Name, result.Message)
+			case doctor.StatusWarn:
+				log.Printf("⚠️ %s: %s", result.Name, result.Message)
+			default:
+				log.Printf("❌ %s: %s", result.Name, result.Message)
+			}
+		}
+	}
+	if report.Status == doctor.StatusFail {
+		os.Exit(1)
+	}
+}
+
+// doctorChecks lists the diagnostics of the node: the database and its clock, every
+// shard folder (or the data directory for other backends), the DHT bootstrap nodes, the
+// certificates in use and the configuration
+func doctorChecks(cfg *config.Config, dhtConfig *config.DHTConfig, messageStore storage.MessageStore) []doctor.Check {
+	checks := []doctor.Check{
+		doctor.Database(models.PingDB),
+		doctor.ClockSkew("database", models.DatabaseTime),
+	}
+
+	if fileStore := fileMessageStore(messageStore); fileStore != nil {
+		for i, dir := range fileStore.ShardDirs() {
+			checks = append(checks, doctor.Writable(fmt.Sprintf("storage_shard_%d", i), dir))
+		}
+	} else {
+		checks = append(checks, doctor.Writable("storage", config.DataDir))
+	}
+
+	// Bootstrap nodes with mutual TLS only answer nodes presenting their certificate
+	var nodeTLS *tls.Config
+	if cfg.NodeMTLS {
+		files := nodeca.NodeFiles(cfg.NodeTLSDir)
+		checks = append(checks, doctor.Certificate("node_certificate", files.Cert, false))
+		if identity, err := nodeca.Load(files); err == nil {
+			nodeTLS = identity.ClientConfig()
+		}
+	}
+	if cfg.EnableDHT {
+		checks = append(checks, doctor.Bootstrap(dhtConfig.BootstrapNodes, dhtConfig.UseSSL, nodeTLS))
+	}
+
+	switch {
+	case cfg.UseAutoCert:
+		checks = append(checks, doctor.AutocertCertificate(config.CertsDir, cfg.PublicDomain))
+	case cfg.UseTLS:
+		checks = append(checks, doctor.Certificate("tls_certificate", cfg.CertFile, false))
+	}
+	if cfg.DbSslCert != "" {
+		checks = append(checks, doctor.Certificate("db_client_certificate", cfg.DbSslCert, false))
+	}
+
+	checks = append(checks, doctor.Config(func() []config.Problem {
+		return cfg.Validate(dhtConfig)
+	}))
+	return checks
+}
+
+// writeBackupStream streams one account's backup, incremental if since is set, to a file
+// which is only created once it is complete
+func writeBackupStream(ctx context.Context, dir, username string, since int64) error {
+	write, err := handlers.OpenBackupStream(ctx, username, since)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, username+".ndjson")
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// runUser disables or re-enables an account, like the admin users endpoints
+func runUser(cfg *config.Config, args []string) {
+	flags := commandFlags("user")
+	if len(args) == 0 || (args[0] != "disable" && args[0] != "enable") {
+		flags.Usage()
+		os.Exit(2)
+	}
+	action := args[0]
+	reason := flags.String("reason", "", "Reason kept for operators (disable only)")
+	flags.Parse(args[1:])
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	username := flags.Arg(0)
+
+	if err := models.ConnectDB(); err != nil {
+		log.Fatalf("❌ Database connection failed: %v", err)
+	}
+
+	disabled := action == "disable"
+	err := models.SetUserDisabled(context.Background(), username, disabled, strings.TrimSpace(*reason))
+	if errors.Is(err, models.ErrUserNotFound) {
+		log.Fatalf("❌ User %s not found", username)
+	}
+	if err != nil {
+		log.Fatalf("❌ Failed to %s %s: %v", action, username, err)
+	}
+	if disabled {
+		log.Printf("✅ Disabled %s and revoked its tokens", username)
+	} else {
+		log.Printf("✅ Re-enabled %s", username)
+	}
+}
@@ -1,26 +1,63 @@
 package config
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"wave_capacitor/secrets"
 )
 
-// Constants for directories
-const (
-	DataDir     = "./data"
-	MessagesDir = "./data/messages"
-	ContactsDir = "./data/contacts"
-	KeysDir     = "./data/keys"
-	CertsDir    = "./data/certs"
-	ConfigDir   = "./data/config"
+// Data directories. They live below the data root and are updated by SetDataRoot.
+var (
+	DataDir       = "./data"
+	MessagesDir   = "./data/messages"
+	ContactsDir   = "./data/contacts"
+	KeysDir       = "./data/keys"
+	CertsDir      = "./data/certs"
+	ConfigDir     = "./data/config"
+	QuarantineDir = "./data/quarantine"
 )
 
-// ConfusionSalt is used for obfuscation during sharding
-const ConfusionSalt = "change_this_to_a_secure_random_value_in_production"
+// SetDataRoot moves all data directories below root. Relative roots are resolved
+// against the working directory so later chdirs can't redirect writes.
+func SetDataRoot(root string) error {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return fmt.Errorf("invalid data root %q: %v", root, err)
+	}
+
+	DataDir = abs
+	MessagesDir = filepath.Join(abs, "messages")
+	ContactsDir = filepath.Join(abs, "contacts")
+	KeysDir = filepath.Join(abs, "keys")
+	CertsDir = filepath.Join(abs, "certs")
+	ConfigDir = filepath.Join(abs, "config")
+	QuarantineDir = filepath.Join(abs, "quarantine")
+	return nil
+}
+
+// ConfusionSalt is used for obfuscation during sharding.
+// It can be overridden through the configured secrets provider (CONFUSION_SALT).
+var ConfusionSalt = defaultSecret
+
+// PreviousConfusionSalt is set (PREVIOUS_CONFUSION_SALT) while rotating the confusion salt:
+// messages and index entries are still found under it until the rehash job moved them
+var PreviousConfusionSalt = ""
+
+// defaultSecret is the placeholder JWT secret and confusion salt; Validate refuses it in production
+const defaultSecret = "change_this_to_a_secure_random_value_in_production"
 
 // Config holds all configuration options for the capacitor
 type Config struct {
+	// Environment profile (ENVIRONMENT) whose defaults apply to unset settings
+	Profile string
+
 	// Basic configuration
 	Port      string
 	NumShards int
@@ -35,72 +72,721 @@ type Config struct {
 	DbSslMode  string
 	DbHosts    string
 
+	// Database TLS; client certificates are re-read when they are rotated on disk
+	DbSslRootCert              string
+	DbSslCert                  string
+	DbSslKey                   string
+	DbCertCheckIntervalSeconds int
+
+	// Database pool and query timeouts
+	DbMaxOpenConns           int
+	DbMaxIdleConns           int
+	DbConnMaxLifetimeMinutes int
+	DbQueryTimeoutSeconds    int // 0 disables the per-query timeout
+	DbSlowQueryMs            int // 0 disables slow query logging
+
+	// Multi-region CockroachDB
+	DbRegion        string
+	DbFollowerReads bool
+
+	// Accounts looked up by username or public key are cached in process, up to
+	// USER_CACHE_SIZE of them (0 disables the cache) for USER_CACHE_TTL_SECONDS; changes
+	// made on other nodes or prefork processes are seen once the entries expire
+	UserCacheSize       int
+	UserCacheTTLSeconds int
+
+	// Updates that can wait, such as when accounts were last seen, are queued in process
+	// and written every DB_WRITE_BEHIND_MS in multi-row statements; beyond
+	// DB_WRITE_BEHIND_MAX_PENDING queued ones further are dropped until the queue drains
+	DbWriteBehindMs         int
+	DbWriteBehindMaxPending int
+
+	// Slow operation logging besides DB_SLOW_QUERY_MS; 0 disables a threshold
+	SlowRequestMs int // HTTP requests, logged with their route and status
+	SlowScanMs    int // message folder listings, logged with the folder and shard
+	SlowDHTMs     int // DHT lookups and the RPCs they make, logged with the target and peer
+
 	// Internet connectivity
 	PublicDomain string
 	UseTLS       bool
 	UseAutoCert  bool
 	CertFile     string
 	KeyFile      string
+	AcmeEmail    string // Contact address registered with Let's Encrypt
+	RedirectPort string // Plain HTTP port redirecting to HTTPS (and answering ACME challenges); empty disables it
+	TLSOffloaded bool   // TLS is terminated by a load balancer or proxy in front of the node
+
+	// HTTP server; timeouts of 0 disable them
+	HTTPReadTimeoutSeconds  int
+	HTTPWriteTimeoutSeconds int // covers whole responses, so keep it generous for backup downloads
+	HTTPIdleTimeoutSeconds  int // how long keep-alive connections wait for the next request
+	HTTPMaxBodyMB           int // largest request body read at all; the limits below tighten it per route group
+	HTTPKeepAlive           bool
+	HTTPPrefork             bool // one listening process per CPU; node-wide services run in the parent only
+	HTTP2Enabled            bool // h2 over TLS and h2c with prior knowledge, served through net/http
+
+	// Request body limits per route group
+	BodyLimitDefaultKB int // public, admin and shard transfer endpoints
+	BodyLimitUserKB    int // authenticated user endpoints (messages, prekeys, sessions)
+	BodyLimitBackupMB  int // account recovery
 
 	// DHT configuration
 	EnableDHT       bool
 	DhtPort         int
 	PublicAddress   string
 	BootstrapConfig string
+
+	// At-rest encryption
+	EncryptAtRest bool
+	MasterKey     string // Base64-encoded 32-byte key
+	MasterKeyFile string // Path to a file containing the base64-encoded key
+
+	// Per-file data keys wrapped by the master key
+	PerFileKeys       bool
+	PreviousMasterKey string // Base64-encoded retired master key, set while re-wrapping after rotation
+
+	// Key wrapping the private keys stored for accounts
+	PrivateKeyWrapKey         string // Base64-encoded 32-byte key
+	PreviousPrivateKeyWrapKey string // Base64-encoded retired wrap key, still accepted when unwrapping
+
+	// Secrets provider
+	SecretsProvider string // "env", "vault" or "awskms"
+	VaultAddr       string
+	VaultToken      string
+	VaultMount      string
+	VaultPath       string
+	AWSRegion       string
+
+	// Secret files (NAME_FILE or SECRETS_DIR) are re-read this often; 0 disables reloading
+	SecretsReloadIntervalSeconds int
+
+	// Storage backend
+	StorageBackend   string // "file", "s3" or "sqlite"
+	SQLitePath       string
+	S3Endpoint       string // Empty for AWS S3, e.g. http://minio:9000 for MinIO
+	S3Region         string
+	S3Bucket         string
+	S3Prefix         string
+	S3PathStyle      bool
+	S3BucketPerShard bool
+	S3AccessKey      string
+	S3SecretKey      string
+	Compression      string // "none", "gzip" or "zstd"
+
+	// Messages listed, backed up or exported are read this many at a time, and handed
+	// on in order; 1 reads them one after the other
+	MessageReadWorkers int
+
+	// Contacts storage
+	ContactsBackend string // "database", or "file" to keep them with the local storage backend
+
+	// Hot/cold storage tiering
+	ColdStorageBackend     string // Empty disables tiering; "s3" or "sqlite"
+	ColdAfterDays          int
+	TieringIntervalMinutes int
+
+	// Integrity scrubbing of message files
+	ScrubIntervalMinutes int // 0 disables the background scrubber
+
+	// Deletion of old messages
+	MessageRetentionDays     int // 0 keeps messages forever
+	RetentionIntervalMinutes int
+	ChangeLogRetentionDays   int // account changes and contact tombstones kept for incremental backups and sync; 0 keeps them forever
+
+	// Health checks behind /readyz and /livez
+	HealthCheckIntervalSeconds int
+	HealthCheckTimeoutSeconds  int
+	ReadinessFailureThreshold  int // consecutive failures before a component makes the node unready
+	LivenessFailureThreshold   int // consecutive failures before the node asks to be restarted; 0 disables
+
+	// Free disk space low-water mark; writes are refused below either limit (0 disables it)
+	MinFreeDiskMB      int
+	MinFreeDiskPercent int
+
+	// Shard transfer between capacitors
+	ShardTransferToken string // Empty disables the shard transfer endpoints
+
+	// Operator endpoints and read-only maintenance mode
+	AdminToken         string // Empty disables the admin endpoints
+	MaintenanceMode    bool   // Start in read-only maintenance mode
+	MaintenanceMessage string
+	DebugEndpoints     bool // Serve runtime stats and pprof profiles below /admin/debug
+
+	// API documentation
+	DocsUI bool // Serve Swagger UI at /api/v1/docs; /api/v1/openapi.json is always served
+
+	// Date after which the unversioned /api paths may be removed (HTTP date, sent as Sunset header)
+	LegacyAPISunset string
+
+	// Log output: "text" (standard log lines with key=value attributes) or "json", and the
+	// lowest level logged: "debug", "info", "warn" or "error"
+	LogFormat string
+	LogLevel  string
+
+	// Log file with rotation for nodes without a log shipper; empty logs to stderr
+	LogFile               string
+	LogMaxSizeMB          int // 0 rotates by time only
+	LogRotateHours        int // 0 rotates by size only
+	LogMaxBackups         int // rotated files kept; 0 keeps all
+	LogMaxAgeDays         int // rotated files older than this are deleted; 0 keeps them
+	LogMinFreeDiskMB      int // below this, debug and info lines are sampled; 0 disables it
+	LogLowDiskSampleEvery int // one in this many debug and info lines is kept while sampling
+
+	// Rate limiting; budgets are requests per window, 0 disables a budget
+	RateLimitEnabled       bool
+	RateLimitBackend       string // "memory" (per node) or "redis" (shared by all nodes)
+	RateLimitRedisAddr     string
+	RateLimitRedisPassword string
+	RateLimitWindowSeconds int
+	RateLimitGlobal        int // per client IP, all endpoints
+	RateLimitUser          int // per authenticated user
+	RateLimitAuth          int // per client IP on register, login and account recovery
+	RateLimitSend          int // per user on send_message
+
+	// Compression of large responses: "off", "speed", "default" or "best"
+	ResponseCompression string
+
+	// How long responses to requests with an Idempotency-Key are replayed; 0 disables it
+	IdempotencyTTLSeconds int
+
+	// Webhooks; WebhookURL receives every event of the node, signed with WebhookSecret
+	WebhooksEnabled             bool
+	WebhookURL                  string
+	WebhookSecret               string
+	WebhookAllowPrivateNetworks bool // let user webhooks reach private addresses
+	WebhookMaxPerUser           int
+	WebhookWorkers              int
+
+	// Tracing: spans are exported to an OTLP/HTTP collector, e.g. http://otel-collector:4318
+	TracingEndpoint      string // Empty disables tracing
+	TracingHeaders       string // "key1=value1,key2=value2" sent with every export, e.g. an API key
+	TracingServiceName   string
+	TracingSamplePercent int // Share of new traces recorded; traces from other nodes keep their decision
+
+	// Sentry-compatible DSN receiving recovered panics; empty only logs them
+	CrashReportDSN string
+
+	// Alerts on operational conditions; at least one notifier enables them
+	AlertWebhookURL      string // receives each alert as JSON
+	AlertSMTPAddr        string // host:port of the mail server
+	AlertSMTPUsername    string
+	AlertSMTPPassword    string
+	AlertSMTPFrom        string
+	AlertSMTPTo          string // comma-separated recipients
+	AlertStdout          bool   // write each alert as a JSON line to stdout
+	AlertIntervalSeconds int
+	AlertRepeatMinutes   int // firing alerts are sent again this often; 0 sends them once
+	AlertDiskFreePercent int // free disk space below this fires "disk"
+	AlertWebhookQueue    int // queued webhook deliveries at or above this fire "webhook_queue"
+	AlertAuthFailures    int // rejected credentials per interval at or above this fire "auth_failures"; 0 disables it
+
+	// Scheduled snapshots of every account and the node's metadata
+	BackupSchedule string // cron-like, e.g. "0 3 * * *" or "@every 12h"; empty disables them
+	BackupTarget   string // comma-separated sinks, each taking every snapshot: file, s3, sftp, locker
+	BackupDir      string // file sink
+	BackupKeep     int    // snapshots retained per sink; 0 keeps all
+
+	// S3 sink; bucket, prefix and credentials default to the S3_* settings
+	BackupS3Bucket    string
+	BackupS3Prefix    string
+	BackupS3AccessKey string
+	BackupS3SecretKey string
+
+	// SFTP sink
+	BackupSFTPAddr     string // host:port
+	BackupSFTPUser     string
+	BackupSFTPPassword string
+	BackupSFTPKeyFile  string // SSH private key, used instead of or with the password
+	BackupSFTPHostKey  string // the server's key in authorized_keys format, e.g. "ssh-ed25519 AAAA..."
+	BackupSFTPDir      string
+
+	// Locker sink, on the locker nodes found through the DHT
+	BackupLockerToken string // bearer token of the lockers' blob API
+
+	// Per-sink encryption: base64-encoded 32-byte keys; a sink without one receives
+	// plaintext snapshots
+	BackupFileEncryptionKey   string
+	BackupS3EncryptionKey     string
+	BackupSFTPEncryptionKey   string
+	BackupLockerEncryptionKey string
+
+	// Ed25519 key (PKCS #8 PEM) signing backup manifests, created on first use
+	BackupSigningKeyFile string
+
+	// Backups users encrypt on their devices and store on the node, each at most
+	// BODY_LIMIT_BACKUP_MB; 0 per user disables them
+	StoredBackupDir        string
+	StoredBackupMaxPerUser int
+
+	// Per-user blocklists; messages from blocked senders are dropped, answering as if they
+	// were delivered, or rejected with 403
+	BlockedMessages     string // "drop" or "reject"
+	BlocklistMaxPerUser int
+
+	// Mutual-contact discovery through the DHT; records users publish last
+	// DISCOVERY_TTL_HOURS, at most a week, unless looked up again
+	DiscoveryEnabled  bool
+	DiscoveryTTLHours int
+
+	// Route records naming this capacitor as the home of its accounts' public keys,
+	// published to the DHT for ROUTE_TTL_HOURS (at most a week) and republished halfway;
+	// routes found in the DHT are reused for ROUTE_CACHE_SECONDS
+	RouteTTLHours     int
+	RouteCacheSeconds int
+
+	// Domain the accounts hosted here are addressed under as user@domain, besides the
+	// capacitor's address; other capacitors find this one through the record published to
+	// the DHT when DNS points the domain at this capacitor, or through
+	// https://<domain>/.well-known/wave-capacitor, which this capacitor serves
+	HandleDomain string
+
+	// Forwarding messages to the capacitors hosting their recipients, and accepting the
+	// messages other capacitors forward, through POST /federation/deliver. Other
+	// capacitors are reached over HTTPS; FEDERATION_PLAIN_HTTP allows plain HTTP, outside
+	// production only.
+	FederationEnabled   bool
+	FederationPlainHTTP bool
+
+	// Messages for capacitors that can't be reached are queued in FEDERATION_QUEUE_DIR and
+	// forwarded once they can be, or dropped after FEDERATION_QUEUE_MAX_AGE_HOURS; with the
+	// queue off the sender gets a 502 instead. A capacitor with FEDERATION_QUEUE_MAX_DEPTH
+	// messages or FEDERATION_QUEUE_MAX_MB queued gets no more until some are sent, and their
+	// senders a 502; 0 leaves either unbounded.
+	FederationQueue            bool
+	FederationQueueDir         string
+	FederationQueueMaxAgeHours int
+	FederationQueueMaxDepth    int
+	FederationQueueMaxMB       int
+
+	// Mutual TLS between nodes: the DHT server and the node endpoints (federation, replicas,
+	// internal lookups and shard transfers) require a certificate of the node CA, which
+	// this node presents to the others too. NODE_TLS_DIR holds the node's certificate, key,
+	// the CA and the revocation list, as the node-ca command issues them.
+	NodeMTLS   bool
+	NodeTLSDir string
+
+	// Backup signing keys (base64 Ed25519, comma-separated) of the capacitors trusted with
+	// the node endpoints and the route records in the DHT; with NODE_MTLS a certificate of
+	// the node CA is trusted as well. Without either, other capacitors are refused.
+	NodeAllowlist string
+
+	// Connections to other nodes, shared by DHT lookups, federation, replication, presence
+	// and the lockers: idle connections kept to each peer, dial, TLS handshake and idle
+	// timeouts, and how many requests run at once against one peer (0 is unlimited)
+	NodeHTTPIdleConnsPerPeer   int
+	NodeHTTPDialTimeoutSeconds int
+	NodeHTTPTLSTimeoutSeconds  int
+	NodeHTTPIdleTimeoutSeconds int
+	NodeHTTPPeerConcurrency    int
+
+	// Mailbox replication: each mailbox hosted here is copied to MAILBOX_REPLICAS peer
+	// capacitors, the MAILBOX_REPLICA_PEERS (comma-separated host:port) or else the closest
+	// ones in the DHT, and reconciled with them every REPLICA_RECONCILE_HOURS (0 only
+	// through the admin job). MAILBOX_REPLICA_ACCEPT keeps replicas other capacitors send.
+	// Every REPLICA_ANTI_ENTROPY_MINUTES (0 only through the admin job) the Merkle digests
+	// of the mailboxes are compared with those of their replicas, repairing the replicas
+	// that diverged without listing the ones in sync.
+	MailboxReplicas           int
+	MailboxReplicaPeers       string
+	MailboxReplicaAccept      bool
+	ReplicaReconcileHours     int
+	ReplicaAntiEntropyMinutes int
+
+	// Capacitors sharing a database elect a leader to run the scheduled jobs acting on what
+	// they share, through a lease in the database renewed every third of LEADER_LEASE_SECONDS
+	LeaderElection     bool
+	LeaderLeaseSeconds int
+
+	// Presence: a heartbeat keeps a user's device online for PRESENCE_TIMEOUT_SECONDS, and
+	// the capacitors hosting the user's contacts are told when the user comes and goes.
+	// Presence is kept in the memory of the process the user's requests reach.
+	PresenceEnabled        bool
+	PresenceTimeoutSeconds int
+
+	// Message ciphertexts of at least LOCKER_OFFLOAD_KB are stored on the locker nodes
+	// found through the DHT, keeping only a pointer locally; 0 keeps every message local
+	LockerOffloadKB     int
+	LockerOffloadToken  string // bearer token of the lockers' blob API
+	LockerOffloadCopies int    // lockers each offloaded message is stored on, at least 2
+
+	// Lockers receive their bearer token, so only trusted ones are used: with node mutual
+	// TLS over HTTPS those presenting a certificate of the node CA, and the lockers at the
+	// comma-separated host:port addresses of LOCKER_ALLOWLIST
+	LockerAllowlist string
+
+	// Anonymous usage statistics (version, platform, bucketed throughput and DHT size);
+	// off unless an endpoint is set
+	TelemetryEndpoint      string
+	TelemetryIntervalHours int
+
+	// Where each setting came from, see Effective
+	settings *settingsLog
 }
 
 // LoadConfig sets environment variables for the DB connection, API port, and sharding configuration.
 // You can override these variables when deploying.
 func LoadConfig() *Config {
+	loading = newSettingsLog()
+	profileSource := SourceDefault
+	if os.Getenv("ENVIRONMENT") != "" {
+		profileSource = SourceEnv
+	}
+	loading.record("ENVIRONMENT", Profile(), profileSource, false)
+
+	// The data root comes first, other path defaults are derived from it
+	if err := SetDataRoot(getEnvOrDefault("DATA_DIR", "./data")); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
 	cfg := &Config{
+		Profile:  Profile(),
+		settings: loading,
+
 		// Basic configuration
 		Port:      getEnvOrDefault("PORT", "8080"),
 		NumShards: getEnvAsIntOrDefault("NUM_SHARDS", 1),
-		JwtSecret: getEnvOrDefault("JWT_SECRET", "change_this_to_a_secure_random_value_in_production"),
+		JwtSecret: getSecretOrDefault("JWT_SECRET", defaultSecret),
 
 		// Database configuration
 		DbHost:     getEnvOrDefault("DB_HOST", "cockroachdb"),
 		DbPort:     getEnvOrDefault("DB_PORT", "26257"),
 		DbUser:     getEnvOrDefault("DB_USER", "root"),
-		DbPassword: getEnvOrDefault("DB_PASSWORD", ""),
+		DbPassword: getSecretOrDefault("DB_PASSWORD", ""),
 		DbName:     getEnvOrDefault("DB_NAME", "defaultdb"),
 		DbSslMode:  getEnvOrDefault("DB_SSLMODE", "disable"),
 		DbHosts:    getEnvOrDefault("DB_HOSTS", ""),
 
+		// Database TLS
+		DbSslRootCert:              getEnvOrDefault("DB_SSLROOTCERT", ""),
+		DbSslCert:                  getEnvOrDefault("DB_SSLCERT", ""),
+		DbSslKey:                   getEnvOrDefault("DB_SSLKEY", ""),
+		DbCertCheckIntervalSeconds: getEnvAsIntOrDefault("DB_CERT_CHECK_INTERVAL_SECONDS", 60),
+
+		// Database pool and query timeouts
+		DbMaxOpenConns:           getEnvAsIntOrDefault("DB_MAX_OPEN_CONNS", 25),
+		DbMaxIdleConns:           getEnvAsIntOrDefault("DB_MAX_IDLE_CONNS", 10),
+		DbConnMaxLifetimeMinutes: getEnvAsIntOrDefault("DB_CONN_MAX_LIFETIME_MINUTES", 30),
+		DbQueryTimeoutSeconds:    getEnvAsIntOrDefault("DB_QUERY_TIMEOUT_SECONDS", 5),
+		DbSlowQueryMs:            getEnvAsIntOrDefault("DB_SLOW_QUERY_MS", 500),
+
+		// Multi-region CockroachDB
+		DbRegion:        getEnvOrDefault("DB_REGION", ""),
+		DbFollowerReads: getEnvAsBoolOrDefault("DB_FOLLOWER_READS", false),
+
+		// User cache
+		UserCacheSize:       getEnvAsIntOrDefault("USER_CACHE_SIZE", 10000),
+		UserCacheTTLSeconds: getEnvAsIntOrDefault("USER_CACHE_TTL_SECONDS", 30),
+
+		DbWriteBehindMs:         getEnvAsIntOrDefault("DB_WRITE_BEHIND_MS", 5000),
+		DbWriteBehindMaxPending: getEnvAsIntOrDefault("DB_WRITE_BEHIND_MAX_PENDING", 100000),
+
+		// Slow operation logging
+		SlowRequestMs: getEnvAsIntOrDefault("SLOW_REQUEST_MS", 2000),
+		SlowScanMs:    getEnvAsIntOrDefault("SLOW_SCAN_MS", 200),
+		SlowDHTMs:     getEnvAsIntOrDefault("SLOW_DHT_MS", 2000),
+
 		// Internet connectivity
 		PublicDomain: getEnvOrDefault("PUBLIC_DOMAIN", ""),
 		UseTLS:       getEnvAsBoolOrDefault("USE_TLS", false),
 		UseAutoCert:  getEnvAsBoolOrDefault("USE_AUTOCERT", false),
 		CertFile:     getEnvOrDefault("CERT_FILE", ""),
 		KeyFile:      getEnvOrDefault("KEY_FILE", ""),
+		AcmeEmail:    getEnvOrDefault("ACME_EMAIL", ""),
+		RedirectPort: getEnvOrDefault("HTTP_REDIRECT_PORT", "80"),
+		TLSOffloaded: getEnvAsBoolOrDefault("TLS_OFFLOADED", false),
+
+		// HTTP server
+		HTTPReadTimeoutSeconds:  getEnvAsIntOrDefault("HTTP_READ_TIMEOUT_SECONDS", 30),
+		HTTPWriteTimeoutSeconds: getEnvAsIntOrDefault("HTTP_WRITE_TIMEOUT_SECONDS", 0),
+		HTTPIdleTimeoutSeconds:  getEnvAsIntOrDefault("HTTP_IDLE_TIMEOUT_SECONDS", 120),
+		HTTPMaxBodyMB:           getEnvAsIntOrDefault("HTTP_MAX_BODY_MB", 64),
+		HTTPKeepAlive:           getEnvAsBoolOrDefault("HTTP_KEEP_ALIVE", true),
+		HTTPPrefork:             getEnvAsBoolOrDefault("HTTP_PREFORK", false),
+		HTTP2Enabled:            getEnvAsBoolOrDefault("HTTP2_ENABLED", false),
+
+		// Request body limits per route group
+		BodyLimitDefaultKB: getEnvAsIntOrDefault("BODY_LIMIT_DEFAULT_KB", 64),
+		BodyLimitUserKB:    getEnvAsIntOrDefault("BODY_LIMIT_USER_KB", 1024),
+		BodyLimitBackupMB:  getEnvAsIntOrDefault("BODY_LIMIT_BACKUP_MB", 32),
 
 		// DHT configuration
 		EnableDHT:       getEnvAsBoolOrDefault("ENABLE_DHT", true),
 		DhtPort:         getEnvAsIntOrDefault("DHT_PORT", 4001),
 		PublicAddress:   getEnvOrDefault("PUBLIC_ADDRESS", ""),
-		BootstrapConfig: getEnvOrDefault("BOOTSTRAP_CONFIG", ConfigDir+"/bootstrap.json"),
+		BootstrapConfig: getEnvOrDefault("BOOTSTRAP_CONFIG", filepath.Join(ConfigDir, "bootstrap.json")),
+
+		// At-rest encryption
+		EncryptAtRest: getEnvAsBoolOrDefault("ENCRYPT_AT_REST", false),
+		MasterKey:     getSecretOrDefault("NODE_MASTER_KEY", ""),
+		MasterKeyFile: getEnvOrDefault("NODE_MASTER_KEY_FILE", ""),
+
+		// Per-file data keys wrapped by the master key
+		PerFileKeys:       getEnvAsBoolOrDefault("PER_FILE_KEYS", false),
+		PreviousMasterKey: getSecretOrDefault("NODE_PREVIOUS_MASTER_KEY", ""),
+
+		// Key wrapping the private keys stored for accounts
+		PrivateKeyWrapKey:         getSecretOrDefault("PRIVATE_KEY_WRAP_KEY", ""),
+		PreviousPrivateKeyWrapKey: getSecretOrDefault("PREVIOUS_PRIVATE_KEY_WRAP_KEY", ""),
+
+		// Secrets provider
+		SecretsProvider: getEnvOrDefault("SECRETS_PROVIDER", "env"),
+		VaultAddr:       getEnvOrDefault("VAULT_ADDR", ""),
+		VaultToken:      getSecretOrDefault("VAULT_TOKEN", ""),
+		VaultMount:      getEnvOrDefault("VAULT_MOUNT", "secret"),
+		VaultPath:       getEnvOrDefault("VAULT_PATH", "wave-capacitor"),
+		AWSRegion:       getEnvOrDefault("AWS_REGION", ""),
+
+		// Secret files
+		SecretsReloadIntervalSeconds: getEnvAsIntOrDefault("SECRETS_RELOAD_INTERVAL_SECONDS", 30),
+
+		// Storage backend
+		StorageBackend:   getEnvOrDefault("STORAGE_BACKEND", "file"),
+		SQLitePath:       getEnvOrDefault("SQLITE_PATH", filepath.Join(DataDir, "wave.db")),
+		S3Endpoint:       getEnvOrDefault("S3_ENDPOINT", ""),
+		S3Region:         getEnvOrDefault("S3_REGION", getEnvOrDefault("AWS_REGION", "us-east-1")),
+		S3Bucket:         getEnvOrDefault("S3_BUCKET", "wave-capacitor"),
+		S3Prefix:         getEnvOrDefault("S3_PREFIX", ""),
+		S3PathStyle:      getEnvAsBoolOrDefault("S3_PATH_STYLE", false),
+		S3BucketPerShard: getEnvAsBoolOrDefault("S3_BUCKET_PER_SHARD", false),
+		S3AccessKey:      getSecretOrDefault("S3_ACCESS_KEY", ""),
+		S3SecretKey:      getSecretOrDefault("S3_SECRET_KEY", ""),
+		Compression:      getEnvOrDefault("STORAGE_COMPRESSION", "none"),
+
+		// Contacts storage
+		ContactsBackend: getEnvOrDefault("CONTACTS_BACKEND", "database"),
+
+		// Parallel message reads
+		MessageReadWorkers: getEnvAsIntOrDefault("MESSAGE_READ_WORKERS", 8),
+
+		// Hot/cold storage tiering
+		ColdStorageBackend:     getEnvOrDefault("COLD_STORAGE_BACKEND", ""),
+		ColdAfterDays:          getEnvAsIntOrDefault("COLD_AFTER_DAYS", 30),
+		TieringIntervalMinutes: getEnvAsIntOrDefault("TIERING_INTERVAL_MINUTES", 60),
+
+		// Integrity scrubbing of message files
+		ScrubIntervalMinutes: getEnvAsIntOrDefault("SCRUB_INTERVAL_MINUTES", 360),
+
+		// Deletion of old messages
+		MessageRetentionDays:     getEnvAsIntOrDefault("MESSAGE_RETENTION_DAYS", 0),
+		RetentionIntervalMinutes: getEnvAsIntOrDefault("RETENTION_INTERVAL_MINUTES", 60),
+		ChangeLogRetentionDays:   getEnvAsIntOrDefault("CHANGE_LOG_RETENTION_DAYS", 90),
+
+		// Health checks behind /readyz and /livez
+		HealthCheckIntervalSeconds: getEnvAsIntOrDefault("HEALTH_CHECK_INTERVAL_SECONDS", 10),
+		HealthCheckTimeoutSeconds:  getEnvAsIntOrDefault("HEALTH_CHECK_TIMEOUT_SECONDS", 3),
+		ReadinessFailureThreshold:  getEnvAsIntOrDefault("READINESS_FAILURE_THRESHOLD", 3),
+		LivenessFailureThreshold:   getEnvAsIntOrDefault("LIVENESS_FAILURE_THRESHOLD", 0),
+
+		// Free disk space low-water mark
+		MinFreeDiskMB:      getEnvAsIntOrDefault("MIN_FREE_DISK_MB", 512),
+		MinFreeDiskPercent: getEnvAsIntOrDefault("MIN_FREE_DISK_PERCENT", 2),
+
+		// Shard transfer between capacitors
+		ShardTransferToken: getSecretOrDefault("SHARD_TRANSFER_TOKEN", ""),
+
+		// Operator endpoints and read-only maintenance mode
+		AdminToken:         getSecretOrDefault("ADMIN_TOKEN", ""),
+		MaintenanceMode:    getEnvAsBoolOrDefault("MAINTENANCE_MODE", false),
+		MaintenanceMessage: getEnvOrDefault("MAINTENANCE_MESSAGE", ""),
+		DebugEndpoints:     getEnvAsBoolOrDefault("DEBUG_ENDPOINTS", false),
+
+		// API documentation
+		DocsUI: getEnvAsBoolOrDefault("DOCS_UI", false),
+
+		// API versioning
+		LegacyAPISunset: getEnvOrDefault("LEGACY_API_SUNSET", ""),
+
+		LogFormat: getEnvOrDefault("LOG_FORMAT", "text"),
+		LogLevel:  getEnvOrDefault("LOG_LEVEL", "info"),
+
+		// Log file
+		LogFile:               getEnvOrDefault("LOG_FILE", ""),
+		LogMaxSizeMB:          getEnvAsIntOrDefault("LOG_MAX_SIZE_MB", 100),
+		LogRotateHours:        getEnvAsIntOrDefault("LOG_ROTATE_HOURS", 24),
+		LogMaxBackups:         getEnvAsIntOrDefault("LOG_MAX_BACKUPS", 14),
+		LogMaxAgeDays:         getEnvAsIntOrDefault("LOG_MAX_AGE_DAYS", 30),
+		LogMinFreeDiskMB:      getEnvAsIntOrDefault("LOG_MIN_FREE_DISK_MB", 512),
+		LogLowDiskSampleEvery: getEnvAsIntOrDefault("LOG_LOW_DISK_SAMPLE_EVERY", 100),
+
+		// Rate limiting
+		RateLimitEnabled:       getEnvAsBoolOrDefault("RATE_LIMIT_ENABLED", true),
+		RateLimitBackend:       getEnvOrDefault("RATE_LIMIT_BACKEND", "memory"),
+		RateLimitRedisAddr:     getEnvOrDefault("RATE_LIMIT_REDIS_ADDR", "localhost:6379"),
+		RateLimitRedisPassword: getSecretOrDefault("RATE_LIMIT_REDIS_PASSWORD", ""),
+		RateLimitWindowSeconds: getEnvAsIntOrDefault("RATE_LIMIT_WINDOW_SECONDS", 60),
+		RateLimitGlobal:        getEnvAsIntOrDefault("RATE_LIMIT_GLOBAL", 300),
+		RateLimitUser:          getEnvAsIntOrDefault("RATE_LIMIT_USER", 600),
+		RateLimitAuth:          getEnvAsIntOrDefault("RATE_LIMIT_AUTH", 10),
+		RateLimitSend:          getEnvAsIntOrDefault("RATE_LIMIT_SEND", 60),
+
+		// Ciphertext compresses little beyond its base64 overhead, so favour speed
+		ResponseCompression: getEnvOrDefault("RESPONSE_COMPRESSION", "speed"),
+
+		// Retries of flaky mobile connections arrive within minutes; the replayed bodies
+		// can hold tokens, so they are not kept much longer than that
+		IdempotencyTTLSeconds: getEnvAsIntOrDefault("IDEMPOTENCY_TTL_SECONDS", 3600),
+
+		// Webhooks
+		WebhooksEnabled:             getEnvAsBoolOrDefault("WEBHOOKS_ENABLED", true),
+		WebhookURL:                  getEnvOrDefault("WEBHOOK_URL", ""),
+		WebhookSecret:               getSecretOrDefault("WEBHOOK_SECRET", ""),
+		WebhookAllowPrivateNetworks: getEnvAsBoolOrDefault("WEBHOOK_ALLOW_PRIVATE_NETWORKS", false),
+		WebhookMaxPerUser:           getEnvAsIntOrDefault("WEBHOOK_MAX_PER_USER", 5),
+		WebhookWorkers:              getEnvAsIntOrDefault("WEBHOOK_WORKERS", 4),
+
+		// Tracing, named as the OpenTelemetry SDKs name them
+		TracingEndpoint:      getEnvOrDefault("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		TracingHeaders:       getSecretOrDefault("OTEL_EXPORTER_OTLP_HEADERS", ""),
+		TracingServiceName:   getEnvOrDefault("OTEL_SERVICE_NAME", "wave-capacitor"),
+		TracingSamplePercent: getEnvAsIntOrDefault("TRACING_SAMPLE_PERCENT", 100),
+
+		// Crash reporting; the DSN embeds the project's key
+		CrashReportDSN: getSecretOrDefault("CRASH_REPORT_DSN", ""),
+
+		// Alerting
+		AlertWebhookURL:      getEnvOrDefault("ALERT_WEBHOOK_URL", ""),
+		AlertSMTPAddr:        getEnvOrDefault("ALERT_SMTP_ADDR", ""),
+		AlertSMTPUsername:    getEnvOrDefault("ALERT_SMTP_USERNAME", ""),
+		AlertSMTPPassword:    getSecretOrDefault("ALERT_SMTP_PASSWORD", ""),
+		AlertSMTPFrom:        getEnvOrDefault("ALERT_SMTP_FROM", ""),
+		AlertSMTPTo:          getEnvOrDefault("ALERT_SMTP_TO", ""),
+		AlertStdout:          getEnvAsBoolOrDefault("ALERT_STDOUT", false),
+		AlertIntervalSeconds: getEnvAsIntOrDefault("ALERT_INTERVAL_SECONDS", 60),
+		AlertRepeatMinutes:   getEnvAsIntOrDefault("ALERT_REPEAT_MINUTES", 60),
+		AlertDiskFreePercent: getEnvAsIntOrDefault("ALERT_DISK_FREE_PERCENT", 10),
+		AlertWebhookQueue:    getEnvAsIntOrDefault("ALERT_WEBHOOK_QUEUE", 512),
+		AlertAuthFailures:    getEnvAsIntOrDefault("ALERT_AUTH_FAILURES", 100),
+
+		// Scheduled snapshots
+		BackupSchedule: getEnvOrDefault("BACKUP_SCHEDULE", ""),
+		BackupTarget:   getEnvOrDefault("BACKUP_TARGET", "file"),
+		BackupDir:      getEnvOrDefault("BACKUP_DIR", filepath.Join(DataDir, "snapshots")),
+		BackupKeep:     getEnvAsIntOrDefault("BACKUP_KEEP", 7),
+
+		BackupS3Bucket:    getEnvOrDefault("BACKUP_S3_BUCKET", getEnvOrDefault("S3_BUCKET", "wave-capacitor")),
+		BackupS3Prefix:    getEnvOrDefault("BACKUP_S3_PREFIX", getEnvOrDefault("S3_PREFIX", "")),
+		BackupS3AccessKey: getSecretOrDefault("BACKUP_S3_ACCESS_KEY", ""),
+		BackupS3SecretKey: getSecretOrDefault("BACKUP_S3_SECRET_KEY", ""),
+
+		BackupSFTPAddr:     getEnvOrDefault("BACKUP_SFTP_ADDR", ""),
+		BackupSFTPUser:     getEnvOrDefault("BACKUP_SFTP_USER", ""),
+		BackupSFTPPassword: getSecretOrDefault("BACKUP_SFTP_PASSWORD", ""),
+		BackupSFTPKeyFile:  getEnvOrDefault("BACKUP_SFTP_KEY_FILE", ""),
+		BackupSFTPHostKey:  getEnvOrDefault("BACKUP_SFTP_HOST_KEY", ""),
+		BackupSFTPDir:      getEnvOrDefault("BACKUP_SFTP_DIR", "snapshots"),
+
+		BackupLockerToken: getSecretOrDefault("BACKUP_LOCKER_TOKEN", ""),
+
+		BackupFileEncryptionKey:   getSecretOrDefault("BACKUP_FILE_ENCRYPTION_KEY", ""),
+		BackupS3EncryptionKey:     getSecretOrDefault("BACKUP_S3_ENCRYPTION_KEY", ""),
+		BackupSFTPEncryptionKey:   getSecretOrDefault("BACKUP_SFTP_ENCRYPTION_KEY", ""),
+		BackupLockerEncryptionKey: getSecretOrDefault("BACKUP_LOCKER_ENCRYPTION_KEY", ""),
+
+		BackupSigningKeyFile: getEnvOrDefault("BACKUP_SIGNING_KEY_FILE", filepath.Join(KeysDir, "backup_signing.pem")),
+
+		// Stored client-encrypted backups
+		StoredBackupDir:        getEnvOrDefault("STORED_BACKUP_DIR", filepath.Join(DataDir, "stored_backups")),
+		StoredBackupMaxPerUser: getEnvAsIntOrDefault("STORED_BACKUP_MAX_PER_USER", 3),
+
+		// Blocklists
+		BlockedMessages:     getEnvOrDefault("BLOCKED_MESSAGES", "drop"),
+		BlocklistMaxPerUser: getEnvAsIntOrDefault("BLOCKLIST_MAX_PER_USER", 1000),
+
+		// Contact discovery
+		DiscoveryEnabled:  getEnvAsBoolOrDefault("DISCOVERY_ENABLED", true),
+		DiscoveryTTLHours: getEnvAsIntOrDefault("DISCOVERY_TTL_HOURS", 168),
+
+		// Cross-node routing
+		RouteTTLHours:     getEnvAsIntOrDefault("ROUTE_TTL_HOURS", 24),
+		RouteCacheSeconds: getEnvAsIntOrDefault("ROUTE_CACHE_SECONDS", 300),
+		HandleDomain:      getEnvOrDefault("HANDLE_DOMAIN", ""),
+
+		// Federated message delivery
+		FederationEnabled:   getEnvAsBoolOrDefault("FEDERATION_ENABLED", true),
+		FederationPlainHTTP: getEnvAsBoolOrDefault("FEDERATION_PLAIN_HTTP", false),
+
+		// Outbound federation queue
+		FederationQueue:            getEnvAsBoolOrDefault("FEDERATION_QUEUE", true),
+		FederationQueueDir:         getEnvOrDefault("FEDERATION_QUEUE_DIR", filepath.Join(DataDir, "federation_queue")),
+		FederationQueueMaxAgeHours: getEnvAsIntOrDefault("FEDERATION_QUEUE_MAX_AGE_HOURS", 168),
+		FederationQueueMaxDepth:    getEnvAsIntOrDefault("FEDERATION_QUEUE_MAX_DEPTH", 10000),
+		FederationQueueMaxMB:       getEnvAsIntOrDefault("FEDERATION_QUEUE_MAX_MB", 256),
+
+		// Node-to-node mutual TLS
+		NodeMTLS:   getEnvAsBoolOrDefault("NODE_MTLS", false),
+		NodeTLSDir: getEnvOrDefault("NODE_TLS_DIR", filepath.Join(CertsDir, "nodes")),
+
+		// Capacitors trusted without a node certificate
+		NodeAllowlist: getEnvOrDefault("NODE_ALLOWLIST", ""),
+
+		// Connections to other nodes
+		NodeHTTPIdleConnsPerPeer:   getEnvAsIntOrDefault("NODE_HTTP_IDLE_CONNS_PER_PEER", 32),
+		NodeHTTPDialTimeoutSeconds: getEnvAsIntOrDefault("NODE_HTTP_DIAL_TIMEOUT_SECONDS", 5),
+		NodeHTTPTLSTimeoutSeconds:  getEnvAsIntOrDefault("NODE_HTTP_TLS_TIMEOUT_SECONDS", 5),
+		NodeHTTPIdleTimeoutSeconds: getEnvAsIntOrDefault("NODE_HTTP_IDLE_TIMEOUT_SECONDS", 90),
+		NodeHTTPPeerConcurrency:    getEnvAsIntOrDefault("NODE_HTTP_PEER_CONCURRENCY", 16),
+
+		// Mailbox replication
+		MailboxReplicas:           getEnvAsIntOrDefault("MAILBOX_REPLICAS", 0),
+		MailboxReplicaPeers:       getEnvOrDefault("MAILBOX_REPLICA_PEERS", ""),
+		MailboxReplicaAccept:      getEnvAsBoolOrDefault("MAILBOX_REPLICA_ACCEPT", false),
+		ReplicaReconcileHours:     getEnvAsIntOrDefault("REPLICA_RECONCILE_HOURS", 24),
+		ReplicaAntiEntropyMinutes: getEnvAsIntOrDefault("REPLICA_ANTI_ENTROPY_MINUTES", 30),
+
+		// Leader election for singleton jobs
+		LeaderElection:     getEnvAsBoolOrDefault("LEADER_ELECTION", true),
+		LeaderLeaseSeconds: getEnvAsIntOrDefault("LEADER_LEASE_SECONDS", 30),
+
+		// Presence gossip, opt-in
+		PresenceEnabled:        getEnvAsBoolOrDefault("PRESENCE_ENABLED", false),
+		PresenceTimeoutSeconds: getEnvAsIntOrDefault("PRESENCE_TIMEOUT_SECONDS", 60),
+
+		// Message offloading to lockers
+		LockerOffloadKB:     getEnvAsIntOrDefault("LOCKER_OFFLOAD_KB", 0),
+		LockerOffloadToken:  getSecretOrDefault("LOCKER_OFFLOAD_TOKEN", ""),
+		LockerOffloadCopies: getEnvAsIntOrDefault("LOCKER_OFFLOAD_COPIES", 2),
+		LockerAllowlist:     getEnvOrDefault("LOCKER_ALLOWLIST", ""),
+
+		// Usage telemetry, opt-in
+		TelemetryEndpoint:      getEnvOrDefault("TELEMETRY_ENDPOINT", ""),
+		TelemetryIntervalHours: getEnvAsIntOrDefault("TELEMETRY_INTERVAL_HOURS", 24),
+	}
+
+	// A client certificate is useless without its key and vice versa
+	if (cfg.DbSslCert == "") != (cfg.DbSslKey == "") {
+		log.Fatalf("❌ DB_SSLCERT and DB_SSLKEY must be set together")
 	}
 
-	log.Println("✅ Configuration loaded")
+	log.Printf("✅ Configuration loaded (%s profile)", cfg.Profile)
 	return cfg
 }
 
 // GetDBConnectionString builds and returns the CockroachDB connection string.
 // If DB_HOSTS is set, it uses that (for multi-node clusters); otherwise, it uses DB_HOST and DB_PORT.
+// Client certificate, key and CA paths are passed through for certificate authentication.
 func (c *Config) GetDBConnectionString() string {
-	if c.DbHosts != "" {
-		// Use multiple hosts
-		if c.DbPassword == "" {
-			return "postgresql://" + c.DbUser + "@" + c.DbHosts + "/" + c.DbName + "?sslmode=" + c.DbSslMode
-		}
-		return "postgresql://" + c.DbUser + ":" + c.DbPassword + "@" + c.DbHosts + "/" + c.DbName + "?sslmode=" + c.DbSslMode
+	// Use multiple hosts, or fall back to a single host
+	hosts := c.DbHosts
+	if hosts == "" {
+		hosts = c.DbHost + ":" + c.DbPort
+	}
+
+	userInfo := c.DbUser
+	if c.DbPassword != "" {
+		userInfo += ":" + c.DbPassword
 	}
 
-	// Fallback to single host
-	if c.DbPassword == "" {
-		return "postgresql://" + c.DbUser + "@" + c.DbHost + ":" + c.DbPort + "/" + c.DbName + "?sslmode=" + c.DbSslMode
+	params := url.Values{}
+	params.Set("sslmode", c.DbSslMode)
+	if c.DbSslRootCert != "" {
+		params.Set("sslrootcert", c.DbSslRootCert)
 	}
-	return "postgresql://" + c.DbUser + ":" + c.DbPassword + "@" + c.DbHost + ":" + c.DbPort + "/" + c.DbName + "?sslmode=" + c.DbSslMode
+	if c.DbSslCert != "" {
+		params.Set("sslcert", c.DbSslCert)
+		params.Set("sslkey", c.DbSslKey)
+	}
+
+	return "postgresql://" + userInfo + "@" + hosts + "/" + c.DbName + "?" + params.Encode()
 }
 
 // GetJWTSecret returns the JWT secret key for token signing and verification
@@ -118,6 +804,180 @@ func (c *Config) GetNumShards() int {
 	return c.NumShards
 }
 
+// SetNumShards records a shard count changed at runtime through the admin API. It only
+// lasts until the next restart, which applies NUM_SHARDS again.
+func (c *Config) SetNumShards(numShards int) {
+	c.NumShards = numShards
+	c.settings.record("NUM_SHARDS", strconv.Itoa(numShards), SourceRuntime, false)
+}
+
+// LoadSecrets resolves the JWT secret, node master key, private key wrap key, and current and
+// previous confusion salts through the configured secrets provider. Values found in the provider override the environment defaults.
+func (c *Config) LoadSecrets() error {
+	provider, err := secrets.NewProvider(secrets.Options{
+		Provider:   c.SecretsProvider,
+		VaultAddr:  c.VaultAddr,
+		VaultToken: c.VaultToken,
+		VaultMount: c.VaultMount,
+		VaultPath:  c.VaultPath,
+		AWSRegion:  c.AWSRegion,
+	})
+	if err != nil {
+		return err
+	}
+
+	targets := map[string]*string{
+		secrets.JWTSecret:         &c.JwtSecret,
+		secrets.NodeMasterKey:     &c.MasterKey,
+		secrets.ConfusionSalt:     &ConfusionSalt,
+		secrets.PrivateKeyWrapKey: &c.PrivateKeyWrapKey,
+
+		secrets.PreviousConfusionSalt: &PreviousConfusionSalt,
+	}
+	for _, name := range []string{secrets.JWTSecret, secrets.NodeMasterKey, secrets.PrivateKeyWrapKey, secrets.ConfusionSalt, secrets.PreviousConfusionSalt} {
+		target := targets[name]
+		value, err := provider.GetSecret(name)
+		if errors.Is(err, secrets.ErrSecretNotFound) {
+			if !c.settings.recorded(name) {
+				c.settings.record(name, *target, SourceDefault, true)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load %s from %s: %v", name, provider.Name(), err)
+		}
+		*target = value
+
+		source := provider.Name()
+		if source == "env" {
+			source = SourceEnv
+			if secrets.SecretFile(name) != "" {
+				source = SourceFile
+			}
+		}
+		c.settings.record(name, value, source, true)
+	}
+
+	log.Printf("✅ Secrets loaded from %s provider", provider.Name())
+	return nil
+}
+
+// GetMasterKey returns the node master key used for at-rest encryption.
+// The key is read from NODE_MASTER_KEY, or from NODE_MASTER_KEY_FILE if the former is unset.
+func (c *Config) GetMasterKey() ([]byte, error) {
+	encoded := c.MasterKey
+	if encoded == "" && c.MasterKeyFile != "" {
+		data, err := os.ReadFile(c.MasterKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read master key file: %v", err)
+		}
+		encoded = strings.TrimSpace(string(data))
+	}
+	if encoded == "" {
+		return nil, errors.New("no master key configured (set NODE_MASTER_KEY or NODE_MASTER_KEY_FILE)")
+	}
+	return decodeMasterKey(encoded)
+}
+
+// GetPreviousMasterKey returns the retired master key from NODE_PREVIOUS_MASTER_KEY, or nil if unset
+func (c *Config) GetPreviousMasterKey() ([]byte, error) {
+	if c.PreviousMasterKey == "" {
+		return nil, nil
+	}
+	return decodeMasterKey(c.PreviousMasterKey)
+}
+
+// GetPrivateKeyWrapKeys returns the key wrapping the private keys stored for accounts, and
+// the retired one from PREVIOUS_PRIVATE_KEY_WRAP_KEY or nil if unset
+func (c *Config) GetPrivateKeyWrapKeys() ([]byte, []byte, error) {
+	if c.PrivateKeyWrapKey == "" {
+		return nil, nil, errors.New("no private key wrap key configured (set PRIVATE_KEY_WRAP_KEY)")
+	}
+	current, err := decodeMasterKey(c.PrivateKeyWrapKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid PRIVATE_KEY_WRAP_KEY: %v", err)
+	}
+	if c.PreviousPrivateKeyWrapKey == "" {
+		return current, nil, nil
+	}
+	previous, err := decodeMasterKey(c.PreviousPrivateKeyWrapKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid PREVIOUS_PRIVATE_KEY_WRAP_KEY: %v", err)
+	}
+	return current, previous, nil
+}
+
+// BackupSinks returns the snapshot sinks listed in BACKUP_TARGET
+func (c *Config) BackupSinks() []string {
+	var sinks []string
+	for _, sink := range strings.Split(c.BackupTarget, ",") {
+		if sink = strings.TrimSpace(sink); sink != "" {
+			sinks = append(sinks, sink)
+		}
+	}
+	return sinks
+}
+
+// ReplicaPeers returns the capacitors named by MAILBOX_REPLICA_PEERS
+func (c *Config) ReplicaPeers() []string {
+	var peers []string
+	for _, peer := range strings.Split(c.MailboxReplicaPeers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// AllowedNodes returns the signing keys of the capacitors named by NODE_ALLOWLIST
+func (c *Config) AllowedNodes() []string {
+	var keys []string
+	for _, key := range strings.Split(c.NodeAllowlist, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// AllowedLockers returns the addresses of the lockers named by LOCKER_ALLOWLIST
+func (c *Config) AllowedLockers() []string {
+	var addresses []string
+	for _, address := range strings.Split(c.LockerAllowlist, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// BackupEncryptionKey returns the key sealing the snapshots of a sink, or nil if they
+// are stored in plaintext
+func (c *Config) BackupEncryptionKey(sink string) ([]byte, error) {
+	encoded := map[string]string{
+		"file":   c.BackupFileEncryptionKey,
+		"s3":     c.BackupS3EncryptionKey,
+		"sftp":   c.BackupSFTPEncryptionKey,
+		"locker": c.BackupLockerEncryptionKey,
+	}[sink]
+	if encoded == "" {
+		return nil, nil
+	}
+	return decodeMasterKey(encoded)
+}
+
+// decodeMasterKey decodes a base64-encoded 32-byte master key
+func decodeMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("master key is not valid base64: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key must decode to 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
 // EnsureDirectoriesExist creates necessary directories for the application
 func EnsureDirectoriesExist() {
 	dirs := []string{DataDir, MessagesDir, ContactsDir, KeysDir, CertsDir, ConfigDir}
@@ -129,27 +989,69 @@ func EnsureDirectoriesExist() {
 	log.Println("✅ Required directories created")
 }
 
-// Helper functions
+// Helper functions; environment variables take precedence over the profile's defaults
+// (see profileDefaults), which take precedence over defaultValue. Every resolved value is
+// recorded with its source for Effective.
 func getEnvOrDefault(key, defaultValue string) string {
+	value, source := envValue(key, defaultValue)
+	loading.record(key, value, source, false)
+	return value
+}
+
+// envValue resolves key and returns the value with its source
+func envValue(key, defaultValue string) (string, string) {
 	if value, exists := os.LookupEnv(key); exists {
-		return value
+		return value, SourceEnv
 	}
-	return defaultValue
+	if value, ok := profileDefault(key); ok {
+		return value, SourceProfile
+	}
+	return defaultValue, SourceDefault
+}
+
+// getSecretOrDefault reads a sensitive value from KEY_FILE or the secrets directory
+// (see secrets.Lookup) so it stays out of the environment, falling back to KEY
+func getSecretOrDefault(key, defaultValue string) string {
+	value, err := secrets.Lookup(key)
+	source := SourceFile
+	if errors.Is(err, secrets.ErrSecretNotFound) {
+		value, source = envValue(key, defaultValue)
+	} else if err != nil {
+		log.Fatalf("❌ %v", err)
+	} else if secrets.SecretFile(key) == "" {
+		source = SourceEnv
+	}
+	loading.record(key, value, source, true)
+	return value
 }
 
 func getEnvAsIntOrDefault(key string, defaultValue int) int {
 	if value, exists := os.LookupEnv(key); exists {
 		if intValue, err := strconv.Atoi(value); err == nil {
+			recordInt(key, intValue, SourceEnv)
 			return intValue
 		}
 		log.Printf("Warning: Invalid value for %s: %s, using default: %d", key, value, defaultValue)
 	}
+	if value, ok := profileDefault(key); ok {
+		intValue, _ := strconv.Atoi(value)
+		recordInt(key, intValue, SourceProfile)
+		return intValue
+	}
+	recordInt(key, defaultValue, SourceDefault)
 	return defaultValue
 }
 
 func getEnvAsBoolOrDefault(key string, defaultValue bool) bool {
 	if value, exists := os.LookupEnv(key); exists {
-		return value == "true" || value == "1" || value == "yes"
+		boolValue := value == "true" || value == "1" || value == "yes"
+		recordBool(key, boolValue, SourceEnv)
+		return boolValue
+	}
+	if value, ok := profileDefault(key); ok {
+		recordBool(key, value == "true", SourceProfile)
+		return value == "true"
 	}
+	recordBool(key, defaultValue, SourceDefault)
 	return defaultValue
 }
@@ -3,6 +3,7 @@ package config
 
 import (
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 	"strconv"
@@ -15,7 +16,7 @@ type DHTConfig struct {
 	ExternalIP     string        // External IP address for others to contact us
 	DHTPort        int           // Port for DHT communication
 	APIPort        int           // Port for API communication
-	GRPCPort       int           // Port for gRPC communication
+	GRPCPort       int           // Port for the gRPC API (0 disables it)
 	
 	// Discovery Configuration
 	BootstrapNodes []string      // List of seed nodes for bootstrapping
@@ -48,7 +49,7 @@ func LoadDHTConfig() *DHTConfig {
 		RefreshInterval: time.Duration(getEnvAsIntOrDefault("DHT_REFRESH_INTERVAL_MINUTES", 60)) * time.Minute,
 		NumShards:       getEnvAsIntOrDefault("NUM_SHARDS", 1),         // Default shards for Capacitor
 		NodeID:          getEnvOrDefault("DHT_NODE_ID", ""),
-		StoragePath:     getEnvOrDefault("DHT_STORAGE_PATH", "./data/dht"),
+		StoragePath:     getEnvOrDefault("DHT_STORAGE_PATH", filepath.Join(DataDir, "dht")),
 		UseSSL:          getEnvAsBoolOrDefault("DHT_USE_SSL", false),
 		CertFile:        getEnvOrDefault("DHT_CERT_FILE", ""),
 		KeyFile:         getEnvOrDefault("DHT_KEY_FILE", ""),
@@ -119,14 +120,3 @@ func (c *DHTConfig) AddBootstrapNode(node string) {
 func (c *DHTConfig) ClearBootstrapNodes() {
 	c.BootstrapNodes = []string{}
 }
-
-// getEnvAsBoolOrDefault gets an environment variable as bool with a default fallback
-func getEnvAsBoolOrDefault(key string, defaultVal bool) bool {
-	if val, exists := os.LookupEnv(key); exists {
-		boolVal, err := strconv.ParseBool(val)
-		if err == nil {
-			return boolVal
-		}
-	}
-	return defaultVal
-}
\ No newline at end of file
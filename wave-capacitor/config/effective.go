@@ -0,0 +1,98 @@
+package config
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Sources of a setting's value, from the lowest precedence to the highest
+const (
+	SourceDefault = "default" // built into LoadConfig
+	SourceProfile = "profile" // the active profile's defaults (see profileDefaults)
+	SourceEnv     = "env"     // the environment variable
+	SourceFile    = "file"    // NAME_FILE or the secrets directory
+	SourceRuntime = "runtime" // changed through the admin API, until the next restart
+)
+
+// Setting is one setting of the effective configuration, named by its environment
+// variable, with where its value came from. Secrets providers other than env are
+// reported as the source of the secrets they resolved (e.g. "vault").
+type Setting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value" doc:"<redacted> for secrets, <unset> for empty secrets"`
+	Source string `json:"source" doc:"default, profile, env, file, runtime or the secrets provider"`
+	Secret bool   `json:"secret,omitempty"`
+}
+
+// settingsLog records every setting LoadConfig and LoadSecrets resolve, in the order they
+// are first read
+type settingsLog struct {
+	mu       sync.Mutex
+	names    []string
+	settings map[string]Setting
+}
+
+// loading is the log of the most recent LoadConfig; the getEnv helpers record into it
+var loading = newSettingsLog()
+
+func newSettingsLog() *settingsLog {
+	return &settingsLog{settings: make(map[string]Setting)}
+}
+
+// record stores the resolved value of a setting, replacing an earlier one of the same name
+func (l *settingsLog) record(name, value, source string, secret bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.settings[name]; !ok {
+		l.names = append(l.names, name)
+	}
+	l.settings[name] = Setting{Name: name, Value: value, Source: source, Secret: secret}
+}
+
+// recorded reports whether a setting has been recorded
+func (l *settingsLog) recorded(name string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.settings[name]
+	return ok
+}
+
+// recordInt and recordBool record settings parsed from their environment variable
+func recordInt(name string, value int, source string) {
+	loading.record(name, strconv.Itoa(value), source, false)
+}
+
+func recordBool(name string, value bool, source string) {
+	loading.record(name, strconv.FormatBool(value), source, false)
+}
+
+// Effective lists every setting of the configuration with its resolved value and source,
+// secrets replaced by "<redacted>" (or "<unset>" when empty), for logging at startup and
+// GET /api/admin/config
+func (c *Config) Effective() []Setting {
+	if c.settings == nil {
+		return nil
+	}
+	c.settings.mu.Lock()
+	defer c.settings.mu.Unlock()
+
+	settings := make([]Setting, 0, len(c.settings.names))
+	for _, name := range c.settings.names {
+		setting := c.settings.settings[name]
+		if setting.Secret {
+			if setting.Value == "" {
+				setting.Value = "<unset>"
+			} else {
+				setting.Value = "<redacted>"
+			}
+		}
+		settings = append(settings, setting)
+	}
+	return settings
+}
@@ -0,0 +1,58 @@
+package config
+
+import "os"
+
+// Environment profiles, selected with ENVIRONMENT
+const (
+	ProfileDevelopment = "development"
+	ProfileStaging     = "staging"
+	ProfileProduction  = "production"
+)
+
+// profileDefaults are the defaults each profile puts between the built-in defaults and
+// the environment: a setting comes from its environment variable if set, else from the
+// active profile, else from LoadConfig. Only settings that differ per profile are listed.
+var profileDefaults = map[string]map[string]string{
+	// Single node on a laptop: plain connections, readable and verbose logs
+	ProfileDevelopment: {
+		"DB_SSLMODE":       "disable",
+		"LOG_LEVEL":        "debug",
+		"DB_SLOW_QUERY_MS": "100",
+		"SLOW_REQUEST_MS":  "500",
+		"SLOW_SCAN_MS":     "50",
+		"DOCS_UI":          "true",
+	},
+	// Production-like, but insecure settings are only warned about
+	ProfileStaging: {
+		"DB_SSLMODE": "verify-full",
+		"LOG_FORMAT": "json",
+		"DOCS_UI":    "true",
+	},
+	// Validate refuses insecure settings and requires TLS (see TLS_OFFLOADED)
+	ProfileProduction: {
+		"DB_SSLMODE":      "verify-full",
+		"LOG_FORMAT":      "json",
+		"ENCRYPT_AT_REST": "true",
+	},
+}
+
+// Profile returns the active profile, development unless ENVIRONMENT says otherwise.
+// Unknown profiles get no profile defaults; Validate reports them.
+func Profile() string {
+	if profile := os.Getenv("ENVIRONMENT"); profile != "" {
+		return profile
+	}
+	return ProfileDevelopment
+}
+
+// Production reports whether the node runs with ENVIRONMENT=production, which turns
+// insecure defaults from warnings into fatal problems
+func Production() bool {
+	return Profile() == ProfileProduction
+}
+
+// profileDefault returns the active profile's default of an environment variable
+func profileDefault(key string) (string, bool) {
+	value, ok := profileDefaults[Profile()][key]
+	return value, ok
+}
@@ -0,0 +1,399 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"wave_capacitor/schedule"
+	"wave_capacitor/secrets"
+)
+
+// minSecretLength is the shortest JWT secret or operator token accepted in production
+const minSecretLength = 32
+
+// Problem is one finding of Validate. Fatal problems must keep the node from starting;
+// the others are logged as warnings.
+type Problem struct {
+	Fatal   bool
+	Message string
+}
+
+// Validate checks the configuration, after secrets are loaded, for settings that are
+// insecure in production or contradict each other
+func (c *Config) Validate(dht *DHTConfig) []Problem {
+	var problems []Problem
+	production := Production()
+	fatal := func(format string, args ...interface{}) {
+		problems = append(problems, Problem{Fatal: true, Message: fmt.Sprintf(format, args...)})
+	}
+	warn := func(format string, args ...interface{}) {
+		problems = append(problems, Problem{Message: fmt.Sprintf(format, args...)})
+	}
+	// insecure is fatal in production and a warning elsewhere
+	insecure := func(format string, args ...interface{}) {
+		problems = append(problems, Problem{Fatal: production, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// Profile and logging
+	if _, known := profileDefaults[c.Profile]; !known {
+		warn("ENVIRONMENT %q is not development, staging or production, no profile defaults apply", c.Profile)
+	}
+	switch c.LogFormat {
+	case "text", "json":
+	default:
+		fatal("LOG_FORMAT %q is not text or json", c.LogFormat)
+	}
+	switch c.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		fatal("LOG_LEVEL %q is not debug, info, warn or error", c.LogLevel)
+	}
+	if c.LogFile != "" {
+		if c.HTTPPrefork {
+			fatal("LOG_FILE cannot be combined with HTTP_PREFORK, the processes would rotate the same file")
+		}
+		if c.LogMaxSizeMB <= 0 && c.LogRotateHours <= 0 {
+			warn("LOG_MAX_SIZE_MB and LOG_ROTATE_HOURS are both 0, LOG_FILE is never rotated")
+		}
+		if c.LogMinFreeDiskMB > 0 && c.LogLowDiskSampleEvery < 1 {
+			fatal("LOG_LOW_DISK_SAMPLE_EVERY must be at least 1, got %d", c.LogLowDiskSampleEvery)
+		}
+	}
+
+	// Secrets
+	if c.JwtSecret == defaultSecret {
+		insecure("JWT_SECRET is the default value, anyone can forge tokens")
+	} else if len(c.JwtSecret) < minSecretLength {
+		insecure("JWT_SECRET is shorter than %d characters", minSecretLength)
+	}
+	if ConfusionSalt == defaultSecret {
+		insecure("CONFUSION_SALT is the default value, shard placement is predictable")
+	}
+	if PreviousConfusionSalt != "" && PreviousConfusionSalt == ConfusionSalt {
+		warn("PREVIOUS_CONFUSION_SALT equals CONFUSION_SALT, there is nothing to rotate")
+	}
+	if c.AdminToken != "" && len(c.AdminToken) < minSecretLength {
+		insecure("ADMIN_TOKEN is shorter than %d characters", minSecretLength)
+	}
+	if c.ShardTransferToken != "" && len(c.ShardTransferToken) < minSecretLength {
+		insecure("SHARD_TRANSFER_TOKEN is shorter than %d characters", minSecretLength)
+	}
+	if c.EncryptAtRest && c.MasterKey == "" && c.MasterKeyFile == "" {
+		fatal("ENCRYPT_AT_REST requires NODE_MASTER_KEY or NODE_MASTER_KEY_FILE")
+	}
+	if !c.EncryptAtRest && production {
+		warn("ENCRYPT_AT_REST is off, message files are stored unencrypted")
+	}
+	if production {
+		for _, name := range []string{"JWT_SECRET", "NODE_MASTER_KEY", "PRIVATE_KEY_WRAP_KEY", "CONFUSION_SALT", "DB_PASSWORD", "ADMIN_TOKEN", "SHARD_TRANSFER_TOKEN"} {
+			if os.Getenv(name) != "" && secrets.SecretFile(name) == "" {
+				warn("%s is passed in the environment, where it shows in process listings; use %s_FILE or %s", name, name, secrets.SecretsDir())
+			}
+		}
+	}
+
+	// Ports
+	ports := map[int]string{}
+	usePort := func(name string, port int) {
+		if port <= 0 {
+			return
+		}
+		if other, ok := ports[port]; ok {
+			fatal("%s and %s both use port %d", other, name, port)
+			return
+		}
+		ports[port] = name
+	}
+	apiPort, err := strconv.Atoi(c.Port)
+	if err != nil || apiPort <= 0 || apiPort > 65535 {
+		fatal("PORT %q is not a valid port", c.Port)
+	}
+	usePort("PORT", apiPort)
+	usePort("DHT_PORT", dht.DHTPort)
+	usePort("GRPC_PORT", dht.GRPCPort)
+	if c.UseTLS || c.UseAutoCert {
+		redirectPort, _ := strconv.Atoi(c.RedirectPort)
+		usePort("HTTP_REDIRECT_PORT", redirectPort)
+	}
+	if dht.APIPort != apiPort {
+		warn("API_PORT %d is advertised in the DHT, but the API listens on PORT %s", dht.APIPort, c.Port)
+	}
+
+	// TLS
+	if c.UseAutoCert && c.PublicDomain == "" {
+		fatal("USE_AUTOCERT requires PUBLIC_DOMAIN")
+	}
+	if c.UseTLS && !c.UseAutoCert && (c.CertFile == "" || c.KeyFile == "") {
+		fatal("USE_TLS requires CERT_FILE and KEY_FILE")
+	}
+	if !c.UseTLS && !c.UseAutoCert && !c.TLSOffloaded {
+		if production {
+			fatal("production requires TLS: set USE_TLS or USE_AUTOCERT, or TLS_OFFLOADED=true behind a TLS-terminating proxy")
+		} else if c.PublicDomain != "" {
+			warn("PUBLIC_DOMAIN is set but TLS is off; only run like this behind a TLS-terminating proxy")
+		}
+	}
+	if dht.UseSSL && !c.NodeMTLS && (dht.CertFile == "" || dht.KeyFile == "") {
+		fatal("DHT_USE_SSL requires DHT_CERT_FILE and DHT_KEY_FILE, or NODE_MTLS")
+	}
+	if c.NodeMTLS {
+		// Node certificates are checked on the connection, so the API must terminate TLS
+		// itself, through fasthttp, in a single process
+		if !dht.UseSSL {
+			fatal("NODE_MTLS requires DHT_USE_SSL, node traffic goes over HTTPS")
+		}
+		if !c.UseTLS && !c.UseAutoCert {
+			fatal("NODE_MTLS requires USE_TLS or USE_AUTOCERT, a TLS-terminating proxy would drop node certificates")
+		}
+		if c.HTTP2Enabled || c.HTTPPrefork {
+			fatal("NODE_MTLS cannot be combined with HTTP2_ENABLED or HTTP_PREFORK")
+		}
+	}
+	if c.HTTPPrefork && (c.HTTP2Enabled || c.UseAutoCert) {
+		fatal("HTTP_PREFORK cannot be combined with HTTP2_ENABLED or USE_AUTOCERT")
+	}
+	if c.BodyLimitBackupMB > c.HTTPMaxBodyMB {
+		warn("BODY_LIMIT_BACKUP_MB (%d) is above HTTP_MAX_BODY_MB (%d), which then limits backups", c.BodyLimitBackupMB, c.HTTPMaxBodyMB)
+	}
+
+	// Sharding; the shard is picked by the first byte of a hash, so at most 256 are used
+	if c.NumShards < 1 || c.NumShards > 256 {
+		fatal("NUM_SHARDS must be between 1 and 256, got %d", c.NumShards)
+	}
+	if c.MessageReadWorkers < 1 || c.MessageReadWorkers > 64 {
+		fatal("MESSAGE_READ_WORKERS must be between 1 and 64, got %d", c.MessageReadWorkers)
+	}
+
+	// Database
+	switch c.DbSslMode {
+	case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+	default:
+		fatal("DB_SSLMODE %q is not a valid sslmode", c.DbSslMode)
+	}
+	if c.DbSslMode == "disable" && production {
+		warn("DB_SSLMODE=disable in production, database traffic is not encrypted")
+	}
+	if c.DbSslCert != "" && c.DbSslMode == "disable" {
+		warn("DB_SSLCERT is set but DB_SSLMODE=disable, the client certificate is not used")
+	}
+	if c.DbMaxOpenConns > 0 && c.DbMaxIdleConns > c.DbMaxOpenConns {
+		warn("DB_MAX_IDLE_CONNS (%d) is above DB_MAX_OPEN_CONNS (%d)", c.DbMaxIdleConns, c.DbMaxOpenConns)
+	}
+	if c.UserCacheSize < 0 {
+		fatal("USER_CACHE_SIZE must not be negative, got %d", c.UserCacheSize)
+	}
+	if c.UserCacheSize > 0 && (c.UserCacheTTLSeconds < 1 || c.UserCacheTTLSeconds > 600) {
+		fatal("USER_CACHE_TTL_SECONDS must be between 1 and 600, got %d", c.UserCacheTTLSeconds)
+	}
+	if c.DbWriteBehindMs < 100 || c.DbWriteBehindMs > 60000 {
+		fatal("DB_WRITE_BEHIND_MS must be between 100 and 60000, got %d", c.DbWriteBehindMs)
+	}
+	if c.DbWriteBehindMaxPending < 1 {
+		fatal("DB_WRITE_BEHIND_MAX_PENDING must be at least 1, got %d", c.DbWriteBehindMaxPending)
+	}
+
+	// Tracing
+	if c.TracingEndpoint != "" {
+		if u, err := url.Parse(c.TracingEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fatal("OTEL_EXPORTER_OTLP_ENDPOINT %q is not an http(s) URL", c.TracingEndpoint)
+		}
+		if c.TracingSamplePercent < 0 || c.TracingSamplePercent > 100 {
+			fatal("TRACING_SAMPLE_PERCENT must be between 0 and 100, got %d", c.TracingSamplePercent)
+		}
+	}
+
+	// Alerting
+	if c.AlertWebhookURL != "" {
+		if u, err := url.Parse(c.AlertWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fatal("ALERT_WEBHOOK_URL %q is not an http(s) URL", c.AlertWebhookURL)
+		}
+	}
+	if c.AlertSMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.AlertSMTPAddr); err != nil {
+			fatal("ALERT_SMTP_ADDR %q is not host:port", c.AlertSMTPAddr)
+		}
+		if c.AlertSMTPFrom == "" || c.AlertSMTPTo == "" {
+			fatal("ALERT_SMTP_ADDR needs ALERT_SMTP_FROM and ALERT_SMTP_TO")
+		}
+	}
+	if (c.AlertWebhookURL != "" || c.AlertSMTPAddr != "" || c.AlertStdout) && c.AlertIntervalSeconds <= 0 {
+		fatal("ALERT_INTERVAL_SECONDS must be positive, got %d", c.AlertIntervalSeconds)
+	}
+
+	// Scheduled snapshots
+	if c.BackupSchedule != "" {
+		if _, err := schedule.Parse(c.BackupSchedule); err != nil {
+			fatal("BACKUP_SCHEDULE: %v", err)
+		}
+		sinks := c.BackupSinks()
+		if len(sinks) == 0 {
+			fatal("BACKUP_TARGET must name at least one of file, s3, sftp or locker")
+		}
+		for _, sink := range sinks {
+			switch sink {
+			case "file", "s3", "locker":
+			case "sftp":
+				if c.BackupSFTPAddr == "" || c.BackupSFTPUser == "" {
+					fatal("BACKUP_TARGET sftp needs BACKUP_SFTP_ADDR and BACKUP_SFTP_USER")
+				}
+				if c.BackupSFTPPassword == "" && c.BackupSFTPKeyFile == "" {
+					fatal("BACKUP_TARGET sftp needs BACKUP_SFTP_PASSWORD or BACKUP_SFTP_KEY_FILE")
+				}
+				if c.BackupSFTPHostKey == "" {
+					fatal("BACKUP_TARGET sftp needs BACKUP_SFTP_HOST_KEY to authenticate the server")
+				}
+			default:
+				fatal("BACKUP_TARGET: unknown sink %q (use file, s3, sftp or locker)", sink)
+				continue
+			}
+			if _, err := c.BackupEncryptionKey(sink); err != nil {
+				fatal("BACKUP_%s_ENCRYPTION_KEY: %v", strings.ToUpper(sink), err)
+			}
+		}
+		if c.BackupLockerToken == "" && slices.Contains(sinks, "locker") {
+			insecure("BACKUP_TARGET locker without BACKUP_LOCKER_TOKEN sends snapshots to the lockers without credentials")
+		}
+		if c.BackupKeep < 0 {
+			fatal("BACKUP_KEEP must not be negative, got %d", c.BackupKeep)
+		}
+	}
+	if c.StoredBackupMaxPerUser < 0 {
+		fatal("STORED_BACKUP_MAX_PER_USER must not be negative, got %d", c.StoredBackupMaxPerUser)
+	}
+
+	// Blocklists
+	if c.BlockedMessages != "drop" && c.BlockedMessages != "reject" {
+		fatal("BLOCKED_MESSAGES %q is not drop or reject", c.BlockedMessages)
+	}
+	if c.BlocklistMaxPerUser < 1 {
+		fatal("BLOCKLIST_MAX_PER_USER must be at least 1, got %d", c.BlocklistMaxPerUser)
+	}
+
+	// Contact discovery; DHT nodes keep values a week at most
+	if c.DiscoveryTTLHours < 1 || c.DiscoveryTTLHours > 168 {
+		fatal("DISCOVERY_TTL_HOURS must be between 1 and 168, got %d", c.DiscoveryTTLHours)
+	}
+
+	// Cross-node routing
+	if c.RouteTTLHours < 1 || c.RouteTTLHours > 168 {
+		fatal("ROUTE_TTL_HOURS must be between 1 and 168, got %d", c.RouteTTLHours)
+	}
+	if c.RouteCacheSeconds < 0 {
+		fatal("ROUTE_CACHE_SECONDS must not be negative, got %d", c.RouteCacheSeconds)
+	}
+	if strings.ContainsAny(c.HandleDomain, ":/@ ") {
+		fatal("HANDLE_DOMAIN must be a bare domain name, got %q", c.HandleDomain)
+	}
+
+	// Federation
+	if c.FederationPlainHTTP {
+		insecure("FEDERATION_PLAIN_HTTP sends messages to other capacitors unencrypted")
+	}
+	for _, key := range c.AllowedNodes() {
+		if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != ed25519.PublicKeySize {
+			fatal("NODE_ALLOWLIST entry %q is not a base64 Ed25519 public key", key)
+		}
+	}
+	if c.FederationEnabled && !c.NodeMTLS && c.NodeAllowlist == "" {
+		warn("FEDERATION_ENABLED without NODE_MTLS or NODE_ALLOWLIST refuses every other capacitor")
+	}
+
+	// Outbound federation queue
+	if c.FederationQueue && c.FederationQueueMaxAgeHours < 1 {
+		fatal("FEDERATION_QUEUE_MAX_AGE_HOURS must be at least 1, got %d", c.FederationQueueMaxAgeHours)
+	}
+	if c.FederationQueueMaxDepth < 0 {
+		fatal("FEDERATION_QUEUE_MAX_DEPTH must not be negative, got %d", c.FederationQueueMaxDepth)
+	}
+	if c.FederationQueueMaxMB < 0 {
+		fatal("FEDERATION_QUEUE_MAX_MB must not be negative, got %d", c.FederationQueueMaxMB)
+	}
+
+	// Connections to other nodes
+	if c.NodeHTTPIdleConnsPerPeer < 1 {
+		fatal("NODE_HTTP_IDLE_CONNS_PER_PEER must be at least 1, got %d", c.NodeHTTPIdleConnsPerPeer)
+	}
+	if c.NodeHTTPDialTimeoutSeconds < 1 || c.NodeHTTPTLSTimeoutSeconds < 1 || c.NodeHTTPIdleTimeoutSeconds < 1 {
+		fatal("NODE_HTTP_DIAL_TIMEOUT_SECONDS, NODE_HTTP_TLS_TIMEOUT_SECONDS and NODE_HTTP_IDLE_TIMEOUT_SECONDS must be at least 1")
+	}
+	if c.NodeHTTPPeerConcurrency < 0 {
+		fatal("NODE_HTTP_PEER_CONCURRENCY must not be negative, got %d", c.NodeHTTPPeerConcurrency)
+	}
+
+	// Mailbox replication
+	if c.MailboxReplicas < 0 || c.MailboxReplicas > 5 {
+		fatal("MAILBOX_REPLICAS must be between 0 and 5, got %d", c.MailboxReplicas)
+	}
+	if c.MailboxReplicas > 0 && !c.FederationEnabled {
+		fatal("MAILBOX_REPLICAS needs FEDERATION_ENABLED, replicas are only accepted from the capacitor a key is routed to")
+	}
+	if peers := c.ReplicaPeers(); len(peers) > 0 && len(peers) < c.MailboxReplicas {
+		warn("MAILBOX_REPLICA_PEERS names %d capacitors, fewer than MAILBOX_REPLICAS=%d", len(peers), c.MailboxReplicas)
+	}
+	for _, peer := range c.ReplicaPeers() {
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			fatal("MAILBOX_REPLICA_PEERS: %q is not host:port", peer)
+		}
+	}
+	if c.ReplicaReconcileHours < 0 {
+		fatal("REPLICA_RECONCILE_HOURS must not be negative, got %d", c.ReplicaReconcileHours)
+	}
+	if c.ReplicaAntiEntropyMinutes < 0 {
+		fatal("REPLICA_ANTI_ENTROPY_MINUTES must not be negative, got %d", c.ReplicaAntiEntropyMinutes)
+	}
+
+	// Leader election; renewing every third of the lease needs a few seconds of it
+	if c.LeaderElection && c.LeaderLeaseSeconds < 3 {
+		fatal("LEADER_LEASE_SECONDS must be at least 3, got %d", c.LeaderLeaseSeconds)
+	}
+
+	// Presence; a timeout under the sweep interval would end devices between heartbeats
+	if c.PresenceEnabled {
+		if c.PresenceTimeoutSeconds < 10 || c.PresenceTimeoutSeconds > 600 {
+			fatal("PRESENCE_TIMEOUT_SECONDS must be between 10 and 600, got %d", c.PresenceTimeoutSeconds)
+		}
+		if c.HTTPPrefork {
+			fatal("PRESENCE_ENABLED cannot be combined with HTTP_PREFORK, each process would keep presence of its own")
+		}
+		if !c.FederationEnabled {
+			warn("PRESENCE_ENABLED without FEDERATION_ENABLED only shares presence with contacts hosted here")
+		}
+	}
+
+	// Message offloading to lockers
+	if c.LockerOffloadKB < 0 {
+		fatal("LOCKER_OFFLOAD_KB must not be negative, got %d", c.LockerOffloadKB)
+	}
+	if c.LockerOffloadKB > 0 && c.LockerOffloadToken == "" {
+		insecure("LOCKER_OFFLOAD_KB without LOCKER_OFFLOAD_TOKEN sends message ciphertexts to the lockers without credentials")
+	}
+	if c.LockerOffloadKB > 0 && c.LockerOffloadCopies < 2 {
+		fatal("LOCKER_OFFLOAD_COPIES must be at least 2, so that losing a locker loses no message, got %d", c.LockerOffloadCopies)
+	}
+	for _, address := range c.AllowedLockers() {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			fatal("LOCKER_ALLOWLIST entries must be host:port addresses, got %q", address)
+		}
+	}
+	if c.LockerOffloadKB > 0 && !c.NodeMTLS && c.LockerAllowlist == "" {
+		warn("LOCKER_OFFLOAD_KB without NODE_MTLS or LOCKER_ALLOWLIST trusts no locker, so messages stay local")
+	}
+
+	// Usage telemetry
+	if c.TelemetryEndpoint != "" {
+		if u, err := url.Parse(c.TelemetryEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fatal("TELEMETRY_ENDPOINT %q is not an http(s) URL", c.TelemetryEndpoint)
+		}
+		if c.TelemetryIntervalHours <= 0 {
+			fatal("TELEMETRY_INTERVAL_HOURS must be positive, got %d", c.TelemetryIntervalHours)
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,243 @@
+// Package crashreport handles panics recovered while serving requests: it logs them with
+// their stack and the request's context, counts them, and optionally reports them to a
+// Sentry-compatible error tracker.
+package crashreport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+	"wave_capacitor/logging"
+)
+
+const (
+	// reportQueueSize bounds the reports waiting to be sent; more are dropped
+	reportQueueSize = 32
+	// reportTimeout bounds one report request
+	reportTimeout = 10 * time.Second
+)
+
+// logger logs recovered panics
+var logger = logging.Component("crash")
+
+// panics counts the panics recovered since the node started
+var panics atomic.Int64
+
+// Count returns the number of panics recovered since the node started
+func Count() int64 {
+	return panics.Load()
+}
+
+// Options configures reporting to an error tracker
+type Options struct {
+	DSN         string // Sentry DSN, https://<key>@<host>/<project>
+	Environment string
+	ServerName  string
+	Release     string
+}
+
+// reporter sends events to the error tracker's store endpoint
+type reporter struct {
+	storeURL string
+	auth     string
+	opts     Options
+	client   *http.Client
+	queue    chan event
+}
+
+// current is the reporter configured by Setup, nil while reporting is off
+var current atomic.Pointer[reporter]
+
+// Setup starts reporting recovered panics to the error tracker of opts.DSN
+func Setup(opts Options) error {
+	dsn, err := url.Parse(opts.DSN)
+	if err != nil || (dsn.Scheme != "http" && dsn.Scheme != "https") || dsn.User == nil || dsn.Host == "" {
+		return fmt.Errorf("crash report DSN is not a Sentry DSN (https://<key>@<host>/<project>)")
+	}
+	path := strings.Trim(dsn.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	project := path[slash+1:]
+	if project == "" {
+		return fmt.Errorf("crash report DSN has no project ID")
+	}
+	prefix := ""
+	if slash >= 0 {
+		prefix = "/" + path[:slash]
+	}
+
+	r := &reporter{
+		storeURL: fmt.Sprintf("%s://%s%s/api/%s/store/", dsn.Scheme, dsn.Host, prefix, project),
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=wave-capacitor/1.0, sentry_key=%s", dsn.User.Username()),
+		opts:     opts,
+		client:   &http.Client{Timeout: reportTimeout},
+		queue:    make(chan event, reportQueueSize),
+	}
+	go r.run()
+	current.Store(r)
+	return nil
+}
+
+// Recovered handles a panic value recovered while serving a request: it logs it with the
+// stack, counts it and queues a report. tags describe the request, e.g. its route.
+func Recovered(ctx context.Context, recovered interface{}, tags map[string]string) {
+	panics.Add(1)
+	stack := debug.Stack()
+
+	args := []interface{}{"panic", fmt.Sprint(recovered), "stack", string(stack)}
+	for key, value := range tags {
+		args = append(args, key, value)
+	}
+	logger.Error(ctx, "recovered from panic", args...)
+
+	if r := current.Load(); r != nil {
+		// Skip runtime.Callers, newEvent, Recovered and the deferred function calling it
+		r.enqueue(newEvent(ctx, r.opts, recovered, tags, 4))
+	}
+}
+
+func (r *reporter) enqueue(e event) {
+	select {
+	case r.queue <- e:
+	default:
+		logger.Warn(context.Background(), "crash report dropped, the report queue is full", "event_id", e.EventID)
+	}
+}
+
+func (r *reporter) run() {
+	for e := range r.queue {
+		r.send(e)
+	}
+}
+
+// send posts one event; failures are logged and the event dropped
+func (r *reporter) send(e event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		logger.Warn(context.Background(), "encoding crash report failed", "event_id", e.EventID, "error", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, r.storeURL, bytes.NewReader(body))
+	if err != nil {
+		logger.Warn(context.Background(), "sending crash report failed", "event_id", e.EventID, "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		logger.Warn(context.Background(), "sending crash report failed", "event_id", e.EventID, "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode/100 != 2 {
+		logger.Warn(context.Background(), "sending crash report failed", "event_id", e.EventID, "status", resp.StatusCode)
+	}
+}
+
+// event is a Sentry event in the store endpoint's JSON format
+type event struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Exception   struct {
+		Values []exception `json:"values"`
+	} `json:"exception"`
+}
+
+type exception struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Stacktrace struct {
+		Frames []frame `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+type frame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// newEvent describes a panic; skip is the number of stack frames above the panicking code
+// that belong to the recovery
+func newEvent(ctx context.Context, opts Options, recovered interface{}, tags map[string]string, skip int) event {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	e := event{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Level:       "error",
+		Platform:    "go",
+		Logger:      "wave_capacitor",
+		ServerName:  opts.ServerName,
+		Environment: opts.Environment,
+		Release:     opts.Release,
+		Tags:        map[string]string{},
+	}
+	for key, value := range tags {
+		e.Tags[key] = value
+	}
+	if id := logging.RequestID(ctx); id != "" {
+		e.Tags["request_id"] = id
+	}
+
+	exc := exception{Type: fmt.Sprintf("%T", recovered), Value: fmt.Sprint(recovered)}
+	if err, ok := recovered.(error); ok {
+		exc.Value = err.Error()
+	}
+
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(skip, pcs)])
+	for {
+		f, more := frames.Next()
+		module, function := splitFunction(f.Function)
+		exc.Stacktrace.Frames = append(exc.Stacktrace.Frames, frame{
+			Function: function,
+			Module:   module,
+			Filename: f.File,
+			Lineno:   f.Line,
+			InApp:    strings.HasPrefix(module, "wave_capacitor"),
+		})
+		if !more {
+			break
+		}
+	}
+	// Sentry lists frames oldest first
+	for i, j := 0, len(exc.Stacktrace.Frames)-1; i < j; i, j = i+1, j-1 {
+		exc.Stacktrace.Frames[i], exc.Stacktrace.Frames[j] = exc.Stacktrace.Frames[j], exc.Stacktrace.Frames[i]
+	}
+	e.Exception.Values = []exception{exc}
+	return e
+}
+
+// splitFunction splits "wave_capacitor/api/handlers.SendMessage" into its package and function
+func splitFunction(name string) (module, function string) {
+	slash := strings.LastIndex(name, "/")
+	dot := strings.Index(name[slash+1:], ".")
+	if dot < 0 {
+		return "", name
+	}
+	return name[:slash+1+dot], name[slash+2+dot:]
+}
@@ -3,14 +3,24 @@ package dht
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
+	"wave_capacitor/logging"
+	"wave_capacitor/tracing"
+	"wave_capacitor/utils"
 )
 
+// logger logs DHT membership and server failures
+var logger = logging.Component("dht")
+
 // ServiceInfo contains information about a service in the DHT
 type ServiceInfo struct {
 	NodeID     NodeID            `json:"node_id"`
@@ -30,7 +40,8 @@ type DHT struct {
 	localNode   *Node
 	routingTable *RoutingTable
 	services     map[string]ServiceInfo // Services by service ID
-	privateKey   []byte                 // Node's private key
+	values       *valueStore            // Values stored for other nodes
+	privateKey   *utils.LockedBuffer    // Node's Ed25519 private key (locked in memory)
 	config       *DHTConfig             // DHT configuration
 	httpClient   *http.Client           // HTTP client for node communication
 	server       *http.Server           // HTTP server for node API
@@ -48,6 +59,13 @@ type DHTConfig struct {
 	NodeType        string        // "capacitor" or "locker"
 	NumShards       int           // Number of shards for this node
 	StoreDir        string        // Directory to store DHT data
+	UseTLS          bool          // Serve and call other nodes over HTTPS
+	CertFile        string        // TLS certificate when UseTLS is set
+	KeyFile         string        // TLS key when UseTLS is set
+	ServerTLS       *tls.Config   // Mutual TLS of the server, replacing CertFile and KeyFile
+	ClientTLS       *tls.Config   // Mutual TLS of calls to other nodes
+	HTTPClient      *http.Client  // Client of calls to other nodes, shared with federation; replaces ClientTLS
+	SlowLookup      time.Duration // Lookups and RPCs taking longer are logged; 0 disables it
 }
 
 // NewDHT creates a new DHT instance
@@ -69,19 +87,38 @@ func NewDHT(cfg *DHTConfig) (*DHT, error) {
 		return nil, fmt.Errorf("failed to create node: %v", err)
 	}
 	
+	// Move the private key into locked memory; the original slice is zeroized
+	lockedKey, err := utils.NewLockedBufferFrom(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to protect node key: %v", err)
+	}
+	
 	// Initialize DHT
 	dht := &DHT{
 		localNode:    node,
 		routingTable: NewRoutingTable(node.ID),
 		services:     make(map[string]ServiceInfo),
-		privateKey:   privateKey,
+		values:       newValueStore(),
+		privateKey:   lockedKey,
 		config:       cfg,
 		httpClient: &http.Client{
-			Timeout: 10 * time.Second,
+			Timeout:   10 * time.Second,
+			Transport: tracing.Transport(nil),
 		},
 		shutdown: make(chan struct{}),
 	}
 	
+	// Use the client shared with federation, or present the node certificate to other
+	// nodes with mutual TLS
+	if cfg.HTTPClient != nil {
+		dht.httpClient = cfg.HTTPClient
+	} else if cfg.ClientTLS != nil {
+		dht.httpClient.Transport = tracing.Transport(&http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: cfg.ClientTLS,
+		})
+	}
+	
 	return dht, nil
 }
 
@@ -117,6 +154,9 @@ func (dht *DHT) Stop() error {
 	// Wait for all background tasks to complete
 	dht.wg.Wait()
 	
+	// Wipe the node key
+	dht.privateKey.Destroy()
+	
 	return nil
 }
 
@@ -131,7 +171,7 @@ func (dht *DHT) bootstrap() error {
 	for _, addr := range dht.config.BootstrapNodes {
 		if err := dht.addBootstrapNode(addr); err != nil {
 			// Log the error but continue with other nodes
-			fmt.Printf("Failed to add bootstrap node %s: %v\n", addr, err)
+			logger.Warn(context.Background(), "adding bootstrap node failed", "address", addr, "error", err)
 		}
 	}
 	
@@ -171,6 +211,8 @@ func (dht *DHT) addBootstrapNode(addr string) error {
 
 // FindNode performs a Kademlia FIND_NODE operation
 func (dht *DHT) FindNode(targetID NodeID) error {
+	defer dht.logIfSlow("find_node", time.Now(), "target", targetID.String())
+
 	// Get alpha closest nodes from routing table
 	closestNodes := dht.routingTable.GetClosestContacts(targetID, Alpha)
 	if len(closestNodes) == 0 {
@@ -255,7 +297,9 @@ func (dht *DHT) FindNode(targetID NodeID) error {
 
 // findNodeRPC performs a FIND_NODE RPC call to another node
 func (dht *DHT) findNodeRPC(contact Contact, targetID NodeID) ([]Contact, error) {
-	url := fmt.Sprintf("http://%s/dht/findnode", contact.Address)
+	defer dht.logIfSlow("find_node_rpc", time.Now(), "target", targetID.String(), "peer", contact.Address)
+
+	url := dht.nodeURL(contact, "/dht/findnode")
 	
 	// Create the request
 	req, err := http.NewRequest("GET", url, nil)
@@ -292,9 +336,19 @@ func (dht *DHT) findNodeRPC(contact Contact, targetID NodeID) ([]Contact, error)
 	return result.Contacts, nil
 }
 
+// logIfSlow logs an operation started at start that took longer than SlowLookup
+func (dht *DHT) logIfSlow(op string, start time.Time, attrs ...interface{}) {
+	elapsed := time.Since(start)
+	if dht.config.SlowLookup <= 0 || elapsed < dht.config.SlowLookup {
+		return
+	}
+	attrs = append([]interface{}{"op", op, "duration_ms", elapsed.Milliseconds()}, attrs...)
+	logger.Warn(context.Background(), "slow DHT lookup", attrs...)
+}
+
 // pingNode pings a node to get its information
 func (dht *DHT) pingNode(contact Contact) (*ServiceInfo, error) {
-	url := fmt.Sprintf("http://%s/dht/ping", contact.Address)
+	url := dht.nodeURL(contact, "/dht/ping")
 	
 	// Send the request
 	resp, err := dht.httpClient.Get(url)
@@ -317,6 +371,16 @@ func (dht *DHT) pingNode(contact Contact) (*ServiceInfo, error) {
 	return &info, nil
 }
 
+// nodeURL builds the URL of an endpoint on another node; every node of a network is
+// expected to use the same scheme
+func (dht *DHT) nodeURL(contact Contact, path string) string {
+	scheme := "http"
+	if dht.config.UseTLS {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, contact.Address, path)
+}
+
 // startServer starts the HTTP server for DHT communication
 func (dht *DHT) startServer() error {
 	mux := http.NewServeMux()
@@ -329,14 +393,23 @@ func (dht *DHT) startServer() error {
 	
 	// Create server
 	dht.server = &http.Server{
-		Addr:    dht.config.ListenAddr,
-		Handler: mux,
+		Addr:      dht.config.ListenAddr,
+		Handler:   tracing.Handler(mux),
+		TLSConfig: dht.config.ServerTLS,
 	}
 	
 	// Start server in a goroutine
 	go func() {
-		if err := dht.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			fmt.Printf("HTTP server error: %v\n", err)
+		var err error
+		if dht.config.ServerTLS != nil {
+			err = dht.server.ListenAndServeTLS("", "")
+		} else if dht.config.UseTLS {
+			err = dht.server.ListenAndServeTLS(dht.config.CertFile, dht.config.KeyFile)
+		} else {
+			err = dht.server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error(context.Background(), "DHT HTTP server failed", "error", err)
 		}
 	}()
 	
@@ -392,18 +465,6 @@ func (dht *DHT) handleFindNode(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// Handler for /dht/findvalue (stub)
-func (dht *DHT) handleFindValue(w http.ResponseWriter, r *http.Request) {
-	// This would be implemented for a full DHT
-	http.Error(w, "Not implemented", http.StatusNotImplemented)
-}
-
-// Handler for /dht/store (stub)
-func (dht *DHT) handleStore(w http.ResponseWriter, r *http.Request) {
-	// This would be implemented for a full DHT
-	http.Error(w, "Not implemented", http.StatusNotImplemented)
-}
-
 // Background tasks
 
 // refreshRoutingTable periodically refreshes the routing table
@@ -445,7 +506,7 @@ func (dht *DHT) republishServices() {
 	}
 }
 
-// expireContacts periodically expires old contacts
+// expireContacts periodically expires old contacts and stored values
 func (dht *DHT) expireContacts() {
 	defer dht.wg.Done()
 	
@@ -456,6 +517,7 @@ func (dht *DHT) expireContacts() {
 		select {
 		case <-ticker.C:
 			// This would expire old contacts
+			dht.values.expire()
 			
 		case <-dht.shutdown:
 			return
@@ -508,4 +570,29 @@ func (dht *DHT) FindServicesByType(serviceType string) ([]ServiceInfo, error) {
 	// In a full implementation, we would also search the DHT
 	
 	return result, nil
-}
\ No newline at end of file
+}
+
+// KnownPeers returns the contacts of the routing table
+func (dht *DHT) KnownPeers() []Contact {
+	return dht.routingTable.Contacts()
+}
+
+// PingNode pings the node at address and returns its information; a node that doesn't
+// answer reports false with the error
+func (dht *DHT) PingNode(address string) (bool, *ServiceInfo, error) {
+	info, err := dht.pingNode(Contact{Address: address})
+	if err != nil {
+		return false, nil, err
+	}
+	return true, info, nil
+}
+
+// RoutingTableSize returns how many contacts the routing table holds
+func (dht *DHT) RoutingTableSize() int {
+	return dht.routingTable.Size()
+}
+
+// LocalNode returns this node
+func (dht *DHT) LocalNode() *Node {
+	return dht.localNode
+}
@@ -30,7 +30,7 @@ type KBucket struct {
 	mutex    sync.RWMutex
 	contacts *list.List    // Ordered list of contacts
 	lastSeen time.Time     // Last time this bucket was updated
-	range    struct {       // Range of node IDs in this bucket
+	idRange  struct {       // Range of node IDs in this bucket
 		min, max NodeID
 	}
 }
@@ -43,8 +43,8 @@ func NewKBucket() *KBucket {
 	}
 	// Initialize min to all 1s and max to all 0s (will be replaced)
 	for i := 0; i < 20; i++ {
-		kb.range.min[i] = 0xFF
-		kb.range.max[i] = 0x00
+		kb.idRange.min[i] = 0xFF
+		kb.idRange.max[i] = 0x00
 	}
 	return kb
 }
@@ -71,11 +71,11 @@ func (kb *KBucket) AddContact(contact Contact) bool {
 		kb.contacts.PushBack(contact)
 		kb.lastSeen = time.Now()
 		// Update ID range for the bucket
-		if lessThan(contact.ID, kb.range.min) {
-			kb.range.min = contact.ID
+		if lessThan(contact.ID, kb.idRange.min) {
+			kb.idRange.min = contact.ID
 		}
-		if lessThan(kb.range.max, contact.ID) {
-			kb.range.max = contact.ID
+		if lessThan(kb.idRange.max, contact.ID) {
+			kb.idRange.max = contact.ID
 		}
 		return true
 	}
@@ -224,6 +224,18 @@ func (rt *RoutingTable) Size() int {
 	return total
 }
 
+// Contacts returns every contact of the routing table, bucket by bucket
+func (rt *RoutingTable) Contacts() []Contact {
+	rt.mutex.RLock()
+	defer rt.mutex.RUnlock()
+
+	var contacts []Contact
+	for _, bucket := range rt.buckets {
+		contacts = append(contacts, bucket.GetContacts(K)...)
+	}
+	return contacts
+}
+
 // lessThan compares two NodeIDs lexicographically
 func lessThan(a, b NodeID) bool {
 	for i := 0; i < len(a); i++ {
@@ -0,0 +1,49 @@
+package dht
+
+import (
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// benchContacts returns contacts with random IDs
+func benchContacts(count int) []Contact {
+	contacts := make([]Contact, count)
+	for i := range contacts {
+		rand.Read(contacts[i].ID[:])
+		contacts[i].Address = fmt.Sprintf("10.0.%d.%d:4000", i/256%256, i%256)
+		contacts[i].LastSeen = time.Now()
+	}
+	return contacts
+}
+
+// BenchmarkAddContact times adding contacts to a routing table, most of them to full buckets
+func BenchmarkAddContact(b *testing.B) {
+	var local NodeID
+	rand.Read(local[:])
+	table := NewRoutingTable(local)
+	contacts := benchContacts(4096)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.AddContact(contacts[i%len(contacts)])
+	}
+}
+
+// BenchmarkClosestContacts times finding the contacts closest to a target, done by every
+// DHT lookup and the FIND_NODE requests of peers
+func BenchmarkClosestContacts(b *testing.B) {
+	var local NodeID
+	rand.Read(local[:])
+	table := NewRoutingTable(local)
+	for _, contact := range benchContacts(4096) {
+		table.AddContact(contact)
+	}
+	targets := benchContacts(256)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.GetClosestContacts(targets[i%len(targets)].ID, K)
+	}
+}
@@ -0,0 +1,319 @@
+// dht/values.go - Values published under a key to the nodes closest to it
+package dht
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxValueSize is the largest value a node stores
+	MaxValueSize = 4096
+
+	// MaxValuesPerKey is how many values, from different slots, a node keeps per key; a
+	// new slot replaces the value expiring first
+	MaxValuesPerKey = 16
+
+	// MaxValueKeys is how many keys a node stores values for
+	MaxValueKeys = 100000
+
+	// MaxValueTTL is the longest a node keeps a value before it has to be published again
+	MaxValueTTL = 7 * 24 * time.Hour
+)
+
+// ErrValueStoreFull is returned when a node already stores values for MaxValueKeys keys
+var ErrValueStoreFull = errors.New("value store full")
+
+// StoredValue is a value kept for a key. Publishers name a slot so that publishing again
+// replaces their previous value instead of adding one.
+type StoredValue struct {
+	Slot      string    `json:"slot"`
+	Value     []byte    `json:"value"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// storeValueRequest is the body of /dht/store
+type storeValueRequest struct {
+	Key        string `json:"key"`
+	Slot       string `json:"slot"`
+	Value      []byte `json:"value"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+}
+
+// valueStore holds the values this node stores for others, in memory
+type valueStore struct {
+	mu     sync.Mutex
+	values map[NodeID][]StoredValue
+}
+
+func newValueStore() *valueStore {
+	return &valueStore{values: make(map[NodeID][]StoredValue)}
+}
+
+// put stores value under key, replacing the value of the same slot
+func (s *valueStore) put(key NodeID, value StoredValue) error {
+	if len(value.Value) > MaxValueSize {
+		return fmt.Errorf("value larger than %d bytes", MaxValueSize)
+	}
+	if value.Slot == "" {
+		return errors.New("value has no slot")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values, ok := s.values[key]
+	if !ok && len(s.values) >= MaxValueKeys {
+		return ErrValueStoreFull
+	}
+	for i := range values {
+		if values[i].Slot == value.Slot {
+			values[i] = value
+			return nil
+		}
+	}
+	if len(values) < MaxValuesPerKey {
+		s.values[key] = append(values, value)
+		return nil
+	}
+	first := 0
+	for i := range values {
+		if values[i].ExpiresAt.Before(values[first].ExpiresAt) {
+			first = i
+		}
+	}
+	values[first] = value
+	return nil
+}
+
+// get returns the unexpired values of key
+func (s *valueStore) get(key NodeID) []StoredValue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var values []StoredValue
+	for _, value := range s.values[key] {
+		if value.ExpiresAt.After(now) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// expire forgets expired values
+func (s *valueStore) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for key, values := range s.values {
+		kept := values[:0]
+		for _, value := range values {
+			if value.ExpiresAt.After(now) {
+				kept = append(kept, value)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.values, key)
+		} else {
+			s.values[key] = kept
+		}
+	}
+}
+
+// StoreValue publishes value under key in the slot, on this node and the K nodes closest
+// to the key, for ttl (at most MaxValueTTL). Nodes that can't be reached are logged; the
+// value is published as long as this node stored it.
+func (dht *DHT) StoreValue(ctx context.Context, key NodeID, slot string, value []byte, ttl time.Duration) error {
+	defer dht.logIfSlow("store_value", time.Now(), "key", key.String())
+
+	ttl = min(ttl, MaxValueTTL)
+	if err := dht.values.put(key, StoredValue{Slot: slot, Value: value, ExpiresAt: time.Now().Add(ttl)}); err != nil {
+		return err
+	}
+
+	// Walk towards the key first, so the closest nodes are in the routing table
+	if err := dht.FindNode(key); err != nil {
+		logger.Debug(ctx, "no DHT contacts to store value on", "key", key.String(), "error", err)
+		return nil
+	}
+	body, err := json.Marshal(storeValueRequest{Key: key.String(), Slot: slot, Value: value, TTLSeconds: int64(ttl / time.Second)})
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, contact := range dht.routingTable.GetClosestContacts(key, K) {
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+			if err := dht.storeValueRPC(ctx, c, body); err != nil {
+				logger.Debug(ctx, "storing value on peer failed", "key", key.String(), "peer", c.Address, "error", err)
+			}
+		}(contact)
+	}
+	wg.Wait()
+	return nil
+}
+
+// FindValues returns the unexpired values published under key, from this node and the K
+// nodes closest to the key; of values in the same slot, the one expiring last is kept
+func (dht *DHT) FindValues(ctx context.Context, key NodeID) ([][]byte, error) {
+	defer dht.logIfSlow("find_values", time.Now(), "key", key.String())
+
+	var mu sync.Mutex
+	bySlot := make(map[string]StoredValue)
+	merge := func(values []StoredValue) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, value := range values {
+			if existing, ok := bySlot[value.Slot]; !ok || value.ExpiresAt.After(existing.ExpiresAt) {
+				bySlot[value.Slot] = value
+			}
+		}
+	}
+	merge(dht.values.get(key))
+
+	var wg sync.WaitGroup
+	for _, contact := range dht.routingTable.GetClosestContacts(key, K) {
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+			values, err := dht.findValueRPC(ctx, c, key)
+			if err != nil {
+				logger.Debug(ctx, "finding value on peer failed", "key", key.String(), "peer", c.Address, "error", err)
+				return
+			}
+			merge(values)
+		}(contact)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	values := make([][]byte, 0, len(bySlot))
+	for _, value := range bySlot {
+		if value.ExpiresAt.After(now) && len(value.Value) <= MaxValueSize {
+			values = append(values, value.Value)
+		}
+	}
+	return values, nil
+}
+
+// storeValueRPC sends a STORE call to another node
+func (dht *DHT) storeValueRPC(ctx context.Context, contact Contact, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dht.nodeURL(contact, "/dht/store"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := dht.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// findValueRPC sends a FIND_VALUE call to another node
+func (dht *DHT) findValueRPC(ctx context.Context, contact Contact, key NodeID) ([]StoredValue, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dht.nodeURL(contact, "/dht/findvalue"), nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	q.Add("key", key.String())
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := dht.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Values []StoredValue `json:"values"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MaxValuesPerKey*2*MaxValueSize)).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Values, nil
+}
+
+// Handler for /dht/store
+func (dht *DHT) handleStore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req storeValueRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*MaxValueSize)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	key, ok := parseNodeID(req.Key)
+	if !ok {
+		http.Error(w, "Invalid key", http.StatusBadRequest)
+		return
+	}
+	if req.TTLSeconds <= 0 {
+		http.Error(w, "Invalid ttl_seconds", http.StatusBadRequest)
+		return
+	}
+
+	// The value expires by this node's clock, whatever the publisher's says
+	ttl := min(time.Duration(req.TTLSeconds)*time.Second, MaxValueTTL)
+	err := dht.values.put(key, StoredValue{Slot: req.Slot, Value: req.Value, ExpiresAt: time.Now().Add(ttl)})
+	if errors.Is(err, ErrValueStoreFull) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for /dht/findvalue
+func (dht *DHT) handleFindValue(w http.ResponseWriter, r *http.Request) {
+	key, ok := parseNodeID(r.URL.Query().Get("key"))
+	if !ok {
+		http.Error(w, "Invalid key", http.StatusBadRequest)
+		return
+	}
+
+	values := dht.values.get(key)
+	if values == nil {
+		values = []StoredValue{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"values": values,
+	})
+}
+
+// parseNodeID parses the hex form of a NodeID
+func parseNodeID(s string) (NodeID, bool) {
+	var id NodeID
+	if len(s) != hex.EncodedLen(len(id)) {
+		return id, false
+	}
+	if _, err := hex.Decode(id[:], []byte(s)); err != nil {
+		return id, false
+	}
+	return id, true
+}
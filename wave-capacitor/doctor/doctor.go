@@ -0,0 +1,272 @@
+// Package doctor runs one-off diagnostics of a node's environment (database, storage,
+// DHT bootstrap nodes, certificates, clock and configuration) and reports each as pass,
+// warn or fail, for "capacitor doctor" and GET /api/admin/doctor.
+package doctor
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"wave_capacitor/config"
+)
+
+// Result states, from the best to the worst
+const (
+	StatusPass = "pass"
+	StatusWarn = "warn"
+	StatusFail = "fail"
+)
+
+// checkTimeout bounds one check
+const checkTimeout = 10 * time.Second
+
+// Thresholds of the certificate and clock checks
+const (
+	certExpiryWarning = 14 * 24 * time.Hour
+	clockSkewWarning  = 2 * time.Second
+	clockSkewFailure  = 30 * time.Second // beyond this tokens are rejected as not yet valid or expired early
+)
+
+// Check diagnoses one aspect of the node and returns its status with an explanation
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) (status, message string)
+}
+
+// Result is the outcome of one check
+type Result struct {
+	Name       string `json:"name"`
+	Status     string `json:"status" doc:"pass, warn or fail"`
+	Message    string `json:"message"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// Report lists the results of every check; Status is the worst of them
+type Report struct {
+	Status  string    `json:"status" doc:"pass, warn or fail: the worst result"`
+	Results []Result  `json:"results"`
+	RanAt   time.Time `json:"ran_at"`
+}
+
+// Run runs the checks one after the other
+func Run(ctx context.Context, checks []Check) Report {
+	report := Report{Status: StatusPass, Results: make([]Result, 0, len(checks)), RanAt: time.Now()}
+	for _, check := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+		start := time.Now()
+		status, message := check.Run(checkCtx)
+		cancel()
+
+		report.Results = append(report.Results, Result{
+			Name:       check.Name,
+			Status:     status,
+			Message:    message,
+			DurationMs: time.Since(start).Milliseconds(),
+		})
+		if severity(status) > severity(report.Status) {
+			report.Status = status
+		}
+	}
+	return report
+}
+
+func severity(status string) int {
+	switch status {
+	case StatusWarn:
+		return 1
+	case StatusFail:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// Database checks that the database answers
+func Database(ping func(ctx context.Context) error) Check {
+	return Check{Name: "database", Run: func(ctx context.Context) (string, string) {
+		if err := ping(ctx); err != nil {
+			return StatusFail, fmt.Sprintf("database unreachable: %v", err)
+		}
+		return StatusPass, "database reachable"
+	}}
+}
+
+// Writable checks that a file can be created in dir, as message writes do
+func Writable(name, dir string) Check {
+	return Check{Name: name, Run: func(ctx context.Context) (string, string) {
+		info, err := os.Stat(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			return StatusWarn, fmt.Sprintf("%s does not exist yet; it is created on the first write", dir)
+		}
+		if err != nil {
+			return StatusFail, err.Error()
+		}
+		if !info.IsDir() {
+			return StatusFail, fmt.Sprintf("%s is not a directory", dir)
+		}
+
+		probe, err := os.CreateTemp(dir, ".doctor-*")
+		if err != nil {
+			return StatusFail, fmt.Sprintf("%s is not writable: %v", dir, err)
+		}
+		probe.Close()
+		os.Remove(probe.Name())
+		return StatusPass, fmt.Sprintf("%s is writable", dir)
+	}}
+}
+
+// Bootstrap checks that the DHT bootstrap nodes answer pings; some unreachable nodes
+// warn, none reachable fails. clientTLS, when set, is the node's mutual TLS.
+func Bootstrap(nodes []string, useTLS bool, clientTLS *tls.Config) Check {
+	return Check{Name: "dht_bootstrap", Run: func(ctx context.Context) (string, string) {
+		if len(nodes) == 0 {
+			return StatusPass, "no bootstrap nodes configured, this node starts the network"
+		}
+		scheme := "http"
+		if useTLS {
+			scheme = "https"
+		}
+		client := http.DefaultClient
+		if clientTLS != nil {
+			client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: clientTLS}}
+		}
+
+		var unreachable []string
+		for _, node := range nodes {
+			if err := pingNode(ctx, client, scheme+"://"+node+"/dht/ping"); err != nil {
+				unreachable = append(unreachable, fmt.Sprintf("%s (%v)", node, err))
+			}
+		}
+		switch {
+		case len(unreachable) == len(nodes):
+			return StatusFail, "no bootstrap node reachable: " + strings.Join(unreachable, ", ")
+		case len(unreachable) > 0:
+			return StatusWarn, fmt.Sprintf("%d of %d bootstrap nodes unreachable: %s", len(unreachable), len(nodes), strings.Join(unreachable, ", "))
+		}
+		return StatusPass, fmt.Sprintf("all %d bootstrap nodes reachable", len(nodes))
+	}}
+}
+
+// pingNode requests a node's /dht/ping endpoint
+func pingNode(ctx context.Context, client *http.Client, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var info json.RawMessage
+	return json.NewDecoder(resp.Body).Decode(&info)
+}
+
+// Certificate checks that the PEM file at path holds a certificate that is valid now and
+// for at least two more weeks. A missing file fails unless optional, e.g. a Let's Encrypt
+// certificate that has not been issued yet.
+func Certificate(name, path string, optional bool) Check {
+	return Check{Name: name, Run: func(ctx context.Context) (string, string) {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) && optional {
+			return StatusWarn, fmt.Sprintf("%s does not exist yet", path)
+		}
+		if err != nil {
+			return StatusFail, err.Error()
+		}
+
+		cert, err := firstCertificate(data)
+		if err != nil {
+			return StatusFail, fmt.Sprintf("%s: %v", path, err)
+		}
+		now := time.Now()
+		switch {
+		case now.Before(cert.NotBefore):
+			return StatusFail, fmt.Sprintf("%s is not valid before %s", path, cert.NotBefore.Format(time.RFC3339))
+		case now.After(cert.NotAfter):
+			return StatusFail, fmt.Sprintf("%s expired on %s", path, cert.NotAfter.Format(time.RFC3339))
+		case cert.NotAfter.Sub(now) < certExpiryWarning:
+			return StatusWarn, fmt.Sprintf("%s expires on %s", path, cert.NotAfter.Format(time.RFC3339))
+		}
+		return StatusPass, fmt.Sprintf("%s valid until %s", path, cert.NotAfter.Format(time.RFC3339))
+	}}
+}
+
+// firstCertificate parses the first certificate of a PEM file, which may also hold a key
+func firstCertificate(data []byte) (*x509.Certificate, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no PEM certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return x509.ParseCertificate(block.Bytes)
+		}
+	}
+}
+
+// AutocertCertificate checks the Let's Encrypt certificate of domain in the autocert cache
+func AutocertCertificate(cacheDir, domain string) Check {
+	return Certificate("tls_certificate", filepath.Join(cacheDir, domain), true)
+}
+
+// ClockSkew compares the local clock with a reference clock, such as the database's;
+// tokens and message timestamps assume the nodes agree on the time
+func ClockSkew(reference string, now func(ctx context.Context) (time.Time, error)) Check {
+	return Check{Name: "clock_skew", Run: func(ctx context.Context) (string, string) {
+		start := time.Now()
+		remote, err := now(ctx)
+		if err != nil {
+			return StatusWarn, fmt.Sprintf("unable to read the %s clock: %v", reference, err)
+		}
+		// Assume the reference read its clock halfway through the round trip
+		elapsed := time.Since(start)
+		skew := start.Add(elapsed / 2).Sub(remote)
+		if skew < 0 {
+			skew = -skew
+		}
+		skew = skew.Round(time.Millisecond)
+
+		switch {
+		case skew >= clockSkewFailure:
+			return StatusFail, fmt.Sprintf("local clock is %s off the %s clock", skew, reference)
+		case skew >= clockSkewWarning:
+			return StatusWarn, fmt.Sprintf("local clock is %s off the %s clock", skew, reference)
+		}
+		return StatusPass, fmt.Sprintf("local clock within %s of the %s clock", skew, reference)
+	}}
+}
+
+// Config reports the findings of the configuration validation; fatal findings fail
+func Config(validate func() []config.Problem) Check {
+	return Check{Name: "config", Run: func(ctx context.Context) (string, string) {
+		var fatal, warnings []string
+		for _, problem := range validate() {
+			if problem.Fatal {
+				fatal = append(fatal, problem.Message)
+			} else {
+				warnings = append(warnings, problem.Message)
+			}
+		}
+		switch {
+		case len(fatal) > 0:
+			return StatusFail, strings.Join(append(fatal, warnings...), "; ")
+		case len(warnings) > 0:
+			return StatusWarn, strings.Join(warnings, "; ")
+		}
+		return StatusPass, "configuration valid"
+	}}
+}
@@ -0,0 +1,222 @@
+// Package health runs the node's component checks (database, storage, DHT) in the
+// background and turns their results into readiness and liveness verdicts for probes.
+package health
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+	"wave_capacitor/logging"
+)
+
+// logger logs check failures and recoveries
+var logger = logging.Component("health")
+
+// Component states
+const (
+	StatusOK      = "ok"
+	StatusFailing = "failing" // failed recently, but fewer times in a row than the threshold
+	StatusDown    = "down"
+)
+
+// Check reports whether one component works; a nil error means healthy
+type Check func(ctx context.Context) error
+
+// Options configures a Monitor
+type Options struct {
+	Interval time.Duration // between check rounds
+	Timeout  time.Duration // per check
+
+	// ReadinessThreshold is how many consecutive failures take a component down, making
+	// the node unready
+	ReadinessThreshold int
+	// LivenessThreshold is how many consecutive failures of a component make the node
+	// report itself dead so it gets restarted; 0 keeps component failures out of liveness
+	LivenessThreshold int
+}
+
+// Component is the latest result of one check
+type Component struct {
+	Name                string    `json:"name"`
+	Status              string    `json:"status"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	Error               string    `json:"-"` // logged rather than exposed to unauthenticated probes
+	LatencyMs           int64     `json:"latency_ms"`
+	CheckedAt           time.Time `json:"checked_at,omitempty"`
+}
+
+// Report is the verdict of a probe with the components behind it
+type Report struct {
+	Healthy    bool        `json:"healthy"`
+	Components []Component `json:"components"`
+}
+
+// Monitor runs registered checks every interval and caches the results, so probes never
+// wait on a dependency
+type Monitor struct {
+	opts   Options
+	checks map[string]Check
+	stop   chan struct{}
+	done   chan struct{}
+
+	mu         sync.Mutex
+	components map[string]*Component
+	lastRound  time.Time
+}
+
+// NewMonitor creates a monitor; register checks with Add, then call Start
+func NewMonitor(opts Options) *Monitor {
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 3 * time.Second
+	}
+	if opts.ReadinessThreshold <= 0 {
+		opts.ReadinessThreshold = 1
+	}
+	return &Monitor{
+		opts:       opts,
+		checks:     make(map[string]Check),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		components: make(map[string]*Component),
+	}
+}
+
+// Add registers a component check; components are unready until checked once
+func (m *Monitor) Add(name string, check Check) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checks[name] = check
+	m.components[name] = &Component{Name: name, Status: StatusDown, Error: "not checked yet"}
+}
+
+// Start runs a first round of checks and keeps checking in the background until Stop
+func (m *Monitor) Start() {
+	m.runChecks()
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(m.opts.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				m.runChecks()
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the background checks
+func (m *Monitor) Stop() {
+	close(m.stop)
+	<-m.done
+}
+
+// runChecks runs every check concurrently and records the results
+func (m *Monitor) runChecks() {
+	m.mu.Lock()
+	checks := make(map[string]Check, len(m.checks))
+	for name, check := range m.checks {
+		checks[name] = check
+	}
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), m.opts.Timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(ctx)
+			m.record(name, err, time.Since(start))
+		}(name, check)
+	}
+	wg.Wait()
+
+	m.mu.Lock()
+	m.lastRound = time.Now()
+	m.mu.Unlock()
+}
+
+// record updates a component with the outcome of its check
+func (m *Monitor) record(name string, err error, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	component := m.components[name]
+	component.CheckedAt = time.Now()
+	component.LatencyMs = latency.Milliseconds()
+	if err == nil {
+		if component.Status == StatusDown && component.ConsecutiveFailures > 0 {
+			logger.Info(context.Background(), "health check recovered", "check", name)
+		}
+		component.Status = StatusOK
+		component.ConsecutiveFailures = 0
+		component.Error = ""
+		return
+	}
+
+	component.ConsecutiveFailures++
+	component.Error = err.Error()
+	component.Status = StatusFailing
+	if component.ConsecutiveFailures >= m.opts.ReadinessThreshold {
+		if component.ConsecutiveFailures == m.opts.ReadinessThreshold {
+			logger.Error(context.Background(), "health check keeps failing, node is unready", "check", name,
+				"consecutive_failures", component.ConsecutiveFailures, "error", err)
+		}
+		component.Status = StatusDown
+	} else {
+		logger.Warn(context.Background(), "health check failed", "check", name, "error", err)
+	}
+}
+
+// Readiness reports whether the node should receive traffic: no component is down
+func (m *Monitor) Readiness() Report {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	report := Report{Healthy: true, Components: m.snapshot()}
+	for _, component := range report.Components {
+		if component.Status == StatusDown {
+			report.Healthy = false
+		}
+	}
+	return report
+}
+
+// Liveness reports whether the node works well enough to keep running: the checks are
+// still making progress, and no component exceeded the liveness threshold
+func (m *Monitor) Liveness() Report {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// A round that takes longer than a few intervals means the process is wedged
+	report := Report{Healthy: time.Since(m.lastRound) < 3*m.opts.Interval+m.opts.Timeout, Components: m.snapshot()}
+	if m.opts.LivenessThreshold > 0 {
+		for _, component := range report.Components {
+			if component.ConsecutiveFailures >= m.opts.LivenessThreshold {
+				report.Healthy = false
+			}
+		}
+	}
+	return report
+}
+
+// snapshot copies the components sorted by name; m.mu must be held
+func (m *Monitor) snapshot() []Component {
+	components := make([]Component, 0, len(m.components))
+	for _, component := range m.components {
+		components = append(components, *component)
+	}
+	sort.Slice(components, func(i, j int) bool { return components[i].Name < components[j].Name })
+	return components
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"wave_capacitor/config"
+	"wave_capacitor/middleware"
+)
+
+// Operations timed by the load test
+const (
+	loadOpRegister = "register"
+	loadOpSend     = "send_message"
+	loadOpFetch    = "get_messages"
+)
+
+// loadUser is an account registered for the load test
+type loadUser struct {
+	username  string
+	password  string
+	token     string
+	publicKey string
+}
+
+// loadClient makes the API requests of the load test against one node
+type loadClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// loadStats collects the latency of every request, by operation
+type loadStats struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+	lastError map[string]string
+}
+
+// loadResult summarizes one operation of the load test
+type loadResult struct {
+	Operation string  `json:"operation"`
+	Requests  int     `json:"requests"`
+	Errors    int     `json:"errors"`
+	PerSecond float64 `json:"per_second"`
+	P50Ms     float64 `json:"p50_ms"`
+	P90Ms     float64 `json:"p90_ms"`
+	P99Ms     float64 `json:"p99_ms"`
+	MaxMs     float64 `json:"max_ms"`
+	LastError string  `json:"last_error,omitempty"`
+}
+
+// runLoadTest simulates users sending and fetching messages against a running node and
+// reports the latency percentiles of each operation. It registers its own accounts and
+// deletes them afterwards unless --keep is given; point it at a test node, whose auth
+// and send rate limits are raised so that they don't throttle the simulated users.
+func runLoadTest(cfg *config.Config, args []string) {
+	flags := commandFlags("loadtest")
+	scheme := "http"
+	if cfg.UseTLS {
+		scheme = "https"
+	}
+	baseURL := flags.String("url", scheme+"://localhost:"+cfg.Port, "Base URL of the node")
+	users := flags.Int("users", 10, "Simulated users, each sending and fetching in turn")
+	duration := flags.Duration("duration", 30*time.Second, "How long the users run")
+	rate := flags.Float64("rate", 0, "Requests per second of each user; 0 sends as fast as the node answers")
+	fetchRatio := flags.Float64("fetch-ratio", 0.5, "Share of the requests fetching messages rather than sending one")
+	size := flags.Int("size", 1024, "Bytes of ciphertext in each message")
+	insecure := flags.Bool("insecure", false, "Skip verification of the node's TLS certificate")
+	keep := flags.Bool("keep", false, "Keep the registered accounts instead of deleting them")
+	asJSON := flags.Bool("json", false, "Print the results as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 0 || *users < 1 || *duration <= 0 || *rate < 0 || *fetchRatio < 0 || *fetchRatio > 1 || *size < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = *users
+	if *insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	client := &loadClient{baseURL: *baseURL + middleware.CurrentAPIPrefix, client: &http.Client{Transport: transport, Timeout: 30 * time.Second}}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	stats := &loadStats{latencies: make(map[string][]time.Duration), errors: make(map[string]int), lastError: make(map[string]string)}
+
+	accounts, err := client.registerUsers(ctx, *users, stats)
+	if err != nil {
+		if !*keep {
+			client.deleteUsers(accounts)
+		}
+		log.Fatalf("❌ %v", err)
+	}
+	if !*keep {
+		defer client.deleteUsers(accounts)
+	}
+	log.Printf("✅ Registered %d users, running for %s", len(accounts), *duration)
+
+	payload := loadPayload(*size)
+	runCtx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+	started := time.Now()
+	var wg sync.WaitGroup
+	for i := range accounts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client.simulateUser(runCtx, accounts, i, *rate, *fetchRatio, payload, stats)
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(started)
+
+	results := stats.results(elapsed)
+	if *asJSON {
+		out, _ := json.MarshalIndent(results, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+	fmt.Printf("%-14s %9s %7s %9s %9s %9s %9s %9s\n", "operation", "requests", "errors", "req/s", "p50 ms", "p90 ms", "p99 ms", "max ms")
+	for _, result := range results {
+		fmt.Printf("%-14s %9d %7d %9.1f %9.1f %9.1f %9.1f %9.1f\n", result.Operation, result.Requests, result.Errors,
+			result.PerSecond, result.P50Ms, result.P90Ms, result.P99Ms, result.MaxMs)
+	}
+	for _, result := range results {
+		if result.LastError != "" {
+			log.Printf("⚠️ %s: %d errors, the last: %s", result.Operation, result.Errors, result.LastError)
+		}
+	}
+}
+
+// loadPayload returns base64 ciphertext of size random bytes; the node stores it as given
+func loadPayload(size int) string {
+	data := make([]byte, size)
+	rand.Read(data)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// registerUsers registers count accounts named after a random run prefix, waiting out
+// the auth rate limit when the node applies it
+func (lc *loadClient) registerUsers(ctx context.Context, count int, stats *loadStats) ([]loadUser, error) {
+	prefix := make([]byte, 4)
+	rand.Read(prefix)
+	accounts := make([]loadUser, 0, count)
+	for i := 0; i < count; i++ {
+		secret := make([]byte, 16)
+		rand.Read(secret)
+		user := loadUser{username: fmt.Sprintf("loadtest_%s_%d", hex.EncodeToString(prefix), i), password: hex.EncodeToString(secret)}
+
+		var resp struct {
+			Token     string `json:"token"`
+			PublicKey string `json:"public_key"`
+		}
+		for {
+			start := time.Now()
+			status, retryAfter, err := lc.do(ctx, http.MethodPost, "/register", "", map[string]string{"username": user.username, "password": user.password}, &resp)
+			if status == http.StatusTooManyRequests {
+				log.Printf("⚠️ Registration is rate limited, retrying in %s", retryAfter)
+				select {
+				case <-time.After(retryAfter):
+					continue
+				case <-ctx.Done():
+					return accounts, ctx.Err()
+				}
+			}
+			stats.record(loadOpRegister, time.Since(start), err)
+			if err != nil {
+				return accounts, fmt.Errorf("registering %s: %w", user.username, err)
+			}
+			break
+		}
+		user.token, user.publicKey = resp.Token, resp.PublicKey
+		accounts = append(accounts, user)
+	}
+	return accounts, nil
+}
+
+// deleteUsers deletes the accounts registered for the load test
+func (lc *loadClient) deleteUsers(accounts []loadUser) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, user := range accounts {
+		if _, _, err := lc.do(ctx, http.MethodPost, "/delete_account", user.token, nil, nil); err != nil {
+			log.Printf("⚠️ Failed to delete %s: %v", user.username, err)
+		}
+	}
+}
+
+// simulateUser has one account send messages to random other accounts and fetch its
+// own, at the given rate, until ctx ends
+func (lc *loadClient) simulateUser(ctx context.Context, accounts []loadUser, self int, rate, fetchRatio float64, payload string, stats *loadStats) {
+	random := mathrand.New(mathrand.NewSource(time.Now().UnixNano() + int64(self)))
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	user := accounts[self]
+	for ctx.Err() == nil {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		start := time.Now()
+		if random.Float64() < fetchRatio {
+			var resp struct {
+				Messages []json.RawMessage `json:"messages"`
+			}
+			_, _, err := lc.do(ctx, http.MethodGet, "/get_messages?limit=50", user.token, nil, &resp)
+			stats.record(loadOpFetch, time.Since(start), ctxError(ctx, err))
+			continue
+		}
+		recipient := accounts[random.Intn(len(accounts))]
+		req := map[string]string{
+			"recipient_pubkey":      recipient.publicKey,
+			"ciphertext_kem":        payload[:min(len(payload), 1024)],
+			"ciphertext_msg":        payload,
+			"nonce":                 payload[:min(len(payload), 16)],
+			"sender_ciphertext_kem": payload[:min(len(payload), 1024)],
+			"sender_ciphertext_msg": payload,
+			"sender_nonce":          payload[:min(len(payload), 16)],
+		}
+		_, _, err := lc.do(ctx, http.MethodPost, "/send_message", user.token, req, nil)
+		stats.record(loadOpSend, time.Since(start), ctxError(ctx, err))
+	}
+}
+
+// ctxError drops errors of requests cut short because the run ended
+func ctxError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// do sends a JSON request and decodes the response into out, returning the status and
+// the Retry-After of a throttled request. Responses other than 2xx are errors.
+func (lc *loadClient) do(ctx context.Context, method, path, token string, body, out interface{}) (int, time.Duration, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, 0, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, lc.baseURL+path, reader)
+	if err != nil {
+		return 0, 0, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := lc.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retryAfter := time.Second
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, retryAfter, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(message))
+	}
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+	} else {
+		err = json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode, 0, err
+}
+
+// record adds the latency of one request; failed requests are counted, not timed
+func (s *loadStats) record(op string, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors[op]++
+		s.lastError[op] = err.Error()
+		return
+	}
+	s.latencies[op] = append(s.latencies[op], latency)
+}
+
+// results summarizes each operation; the rates of the simulated ones are over elapsed
+func (s *loadStats) results(elapsed time.Duration) []loadResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var results []loadResult
+	for _, op := range []string{loadOpRegister, loadOpSend, loadOpFetch} {
+		latencies := s.latencies[op]
+		if len(latencies) == 0 && s.errors[op] == 0 {
+			continue
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		result := loadResult{
+			Operation: op,
+			Requests:  len(latencies) + s.errors[op],
+			Errors:    s.errors[op],
+			P50Ms:     percentileMs(latencies, 0.50),
+			P90Ms:     percentileMs(latencies, 0.90),
+			P99Ms:     percentileMs(latencies, 0.99),
+			MaxMs:     percentileMs(latencies, 1),
+			LastError: s.lastError[op],
+		}
+		if op != loadOpRegister {
+			result.PerSecond = float64(result.Requests) / elapsed.Seconds()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// percentileMs returns the p-th percentile of sorted latencies in milliseconds
+func percentileMs(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	index := int(p*float64(len(sorted))+0.5) - 1
+	index = max(0, min(index, len(sorted)-1))
+	return float64(sorted[index].Microseconds()) / 1000
+}
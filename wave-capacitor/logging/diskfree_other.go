@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package logging
+
+import "errors"
+
+// freeDiskBytes is not supported on this platform; log lines are then never sampled
+func freeDiskBytes(path string) (uint64, error) {
+	return 0, errors.New("disk usage is not supported on this platform")
+}
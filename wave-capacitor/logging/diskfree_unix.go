@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package logging
+
+import "syscall"
+
+// freeDiskBytes returns the space available on the filesystem holding path
+func freeDiskBytes(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,189 @@
+package logging
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat names rotated log files, e.g. capacitor.log.20261016-150405
+const backupTimeFormat = "20060102-150405"
+
+// FileOptions configures logging to a file on the node's own disk
+type FileOptions struct {
+	Path           string
+	MaxSize        int64         // bytes before the file is rotated; 0 rotates by time only
+	RotateInterval time.Duration // age of the file before it is rotated; 0 rotates by size only
+	MaxBackups     int           // rotated files kept; 0 keeps all
+	MaxAge         time.Duration // rotated files older than this are deleted; 0 keeps them
+
+	// Below MinFreeBytes of free space on the log volume, debug and info lines are sampled,
+	// keeping one in SampleEvery; warnings and errors are always written. 0 disables it.
+	MinFreeBytes uint64
+	SampleEvery  int
+}
+
+// SetupFile is Setup writing to a rotating file instead of stderr, for nodes without an
+// external log shipper. Text output uses slog's key=value format with a level on every
+// line. The returned function closes the file.
+func SetupFile(format, level string, opts FileOptions) (func(), error) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		minLevel = slog.LevelInfo
+	}
+
+	file, err := OpenRotatingFile(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: minLevel}
+	var handler slog.Handler
+	if strings.EqualFold(format, "json") {
+		handler = slog.NewJSONHandler(file, handlerOpts)
+	} else {
+		handler = slog.NewTextHandler(file, handlerOpts)
+	}
+	if opts.MinFreeBytes > 0 {
+		handler = newSamplingHandler(handler, newLogDiskGuard(filepath.Dir(opts.Path), opts.MinFreeBytes), opts.SampleEvery)
+	}
+	slog.SetDefault(slog.New(handler))
+	log.SetFlags(0)
+
+	return func() { file.Close() }, nil
+}
+
+// RotatingFile is an append-only log file that is renamed aside once it grows past its
+// size limit or gets older than its rotation interval, keeping a bounded number of
+// rotated files
+type RotatingFile struct {
+	opts FileOptions
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// OpenRotatingFile opens (or creates) the log file at opts.Path for appending
+func OpenRotatingFile(opts FileOptions) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(opts.Path), 0750); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
+	f := &RotatingFile{opts: opts}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	f.file, f.size, f.openedAt = file, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends one log line, rotating first when the line would cross a limit
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.dueForRotation(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the current file rather than losing lines
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *RotatingFile) dueForRotation(next int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.opts.MaxSize > 0 && f.size+next > f.opts.MaxSize {
+		return true
+	}
+	return f.opts.RotateInterval > 0 && time.Since(f.openedAt) >= f.opts.RotateInterval
+}
+
+// rotate renames the current file aside, opens a new one and prunes old rotated files
+func (f *RotatingFile) rotate() error {
+	backup := f.opts.Path + "." + time.Now().Format(backupTimeFormat)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			break
+		}
+		backup = fmt.Sprintf("%s.%s.%d", f.opts.Path, time.Now().Format(backupTimeFormat), i)
+	}
+
+	if err := os.Rename(f.opts.Path, backup); err != nil {
+		return err
+	}
+	f.file.Close()
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.prune()
+	return nil
+}
+
+// prune deletes the rotated files beyond MaxBackups or older than MaxAge
+func (f *RotatingFile) prune() {
+	if f.opts.MaxBackups <= 0 && f.opts.MaxAge <= 0 {
+		return
+	}
+
+	backups, err := filepath.Glob(f.opts.Path + ".*")
+	if err != nil {
+		return
+	}
+	// The timestamps sort chronologically; newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+
+	for i, backup := range backups {
+		expired := f.opts.MaxBackups > 0 && i >= f.opts.MaxBackups
+		if !expired && f.opts.MaxAge > 0 {
+			if info, err := os.Stat(backup); err == nil && time.Since(info.ModTime()) > f.opts.MaxAge {
+				expired = true
+			}
+		}
+		if expired {
+			if err := os.Remove(backup); err != nil && !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "removing rotated log file %s failed: %v\n", backup, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,228 @@
+// Package logging provides request scoped structured logging. Lines logged through it
+// carry the ID of the HTTP or gRPC request they belong to, so a request can be followed
+// across log lines and, via the X-Request-ID header, across capacitor nodes. Lines of an
+// authenticated request also carry a hash of the user, and every line the node's ID.
+//
+// Output goes through log/slog, so any slog.Handler can be plugged in with SetLogger
+// (zap and zerolog both provide one). Packages log through a Component logger rather
+// than the log package.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"wave_capacitor/tracing"
+)
+
+// RequestIDHeader carries the request ID on HTTP requests and responses
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds client supplied request IDs
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+type userKey struct{}
+
+// Setup selects the log output format: "json" writes one JSON object per line, anything
+// else keeps the standard log output with key=value attributes. Bare log.Printf calls go
+// through the same handler, at info level in JSON output. level is the lowest level
+// logged ("debug", "info", "warn" or "error"); unknown levels log from info up.
+func Setup(format, level string) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		minLevel = slog.LevelInfo
+	}
+
+	if strings.EqualFold(format, "json") {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: minLevel})))
+		log.SetFlags(0)
+		return
+	}
+	slog.SetLogLoggerLevel(minLevel)
+}
+
+// SetLogger replaces the logger Setup installed, e.g. with one writing through another
+// logging library's slog.Handler. Bare log.Printf calls are routed to it as well.
+func SetLogger(logger *slog.Logger) {
+	slog.SetDefault(logger)
+}
+
+// SetNodeID adds the node's ID to every line logged from now on; call it once the ID is
+// known, after Setup or SetLogger
+func SetNodeID(id string) {
+	slog.SetDefault(slog.Default().With("node_id", id))
+}
+
+// NewRequestID returns a random 128-bit request ID
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ValidRequestID reports whether a client supplied request ID is safe to log and echo
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// WithRequestID returns a context carrying the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by ctx, or "" outside a request
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// WithUser returns a context carrying a hash of the authenticated user, so a user's
+// requests can be correlated without their name appearing in the logs
+func WithUser(ctx context.Context, username string) context.Context {
+	sum := sha256.Sum256([]byte(username))
+	return context.WithValue(ctx, userKey{}, hex.EncodeToString(sum[:8]))
+}
+
+// userHash returns the user hash carried by ctx, or ""
+func userHash(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	hash, _ := ctx.Value(userKey{}).(string)
+	return hash
+}
+
+// Detach returns a background context carrying only the request ID, user and trace of
+// ctx, for work that outlives the request (e.g. a shard import started by it)
+func Detach(ctx context.Context) context.Context {
+	detached := context.Background()
+	if id := RequestID(ctx); id != "" {
+		detached = WithRequestID(detached, id)
+	}
+	if hash := userHash(ctx); hash != "" {
+		detached = context.WithValue(detached, userKey{}, hash)
+	}
+	if traceparent := tracing.TraceParent(ctx); traceparent != "" {
+		detached = tracing.Extract(detached, traceparent)
+	}
+	return detached
+}
+
+// Propagate copies the request ID and trace context of ctx onto an outgoing request to
+// another node
+func Propagate(ctx context.Context, header http.Header) {
+	if id := RequestID(ctx); id != "" {
+		header.Set(RequestIDHeader, id)
+	}
+	tracing.Inject(ctx, header)
+}
+
+// FromContext returns the default logger annotated with the request ID and user hash of
+// ctx and, when the request is traced, its trace ID
+func FromContext(ctx context.Context) *slog.Logger {
+	logger := slog.Default()
+	if id := RequestID(ctx); id != "" {
+		logger = logger.With("request_id", id)
+	}
+	if hash := userHash(ctx); hash != "" {
+		logger = logger.With("user", hash)
+	}
+	if traceID := tracing.TraceIDFromContext(ctx); traceID != "" {
+		logger = logger.With("trace_id", traceID)
+	}
+	return logger
+}
+
+// Debugf logs a formatted message at debug level
+func Debugf(ctx context.Context, format string, args ...interface{}) {
+	logger := FromContext(ctx)
+	if logger.Enabled(ctx, slog.LevelDebug) {
+		logger.Debug(fmt.Sprintf(format, args...))
+	}
+}
+
+// Infof logs a formatted message at info level
+func Infof(ctx context.Context, format string, args ...interface{}) {
+	FromContext(ctx).Info(fmt.Sprintf(format, args...))
+}
+
+// Warnf logs a formatted message at warning level
+func Warnf(ctx context.Context, format string, args ...interface{}) {
+	FromContext(ctx).Warn(fmt.Sprintf(format, args...))
+}
+
+// Errorf logs a formatted message at error level
+func Errorf(ctx context.Context, format string, args ...interface{}) {
+	FromContext(ctx).Error(fmt.Sprintf(format, args...))
+}
+
+// Logger logs the lines of one component (e.g. "storage") with key-value attributes.
+// It resolves the logger installed by Setup or SetLogger on every call, so package level
+// Component loggers created before Setup log through the configured output.
+type Logger struct {
+	component string
+}
+
+// Component returns the logger of a component
+func Component(name string) Logger {
+	return Logger{component: name}
+}
+
+// log writes one line; args are alternating keys and values as with slog.Logger.Info.
+// ctx may be nil for work outside any request.
+func (l Logger) log(ctx context.Context, level slog.Level, msg string, args []interface{}) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	logger := FromContext(ctx)
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	logger.With("component", l.component).Log(ctx, level, msg, args...)
+}
+
+// Debug logs at debug level
+func (l Logger) Debug(ctx context.Context, msg string, args ...interface{}) {
+	l.log(ctx, slog.LevelDebug, msg, args)
+}
+
+// Info logs at info level
+func (l Logger) Info(ctx context.Context, msg string, args ...interface{}) {
+	l.log(ctx, slog.LevelInfo, msg, args)
+}
+
+// Warn logs at warning level
+func (l Logger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	l.log(ctx, slog.LevelWarn, msg, args)
+}
+
+// Error logs at error level
+func (l Logger) Error(ctx context.Context, msg string, args ...interface{}) {
+	l.log(ctx, slog.LevelError, msg, args)
+}
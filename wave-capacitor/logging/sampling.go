@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// diskCheckInterval is how long a free-space measurement of the log volume is reused
+const diskCheckInterval = 5 * time.Second
+
+// logDiskGuard tracks whether the log volume is below its free-space low-water mark
+type logDiskGuard struct {
+	path         string
+	minFreeBytes uint64
+
+	mu        sync.Mutex
+	checkedAt atomic.Int64 // Unix nanoseconds of the last measurement
+	low       atomic.Bool
+}
+
+func newLogDiskGuard(path string, minFreeBytes uint64) *logDiskGuard {
+	return &logDiskGuard{path: path, minFreeBytes: minFreeBytes}
+}
+
+// check reports whether free space is low and whether that changed with this call. It
+// measures at most every diskCheckInterval, and never makes a log call wait for another
+// one's measurement.
+func (g *logDiskGuard) check() (low, changed bool) {
+	if time.Now().UnixNano()-g.checkedAt.Load() < int64(diskCheckInterval) || !g.mu.TryLock() {
+		return g.low.Load(), false
+	}
+	defer g.mu.Unlock()
+
+	g.checkedAt.Store(time.Now().UnixNano())
+	free, err := freeDiskBytes(g.path)
+	if err != nil {
+		// Don't drop lines on a measuring error
+		low = false
+	} else {
+		low = free < g.minFreeBytes
+	}
+	return low, g.low.Swap(low) != low
+}
+
+// samplingHandler writes every line while the log volume has room and, once it runs
+// low, only warnings, errors and one in every sampleEvery other lines
+type samplingHandler struct {
+	next        slog.Handler
+	guard       *logDiskGuard
+	sampleEvery uint64
+	seen        *atomic.Uint64 // lines below warning level seen while low, shared with derived handlers
+}
+
+func newSamplingHandler(next slog.Handler, guard *logDiskGuard, sampleEvery int) *samplingHandler {
+	if sampleEvery < 1 {
+		sampleEvery = 1
+	}
+	return &samplingHandler{next: next, guard: guard, sampleEvery: uint64(sampleEvery), seen: new(atomic.Uint64)}
+}
+
+func (h *samplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, record slog.Record) error {
+	low, changed := h.guard.check()
+	if changed {
+		h.announce(ctx, low)
+	}
+	if low && record.Level < slog.LevelWarn && (h.seen.Add(1)-1)%h.sampleEvery != 0 {
+		return nil
+	}
+	return h.next.Handle(ctx, record)
+}
+
+// announce logs entering and leaving sampled mode
+func (h *samplingHandler) announce(ctx context.Context, low bool) {
+	var record slog.Record
+	if low {
+		record = slog.NewRecord(time.Now(), slog.LevelWarn, "log volume low on free space, sampling debug and info lines", 0)
+		record.AddAttrs(slog.Int("sample_every", int(h.sampleEvery)))
+	} else {
+		record = slog.NewRecord(time.Now(), slog.LevelInfo, "log volume has free space again, writing all lines", 0)
+	}
+	record.AddAttrs(slog.String("component", "logging"), slog.Uint64("min_free_bytes", h.guard.minFreeBytes))
+	h.next.Handle(ctx, record)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{next: h.next.WithAttrs(attrs), guard: h.guard, sampleEvery: h.sampleEvery, seen: h.seen}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{next: h.next.WithGroup(name), guard: h.guard, sampleEvery: h.sampleEvery, seen: h.seen}
+}
@@ -2,35 +2,132 @@
 package main
 
 import (
+	
+	
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/gofiber/fiber/v2/middleware/compress"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
-	
-	"wave-capacitor/config"
-	"wave-capacitor/dht"
-	"wave-capacitor/models"
-	"wave-capacitor/routes"
-	
-	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
+	"wave_capacitor/alerting"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/api/grpcapi"
+	"wave_capacitor/api/handlers"
+	"wave_capacitor/config"
+	"wave_capacitor/crashreport"
+	"wave_capacitor/dht/dht"
+	"wave_capacitor/health"
+	"wave_capacitor/logging"
+	"wave_capacitor/middleware"
+	"wave_capacitor/models"
+	"wave_capacitor/nodeca"
+	"wave_capacitor/nodehttp"
+	"wave_capacitor/outbox"
+	"wave_capacitor/routes"
+	"wave_capacitor/schedule"
+	"wave_capacitor/secrets"
+	"wave_capacitor/storage"
+	"wave_capacitor/telemetry"
+	"wave_capacitor/tracing"
+	"wave_capacitor/utils"
+	"wave_capacitor/version"
+	"wave_capacitor/webhooks"
 )
 
 func main() {
 	// Starting Wave Capacitor...
 	log.Println("🔹 Starting Wave Capacitor with DHT support")
 
+	// Command-line flags take precedence over the environment
+	dataDir := flag.String("data-dir", "", "Root directory for all node data (overrides DATA_DIR)")
+	checkConfig := flag.Bool("check-config", false, "Validate the configuration and exit")
+	flag.Usage = usage
+	flag.Parse()
+	if *dataDir != "" {
+		os.Setenv("DATA_DIR", *dataDir)
+	}
+	
 	// Load configuration
-	config.LoadConfig()
+	cfg := config.LoadConfig()
+	closeLog := initializeLogging(cfg)
+	log.Printf("📁 Data directory: %s", config.DataDir)
+	
+	// Resolve node secrets (JWT secret, master key, confusion salt)
+	if err := cfg.LoadSecrets(); err != nil {
+		log.Fatalf("❌ Failed to load secrets: %v", err)
+	}
+	
+	// Wrap the private keys stored for accounts with the configured key
+	if err := initializePrivateKeyWrap(cfg); err != nil {
+		log.Fatalf("❌ Failed to load the private key wrap key: %v", err)
+	}
+
+	// Verify the crypto stack before accepting any traffic
+	if err := utils.CryptoSelfTest(); err != nil {
+		log.Fatalf("❌ Crypto self-test failed: %v", err)
+	}
+	log.Println("✅ Crypto self-test passed")
+	
+	// Database pool and query timeouts apply to the server and the migrate command alike
+	models.SetDBOptions(dbOptions(cfg))
+	if cfg.DbSlowQueryMs > 0 {
+		models.SetQueryHook(slowQueryLogger(time.Duration(cfg.DbSlowQueryMs) * time.Millisecond))
+	}
+	middleware.SetSlowRequestThreshold(time.Duration(cfg.SlowRequestMs) * time.Millisecond)
+	storage.SetSlowScanThreshold(time.Duration(cfg.SlowScanMs) * time.Millisecond)
+	
+	// Operator commands run instead of the server (see commands.go)
+	if name := flag.Arg(0); name != "" && name != "serve" {
+		runCommand(cfg, name, flag.Args()[1:])
+		return
+	}
 	
 	// Load DHT configuration
 	dhtConfig := config.LoadDHTConfig()
 	
+	// Show what the profile, environment and secrets resolved to, once per node
+	if !fiber.IsChild() {
+		logEffectiveConfig(cfg)
+	}
+	
+	// Refuse to serve with insecure or contradictory settings
+	configValid := reportConfigProblems(cfg.Validate(dhtConfig))
+	if *checkConfig {
+		if !configValid {
+			os.Exit(1)
+		}
+		log.Println("✅ Configuration is valid")
+		return
+	}
+	if !configValid {
+		log.Fatalf("❌ Invalid configuration, see above (run with --check-config to validate without starting)")
+	}
+	
+	// Export spans before anything that records them is started
+	stopTracing := initializeTracing(cfg)
+	initializeCrashReporting(cfg)
+	
 	// Create the DHT storage directory
 	if err := dhtConfig.MakeDHTStorageDirectory(); err != nil {
 		log.Fatalf("❌ Failed to create DHT storage directory: %v", err)
@@ -41,27 +138,82 @@ func main() {
 		log.Fatalf("❌ Database initialization failed: %v", err)
 	}
 	log.Println("✅ Database initialized")
+	stopWriteBehind := models.StartWriteBehind()
+	certWatcher := initializeCertWatcher(cfg)
+	stopLeaderElection := initializeLeaderElection(cfg)
+	
+	// Initialize at-rest encryption and message storage
+	keyRing, err := initializeKeyRing(cfg)
+	if err != nil {
+		log.Fatalf("❌ At-rest encryption initialization failed: %v", err)
+	}
+	diskGuard := storage.NewDiskGuard(config.DataDir, uint64(cfg.MinFreeDiskMB)*1024*1024, float64(cfg.MinFreeDiskPercent))
+	handlers.SetDiskGuard(diskGuard)
+	messageStore := initializeMessageStore(cfg, keyRing, diskGuard)
+	handlers.SetMessageStore(messageStore)
+	handlers.SetMessageReadWorkers(cfg.MessageReadWorkers)
+	handlers.SetContactStore(initializeContactStore(cfg, messageStore, keyRing))
+	initializeBackupSigningKey(cfg)
+	initializeStoredBackups(cfg)
+	scrubber := initializeScrubber(cfg, messageStore)
+	stopRetention := initializeRetention(cfg)
+	registerAdminJobs(cfg, messageStore, scrubber)
+	handlers.SetDoctorChecks(doctorChecks(cfg, dhtConfig, messageStore))
+	middleware.SetJWTSecret(cfg.GetJWTSecret())
+	handlers.SetConfig(cfg)
+	middleware.SetTransferToken(cfg.ShardTransferToken)
+	middleware.SetAdminToken(cfg.AdminToken)
+	initializeRateLimiter(cfg)
+	middleware.SetBodyLimits(middleware.BodyLimits{
+		Default: cfg.BodyLimitDefaultKB * 1024,
+		User:    cfg.BodyLimitUserKB * 1024,
+		Backup:  cfg.BodyLimitBackupMB * 1024 * 1024,
+	})
+	middleware.SetIdempotencyTTL(time.Duration(cfg.IdempotencyTTLSeconds) * time.Second)
+	webhookDispatcher := initializeWebhooks(cfg)
+	secretWatcher := initializeSecretWatcher(cfg, webhookDispatcher)
+	if cfg.MaintenanceMode {
+		status := middleware.SetMaintenanceMode(true, cfg.MaintenanceMessage)
+		log.Printf("🚧 Starting in maintenance mode: %s", status.Message)
+	}
 	
-	// Initialize DHT
-	dht, err := initializeDHT(dhtConfig)
+	// Initialize DHT, with mutual TLS between nodes when configured
+	initializeNodeHTTP(cfg)
+	nodeTLS := initializeNodeTLS(cfg)
+	dht, err := initializeDHT(dhtConfig, time.Duration(cfg.SlowDHTMs)*time.Millisecond, nodeTLS)
 	if err != nil {
 		log.Fatalf("❌ DHT initialization failed: %v", err)
 	}
 	log.Printf("✅ DHT initialized with node ID: %s", dht.LocalNode().ID.String())
+	logging.SetNodeID(dht.LocalNode().ID.String())
+	stopSnapshots := initializeSnapshots(cfg, dht, dhtConfig.UseSSL)
+	initializeLockerOffload(cfg, dht, dhtConfig.UseSSL)
+	initializeDiscovery(cfg, dht, dhtConfig)
 	
 	// Create a new Fiber instance
-	app := fiber.New(fiber.Config{
-		AppName: "Wave Capacitor v1.0",
-	})
+	app := fiber.New(fiberConfig(cfg))
+	handlers.SetConnectionCounter(app.Server().GetOpenConnectionsCount)
+
+	// Orchestrator probes come before all middleware
+	routes.SetupProbes(app)
 
-	// Add middleware
+	// Add middleware; compression wraps everything else so it sees the final body,
+	// then the request ID comes first so every later log line carries it
+	if compression := responseCompression(cfg); compression != nil {
+		app.Use(compression)
+	}
+	app.Use(middleware.RequestID)
+	app.Use(middleware.Tracing)
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "*",
 		AllowMethods:     "GET,POST,PUT,DELETE",
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, X-Request-ID, If-None-Match, Idempotency-Key",
+		ExposeHeaders:    "Deprecation, Sunset, Link, X-Request-ID, ETag, Idempotent-Replayed",
 		AllowCredentials: true,
 	}))
-	app.Use(logger.New())
+	app.Use(middleware.RequestLogger)
+	app.Use(middleware.Recover)
+	app.Use(middleware.GlobalRateLimit)
 
 	// Root endpoint for API info
 	app.Get("/", func(c *fiber.Ctx) error {
@@ -71,19 +223,39 @@ func main() {
 			"node_id": dht.LocalNode().ID.String(),
 			"node_type": "capacitor",
 			"endpoints": []string{
-				"/api/register",
-				"/api/login",
-				"/api/recover_account",
-				"/api/logout",
-				"/api/get_public_key",
-				"/api/get_encrypted_private_key",
-				"/api/send_message",
-				"/api/get_messages",
-				"/api/add_contact",
-				"/api/get_contacts",
-				"/api/remove_contact",
-				"/api/backup_account",
-				"/api/delete_account",
+				"/api/v1/register",
+				"/api/v1/login",
+				"/api/v1/recover_account",
+				"/api/v1/logout",
+				"/api/v1/change_username",
+				"/api/v1/get_public_key",
+				"/api/v1/get_encrypted_private_key",
+				"/api/v1/rotate_keys",
+				"/api/v1/key_history",
+				"/api/v1/resolve_key",
+				"/api/v1/upload_prekeys",
+				"/api/v1/claim_prekey",
+				"/api/v1/prekey_status",
+				"/api/v1/session",
+				"/api/v1/sessions",
+				"/api/v1/send_message",
+				"/api/v1/get_messages",
+				"/api/v1/unread_count",
+				"/api/v1/mark_read",
+				"/api/v1/add_contact",
+				"/api/v1/get_contacts",
+				"/api/v1/remove_contact",
+				"/api/v1/backup_account",
+				"/api/v1/webhooks",
+				"/api/v1/delete_account",
+				"/api/v1/shards/:shard/export",
+				"/api/v1/shards/import",
+				"/api/v1/admin/maintenance",
+				"/api/v1/version",
+				"/api/v1/openapi.json",
+				"/healthz",
+				"/readyz",
+				"/livez",
 				"/dht/status", // New DHT status endpoint
 			},
 			"status": "Online",
@@ -105,19 +277,13 @@ func main() {
 	app.Get("/dht/ping", func(c *fiber.Ctx) error {
 		address := c.Query("address")
 		if address == "" {
-			return c.Status(400).JSON(fiber.Map{
-				"success": false,
-				"error": "Missing address parameter",
-			})
+			return apierror.Respond(c, fiber.StatusBadRequest, "", "Missing address parameter", nil)
 		}
 		
 		// Ping the node
 		success, nodeInfo, err := dht.PingNode(address)
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{
-				"success": false,
-				"error": err.Error(),
-			})
+			return apierror.Respond(c, fiber.StatusInternalServerError, "", err.Error(), nil)
 		}
 		
 		return c.JSON(fiber.Map{
@@ -132,10 +298,7 @@ func main() {
 		
 		services, err := dht.FindServicesByType(serviceType)
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{
-				"success": false,
-				"error": err.Error(),
-			})
+			return apierror.Respond(c, fiber.StatusInternalServerError, "", err.Error(), nil)
 		}
 		
 		return c.JSON(fiber.Map{
@@ -145,33 +308,74 @@ func main() {
 	})
 
 	// Setup API routes
+	routes.SetDocsUI(cfg.DocsUI)
+	routes.SetDebugEndpoints(cfg.DebugEndpoints)
+	middleware.SetLegacySunset(cfg.LegacyAPISunset)
 	routes.SetupRoutes(app)
 
 	// Create required directories for message and contact storage
 	config.EnsureDirectoriesExist()
 
-	// Register this service in the DHT
-	registerCapacitorService(dht, dhtConfig)
-	
-	// Start the DHT
-	if err := dht.Start(); err != nil {
-		log.Fatalf("❌ Failed to start DHT: %v", err)
+	// With prefork every child process runs main as well; only the parent joins the DHT
+	if !fiber.IsChild() {
+		// Register this service in the DHT
+		registerCapacitorService(dht, dhtConfig)
+		
+		// Start the DHT
+		if err := dht.Start(); err != nil {
+			log.Fatalf("❌ Failed to start DHT: %v", err)
+		}
+		log.Println("✅ DHT service started")
 	}
-	log.Println("✅ DHT service started")
+	stopRoutePublishing := initializeRouting(cfg, dht, dhtConfig)
+	stopFederationQueue := initializeFederationQueue(cfg, keyRing)
+	stopReplication := initializeReplication(cfg, dht, keyRing)
+	stopPresence := initializePresence(cfg)
+	
+	// Check the components behind /readyz and /livez now that everything is up
+	healthMonitor := initializeHealth(cfg, dht, dhtConfig, diskGuard)
+	
+	// Notify the operator when disk space, the database or the queues need attention
+	alerts := initializeAlerting(cfg, diskGuard, webhookDispatcher)
+	
+	// Report anonymous usage statistics when the operator opted in
+	usageReporter := initializeTelemetry(cfg, dht)
 	
 	// Create a channel to listen for shutdown signals
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	
+	// Serve HTTPS when configured, with plain HTTP redirecting to it
+	port := cfg.GetPort()
+	tlsConfig, redirect := initializeTLS(cfg, port)
+	if nodeTLS != nil {
+		// Other nodes present their certificate to the API port as well
+		nodeTLS.RequestClientCertificates(tlsConfig)
+	}
+	var redirectServer *http.Server
+	if !fiber.IsChild() {
+		redirectServer = startRedirectServer(cfg.RedirectPort, redirect)
+	}
+	
+	// fasthttp only speaks HTTP/1.1; HTTP/2 goes through net/http instead
+	var h2Server *http.Server
+	if cfg.HTTP2Enabled {
+		h2Server = newHTTP2Server(app, cfg, tlsConfig)
+	}
+	
 	// Start the server in a goroutine
 	go func() {
 		// Start the server
-		port := config.GetPort()
-		log.Printf("🚀 Wave Capacitor running on http://localhost:%s", port)
-		if err := app.Listen(":" + port); err != nil {
+		if err := serve(app, cfg, port, tlsConfig, h2Server); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("❌ Server failed: %v", err)
 		}
 	}()
+
+	// Serve the gRPC API next to the REST API
+	var grpcServer *grpc.Server
+	if !fiber.IsChild() {
+		grpcServer = startGRPCServer(dhtConfig.GRPCPort)
+	}
 	
 	// Block until we receive a shutdown signal
 	<-quit
@@ -187,15 +391,160 @@ func main() {
 	}
 	
 	// Shutdown the server
-	if err := app.ShutdownWithContext(ctx); err != nil {
+	if h2Server != nil {
+		if err := h2Server.Shutdown(ctx); err != nil {
+			log.Fatalf("❌ Server shutdown failed: %v", err)
+		}
+	} else if err := app.ShutdownWithContext(ctx); err != nil {
 		log.Fatalf("❌ Server shutdown failed: %v", err)
 	}
+	if redirectServer != nil {
+		redirectServer.Shutdown(ctx)
+	}
+	
+	// Stop the gRPC server, letting in-flight calls finish
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+
+	// Write the updates still queued now that no request adds more
+	stopWriteBehind()
+
+	// Stop watching the database client certificate and secret files
+	if certWatcher != nil {
+		certWatcher.Stop()
+	}
+	if secretWatcher != nil {
+		secretWatcher.Stop()
+	}
+
+	// Stop the health checks and alerts
+	healthMonitor.Stop()
+	if alerts != nil {
+		alerts.Stop()
+	}
+	if usageReporter != nil {
+		usageReporter.Stop()
+	}
+
+	// Stop the integrity scrubber
+	if scrubber != nil {
+		scrubber.Stop()
+	}
+
+	// Stop deleting old messages
+	if stopRetention != nil {
+		stopRetention()
+	}
+	
+	// Stop scheduling snapshots
+	if stopSnapshots != nil {
+		stopSnapshots()
+	}
+	
+	// Stop republishing route records
+	if stopRoutePublishing != nil {
+		stopRoutePublishing()
+	}
+	
+	// Stop sending queued messages; they are sent after the restart
+	if stopFederationQueue != nil {
+		stopFederationQueue()
+	}
+	
+	// Stop replicating mailboxes
+	if stopReplication != nil {
+		stopReplication()
+	}
+
+	// Stop gossiping presence
+	if stopPresence != nil {
+		stopPresence()
+	}
+
+	// Hand leadership over now that the singleton jobs stopped
+	if stopLeaderElection != nil {
+		stopLeaderElection()
+	}
+
+	// Finish in-flight webhook deliveries
+	if webhookDispatcher != nil {
+		webhookDispatcher.Stop()
+	}
+	
+	// Stop storage tiering
+	if tiered, ok := messageStore.(*storage.TieredMessageStore); ok {
+		tiered.Stop()
+	}
+	
+	// Close embedded storage
+	if closer, ok := messageStore.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("⚠️ Error closing message store: %v", err)
+		}
+	}
+	
+	// Export the remaining spans
+	if stopTracing != nil {
+		stopTracing()
+	}
+	
+	// Wipe the master key from memory
+	if keyRing != nil {
+		keyRing.Destroy()
+	}
 	
 	log.Println("👋 Server gracefully stopped")
+	closeLog()
+}
+
+// startGRPCServer serves the gRPC API on port; 0 disables it
+func startGRPCServer(port int) *grpc.Server {
+	if port <= 0 {
+		log.Println("⚠️ gRPC API disabled (GRPC_PORT=0)")
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatalf("❌ Failed to listen for gRPC on port %d: %v", port, err)
+	}
+
+	server := grpcapi.NewServer()
+	go func() {
+		log.Printf("🚀 gRPC API listening on :%d", port)
+		if err := server.Serve(listener); err != nil {
+			log.Printf("⚠️ gRPC server stopped: %v", err)
+		}
+	}()
+	return server
+}
+
+// logEffectiveConfig logs every setting of cfg and its source with secrets redacted
+func logEffectiveConfig(cfg *config.Config) {
+	log.Printf("⚙️ Effective configuration (%s profile):", cfg.Profile)
+	for _, setting := range cfg.Effective() {
+		log.Printf("   %s=%s (%s)", setting.Name, setting.Value, setting.Source)
+	}
+}
+
+// reportConfigProblems logs the findings of config validation and reports whether none
+// of them is fatal
+func reportConfigProblems(problems []config.Problem) bool {
+	valid := true
+	for _, problem := range problems {
+		if problem.Fatal {
+			log.Printf("❌ %s", problem.Message)
+			valid = false
+		} else {
+			log.Printf("⚠️ %s", problem.Message)
+		}
+	}
+	return valid
 }
 
 // initializeDHT initializes the DHT service for the capacitor
-func initializeDHT(cfg *config.DHTConfig) (*dht.DHT, error) {
+func initializeDHT(cfg *config.DHTConfig, slowLookup time.Duration, nodeTLS *nodeca.Identity) (*dht.DHT, error) {
 	// Create DHT configuration
 	dhtCfg := &dht.DHTConfig{
 		BootstrapNodes:  cfg.BootstrapNodes,
@@ -206,58 +555,1450 @@ func initializeDHT(cfg *config.DHTConfig) (*dht.DHT, error) {
 		NodeType:        "capacitor", // Explicitly set as capacitor
 		NumShards:       cfg.NumShards,
 		StoreDir:        cfg.StoragePath,
+		UseTLS:          cfg.UseSSL,
+		CertFile:        cfg.CertFile,
+		KeyFile:         cfg.KeyFile,
+		SlowLookup:      slowLookup,
+		HTTPClient:      nodehttp.NewClient(10 * time.Second),
+	}
+	if nodeTLS != nil {
+		dhtCfg.ServerTLS = nodeTLS.ServerConfig()
 	}
 	
 	// Create DHT instance
 	return dht.NewDHT(dhtCfg)
 }
 
-// registerCapacitorService registers this capacitor as a service in the DHT
-func registerCapacitorService(d *dht.DHT, cfg *config.DHTConfig) {
-	// Create a unique service ID based on node ID
-	serviceID := "capacitor:" + d.LocalNode().ID.String()
+// initializeNodeHTTP tunes the connections to other nodes, which the DHT, federation
+// and the lockers share
+func initializeNodeHTTP(cfg *config.Config) {
+	nodehttp.Configure(nodehttp.Options{
+		MaxIdleConnsPerHost: cfg.NodeHTTPIdleConnsPerPeer,
+		DialTimeout:         time.Duration(cfg.NodeHTTPDialTimeoutSeconds) * time.Second,
+		TLSHandshakeTimeout: time.Duration(cfg.NodeHTTPTLSTimeoutSeconds) * time.Second,
+		IdleConnTimeout:     time.Duration(cfg.NodeHTTPIdleTimeoutSeconds) * time.Second,
+		PeerConcurrency:     cfg.NodeHTTPPeerConcurrency,
+	})
+}
+
+// initializeNodeTLS trusts the capacitors of NODE_ALLOWLIST, loads this node's
+// certificate for mutual TLS with other nodes from NODE_TLS_DIR and makes the node
+// endpoints require one from them. It returns nil when NODE_MTLS is off.
+func initializeNodeTLS(cfg *config.Config) *nodeca.Identity {
+	handlers.SetNodeAllowlist(cfg.AllowedNodes())
+	if !cfg.NodeMTLS {
+		return nil
+	}
 	
-	// Get the external IP
-	externalIP := cfg.ExternalIP
-	if externalIP == "" {
-		// In a production environment, you should implement a proper
-		// external IP detection mechanism
-		externalIP = getOutboundIP().String()
+	identity, err := nodeca.Load(nodeca.NodeFiles(cfg.NodeTLSDir))
+	if err != nil {
+		log.Fatalf("❌ Failed to load the node certificate from %s (see the node-ca command): %v", cfg.NodeTLSDir, err)
+	}
+	handlers.SetNodeTLS(identity.ClientConfig())
+	middleware.SetNodeTLS(true)
+	log.Printf("✅ Node mutual TLS enabled, certificate valid until %s", identity.NotAfter().Format(time.RFC3339))
+	return identity
+}
+
+// initializeTLS returns the TLS configuration of the API server, or nil to serve plain HTTP,
+// and the handler of the plain HTTP redirect port. With USE_AUTOCERT certificates for
+// PUBLIC_DOMAIN are obtained from Let's Encrypt and cached under the certs directory.
+func initializeTLS(cfg *config.Config, port string) (*tls.Config, http.Handler) {
+	switch {
+	case cfg.UseAutoCert:
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.PublicDomain),
+			Cache:      autocert.DirCache(config.CertsDir),
+			Email:      cfg.AcmeEmail,
+		}
+		tlsConfig := manager.TLSConfig()
+		// fasthttp only speaks HTTP/1.1; net/http adds h2 itself when HTTP/2 is enabled
+		tlsConfig.NextProtos = []string{"http/1.1", acme.ALPNProto}
+		tlsConfig.MinVersion = tls.VersionTLS12
+		log.Printf("✅ Let's Encrypt certificates enabled for %s", cfg.PublicDomain)
+		return tlsConfig, manager.HTTPHandler(redirectToHTTPS(cfg.PublicDomain, port))
+
+	case cfg.UseTLS:
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			log.Fatalf("❌ Failed to load TLS certificate: %v", err)
+		}
+		log.Printf("✅ TLS enabled with certificate %s", cfg.CertFile)
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}, redirectToHTTPS(cfg.PublicDomain, port)
+
+	default:
+		log.Println("⚠️ TLS disabled, serving plain HTTP")
+		return nil, nil
+	}
+}
+
+// fiberConfig applies the HTTP server tuning options to the Fiber app
+func fiberConfig(cfg *config.Config) fiber.Config {
+	return fiber.Config{
+		AppName:          "Wave Capacitor v1.0",
+		ErrorHandler:     middleware.ErrorHandler,
+		ReadTimeout:      time.Duration(cfg.HTTPReadTimeoutSeconds) * time.Second,
+		WriteTimeout:     time.Duration(cfg.HTTPWriteTimeoutSeconds) * time.Second,
+		IdleTimeout:      time.Duration(cfg.HTTPIdleTimeoutSeconds) * time.Second,
+		BodyLimit:        cfg.HTTPMaxBodyMB * 1024 * 1024,
+		DisableKeepalive: !cfg.HTTPKeepAlive,
+		Prefork:          cfg.HTTPPrefork,
+	}
+}
+
+// newHTTP2Server serves the app through net/http, which speaks h2 over TLS and h2c with
+// prior knowledge over plain connections, with the same tuning options as Fiber
+func newHTTP2Server(app *fiber.App, cfg *config.Config, tlsConfig *tls.Config) *http.Server {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	server := &http.Server{
+		Handler:           limitBody(adaptor.FiberApp(app), int64(cfg.HTTPMaxBodyMB)*1024*1024),
+		TLSConfig:         tlsConfig,
+		Protocols:         protocols,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Duration(cfg.HTTPReadTimeoutSeconds) * time.Second,
+		WriteTimeout:      time.Duration(cfg.HTTPWriteTimeoutSeconds) * time.Second,
+		IdleTimeout:       time.Duration(cfg.HTTPIdleTimeoutSeconds) * time.Second,
+	}
+	server.SetKeepAlivesEnabled(cfg.HTTPKeepAlive)
+	log.Println("✅ HTTP/2 enabled (h2 and h2c)")
+	return server
+}
+
+// limitBody rejects request bodies over limit bytes, which Fiber's BodyLimit does not see
+// when the app is served through net/http
+func limitBody(next http.Handler, limit int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve runs the API server on port until it is shut down, over TLS when tlsConfig is set
+// and through h2Server when HTTP/2 is enabled
+func serve(app *fiber.App, cfg *config.Config, port string, tlsConfig *tls.Config, h2Server *http.Server) error {
+	scheme, host := "http", "localhost"
+	if tlsConfig != nil {
+		scheme = "https"
+		if cfg.PublicDomain != "" {
+			host = cfg.PublicDomain
+		}
+	}
+	if !fiber.IsChild() {
+		log.Printf("🚀 Wave Capacitor running on %s://%s:%s", scheme, host, port)
+	}
+
+	switch {
+	case h2Server != nil:
+		ln, err := net.Listen("tcp", ":"+port)
+		if err != nil {
+			return err
+		}
+		if tlsConfig != nil {
+			return h2Server.ServeTLS(ln, "", "")
+		}
+		return h2Server.Serve(ln)
+
+	case tlsConfig == nil:
+		return app.Listen(":" + port)
+
+	case tlsConfig.GetCertificate == nil && tlsConfig.ClientCAs == nil:
+		// Certificates from files go through Fiber's own TLS listener, which supports prefork
+		// but doesn't ask for client certificates
+		return app.ListenTLSWithCertificate(":"+port, tlsConfig.Certificates[0])
+
+	default:
+		ln, err := tls.Listen("tcp", ":"+port, tlsConfig)
+		if err != nil {
+			return err
+		}
+		return app.Listener(ln)
+	}
+}
+
+// redirectToHTTPS redirects plain HTTP requests to the same path on the HTTPS port. The
+// public domain, when set, is used instead of the Host header.
+func redirectToHTTPS(domain, port string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := domain
+		if host == "" {
+			host = r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			host = strings.Trim(host, "[]")
+		}
+		if port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// startRedirectServer serves handler on the plain HTTP port; it does nothing when the port
+// is empty or there is nothing to redirect to
+func startRedirectServer(port string, handler http.Handler) *http.Server {
+	if port == "" || handler == nil {
+		return nil
 	}
+
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		log.Printf("🔀 Redirecting HTTP on :%s to HTTPS", port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("⚠️ HTTP redirect server failed: %v", err)
+		}
+	}()
+	return server
+}
+
+// initializeHealth starts the health checks reported by the readiness and liveness probes:
+// the database answers, the message store accepts writes and the DHT found peers
+func initializeHealth(cfg *config.Config, d *dht.DHT, dhtConfig *config.DHTConfig, diskGuard *storage.DiskGuard) *health.Monitor {
+	monitor := health.NewMonitor(health.Options{
+		Interval:           time.Duration(cfg.HealthCheckIntervalSeconds) * time.Second,
+		Timeout:            time.Duration(cfg.HealthCheckTimeoutSeconds) * time.Second,
+		ReadinessThreshold: cfg.ReadinessFailureThreshold,
+		LivenessThreshold:  cfg.LivenessFailureThreshold,
+	})
 	
-	// Create service info
-	info := dht.ServiceInfo{
-		NodeID:     d.LocalNode().ID,
-		NodeType:   "capacitor",
-		Address:    externalIP + ":" + strconv.Itoa(cfg.APIPort),
-		APIPort:    cfg.APIPort,
-		GRPCPort:   cfg.GRPCPort,
-		NumShards:  cfg.NumShards,
-		Version:    "1.0.0",
-		Properties: map[string]string{
-			"environment": os.Getenv("ENVIRONMENT"),
-			"role": "message_processor",
-		},
-		LastSeen:   time.Now(),
+	monitor.Add("database", models.PingDB)
+	monitor.Add("storage", func(ctx context.Context) error {
+		if err := diskGuard.Check(); err != nil {
+			return err
+		}
+		return storage.ProbeWritable(config.MessagesDir)
+	})
+	if !fiber.IsChild() {
+		monitor.Add("dht", func(ctx context.Context) error {
+			// A node without bootstrap nodes is the first of its network and has no one to find
+			if len(dhtConfig.BootstrapNodes) > 0 && d.RoutingTableSize() == 0 {
+				return fmt.Errorf("no peers reachable from %d bootstrap nodes", len(dhtConfig.BootstrapNodes))
+			}
+			return nil
+		})
 	}
 	
-	// Register the service
-	if err := d.RegisterService(serviceID, info); err != nil {
-		log.Printf("⚠️ Failed to register service: %v", err)
-	} else {
-		log.Println("✅ Capacitor service registered in DHT")
+	monitor.Start()
+	handlers.SetHealthMonitor(monitor)
+	log.Printf("✅ Health checks running every %d seconds", cfg.HealthCheckIntervalSeconds)
+	return monitor
+}
+
+// initializeKeyRing loads the node master key when at-rest encryption is enabled.
+// It returns nil if encryption is disabled.
+func initializeKeyRing(cfg *config.Config) (*storage.KeyRing, error) {
+	if !cfg.EncryptAtRest {
+		return nil, nil
+	}
+	
+	masterKey, err := cfg.GetMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	keyRing, err := storage.NewKeyRing(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Keep the retired key available while data keys are re-wrapped after a rotation
+	previousKey, err := cfg.GetPreviousMasterKey()
+	if err != nil {
+		keyRing.Destroy()
+		return nil, fmt.Errorf("invalid previous master key: %v", err)
+	}
+	if previousKey != nil {
+		if err := keyRing.AddPreviousKey(previousKey); err != nil {
+			keyRing.Destroy()
+			return nil, err
+		}
 	}
+	
+	log.Println("✅ At-rest encryption enabled")
+	return keyRing, nil
 }
 
-// getOutboundIP gets the preferred outbound IP of this machine
-func getOutboundIP() net.IP {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+// initializePrivateKeyWrap loads the key wrapping the private keys stored for accounts,
+// and the retired one still accepted when unwrapping keys wrapped before a key change
+func initializePrivateKeyWrap(cfg *config.Config) error {
+	current, previous, err := cfg.GetPrivateKeyWrapKeys()
 	if err != nil {
-		log.Printf("⚠️ Failed to determine outbound IP: %v", err)
-		return net.ParseIP("127.0.0.1")
+		return err
+	}
+	if previous != nil {
+		return utils.SetPrivateKeyWrapKeys(current, previous)
+	}
+	return utils.SetPrivateKeyWrapKeys(current)
+}
+
+// initializeBackupSigningKey loads the key signing backup manifests, creating it on the
+// first start; without it backups are written with unsigned manifests
+func initializeBackupSigningKey(cfg *config.Config) {
+	key, err := utils.LoadOrCreateSigningKey(cfg.BackupSigningKeyFile)
+	if err != nil {
+		log.Printf("⚠️ Backup signing key unavailable, backup manifests will be unsigned: %v", err)
+		return
+	}
+	handlers.SetBackupSigningKey(key)
+}
+
+// initializeStoredBackups sets where users' client-encrypted backups are kept, unless
+// STORED_BACKUP_MAX_PER_USER disables them
+func initializeStoredBackups(cfg *config.Config) {
+	if cfg.StoredBackupMaxPerUser == 0 {
+		handlers.SetStoredBackups(nil, 0)
+		log.Println("⚠️ Stored backups disabled")
+		return
+	}
+	handlers.SetStoredBackups(storage.NewFileBlobStore(cfg.StoredBackupDir), cfg.StoredBackupMaxPerUser)
+}
+
+// initializeDiscovery lets users who opt in find each other through the DHT, unless
+// DISCOVERY_ENABLED is off
+func initializeDiscovery(cfg *config.Config, d *dht.DHT, dhtConfig *config.DHTConfig) {
+	if !cfg.DiscoveryEnabled {
+		handlers.SetDiscovery(nil, "")
+		log.Println("⚠️ Contact discovery disabled")
+		return
+	}
+	handlers.SetDiscovery(dhtValues{d}, capacitorAddress(dhtConfig))
+}
+
+// initializeRouting lets other capacitors find the accounts hosted here: it publishes
+// their route records, and the HANDLE_DOMAIN record, to the DHT and republishes them
+// halfway through ROUTE_TTL_HOURS. It returns the function stopping the republishing, or
+// nil in prefork children.
+func initializeRouting(cfg *config.Config, d *dht.DHT, dhtConfig *config.DHTConfig) func() {
+	handlers.SetRouting(dhtValues{d}, capacitorAddress(dhtConfig))
+	handlers.SetFederationTLS(!cfg.FederationPlainHTTP)
+	handlers.SetHandleDomain(cfg.HandleDomain)
+	handlers.RegisterAdminJob("publish_routes", func(ctx context.Context) (interface{}, error) {
+		return handlers.RunRoutePublishing(ctx)
+	})
+	if fiber.IsChild() {
+		return nil // The parent process publishes
 	}
-	defer conn.Close()
 	
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP
-}
\ No newline at end of file
+	interval := time.Duration(cfg.RouteTTLHours) * time.Hour / 2
+	stop := handlers.StartRoutePublishing(interval)
+	log.Printf("✅ Publishing route records to the DHT every %s", interval)
+	return stop
+}
+
+// initializeFederationQueue queues the messages for capacitors that can't be reached
+// with FEDERATION_QUEUE on, sealed under the master key when messages are encrypted at
+// rest. It returns the function stopping the sending of queued messages, or nil.
+func initializeFederationQueue(cfg *config.Config, keyRing *storage.KeyRing) func() {
+	if !cfg.FederationEnabled || !cfg.FederationQueue {
+		return nil
+	}
+	
+	var encryptor *storage.Encryptor
+	if keyRing != nil {
+		var err error
+		if encryptor, err = keyRing.MasterEncryptor(); err != nil {
+			log.Fatalf("❌ Failed to derive federation queue encryption key: %v", err)
+		}
+	}
+	queue, err := outbox.Open(cfg.FederationQueueDir, encryptor, outbox.Limits{
+		MaxDepth: cfg.FederationQueueMaxDepth,
+		MaxBytes: int64(cfg.FederationQueueMaxMB) * 1024 * 1024,
+	})
+	if err != nil {
+		log.Fatalf("❌ Failed to open the federation queue: %v", err)
+	}
+	handlers.SetFederationQueue(queue, time.Duration(cfg.FederationQueueMaxAgeHours)*time.Hour)
+	if fiber.IsChild() {
+		return nil // The parent process sends what the children queue
+	}
+	
+	stop := handlers.StartFederationQueue()
+	log.Printf("✅ Queueing messages for unreachable capacitors in %s for up to %d hours", cfg.FederationQueueDir, cfg.FederationQueueMaxAgeHours)
+	return stop
+}
+
+// initializeReplication replicates the mailboxes hosted here with MAILBOX_REPLICAS set,
+// and keeps the replicas of other capacitors with MAILBOX_REPLICA_ACCEPT on. It returns
+// the function stopping replication, or nil.
+func initializeReplication(cfg *config.Config, d *dht.DHT, keyRing *storage.KeyRing) func() {
+	if cfg.MailboxReplicaAccept {
+		var encryptor *storage.Encryptor
+		if keyRing != nil {
+			var err error
+			if encryptor, err = keyRing.MasterEncryptor(); err != nil {
+				log.Fatalf("❌ Failed to derive replica encryption key: %v", err)
+			}
+		}
+		handlers.SetReplicaStore(storage.NewFileMessageStore(filepath.Join(config.DataDir, "replicas"), encryptor))
+		log.Println("✅ Accepting mailbox replicas from other capacitors")
+	}
+	if cfg.MailboxReplicas <= 0 {
+		return nil
+	}
+	
+	handlers.SetReplication(cfg.MailboxReplicas, replicaPeers(cfg, d))
+	handlers.RegisterAdminJob("reconcile_replicas", func(ctx context.Context) (interface{}, error) {
+		return handlers.RunReplicaReconciliation(ctx)
+	})
+	handlers.RegisterAdminJob("replica_anti_entropy", func(ctx context.Context) (interface{}, error) {
+		return handlers.RunReplicaAntiEntropy(ctx)
+	})
+	stopReplication := handlers.StartReplication()
+	log.Printf("✅ Replicating mailboxes to %d peer capacitors", cfg.MailboxReplicas)
+	if fiber.IsChild() {
+		return stopReplication // The parent process reconciles
+	}
+	
+	var stopReconciliation, stopAntiEntropy func()
+	if cfg.ReplicaReconcileHours > 0 {
+		stopReconciliation = handlers.StartReplicaReconciliation(time.Duration(cfg.ReplicaReconcileHours) * time.Hour)
+	}
+	if cfg.ReplicaAntiEntropyMinutes > 0 {
+		stopAntiEntropy = handlers.StartReplicaAntiEntropy(time.Duration(cfg.ReplicaAntiEntropyMinutes) * time.Minute)
+		log.Printf("✅ Comparing mailbox digests with their replicas every %d minutes", cfg.ReplicaAntiEntropyMinutes)
+	}
+	return func() {
+		if stopAntiEntropy != nil {
+			stopAntiEntropy()
+		}
+		if stopReconciliation != nil {
+			stopReconciliation()
+		}
+		stopReplication()
+	}
+}
+
+// replicaPeers returns the function listing the capacitors that may hold the replicas of
+// a mailbox, best first: MAILBOX_REPLICA_PEERS ranked by rendezvous hashing on the owner
+// key, or else the capacitors closest to the owner key in the DHT
+func replicaPeers(cfg *config.Config, d *dht.DHT) func(string) []string {
+	if static := cfg.ReplicaPeers(); len(static) > 0 {
+		return func(ownerKey string) []string {
+			weights := make(map[string][]byte, len(static))
+			for _, peer := range static {
+				sum := sha256.Sum256([]byte(peer + "/" + ownerKey))
+				weights[peer] = sum[:]
+			}
+			peers := slices.Clone(static)
+			slices.SortFunc(peers, func(a, b string) int { return bytes.Compare(weights[b], weights[a]) })
+			return peers
+		}
+	}
+	
+	self := d.LocalNode().ID
+	return func(ownerKey string) []string {
+		services, err := d.FindServicesByType("capacitor")
+		if err != nil {
+			return nil
+		}
+		var target dht.NodeID
+		sum := sha256.Sum256([]byte(ownerKey))
+		copy(target[:], sum[:])
+		
+		services = slices.DeleteFunc(services, func(service dht.ServiceInfo) bool { return service.NodeID == self })
+		slices.SortFunc(services, func(a, b dht.ServiceInfo) int {
+			da, db := a.NodeID.Distance(target), b.NodeID.Distance(target)
+			return bytes.Compare(da[:], db[:])
+		})
+		peers := make([]string, 0, len(services))
+		for _, service := range services {
+			peers = append(peers, service.Address)
+		}
+		return peers
+	}
+}
+
+// dhtValues publishes the records of discovery and routing as DHT values
+type dhtValues struct {
+	dht *dht.DHT
+}
+
+func (n dhtValues) StoreValue(ctx context.Context, key [20]byte, slot string, value []byte, ttl time.Duration) error {
+	return n.dht.StoreValue(ctx, dht.NodeID(key), slot, value, ttl)
+}
+
+func (n dhtValues) FindValues(ctx context.Context, key [20]byte) ([][]byte, error) {
+	return n.dht.FindValues(ctx, dht.NodeID(key))
+}
+
+// initializeDataKeys returns the per-file data key manager, or nil if per-file keys are disabled
+func initializeDataKeys(cfg *config.Config, keyRing *storage.KeyRing) *storage.DataKeys {
+	if keyRing == nil || !cfg.PerFileKeys {
+		return nil
+	}
+	return storage.NewDataKeys(keyRing, storage.NewFileDataKeyStore(filepath.Join(config.KeysDir, "data")))
+}
+
+// initializeFolderDerivation keeps the folder names of messages and contacts files in sync
+// with the configured salt and shard count
+func initializeFolderDerivation(cfg *config.Config) {
+	storage.ConfusionSalt = config.ConfusionSalt
+	storage.PreviousConfusionSalt = config.PreviousConfusionSalt
+	storage.GetNumShards = cfg.GetNumShards
+}
+
+// initializeMessageStore creates the message store, encrypting messages if a key ring is configured
+func initializeMessageStore(cfg *config.Config, keyRing *storage.KeyRing, diskGuard *storage.DiskGuard) storage.MessageStore {
+	initializeFolderDerivation(cfg)
+	if config.PreviousConfusionSalt != "" && config.PreviousConfusionSalt != config.ConfusionSalt {
+		log.Println("⚠️ Confusion salt rotation in progress, run the rehash-salt command or rehash job to finish it")
+	}
+	
+	var encryptor *storage.Encryptor
+	if keyRing != nil {
+		var err error
+		encryptor, err = keyRing.MasterEncryptor()
+		if err != nil {
+			log.Fatalf("❌ Failed to derive message encryption key: %v", err)
+		}
+	}
+	
+	compressor, err := storage.NewCompressor(cfg.Compression)
+	if err != nil {
+		log.Fatalf("❌ Invalid storage compression: %v", err)
+	}
+	
+	dataKeys := initializeDataKeys(cfg, keyRing)
+	if dataKeys != nil {
+		log.Println("✅ Per-file data keys enabled")
+	}
+	
+	store := newMessageStore(cfg, cfg.StorageBackend, encryptor, dataKeys, compressor, diskGuard)
+	if cfg.ColdStorageBackend == "" {
+		return store
+	}
+	
+	// Move old messages from local disk to the cold backend
+	hot, ok := store.(*storage.FileMessageStore)
+	if !ok {
+		log.Fatalf("❌ Storage tiering requires the file storage backend")
+	}
+	cold, ok := newMessageStore(cfg, cfg.ColdStorageBackend, encryptor, dataKeys, compressor, diskGuard).(storage.ColdStore)
+	if !ok {
+		log.Fatalf("❌ Unsupported cold storage backend: %s", cfg.ColdStorageBackend)
+	}
+	
+	tiered := storage.NewTieredMessageStore(hot, cold, time.Duration(cfg.ColdAfterDays)*24*time.Hour)
+	interval := time.Duration(cfg.TieringIntervalMinutes) * time.Minute
+	if fiber.IsChild() {
+		interval = 0 // The parent process migrates
+	}
+	tiered.Start(interval)
+	log.Printf("✅ Storage tiering enabled: messages older than %d days move to %s", cfg.ColdAfterDays, cfg.ColdStorageBackend)
+	return tiered
+}
+
+// newMessageStore creates a message store for the named backend
+func newMessageStore(cfg *config.Config, backend string, encryptor *storage.Encryptor, dataKeys *storage.DataKeys, compressor *storage.Compressor, diskGuard *storage.DiskGuard) storage.MessageStore {
+	switch backend {
+	case "s3":
+		client, err := newS3Client(cfg)
+		if err != nil {
+			log.Fatalf("❌ Failed to initialize S3 client: %v", err)
+		}
+		log.Printf("✅ Using S3 message store (bucket: %s)", cfg.S3Bucket)
+		store := storage.NewS3MessageStore(client, s3Options(cfg), encryptor)
+		store.SetCompressor(compressor)
+		store.SetDataKeys(dataKeys)
+		return store
+	case "sqlite":
+		store, err := storage.OpenSQLiteStore(cfg.SQLitePath, encryptor)
+		if err != nil {
+			log.Fatalf("❌ Failed to open SQLite store: %v", err)
+		}
+		store.SetCompressor(compressor)
+		store.SetDataKeys(dataKeys)
+		store.SetDiskGuard(diskGuard)
+		log.Printf("✅ Using SQLite store (%s)", cfg.SQLitePath)
+		return store
+	case "file", "":
+		store := storage.NewFileMessageStore(config.MessagesDir, encryptor)
+		store.SetCompressor(compressor)
+		store.SetDataKeys(dataKeys)
+		store.SetQuarantineDir(config.QuarantineDir)
+		store.SetDiskGuard(diskGuard)
+		return store
+	default:
+		log.Fatalf("❌ Unknown storage backend: %s", backend)
+		return nil
+	}
+}
+
+// initializeScrubber starts the background integrity checker for file-backed message storage.
+// It returns nil when scrubbing is disabled or not applicable to the backend.
+func initializeScrubber(cfg *config.Config, messageStore storage.MessageStore) *storage.Scrubber {
+	fileStore := fileMessageStore(messageStore)
+	if fileStore == nil || cfg.ScrubIntervalMinutes <= 0 || fiber.IsChild() {
+		return nil
+	}
+	
+	scrubber := storage.NewScrubber(fileStore, time.Duration(cfg.ScrubIntervalMinutes)*time.Minute)
+	scrubber.Start()
+	log.Printf("✅ Integrity scrubber running every %d minutes", cfg.ScrubIntervalMinutes)
+	return scrubber
+}
+
+// fileMessageStore returns the file store holding messages locally (the hot tier when
+// tiering is on), or nil for embedded backends
+func fileMessageStore(messageStore storage.MessageStore) *storage.FileMessageStore {
+	switch store := messageStore.(type) {
+	case *storage.FileMessageStore:
+		return store
+	case *storage.TieredMessageStore:
+		return store.Hot()
+	default:
+		return nil
+	}
+}
+
+// initializeLeaderElection lets the capacitors sharing the database elect the one running
+// the scheduled singleton jobs, naming this one by its host and port. It returns the
+// function leaving the election, or nil when disabled or in prefork children.
+func initializeLeaderElection(cfg *config.Config) func() {
+	if !cfg.LeaderElection {
+		return nil // Every capacitor runs the singleton jobs
+	}
+	
+	hostname, _ := os.Hostname()
+	handlers.SetLeaderElection(net.JoinHostPort(hostname, cfg.GetPort()), time.Duration(cfg.LeaderLeaseSeconds)*time.Second)
+	if fiber.IsChild() {
+		return nil // The parent process runs the jobs
+	}
+	
+	stop := handlers.StartLeaderElection()
+	log.Printf("✅ Electing the cluster leader for singleton jobs with %ds leases", cfg.LeaderLeaseSeconds)
+	return stop
+}
+
+// initializePresence shares users' presence with their contacts when PRESENCE_ENABLED is
+// on. It returns the function stopping the presence sweeps, or nil.
+func initializePresence(cfg *config.Config) func() {
+	if !cfg.PresenceEnabled {
+		return nil
+	}
+	
+	handlers.SetPresence(time.Duration(cfg.PresenceTimeoutSeconds) * time.Second)
+	stop := handlers.StartPresenceSweeps()
+	log.Printf("✅ Sharing presence with contacts, devices time out after %ds", cfg.PresenceTimeoutSeconds)
+	return stop
+}
+
+// initializeRetention starts the periodic deletion of messages older than
+// MESSAGE_RETENTION_DAYS. It returns the function stopping it, or nil when disabled.
+func initializeRetention(cfg *config.Config) func() {
+	if fiber.IsChild() {
+		return nil // The parent process sweeps
+	}
+	if cfg.MessageRetentionDays <= 0 || cfg.RetentionIntervalMinutes <= 0 {
+		log.Println("⚠️ Message retention disabled, messages are kept until deleted")
+		return nil
+	}
+	
+	maxAge := time.Duration(cfg.MessageRetentionDays) * 24 * time.Hour
+	stop := handlers.StartRetentionSweeps(maxAge, time.Duration(cfg.RetentionIntervalMinutes)*time.Minute)
+	log.Printf("✅ Deleting messages older than %d days every %d minutes", cfg.MessageRetentionDays, cfg.RetentionIntervalMinutes)
+	return stop
+}
+
+// initializeSnapshots takes snapshots of every account and the node's metadata on
+// BACKUP_SCHEDULE to each sink of BACKUP_TARGET, offering them as the "snapshot" admin
+// job as well. It returns the function stopping the schedule, or nil when snapshots are
+// disabled.
+func initializeSnapshots(cfg *config.Config, d *dht.DHT, useTLS bool) func() {
+	if cfg.BackupSchedule == "" || fiber.IsChild() {
+		return nil
+	}
+	
+	sched, err := schedule.Parse(cfg.BackupSchedule)
+	if err != nil {
+		log.Fatalf("❌ Invalid BACKUP_SCHEDULE: %v", err)
+	}
+	
+	var sinks []handlers.SnapshotSink
+	for _, name := range cfg.BackupSinks() {
+		store, err := snapshotSink(cfg, name, d, useTLS)
+		if err != nil {
+			log.Fatalf("❌ Failed to initialize snapshot sink %s: %v", name, err)
+		}
+		key, err := cfg.BackupEncryptionKey(name)
+		if err != nil {
+			log.Fatalf("❌ Invalid BACKUP_%s_ENCRYPTION_KEY: %v", strings.ToUpper(name), err)
+		}
+		if key != nil {
+			if store, err = storage.NewSealedBlobStore(store, key); err != nil {
+				log.Fatalf("❌ Failed to initialize snapshot encryption for %s: %v", name, err)
+			}
+		}
+		sinks = append(sinks, handlers.SnapshotSink{Name: name, Store: store})
+	}
+	handlers.SetSnapshotSinks(sinks, cfg.BackupKeep)
+	handlers.RegisterAdminJob("snapshot", func(ctx context.Context) (interface{}, error) {
+		return handlers.RunSnapshot(ctx)
+	})
+	
+	stop := handlers.StartSnapshots(sched.Next)
+	log.Printf("✅ Taking snapshots on schedule %q to %s, keeping %d", cfg.BackupSchedule, cfg.BackupTarget, cfg.BackupKeep)
+	return stop
+}
+
+// snapshotSink creates the blob store of one BACKUP_TARGET sink with its own credentials
+func snapshotSink(cfg *config.Config, name string, d *dht.DHT, useTLS bool) (storage.BlobStore, error) {
+	switch name {
+	case "file":
+		return storage.NewFileBlobStore(cfg.BackupDir), nil
+	case "s3":
+		creds := utils.AWSCredentialsFromEnv()
+		switch {
+		case cfg.BackupS3AccessKey != "":
+			creds = utils.AWSCredentials{AccessKeyID: cfg.BackupS3AccessKey, SecretAccessKey: cfg.BackupS3SecretKey}
+		case cfg.S3AccessKey != "":
+			creds = utils.AWSCredentials{AccessKeyID: cfg.S3AccessKey, SecretAccessKey: cfg.S3SecretKey}
+		}
+		client, err := storage.NewS3Client(cfg.S3Endpoint, cfg.S3Region, cfg.S3PathStyle, creds)
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewS3BlobStore(client, storage.S3Options{Bucket: cfg.BackupS3Bucket, Prefix: cfg.BackupS3Prefix}), nil
+	case "sftp":
+		opts := storage.SFTPOptions{
+			Addr:     cfg.BackupSFTPAddr,
+			User:     cfg.BackupSFTPUser,
+			Password: cfg.BackupSFTPPassword,
+			HostKey:  cfg.BackupSFTPHostKey,
+		}
+		if cfg.BackupSFTPKeyFile != "" {
+			key, err := os.ReadFile(cfg.BackupSFTPKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			opts.PrivateKey = key
+		}
+		return storage.NewSFTPBlobStore(opts, cfg.BackupSFTPDir), nil
+	case "locker":
+		// The node transport checks the certificates of lockers against the node CA
+		return storage.NewLockerBlobStore(lockerDiscovery(cfg, d, useTLS), cfg.BackupLockerToken, nodehttp.NewClient(5*time.Minute)), nil
+	}
+	return nil, fmt.Errorf("unknown sink %q", name)
+}
+
+// lockerDiscovery returns the function finding the locker nodes through the DHT. Lockers
+// get the bearer token of their blob API, so only trusted ones are returned: with node
+// mutual TLS over HTTPS every locker, as the node transport only reaches those with a
+// certificate of the node CA, and otherwise those on LOCKER_ALLOWLIST.
+func lockerDiscovery(cfg *config.Config, d *dht.DHT, useTLS bool) func() ([]storage.Locker, error) {
+	scheme := "http://"
+	if useTLS {
+		scheme = "https://"
+	}
+	verified := cfg.NodeMTLS && useTLS
+	allowed := make(map[string]bool)
+	for _, address := range cfg.AllowedLockers() {
+		allowed[address] = true
+	}
+	return func() ([]storage.Locker, error) {
+		services, err := d.FindServicesByType("locker")
+		if err != nil {
+			return nil, err
+		}
+		lockers := make([]storage.Locker, 0, len(services))
+		for _, service := range services {
+			if !verified && !allowed[service.Address] {
+				continue
+			}
+			lockers = append(lockers, storage.Locker{ID: service.NodeID.String(), URL: scheme + service.Address})
+		}
+		return lockers, nil
+	}
+}
+
+// initializeLockerOffload offloads the ciphertexts of messages of at least LOCKER_OFFLOAD_KB
+// to the locker nodes. The lockers stay configured with offloading off, so messages
+// offloaded before remain readable.
+func initializeLockerOffload(cfg *config.Config, d *dht.DHT, useTLS bool) {
+	// Messages are fetched through while get_messages waits, so lockers get less time than for snapshots
+	lockers := storage.NewLockerBlobStore(lockerDiscovery(cfg, d, useTLS), cfg.LockerOffloadToken, nodehttp.NewClient(30*time.Second))
+	handlers.SetMessageLockers(lockers, cfg.LockerOffloadKB*1024, cfg.LockerOffloadCopies)
+	if cfg.LockerOffloadKB > 0 {
+		log.Printf("✅ Offloading messages of %d KB or more to %d locker nodes each", cfg.LockerOffloadKB, cfg.LockerOffloadCopies)
+	}
+}
+
+// registerAdminJobs offers the maintenance jobs that apply to this node through the admin API
+func registerAdminJobs(cfg *config.Config, messageStore storage.MessageStore, scrubber *storage.Scrubber) {
+	if fileStore := fileMessageStore(messageStore); fileStore != nil {
+		handlers.RegisterAdminJob("rebalance", func(ctx context.Context) (interface{}, error) {
+			return fileStore.Rebalance(), nil
+		})
+	}
+	if scrubber != nil {
+		handlers.RegisterAdminJob("scrub", func(ctx context.Context) (interface{}, error) {
+			return scrubber.RunOnce(), nil
+		})
+	}
+	if tiered, ok := messageStore.(*storage.TieredMessageStore); ok {
+		handlers.RegisterAdminJob("tiering", func(ctx context.Context) (interface{}, error) {
+			return tiered.Migrate(), nil
+		})
+	}
+	if _, ok := messageStore.(storage.SaltRotator); ok && config.PreviousConfusionSalt != "" {
+		handlers.RegisterAdminJob("rehash", func(ctx context.Context) (interface{}, error) {
+			return handlers.RunSaltRotation(ctx)
+		})
+	}
+	if cfg.MessageRetentionDays > 0 {
+		maxAge := time.Duration(cfg.MessageRetentionDays) * 24 * time.Hour
+		handlers.RegisterAdminJob("retention", func(ctx context.Context) (interface{}, error) {
+			return handlers.RunRetention(ctx, maxAge)
+		})
+	}
+}
+
+// initializeLogging selects the log output: stderr, or LOG_FILE with rotation and sampling
+// on a nearly full disk. It returns the function closing the log file.
+func initializeLogging(cfg *config.Config) func() {
+	if cfg.LogFile == "" {
+		logging.Setup(cfg.LogFormat, cfg.LogLevel)
+		return func() {}
+	}
+
+	closeLog, err := logging.SetupFile(cfg.LogFormat, cfg.LogLevel, logging.FileOptions{
+		Path:           cfg.LogFile,
+		MaxSize:        int64(cfg.LogMaxSizeMB) * 1024 * 1024,
+		RotateInterval: time.Duration(cfg.LogRotateHours) * time.Hour,
+		MaxBackups:     cfg.LogMaxBackups,
+		MaxAge:         time.Duration(cfg.LogMaxAgeDays) * 24 * time.Hour,
+		MinFreeBytes:   uint64(cfg.LogMinFreeDiskMB) * 1024 * 1024,
+		SampleEvery:    cfg.LogLowDiskSampleEvery,
+	})
+	if err != nil {
+		log.Fatalf("❌ Failed to set up logging to %s: %v", cfg.LogFile, err)
+	}
+	log.Printf("✅ Logging to %s", cfg.LogFile)
+	return closeLog
+}
+
+// initializeTracing starts exporting spans to OTEL_EXPORTER_OTLP_ENDPOINT. It returns the
+// function flushing and stopping the export, or nil when tracing is disabled.
+func initializeTracing(cfg *config.Config) func() {
+	if cfg.TracingEndpoint == "" {
+		return nil
+	}
+
+	resource := map[string]string{"deployment.environment": cfg.Profile}
+	if hostname, err := os.Hostname(); err == nil {
+		resource["host.name"] = hostname
+	}
+	// Prefork children export separately; the process ID tells their spans apart
+	resource["process.pid"] = strconv.Itoa(os.Getpid())
+
+	stop, err := tracing.Setup(tracing.Options{
+		Endpoint:      cfg.TracingEndpoint,
+		Headers:       tracing.ParseHeaders(cfg.TracingHeaders),
+		ServiceName:   cfg.TracingServiceName,
+		SamplePercent: cfg.TracingSamplePercent,
+		Resource:      resource,
+	})
+	if err != nil {
+		log.Fatalf("❌ Tracing initialization failed: %v", err)
+	}
+	if !fiber.IsChild() {
+		log.Printf("✅ Tracing enabled, sampling %d%% of new traces", cfg.TracingSamplePercent)
+	}
+	return stop
+}
+
+// initializeCrashReporting sends recovered panics to CRASH_REPORT_DSN when it is set
+func initializeCrashReporting(cfg *config.Config) {
+	if cfg.CrashReportDSN == "" {
+		return
+	}
+
+	hostname, _ := os.Hostname()
+	err := crashreport.Setup(crashreport.Options{
+		DSN:         cfg.CrashReportDSN,
+		Environment: cfg.Profile,
+		ServerName:  hostname,
+		Release:     "wave-capacitor@" + version.Version,
+	})
+	if err != nil {
+		log.Fatalf("❌ Crash reporting initialization failed: %v", err)
+	}
+	if !fiber.IsChild() {
+		log.Println("✅ Reporting recovered panics to CRASH_REPORT_DSN")
+	}
+}
+
+// initializeAlerting evaluates the alert conditions in the parent process and sends their
+// alerts to the configured notifiers. Returns nil when no notifier is configured.
+func initializeAlerting(cfg *config.Config, diskGuard *storage.DiskGuard, dispatcher *webhooks.Dispatcher) *alerting.Manager {
+	if fiber.IsChild() {
+		return nil
+	}
+
+	hostname, _ := os.Hostname()
+	manager := alerting.NewManager(alerting.Options{
+		Interval:       time.Duration(cfg.AlertIntervalSeconds) * time.Second,
+		RepeatInterval: time.Duration(cfg.AlertRepeatMinutes) * time.Minute,
+		Node:           hostname,
+	})
+
+	var notifiers []string
+	if cfg.AlertWebhookURL != "" {
+		manager.AddNotifier(alerting.NewWebhookNotifier(cfg.AlertWebhookURL))
+		notifiers = append(notifiers, "webhook")
+	}
+	if cfg.AlertSMTPAddr != "" {
+		var to []string
+		for _, addr := range strings.Split(cfg.AlertSMTPTo, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				to = append(to, addr)
+			}
+		}
+		manager.AddNotifier(&alerting.SMTPNotifier{
+			Addr:     cfg.AlertSMTPAddr,
+			Username: cfg.AlertSMTPUsername,
+			Password: cfg.AlertSMTPPassword,
+			From:     cfg.AlertSMTPFrom,
+			To:       to,
+		})
+		notifiers = append(notifiers, "email")
+	}
+	if cfg.AlertStdout {
+		manager.AddNotifier(&alerting.StdoutNotifier{})
+		notifiers = append(notifiers, "stdout")
+	}
+	if len(notifiers) == 0 {
+		return nil
+	}
+
+	if cfg.AlertDiskFreePercent > 0 {
+		manager.Add("disk", func(ctx context.Context) string {
+			usage, err := diskGuard.Usage()
+			if err != nil {
+				return fmt.Sprintf("unable to measure free disk space: %v", err)
+			}
+			if free := usage.FreePercent(); free < float64(cfg.AlertDiskFreePercent) {
+				return fmt.Sprintf("%.1f%% disk space free (%d MB), below %d%%", free, usage.FreeBytes/1024/1024, cfg.AlertDiskFreePercent)
+			}
+			return ""
+		})
+	}
+	manager.Add("database", func(ctx context.Context) string {
+		if err := models.PingDB(ctx); err != nil {
+			return fmt.Sprintf("database unreachable: %v", err)
+		}
+		return ""
+	})
+	if dispatcher != nil && cfg.AlertWebhookQueue > 0 {
+		manager.Add("webhook_queue", func(ctx context.Context) string {
+			if queued := dispatcher.QueueLength(); queued >= cfg.AlertWebhookQueue {
+				return fmt.Sprintf("%d webhook deliveries queued, at least %d", queued, cfg.AlertWebhookQueue)
+			}
+			return ""
+		})
+	}
+	// Only the parent's requests are counted, so this condition is off under prefork
+	if cfg.AlertAuthFailures > 0 && !cfg.HTTPPrefork {
+		last := middleware.AuthFailures()
+		manager.Add("auth_failures", func(ctx context.Context) string {
+			total := middleware.AuthFailures()
+			failures := total - last
+			last = total
+			if failures >= int64(cfg.AlertAuthFailures) {
+				return fmt.Sprintf("%d authentication failures in the last %ds, at least %d", failures, cfg.AlertIntervalSeconds, cfg.AlertAuthFailures)
+			}
+			return ""
+		})
+	}
+
+	manager.Start()
+	log.Printf("✅ Alerting enabled (%s), checking every %ds", strings.Join(notifiers, ", "), cfg.AlertIntervalSeconds)
+	return manager
+}
+
+// initializeTelemetry sends anonymous usage statistics to TELEMETRY_ENDPOINT from the parent
+// process. Returns nil unless an endpoint is set. Under prefork only the messages the parent
+// delivered are counted.
+func initializeTelemetry(cfg *config.Config, d *dht.DHT) *telemetry.Reporter {
+	if cfg.TelemetryEndpoint == "" || fiber.IsChild() {
+		return nil
+	}
+
+	reporter := telemetry.NewReporter(telemetry.Options{
+		Endpoint:    cfg.TelemetryEndpoint,
+		Interval:    time.Duration(cfg.TelemetryIntervalHours) * time.Hour,
+		Version:     version.Version,
+		StorageKind: cfg.StorageBackend,
+		Messages:    handlers.MessagesDelivered,
+		DHTNodes:    d.RoutingTableSize,
+	})
+	reporter.Start()
+	log.Printf("✅ Sending anonymous usage statistics to %s every %dh", cfg.TelemetryEndpoint, cfg.TelemetryIntervalHours)
+	return reporter
+}
+
+// initializeWebhooks starts the webhook dispatcher, or returns nil when webhooks are disabled
+func initializeWebhooks(cfg *config.Config) *webhooks.Dispatcher {
+	if !cfg.WebhooksEnabled {
+		handlers.SetWebhooks(nil, 0)
+		log.Println("⚠️ Webhooks disabled")
+		return nil
+	}
+	if cfg.WebhookURL != "" && cfg.WebhookSecret == "" {
+		log.Fatalf("❌ WEBHOOK_SECRET is required when WEBHOOK_URL is set")
+	}
+
+	dispatcher := webhooks.NewDispatcher(webhooks.Options{
+		URL:                  cfg.WebhookURL,
+		Secret:               cfg.WebhookSecret,
+		AllowPrivateNetworks: cfg.WebhookAllowPrivateNetworks,
+		Workers:              cfg.WebhookWorkers,
+	})
+	dispatcher.Start()
+	handlers.SetWebhooks(dispatcher, cfg.WebhookMaxPerUser)
+	if cfg.WebhookURL != "" {
+		log.Println("✅ Webhooks enabled, node-wide events sent to WEBHOOK_URL")
+	} else {
+		log.Println("✅ Webhooks enabled")
+	}
+	return dispatcher
+}
+
+// initializeContactStore selects the contacts backend. With CONTACTS_BACKEND=file, contacts
+// stay alongside messages for embedded backends and in per-user files otherwise. Files
+// named after the username, as earlier versions wrote them, are moved into hashed folders.
+func initializeContactStore(cfg *config.Config, messageStore storage.MessageStore, keyRing *storage.KeyRing) storage.ContactStore {
+	files := storage.NewFileContactStore(config.ContactsDir)
+	if moved, err := files.MigrateFlatFiles(); err != nil {
+		log.Fatalf("❌ Failed to move contacts files into hashed folders after %d files: %v", moved, err)
+	} else if moved > 0 {
+		log.Printf("✅ Moved %d contacts files into hashed folders", moved)
+	}
+	
+	switch cfg.ContactsBackend {
+	case "database":
+		// Files left from the file backend are not read any more until they are imported
+		if count, err := files.Count(); err == nil && count > 0 {
+			log.Printf("⚠️ %d contacts files found in %s; run 'import-contacts' to move them into the database", count, config.ContactsDir)
+		}
+		store := models.NewDBContactStore(keyRing)
+		if converted, err := store.SealContactKeys(context.Background()); err != nil {
+			log.Fatalf("❌ Failed to seal stored contacts after %d contacts: %v", converted, err)
+		} else if converted > 0 {
+			log.Printf("✅ Sealed %d stored contacts", converted)
+		}
+		log.Println("✅ Contacts stored in the database")
+		return store
+	case "file":
+		if blobs, ok := messageStore.(storage.ContactBlobStore); ok {
+			return storage.NewBlobContactStore(blobs, keyRing)
+		}
+		return storage.NewBlobContactStore(files, keyRing)
+	default:
+		log.Fatalf("❌ Unknown contacts backend %q (expected database or file)", cfg.ContactsBackend)
+		return nil
+	}
+}
+
+// newS3Client creates an S3 client, falling back to the standard AWS credential variables
+func newS3Client(cfg *config.Config) (*storage.S3Client, error) {
+	creds := utils.AWSCredentialsFromEnv()
+	if cfg.S3AccessKey != "" {
+		creds = utils.AWSCredentials{AccessKeyID: cfg.S3AccessKey, SecretAccessKey: cfg.S3SecretKey}
+	}
+	return storage.NewS3Client(cfg.S3Endpoint, cfg.S3Region, cfg.S3PathStyle, creds)
+}
+
+// s3Options returns the object layout configured for the S3 stores
+func s3Options(cfg *config.Config) storage.S3Options {
+	return storage.S3Options{
+		Bucket:         cfg.S3Bucket,
+		Prefix:         cfg.S3Prefix,
+		BucketPerShard: cfg.S3BucketPerShard,
+	}
+}
+
+// dbOptions returns the database pool and timeout settings
+func dbOptions(cfg *config.Config) models.DBOptions {
+	return models.DBOptions{
+		ConnectionString: cfg.GetDBConnectionString(),
+		MaxOpenConns:     cfg.DbMaxOpenConns,
+		MaxIdleConns:     cfg.DbMaxIdleConns,
+		ConnMaxLifetime:  time.Duration(cfg.DbConnMaxLifetimeMinutes) * time.Minute,
+		QueryTimeout:     time.Duration(cfg.DbQueryTimeoutSeconds) * time.Second,
+		Region:           cfg.DbRegion,
+		FollowerReads:    cfg.DbFollowerReads,
+		UserCacheSize:    cfg.UserCacheSize,
+		UserCacheTTL:     time.Duration(cfg.UserCacheTTLSeconds) * time.Second,
+
+		WriteBehindInterval:   time.Duration(cfg.DbWriteBehindMs) * time.Millisecond,
+		WriteBehindMaxPending: cfg.DbWriteBehindMaxPending,
+	}
+}
+
+// initializeCertWatcher reloads the database client certificate when it is rotated on disk.
+// Returns nil when password authentication is used.
+func initializeCertWatcher(cfg *config.Config) *models.CertWatcher {
+	if cfg.DbSslCert == "" {
+		return nil
+	}
+
+	watcher, err := models.NewCertWatcher(cfg.DbSslCert, cfg.DbSslKey, time.Duration(cfg.DbCertCheckIntervalSeconds)*time.Second)
+	if err != nil {
+		log.Fatalf("❌ Database client certificate: %v", err)
+	}
+	watcher.Start()
+	log.Printf("✅ Database client certificate valid until %s", watcher.NotAfter().Format(time.RFC3339))
+	return watcher
+}
+
+// initializeSecretWatcher reloads the operator and webhook secrets when their mounted
+// files change. The other secrets are only read at startup, so their changes are logged
+// as needing a restart. Returns nil when no secret is kept in a file or reloading is off.
+func initializeSecretWatcher(cfg *config.Config, dispatcher *webhooks.Dispatcher) *secrets.Watcher {
+	if cfg.SecretsReloadIntervalSeconds <= 0 {
+		return nil
+	}
+
+	watcher := secrets.NewWatcher(time.Duration(cfg.SecretsReloadIntervalSeconds) * time.Second)
+	watcher.Watch("ADMIN_TOKEN", middleware.SetAdminToken)
+	watcher.Watch("SHARD_TRANSFER_TOKEN", middleware.SetTransferToken)
+	watcher.Watch("WEBHOOK_SECRET", dispatcher.SetSecret)
+	for _, name := range []string{secrets.JWTSecret, secrets.NodeMasterKey, secrets.ConfusionSalt, secrets.PreviousConfusionSalt, "DB_PASSWORD",
+		secrets.PrivateKeyWrapKey, "NODE_PREVIOUS_MASTER_KEY", "PREVIOUS_PRIVATE_KEY_WRAP_KEY", "VAULT_TOKEN", "S3_ACCESS_KEY", "S3_SECRET_KEY", "RATE_LIMIT_REDIS_PASSWORD",
+		"OTEL_EXPORTER_OTLP_HEADERS", "CRASH_REPORT_DSN", "ALERT_SMTP_PASSWORD", "BACKUP_S3_ACCESS_KEY", "BACKUP_S3_SECRET_KEY",
+		"BACKUP_SFTP_PASSWORD", "BACKUP_LOCKER_TOKEN"} {
+		watcher.Watch(name, nil)
+	}
+	if watcher.Len() == 0 {
+		return nil
+	}
+
+	watcher.Start()
+	log.Printf("✅ Watching %d secret files for changes", watcher.Len())
+	return watcher
+}
+
+// initializeRateLimiter configures the rate limiting middleware from cfg
+func initializeRateLimiter(cfg *config.Config) {
+	if !cfg.RateLimitEnabled {
+		log.Println("⚠️ Rate limiting disabled")
+		return
+	}
+
+	var store middleware.RateLimitStore
+	switch cfg.RateLimitBackend {
+	case "memory":
+		store = middleware.NewMemoryRateLimitStore()
+	case "redis":
+		redisStore, err := middleware.NewRedisRateLimitStore(cfg.RateLimitRedisAddr, cfg.RateLimitRedisPassword)
+		if err != nil {
+			log.Fatalf("❌ Rate limit store: %v", err)
+		}
+		store = redisStore
+	default:
+		log.Fatalf("❌ Unknown RATE_LIMIT_BACKEND %q (use memory or redis)", cfg.RateLimitBackend)
+	}
+
+	middleware.SetRateLimiter(store, middleware.RateLimits{
+		Window: time.Duration(cfg.RateLimitWindowSeconds) * time.Second,
+		Global: cfg.RateLimitGlobal,
+		User:   cfg.RateLimitUser,
+		Auth:   cfg.RateLimitAuth,
+		Send:   cfg.RateLimitSend,
+	})
+	log.Printf("✅ Rate limiting enabled (%s backend)", cfg.RateLimitBackend)
+}
+
+// responseCompression returns the compression middleware for large responses, or nil if disabled
+func responseCompression(cfg *config.Config) fiber.Handler {
+	level, err := middleware.ParseCompressionLevel(cfg.ResponseCompression)
+	if err != nil {
+		log.Fatalf("❌ Invalid RESPONSE_COMPRESSION: %v", err)
+	}
+	if level == compress.LevelDisabled {
+		log.Println("⚠️ Response compression disabled")
+		return nil
+	}
+	log.Printf("✅ Response compression enabled (%s)", cfg.ResponseCompression)
+	return middleware.Compression(level)
+}
+
+// slowQueryLogger returns a query hook that logs database calls slower than threshold
+func slowQueryLogger(threshold time.Duration) models.QueryHook {
+	return func(ctx context.Context, trace models.QueryTrace) {
+		if trace.Duration < threshold {
+			return
+		}
+		if trace.Err != nil {
+			logging.Warnf(ctx, "🐢 Slow query %s took %v over %d attempt(s) and failed: %v", trace.Op, trace.Duration, trace.Attempts, trace.Err)
+			return
+		}
+		logging.Warnf(ctx, "🐢 Slow query %s took %v over %d attempt(s)", trace.Op, trace.Duration, trace.Attempts)
+	}
+}
+
+// runEncryptContacts encrypts existing plaintext contacts files with the node master key
+func runEncryptContacts(cfg *config.Config) {
+	cfg.EncryptAtRest = true
+	keyRing, err := initializeKeyRing(cfg)
+	if err != nil {
+		log.Fatalf("❌ Cannot encrypt contacts: %v", err)
+	}
+	
+	if err := models.ConnectDB(); err != nil {
+		log.Fatalf("❌ Database connection failed: %v", err)
+	}
+	users, err := models.ListUsers(context.Background())
+	if err != nil {
+		log.Fatalf("❌ Failed to list users: %v", err)
+	}
+	usernames := make([]string, len(users))
+	for i, user := range users {
+		usernames[i] = user.Username
+	}
+	
+	initializeFolderDerivation(cfg)
+	files := storage.NewFileContactStore(config.ContactsDir)
+	if _, err := files.MigrateFlatFiles(); err != nil {
+		log.Fatalf("❌ Failed to move contacts files into hashed folders: %v", err)
+	}
+	converted, err := storage.EncryptContacts(files, usernames, keyRing)
+	if err != nil {
+		log.Fatalf("❌ Contacts encryption failed after %d files: %v", converted, err)
+	}
+	log.Printf("✅ Encrypted %d contacts files", converted)
+}
+
+// registerCapacitorService registers this capacitor as a service in the DHT
+func registerCapacitorService(d *dht.DHT, cfg *config.DHTConfig) {
+	// Create a unique service ID based on node ID
+	serviceID := "capacitor:" + d.LocalNode().ID.String()
+	
+	// Create service info
+	info := dht.ServiceInfo{
+		NodeID:     d.LocalNode().ID,
+		NodeType:   "capacitor",
+		Address:    capacitorAddress(cfg),
+		APIPort:    cfg.APIPort,
+		GRPCPort:   cfg.GRPCPort,
+		NumShards:  cfg.NumShards,
+		Version:    version.Version,
+		Properties: map[string]string{
+			"environment": os.Getenv("ENVIRONMENT"),
+			"role": "message_processor",
+		},
+		LastSeen:   time.Now(),
+	}
+	
+	// Register the service
+	if err := d.RegisterService(serviceID, info); err != nil {
+		log.Printf("⚠️ Failed to register service: %v", err)
+	} else {
+		log.Println("✅ Capacitor service registered in DHT")
+	}
+}
+
+// capacitorAddress returns the host:port other nodes and clients reach this capacitor's API at
+func capacitorAddress(cfg *config.DHTConfig) string {
+	externalIP := cfg.ExternalIP
+	if externalIP == "" {
+		// In a production environment, you should implement a proper
+		// external IP detection mechanism
+		externalIP = getOutboundIP().String()
+	}
+	return externalIP + ":" + strconv.Itoa(cfg.APIPort)
+}
+
+// getOutboundIP gets the preferred outbound IP of this machine
+func getOutboundIP() net.IP {
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		log.Printf("⚠️ Failed to determine outbound IP: %v", err)
+		return net.ParseIP("127.0.0.1")
+	}
+	defer conn.Close()
+	
+	localAddr := conn.LocalAddr().(*net.UDPAddr)
+	return localAddr.IP
+}
+
+// runRewrapKeys re-wraps per-file data keys with the current master key after a rotation.
+// NODE_PREVIOUS_MASTER_KEY must hold the retired key.
+func runRewrapKeys(cfg *config.Config) {
+	cfg.EncryptAtRest = true
+	cfg.PerFileKeys = true
+	keyRing, err := initializeKeyRing(cfg)
+	if err != nil {
+		log.Fatalf("❌ At-rest encryption initialization failed: %v", err)
+	}
+	defer keyRing.Destroy()
+	
+	count, err := initializeDataKeys(cfg, keyRing).Rewrap()
+	if err != nil {
+		log.Fatalf("❌ Failed to re-wrap data keys: %v", err)
+	}
+	log.Printf("✅ Re-wrapped %d data keys with the current master key", count)
+}
+
+// runMigrate applies pending database schema migrations and exits.
+// "migrate status" only lists the pending migrations.
+func runMigrate(args []string) {
+	if err := models.ConnectDB(); err != nil {
+		log.Fatalf("❌ Database connection failed: %v", err)
+	}
+	
+	if len(args) > 0 && args[0] == "status" {
+		pending, err := models.PendingMigrations(context.Background())
+		if err != nil {
+			log.Fatalf("❌ Failed to read migration status: %v", err)
+		}
+		for _, m := range pending {
+			log.Printf("⏳ Pending migration %04d_%s", m.Version, m.Name)
+		}
+		log.Printf("✅ %d pending migrations", len(pending))
+		return
+	}
+	
+	applied, err := models.Migrate(context.Background())
+	if err != nil {
+		log.Fatalf("❌ Migration failed after %d migrations: %v", applied, err)
+	}
+	log.Printf("✅ Applied %d migrations", applied)
+}
+
+// runImportContacts copies per-user contacts files into the database contacts table.
+// Imported files are removed, so the command can be re-run after a partial failure.
+func runImportContacts(cfg *config.Config) {
+	keyRing, err := initializeKeyRing(cfg)
+	if err != nil {
+		log.Fatalf("❌ At-rest encryption initialization failed: %v", err)
+	}
+	if err := models.ConnectDB(); err != nil {
+		log.Fatalf("❌ Database connection failed: %v", err)
+	}
+	if _, err := models.Migrate(context.Background()); err != nil {
+		log.Fatalf("❌ Schema migration failed: %v", err)
+	}
+	
+	initializeFolderDerivation(cfg)
+	files := storage.NewFileContactStore(config.ContactsDir)
+	source := storage.NewBlobContactStore(files, keyRing)
+	target := models.NewDBContactStore(keyRing)
+	
+	// The files are found by username, as their folder names are hashed
+	ctx := context.Background()
+	users, err := models.ListUsers(ctx)
+	if err != nil {
+		log.Fatalf("❌ Failed to list users: %v", err)
+	}
+	
+	imported := 0
+	for _, user := range users {
+		username := user.Username
+		if data, err := files.LoadContacts(username); err != nil {
+			log.Fatalf("❌ Failed to read contacts file of %s: %v", username, err)
+		} else if data == nil {
+			continue
+		}
+		contacts, err := source.ListContacts(ctx, username)
+		if err != nil {
+			log.Fatalf("❌ Failed to read contacts of %s: %v", username, err)
+		}
+		if err := target.ReplaceContacts(ctx, username, contacts); err != nil {
+			log.Fatalf("❌ Failed to import contacts of %s: %v", username, err)
+		}
+		if err := files.DeleteContacts(username); err != nil {
+			log.Fatalf("❌ Failed to remove imported contacts file of %s: %v", username, err)
+		}
+		imported++
+	}
+	log.Printf("✅ Imported contacts of %d users into the database", imported)
+}
+
+// runReindexMessages rebuilds the message metadata index from the message store, covering
+// messages stored before the index existed or its hashes were kept. Existing entries keep
+// their read state.
+func runReindexMessages(cfg *config.Config) {
+	keyRing, err := initializeKeyRing(cfg)
+	if err != nil {
+		log.Fatalf("❌ At-rest encryption initialization failed: %v", err)
+	}
+	if err := models.ConnectDB(); err != nil {
+		log.Fatalf("❌ Database connection failed: %v", err)
+	}
+	if _, err := models.Migrate(context.Background()); err != nil {
+		log.Fatalf("❌ Schema migration failed: %v", err)
+	}
+	
+	messageStore := initializeMessageStore(cfg, keyRing, nil)
+	if tiered, ok := messageStore.(*storage.TieredMessageStore); ok {
+		defer tiered.Stop()
+	}
+	
+	ctx := context.Background()
+	users, err := models.ListUsers(ctx)
+	if err != nil {
+		log.Fatalf("❌ Failed to list users: %v", err)
+	}
+	
+	indexed := 0
+	for _, user := range users {
+		keys := []string{user.PublicKey}
+		history, err := models.GetKeyHistory(ctx, user.Username)
+		if err != nil {
+			log.Fatalf("❌ Failed to read key history of %s: %v", user.Username, err)
+		}
+		for _, record := range history {
+			keys = append(keys, record.PublicKey)
+		}
+		
+		for _, key := range keys {
+			ids, err := messageStore.List(key)
+			if err != nil {
+				log.Fatalf("❌ Failed to list messages of %s: %v", user.Username, err)
+			}
+			for _, id := range ids {
+				data, err := messageStore.Read(key, id)
+				if err != nil {
+					log.Printf("⚠️ Skipping unreadable message %s: %v", id, err)
+					continue
+				}
+				var message handlers.Message
+				if err := json.Unmarshal(data, &message); err != nil {
+					log.Printf("⚠️ Skipping malformed message %s: %v", id, err)
+					continue
+				}
+				meta := models.MessageMeta{
+					RecipientHash: handlers.RecipientHash(key),
+					MessageID:     id,
+					Timestamp:     message.Timestamp,
+					Size:          len(data),
+					Hash:          handlers.MessageHash(data),
+				}
+				if err := models.IndexMessage(ctx, meta); err != nil {
+					log.Fatalf("❌ Failed to index message %s: %v", id, err)
+				}
+				indexed++
+			}
+		}
+	}
+	log.Printf("✅ Indexed %d messages of %d users", indexed, len(users))
+}
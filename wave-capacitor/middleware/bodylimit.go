@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"fmt"
+	"wave_capacitor/api/apierror"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// BodyLimits are the largest request bodies accepted per route group, in bytes; 0 leaves
+// only the server-wide HTTP_MAX_BODY_MB, which bounds what is read at all
+type BodyLimits struct {
+	Default int // public, admin and shard transfer endpoints
+	User    int // endpoints of authenticated users, e.g. messages, prekeys and sessions
+	Backup  int // account recovery, whose body carries a whole backup
+}
+
+var bodyLimits BodyLimits
+
+// SetBodyLimits configures the limits enforced by the body limit middleware
+func SetBodyLimits(limits BodyLimits) {
+	bodyLimits = limits
+}
+
+// DefaultBodyLimit applies the limit of endpoints that only take small requests
+func DefaultBodyLimit(c *fiber.Ctx) error {
+	return bodyLimit(c, bodyLimits.Default)
+}
+
+// UserBodyLimit applies the limit of the authenticated user endpoints
+func UserBodyLimit(c *fiber.Ctx) error {
+	return bodyLimit(c, bodyLimits.User)
+}
+
+// BackupBodyLimit applies the limit of endpoints that upload a backup
+func BackupBodyLimit(c *fiber.Ctx) error {
+	return bodyLimit(c, bodyLimits.Backup)
+}
+
+// bodyLimit rejects the request with 413 when its body, as received, exceeds limit bytes
+func bodyLimit(c *fiber.Ctx, limit int) error {
+	if limit > 0 && len(c.Request().Body()) > limit {
+		return apierror.Respond(c, fiber.StatusRequestEntityTooLarge, apierror.PayloadTooLarge,
+			fmt.Sprintf("Request body is larger than %d bytes", limit), nil)
+	}
+	return c.Next()
+}
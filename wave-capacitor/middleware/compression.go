@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/compress"
+)
+
+// ParseCompressionLevel maps a RESPONSE_COMPRESSION value to a compression level
+func ParseCompressionLevel(name string) (compress.Level, error) {
+	switch name {
+	case "off":
+		return compress.LevelDisabled, nil
+	case "speed":
+		return compress.LevelBestSpeed, nil
+	case "default":
+		return compress.LevelDefault, nil
+	case "best":
+		return compress.LevelBestCompression, nil
+	}
+	return compress.LevelDisabled, fmt.Errorf("unknown response compression %q (use off, speed, default or best)", name)
+}
+
+// largeResponse reports whether the path serves payloads that are often megabytes of base64:
+// message listings, account backups and the shard archives nodes sync with
+func largeResponse(path string) bool {
+	if !strings.HasPrefix(path, "/api/") {
+		return false
+	}
+	return strings.HasSuffix(path, "/get_messages") ||
+		strings.HasSuffix(path, "/backup_account") ||
+		(strings.Contains(path, "/shards/") && strings.HasSuffix(path, "/export"))
+}
+
+// Compression gzip, deflate or brotli encodes large responses as the client's
+// Accept-Encoding allows. Streamed bodies such as shard exports are compressed as they
+// are written. Register it before RequestID, which has to read error bodies uncompressed.
+func Compression(level compress.Level) fiber.Handler {
+	return compress.New(compress.Config{
+		Level: level,
+		Next: func(c *fiber.Ctx) bool {
+			return !largeResponse(c.Path())
+		},
+	})
+}
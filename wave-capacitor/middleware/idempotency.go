@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/logging"
+	"wave_capacitor/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// IdempotencyKeyHeader carries the client-chosen key that makes a retried request safe
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader marks a response replayed from an earlier request
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLength bounds the keys clients may send
+const maxIdempotencyKeyLength = 255
+
+// maxIdempotentBody is the largest response stored for replay. Larger responses (e.g.
+// encrypted backups) come from requests that are cheap to repeat, so they are not kept.
+const maxIdempotentBody = 64 * 1024
+
+// idempotencyPurgeInterval is how often expired responses are deleted
+const idempotencyPurgeInterval = 10 * time.Minute
+
+var (
+	idempotencyTTL time.Duration // 0 disables idempotency keys
+
+	purgeMu   sync.Mutex
+	lastPurge time.Time
+)
+
+// SetIdempotencyTTL configures how long responses are kept for replay; 0 ignores Idempotency-Key
+func SetIdempotencyTTL(ttl time.Duration) {
+	idempotencyTTL = ttl
+}
+
+// Idempotency replays the stored response when a POST, PUT or DELETE is retried with the
+// same Idempotency-Key, so the request's side effects happen once. Keys are scoped to the
+// authenticated user, so use it after JWTMiddleware on protected routes. A key reused for a
+// different request fails with 422, one whose first request is still running with 409.
+func Idempotency(c *fiber.Ctx) error {
+	key := c.Get(IdempotencyKeyHeader)
+	if key == "" || idempotencyTTL <= 0 || c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead {
+		return c.Next()
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return apierror.Respond(c, fiber.StatusBadRequest, apierror.InvalidRequest, "Idempotency-Key is too long", nil)
+	}
+
+	// Unauthenticated requests share one scope; the request hash keeps their keys apart
+	scope := ""
+	if token, ok := c.Locals("user").(*jwt.Token); ok {
+		if claims, ok := token.Claims.(jwt.MapClaims); ok {
+			scope, _ = claims["username"].(string)
+		}
+	}
+	hash := sha256.New()
+	hash.Write([]byte(c.Method() + " " + c.Path() + "\n"))
+	hash.Write(c.Body())
+	requestHash := hex.EncodeToString(hash.Sum(nil))
+
+	ctx := c.UserContext()
+	purgeIdempotencyKeys(ctx)
+
+	previous, err := models.ClaimIdempotencyKey(ctx, scope, key, requestHash, idempotencyTTL)
+	if err != nil {
+		logging.Errorf(ctx, "Error claiming idempotency key: %v", err)
+		return apierror.Respond(c, fiber.StatusServiceUnavailable, apierror.Unavailable, "Unable to verify Idempotency-Key, please try again later", nil)
+	}
+	if previous != nil {
+		switch {
+		case previous.RequestHash != requestHash:
+			return apierror.Respond(c, fiber.StatusUnprocessableEntity, apierror.IdempotencyKeyReused, "Idempotency-Key was already used for a different request", nil)
+		case previous.Status == 0:
+			c.Set(fiber.HeaderRetryAfter, "1")
+			return apierror.Respond(c, fiber.StatusConflict, apierror.IdempotencyInFlight, "A request with this Idempotency-Key is still being processed", nil)
+		}
+		c.Set(IdempotentReplayedHeader, "true")
+		c.Set(fiber.HeaderContentType, previous.ContentType)
+		return c.Status(previous.Status).Send(previous.Body)
+	}
+
+	if err := c.Next(); err != nil {
+		// Render the error now so the stored response is the one the client sees
+		if err := ErrorHandler(c, err); err != nil {
+			return err
+		}
+	}
+
+	// Throttled and failed requests may succeed when retried, so they release the key
+	resp := c.Response()
+	status := resp.StatusCode()
+	if status == fiber.StatusTooManyRequests || status >= fiber.StatusInternalServerError || len(resp.Body()) > maxIdempotentBody {
+		if err := models.ReleaseIdempotencyKey(ctx, scope, key); err != nil {
+			logging.Errorf(ctx, "Error releasing idempotency key: %v", err)
+		}
+		return nil
+	}
+	if err := models.CompleteIdempotencyKey(ctx, scope, key, status, string(resp.Header.ContentType()), resp.Body()); err != nil {
+		logging.Errorf(ctx, "Error storing idempotent response: %v", err)
+	}
+	return nil
+}
+
+// purgeIdempotencyKeys deletes expired responses in the background at most once per interval
+func purgeIdempotencyKeys(ctx context.Context) {
+	purgeMu.Lock()
+	defer purgeMu.Unlock()
+	if time.Since(lastPurge) < idempotencyPurgeInterval {
+		return
+	}
+	lastPurge = time.Now()
+
+	ctx = logging.Detach(ctx)
+	go func() {
+		if _, err := models.PurgeExpiredIdempotencyKeys(ctx); err != nil {
+			logging.Errorf(ctx, "Error purging idempotency keys: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,107 @@
+package middleware
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultMaintenanceMessage is shown to clients when no message was configured
+const defaultMaintenanceMessage = "The capacitor is in read-only maintenance mode, please try again later"
+
+// MaintenanceStatus describes the node's maintenance mode
+type MaintenanceStatus struct {
+	Enabled bool      `json:"enabled"`
+	Message string    `json:"message,omitempty"`
+	Since   time.Time `json:"since,omitzero"`
+}
+
+var (
+	maintenanceMu sync.RWMutex
+	maintenance   MaintenanceStatus
+)
+
+// readOnlyPosts are POST endpoints that don't modify state and stay available in maintenance mode.
+// Paths are relative to the API prefix, see RoutePath.
+var readOnlyPosts = map[string]bool{
+	"/login":          true,
+	"/logout":         true,
+	"/backup_account": true, // encrypted backup export
+}
+
+// SetMaintenanceMode switches read-only maintenance mode on or off. An empty message
+// falls back to a generic one.
+func SetMaintenanceMode(enabled bool, message string) MaintenanceStatus {
+	maintenanceMu.Lock()
+	defer maintenanceMu.Unlock()
+
+	if !enabled {
+		maintenance = MaintenanceStatus{}
+		return maintenance
+	}
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	since := maintenance.Since
+	if !maintenance.Enabled {
+		since = time.Now()
+	}
+	maintenance = MaintenanceStatus{Enabled: true, Message: message, Since: since}
+	return maintenance
+}
+
+// Maintenance returns the current maintenance mode
+func Maintenance() MaintenanceStatus {
+	maintenanceMu.RLock()
+	defer maintenanceMu.RUnlock()
+	return maintenance
+}
+
+// MaintenanceGuard rejects writes with 503 while maintenance mode is on; reads keep working
+func MaintenanceGuard(c *fiber.Ctx) error {
+	status := Maintenance()
+	if !status.Enabled {
+		return c.Next()
+	}
+
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		return c.Next()
+	case fiber.MethodPost:
+		if readOnlyPosts[RoutePath(c.Path())] {
+			return c.Next()
+		}
+	}
+
+	c.Set(fiber.HeaderRetryAfter, "60")
+	return apierror.Respond(c, fiber.StatusServiceUnavailable, apierror.Maintenance, status.Message, nil)
+}
+
+// adminToken authenticates operator endpoints; empty disables them. It is replaced at
+// runtime when the token's secret file changes.
+var adminToken atomic.Value
+
+// SetAdminToken configures the shared secret required by AdminAuth
+func SetAdminToken(token string) {
+	adminToken.Store(token)
+}
+
+// AdminAuth protects operator endpoints with the admin token
+func AdminAuth(c *fiber.Ctx) error {
+	token, _ := adminToken.Load().(string)
+	if token == "" {
+		return apierror.Respond(c, fiber.StatusNotFound, apierror.NotFound, "Admin endpoints are not enabled on this node", nil)
+	}
+
+	provided := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !utils.ConstantTimeEqualString(provided, token) {
+		RecordAuthFailure()
+		return apierror.Respond(c, fiber.StatusUnauthorized, apierror.Unauthorized, "Invalid admin token", nil)
+	}
+	return c.Next()
+}
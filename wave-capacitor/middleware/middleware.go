@@ -1,22 +1,71 @@
 package middleware
 
 import (
+	"errors"
+	"strings"
+	"sync/atomic"
 	"time"
-	"wave_capacitor/config"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/logging"
+	"wave_capacitor/nodeca"
+	"wave_capacitor/utils"
 
 	jwtware "github.com/gofiber/contrib/jwt"
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// jwtSecret signs and verifies tokens. The middleware is created at package init, before
+// the configuration is loaded, so the secret is looked up per request rather than captured.
+var jwtSecret atomic.Value
+
+// SetJWTSecret configures the secret signing and verifying tokens; call it before serving
+func SetJWTSecret(secret []byte) {
+	jwtSecret.Store(secret)
+}
+
+// signingKey returns the configured JWT secret, refusing to sign or verify without one
+func signingKey() ([]byte, error) {
+	secret, _ := jwtSecret.Load().([]byte)
+	if len(secret) == 0 {
+		return nil, errors.New("JWT secret not configured")
+	}
+	return secret, nil
+}
+
+// verificationKey is the jwt.Keyfunc of JWTMiddleware and ParseToken; only HS256 is accepted
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	if token.Method != jwt.SigningMethodHS256 {
+		return nil, errors.New("unexpected signing method")
+	}
+	return signingKey()
+}
+
+// authFailures counts rejected credentials and tokens since the node started
+var authFailures atomic.Int64
+
+// RecordAuthFailure counts a rejected login, token or operator credential
+func RecordAuthFailure() {
+	authFailures.Add(1)
+}
+
+// AuthFailures returns the number of rejected credentials and tokens since the node
+// started; alerting watches it for spikes
+func AuthFailures() int64 {
+	return authFailures.Load()
+}
+
 // JWTMiddleware protects specific routes requiring authentication
 var JWTMiddleware = jwtware.New(jwtware.Config{
-	SigningKey: jwtware.SigningKey{Key: config.GetJWTSecret()},
+	KeyFunc: verificationKey,
+	SuccessHandler: func(c *fiber.Ctx) error {
+		// Later log lines of the request carry the user's hash
+		c.SetUserContext(logging.WithUser(c.UserContext(), ExtractUsername(c)))
+		return c.Next()
+	},
 	ErrorHandler: func(c *fiber.Ctx, err error) error {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error":   "Unauthorized",
-			"message": "Invalid or expired token",
-		})
+		RecordAuthFailure()
+		return apierror.Respond(c, fiber.StatusUnauthorized, apierror.Unauthorized, "Invalid or expired token", nil)
 	},
 })
 
@@ -30,7 +79,31 @@ func GenerateToken(username string) (string, error) {
 	})
 
 	// Generate encoded token
-	return token.SignedString(config.GetJWTSecret())
+	secret, err := signingKey()
+	if err != nil {
+		return "", err
+	}
+	return token.SignedString(secret)
+}
+
+// ParseToken validates a token issued by GenerateToken and returns its username and
+// issue time (Unix seconds), for callers outside the Fiber middleware chain such as gRPC
+func ParseToken(tokenString string) (string, int64, error) {
+	token, err := jwt.Parse(tokenString, verificationKey, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return "", 0, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return "", 0, errors.New("invalid token claims")
+	}
+	username, _ := claims["username"].(string)
+	if username == "" {
+		return "", 0, errors.New("token has no username")
+	}
+	issuedAt, _ := claims["iat"].(float64)
+	return username, int64(issuedAt), nil
 }
 
 // ExtractUsername gets the username from the JWT token
@@ -39,3 +112,77 @@ func ExtractUsername(c *fiber.Ctx) string {
 	claims := user.Claims.(jwt.MapClaims)
 	return claims["username"].(string)
 }
+
+// OptionalJWT authenticates requests carrying a token as JWTMiddleware does and lets
+// requests without one through, for public routes that do more for the account's owner.
+// Use it before RevocationCheck and read the username with AuthenticatedUsername.
+func OptionalJWT(c *fiber.Ctx) error {
+	if c.Get(fiber.HeaderAuthorization) == "" {
+		return c.Next()
+	}
+	return JWTMiddleware(c)
+}
+
+// AuthenticatedUsername returns the username of the request's token, or "" when a route
+// using OptionalJWT got none
+func AuthenticatedUsername(c *fiber.Ctx) string {
+	if _, ok := c.Locals("user").(*jwt.Token); !ok {
+		return ""
+	}
+	return ExtractUsername(c)
+}
+
+// DerivedKey derives a key for purpose from the JWT secret, for other values the
+// capacitors sharing that secret issue and check without storing them
+func DerivedKey(purpose string) ([]byte, error) {
+	secret, err := signingKey()
+	if err != nil {
+		return nil, err
+	}
+	return utils.DeriveKey(secret, nil, purpose, 32)
+}
+
+// transferToken authenticates node-to-node shard transfers; empty disables those endpoints.
+// It is replaced at runtime when the token's secret file changes.
+var transferToken atomic.Value
+
+// SetTransferToken configures the shared secret required by TransferAuth
+func SetTransferToken(token string) {
+	transferToken.Store(token)
+}
+
+// nodeTLSRequired makes NodeTLS refuse requests without a node certificate
+var nodeTLSRequired bool
+
+// SetNodeTLS requires a node certificate on the endpoints NodeTLS guards; call it before serving
+func SetNodeTLS(required bool) {
+	nodeTLSRequired = required
+}
+
+// NodeTLS guards node-to-node endpoints: with node mutual TLS on, only requests over
+// connections that presented a valid node certificate get through (see the nodeca package)
+func NodeTLS(c *fiber.Ctx) error {
+	if !nodeTLSRequired {
+		return c.Next()
+	}
+	if nodeca.PeerName(c.Context().TLSConnectionState()) == "" {
+		RecordAuthFailure()
+		return apierror.Respond(c, fiber.StatusUnauthorized, apierror.Unauthorized, "A node certificate is required", nil)
+	}
+	return c.Next()
+}
+
+// TransferAuth protects shard transfer endpoints with the shared transfer token
+func TransferAuth(c *fiber.Ctx) error {
+	token, _ := transferToken.Load().(string)
+	if token == "" {
+		return apierror.Respond(c, fiber.StatusNotFound, apierror.NotFound, "Shard transfer is not enabled on this node", nil)
+	}
+
+	provided := strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	if !utils.ConstantTimeEqualString(provided, token) {
+		RecordAuthFailure()
+		return apierror.Respond(c, fiber.StatusUnauthorized, apierror.Unauthorized, "Invalid transfer token", nil)
+	}
+	return c.Next()
+}
@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/logging"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RateLimitStore counts requests per key in fixed windows
+type RateLimitStore interface {
+	// Hit counts a request against key and returns the number of requests in the
+	// current window and the time until the window resets
+	Hit(ctx context.Context, key string, window time.Duration) (int, time.Duration, error)
+}
+
+// RateLimits are the request budgets per window; 0 disables a budget
+type RateLimits struct {
+	Window time.Duration
+	Global int // per client IP, all endpoints
+	User   int // per authenticated user, all protected endpoints
+	Auth   int // per client IP on register, login and account recovery
+	Send   int // per authenticated user on send_message
+}
+
+var (
+	rateLimitStore RateLimitStore // nil disables rate limiting
+	rateLimits     RateLimits
+)
+
+// SetRateLimiter configures the store and budgets used by the rate limiting middleware
+func SetRateLimiter(store RateLimitStore, limits RateLimits) {
+	rateLimitStore = store
+	rateLimits = limits
+}
+
+// GlobalRateLimit limits all requests per client IP
+func GlobalRateLimit(c *fiber.Ctx) error {
+	return rateLimit(c, "global", "ip:"+c.IP(), rateLimits.Global)
+}
+
+// UserRateLimit limits requests per authenticated user; use it after JWTMiddleware
+func UserRateLimit(c *fiber.Ctx) error {
+	return rateLimit(c, "user", "user:"+ExtractUsername(c), rateLimits.User)
+}
+
+// AuthRateLimit applies the stricter budget of the credential endpoints per client IP
+func AuthRateLimit(c *fiber.Ctx) error {
+	return rateLimit(c, "auth", "ip:"+c.IP(), rateLimits.Auth)
+}
+
+// SendRateLimit applies the budget of message sending per authenticated user
+func SendRateLimit(c *fiber.Ctx) error {
+	return rateLimit(c, "send", "user:"+ExtractUsername(c), rateLimits.Send)
+}
+
+// rateLimit counts the request against the budget and rejects it with 429 once the
+// budget is spent. The RateLimit-* headers follow the IETF RateLimit header fields draft.
+func rateLimit(c *fiber.Ctx, scope, key string, limit int) error {
+	count, reset, ok := hitRateLimit(c.UserContext(), scope, key, limit)
+	if !ok {
+		return c.Next()
+	}
+
+	resetSeconds := strconv.Itoa(int((reset + time.Second - 1) / time.Second))
+	remaining := limit - count
+	if remaining < 0 {
+		remaining = 0
+	}
+	c.Set("RateLimit-Limit", strconv.Itoa(limit))
+	c.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	c.Set("RateLimit-Reset", resetSeconds)
+
+	if count > limit {
+		c.Set(fiber.HeaderRetryAfter, resetSeconds)
+		return apierror.Respond(c, fiber.StatusTooManyRequests, apierror.RateLimited, "Too many requests, please slow down", nil)
+	}
+	return c.Next()
+}
+
+// hitRateLimit counts a request against key in the budget of scope, returning the count
+// in the window and the time until it resets; ok is false when the budget is disabled.
+// Store failures let the request through: an unavailable limiter must not take the API down.
+func hitRateLimit(ctx context.Context, scope, key string, limit int) (count int, reset time.Duration, ok bool) {
+	if rateLimitStore == nil || limit <= 0 {
+		return 0, 0, false
+	}
+	count, reset, err := rateLimitStore.Hit(ctx, "ratelimit:"+scope+":"+key, rateLimits.Window)
+	if err != nil {
+		logging.Errorf(ctx, "Error checking %s rate limit: %v", scope, err)
+		return 0, 0, false
+	}
+	return count, reset, true
+}
+
+// overLimit counts a call made without Fiber against a budget, returning the time until
+// the budget resets once it is spent
+func overLimit(ctx context.Context, scope, key string, limit int) (time.Duration, bool) {
+	count, reset, ok := hitRateLimit(ctx, scope, key, limit)
+	return reset, ok && count > limit
+}
+
+// GlobalLimitExceeded counts a call of another transport, e.g. gRPC, from clientIP against
+// the budget of GlobalRateLimit. Both transports share the counters.
+func GlobalLimitExceeded(ctx context.Context, clientIP string) (time.Duration, bool) {
+	return overLimit(ctx, "global", "ip:"+clientIP, rateLimits.Global)
+}
+
+// UserLimitExceeded counts a call of another transport by username against the budget of
+// UserRateLimit
+func UserLimitExceeded(ctx context.Context, username string) (time.Duration, bool) {
+	return overLimit(ctx, "user", "user:"+username, rateLimits.User)
+}
+
+// AuthLimitExceeded counts a credential call of another transport from clientIP against
+// the budget of AuthRateLimit
+func AuthLimitExceeded(ctx context.Context, clientIP string) (time.Duration, bool) {
+	return overLimit(ctx, "auth", "ip:"+clientIP, rateLimits.Auth)
+}
+
+// SendLimitExceeded counts a message sent over another transport by username against the
+// budget of SendRateLimit
+func SendLimitExceeded(ctx context.Context, username string) (time.Duration, bool) {
+	return overLimit(ctx, "send", "user:"+username, rateLimits.Send)
+}
+
+// MemoryRateLimitStore keeps the counters in process memory. Each capacitor node counts
+// on its own; use the Redis store to share budgets across nodes.
+type MemoryRateLimitStore struct {
+	mu        sync.Mutex
+	windows   map[string]*rateWindow
+	lastSweep time.Time
+}
+
+type rateWindow struct {
+	count int
+	reset time.Time
+}
+
+// NewMemoryRateLimitStore creates an empty in-memory store
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{windows: make(map[string]*rateWindow), lastSweep: time.Now()}
+}
+
+// Hit implements RateLimitStore
+func (s *MemoryRateLimitStore) Hit(ctx context.Context, key string, window time.Duration) (int, time.Duration, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Drop expired windows once per window so idle clients don't accumulate
+	if now.Sub(s.lastSweep) > window {
+		for k, w := range s.windows {
+			if !now.Before(w.reset) {
+				delete(s.windows, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	w, ok := s.windows[key]
+	if !ok || !now.Before(w.reset) {
+		w = &rateWindow{reset: now.Add(window)}
+		s.windows[key] = w
+	}
+	w.count++
+	return w.count, w.reset.Sub(now), nil
+}
@@ -0,0 +1,195 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateLimitScript increments the window counter, starts the window on the first hit and
+// returns the count and the milliseconds left in the window
+const rateLimitScript = `local n = redis.call('INCR', KEYS[1])
+if n == 1 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+return {n, redis.call('PTTL', KEYS[1])}`
+
+// redisPoolSize bounds the idle connections kept by RedisRateLimitStore
+const redisPoolSize = 8
+
+// RedisRateLimitStore keeps the counters in Redis so all capacitor nodes share the
+// budgets. It speaks just enough of the RESP protocol to run the counter script.
+type RedisRateLimitStore struct {
+	addr     string
+	password string
+	timeout  time.Duration
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedisRateLimitStore creates a store for the Redis server at addr (host:port).
+// The connection is verified with a PING.
+func NewRedisRateLimitStore(addr, password string) (*RedisRateLimitStore, error) {
+	s := &RedisRateLimitStore{
+		addr:     addr,
+		password: password,
+		timeout:  2 * time.Second,
+		idle:     make(chan *redisConn, redisPoolSize),
+	}
+
+	conn, err := s.get(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.do("PING"); err != nil {
+		conn.conn.Close()
+		return nil, fmt.Errorf("redis ping failed: %v", err)
+	}
+	s.put(conn)
+	return s, nil
+}
+
+// Hit implements RateLimitStore
+func (s *RedisRateLimitStore) Hit(ctx context.Context, key string, window time.Duration) (int, time.Duration, error) {
+	conn, err := s.get(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	deadline := time.Now().Add(s.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.conn.SetDeadline(deadline)
+
+	reply, err := conn.do("EVAL", rateLimitScript, "1", key, strconv.FormatInt(window.Milliseconds(), 10))
+	if err != nil {
+		// The connection state is unknown after a failed command
+		conn.conn.Close()
+		return 0, 0, err
+	}
+	s.put(conn)
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return 0, 0, errors.New("unexpected redis reply")
+	}
+	count, _ := values[0].(int64)
+	ttl, _ := values[1].(int64)
+	if ttl < 0 {
+		ttl = window.Milliseconds()
+	}
+	return int(count), time.Duration(ttl) * time.Millisecond, nil
+}
+
+// Close closes the idle connections
+func (s *RedisRateLimitStore) Close() {
+	for {
+		select {
+		case conn := <-s.idle:
+			conn.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// get returns an idle connection or dials a new one
+func (s *RedisRateLimitStore) get(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-s.idle:
+		return conn, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: s.timeout}
+	nc, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %v", err)
+	}
+	conn := &redisConn{conn: nc, reader: bufio.NewReader(nc)}
+
+	if s.password != "" {
+		nc.SetDeadline(time.Now().Add(s.timeout))
+		if _, err := conn.do("AUTH", s.password); err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("redis authentication failed: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+// put returns a healthy connection to the pool, closing it when the pool is full
+func (s *RedisRateLimitStore) put(conn *redisConn) {
+	select {
+	case s.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+// do sends a command and reads its reply
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply parses one RESP reply: simple strings, errors, integers, bulk strings and arrays
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("malformed redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unknown redis reply type %q", line[0])
+	}
+}
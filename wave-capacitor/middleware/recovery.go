@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/crashreport"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Recover turns a panic in a later handler into a 500 response in the API's error format,
+// so one bad request doesn't take down the node. The panic is logged with its stack,
+// counted and reported (see crashreport). Register it after RequestLogger so the request
+// is logged with the 500.
+func Recover(c *fiber.Ctx) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			crashreport.Recovered(c.UserContext(), recovered, map[string]string{
+				"method": c.Method(),
+				"route":  c.Route().Path,
+			})
+			err = apierror.Respond(c, fiber.StatusInternalServerError, apierror.Internal, "Internal server error", nil)
+		}
+	}()
+	return c.Next()
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/logging"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequestID accepts the caller's X-Request-ID (or generates one), echoes it in the
+// response header and attaches it to the request context, so every log line of the
+// request and every call relayed to another node carries it. JSON error bodies get a
+// "request_id" field that users can quote when reporting problems.
+func RequestID(c *fiber.Ctx) error {
+	id := c.Get(logging.RequestIDHeader)
+	if !logging.ValidRequestID(id) {
+		id = logging.NewRequestID()
+	}
+	c.Locals("request_id", id)
+	c.SetUserContext(logging.WithRequestID(c.UserContext(), id))
+	c.Set(logging.RequestIDHeader, id)
+
+	if err := c.Next(); err != nil {
+		return err
+	}
+	tagErrorBody(c, id)
+	return nil
+}
+
+// GetRequestID returns the ID of the current request
+func GetRequestID(c *fiber.Ctx) string {
+	id, _ := c.Locals("request_id").(string)
+	return id
+}
+
+// tagErrorBody adds the request ID to JSON error responses that don't carry it yet
+func tagErrorBody(c *fiber.Ctx, id string) {
+	resp := c.Response()
+	if resp.StatusCode() < fiber.StatusBadRequest || !bytes.HasPrefix(resp.Header.ContentType(), []byte(fiber.MIMEApplicationJSON)) {
+		return
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(resp.Body(), &body); err != nil {
+		return
+	}
+	if _, ok := body["request_id"]; ok {
+		return
+	}
+	body["request_id"] = id
+	if data, err := json.Marshal(body); err == nil {
+		resp.SetBody(data)
+	}
+}
+
+// slowRequest is the latency above which RequestLogger logs requests as slow; 0 disables it
+var slowRequest atomic.Int64
+
+// SetSlowRequestThreshold configures when RequestLogger logs a request as slow
+func SetSlowRequestThreshold(threshold time.Duration) {
+	slowRequest.Store(int64(threshold))
+}
+
+// RequestLogger writes one structured log line per request with its ID, status and latency.
+// Slow requests are logged at warning level with their route.
+func RequestLogger(c *fiber.Ctx) error {
+	start := time.Now()
+	if err := c.Next(); err != nil {
+		// Render the error now so the logged status matches the response
+		if err := ErrorHandler(c, err); err != nil {
+			return err
+		}
+	}
+
+	status := c.Response().StatusCode()
+	latency := time.Since(start)
+	logger := logging.FromContext(c.UserContext())
+	attrs := []interface{}{
+		"method", c.Method(),
+		"path", c.Path(),
+		"status", status,
+		"latency_ms", latency.Milliseconds(),
+		"ip", c.IP(),
+	}
+	threshold := time.Duration(slowRequest.Load())
+	switch {
+	case status >= fiber.StatusInternalServerError:
+		logger.Error("request", attrs...)
+	case threshold > 0 && latency >= threshold:
+		logger.Warn("slow request", append(attrs, "route", c.Route().Path, "threshold_ms", threshold.Milliseconds())...)
+	default:
+		logger.Info("request", attrs...)
+	}
+	return nil
+}
+
+// ErrorHandler renders errors returned by handlers in the API's JSON error format
+func ErrorHandler(c *fiber.Ctx, err error) error {
+	code := fiber.StatusInternalServerError
+	message := "Internal server error"
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		code = fiberErr.Code
+		message = fiberErr.Message
+	} else {
+		logging.Errorf(c.UserContext(), "Error handling %s %s: %v", c.Method(), c.Path(), err)
+	}
+
+	return apierror.Respond(c, code, "", message, nil)
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"context"
+	"sync"
+	"time"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/logging"
+	"wave_capacitor/models"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// revocationCacheTTL bounds how long a revocation made on another capacitor can go unnoticed
+const revocationCacheTTL = 30 * time.Second
+
+type cachedRevocation struct {
+	revokedAt time.Time
+	fetchedAt time.Time
+}
+
+var (
+	revocationMu    sync.Mutex
+	revocationCache = make(map[string]cachedRevocation)
+)
+
+// tokensRevokedAt returns the user's revocation time, consulting the database at most
+// once per revocationCacheTTL
+func tokensRevokedAt(ctx context.Context, username string) (time.Time, error) {
+	revocationMu.Lock()
+	cached, ok := revocationCache[username]
+	revocationMu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < revocationCacheTTL {
+		return cached.revokedAt, nil
+	}
+
+	revokedAt, err := models.TokensRevokedAt(ctx, username)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	revocationMu.Lock()
+	revocationCache[username] = cachedRevocation{revokedAt: revokedAt, fetchedAt: time.Now()}
+	revocationMu.Unlock()
+	return revokedAt, nil
+}
+
+// NoteRevocation makes this node reject the user's existing tokens immediately,
+// without waiting for the revocation cache to expire
+func NoteRevocation(username string) {
+	revocationMu.Lock()
+	revocationCache[username] = cachedRevocation{revokedAt: time.Now(), fetchedAt: time.Now()}
+	revocationMu.Unlock()
+}
+
+// RevocationCheck rejects tokens issued before the user's tokens were revoked
+// (e.g. on account deletion). It must run after JWTMiddleware.
+func RevocationCheck(c *fiber.Ctx) error {
+	token, ok := c.Locals("user").(*jwt.Token)
+	if !ok {
+		return c.Next()
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	username, _ := claims["username"].(string)
+	issuedAt, _ := claims["iat"].(float64)
+
+	revoked, err := TokenRevoked(c.UserContext(), username, int64(issuedAt))
+	if err != nil {
+		logging.Errorf(c.UserContext(), "Error checking token revocation for %s: %v", username, err)
+		return apierror.Respond(c, fiber.StatusServiceUnavailable, apierror.Unavailable, "Unable to verify token, please try again later", nil)
+	}
+
+	if revoked {
+		RecordAuthFailure()
+		return apierror.Respond(c, fiber.StatusUnauthorized, apierror.TokenRevoked, "Token has been revoked", nil)
+	}
+	return c.Next()
+}
+
+// TrackLastSeen records that the authenticated account was seen, see NoteSeen. It must
+// run after RevocationCheck.
+func TrackLastSeen(c *fiber.Ctx) error {
+	if token, ok := c.Locals("user").(*jwt.Token); ok {
+		username, _ := token.Claims.(jwt.MapClaims)["username"].(string)
+		NoteSeen(username)
+	}
+	return c.Next()
+}
+
+// NoteSeen records that username made an authenticated request, written behind it.
+// Nothing is recorded in maintenance mode, which keeps the database unwritten.
+func NoteSeen(username string) {
+	if username != "" && !Maintenance().Enabled {
+		models.TouchLastSeen(username)
+	}
+}
+
+// TokenRevoked reports whether a token of username issued at issuedAt (Unix seconds) has been revoked
+func TokenRevoked(ctx context.Context, username string, issuedAt int64) (bool, error) {
+	revokedAt, err := tokensRevokedAt(ctx, username)
+	if err != nil {
+		return false, err
+	}
+	return !revokedAt.IsZero() && issuedAt <= revokedAt.Unix(), nil
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"fmt"
+	"wave_capacitor/tracing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Tracing starts a server span per request, continuing the caller's trace from its
+// traceparent header, and puts it in the request context so storage, database and
+// outgoing calls are recorded as its children. Register it before RequestLogger, which
+// renders errors, so the span sees the final status.
+func Tracing(c *fiber.Ctx) error {
+	if !tracing.Enabled() {
+		return c.Next()
+	}
+
+	ctx := tracing.Extract(c.UserContext(), c.Get(tracing.TraceParentHeader))
+	ctx, span := tracing.Start(ctx, c.Method(), tracing.KindServer)
+	c.SetUserContext(ctx)
+
+	err := c.Next()
+
+	// The route is only known once the router matched it
+	route := c.Route().Path
+	status := c.Response().StatusCode()
+	span.SetName(c.Method() + " " + route)
+	span.SetAttribute("http.request.method", c.Method())
+	span.SetAttribute("http.route", route)
+	span.SetAttribute("http.response.status_code", status)
+	span.SetAttribute("request_id", GetRequestID(c))
+	if err != nil {
+		span.End(err)
+	} else if status >= fiber.StatusInternalServerError {
+		span.End(fmt.Errorf("status %d", status))
+	} else {
+		span.End(nil)
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// API versions. Handlers that change their response shape check APIVersion and keep
+// the old shape for legacy clients.
+const (
+	APIVersionLegacy = 0 // unversioned /api/... paths
+	APIVersion1      = 1 // /api/v1/...
+)
+
+// CurrentAPIPrefix is the path prefix of the current API version
+const CurrentAPIPrefix = "/api/v1"
+
+// legacySunset is the HTTP date after which the legacy paths may be removed; empty omits it
+var legacySunset string
+
+// SetLegacySunset configures the Sunset header sent on legacy API responses
+func SetLegacySunset(date string) {
+	legacySunset = date
+}
+
+// WithAPIVersion records the API version a route group serves
+func WithAPIVersion(version int) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Locals("api_version", version)
+		return c.Next()
+	}
+}
+
+// APIVersion returns the API version of the current request
+func APIVersion(c *fiber.Ctx) int {
+	if version, ok := c.Locals("api_version").(int); ok {
+		return version
+	}
+	return APIVersionLegacy
+}
+
+// Deprecated marks responses of the legacy paths as deprecated and points clients to the
+// same endpoint under the current version (RFC 8594 Sunset, draft Deprecation header)
+func Deprecated(c *fiber.Ctx) error {
+	c.Set("Deprecation", "true")
+	c.Set(fiber.HeaderLink, "<"+CurrentAPIPrefix+RoutePath(c.Path())+`>; rel="successor-version"`)
+	if legacySunset != "" {
+		c.Set("Sunset", legacySunset)
+	}
+	return c.Next()
+}
+
+// RoutePath strips the API prefix (versioned or legacy) from a request path, e.g.
+// "/api/v1/login" and "/api/login" both become "/login"
+func RoutePath(path string) string {
+	path = strings.TrimSuffix(path, "/")
+	if rest, ok := strings.CutPrefix(path, CurrentAPIPrefix); ok && (rest == "" || rest[0] == '/') {
+		return rest
+	}
+	return strings.TrimPrefix(path, "/api")
+}
@@ -0,0 +1,160 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// UserSummary is the operator's view of an account
+type UserSummary struct {
+	Username       string     `json:"username"`
+	PublicKey      string     `json:"public_key"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DisabledAt     *time.Time `json:"disabled_at,omitempty"`
+	DisabledReason string     `json:"disabled_reason,omitempty"`
+	LastSeenAt     *time.Time `json:"last_seen_at,omitempty" doc:"Last authenticated request, written in batches and so up to DB_WRITE_BEHIND_MS behind"`
+}
+
+const userSummaryColumns = `username, public_key, created_at, disabled_at, disabled_reason, last_seen_at`
+
+// scanUserSummary reads a row selected with userSummaryColumns
+func scanUserSummary(row interface{ Scan(...interface{}) error }) (UserSummary, error) {
+	var user UserSummary
+	var createdAt, disabledAt, lastSeenAt sql.NullTime
+	if err := row.Scan(&user.Username, &user.PublicKey, &createdAt, &disabledAt, &user.DisabledReason, &lastSeenAt); err != nil {
+		return user, err
+	}
+	user.CreatedAt = createdAt.Time
+	if disabledAt.Valid {
+		user.DisabledAt = &disabledAt.Time
+	}
+	if lastSeenAt.Valid {
+		user.LastSeenAt = &lastSeenAt.Time
+	}
+	return user, nil
+}
+
+// SearchUsers returns up to limit accounts whose username contains query, ordered by
+// username and starting after the given username (for paging)
+func SearchUsers(ctx context.Context, query, after string, limit int) ([]UserSummary, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	pattern := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(query) + "%"
+	var users []UserSummary
+	sqlQuery := `SELECT ` + userSummaryColumns + ` FROM users
+		WHERE username LIKE $1 AND username > $2 ORDER BY username LIMIT $3`
+	err := withRetry(ctx, "SearchUsers", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, sqlQuery, pattern, after, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		users = []UserSummary{}
+		for rows.Next() {
+			user, err := scanUserSummary(rows)
+			if err != nil {
+				return err
+			}
+			users = append(users, user)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error searching users: %v", err)
+	}
+	return users, nil
+}
+
+// GetUserSummary returns the operator's view of one account
+func GetUserSummary(ctx context.Context, username string) (*UserSummary, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var user UserSummary
+	query := `SELECT ` + userSummaryColumns + ` FROM users WHERE username = $1`
+	err := withRetry(ctx, "GetUserSummary", func(ctx context.Context) error {
+		var err error
+		user, err = scanUserSummary(db.QueryRowContext(ctx, query, username))
+		return err
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving user: %v", err)
+	}
+	return &user, nil
+}
+
+// SetUserDisabled disables or re-enables an account. Disabling also revokes the user's
+// tokens; reason is kept for operators and cleared on re-enable.
+func SetUserDisabled(ctx context.Context, username string, disabled bool, reason string) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	err := withTx(ctx, "SetUserDisabled", func(ctx context.Context, tx *sql.Tx) error {
+		query := `UPDATE users SET disabled_at = NULL, disabled_reason = '' WHERE username = $1`
+		args := []interface{}{username}
+		if disabled {
+			query = `UPDATE users SET disabled_at = COALESCE(disabled_at, CURRENT_TIMESTAMP), disabled_reason = $2 WHERE username = $1`
+			args = append(args, reason)
+		}
+
+		result, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrUserNotFound
+		}
+
+		if disabled {
+			return revokeTokens(ctx, tx, username)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update account status: %v", err)
+	}
+
+	if disabled {
+		logger.Info(ctx, "disabled user", "username", username)
+	} else {
+		logger.Info(ctx, "re-enabled user", "username", username)
+	}
+	return nil
+}
+
+// UserDisabled reports whether an operator disabled the account; unknown users are not disabled
+func UserDisabled(ctx context.Context, username string) (bool, error) {
+	if db == nil {
+		return false, errors.New("database connection not initialized")
+	}
+
+	var disabled bool
+	query := `SELECT disabled_at IS NOT NULL FROM users WHERE username = $1`
+	err := withRetry(ctx, "UserDisabled", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, username).Scan(&disabled)
+	})
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error checking account status: %v", err)
+	}
+	return disabled, nil
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrUsernameTaken is returned when a new username is already in use or reserved as an alias
+var ErrUsernameTaken = errors.New("username already taken")
+
+// usernameTables lists every table keyed by username that must follow a rename
+var usernameTables = []string{"user_key_history", "prekeys", "signed_prekeys", "session_blobs", "webhooks", "account_changes", "stored_backups", "blocked_keys", "discovery_identities"}
+
+// ChangeUsername renames an account in a single transaction: the users row, every table
+// keyed by username, and existing aliases move to newName, and oldName is recorded as an alias.
+func ChangeUsername(ctx context.Context, oldName, newName string) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	defer accountCache.invalidate(oldName, newName)
+	err := withTx(ctx, "ChangeUsername", func(ctx context.Context, tx *sql.Tx) error {
+		// The new name must be free, unless it is one of this user's own former names
+		var taken bool
+		query := `SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)
+			OR EXISTS(SELECT 1 FROM user_aliases WHERE alias = $1 AND username <> $2)`
+		if err := tx.QueryRowContext(ctx, query, newName, oldName).Scan(&taken); err != nil {
+			return fmt.Errorf("error checking username: %w", err)
+		}
+		if taken {
+			return ErrUsernameTaken
+		}
+
+		result, err := tx.ExecContext(ctx, `UPDATE users SET username = $1, updated_at = CURRENT_TIMESTAMP WHERE username = $2`, newName, oldName)
+		if err != nil {
+			return fmt.Errorf("failed to rename user: %w", err)
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return fmt.Errorf("error getting rows affected: %w", err)
+		} else if n == 0 {
+			return ErrUserNotFound
+		}
+
+		for _, table := range usernameTables {
+			if _, err := tx.ExecContext(ctx, "UPDATE "+table+" SET username = $1 WHERE username = $2", newName, oldName); err != nil {
+				return fmt.Errorf("failed to rename user in %s: %w", table, err)
+			}
+		}
+		// Rows left behind by a deleted account under the new name must not collide
+		if _, err := tx.ExecContext(ctx, `DELETE FROM contacts WHERE owner = $1`, newName); err != nil {
+			return fmt.Errorf("failed to clear stale contacts: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE contacts SET owner = $1 WHERE owner = $2`, newName, oldName); err != nil {
+			return fmt.Errorf("failed to rename user in contacts: %w", err)
+		}
+
+		// Reclaiming a former name drops that alias; all others now point at the new name
+		if _, err := tx.ExecContext(ctx, `DELETE FROM user_aliases WHERE alias = $1`, newName); err != nil {
+			return fmt.Errorf("failed to update aliases: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE user_aliases SET username = $1 WHERE username = $2`, newName, oldName); err != nil {
+			return fmt.Errorf("failed to update aliases: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO user_aliases (alias, username) VALUES ($1, $2)`, oldName, newName); err != nil {
+			return fmt.Errorf("failed to record alias: %w", err)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrUsernameTaken) || errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("username change failed: %v", err)
+	}
+
+	logger.Info(ctx, "renamed user", "username", newName, "previous_username", oldName)
+	return nil
+}
+
+// ResolveUsername follows a former username to the account's current name.
+// Names that are not aliases are returned unchanged.
+func ResolveUsername(ctx context.Context, name string) (string, error) {
+	if db == nil {
+		return "", errors.New("database connection not initialized")
+	}
+
+	var username string
+	query := `SELECT username FROM user_aliases WHERE alias = $1`
+	err := withRetry(ctx, "ResolveUsername", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, name).Scan(&username)
+	})
+	if err == sql.ErrNoRows {
+		return name, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error resolving username: %v", err)
+	}
+	return username, nil
+}
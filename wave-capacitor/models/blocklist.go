@@ -0,0 +1,160 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrBlockNotFound is returned when the key is not on the user's blocklist
+var ErrBlockNotFound = errors.New("key not blocked")
+
+// ErrBlocklistFull is returned when the user's blocklist already holds the most keys allowed
+var ErrBlocklistFull = errors.New("blocklist limit reached")
+
+// BlockedKey is an entry of a user's blocklist
+type BlockedKey struct {
+	PublicKey string    `json:"public_key"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BlockKey adds publicKey to the user's blocklist unless it already holds maxPerUser keys,
+// in which case ErrBlocklistFull is returned. Blocking a key twice is not an error.
+func BlockKey(ctx context.Context, username, publicKey string, maxPerUser int) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	var result sql.Result
+	query := `INSERT INTO blocked_keys (username, public_key)
+		SELECT $1, $2 WHERE (SELECT count(*) FROM blocked_keys WHERE username = $1) < $3
+		ON CONFLICT (username, public_key) DO NOTHING`
+	err := withRetry(ctx, "BlockKey", func(ctx context.Context) error {
+		var err error
+		result, err = db.ExecContext(ctx, query, username, publicKey, maxPerUser)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to block key: %v", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("error getting rows affected: %v", err)
+	} else if n == 0 {
+		// Nothing was inserted, either because the key is blocked already or the list is full
+		blocked, err := IsKeyBlocked(ctx, username, publicKey)
+		if err != nil {
+			return err
+		}
+		if !blocked {
+			return ErrBlocklistFull
+		}
+	}
+	return nil
+}
+
+// UnblockKey removes publicKey from the user's blocklist
+func UnblockKey(ctx context.Context, username, publicKey string) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	var result sql.Result
+	err := withRetry(ctx, "UnblockKey", func(ctx context.Context) error {
+		var err error
+		result, err = db.ExecContext(ctx, `DELETE FROM blocked_keys WHERE username = $1 AND public_key = $2`, username, publicKey)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to unblock key: %v", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("error getting rows affected: %v", err)
+	} else if n == 0 {
+		return ErrBlockNotFound
+	}
+	return nil
+}
+
+// ListBlockedKeys returns the user's blocklist, oldest first
+func ListBlockedKeys(ctx context.Context, username string) ([]BlockedKey, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var keys []BlockedKey
+	query := `SELECT public_key, created_at FROM blocked_keys WHERE username = $1 ORDER BY created_at, public_key`
+	err := withRetry(ctx, "ListBlockedKeys", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query, username)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		keys = []BlockedKey{}
+		for rows.Next() {
+			var key BlockedKey
+			if err := rows.Scan(&key.PublicKey, &key.CreatedAt); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing blocked keys: %v", err)
+	}
+	return keys, nil
+}
+
+// IsKeyBlocked reports whether publicKey itself is on the user's blocklist
+func IsKeyBlocked(ctx context.Context, username, publicKey string) (bool, error) {
+	if db == nil {
+		return false, errors.New("database connection not initialized")
+	}
+
+	var blocked bool
+	err := withRetry(ctx, "IsKeyBlocked", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM blocked_keys WHERE username = $1 AND public_key = $2)`,
+			username, publicKey).Scan(&blocked)
+	})
+	if err != nil {
+		return false, fmt.Errorf("error reading blocklist: %v", err)
+	}
+	return blocked, nil
+}
+
+// IsBlocked reports whether owner blocked the account sender. A block on any key the
+// sender held counts, so rotating keys doesn't get around it.
+func IsBlocked(ctx context.Context, owner, sender string) (bool, error) {
+	return isBlocked(ctx, "username", owner, sender)
+}
+
+// IsBlockedByKey is like IsBlocked for the account whose current public key is
+// ownerPublicKey, e.g. the recipient of a message. Keys no account holds block nobody.
+func IsBlockedByKey(ctx context.Context, ownerPublicKey, sender string) (bool, error) {
+	return isBlocked(ctx, "public_key", ownerPublicKey, sender)
+}
+
+func isBlocked(ctx context.Context, column, value, sender string) (bool, error) {
+	if db == nil {
+		return false, errors.New("database connection not initialized")
+	}
+
+	query := `SELECT EXISTS (
+		SELECT 1 FROM blocked_keys b JOIN users o ON o.username = b.username
+		WHERE o.` + column + ` = $1 AND b.public_key IN (
+			SELECT public_key FROM users WHERE username = $2
+			UNION SELECT public_key FROM user_key_history WHERE username = $2
+		)
+	)`
+	var blocked bool
+	err := withRetry(ctx, "IsBlocked", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, value, sender).Scan(&blocked)
+	})
+	if err != nil {
+		return false, fmt.Errorf("error reading blocklist: %v", err)
+	}
+	return blocked, nil
+}
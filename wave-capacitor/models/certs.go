@@ -0,0 +1,164 @@
+package models
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// certExpiryWarning is how long before expiry the client certificate is reported as expiring
+const certExpiryWarning = 7 * 24 * time.Hour
+
+// CertWatcher notices when the database client certificate is rotated on disk.
+// lib/pq reads the certificate files whenever it opens a connection, so a rotation only
+// needs the pool to drop connections that were authenticated with the old certificate.
+type CertWatcher struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu       sync.Mutex
+	modTime  time.Time
+	notAfter time.Time
+	warnedAt time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewCertWatcher validates the client certificate pair and returns a watcher for it
+func NewCertWatcher(certFile, keyFile string, interval time.Duration) (*CertWatcher, error) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	w := &CertWatcher{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	modTime, err := w.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	notAfter, err := w.load()
+	if err != nil {
+		return nil, err
+	}
+	w.modTime, w.notAfter = modTime, notAfter
+	w.warnIfExpiring()
+	return w, nil
+}
+
+// Start checks the certificate files periodically in the background
+func (w *CertWatcher) Start() {
+	go func() {
+		defer close(w.done)
+
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				w.Check()
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the background checks
+func (w *CertWatcher) Stop() {
+	close(w.stop)
+	<-w.done
+}
+
+// NotAfter returns the expiry of the client certificate currently in use
+func (w *CertWatcher) NotAfter() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.notAfter
+}
+
+// Check reloads the certificate pair if it changed on disk and recycles idle connections.
+// A pair that does not load (e.g. the key was replaced before the certificate) is skipped
+// until the next check so half-finished rotations never reach the pool.
+func (w *CertWatcher) Check() {
+	modTime, err := w.latestModTime()
+	if err != nil {
+		logger.Error(context.Background(), "checking database client certificate failed", "error", err)
+		return
+	}
+
+	w.mu.Lock()
+	changed := modTime.After(w.modTime)
+	w.mu.Unlock()
+	if !changed {
+		w.warnIfExpiring()
+		return
+	}
+
+	notAfter, err := w.load()
+	if err != nil {
+		logger.Warn(context.Background(), "rotated database client certificate is not usable yet", "error", err)
+		return
+	}
+
+	w.mu.Lock()
+	w.modTime, w.notAfter = modTime, notAfter
+	w.mu.Unlock()
+
+	recycleConnections()
+	logger.Info(context.Background(), "database client certificate rotated", "not_after", notAfter.Format(time.RFC3339))
+}
+
+// latestModTime returns the newer modification time of the certificate and key files
+func (w *CertWatcher) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{w.certFile, w.keyFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load parses the certificate pair and returns the leaf certificate's expiry
+func (w *CertWatcher) load() (time.Time, error) {
+	pair, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid database client certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid database client certificate: %v", err)
+	}
+	return leaf.NotAfter, nil
+}
+
+// warnIfExpiring logs, at most hourly, when the certificate in use is close to or past its expiry
+func (w *CertWatcher) warnIfExpiring() {
+	w.mu.Lock()
+	notAfter := w.notAfter
+	recentlyWarned := time.Since(w.warnedAt) < time.Hour
+	if !recentlyWarned {
+		w.warnedAt = time.Now()
+	}
+	w.mu.Unlock()
+
+	if remaining := time.Until(notAfter); remaining < certExpiryWarning && !recentlyWarned {
+		logger.Warn(context.Background(), "database client certificate expires soon", "not_after", notAfter.Format(time.RFC3339),
+			"remaining", remaining.Round(time.Minute).String())
+	}
+}
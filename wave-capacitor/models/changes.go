@@ -0,0 +1,156 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Kinds of account changes
+const (
+	ChangeMessageAdded   = "message"
+	ChangeMessageDeleted = "message_deleted"
+	ChangeContacts       = "contacts"
+)
+
+// ErrChangesPruned is returned when the changes after a sequence number have partly been
+// purged from the log
+var ErrChangesPruned = errors.New("changes have been purged from the log")
+
+// AccountChange is one entry of an account's change log
+type AccountChange struct {
+	Seq           int64
+	Kind          string
+	RecipientHash string // the message's owner, for message changes
+	MessageID     string
+	ChangedAt     time.Time
+}
+
+// RecordChange appends a change to the log of username, taking the account's next
+// sequence number in the same statement
+func RecordChange(ctx context.Context, username, kind, recipientHash, messageID string) error {
+	return recordChange(ctx, "username", username, kind, recipientHash, messageID)
+}
+
+// RecordKeyChange is like RecordChange for the account whose current public key is
+// publicKey, e.g. the recipient of a message. Keys no account holds are ignored.
+func RecordKeyChange(ctx context.Context, publicKey, kind, recipientHash, messageID string) error {
+	return recordChange(ctx, "public_key", publicKey, kind, recipientHash, messageID)
+}
+
+func recordChange(ctx context.Context, column, value, kind, recipientHash, messageID string) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	query := `WITH account AS (
+			UPDATE users SET change_seq = change_seq + 1 WHERE ` + column + ` = $1 RETURNING username, change_seq
+		)
+		INSERT INTO account_changes (username, seq, kind, recipient_hash, message_id, changed_at)
+		SELECT username, change_seq, $2, $3, $4, $5 FROM account`
+	err := withWriteRetry(ctx, "RecordChange", func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, query, value, kind, recipientHash, messageID, time.Now().UTC())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record change: %v", err)
+	}
+	return nil
+}
+
+// ChangeSequence returns the sequence number of the account's latest change and the
+// highest one purged from its log
+func ChangeSequence(ctx context.Context, username string) (latest, prunedThrough int64, err error) {
+	if db == nil {
+		return 0, 0, errors.New("database connection not initialized")
+	}
+
+	err = withRetry(ctx, "ChangeSequence", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, `SELECT change_seq, changes_pruned_through FROM users WHERE username = $1`, username).
+			Scan(&latest, &prunedThrough)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, ErrUserNotFound
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading change sequence: %v", err)
+	}
+	return latest, prunedThrough, nil
+}
+
+// ListChanges returns up to limit changes of the account after sequence number after,
+// oldest first. It fails with ErrChangesPruned when some of them were purged.
+func ListChanges(ctx context.Context, username string, after int64, limit int) ([]AccountChange, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var changes []AccountChange
+	err := withRetry(ctx, "ListChanges", func(ctx context.Context) error {
+		var prunedThrough int64
+		err := db.QueryRowContext(ctx, `SELECT changes_pruned_through FROM users WHERE username = $1`, username).Scan(&prunedThrough)
+		if err != nil {
+			return err
+		}
+		if after < prunedThrough {
+			return ErrChangesPruned
+		}
+
+		rows, err := db.QueryContext(ctx, `SELECT seq, kind, recipient_hash, message_id, changed_at FROM account_changes
+			WHERE username = $1 AND seq > $2 ORDER BY seq LIMIT $3`, username, after, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		changes = []AccountChange{}
+		for rows.Next() {
+			var change AccountChange
+			if err := rows.Scan(&change.Seq, &change.Kind, &change.RecipientHash, &change.MessageID, &change.ChangedAt); err != nil {
+				return err
+			}
+			changes = append(changes, change)
+		}
+		return rows.Err()
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if errors.Is(err, ErrChangesPruned) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing changes: %v", err)
+	}
+	return changes, nil
+}
+
+// PurgeAccountChanges deletes changes older than before, remembering per account the
+// highest sequence number purged, and returns how many were removed
+func PurgeAccountChanges(ctx context.Context, before time.Time) (int64, error) {
+	if db == nil {
+		return 0, errors.New("database connection not initialized")
+	}
+
+	var purged int64
+	err := withTx(ctx, "PurgeAccountChanges", func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `UPDATE users SET changes_pruned_through = purged.seq
+			FROM (SELECT username, max(seq) AS seq FROM account_changes WHERE changed_at < $1 GROUP BY username) AS purged
+			WHERE users.username = purged.username AND purged.seq > users.changes_pruned_through`, before.UTC())
+		if err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, `DELETE FROM account_changes WHERE changed_at < $1`, before.UTC())
+		if err != nil {
+			return err
+		}
+		purged, _ = result.RowsAffected()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error purging account changes: %v", err)
+	}
+	return purged, nil
+}
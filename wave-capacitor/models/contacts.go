@@ -0,0 +1,538 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"wave_capacitor/storage"
+)
+
+// DBContactStore keeps contacts in the contacts table, one row per contact, so updates are
+// transactional and every capacitor sharing the database sees the same lists.
+// With a key ring, nicknames and contact keys are sealed under a scope of the owner's
+// user ID, which a rename doesn't change, and rows are looked up by a keyed hash of the
+// contact key kept in contact_pubkey, so the table doesn't reveal who knows whom.
+type DBContactStore struct {
+	keyRing *storage.KeyRing // nil stores plaintext nicknames and keys
+}
+
+// NewDBContactStore creates a database-backed contact store; keyRing may be nil
+func NewDBContactStore(keyRing *storage.KeyRing) *DBContactStore {
+	return &DBContactStore{keyRing: keyRing}
+}
+
+// contactKeys seals and looks up the contacts of one owner
+type contactKeys struct {
+	keyRing *storage.KeyRing // nil leaves values in plaintext
+	scope   string
+}
+
+// contactScope returns the key scope of the contacts of a user
+func contactScope(userID int) string {
+	return storage.ContactsScope("user/" + strconv.Itoa(userID))
+}
+
+// keysFor returns the contact keys of username
+func (s *DBContactStore) keysFor(ctx context.Context, username string) (contactKeys, error) {
+	if s.keyRing == nil {
+		return contactKeys{}, nil
+	}
+	user, err := GetUser(ctx, username)
+	if err != nil {
+		return contactKeys{}, err
+	}
+	return contactKeys{keyRing: s.keyRing, scope: contactScope(user.ID)}, nil
+}
+
+// lookup returns what the row of a contact key is found by: its keyed hash, or the key
+// itself without a key ring
+func (k contactKeys) lookup(publicKey string) (string, error) {
+	if k.keyRing == nil {
+		return publicKey, nil
+	}
+	mac, err := k.keyRing.MAC(k.scope, []byte(publicKey))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(mac), nil
+}
+
+// sealKey encrypts a contact key for the public_key column; it stays empty without a key
+// ring, as contact_pubkey then holds the key itself
+func (k contactKeys) sealKey(publicKey string) (string, error) {
+	if k.keyRing == nil {
+		return "", nil
+	}
+	return k.seal(publicKey)
+}
+
+// seal encrypts a value for storage in the owner's contacts scope
+func (k contactKeys) seal(value string) (string, error) {
+	if k.keyRing == nil {
+		return value, nil
+	}
+	sealed, err := k.keyRing.Seal(k.scope, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open reverses seal; plaintext values are returned unchanged
+func (k contactKeys) open(stored string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil || !storage.IsEncrypted(sealed) {
+		return stored, nil
+	}
+	if k.keyRing == nil {
+		return "", errors.New("contact is encrypted but no master key is configured")
+	}
+	value, err := k.keyRing.Open(k.scope, sealed)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// ListContacts returns the user's contacts, oldest first
+func (s *DBContactStore) ListContacts(ctx context.Context, username string) ([]storage.Contact, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	query := `SELECT contact_pubkey, public_key, nickname, verification, created_at, modified_at, deleted FROM contacts
+		WHERE owner = $1 AND NOT deleted ORDER BY created_at, contact_pubkey`
+	contacts, err := s.queryContacts(ctx, "ListContacts", username, query, username)
+	if err != nil {
+		return nil, fmt.Errorf("error listing contacts: %v", err)
+	}
+	return contacts, nil
+}
+
+// ContactChanges returns the contacts and tombstones modified after since
+func (s *DBContactStore) ContactChanges(ctx context.Context, username string, since time.Time) ([]storage.Contact, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	query := `SELECT contact_pubkey, public_key, nickname, verification, created_at, modified_at, deleted FROM contacts
+		WHERE owner = $1 AND modified_at > $2 ORDER BY modified_at, contact_pubkey`
+	contacts, err := s.queryContacts(ctx, "ContactChanges", username, query, username, since.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("error listing contact changes: %v", err)
+	}
+	return contacts, nil
+}
+
+// queryContacts runs a query selecting contact rows of username and opens their keys and
+// nicknames
+func (s *DBContactStore) queryContacts(ctx context.Context, op, username, query string, args ...interface{}) ([]storage.Contact, error) {
+	var contacts []storage.Contact
+	var sealedKeys []string
+	err := withRetry(ctx, op, func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		contacts = []storage.Contact{}
+		sealedKeys = []string{}
+		for rows.Next() {
+			var contact storage.Contact
+			var sealedKey string
+			err := rows.Scan(&contact.PublicKey, &sealedKey, &contact.Nickname, &contact.Verification, &contact.CreatedAt, &contact.ModifiedAt, &contact.Deleted)
+			if err != nil {
+				return err
+			}
+			contacts = append(contacts, contact)
+			sealedKeys = append(sealedKeys, sealedKey)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(contacts) == 0 {
+		return contacts, nil
+	}
+
+	keys, err := s.keysFor(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	for i := range contacts {
+		// Rows written without a key ring keep the key itself in contact_pubkey
+		if sealedKeys[i] != "" {
+			if contacts[i].PublicKey, err = keys.open(sealedKeys[i]); err != nil {
+				return nil, err
+			}
+		}
+		if contacts[i].Deleted {
+			contacts[i].Verification = ""
+			continue
+		}
+		if contacts[i].Nickname, err = keys.open(contacts[i].Nickname); err != nil {
+			return nil, err
+		}
+	}
+	return contacts, nil
+}
+
+// sealedContact is a contact as its row stores it
+type sealedContact struct {
+	lookup    string
+	publicKey string
+	nickname  string
+}
+
+// sealContact seals a contact for its row
+func (k contactKeys) sealContact(contact storage.Contact) (sealedContact, error) {
+	var sealed sealedContact
+	var err error
+	if sealed.lookup, err = k.lookup(contact.PublicKey); err != nil {
+		return sealedContact{}, err
+	}
+	if sealed.publicKey, err = k.sealKey(contact.PublicKey); err != nil {
+		return sealedContact{}, err
+	}
+	if sealed.nickname, err = k.seal(contact.Nickname); err != nil {
+		return sealedContact{}, err
+	}
+	return sealed, nil
+}
+
+// PutContact adds a contact or updates its nickname; an existing contact keeps its
+// verification state
+func (s *DBContactStore) PutContact(ctx context.Context, username string, contact storage.Contact) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	keys, err := s.keysFor(ctx, username)
+	if err != nil {
+		return err
+	}
+	sealed, err := keys.sealContact(contact)
+	if err != nil {
+		return err
+	}
+
+	// A contact removed before starts over, like a new one
+	query := `INSERT INTO contacts (owner, contact_pubkey, public_key, nickname, verification, created_at, modified_at)
+		VALUES ($1, $2, $3, $4, COALESCE(NULLIF($5, ''), 'unverified'), $6, $6)
+		ON CONFLICT (owner, contact_pubkey) DO UPDATE SET public_key = excluded.public_key, nickname = excluded.nickname,
+			verification = CASE WHEN contacts.deleted THEN excluded.verification ELSE contacts.verification END,
+			created_at = CASE WHEN contacts.deleted THEN excluded.created_at ELSE contacts.created_at END,
+			modified_at = excluded.modified_at, deleted = false`
+	err = withRetry(ctx, "PutContact", func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, query, username, sealed.lookup, sealed.publicKey, sealed.nickname, contact.Verification, time.Now().UTC())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store contact: %v", err)
+	}
+	return nil
+}
+
+// SetVerification sets the verification state of a single contact
+func (s *DBContactStore) SetVerification(ctx context.Context, username, publicKey, verification string) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	lookup, err := s.lookup(ctx, username, publicKey)
+	if err != nil {
+		return err
+	}
+
+	var result sql.Result
+	query := `UPDATE contacts SET verification = $1, modified_at = $2 WHERE owner = $3 AND contact_pubkey = $4 AND NOT deleted`
+	err = withRetry(ctx, "SetContactVerification", func(ctx context.Context) error {
+		var err error
+		result, err = db.ExecContext(ctx, query, verification, time.Now().UTC(), username, lookup)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update contact: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return storage.ErrContactNotFound
+	}
+	return nil
+}
+
+// lookup returns what the row of username's contact with publicKey is found by
+func (s *DBContactStore) lookup(ctx context.Context, username, publicKey string) (string, error) {
+	keys, err := s.keysFor(ctx, username)
+	if errors.Is(err, ErrUserNotFound) {
+		return "", storage.ErrContactNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return keys.lookup(publicKey)
+}
+
+// DeleteContact replaces a single contact with its tombstone
+func (s *DBContactStore) DeleteContact(ctx context.Context, username, publicKey string) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	lookup, err := s.lookup(ctx, username, publicKey)
+	if err != nil {
+		return err
+	}
+
+	var result sql.Result
+	query := `UPDATE contacts SET nickname = '', deleted = true, modified_at = $1 WHERE owner = $2 AND contact_pubkey = $3 AND NOT deleted`
+	err = withRetry(ctx, "DeleteContact", func(ctx context.Context) error {
+		var err error
+		result, err = db.ExecContext(ctx, query, time.Now().UTC(), username, lookup)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete contact: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return storage.ErrContactNotFound
+	}
+	return nil
+}
+
+// ReplaceContacts replaces the user's whole list in one transaction
+func (s *DBContactStore) ReplaceContacts(ctx context.Context, username string, contacts []storage.Contact) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	keys, err := s.keysFor(ctx, username)
+	if err != nil {
+		return err
+	}
+	sealed := make([]sealedContact, len(contacts))
+	for i, contact := range contacts {
+		if sealed[i], err = keys.sealContact(contact); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC()
+	err = withTx(ctx, "ReplaceContacts", func(ctx context.Context, tx *sql.Tx) error {
+		tombstone := `UPDATE contacts SET nickname = '', deleted = true, modified_at = $1 WHERE owner = $2 AND NOT deleted`
+		if _, err := tx.ExecContext(ctx, tombstone, now, username); err != nil {
+			return err
+		}
+		// Restored contacts keep their original creation time when they have one
+		insert := `INSERT INTO contacts (owner, contact_pubkey, public_key, nickname, verification, created_at, modified_at)
+			VALUES ($1, $2, $3, $4, COALESCE(NULLIF($5, ''), 'unverified'), COALESCE($6, $7), $7)
+			ON CONFLICT (owner, contact_pubkey) DO UPDATE SET public_key = excluded.public_key, nickname = excluded.nickname, verification = excluded.verification,
+				created_at = excluded.created_at, modified_at = excluded.modified_at, deleted = false`
+		for i, contact := range contacts {
+			createdAt := sql.NullTime{Time: contact.CreatedAt, Valid: !contact.CreatedAt.IsZero()}
+			if _, err := tx.ExecContext(ctx, insert, username, sealed[i].lookup, sealed[i].publicKey, sealed[i].nickname, contact.Verification, createdAt, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replace contacts: %v", err)
+	}
+	return nil
+}
+
+// PurgeTombstones deletes the rows of contacts removed before before
+func (s *DBContactStore) PurgeTombstones(ctx context.Context, username string, before time.Time) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	err := withRetry(ctx, "PurgeContactTombstones", func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, `DELETE FROM contacts WHERE owner = $1 AND deleted AND modified_at < $2`, username, before.UTC())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to purge contact tombstones: %v", err)
+	}
+	return nil
+}
+
+// DeleteContacts removes the user's whole list
+func (s *DBContactStore) DeleteContacts(ctx context.Context, username string) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	err := withRetry(ctx, "DeleteContacts", func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, `DELETE FROM contacts WHERE owner = $1`, username)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete contacts: %v", err)
+	}
+	return nil
+}
+
+// legacyContact is a row stored before contact keys were sealed
+type legacyContact struct {
+	owner     string
+	publicKey string
+	nickname  string
+}
+
+// SealContactKeys converts the rows stored without a key ring or before contact keys were
+// sealed: contact_pubkey is replaced by the keyed hash of the key, which is sealed into
+// public_key, and nicknames sealed under the owner's username, current or former, are
+// sealed again under the user ID. Rows of deleted accounts are left alone. It returns the
+// number of rows converted.
+func (s *DBContactStore) SealContactKeys(ctx context.Context) (int, error) {
+	if db == nil {
+		return 0, errors.New("database connection not initialized")
+	}
+	if s.keyRing == nil {
+		return 0, nil
+	}
+
+	var legacy []legacyContact
+	err := withRetry(ctx, "ListLegacyContacts", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, `SELECT owner, contact_pubkey, nickname FROM contacts WHERE public_key = '' ORDER BY owner`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		legacy = nil
+		for rows.Next() {
+			var contact legacyContact
+			if err := rows.Scan(&contact.owner, &contact.publicKey, &contact.nickname); err != nil {
+				return err
+			}
+			legacy = append(legacy, contact)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error listing contacts to seal: %v", err)
+	}
+
+	converted := 0
+	for start := 0; start < len(legacy); {
+		end := start + 1
+		for end < len(legacy) && legacy[end].owner == legacy[start].owner {
+			end++
+		}
+		count, err := s.sealLegacyContacts(ctx, legacy[start].owner, legacy[start:end])
+		converted += count
+		if err != nil {
+			return converted, fmt.Errorf("failed to seal contacts of %s: %v", legacy[start].owner, err)
+		}
+		start = end
+	}
+	return converted, nil
+}
+
+// sealLegacyContacts converts the legacy rows of one owner in a transaction
+func (s *DBContactStore) sealLegacyContacts(ctx context.Context, owner string, legacy []legacyContact) (int, error) {
+	keys, err := s.keysFor(ctx, owner)
+	if errors.Is(err, ErrUserNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	names, err := formerUsernames(ctx, owner)
+	if err != nil {
+		return 0, err
+	}
+
+	sealed := make([]sealedContact, len(legacy))
+	for i, contact := range legacy {
+		nickname, err := s.openLegacyNickname(append([]string{owner}, names...), contact.nickname)
+		if err != nil {
+			return 0, err
+		}
+		if sealed[i], err = keys.sealContact(storage.Contact{PublicKey: contact.publicKey, Nickname: nickname}); err != nil {
+			return 0, err
+		}
+	}
+
+	// A row already written under the hash is newer than the legacy one and wins
+	err = withTx(ctx, "SealContactKeys", func(ctx context.Context, tx *sql.Tx) error {
+		insert := `INSERT INTO contacts (owner, contact_pubkey, public_key, nickname, verification, created_at, modified_at, deleted)
+			SELECT owner, $3, $4, $5, verification, created_at, modified_at, deleted FROM contacts
+			WHERE owner = $1 AND contact_pubkey = $2 AND public_key = ''
+			ON CONFLICT (owner, contact_pubkey) DO NOTHING`
+		remove := `DELETE FROM contacts WHERE owner = $1 AND contact_pubkey = $2 AND public_key = ''`
+		for i, contact := range legacy {
+			if _, err := tx.ExecContext(ctx, insert, owner, contact.publicKey, sealed[i].lookup, sealed[i].publicKey, sealed[i].nickname); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, remove, owner, contact.publicKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(legacy), nil
+}
+
+// openLegacyNickname opens a nickname sealed under the contacts scope of one of the
+// owner's usernames; plaintext nicknames are returned unchanged
+func (s *DBContactStore) openLegacyNickname(usernames []string, stored string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil || !storage.IsEncrypted(sealed) {
+		return stored, nil
+	}
+	for _, username := range usernames {
+		if nickname, err := s.keyRing.Open(storage.ContactsScope(username), sealed); err == nil {
+			return string(nickname), nil
+		}
+	}
+	return "", errors.New("contact nickname doesn't open under any of the owner's usernames")
+}
+
+// formerUsernames returns the aliases left by the renames of an account
+func formerUsernames(ctx context.Context, username string) ([]string, error) {
+	var names []string
+	err := withRetry(ctx, "FormerUsernames", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, `SELECT alias FROM user_aliases WHERE username = $1`, username)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		names = nil
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return err
+			}
+			names = append(names, name)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing former usernames: %v", err)
+	}
+	return names, nil
+}
@@ -0,0 +1,126 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+	"wave_capacitor/logging"
+)
+
+// logger logs database lifecycle events and account changes
+var logger = logging.Component("db")
+
+// DBOptions configures the connection, pool and query timeouts
+type DBOptions struct {
+	// ConnectionString is the CockroachDB URL, see config.Config.GetDBConnectionString
+	ConnectionString string
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// QueryTimeout bounds each query attempt whose context has no deadline of its own (0 disables it)
+	QueryTimeout time.Duration
+
+	// Region is the CockroachDB region this capacitor runs in (empty for single-region clusters)
+	Region string
+	// FollowerReads serves read-only lookups from the nearest replica, accepting slightly stale data
+	FollowerReads bool
+
+	// UserCacheSize accounts are cached in process for UserCacheTTL (either 0 disables it)
+	UserCacheSize int
+	UserCacheTTL  time.Duration
+
+	// Updates that can wait, such as when accounts were last seen, are written every
+	// WriteBehindInterval; beyond WriteBehindMaxPending queued ones further are dropped
+	WriteBehindInterval   time.Duration
+	WriteBehindMaxPending int
+}
+
+// dbOptions is configured at startup via SetDBOptions
+var dbOptions = DBOptions{
+	MaxOpenConns:    25,
+	MaxIdleConns:    10,
+	ConnMaxLifetime: 30 * time.Minute,
+	QueryTimeout:    5 * time.Second,
+
+	WriteBehindInterval:   5 * time.Second,
+	WriteBehindMaxPending: 100000,
+}
+
+// SetDBOptions configures the pool, timeouts and user cache; call it before ConnectDB
+func SetDBOptions(opts DBOptions) {
+	dbOptions = opts
+	accountCache = newUserCache(opts.UserCacheSize, opts.UserCacheTTL)
+}
+
+// applyPoolOptions sizes the connection pool. A bounded lifetime lets connections
+// rebalance across CockroachDB nodes after one restarts or the cluster grows.
+func applyPoolOptions() {
+	db.SetMaxOpenConns(dbOptions.MaxOpenConns)
+	db.SetMaxIdleConns(dbOptions.MaxIdleConns)
+	db.SetConnMaxLifetime(dbOptions.ConnMaxLifetime)
+}
+
+// queryContext bounds a single query attempt by the configured timeout.
+// Contexts that already carry a deadline (e.g. migrations) are left as they are.
+func queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || dbOptions.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, dbOptions.QueryTimeout)
+}
+
+// QueryTrace describes one models call, including all of its retries
+type QueryTrace struct {
+	Op       string
+	Duration time.Duration
+	Attempts int
+	Err      error
+}
+
+// QueryHook is called after every models call; it must be cheap and safe for concurrent use
+type QueryHook func(ctx context.Context, trace QueryTrace)
+
+// queryHook is configured at startup via SetQueryHook; nil disables tracing
+var queryHook QueryHook
+
+// SetQueryHook installs a tracing hook for database calls (e.g. slow query logging or metrics)
+func SetQueryHook(hook QueryHook) {
+	queryHook = hook
+}
+
+// recycleConnections closes idle pooled connections so new ones are opened with the
+// current credentials. Connections in use are retired once they reach ConnMaxLifetime.
+func recycleConnections() {
+	if db == nil {
+		return
+	}
+	db.SetMaxIdleConns(0)
+	db.SetMaxIdleConns(dbOptions.MaxIdleConns)
+}
+
+// PingDB checks that the database answers a query. It makes a single attempt, so health
+// checks see failures that withRetry would hide.
+func PingDB(ctx context.Context) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	var one int
+	return db.QueryRowContext(ctx, `SELECT 1`).Scan(&one)
+}
+
+// DatabaseTime returns the database server's clock, for spotting clock skew of the node
+func DatabaseTime(ctx context.Context) (time.Time, error) {
+	if db == nil {
+		return time.Time{}, errors.New("database connection not initialized")
+	}
+
+	ctx, cancel := queryContext(ctx)
+	defer cancel()
+	var now time.Time
+	err := db.QueryRowContext(ctx, `SELECT now()`).Scan(&now)
+	return now, err
+}
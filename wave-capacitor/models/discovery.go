@@ -0,0 +1,82 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNotDiscoverable is returned when the user hasn't opted in to discovery
+var ErrNotDiscoverable = errors.New("user not opted in to discovery")
+
+// DiscoveryIdentity is the blinded identifier a user opted in to discovery with
+type DiscoveryIdentity struct {
+	IdentifierHash string    `json:"identifier_hash"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// SetDiscoveryIdentity opts the user in to discovery with identifierHash, replacing the
+// identifier of an earlier opt-in
+func SetDiscoveryIdentity(ctx context.Context, username, identifierHash string) (*DiscoveryIdentity, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	identity := DiscoveryIdentity{IdentifierHash: identifierHash}
+	query := `UPSERT INTO discovery_identities (username, identifier_hash, created_at) VALUES ($1, $2, CURRENT_TIMESTAMP)
+		RETURNING created_at`
+	err := withRetry(ctx, "SetDiscoveryIdentity", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, username, identifierHash).Scan(&identity.CreatedAt)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to opt in to discovery: %v", err)
+	}
+	return &identity, nil
+}
+
+// GetDiscoveryIdentity returns the identifier the user opted in to discovery with, or
+// ErrNotDiscoverable
+func GetDiscoveryIdentity(ctx context.Context, username string) (*DiscoveryIdentity, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var identity DiscoveryIdentity
+	query := `SELECT identifier_hash, created_at FROM discovery_identities WHERE username = $1`
+	err := withRetry(ctx, "GetDiscoveryIdentity", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, username).Scan(&identity.IdentifierHash, &identity.CreatedAt)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrNotDiscoverable
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving discovery identity: %v", err)
+	}
+	return &identity, nil
+}
+
+// DeleteDiscoveryIdentity opts the user out of discovery, returning ErrNotDiscoverable if
+// they weren't opted in
+func DeleteDiscoveryIdentity(ctx context.Context, username string) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	var result sql.Result
+	err := withRetry(ctx, "DeleteDiscoveryIdentity", func(ctx context.Context) error {
+		var err error
+		result, err = db.ExecContext(ctx, `DELETE FROM discovery_identities WHERE username = $1`, username)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to opt out of discovery: %v", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("error getting rows affected: %v", err)
+	} else if n == 0 {
+		return ErrNotDiscoverable
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// AccountRecord is everything the users table and its satellites hold about an account
+// itself, for data exports
+type AccountRecord struct {
+	Username            string     `json:"username"`
+	PublicKey           string     `json:"public_key"`
+	EncryptedPrivateKey string     `json:"encrypted_private_key"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+	DisabledAt          *time.Time `json:"disabled_at,omitempty"`
+	DisabledReason      string     `json:"disabled_reason,omitempty"`
+	TokensRevokedAt     *time.Time `json:"tokens_revoked_at,omitempty" doc:"tokens issued up to this time are rejected"`
+	FormerUsernames     []string   `json:"former_usernames" doc:"oldest first"`
+	ChangeSeq           int64      `json:"change_seq" doc:"sequence number of the latest change in the change log"`
+}
+
+// GetAccountRecord returns the account row of username with its former usernames and
+// token revocation time
+func GetAccountRecord(ctx context.Context, username string) (*AccountRecord, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	record := AccountRecord{FormerUsernames: []string{}}
+	query := `SELECT u.username, u.public_key, u.encrypted_private_key, u.created_at, u.updated_at, u.disabled_at,
+		u.disabled_reason, u.change_seq, r.revoked_at
+		FROM users u LEFT JOIN token_revocations r ON r.username = u.username WHERE u.username = $1`
+	err := withRetry(ctx, "GetAccountRecord", func(ctx context.Context) error {
+		var createdAt, updatedAt, disabledAt, revokedAt sql.NullTime
+		err := db.QueryRowContext(ctx, query, username).Scan(&record.Username, &record.PublicKey, &record.EncryptedPrivateKey,
+			&createdAt, &updatedAt, &disabledAt, &record.DisabledReason, &record.ChangeSeq, &revokedAt)
+		if err != nil {
+			return err
+		}
+		record.CreatedAt, record.UpdatedAt = createdAt.Time, updatedAt.Time
+		if disabledAt.Valid {
+			record.DisabledAt = &disabledAt.Time
+		}
+		if revokedAt.Valid {
+			record.TokensRevokedAt = &revokedAt.Time
+		}
+
+		rows, err := db.QueryContext(ctx, `SELECT alias FROM user_aliases WHERE username = $1 ORDER BY created_at`, username)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		record.FormerUsernames = []string{}
+		for rows.Next() {
+			var alias string
+			if err := rows.Scan(&alias); err != nil {
+				return err
+			}
+			record.FormerUsernames = append(record.FormerUsernames, alias)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("error retrieving account record: %v", err)
+	}
+	return &record, nil
+}
+
+// StoredPrekeys are the prekeys of an account not claimed yet
+type StoredPrekeys struct {
+	OneTime []Prekey      `json:"one_time"`
+	Signed  *SignedPrekey `json:"signed,omitempty"`
+}
+
+// ListStoredPrekeys returns the unclaimed one-time prekeys and the signed prekey of username
+func ListStoredPrekeys(ctx context.Context, username string) (*StoredPrekeys, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var prekeys StoredPrekeys
+	err := withRetry(ctx, "ListStoredPrekeys", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, `SELECT key_id, public_key FROM prekeys WHERE username = $1 ORDER BY key_id`, username)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		prekeys.OneTime = []Prekey{}
+		for rows.Next() {
+			var prekey Prekey
+			if err := rows.Scan(&prekey.KeyID, &prekey.PublicKey); err != nil {
+				return err
+			}
+			prekeys.OneTime = append(prekeys.OneTime, prekey)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		var signed SignedPrekey
+		err = db.QueryRowContext(ctx, `SELECT key_id, public_key, signature FROM signed_prekeys WHERE username = $1`, username).
+			Scan(&signed.KeyID, &signed.PublicKey, &signed.Signature)
+		switch {
+		case err == sql.ErrNoRows:
+			prekeys.Signed = nil
+		case err != nil:
+			return err
+		default:
+			prekeys.Signed = &signed
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing prekeys: %v", err)
+	}
+	return &prekeys, nil
+}
+
+// ListAllSessionBlobs returns the session blobs of every device of username, with the blobs
+func ListAllSessionBlobs(ctx context.Context, username string) ([]SessionBlob, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	query := `SELECT peer_key, device_id, version, blob, updated_at FROM session_blobs WHERE username = $1 ORDER BY device_id, peer_key`
+	var sessions []SessionBlob
+	err := withRetry(ctx, "ListAllSessionBlobs", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query, username)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		sessions = []SessionBlob{}
+		for rows.Next() {
+			var session SessionBlob
+			if err := rows.Scan(&session.PeerKey, &session.DeviceID, &session.Version, &session.Blob, &session.UpdatedAt); err != nil {
+				return err
+			}
+			sessions = append(sessions, session)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing sessions: %v", err)
+	}
+	return sessions, nil
+}
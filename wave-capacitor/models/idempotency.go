@@ -0,0 +1,117 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// idempotencyPendingTimeout is how long an unfinished claim blocks retries; after it the
+// first request is assumed lost (e.g. its node went down) and a retry may claim the key again
+const idempotencyPendingTimeout = time.Minute
+
+// IdempotentResponse is the stored outcome of a request made with an Idempotency-Key
+type IdempotentResponse struct {
+	RequestHash string
+	Status      int // 0 while the first request is still being handled
+	ContentType string
+	Body        []byte
+}
+
+// ClaimIdempotencyKey reserves key within scope for the request identified by requestHash.
+// It returns nil if the caller now owns the key and must handle the request, otherwise the
+// record of the earlier request using it.
+func ClaimIdempotencyKey(ctx context.Context, scope, key, requestHash string, ttl time.Duration) (*IdempotentResponse, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var existing *IdempotentResponse
+	err := withTx(ctx, "ClaimIdempotencyKey", func(ctx context.Context, tx *sql.Tx) error {
+		existing = nil
+		now := time.Now().UTC()
+
+		var record IdempotentResponse
+		var createdAt time.Time
+		err := tx.QueryRowContext(ctx,
+			`SELECT request_hash, status, content_type, body, created_at FROM idempotency_keys
+			 WHERE scope = $1 AND idempotency_key = $2 AND expires_at > $3 FOR UPDATE`,
+			scope, key, now,
+		).Scan(&record.RequestHash, &record.Status, &record.ContentType, &record.Body, &createdAt)
+		switch {
+		case err == nil && (record.Status != 0 || now.Sub(createdAt) < idempotencyPendingTimeout):
+			existing = &record
+			return nil
+		case err != nil && err != sql.ErrNoRows:
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`UPSERT INTO idempotency_keys (scope, idempotency_key, request_hash, status, content_type, body, created_at, expires_at)
+			 VALUES ($1, $2, $3, 0, '', NULL, $4, $5)`,
+			scope, key, requestHash, now, now.Add(ttl),
+		)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error claiming idempotency key: %v", err)
+	}
+	return existing, nil
+}
+
+// CompleteIdempotencyKey stores the response of the request that claimed key
+func CompleteIdempotencyKey(ctx context.Context, scope, key string, status int, contentType string, body []byte) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	query := `UPDATE idempotency_keys SET status = $3, content_type = $4, body = $5 WHERE scope = $1 AND idempotency_key = $2`
+	err := withRetry(ctx, "CompleteIdempotencyKey", func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, query, scope, key, status, contentType, body)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error storing idempotent response: %v", err)
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey drops a claim whose request should run again when retried
+func ReleaseIdempotencyKey(ctx context.Context, scope, key string) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	query := `DELETE FROM idempotency_keys WHERE scope = $1 AND idempotency_key = $2`
+	err := withRetry(ctx, "ReleaseIdempotencyKey", func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, query, scope, key)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error releasing idempotency key: %v", err)
+	}
+	return nil
+}
+
+// PurgeExpiredIdempotencyKeys deletes stored responses past their TTL and returns how many were removed
+func PurgeExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	if db == nil {
+		return 0, errors.New("database connection not initialized")
+	}
+
+	var purged int64
+	err := withRetry(ctx, "PurgeExpiredIdempotencyKeys", func(ctx context.Context) error {
+		result, err := db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at <= $1`, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		purged, _ = result.RowsAffected()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error purging idempotency keys: %v", err)
+	}
+	return purged, nil
+}
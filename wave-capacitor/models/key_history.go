@@ -0,0 +1,186 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"wave_capacitor/utils"
+
+	"github.com/lib/pq"
+)
+
+// KeyRecord represents a retired public key and the window in which it was valid
+type KeyRecord struct {
+	PublicKey  string    `json:"public_key"`
+	ValidFrom  time.Time `json:"valid_from"`
+	ValidUntil time.Time `json:"valid_until"`
+}
+
+// ErrSameKey is returned when a key rotation would install the current public key again
+var ErrSameKey = errors.New("new public key must differ from the current key")
+
+// ErrKeyInUse is returned when a public key is, or was, the key of another account
+var ErrKeyInUse = errors.New("public key belongs to another account")
+
+// checkKeyFree returns ErrKeyInUse when publicKey is the current or a retired key of an
+// account other than username. Keys are public, and the mailbox of a key is listed to
+// whichever account holds it, so an account must never take over another one's key.
+func checkKeyFree(ctx context.Context, tx *sql.Tx, username, publicKey string) error {
+	var taken bool
+	query := `SELECT EXISTS(SELECT 1 FROM users WHERE public_key = $1 AND username <> $2)
+		OR EXISTS(SELECT 1 FROM user_key_history WHERE public_key = $1 AND username <> $2)`
+	if err := tx.QueryRowContext(ctx, query, publicKey, username).Scan(&taken); err != nil {
+		return fmt.Errorf("error checking public key: %w", err)
+	}
+	if taken {
+		return ErrKeyInUse
+	}
+	return nil
+}
+
+// isKeyConflict reports whether err is the unique violation of a write racing another
+// account for the same public key
+func isKeyConflict(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "idx_users_public_key_unique"
+}
+
+// lockUserKey locks the user row and returns its public key and when that key became active
+func lockUserKey(ctx context.Context, tx *sql.Tx, username string) (string, time.Time, error) {
+	var publicKey string
+	var activated time.Time
+	query := `SELECT public_key, COALESCE(key_activated_at,
+			(SELECT max(valid_until) FROM user_key_history WHERE username = $1), created_at)
+		FROM users WHERE username = $1 FOR UPDATE`
+	err := tx.QueryRowContext(ctx, query, username).Scan(&publicKey, &activated)
+	return publicKey, activated, err
+}
+
+// retireKey records a replaced public key of a user in the key history
+func retireKey(ctx context.Context, tx *sql.Tx, username, publicKey string, validFrom time.Time) error {
+	query := `INSERT INTO user_key_history (username, public_key, valid_from, valid_until) VALUES ($1, $2, $3, CURRENT_TIMESTAMP)`
+	if _, err := tx.ExecContext(ctx, query, username, publicKey, validFrom); err != nil {
+		return fmt.Errorf("failed to record key history: %w", err)
+	}
+	return nil
+}
+
+// RotateUserKeys replaces a user's key pair and records the old public key in the key history.
+// It returns the retired public key, ErrUserNotFound for an unknown user, ErrSameKey
+// when newPublicKey is the current key and ErrKeyInUse when it is another account's.
+func RotateUserKeys(ctx context.Context, username, newPublicKey, newEncryptedPrivateKey string) (string, error) {
+	if db == nil {
+		return "", errors.New("database connection not initialized")
+	}
+
+	var oldPublicKey string
+	defer accountCache.invalidate(username)
+	err := withTx(ctx, "RotateUserKeys", func(ctx context.Context, tx *sql.Tx) error {
+		var validFrom time.Time
+		var err error
+		if oldPublicKey, validFrom, err = lockUserKey(ctx, tx, username); err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf("%w: '%s'", ErrUserNotFound, username)
+			}
+			return fmt.Errorf("error retrieving user: %w", err)
+		}
+
+		if utils.ConstantTimeEqualString(oldPublicKey, newPublicKey) {
+			return ErrSameKey
+		}
+		if err := checkKeyFree(ctx, tx, username, newPublicKey); err != nil {
+			return err
+		}
+
+		if err := retireKey(ctx, tx, username, oldPublicKey, validFrom); err != nil {
+			return err
+		}
+
+		// Install the new keys
+		update := `UPDATE users SET public_key = $1, encrypted_private_key = $2, key_activated_at = CURRENT_TIMESTAMP,
+			updated_at = CURRENT_TIMESTAMP WHERE username = $3`
+		if _, err := tx.ExecContext(ctx, update, newPublicKey, newEncryptedPrivateKey, username); err != nil {
+			if isKeyConflict(err) {
+				return ErrKeyInUse
+			}
+			return fmt.Errorf("failed to update user keys: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("key rotation failed: %w", err)
+	}
+
+	logger.Info(ctx, "rotated user keys", "username", username)
+	return oldPublicKey, nil
+}
+
+// GetKeyHistory returns the retired public keys of a user, newest first
+func GetKeyHistory(ctx context.Context, username string) ([]KeyRecord, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	query := `SELECT public_key, valid_from, valid_until FROM user_key_history WHERE username = $1 ORDER BY valid_until DESC`
+	var records []KeyRecord
+	err := withRetry(ctx, "GetKeyHistory", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query, username)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		records = []KeyRecord{}
+		for rows.Next() {
+			var record KeyRecord
+			if err := rows.Scan(&record.PublicKey, &record.ValidFrom, &record.ValidUntil); err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving key history: %v", err)
+	}
+	return records, nil
+}
+
+// CurrentKeysOfRetired maps each of the given public keys that its owner has since rotated
+// away from to the owner's current public key; keys still current or unknown are left out
+func CurrentKeysOfRetired(ctx context.Context, publicKeys []string) (map[string]string, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	current := make(map[string]string)
+	if len(publicKeys) == 0 {
+		return current, nil
+	}
+	query := `SELECT DISTINCT h.public_key, u.public_key FROM user_key_history h
+		JOIN users u ON u.username = h.username
+		WHERE h.public_key = ANY($1) AND u.public_key <> h.public_key`
+	err := withRetry(ctx, "CurrentKeysOfRetired", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query, pq.Array(publicKeys))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		clear(current)
+		for rows.Next() {
+			var retired, key string
+			if err := rows.Scan(&retired, &key); err != nil {
+				return err
+			}
+			current[retired] = key
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error looking up rotated keys: %v", err)
+	}
+	return current, nil
+}
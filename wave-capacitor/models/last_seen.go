@@ -0,0 +1,33 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// lastSeen batches when accounts were last seen, by username
+var lastSeen = newWriteBatch("last_seen", writeLastSeen)
+
+// TouchLastSeen records that the account made an authenticated request now. It is
+// written behind, see StartWriteBehind, so it costs the request no database write.
+func TouchLastSeen(username string) {
+	lastSeen.add(username, time.Now().UTC())
+}
+
+// writeLastSeen sets the last_seen_at of the accounts named, unless a later time was
+// written meanwhile, e.g. by another capacitor
+func writeLastSeen(ctx context.Context, usernames []string, values []interface{}) error {
+	times := make([]string, len(values))
+	for i, value := range values {
+		times[i] = value.(time.Time).Format(time.RFC3339Nano)
+	}
+	query := `UPDATE users SET last_seen_at = seen.at
+		FROM unnest($1::STRING[], $2::TIMESTAMP[]) AS seen(username, at)
+		WHERE users.username = seen.username AND (users.last_seen_at IS NULL OR users.last_seen_at < seen.at)`
+	return withRetry(ctx, "WriteLastSeen", func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, query, pq.Array(usernames), pq.Array(times))
+		return err
+	})
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Leases are timed by the database clock, so capacitors whose clocks drift apart still
+// agree on when a lease expires.
+
+// AcquireLease takes or renews the named lease for holder until ttl from now. It reports
+// false when another holder has a lease that hasn't expired.
+func AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	if db == nil {
+		return false, errors.New("database connection not initialized")
+	}
+
+	query := `INSERT INTO job_leases (name, holder, expires_at) VALUES ($1, $2, now() + $3 * INTERVAL '1 millisecond')
+		ON CONFLICT (name) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+		WHERE job_leases.holder = excluded.holder OR job_leases.expires_at < now()
+		RETURNING holder`
+	var current string
+	err := withRetry(ctx, "AcquireLease", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, name, holder, ttl.Milliseconds()).Scan(&current)
+	})
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error acquiring lease %s: %v", name, err)
+	}
+	return true, nil
+}
+
+// ReleaseLease gives up the named lease if holder has it, so another capacitor can take
+// it over without waiting for it to expire
+func ReleaseLease(ctx context.Context, name, holder string) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	query := `DELETE FROM job_leases WHERE name = $1 AND holder = $2`
+	err := withRetry(ctx, "ReleaseLease", func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, query, name, holder)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error releasing lease %s: %v", name, err)
+	}
+	return nil
+}
+
+// LeaseHolder returns the holder of the named lease, or "" when nobody has it
+func LeaseHolder(ctx context.Context, name string) (string, error) {
+	if db == nil {
+		return "", errors.New("database connection not initialized")
+	}
+
+	var holder string
+	query := `SELECT holder FROM job_leases WHERE name = $1 AND expires_at > now()`
+	err := withRetry(ctx, "LeaseHolder", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, name).Scan(&holder)
+	})
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error looking up lease %s: %v", name, err)
+	}
+	return holder, nil
+}
@@ -0,0 +1,321 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Message states tracked in the index
+const (
+	MessageUnread = "unread"
+	MessageRead   = "read"
+)
+
+// MessageMeta is the index entry of a stored message
+type MessageMeta struct {
+	RecipientHash string    `json:"-"`
+	MessageID     string    `json:"message_id"`
+	Timestamp     time.Time `json:"timestamp"`
+	Size          int       `json:"size"`
+	State         string    `json:"state"`
+	Hash          string    `json:"-"` // hex SHA-256 of the message as stored, empty if unknown
+}
+
+// ErrMessageNotIndexed is returned when the index doesn't list a message
+var ErrMessageNotIndexed = errors.New("message not indexed")
+
+// IndexMessage records a stored message. Re-indexing an existing message keeps its state.
+func IndexMessage(ctx context.Context, meta MessageMeta) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+	if meta.State == "" {
+		meta.State = MessageUnread
+	}
+
+	query := `INSERT INTO message_index (recipient_hash, message_id, created_at, size, state, content_hash) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (recipient_hash, message_id) DO UPDATE SET created_at = excluded.created_at, size = excluded.size, content_hash = excluded.content_hash`
+	err := withRetry(ctx, "IndexMessage", func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, query, meta.RecipientHash, meta.MessageID, meta.Timestamp.UTC(), meta.Size, meta.State, meta.Hash)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index message: %v", err)
+	}
+	return nil
+}
+
+// ListMessageIndex returns up to limit entries for the given recipients, newest first.
+// When before is non-zero only entries older than (before, beforeID) are returned,
+// so the last entry of a page is the cursor for the next one.
+func ListMessageIndex(ctx context.Context, recipientHashes []string, before time.Time, beforeID string, limit int) ([]MessageMeta, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var entries []MessageMeta
+	query := `SELECT recipient_hash, message_id, created_at, size, state FROM message_index
+		WHERE recipient_hash = ANY($1) AND ($2::TIMESTAMP IS NULL OR (created_at, message_id) < ($2, $3))
+		ORDER BY created_at DESC, message_id DESC
+		LIMIT $4`
+	var cursor interface{}
+	if !before.IsZero() {
+		cursor = before.UTC()
+	}
+	err := withRetry(ctx, "ListMessageIndex", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query, pq.Array(recipientHashes), cursor, beforeID, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		entries = []MessageMeta{}
+		for rows.Next() {
+			var meta MessageMeta
+			if err := rows.Scan(&meta.RecipientHash, &meta.MessageID, &meta.Timestamp, &meta.Size, &meta.State); err != nil {
+				return err
+			}
+			entries = append(entries, meta)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing message index: %v", err)
+	}
+	return entries, nil
+}
+
+// CountUnreadMessages returns how many indexed messages of the recipients are unread
+func CountUnreadMessages(ctx context.Context, recipientHashes []string) (int, error) {
+	if db == nil {
+		return 0, errors.New("database connection not initialized")
+	}
+
+	var count int
+	query := `SELECT COUNT(*) FROM message_index WHERE recipient_hash = ANY($1) AND state = $2`
+	err := withRetry(ctx, "CountUnreadMessages", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, pq.Array(recipientHashes), MessageUnread).Scan(&count)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error counting unread messages: %v", err)
+	}
+	return count, nil
+}
+
+// MessageUsage summarizes the indexed messages of a set of recipients
+type MessageUsage struct {
+	Messages int   `json:"messages"`
+	Unread   int   `json:"unread"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// GetMessageUsage counts the indexed messages of the recipients and their total size
+func GetMessageUsage(ctx context.Context, recipientHashes []string) (*MessageUsage, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var usage MessageUsage
+	query := `SELECT COUNT(*), COUNT(*) FILTER (WHERE state = $2), COALESCE(SUM(size), 0)
+		FROM message_index WHERE recipient_hash = ANY($1)`
+	err := withRetry(ctx, "GetMessageUsage", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, pq.Array(recipientHashes), MessageUnread).Scan(&usage.Messages, &usage.Unread, &usage.Bytes)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error measuring message usage: %v", err)
+	}
+	return &usage, nil
+}
+
+// SetMessageState updates the state of the given messages of the recipients and
+// returns how many entries changed
+func SetMessageState(ctx context.Context, recipientHashes []string, messageIDs []string, state string) (int, error) {
+	if db == nil {
+		return 0, errors.New("database connection not initialized")
+	}
+
+	var updated int64
+	query := `UPDATE message_index SET state = $1 WHERE recipient_hash = ANY($2) AND message_id = ANY($3) AND state <> $1`
+	err := withRetry(ctx, "SetMessageState", func(ctx context.Context) error {
+		result, err := db.ExecContext(ctx, query, state, pq.Array(recipientHashes), pq.Array(messageIDs))
+		if err != nil {
+			return err
+		}
+		updated, err = result.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to update message state: %v", err)
+	}
+	return int(updated), nil
+}
+
+// ListMessagesBefore returns up to limit index entries created before cutoff, oldest first,
+// for retention jobs
+func ListMessagesBefore(ctx context.Context, cutoff time.Time, limit int) ([]MessageMeta, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var entries []MessageMeta
+	query := `SELECT recipient_hash, message_id, created_at, size, state FROM message_index
+		WHERE created_at < $1 ORDER BY created_at LIMIT $2`
+	err := withRetry(ctx, "ListMessagesBefore", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query, cutoff.UTC(), limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		entries = []MessageMeta{}
+		for rows.Next() {
+			var meta MessageMeta
+			if err := rows.Scan(&meta.RecipientHash, &meta.MessageID, &meta.Timestamp, &meta.Size, &meta.State); err != nil {
+				return err
+			}
+			entries = append(entries, meta)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing expired messages: %v", err)
+	}
+	return entries, nil
+}
+
+// IndexedMessageIDs returns which of messageIDs are indexed for the recipient
+func IndexedMessageIDs(ctx context.Context, recipientHash string, messageIDs []string) (map[string]bool, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var indexed map[string]bool
+	query := `SELECT message_id FROM message_index WHERE recipient_hash = $1 AND message_id = ANY($2)`
+	err := withRetry(ctx, "IndexedMessageIDs", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query, recipientHash, pq.Array(messageIDs))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		indexed = make(map[string]bool)
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				return err
+			}
+			indexed[id] = true
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error looking up message index: %v", err)
+	}
+	return indexed, nil
+}
+
+// GetMessageHash returns the hash of a message cached in the index, "" when it was
+// indexed without one, or ErrMessageNotIndexed
+func GetMessageHash(ctx context.Context, recipientHash, messageID string) (string, error) {
+	if db == nil {
+		return "", errors.New("database connection not initialized")
+	}
+
+	var hash string
+	query := `SELECT content_hash FROM message_index WHERE recipient_hash = $1 AND message_id = $2`
+	err := withRetry(ctx, "GetMessageHash", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, recipientHash, messageID).Scan(&hash)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrMessageNotIndexed
+	}
+	if err != nil {
+		return "", fmt.Errorf("error looking up message hash: %v", err)
+	}
+	return hash, nil
+}
+
+// ListMessageHashes returns the hash cached in the index of every message of the
+// recipient by ID, "" for those indexed without one
+func ListMessageHashes(ctx context.Context, recipientHash string) (map[string]string, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var hashes map[string]string
+	query := `SELECT message_id, content_hash FROM message_index WHERE recipient_hash = $1`
+	err := withRetry(ctx, "ListMessageHashes", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query, recipientHash)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		hashes = make(map[string]string)
+		for rows.Next() {
+			var id, hash string
+			if err := rows.Scan(&id, &hash); err != nil {
+				return err
+			}
+			hashes[id] = hash
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing message hashes: %v", err)
+	}
+	return hashes, nil
+}
+
+// DeleteMessageIndex removes the index entry of a message
+func DeleteMessageIndex(ctx context.Context, recipientHash, messageID string) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	query := `DELETE FROM message_index WHERE recipient_hash = $1 AND message_id = $2`
+	err := withRetry(ctx, "DeleteMessageIndex", func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, query, recipientHash, messageID)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete message index entry: %v", err)
+	}
+	return nil
+}
+
+// RehashMessageIndex moves the index entries of a recipient from the hash derived with the
+// previous confusion salt to the current one, after a salt rotation, and returns how many
+// moved. Entries already present under the new hash are kept.
+func RehashMessageIndex(ctx context.Context, fromHash, toHash string) (int, error) {
+	if db == nil {
+		return 0, errors.New("database connection not initialized")
+	}
+
+	var moved int64
+	err := withTx(ctx, "RehashMessageIndex", func(ctx context.Context, tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `UPDATE message_index SET recipient_hash = $2 WHERE recipient_hash = $1
+			AND message_id NOT IN (SELECT message_id FROM message_index WHERE recipient_hash = $2)`, fromHash, toHash)
+		if err != nil {
+			return err
+		}
+		if moved, err = result.RowsAffected(); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM message_index WHERE recipient_hash = $1`, fromHash); err != nil {
+			return err
+		}
+		// The change log refers to messages by the same hash
+		_, err = tx.ExecContext(ctx, `UPDATE account_changes SET recipient_hash = $2 WHERE recipient_hash = $1`, fromHash, toHash)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to rehash message index: %v", err)
+	}
+	return int(moved), nil
+}
@@ -0,0 +1,252 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the schema migrations, named "<version>_<description>.sql".
+// Migrations are append-only: once released, a file must never be edited.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationTimeout bounds a whole Migrate run
+const migrationTimeout = 10 * time.Minute
+
+// migrationLockPoll is how often a node waiting for the migration lock tries again
+const migrationLockPoll = time.Second
+
+// Migration is a single versioned schema change
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// loadMigrations returns the embedded migrations ordered by version
+func loadMigrations() ([]Migration, error) {
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(names))
+	seen := make(map[int]string)
+	for _, name := range names {
+		base := strings.TrimSuffix(path.Base(name), ".sql")
+		prefix, description, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s is not named <version>_<description>.sql", name)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s has an invalid version", name)
+		}
+		if other, dup := seen[version]; dup {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", other, name, version)
+		}
+		seen[version] = name
+
+		data, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: description, SQL: string(data)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// appliedMigrations returns the set of versions recorded in schema_migrations
+func appliedMigrations(ctx context.Context) (map[int]bool, error) {
+	createTable := `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		);
+	`
+	err := withRetry(ctx, "schema_migrations", func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, createTable)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+
+	var applied map[int]bool
+	err = withRetry(ctx, "schema_migrations", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, "SELECT version FROM schema_migrations")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		applied = make(map[int]bool)
+		for rows.Next() {
+			var version int
+			if err := rows.Scan(&version); err != nil {
+				return err
+			}
+			applied[version] = true
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read applied migrations: %v", err)
+	}
+	return applied, nil
+}
+
+// PendingMigrations returns the migrations that have not been applied yet, in order
+func PendingMigrations(ctx context.Context) ([]Migration, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []Migration{}
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// lockMigrations takes the migration lock, waiting while another node holds it, and
+// returns the function releasing it. The lock is a lease row timed by the database clock
+// that lasts as long as a Migrate run may, so a node dying mid-run only holds the others
+// up until it expires.
+func lockMigrations(ctx context.Context) (func(), error) {
+	createTable := `
+		CREATE TABLE IF NOT EXISTS schema_migrations_lock (
+			id INT PRIMARY KEY,
+			holder TEXT NOT NULL,
+			expires_at TIMESTAMPTZ NOT NULL
+		);
+	`
+	err := withRetry(ctx, "schema_migrations_lock", func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, createTable)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations_lock table: %v", err)
+	}
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	holder := fmt.Sprintf("%s/%d/%s", hostname, os.Getpid(), hex.EncodeToString(nonce))
+
+	acquire := `INSERT INTO schema_migrations_lock (id, holder, expires_at) VALUES (1, $1, now() + $2 * INTERVAL '1 millisecond')
+		ON CONFLICT (id) DO UPDATE SET holder = excluded.holder, expires_at = excluded.expires_at
+		WHERE schema_migrations_lock.expires_at < now()
+		RETURNING holder`
+	for waited := false; ; waited = true {
+		var current string
+		err := withRetry(ctx, "schema_migrations_lock", func(ctx context.Context) error {
+			return db.QueryRowContext(ctx, acquire, holder, migrationTimeout.Milliseconds()).Scan(&current)
+		})
+		if err == nil {
+			break
+		}
+		if err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to take the migration lock: %v", err)
+		}
+		if !waited {
+			logger.Info(ctx, "waiting for another node to finish migrating")
+		}
+		select {
+		case <-time.After(migrationLockPoll):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to take the migration lock: %v", ctx.Err())
+		}
+	}
+
+	return func() {
+		// The run's context may be done already
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := withRetry(ctx, "schema_migrations_lock", func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, `DELETE FROM schema_migrations_lock WHERE id = 1 AND holder = $1`, holder)
+			return err
+		})
+		if err != nil {
+			logger.Warn(ctx, "failed to release the migration lock, it expires on its own", "error", err)
+		}
+	}, nil
+}
+
+// Migrate applies all pending migrations in version order and returns how many ran.
+// Each migration runs in its own transaction together with its schema_migrations row,
+// so a failed migration leaves no partial record and is retried on the next run. Nodes
+// starting together take turns through the migration lock, and each applies what the
+// others haven't.
+func Migrate(ctx context.Context) (int, error) {
+	if db == nil {
+		return 0, errors.New("database connection not initialized")
+	}
+
+	// Schema changes may rewrite large tables, so they get a longer budget than regular queries
+	ctx, cancel := context.WithTimeout(ctx, migrationTimeout)
+	defer cancel()
+
+	release, err := lockMigrations(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	// Read under the lock, so that migrations another node just applied aren't run again
+	pending, err := PendingMigrations(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, m := range pending {
+		err := withTx(ctx, "Migrate", func(ctx context.Context, tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+				return err
+			}
+			// ON CONFLICT keeps a node whose lock expired mid-run from failing on the row
+			_, err := tx.ExecContext(ctx,
+				"INSERT INTO schema_migrations (version, name) VALUES ($1, $2) ON CONFLICT (version) DO NOTHING",
+				m.Version, m.Name,
+			)
+			return err
+		})
+		if err != nil {
+			return i, fmt.Errorf("migration %04d_%s failed: %v", m.Version, m.Name, err)
+		}
+		logger.Info(ctx, "applied migration", "version", m.Version, "name", m.Name)
+	}
+
+	return len(pending), nil
+}
@@ -0,0 +1,50 @@
+-- Tables created by InitializeDB before versioned migrations existed.
+-- IF NOT EXISTS keeps this a no-op on databases that already have them.
+
+CREATE TABLE IF NOT EXISTS users (
+	id SERIAL PRIMARY KEY,
+	username VARCHAR(255) UNIQUE NOT NULL,
+	public_key TEXT NOT NULL,
+	encrypted_private_key TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Rotated keys, kept so messages stored under old keys remain readable
+CREATE TABLE IF NOT EXISTS user_key_history (
+	id SERIAL PRIMARY KEY,
+	username VARCHAR(255) NOT NULL,
+	public_key TEXT NOT NULL,
+	valid_from TIMESTAMP NOT NULL,
+	valid_until TIMESTAMP NOT NULL,
+	INDEX idx_key_history_username (username)
+);
+
+-- Prekeys for asynchronous key exchange
+CREATE TABLE IF NOT EXISTS prekeys (
+	id SERIAL PRIMARY KEY,
+	username VARCHAR(255) NOT NULL,
+	key_id INT NOT NULL,
+	public_key TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (username, key_id)
+);
+
+CREATE TABLE IF NOT EXISTS signed_prekeys (
+	username VARCHAR(255) PRIMARY KEY,
+	key_id INT NOT NULL,
+	public_key TEXT NOT NULL,
+	signature TEXT NOT NULL,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Client ratchet state
+CREATE TABLE IF NOT EXISTS session_blobs (
+	username VARCHAR(255) NOT NULL,
+	peer_key TEXT NOT NULL,
+	device_id VARCHAR(255) NOT NULL,
+	version INT NOT NULL,
+	blob TEXT NOT NULL,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (username, peer_key, device_id)
+);
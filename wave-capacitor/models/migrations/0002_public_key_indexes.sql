@@ -0,0 +1,3 @@
+-- Resolve accounts by public key without a full table scan
+CREATE INDEX IF NOT EXISTS idx_users_public_key ON users (public_key);
+CREATE INDEX IF NOT EXISTS idx_key_history_public_key ON user_key_history (public_key);
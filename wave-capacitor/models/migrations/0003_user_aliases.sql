@@ -0,0 +1,7 @@
+-- Former usernames, kept after a rename so old references still resolve
+CREATE TABLE IF NOT EXISTS user_aliases (
+	alias VARCHAR(255) PRIMARY KEY,
+	username VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	INDEX idx_user_aliases_username (username)
+);
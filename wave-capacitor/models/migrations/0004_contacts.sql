@@ -0,0 +1,8 @@
+-- One row per contact, replacing the per-user contacts files
+CREATE TABLE IF NOT EXISTS contacts (
+	owner VARCHAR(255) NOT NULL,
+	contact_pubkey TEXT NOT NULL,
+	nickname TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (owner, contact_pubkey)
+);
@@ -0,0 +1,12 @@
+-- Metadata of stored messages; ciphertext bodies stay in the message store.
+-- recipient_hash is the salted SHA-256 of the owner's public key, never the key itself.
+CREATE TABLE IF NOT EXISTS message_index (
+	recipient_hash VARCHAR(64) NOT NULL,
+	message_id VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	size INT NOT NULL,
+	state VARCHAR(16) NOT NULL DEFAULT 'unread',
+	PRIMARY KEY (recipient_hash, message_id),
+	INDEX idx_message_index_recipient_time (recipient_hash, created_at DESC, message_id DESC),
+	INDEX idx_message_index_time (created_at)
+);
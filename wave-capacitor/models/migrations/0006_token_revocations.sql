@@ -0,0 +1,5 @@
+-- Tokens issued to a username at or before revoked_at are rejected
+CREATE TABLE IF NOT EXISTS token_revocations (
+	username VARCHAR(255) PRIMARY KEY,
+	revoked_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,15 @@
+-- First responses of mutating requests, replayed when a client retries with the same
+-- Idempotency-Key. scope is the username, or empty for unauthenticated requests.
+-- status is 0 while the first request is still being handled.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	scope VARCHAR(255) NOT NULL,
+	idempotency_key VARCHAR(255) NOT NULL,
+	request_hash VARCHAR(64) NOT NULL,
+	status INT NOT NULL DEFAULT 0,
+	content_type VARCHAR(255) NOT NULL DEFAULT '',
+	body BYTES,
+	created_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (scope, idempotency_key),
+	INDEX idx_idempotency_keys_expires (expires_at)
+);
@@ -0,0 +1,26 @@
+-- Endpoints users registered for event notifications. An empty events list subscribes
+-- to every event type. The secret signs each delivery.
+CREATE TABLE IF NOT EXISTS webhooks (
+	id UUID PRIMARY KEY,
+	username VARCHAR(255) NOT NULL,
+	url VARCHAR(2048) NOT NULL,
+	secret VARCHAR(255) NOT NULL,
+	events STRING[] NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	INDEX idx_webhooks_username (username)
+);
+
+-- One row per delivery attempt. webhook_id is 'deployment' for the node-wide endpoint.
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	webhook_id VARCHAR(64) NOT NULL,
+	event_id VARCHAR(64) NOT NULL,
+	event_type VARCHAR(64) NOT NULL,
+	attempt INT NOT NULL,
+	status_code INT NOT NULL DEFAULT 0,
+	error TEXT NOT NULL DEFAULT '',
+	duration_ms INT NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	INDEX idx_webhook_deliveries_webhook (webhook_id, created_at DESC),
+	INDEX idx_webhook_deliveries_time (created_at)
+);
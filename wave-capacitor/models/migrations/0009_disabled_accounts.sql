@@ -0,0 +1,4 @@
+-- Accounts an operator disabled through the admin API; NULL means the account is active.
+-- Disabled accounts can't log in or recover and their tokens are revoked.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_reason TEXT NOT NULL DEFAULT '';
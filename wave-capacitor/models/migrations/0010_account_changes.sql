@@ -0,0 +1,19 @@
+-- Per-account change log behind incremental backups. users.change_seq is the sequence
+-- number of the account's latest change and serves as the ID of a backup taken then;
+-- changes_pruned_through is the highest sequence purged from the log, so incremental
+-- backups since older IDs are no longer possible.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS change_seq INT8 NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS changes_pruned_through INT8 NOT NULL DEFAULT 0;
+
+-- recipient_hash and message_id identify the message of message changes; both are empty
+-- for contact changes
+CREATE TABLE IF NOT EXISTS account_changes (
+	username VARCHAR(255) NOT NULL,
+	seq INT8 NOT NULL,
+	kind VARCHAR(16) NOT NULL,
+	recipient_hash VARCHAR(64) NOT NULL DEFAULT '',
+	message_id VARCHAR(255) NOT NULL DEFAULT '',
+	changed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (username, seq),
+	INDEX idx_account_changes_time (changed_at)
+);
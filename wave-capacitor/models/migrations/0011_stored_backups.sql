@@ -0,0 +1,11 @@
+-- Backups users encrypted on their devices and stored on the node. The blobs live in the
+-- stored backup blob store under their ID; sha256 is the checksum of the blob as uploaded.
+CREATE TABLE IF NOT EXISTS stored_backups (
+	id UUID PRIMARY KEY,
+	username VARCHAR(255) NOT NULL,
+	label VARCHAR(255) NOT NULL DEFAULT '',
+	size INT8 NOT NULL,
+	sha256 VARCHAR(64) NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	INDEX idx_stored_backups_username (username, created_at)
+);
@@ -0,0 +1,3 @@
+-- Whether the owner verified the contact's key by comparing safety numbers: unverified,
+-- verified, or changed once the contact rotated away from the key
+ALTER TABLE contacts ADD COLUMN IF NOT EXISTS verification VARCHAR(16) NOT NULL DEFAULT 'unverified';
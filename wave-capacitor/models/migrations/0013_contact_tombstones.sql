@@ -0,0 +1,5 @@
+-- Removed contacts stay behind as tombstones and every row records its last change, so
+-- clients can sync contact lists incrementally
+ALTER TABLE contacts ADD COLUMN IF NOT EXISTS modified_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP;
+ALTER TABLE contacts ADD COLUMN IF NOT EXISTS deleted BOOL NOT NULL DEFAULT false;
+CREATE INDEX IF NOT EXISTS idx_contacts_modified ON contacts (owner, modified_at);
@@ -0,0 +1,7 @@
+-- Public keys each user blocked; messages from the accounts behind them are not delivered
+CREATE TABLE IF NOT EXISTS blocked_keys (
+	username VARCHAR(255) NOT NULL,
+	public_key TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (username, public_key)
+);
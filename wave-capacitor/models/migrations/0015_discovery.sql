@@ -0,0 +1,6 @@
+-- Blinded identifiers of the users who opted in to mutual-contact discovery
+CREATE TABLE IF NOT EXISTS discovery_identities (
+	username VARCHAR(255) PRIMARY KEY,
+	identifier_hash TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,6 @@
+-- Leases electing the capacitor that runs cluster-wide singleton jobs
+CREATE TABLE IF NOT EXISTS job_leases (
+	name VARCHAR(64) PRIMARY KEY,
+	holder TEXT NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
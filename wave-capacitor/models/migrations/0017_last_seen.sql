@@ -0,0 +1,4 @@
+-- When each account last made an authenticated request, written in batches behind the
+-- requests, so it lags by up to DB_WRITE_BEHIND_MS. NULL until the first one after this
+-- migration.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMP NULL;
@@ -0,0 +1,4 @@
+-- SHA-256 (hex) of each message as stored, taken when it is written, against which the
+-- copies fetched back from replicas are checked. Empty for messages indexed before this
+-- migration, until they are indexed again.
+ALTER TABLE message_index ADD COLUMN IF NOT EXISTS content_hash VARCHAR(64) NOT NULL DEFAULT '';
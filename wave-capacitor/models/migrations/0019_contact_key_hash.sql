@@ -0,0 +1,4 @@
+-- Contact keys sealed under the owner's contacts scope. Once a row has one, contact_pubkey
+-- holds a keyed hash of the key instead of the key itself; rows written without a master
+-- key leave it empty.
+ALTER TABLE contacts ADD COLUMN IF NOT EXISTS public_key TEXT NOT NULL DEFAULT '';
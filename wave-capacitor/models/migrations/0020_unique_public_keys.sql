@@ -0,0 +1,10 @@
+-- A public key identifies the mailbox of one account, so no two accounts may hold the
+-- same current key. Databases where two accounts already share one fail here until an
+-- operator resolves the duplicates.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_public_key_unique ON users (public_key);
+DROP INDEX IF EXISTS users@idx_users_public_key;
+
+-- When the current key of each account became active; updated_at also moves on renames
+-- and other changes. NULL for keys installed before this migration, whose start is the
+-- last rotation or else the account's creation.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS key_activated_at TIMESTAMP;
@@ -0,0 +1,304 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// dumpSkippedTables are left out of node dumps; the restoring binary records its own
+// migrations, under its own migration lock
+var dumpSkippedTables = map[string]bool{"schema_migrations": true, "schema_migrations_lock": true}
+
+// restoreBatchSize is how many rows one UPSERT of a restore writes
+const restoreBatchSize = 100
+
+// TableColumn is a column of a dumped table with its database type
+type TableColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// ClusterTimestamp returns the database's current logical timestamp; dumps read as of
+// this timestamp see every table at the same consistent point
+func ClusterTimestamp(ctx context.Context) (string, error) {
+	if db == nil {
+		return "", errors.New("database connection not initialized")
+	}
+
+	var timestamp string
+	err := withRetry(ctx, "ClusterTimestamp", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, `SELECT cluster_logical_timestamp()::STRING`).Scan(&timestamp)
+	})
+	if err != nil {
+		return "", fmt.Errorf("error reading cluster timestamp: %v", err)
+	}
+	return timestamp, nil
+}
+
+// SchemaVersion returns the latest migration applied to the database and the latest one
+// this binary knows
+func SchemaVersion(ctx context.Context) (applied, known int, err error) {
+	if db == nil {
+		return 0, 0, errors.New("database connection not initialized")
+	}
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(migrations) > 0 {
+		known = migrations[len(migrations)-1].Version
+	}
+	versions, err := appliedMigrations(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	for version := range versions {
+		applied = max(applied, version)
+	}
+	return applied, known, nil
+}
+
+// DumpableTables lists the tables of the node's schema that a dump holds
+func DumpableTables(ctx context.Context) ([]string, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var tables []string
+	query := `SELECT table_name FROM information_schema.tables WHERE table_schema = 'public' AND table_type = 'BASE TABLE' ORDER BY table_name`
+	err := withRetry(ctx, "DumpableTables", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		tables = []string{}
+		for rows.Next() {
+			var table string
+			if err := rows.Scan(&table); err != nil {
+				return err
+			}
+			if !dumpSkippedTables[table] {
+				tables = append(tables, table)
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing tables: %v", err)
+	}
+	return tables, nil
+}
+
+// TableHasRows reports whether table holds any row
+func TableHasRows(ctx context.Context, table string) (bool, error) {
+	if db == nil {
+		return false, errors.New("database connection not initialized")
+	}
+
+	var exists bool
+	err := withRetry(ctx, "TableHasRows", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM `+pq.QuoteIdentifier(table)+`)`).Scan(&exists)
+	})
+	if err != nil {
+		return false, fmt.Errorf("error reading %s: %v", table, err)
+	}
+	return exists, nil
+}
+
+// DumpTable writes every row of table as of the cluster timestamp asOf to w as NDJSON:
+// a first line with the columns, then one JSON array per row. BYTES values are base64
+// encoded and timestamps RFC 3339. The read isn't retried, as rows may have been written
+// already; it returns the number of rows.
+func DumpTable(ctx context.Context, w io.Writer, table, asOf string) (int64, error) {
+	if db == nil {
+		return 0, errors.New("database connection not initialized")
+	}
+	if strings.Trim(asOf, "0123456789.") != "" {
+		return 0, fmt.Errorf("invalid cluster timestamp %q", asOf)
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT * FROM `+pq.QuoteIdentifier(table)+` AS OF SYSTEM TIME `+asOf)
+	if err != nil {
+		return 0, fmt.Errorf("error dumping %s: %v", table, err)
+	}
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return 0, err
+	}
+	columns := make([]TableColumn, len(types))
+	for i, columnType := range types {
+		columns[i] = TableColumn{Name: columnType.Name(), Type: columnType.DatabaseTypeName()}
+	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(struct {
+		Columns []TableColumn `json:"columns"`
+	}{columns}); err != nil {
+		return 0, err
+	}
+
+	var count int64
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return count, fmt.Errorf("error dumping %s: %v", table, err)
+		}
+		for i, value := range values {
+			switch v := value.(type) {
+			case []byte:
+				if columns[i].Type == "BYTEA" || columns[i].Type == "BYTES" {
+					values[i] = base64.StdEncoding.EncodeToString(v)
+				} else {
+					values[i] = string(v)
+				}
+			case time.Time:
+				values[i] = v.UTC().Format(time.RFC3339Nano)
+			}
+		}
+		if err := encoder.Encode(values); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, fmt.Errorf("error dumping %s: %v", table, err)
+	}
+	return count, nil
+}
+
+// RestoreTable upserts the rows of a dump written by DumpTable into table and returns
+// the number of rows. Columns the dump lacks, added by later migrations, keep their
+// defaults; columns the table lacks fail the restore.
+func RestoreTable(ctx context.Context, r io.Reader, table string) (int64, error) {
+	if db == nil {
+		return 0, errors.New("database connection not initialized")
+	}
+
+	reader := bufio.NewReaderSize(r, 64*1024)
+	header, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	var dump struct {
+		Columns []TableColumn `json:"columns"`
+	}
+	if err := json.Unmarshal(header, &dump); err != nil || len(dump.Columns) == 0 {
+		return 0, fmt.Errorf("dump of %s has no column header", table)
+	}
+	names := make([]string, len(dump.Columns))
+	for i, column := range dump.Columns {
+		names[i] = pq.QuoteIdentifier(column.Name)
+	}
+	prefix := `UPSERT INTO ` + pq.QuoteIdentifier(table) + ` (` + strings.Join(names, ", ") + `) VALUES `
+
+	var count int64
+	var batch [][]interface{}
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var query strings.Builder
+		query.WriteString(prefix)
+		args := make([]interface{}, 0, len(batch)*len(names))
+		for i, row := range batch {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			query.WriteByte('(')
+			for j := range row {
+				if j > 0 {
+					query.WriteString(", ")
+				}
+				args = append(args, row[j])
+				fmt.Fprintf(&query, "$%d", len(args))
+			}
+			query.WriteByte(')')
+		}
+		err := withRetry(ctx, "RestoreTable", func(ctx context.Context) error {
+			_, err := db.ExecContext(ctx, query.String(), args...)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error restoring %s: %v", table, err)
+		}
+		count += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+
+	for line := 2; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return count, err
+		}
+		if len(bytes.TrimSpace(data)) > 0 {
+			row, decodeErr := decodeDumpRow(data, dump.Columns)
+			if decodeErr != nil {
+				return count, fmt.Errorf("dump of %s, line %d: %v", table, line, decodeErr)
+			}
+			batch = append(batch, row)
+			if len(batch) == restoreBatchSize {
+				if err := flush(); err != nil {
+					return count, err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return count, flush()
+}
+
+// decodeDumpRow turns a dumped row back into query arguments; numbers stay as written so
+// 64-bit IDs survive
+func decodeDumpRow(data []byte, columns []TableColumn) ([]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var row []interface{}
+	if err := decoder.Decode(&row); err != nil {
+		return nil, err
+	}
+	if len(row) != len(columns) {
+		return nil, fmt.Errorf("%d values for %d columns", len(row), len(columns))
+	}
+	for i, value := range row {
+		text, ok := value.(string)
+		if !ok {
+			continue
+		}
+		switch columns[i].Type {
+		case "BYTEA", "BYTES":
+			decoded, err := base64.StdEncoding.DecodeString(text)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %v", columns[i].Name, err)
+			}
+			row[i] = decoded
+		case "TIMESTAMP", "TIMESTAMPTZ":
+			parsed, err := time.Parse(time.RFC3339Nano, text)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %v", columns[i].Name, err)
+			}
+			row[i] = parsed
+		}
+	}
+	return row, nil
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Prekey is a one-time prekey uploaded by a client
+type Prekey struct {
+	KeyID     int    `json:"key_id" validate:"min=0"`
+	PublicKey string `json:"public_key" validate:"required"`
+}
+
+// SignedPrekey is a medium-term prekey signed with the user's identity key
+type SignedPrekey struct {
+	KeyID     int    `json:"key_id" validate:"min=0"`
+	PublicKey string `json:"public_key" validate:"required"`
+	Signature string `json:"signature" validate:"required"`
+}
+
+// PrekeyBundle is what a sender receives when starting a conversation
+type PrekeyBundle struct {
+	IdentityKey   string        `json:"identity_key"`
+	SignedPrekey  *SignedPrekey `json:"signed_prekey,omitempty"`
+	OneTimePrekey *Prekey       `json:"one_time_prekey,omitempty"`
+}
+
+// ErrPrekeyUserNotFound is returned when no account owns the requested identity key
+var ErrPrekeyUserNotFound = errors.New("no user found for identity key")
+
+// StorePrekeys adds a batch of one-time prekeys for a user, ignoring key IDs already present
+func StorePrekeys(ctx context.Context, username string, prekeys []Prekey) (int, error) {
+	if db == nil {
+		return 0, errors.New("database connection not initialized")
+	}
+
+	stored := 0
+	query := `INSERT INTO prekeys (username, key_id, public_key) VALUES ($1, $2, $3) ON CONFLICT (username, key_id) DO NOTHING`
+	err := withTx(ctx, "StorePrekeys", func(ctx context.Context, tx *sql.Tx) error {
+		stored = 0
+		for _, prekey := range prekeys {
+			result, err := tx.ExecContext(ctx, query, username, prekey.KeyID, prekey.PublicKey)
+			if err != nil {
+				return err
+			}
+			if n, err := result.RowsAffected(); err == nil {
+				stored += int(n)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to store prekeys: %v", err)
+	}
+
+	logger.Info(ctx, "stored prekeys", "username", username, "count", stored)
+	return stored, nil
+}
+
+// SetSignedPrekey replaces the user's signed prekey
+func SetSignedPrekey(ctx context.Context, username string, signed SignedPrekey) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	query := `UPSERT INTO signed_prekeys (username, key_id, public_key, signature, updated_at) VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP)`
+	err := withRetry(ctx, "SetSignedPrekey", func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, query, username, signed.KeyID, signed.PublicKey, signed.Signature)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store signed prekey: %v", err)
+	}
+	return nil
+}
+
+// CountPrekeys returns how many unclaimed one-time prekeys a user has left
+func CountPrekeys(ctx context.Context, username string) (int, error) {
+	if db == nil {
+		return 0, errors.New("database connection not initialized")
+	}
+
+	var count int
+	query := `SELECT COUNT(*) FROM prekeys WHERE username = $1`
+	err := withRetry(ctx, "CountPrekeys", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, username).Scan(&count)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error counting prekeys: %v", err)
+	}
+	return count, nil
+}
+
+// ClaimPrekeyBundle returns the bundle for the account owning identityKey, atomically
+// consuming one one-time prekey. The one-time prekey is omitted once the supply is exhausted.
+// It also returns the owner's username and remaining prekey count.
+func ClaimPrekeyBundle(ctx context.Context, identityKey string) (*PrekeyBundle, string, int, error) {
+	if db == nil {
+		return nil, "", 0, errors.New("database connection not initialized")
+	}
+
+	var username string
+	err := withRetry(ctx, "ClaimPrekeyBundle", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, `SELECT username FROM users WHERE public_key = $1`, identityKey).Scan(&username)
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", 0, ErrPrekeyUserNotFound
+		}
+		return nil, "", 0, fmt.Errorf("error resolving identity key: %v", err)
+	}
+
+	bundle := &PrekeyBundle{IdentityKey: identityKey}
+
+	// Signed prekey (optional)
+	var signed SignedPrekey
+	query := `SELECT key_id, public_key, signature FROM signed_prekeys WHERE username = $1`
+	err = withRetry(ctx, "ClaimPrekeyBundle", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, username).Scan(&signed.KeyID, &signed.PublicKey, &signed.Signature)
+	})
+	if err == nil {
+		bundle.SignedPrekey = &signed
+	} else if err != sql.ErrNoRows {
+		return nil, "", 0, fmt.Errorf("error retrieving signed prekey: %v", err)
+	}
+
+	// Atomically remove the oldest one-time prekey
+	var prekey Prekey
+	claim := `DELETE FROM prekeys WHERE id = (SELECT id FROM prekeys WHERE username = $1 ORDER BY id LIMIT 1) RETURNING key_id, public_key`
+	err = withWriteRetry(ctx, "ClaimPrekeyBundle", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, claim, username).Scan(&prekey.KeyID, &prekey.PublicKey)
+	})
+	if err == nil {
+		bundle.OneTimePrekey = &prekey
+	} else if err != sql.ErrNoRows {
+		return nil, "", 0, fmt.Errorf("error claiming prekey: %v", err)
+	}
+
+	remaining, err := CountPrekeys(ctx, username)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	return bundle, username, remaining, nil
+}
@@ -0,0 +1,99 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// servingRegion is the CockroachDB region of the gateway node this capacitor talks to
+var (
+	servingRegionMu sync.RWMutex
+	servingRegion   string
+)
+
+// ServingRegion returns the database region serving this capacitor's queries,
+// falling back to the configured region before the gateway has been checked
+func ServingRegion() string {
+	servingRegionMu.RLock()
+	defer servingRegionMu.RUnlock()
+	if servingRegion != "" {
+		return servingRegion
+	}
+	return dbOptions.Region
+}
+
+// withRegion tags the connection string with the configured region so sessions can be
+// told apart by region in the cluster's session list
+func withRegion(connStr string) string {
+	if dbOptions.Region == "" {
+		return connStr
+	}
+	separator := "?"
+	if strings.Contains(connStr, "?") {
+		separator = "&"
+	}
+	return connStr + separator + "application_name=" + url.QueryEscape("wave-capacitor@"+dbOptions.Region)
+}
+
+// checkGatewayRegion records the gateway node's region and warns when it differs from
+// the configured one, since every query would then cross regions
+func checkGatewayRegion(ctx context.Context) {
+	var region string
+	err := withRetry(ctx, "gateway_region", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, "SELECT gateway_region()").Scan(&region)
+	})
+	if err != nil {
+		// Single-region clusters have no region locality
+		if dbOptions.Region != "" {
+			logger.Warn(ctx, "could not determine the database gateway region", "error", err)
+		}
+		return
+	}
+
+	servingRegionMu.Lock()
+	servingRegion = region
+	servingRegionMu.Unlock()
+
+	if dbOptions.Region != "" && region != dbOptions.Region {
+		logger.Warn(ctx, "database gateway is in another region than this capacitor, check DB_HOSTS",
+			"gateway_region", region, "region", dbOptions.Region)
+		return
+	}
+	logger.Info(ctx, "database gateway region", "region", region)
+}
+
+// GetUserFollowerRead is GetUser served from the nearest replica when follower reads
+// are enabled. The result may be a few seconds stale, so it must only back read-only
+// endpoints that tolerate that (e.g. public key lookups), never read-modify-write flows.
+func GetUserFollowerRead(ctx context.Context, username string) (*User, error) {
+	if !dbOptions.FollowerReads {
+		return GetUser(ctx, username)
+	}
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+	// Cached accounts are fresher than follower reads; these are not cached, being stale
+	if cached, _ := accountCache.get(userKey(username)); cached != nil {
+		return cached, nil
+	}
+
+	var user User
+	query := `SELECT id, username, public_key, encrypted_private_key FROM users
+		AS OF SYSTEM TIME follower_read_timestamp() WHERE username = $1`
+	err := withRetry(ctx, "GetUserFollowerRead", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, username).Scan(&user.ID, &user.Username, &user.PublicKey, &user.EncryptedPrivKey)
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// Accounts created in the last few seconds are not visible to follower reads yet
+			return GetUser(ctx, username)
+		}
+		return nil, fmt.Errorf("error retrieving user: %v", err)
+	}
+	return &user, nil
+}
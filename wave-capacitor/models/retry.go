@@ -0,0 +1,161 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+	"wave_capacitor/tracing"
+
+	"github.com/lib/pq"
+)
+
+// Retry policy for CockroachDB. Under contention CockroachDB aborts transactions with
+// SQLSTATE 40001 and expects the client to run them again.
+const (
+	maxDBAttempts    = 5
+	initialDBBackoff = 25 * time.Millisecond
+	maxDBBackoff     = time.Second
+)
+
+// isRetryableDBError reports whether err is a serialization failure or a transient
+// connection problem that is worth retrying
+func isRetryableDBError(err error) bool {
+	if err == nil {
+		return false
+	}
+	// A query that hit its timeout or whose request went away is not retried
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code == "40001": // serialization_failure / "restart transaction"
+			return true
+		case pqErr.Code.Class() == "08": // connection_exception
+			return true
+		case pqErr.Code == "57P01": // admin_shutdown, e.g. a node draining during a rolling restart
+			return true
+		}
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isAmbiguousDBError reports whether a retryable err leaves it unknown whether the
+// statement was applied: the connection broke after the statement was sent, so the
+// database may have run it without its answer arriving. An error the database answered
+// with means the statement failed, and drivers only return driver.ErrBadConn for
+// connections they found broken before sending anything.
+func isAmbiguousDBError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return false
+	}
+	return !errors.Is(err, driver.ErrBadConn)
+}
+
+// withRetry runs fn, retrying retryable failures with bounded exponential backoff.
+// Each attempt gets its own query timeout (see queryContext). fn must be idempotent,
+// as a statement whose answer was lost is run again; statements that must not apply
+// twice go through withWriteRetry. Anything fn returns besides a retryable error
+// (including sql.ErrNoRows) is passed straight back to the caller.
+func withRetry(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	return retryDB(ctx, op, false, fn)
+}
+
+// withWriteRetry is withRetry for statements that must not apply twice, such as claiming
+// a prekey or appending to a log: only the failures certain to have left the database
+// untouched are retried, the others are returned to the caller
+func withWriteRetry(ctx context.Context, op string, fn func(ctx context.Context) error) error {
+	return retryDB(ctx, op, true, fn)
+}
+
+// retryDB runs fn for withRetry and withWriteRetry; once leaves ambiguous failures unretried
+func retryDB(ctx context.Context, op string, once bool, fn func(ctx context.Context) error) error {
+	start := time.Now()
+	attempt := 0
+	var err error
+	if queryHook != nil {
+		defer func() {
+			queryHook(ctx, QueryTrace{Op: op, Duration: time.Since(start), Attempts: attempt, Err: err})
+		}()
+	}
+
+	// One span per call, covering all attempts
+	ctx, span := tracing.Start(ctx, "db "+op, tracing.KindClient)
+	span.SetAttribute("db.system", "cockroachdb")
+	span.SetAttribute("db.operation.name", op)
+	defer func() {
+		span.SetAttribute("db.attempts", attempt)
+		if errors.Is(err, sql.ErrNoRows) {
+			span.End(nil) // An expected outcome, not a failure
+		} else {
+			span.End(err)
+		}
+	}()
+
+	backoff := initialDBBackoff
+	for attempt = 1; attempt <= maxDBAttempts; attempt++ {
+		attemptCtx, cancel := queryContext(ctx)
+		err = fn(attemptCtx)
+		cancel()
+		if !isRetryableDBError(err) || (once && isAmbiguousDBError(err)) || attempt == maxDBAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		// Full jitter keeps contending clients from retrying in lockstep
+		delay := time.Duration(rand.Int63n(int64(backoff)) + 1)
+		logger.Warn(ctx, "retrying after retryable database error", "op", op, "attempt", attempt,
+			"max_attempts", maxDBAttempts, "delay_ms", delay.Milliseconds(), "error", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			err = ctx.Err()
+			return err
+		}
+
+		backoff *= 2
+		if backoff > maxDBBackoff {
+			backoff = maxDBBackoff
+		}
+	}
+	return err
+}
+
+// withTx runs fn inside a transaction, re-running the whole transaction on retryable errors.
+// fn should wrap database errors with %w so they can be recognized as retryable. A commit
+// whose answer was lost isn't re-run, as the transaction may have been applied.
+func withTx(ctx context.Context, op string, fn func(ctx context.Context, tx *sql.Tx) error) error {
+	return withRetry(ctx, op, func(ctx context.Context) error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(ctx, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if isRetryableDBError(err) && isAmbiguousDBError(err) {
+			return fmt.Errorf("commit result unknown: %v", err)
+		}
+		return err
+	})
+}
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SessionBlob is an opaque, client-encrypted ratchet session state
+type SessionBlob struct {
+	PeerKey   string    `json:"peer_key"`
+	DeviceID  string    `json:"device_id"`
+	Version   int       `json:"version"`
+	Blob      string    `json:"blob,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ErrSessionNotFound is returned when no session blob exists for the given key
+var ErrSessionNotFound = errors.New("session not found")
+
+// ErrSessionConflict is returned when a write is based on a stale version
+var ErrSessionConflict = errors.New("session version conflict")
+
+// GetSessionBlob returns the stored session for (username, peer, device)
+func GetSessionBlob(ctx context.Context, username, peerKey, deviceID string) (*SessionBlob, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	session := SessionBlob{PeerKey: peerKey, DeviceID: deviceID}
+	query := `SELECT version, blob, updated_at FROM session_blobs WHERE username = $1 AND peer_key = $2 AND device_id = $3`
+	err := withRetry(ctx, "GetSessionBlob", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, username, peerKey, deviceID).Scan(&session.Version, &session.Blob, &session.UpdatedAt)
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrSessionNotFound
+		}
+		return nil, fmt.Errorf("error retrieving session: %v", err)
+	}
+	return &session, nil
+}
+
+// ListSessionBlobs returns session metadata (without blobs) for a user's device
+func ListSessionBlobs(ctx context.Context, username, deviceID string) ([]SessionBlob, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	query := `SELECT peer_key, device_id, version, updated_at FROM session_blobs WHERE username = $1 AND device_id = $2 ORDER BY updated_at DESC`
+	var sessions []SessionBlob
+	err := withRetry(ctx, "ListSessionBlobs", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query, username, deviceID)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		sessions = []SessionBlob{}
+		for rows.Next() {
+			var session SessionBlob
+			if err := rows.Scan(&session.PeerKey, &session.DeviceID, &session.Version, &session.UpdatedAt); err != nil {
+				return err
+			}
+			sessions = append(sessions, session)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing sessions: %v", err)
+	}
+	return sessions, nil
+}
+
+// PutSessionBlob stores a session using optimistic concurrency. expectedVersion must match the
+// stored version (0 when creating). On success the new version is returned; on a stale write
+// ErrSessionConflict is returned together with the current version.
+func PutSessionBlob(ctx context.Context, username, peerKey, deviceID string, expectedVersion int, blob string) (int, error) {
+	if db == nil {
+		return 0, errors.New("database connection not initialized")
+	}
+
+	newVersion := expectedVersion + 1
+
+	var result sql.Result
+	err := withWriteRetry(ctx, "PutSessionBlob", func(ctx context.Context) error {
+		var err error
+		if expectedVersion == 0 {
+			query := `INSERT INTO session_blobs (username, peer_key, device_id, version, blob) VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING`
+			result, err = db.ExecContext(ctx, query, username, peerKey, deviceID, newVersion, blob)
+		} else {
+			query := `UPDATE session_blobs SET version = $1, blob = $2, updated_at = CURRENT_TIMESTAMP WHERE username = $3 AND peer_key = $4 AND device_id = $5 AND version = $6`
+			result, err = db.ExecContext(ctx, query, newVersion, blob, username, peerKey, deviceID, expectedVersion)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to store session: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("error getting rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		current, err := GetSessionBlob(ctx, username, peerKey, deviceID)
+		if err == ErrSessionNotFound {
+			return 0, ErrSessionConflict
+		}
+		if err != nil {
+			return 0, err
+		}
+		return current.Version, ErrSessionConflict
+	}
+
+	return newVersion, nil
+}
+
+// DeleteSessionBlob removes a stored session
+func DeleteSessionBlob(ctx context.Context, username, peerKey, deviceID string) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	query := `DELETE FROM session_blobs WHERE username = $1 AND peer_key = $2 AND device_id = $3`
+	var result sql.Result
+	err := withRetry(ctx, "DeleteSessionBlob", func(ctx context.Context) error {
+		var err error
+		result, err = db.ExecContext(ctx, query, username, peerKey, deviceID)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete session: %v", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting rows affected: %v", err)
+	}
+	if rowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
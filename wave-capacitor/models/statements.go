@@ -0,0 +1,47 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// Hot queries are prepared once and reused; database/sql re-prepares them transparently
+// on each pooled connection.
+const (
+	getUserQuery    = `SELECT id, username, public_key, encrypted_private_key FROM users WHERE username = $1`
+	userExistsQuery = `SELECT EXISTS(SELECT 1 FROM users WHERE username = $1) OR EXISTS(SELECT 1 FROM user_aliases WHERE alias = $1)`
+)
+
+var (
+	statementsMu sync.Mutex
+	statements   = make(map[string]*sql.Stmt)
+)
+
+// prepared returns the prepared statement for query, preparing it on first use.
+// Preparation is lazy so it happens after migrations have created the tables.
+func prepared(ctx context.Context, query string) (*sql.Stmt, error) {
+	statementsMu.Lock()
+	defer statementsMu.Unlock()
+
+	if stmt, ok := statements[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	statements[query] = stmt
+	return stmt, nil
+}
+
+// closeStatements releases all prepared statements, e.g. before the connection is replaced
+func closeStatements() {
+	statementsMu.Lock()
+	defer statementsMu.Unlock()
+
+	for query, stmt := range statements {
+		stmt.Close()
+		delete(statements, query)
+	}
+}
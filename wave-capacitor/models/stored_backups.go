@@ -0,0 +1,125 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrStoredBackupNotFound is returned when no stored backup of the user has the given ID
+var ErrStoredBackupNotFound = errors.New("stored backup not found")
+
+// ErrStoredBackupLimit is returned when the user already stores the most backups allowed
+var ErrStoredBackupLimit = errors.New("stored backup limit reached")
+
+// StoredBackup describes a client-encrypted backup a user stored on the node; the blob
+// itself is kept in a blob store under the ID
+type StoredBackup struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"-"`
+	Label     string    `json:"label,omitempty"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256" doc:"hex SHA-256 of the blob as uploaded"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateStoredBackup records a stored backup unless the user already has maxPerUser of
+// them, in which case ErrStoredBackupLimit is returned; ID, Username, Size and SHA256
+// must be set
+func CreateStoredBackup(ctx context.Context, backup *StoredBackup, maxPerUser int) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	query := `INSERT INTO stored_backups (id, username, label, size, sha256)
+		SELECT $1, $2, $3, $4, $5 WHERE (SELECT count(*) FROM stored_backups WHERE username = $2) < $6
+		RETURNING created_at`
+	err := withWriteRetry(ctx, "CreateStoredBackup", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, backup.ID, backup.Username, backup.Label, backup.Size, backup.SHA256, maxPerUser).
+			Scan(&backup.CreatedAt)
+	})
+	if err == sql.ErrNoRows {
+		return ErrStoredBackupLimit
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record stored backup: %v", err)
+	}
+	return nil
+}
+
+// ListStoredBackups returns the user's stored backups, oldest first
+func ListStoredBackups(ctx context.Context, username string) ([]StoredBackup, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var backups []StoredBackup
+	query := `SELECT id, label, size, sha256, created_at FROM stored_backups WHERE username = $1 ORDER BY created_at, id`
+	err := withRetry(ctx, "ListStoredBackups", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query, username)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		backups = []StoredBackup{}
+		for rows.Next() {
+			backup := StoredBackup{Username: username}
+			if err := rows.Scan(&backup.ID, &backup.Label, &backup.Size, &backup.SHA256, &backup.CreatedAt); err != nil {
+				return err
+			}
+			backups = append(backups, backup)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing stored backups: %v", err)
+	}
+	return backups, nil
+}
+
+// GetStoredBackup returns one of the user's stored backups
+func GetStoredBackup(ctx context.Context, username, id string) (*StoredBackup, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	backup := StoredBackup{Username: username}
+	query := `SELECT id, label, size, sha256, created_at FROM stored_backups WHERE username = $1 AND id::STRING = $2`
+	err := withRetry(ctx, "GetStoredBackup", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, username, id).Scan(&backup.ID, &backup.Label, &backup.Size, &backup.SHA256, &backup.CreatedAt)
+	})
+	if err == sql.ErrNoRows {
+		return nil, ErrStoredBackupNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving stored backup: %v", err)
+	}
+	return &backup, nil
+}
+
+// DeleteStoredBackup removes the record of one of the user's stored backups; the caller
+// deletes the blob
+func DeleteStoredBackup(ctx context.Context, username, id string) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	var result sql.Result
+	err := withRetry(ctx, "DeleteStoredBackup", func(ctx context.Context) error {
+		var err error
+		result, err = db.ExecContext(ctx, `DELETE FROM stored_backups WHERE username = $1 AND id::STRING = $2`, username, id)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete stored backup: %v", err)
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("error getting rows affected: %v", err)
+	} else if n == 0 {
+		return ErrStoredBackupNotFound
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TokensRevokedAt returns when the user's tokens were last revoked, or the zero time
+// if they never were
+func TokensRevokedAt(ctx context.Context, username string) (time.Time, error) {
+	if db == nil {
+		return time.Time{}, errors.New("database connection not initialized")
+	}
+
+	var revokedAt time.Time
+	query := `SELECT revoked_at FROM token_revocations WHERE username = $1`
+	err := withRetry(ctx, "TokensRevokedAt", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, username).Scan(&revokedAt)
+	})
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error checking token revocation: %v", err)
+	}
+	return revokedAt, nil
+}
+
+// revokeTokens invalidates every token issued to username up to now
+func revokeTokens(ctx context.Context, tx *sql.Tx, username string) error {
+	_, err := tx.ExecContext(ctx, `UPSERT INTO token_revocations (username, revoked_at) VALUES ($1, CURRENT_TIMESTAMP)`, username)
+	return err
+}
@@ -1,15 +1,14 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"wave_capacitor/config"
 
-	_ "github.com/lib/pq" // PostgreSQL driver for CockroachDB
+	"github.com/lib/pq" // PostgreSQL driver for CockroachDB
 )
 
 // Global database instance
@@ -23,42 +22,50 @@ type User struct {
 	EncryptedPrivKey string `json:"encrypted_private_key"`
 }
 
-// InitializeDB connects to CockroachDB and sets up required tables
-func InitializeDB() error {
-	connStr := config.GetDBConnectionString()
+// ConnectDB opens the CockroachDB connection without touching the schema
+func ConnectDB() error {
+	connStr := dbOptions.ConnectionString
+	if connStr == "" {
+		return errors.New("database connection string not configured, call SetDBOptions first")
+	}
+	closeStatements()
 	var err error
-	db, err = sql.Open("postgres", connStr)
+	db, err = sql.Open("postgres", withRegion(connStr))
 	if err != nil {
 		return fmt.Errorf("failed to open database: %v", err)
 	}
 
+	applyPoolOptions()
+
 	// Test the connection
-	if err := db.Ping(); err != nil {
+	ctx, cancel := queryContext(context.Background())
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
 		return fmt.Errorf("database connection test failed: %v", err)
 	}
-	log.Println("✅ Connected to database successfully")
-
-	// Create users table if it doesn't exist
-	createUsersTable := `
-		CREATE TABLE IF NOT EXISTS users (
-			id SERIAL PRIMARY KEY,
-			username VARCHAR(255) UNIQUE NOT NULL,
-			public_key TEXT NOT NULL,
-			encrypted_private_key TEXT NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		);
-	`
-	if _, err := db.Exec(createUsersTable); err != nil {
-		return fmt.Errorf("failed to create users table: %v", err)
+	logger.Info(ctx, "connected to database")
+
+	checkGatewayRegion(ctx)
+	return nil
+}
+
+// InitializeDB connects to CockroachDB and applies any pending schema migrations
+func InitializeDB() error {
+	if err := ConnectDB(); err != nil {
+		return err
 	}
-	log.Println("✅ Users table ready")
+
+	applied, err := Migrate(context.Background())
+	if err != nil {
+		return fmt.Errorf("schema migration failed: %v", err)
+	}
+	logger.Info(context.Background(), "database schema up to date", "applied_migrations", applied)
 
 	return nil
 }
 
 // CreateUser stores a new user in the database
-func CreateUser(username string, publicKey []byte, encryptedPrivateKey []byte) error {
+func CreateUser(ctx context.Context, username string, publicKey []byte, encryptedPrivateKey []byte) error {
 	if db == nil {
 		return errors.New("database connection not initialized")
 	}
@@ -77,89 +84,259 @@ func CreateUser(username string, publicKey []byte, encryptedPrivateKey []byte) e
 
 	// Insert the user
 	query := `INSERT INTO users (username, public_key, encrypted_private_key) VALUES ($1, $2, $3)`
-	_, err := db.Exec(query, username, publicKeyBase64, encPrivKeyStr)
+	err := withRetry(ctx, "CreateUser", func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, query, username, publicKeyBase64, encPrivKeyStr)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("failed to create user: %v", err)
 	}
+	accountCache.invalidate(username)
 
-	log.Printf("✅ User '%s' created successfully", username)
+	logger.Info(ctx, "created user", "username", username)
 	return nil
 }
 
 // GetUser retrieves a user by username
-func GetUser(username string) (*User, error) {
+func GetUser(ctx context.Context, username string) (*User, error) {
 	if db == nil {
 		return nil, errors.New("database connection not initialized")
 	}
 
+	cached, generation := accountCache.get(userKey(username))
+	if cached != nil {
+		return cached, nil
+	}
+
 	var user User
-	query := `SELECT id, username, public_key, encrypted_private_key FROM users WHERE username = $1`
-	err := db.QueryRow(query, username).Scan(&user.ID, &user.Username, &user.PublicKey, &user.EncryptedPrivKey)
+	err := withRetry(ctx, "GetUser", func(ctx context.Context) error {
+		stmt, err := prepared(ctx, getUserQuery)
+		if err != nil {
+			return err
+		}
+		return stmt.QueryRowContext(ctx, username).Scan(&user.ID, &user.Username, &user.PublicKey, &user.EncryptedPrivKey)
+	})
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("user '%s' not found", username)
+			return nil, fmt.Errorf("%w: '%s'", ErrUserNotFound, username)
 		}
 		return nil, fmt.Errorf("error retrieving user: %v", err)
 	}
 
+	accountCache.put(userKey(username), &user, generation)
 	return &user, nil
 }
 
-// UpdateUserKeys updates the public key and encrypted private key for a user
-func UpdateUserKeys(username, publicKey string, encryptedPrivateKey interface{}) error {
+// ErrUserNotFound is returned when no account matches a lookup
+var ErrUserNotFound = errors.New("user not found")
+
+// GetUserByPublicKey returns the account owning publicKey. Keys retired through rotation
+// still resolve to their owner; compare the returned user's PublicKey to tell them apart.
+func GetUserByPublicKey(ctx context.Context, publicKey string) (*User, error) {
 	if db == nil {
-		return errors.New("database connection not initialized")
+		return nil, errors.New("database connection not initialized")
 	}
 
-	var encPrivKeyStr string
-	switch v := encryptedPrivateKey.(type) {
-	case string:
-		encPrivKeyStr = v
-	case map[string]interface{}:
-		jsonBytes, err := json.Marshal(v)
+	cached, generation := accountCache.get(publicKeyKey(publicKey))
+	if cached != nil {
+		return cached, nil
+	}
+
+	var user User
+	query := `
+		SELECT id, username, public_key, encrypted_private_key, 0 AS retired FROM users WHERE public_key = $1
+		UNION ALL
+		SELECT u.id, u.username, u.public_key, u.encrypted_private_key, 1 AS retired
+		FROM user_key_history h JOIN users u ON u.username = h.username
+		WHERE h.public_key = $1
+		ORDER BY retired
+		LIMIT 1
+	`
+	err := withRetry(ctx, "GetUserByPublicKey", func(ctx context.Context) error {
+		var retired int
+		return db.QueryRowContext(ctx, query, publicKey).Scan(&user.ID, &user.Username, &user.PublicKey, &user.EncryptedPrivKey, &retired)
+	})
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("error resolving public key: %v", err)
+	}
+
+	accountCache.put(publicKeyKey(publicKey), &user, generation)
+	return &user, nil
+}
+
+// ListUsers returns every account, ordered by username (used by maintenance commands)
+func ListUsers(ctx context.Context) ([]User, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var users []User
+	query := `SELECT id, username, public_key, encrypted_private_key FROM users ORDER BY username`
+	err := withRetry(ctx, "ListUsers", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query)
 		if err != nil {
-			return fmt.Errorf("failed to marshal encrypted private key: %v", err)
+			return err
 		}
-		encPrivKeyStr = string(jsonBytes)
-	default:
-		return errors.New("invalid encrypted private key format")
+		defer rows.Close()
+
+		users = []User{}
+		for rows.Next() {
+			var user User
+			if err := rows.Scan(&user.ID, &user.Username, &user.PublicKey, &user.EncryptedPrivKey); err != nil {
+				return err
+			}
+			users = append(users, user)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing users: %v", err)
+	}
+	return users, nil
+}
+
+// UpdateUserKeys installs the keys of a restored backup, creating the user if it doesn't
+// exist. A replaced public key is recorded in the key history, as a rotation does, and
+// ErrKeyInUse is returned when publicKey is, or was, the key of another account.
+func UpdateUserKeys(ctx context.Context, username, publicKey string, encryptedPrivateKey interface{}) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
 	}
 
-	// Update the user's keys
-	query := `UPDATE users SET public_key = $1, encrypted_private_key = $2, updated_at = CURRENT_TIMESTAMP WHERE username = $3`
-	result, err := db.Exec(query, publicKey, encPrivKeyStr, username)
+	encPrivKeyStr, err := EncodeEncryptedPrivateKey(encryptedPrivateKey)
+	if err != nil {
+		return err
+	}
+
+	created := false
+	defer accountCache.invalidate(username)
+	err = withTx(ctx, "UpdateUserKeys", func(ctx context.Context, tx *sql.Tx) error {
+		if err := checkKeyFree(ctx, tx, username, publicKey); err != nil {
+			return err
+		}
+
+		oldPublicKey, validFrom, err := lockUserKey(ctx, tx, username)
+		created = err == sql.ErrNoRows
+		switch {
+		case created:
+			// If the user doesn't exist, create it
+			insert := `INSERT INTO users (username, public_key, encrypted_private_key, key_activated_at) VALUES ($1, $2, $3, CURRENT_TIMESTAMP)`
+			_, err = tx.ExecContext(ctx, insert, username, publicKey, encPrivKeyStr)
+		case err != nil:
+			return fmt.Errorf("error retrieving user: %w", err)
+		case oldPublicKey == publicKey:
+			update := `UPDATE users SET encrypted_private_key = $1, updated_at = CURRENT_TIMESTAMP WHERE username = $2`
+			_, err = tx.ExecContext(ctx, update, encPrivKeyStr, username)
+		default:
+			if err := retireKey(ctx, tx, username, oldPublicKey, validFrom); err != nil {
+				return err
+			}
+			update := `UPDATE users SET public_key = $1, encrypted_private_key = $2, key_activated_at = CURRENT_TIMESTAMP,
+				updated_at = CURRENT_TIMESTAMP WHERE username = $3`
+			_, err = tx.ExecContext(ctx, update, publicKey, encPrivKeyStr, username)
+		}
+		if isKeyConflict(err) {
+			return ErrKeyInUse
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write user keys: %w", err)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrKeyInUse) {
+		return err
+	}
 	if err != nil {
 		return fmt.Errorf("failed to update user keys: %v", err)
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	if created {
+		logger.Info(ctx, "created user during key update", "username", username)
+	} else {
+		logger.Info(ctx, "updated user keys", "username", username)
+	}
+	return nil
+}
+
+// CreateUserWithKeys creates an account with the given stored keys, as a restore of an
+// account that doesn't exist does, returning ErrUsernameTaken if it exists by then and
+// ErrKeyInUse when publicKey is, or was, the key of another account
+func CreateUserWithKeys(ctx context.Context, username, publicKey string, encryptedPrivateKey interface{}) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	encPrivKeyStr, err := EncodeEncryptedPrivateKey(encryptedPrivateKey)
 	if err != nil {
-		return fmt.Errorf("error getting rows affected: %v", err)
+		return err
 	}
 
-	if rowsAffected == 0 {
-		// If no rows were updated, create a new user
-		insertQuery := `INSERT INTO users (username, public_key, encrypted_private_key) VALUES ($1, $2, $3)`
-		_, err := db.Exec(insertQuery, username, publicKey, encPrivKeyStr)
+	query := `INSERT INTO users (username, public_key, encrypted_private_key, key_activated_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP) ON CONFLICT (username) DO NOTHING`
+	defer accountCache.invalidate(username)
+	err = withTx(ctx, "CreateUserWithKeys", func(ctx context.Context, tx *sql.Tx) error {
+		if err := checkKeyFree(ctx, tx, username, publicKey); err != nil {
+			return err
+		}
+		result, err := tx.ExecContext(ctx, query, username, publicKey, encPrivKeyStr)
+		if isKeyConflict(err) {
+			return ErrKeyInUse
+		}
 		if err != nil {
-			return fmt.Errorf("failed to create user during key update: %v", err)
+			return fmt.Errorf("failed to insert user: %w", err)
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return fmt.Errorf("error getting rows affected: %w", err)
+		} else if n == 0 {
+			return ErrUsernameTaken
 		}
-		log.Printf("✅ Created new user '%s' during key update", username)
 		return nil
+	})
+	if errors.Is(err, ErrUsernameTaken) || errors.Is(err, ErrKeyInUse) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create user: %v", err)
 	}
 
-	log.Printf("✅ Updated keys for user '%s'", username)
+	logger.Info(ctx, "created user from backup", "username", username)
 	return nil
 }
 
+// EncodeEncryptedPrivateKey converts a client-supplied encrypted private key
+// (either a string or a JSON object) into its stored string form
+func EncodeEncryptedPrivateKey(encryptedPrivateKey interface{}) (string, error) {
+	switch v := encryptedPrivateKey.(type) {
+	case string:
+		return v, nil
+	case map[string]interface{}:
+		jsonBytes, err := json.Marshal(v)
+		if err != nil {
+			return "", fmt.Errorf("failed to marshal encrypted private key: %v", err)
+		}
+		return string(jsonBytes), nil
+	default:
+		return "", errors.New("invalid encrypted private key format")
+	}
+}
+
 // DeleteUser removes a user from the database
-func DeleteUser(username string) error {
+func DeleteUser(ctx context.Context, username string) error {
 	if db == nil {
 		return errors.New("database connection not initialized")
 	}
 
 	query := `DELETE FROM users WHERE username = $1`
-	result, err := db.Exec(query, username)
+	defer accountCache.invalidate(username)
+	var result sql.Result
+	err := withRetry(ctx, "DeleteUser", func(ctx context.Context) error {
+		var err error
+		result, err = db.ExecContext(ctx, query, username)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("failed to delete user: %v", err)
 	}
@@ -173,19 +350,107 @@ func DeleteUser(username string) error {
 		return fmt.Errorf("user '%s' not found for deletion", username)
 	}
 
-	log.Printf("✅ Deleted user '%s'", username)
+	logger.Info(ctx, "deleted user", "username", username)
 	return nil
 }
 
-// UserExists checks if a username already exists in the database
-func UserExists(username string) (bool, error) {
+// AccountDeletion summarizes what DeleteUserCascade removed
+type AccountDeletion struct {
+	KeyHistory      int64 `json:"key_history"`
+	Prekeys         int64 `json:"prekeys"`
+	Sessions        int64 `json:"sessions"`
+	Contacts        int64 `json:"contacts"`
+	IndexedMessages int64 `json:"indexed_messages"`
+	StoredBackups   int64 `json:"stored_backups"`
+	BlockedKeys     int64 `json:"blocked_keys"`
+}
+
+// DeleteUserCascade removes an account and every row that belongs to it in one transaction:
+// key history, prekeys, sessions, aliases, contacts, stored idempotent responses, webhooks,
+// the change log, stored backup records, the blocklist, the discovery opt-in and the
+// message index entries of recipientHashes.
+// All tokens issued to the username so far are revoked.
+func DeleteUserCascade(ctx context.Context, username string, recipientHashes []string) (*AccountDeletion, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var summary AccountDeletion
+	defer accountCache.invalidate(username)
+	err := withTx(ctx, "DeleteUserCascade", func(ctx context.Context, tx *sql.Tx) error {
+		summary = AccountDeletion{}
+
+		result, err := tx.ExecContext(ctx, `DELETE FROM users WHERE username = $1`, username)
+		if err != nil {
+			return fmt.Errorf("failed to delete user: %w", err)
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return fmt.Errorf("error getting rows affected: %w", err)
+		} else if n == 0 {
+			return ErrUserNotFound
+		}
+
+		deletes := []struct {
+			query string
+			args  []interface{}
+			count *int64
+		}{
+			{`DELETE FROM user_key_history WHERE username = $1`, []interface{}{username}, &summary.KeyHistory},
+			{`DELETE FROM prekeys WHERE username = $1`, []interface{}{username}, &summary.Prekeys},
+			{`DELETE FROM signed_prekeys WHERE username = $1`, []interface{}{username}, nil},
+			{`DELETE FROM session_blobs WHERE username = $1`, []interface{}{username}, &summary.Sessions},
+			{`DELETE FROM user_aliases WHERE username = $1 OR alias = $1`, []interface{}{username}, nil},
+			{`DELETE FROM contacts WHERE owner = $1`, []interface{}{username}, &summary.Contacts},
+			{`DELETE FROM message_index WHERE recipient_hash = ANY($1)`, []interface{}{pq.Array(recipientHashes)}, &summary.IndexedMessages},
+			{`DELETE FROM idempotency_keys WHERE scope = $1`, []interface{}{username}, nil},
+			{`DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id::STRING FROM webhooks WHERE username = $1)`, []interface{}{username}, nil},
+			{`DELETE FROM webhooks WHERE username = $1`, []interface{}{username}, nil},
+			{`DELETE FROM account_changes WHERE username = $1`, []interface{}{username}, nil},
+			{`DELETE FROM stored_backups WHERE username = $1`, []interface{}{username}, &summary.StoredBackups},
+			{`DELETE FROM blocked_keys WHERE username = $1`, []interface{}{username}, &summary.BlockedKeys},
+			{`DELETE FROM discovery_identities WHERE username = $1`, []interface{}{username}, nil},
+		}
+		for _, d := range deletes {
+			result, err := tx.ExecContext(ctx, d.query, d.args...)
+			if err != nil {
+				return fmt.Errorf("failed to delete account data: %w", err)
+			}
+			if d.count != nil {
+				*d.count, _ = result.RowsAffected()
+			}
+		}
+
+		if err := revokeTokens(ctx, tx, username); err != nil {
+			return fmt.Errorf("failed to revoke tokens: %w", err)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("account deletion failed: %v", err)
+	}
+
+	logger.Info(ctx, "deleted user and associated records", "username", username)
+	return &summary, nil
+}
+
+// UserExists checks if a username already exists in the database.
+// Former usernames kept as aliases count as taken.
+func UserExists(ctx context.Context, username string) (bool, error) {
 	if db == nil {
 		return false, errors.New("database connection not initialized")
 	}
 
 	var exists bool
-	query := `SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)`
-	err := db.QueryRow(query, username).Scan(&exists)
+	err := withRetry(ctx, "UserExists", func(ctx context.Context) error {
+		stmt, err := prepared(ctx, userExistsQuery)
+		if err != nil {
+			return err
+		}
+		return stmt.QueryRowContext(ctx, username).Scan(&exists)
+	})
 	if err != nil {
 		return false, fmt.Errorf("error checking if user exists: %v", err)
 	}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// userCache keeps recently used accounts in process, by username and by public key, so
+// that authenticated requests don't each look their account up in the database. Writes
+// made through this package invalidate the entries of the account they change; those
+// made by other processes and capacitors are seen once the entries expire, which bounds
+// how stale an account can be.
+type userCache struct {
+	mu         sync.Mutex
+	size       int
+	ttl        time.Duration
+	order      *list.List               // most recently used first
+	entries    map[string]*list.Element // by cache key, holding *userCacheEntry
+	generation uint64                   // bumped on every invalidation
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// userCacheEntry is a cached account
+type userCacheEntry struct {
+	key     string
+	user    User
+	expires time.Time
+}
+
+// UserCacheStats describes the user cache
+type UserCacheStats struct {
+	Entries int   `json:"entries"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+// accountCache is configured by SetDBOptions; nil disables caching
+var accountCache *userCache
+
+// newUserCache returns a cache of up to size accounts kept for ttl, or nil when either
+// is not positive
+func newUserCache(size int, ttl time.Duration) *userCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &userCache{size: size, ttl: ttl, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// userKey and publicKeyKey are the cache keys of the two lookups; a public key may be a
+// retired one, still resolving to its owner
+func userKey(username string) string       { return "u:" + username }
+func publicKeyKey(publicKey string) string { return "k:" + publicKey }
+
+// get returns a copy of the cached account under key, and the generation a lookup
+// filling the cache after a miss has to pass to put
+func (c *userCache) get(key string) (*User, uint64) {
+	if c == nil {
+		return nil, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*userCacheEntry)
+		if time.Now().Before(entry.expires) {
+			c.order.MoveToFront(element)
+			c.hits.Add(1)
+			user := entry.user
+			return &user, c.generation
+		}
+		c.remove(element)
+	}
+	c.misses.Add(1)
+	return nil, c.generation
+}
+
+// put caches an account under key, unless an invalidation happened since the lookup
+// started at generation, which may have read the account before it changed
+func (c *userCache) put(key string, user *User, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&userCacheEntry{key: key, user: *user, expires: time.Now().Add(c.ttl)})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidate drops every entry of the accounts named, whichever lookup cached them.
+// Accounts change rarely, so this walks the whole cache rather than keeping an index.
+func (c *userCache) invalidate(usernames ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		for _, username := range usernames {
+			if element.Value.(*userCacheEntry).user.Username == username {
+				c.remove(element)
+				break
+			}
+		}
+		element = next
+	}
+}
+
+// remove drops an entry; the caller holds mu
+func (c *userCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*userCacheEntry).key)
+}
+
+// GetUserCacheStats returns the size and hit counts of the user cache; zero when it is off
+func GetUserCacheStats() UserCacheStats {
+	if accountCache == nil {
+		return UserCacheStats{}
+	}
+	accountCache.mu.Lock()
+	entries := accountCache.order.Len()
+	accountCache.mu.Unlock()
+	return UserCacheStats{Entries: entries, Hits: accountCache.hits.Load(), Misses: accountCache.misses.Load()}
+}
@@ -0,0 +1,203 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DeploymentWebhookID identifies the node-wide webhook endpoint in the delivery log
+const DeploymentWebhookID = "deployment"
+
+// ErrWebhookNotFound is returned when no webhook of the user has the given ID
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// Webhook is an endpoint a user registered for event notifications
+type Webhook struct {
+	ID        string    `json:"id"`
+	Username  string    `json:"-"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"-"`
+	Events    []string  `json:"events"` // empty subscribes to all events
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Subscribed reports whether the webhook receives events of the given type
+func (w *Webhook) Subscribed(eventType string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, event := range w.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery records one attempt to deliver an event
+type WebhookDelivery struct {
+	WebhookID  string    `json:"-"`
+	EventID    string    `json:"event_id"`
+	EventType  string    `json:"event_type"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"` // 0 when no response was received
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// CreateWebhook stores a new webhook; ID, Username, URL and Secret must be set
+func CreateWebhook(ctx context.Context, hook *Webhook) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+	if hook.Events == nil {
+		hook.Events = []string{}
+	}
+
+	query := `INSERT INTO webhooks (id, username, url, secret, events) VALUES ($1, $2, $3, $4, $5) RETURNING created_at`
+	err := withWriteRetry(ctx, "CreateWebhook", func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, hook.ID, hook.Username, hook.URL, hook.Secret, pq.Array(hook.Events)).Scan(&hook.CreatedAt)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create webhook: %v", err)
+	}
+	return nil
+}
+
+// ListWebhooks returns the user's webhooks, oldest first
+func ListWebhooks(ctx context.Context, username string) ([]Webhook, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var hooks []Webhook
+	query := `SELECT id, url, secret, events, created_at FROM webhooks WHERE username = $1 ORDER BY created_at, id`
+	err := withRetry(ctx, "ListWebhooks", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query, username)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		hooks = []Webhook{}
+		for rows.Next() {
+			hook := Webhook{Username: username}
+			if err := rows.Scan(&hook.ID, &hook.URL, &hook.Secret, pq.Array(&hook.Events), &hook.CreatedAt); err != nil {
+				return err
+			}
+			hooks = append(hooks, hook)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing webhooks: %v", err)
+	}
+	return hooks, nil
+}
+
+// DeleteWebhook removes one of the user's webhooks together with its delivery log
+func DeleteWebhook(ctx context.Context, username, id string) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	err := withTx(ctx, "DeleteWebhook", func(ctx context.Context, tx *sql.Tx) error {
+		result, err := tx.ExecContext(ctx, `DELETE FROM webhooks WHERE username = $1 AND id::STRING = $2`, username, id)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrWebhookNotFound
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE webhook_id = $1`, id)
+		return err
+	})
+	if errors.Is(err, ErrWebhookNotFound) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %v", err)
+	}
+	return nil
+}
+
+// RecordWebhookDelivery appends an attempt to the delivery log
+func RecordWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	if db == nil {
+		return errors.New("database connection not initialized")
+	}
+
+	query := `INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, attempt, status_code, error, duration_ms)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	err := withWriteRetry(ctx, "RecordWebhookDelivery", func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, query, delivery.WebhookID, delivery.EventID, delivery.EventType,
+			delivery.Attempt, delivery.StatusCode, delivery.Error, delivery.DurationMs)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record webhook delivery: %v", err)
+	}
+	return nil
+}
+
+// ListWebhookDeliveries returns the latest delivery attempts of a webhook, newest first
+func ListWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]WebhookDelivery, error) {
+	if db == nil {
+		return nil, errors.New("database connection not initialized")
+	}
+
+	var deliveries []WebhookDelivery
+	query := `SELECT event_id, event_type, attempt, status_code, error, duration_ms, created_at
+		FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY created_at DESC LIMIT $2`
+	err := withRetry(ctx, "ListWebhookDeliveries", func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query, webhookID, limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		deliveries = []WebhookDelivery{}
+		for rows.Next() {
+			delivery := WebhookDelivery{WebhookID: webhookID}
+			if err := rows.Scan(&delivery.EventID, &delivery.EventType, &delivery.Attempt, &delivery.StatusCode,
+				&delivery.Error, &delivery.DurationMs, &delivery.CreatedAt); err != nil {
+				return err
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing webhook deliveries: %v", err)
+	}
+	return deliveries, nil
+}
+
+// PurgeWebhookDeliveries deletes delivery log entries older than before and returns how many were removed
+func PurgeWebhookDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	if db == nil {
+		return 0, errors.New("database connection not initialized")
+	}
+
+	var purged int64
+	err := withRetry(ctx, "PurgeWebhookDeliveries", func(ctx context.Context) error {
+		result, err := db.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE created_at < $1`, before.UTC())
+		if err != nil {
+			return err
+		}
+		purged, _ = result.RowsAffected()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error purging webhook deliveries: %v", err)
+	}
+	return purged, nil
+}
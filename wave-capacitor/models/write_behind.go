@@ -0,0 +1,175 @@
+package models
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Updates that don't have to be in the database before the request making them is
+// answered, such as when an account was last seen, are written behind: collected in
+// process and written every DBOptions.WriteBehindInterval, each kind in multi-row
+// statements. Updates of the same key are coalesced, the latest one winning, so an
+// account active on every request costs one row per interval. They are lost when the
+// process dies before writing them, which is why only updates that can be are batched.
+
+// writeBatchRows caps the rows of one statement, keeping each write transaction small
+const writeBatchRows = 500
+
+// writeBatch collects the pending updates of one kind
+type writeBatch struct {
+	name  string
+	write func(ctx context.Context, keys []string, values []interface{}) error
+
+	mu      sync.Mutex
+	pending map[string]interface{} // latest value by key
+
+	written atomic.Int64
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+// WriteBatchStats describes one kind of written-behind updates
+type WriteBatchStats struct {
+	Name    string `json:"name"`
+	Pending int    `json:"pending"`
+	Written int64  `json:"written"`
+	Dropped int64  `json:"dropped"`
+	Failed  int64  `json:"failed"`
+}
+
+// writeBatches lists every kind of written-behind updates
+var writeBatches []*writeBatch
+
+// newWriteBatch registers a kind of updates, written by write; it is called at init
+func newWriteBatch(name string, write func(ctx context.Context, keys []string, values []interface{}) error) *writeBatch {
+	batch := &writeBatch{name: name, write: write, pending: make(map[string]interface{})}
+	writeBatches = append(writeBatches, batch)
+	return batch
+}
+
+// add queues an update, replacing a pending one of the same key. Once
+// DBOptions.WriteBehindMaxPending keys are pending, updates of new keys are dropped:
+// the database is not keeping up, and these updates are the ones that can wait.
+func (b *writeBatch) add(key string, value interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.pending[key]; !ok && len(b.pending) >= dbOptions.WriteBehindMaxPending {
+		b.dropped.Add(1)
+		return
+	}
+	b.pending[key] = value
+}
+
+// flush writes the pending updates. Rows of a failed statement are queued again unless
+// a newer update of their key arrived meanwhile.
+func (b *writeBatch) flush(ctx context.Context) {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = make(map[string]interface{})
+	b.mu.Unlock()
+	if len(pending) == 0 || db == nil {
+		b.requeue(pending)
+		return
+	}
+
+	// Rows are written in key order so that concurrent flushes of several capacitors
+	// touch them in the same order
+	keys := make([]string, 0, len(pending))
+	for key := range pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for start := 0; start < len(keys); start += writeBatchRows {
+		chunk := keys[start:min(start+writeBatchRows, len(keys))]
+		values := make([]interface{}, len(chunk))
+		for i, key := range chunk {
+			values[i] = pending[key]
+		}
+		if err := b.write(ctx, chunk, values); err != nil {
+			logger.Warn(ctx, "writing batched updates failed", "kind", b.name, "rows", len(chunk), "error", err)
+			b.failed.Add(int64(len(chunk)))
+			requeue := make(map[string]interface{}, len(chunk))
+			for i, key := range chunk {
+				requeue[key] = values[i]
+			}
+			b.requeue(requeue)
+			continue
+		}
+		b.written.Add(int64(len(chunk)))
+	}
+}
+
+// requeue puts back updates that weren't written, as far as the queue has room
+func (b *writeBatch) requeue(updates map[string]interface{}) {
+	if len(updates) == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, value := range updates {
+		if _, ok := b.pending[key]; ok {
+			continue
+		}
+		if len(b.pending) >= dbOptions.WriteBehindMaxPending {
+			b.dropped.Add(1)
+			continue
+		}
+		b.pending[key] = value
+	}
+}
+
+// stats describes the batch
+func (b *writeBatch) stats() WriteBatchStats {
+	b.mu.Lock()
+	pending := len(b.pending)
+	b.mu.Unlock()
+	return WriteBatchStats{Name: b.name, Pending: pending, Written: b.written.Load(), Dropped: b.dropped.Load(), Failed: b.failed.Load()}
+}
+
+// flushWrites writes the pending updates of every kind
+func flushWrites(ctx context.Context) {
+	for _, batch := range writeBatches {
+		batch.flush(ctx)
+	}
+}
+
+// StartWriteBehind writes the queued updates every DBOptions.WriteBehindInterval until
+// the returned function is called, which writes the last ones. Every process serving
+// requests runs it, prefork children included, as each queues its own updates.
+func StartWriteBehind() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(dbOptions.WriteBehindInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				flushWrites(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-stopped
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		flushWrites(flushCtx)
+	}
+}
+
+// GetWriteBehindStats describes the updates of each kind written behind
+func GetWriteBehindStats() []WriteBatchStats {
+	stats := make([]WriteBatchStats, 0, len(writeBatches))
+	for _, batch := range writeBatches {
+		stats = append(stats, batch.stats())
+	}
+	return stats
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"wave_capacitor/config"
+	"wave_capacitor/models"
+	"wave_capacitor/storage"
+	"wave_capacitor/version"
+)
+
+// Format and version of node backups; the version changes when an entry is removed or
+// changes meaning
+const (
+	nodeBackupFormat  = "wave-node-backup"
+	nodeBackupVersion = 1
+)
+
+// nodeBackupNotes are stored in every node backup's manifest for whoever restores it
+var nodeBackupNotes = []string{
+	"Database tables are read at the consistency point; folders are copied after it, so messages stored meanwhile are in the folders but not the index until node-restore reindexes them",
+	"Stop the node before the backup to leave nothing between the consistency point and the folder copy",
+	"Secrets are not included: restore with the same master key, JWT secret and confusion salt, or stored messages and contacts can't be read",
+	"The DHT identity is generated at every start and the DHT store is held in memory, so only the DHT storage folder is kept",
+}
+
+// nodeBackupManifest is manifest.json, the first entry of a node backup
+type nodeBackupManifest struct {
+	Format           string           `json:"format"`
+	Version          int              `json:"version"`
+	CreatedAt        time.Time        `json:"created_at"`
+	Node             version.Info     `json:"node"`
+	SchemaVersion    int              `json:"schema_version"`
+	ConsistencyPoint string           `json:"consistency_point"` // cluster timestamp the tables are read at
+	Tables           []string         `json:"tables"`
+	Folders          []string         `json:"folders"`
+	Config           []config.Setting `json:"config"` // secrets redacted
+	Notes            []string         `json:"notes"`
+}
+
+// nodeBackupSummary is summary.json, the last entry of a node backup; an archive without
+// it was cut short
+type nodeBackupSummary struct {
+	Rows            map[string]int64 `json:"rows"`
+	Files           int              `json:"files"`
+	Bytes           int64            `json:"bytes"`
+	FilesStartedAt  time.Time        `json:"files_started_at"`
+	FilesFinishedAt time.Time        `json:"files_finished_at"`
+	SkippedFiles    []string         `json:"skipped_files,omitempty"`
+	FinishedAt      time.Time        `json:"finished_at"`
+}
+
+// nodeFolder is a folder of the node copied into backups as folders/<name>/...; restores
+// write it to the restoring node's configured path, which may differ
+type nodeFolder struct {
+	name string
+	path string
+}
+
+// nodeFolders lists the folders of a node backup: every shard of the message store,
+// contacts files, keys, certificates, configuration, the DHT's storage and the backups
+// users stored
+func nodeFolders(cfg *config.Config, dhtConfig *config.DHTConfig) []nodeFolder {
+	return []nodeFolder{
+		{"messages", config.MessagesDir},
+		{"contacts", config.ContactsDir},
+		{"keys", config.KeysDir},
+		{"certs", config.CertsDir},
+		{"config", config.ConfigDir},
+		{"dht", dhtConfig.StoragePath},
+		{"stored_backups", cfg.StoredBackupDir},
+	}
+}
+
+// runNodeBackup writes the whole node to one archive: every table read at a single
+// consistency point, the node's folders and a snapshot of its configuration. The
+// archive is only created under its name once it is complete.
+func runNodeBackup(cfg *config.Config, args []string) {
+	flags := commandFlags("node-backup")
+	out := flags.String("out", "", "Output file (default <data-dir>/backups/node-<time>.tar.gz)")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if *out == "" {
+		*out = filepath.Join(config.DataDir, "backups", "node-"+time.Now().UTC().Format("20060102-150405")+".tar.gz")
+	}
+	if err := os.MkdirAll(filepath.Dir(*out), 0700); err != nil {
+		log.Fatalf("❌ Failed to create backup directory: %v", err)
+	}
+	if cfg.StorageBackend != "file" {
+		log.Printf("⚠️ Messages of the %s storage backend are not in the message folders and are not backed up", cfg.StorageBackend)
+	}
+	if cfg.ColdStorageBackend != "" {
+		log.Printf("⚠️ Messages moved to %s cold storage are not backed up", cfg.ColdStorageBackend)
+	}
+
+	if err := models.ConnectDB(); err != nil {
+		log.Fatalf("❌ Database connection failed: %v", err)
+	}
+	ctx := context.Background()
+	schemaVersion, _, err := models.SchemaVersion(ctx)
+	if err != nil {
+		log.Fatalf("❌ Failed to read the schema version: %v", err)
+	}
+	tables, err := models.DumpableTables(ctx)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	asOf, err := models.ClusterTimestamp(ctx)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	folders := nodeFolders(cfg, config.LoadDHTConfig())
+	manifest := nodeBackupManifest{
+		Format:           nodeBackupFormat,
+		Version:          nodeBackupVersion,
+		CreatedAt:        time.Now().UTC(),
+		Node:             version.Get(),
+		SchemaVersion:    schemaVersion,
+		ConsistencyPoint: asOf,
+		Tables:           tables,
+		Config:           cfg.Effective(),
+		Notes:            nodeBackupNotes,
+	}
+	for _, folder := range folders {
+		manifest.Folders = append(manifest.Folders, folder.name)
+	}
+
+	file, err := os.OpenFile(*out+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	defer os.Remove(*out + ".tmp")
+	summary, err := writeNodeBackup(ctx, file, manifest, folders)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(*out + ".tmp")
+		log.Fatalf("❌ Node backup failed: %v", err)
+	}
+	if err := os.Rename(*out+".tmp", *out); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	var rows int64
+	for _, count := range summary.Rows {
+		rows += count
+	}
+	for _, name := range summary.SkippedFiles {
+		log.Printf("⚠️ Skipped %s", name)
+	}
+	log.Printf("✅ Backed up %d rows of %d tables as of %s and %d files (%d bytes) to %s",
+		rows, len(tables), asOf, summary.Files, summary.Bytes, *out)
+}
+
+// writeNodeBackup writes the gzipped tar archive: manifest.json, db/<table>.ndjson per
+// table, the folders' files and summary.json
+func writeNodeBackup(ctx context.Context, w io.Writer, manifest nodeBackupManifest, folders []nodeFolder) (*nodeBackupSummary, error) {
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+	summary := &nodeBackupSummary{Rows: make(map[string]int64, len(manifest.Tables))}
+
+	if err := writeTarJSON(archive, "manifest.json", manifest); err != nil {
+		return nil, err
+	}
+
+	// tar needs each entry's size up front, so tables are dumped to a scratch file first
+	scratch, err := os.CreateTemp("", "node-backup-*.ndjson")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(scratch.Name())
+	defer scratch.Close()
+	for _, table := range manifest.Tables {
+		if err := scratch.Truncate(0); err != nil {
+			return nil, err
+		}
+		if _, err := scratch.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		rows, err := models.DumpTable(ctx, scratch, table, manifest.ConsistencyPoint)
+		if err != nil {
+			return nil, err
+		}
+		size, err := scratch.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := scratch.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		header := &tar.Header{Name: "db/" + table + ".ndjson", Mode: 0600, Size: size, ModTime: manifest.CreatedAt}
+		if err := archive.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(archive, scratch, size); err != nil {
+			return nil, err
+		}
+		summary.Rows[table] = rows
+	}
+
+	summary.FilesStartedAt = time.Now().UTC()
+	for _, folder := range folders {
+		if err := writeNodeFolder(archive, folder, summary); err != nil {
+			return nil, fmt.Errorf("%s folder: %v", folder.name, err)
+		}
+	}
+	summary.FilesFinishedAt = time.Now().UTC()
+	summary.FinishedAt = summary.FilesFinishedAt
+
+	if err := writeTarJSON(archive, "summary.json", summary); err != nil {
+		return nil, err
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	if err := compressed.Close(); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// nodeFileBufferSize is the largest file copied into a node backup through a pooled
+// buffer; larger ones are streamed from the open file
+const nodeFileBufferSize = 1024 * 1024
+
+// writeNodeFolder copies the regular files of one folder into the archive. Files up to
+// nodeFileBufferSize are read whole, so one being written while copied is either before
+// or after the write; larger ones are streamed at the size they had when opened. Files
+// removed meanwhile and anything that isn't a regular file are skipped.
+func writeNodeFolder(archive *tar.Writer, folder nodeFolder, summary *nodeBackupSummary) error {
+	err := filepath.WalkDir(folder.path, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		rel, err := filepath.Rel(folder.path, name)
+		if err != nil {
+			return err
+		}
+		entryName := path.Join("folders", folder.name, filepath.ToSlash(rel))
+		if entry.IsDir() {
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			summary.SkippedFiles = append(summary.SkippedFiles, entryName)
+			return nil
+		}
+
+		size, err := writeNodeFile(archive, name, entryName)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		summary.Files++
+		summary.Bytes += size
+		return nil
+	})
+	return err
+}
+
+// writeNodeFile adds one file to the archive under entryName, returning its size
+func writeNodeFile(archive *tar.Writer, name, entryName string) (int64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	header := &tar.Header{Name: entryName, Mode: int64(info.Mode().Perm()), Size: info.Size(), ModTime: info.ModTime()}
+
+	if info.Size() > nodeFileBufferSize {
+		if err := archive.WriteHeader(header); err != nil {
+			return 0, err
+		}
+		if _, err := io.CopyN(archive, file, info.Size()); err != nil {
+			return 0, fmt.Errorf("copying %s: %w", name, err)
+		}
+		return info.Size(), nil
+	}
+
+	pooled, err := storage.ReadAllPooled(file, nodeFileBufferSize)
+	if err != nil {
+		return 0, err
+	}
+	defer pooled.Release()
+	data := pooled.Bytes()
+	header.Size = int64(len(data))
+	if err := archive.WriteHeader(header); err != nil {
+		return 0, err
+	}
+	if _, err := archive.Write(data); err != nil {
+		return 0, err
+	}
+	return header.Size, nil
+}
+
+// writeTarJSON adds an indented JSON entry to the archive
+func writeTarJSON(archive *tar.Writer, name string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: time.Now().UTC()}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = archive.Write(data)
+	return err
+}
+
+// runNodeRestore rebuilds a node from a node-backup archive: it migrates the database,
+// upserts every table, writes the folders to this node's configured paths and reindexes
+// the messages. It refuses to restore over a node holding accounts or messages unless
+// --force is given, and a backup taken with a newer schema than this binary knows.
+func runNodeRestore(cfg *config.Config, args []string) {
+	flags := commandFlags("node-restore")
+	force := flags.Bool("force", false, "Restore over a node that already holds accounts or messages")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	defer file.Close()
+	compressed, err := gzip.NewReader(file)
+	if err != nil {
+		log.Fatalf("❌ %s is not a node backup: %v", flags.Arg(0), err)
+	}
+	archive := tar.NewReader(compressed)
+
+	var manifest nodeBackupManifest
+	header, err := archive.Next()
+	if err != nil || header.Name != "manifest.json" {
+		log.Fatalf("❌ %s is not a node backup: it doesn't start with manifest.json", flags.Arg(0))
+	}
+	if err := json.NewDecoder(archive).Decode(&manifest); err != nil {
+		log.Fatalf("❌ Unreadable manifest: %v", err)
+	}
+	if manifest.Format != nodeBackupFormat || manifest.Version != nodeBackupVersion {
+		log.Fatalf("❌ Unsupported backup format %s version %d", manifest.Format, manifest.Version)
+	}
+	log.Printf("⏳ Restoring the backup of %s taken with %s at consistency point %s",
+		manifest.CreatedAt.Format(time.RFC3339), manifest.Node.Version, manifest.ConsistencyPoint)
+
+	if err := models.ConnectDB(); err != nil {
+		log.Fatalf("❌ Database connection failed: %v", err)
+	}
+	ctx := context.Background()
+	_, known, err := models.SchemaVersion(ctx)
+	if err != nil {
+		log.Fatalf("❌ Failed to read the schema version: %v", err)
+	}
+	if manifest.SchemaVersion > known {
+		log.Fatalf("❌ The backup has schema version %d, this binary only knows up to %d; restore with a newer release", manifest.SchemaVersion, known)
+	}
+	if _, err := models.Migrate(ctx); err != nil {
+		log.Fatalf("❌ Schema migration failed: %v", err)
+	}
+
+	if !*force {
+		hasUsers, err := models.TableHasRows(ctx, "users")
+		if err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		entries, err := os.ReadDir(config.MessagesDir)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Fatalf("❌ %v", err)
+		}
+		if hasUsers || len(entries) > 0 {
+			log.Fatalf("❌ This node already holds accounts or messages; pass --force to restore over them")
+		}
+	}
+
+	folders := make(map[string]string)
+	for _, folder := range nodeFolders(cfg, config.LoadDHTConfig()) {
+		folders[folder.name] = folder.path
+	}
+	tables := make(map[string]bool, len(manifest.Tables))
+	for _, table := range manifest.Tables {
+		tables[table] = true
+	}
+
+	restored := &nodeBackupSummary{Rows: make(map[string]int64)}
+	var summary *nodeBackupSummary
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("❌ Archive is damaged after %d files: %v", restored.Files, err)
+		}
+
+		switch name := header.Name; {
+		case name == "summary.json":
+			if err := json.NewDecoder(archive).Decode(&summary); err != nil {
+				log.Fatalf("❌ Unreadable summary: %v", err)
+			}
+		case strings.HasPrefix(name, "db/"):
+			table := strings.TrimSuffix(strings.TrimPrefix(name, "db/"), ".ndjson")
+			if !tables[table] {
+				log.Fatalf("❌ %s is not a table of the manifest", name)
+			}
+			rows, err := models.RestoreTable(ctx, archive, table)
+			if err != nil {
+				log.Fatalf("❌ %v", err)
+			}
+			restored.Rows[table] = rows
+			log.Printf("✅ Restored %d rows of %s", rows, table)
+		case strings.HasPrefix(name, "folders/"):
+			folder, rel, _ := strings.Cut(strings.TrimPrefix(name, "folders/"), "/")
+			dir, ok := folders[folder]
+			if !ok || !filepath.IsLocal(rel) || header.Typeflag != tar.TypeReg {
+				log.Printf("⚠️ Skipping %s", name)
+				continue
+			}
+			if err := restoreNodeFile(filepath.Join(dir, filepath.FromSlash(rel)), archive, header); err != nil {
+				log.Fatalf("❌ %s: %v", name, err)
+			}
+			restored.Files++
+			restored.Bytes += header.Size
+		default:
+			log.Printf("⚠️ Skipping unknown entry %s", name)
+		}
+	}
+
+	if summary == nil {
+		log.Fatalf("❌ The archive has no summary.json, it was cut short; restore from a complete backup")
+	}
+	for table, rows := range summary.Rows {
+		if restored.Rows[table] != rows {
+			log.Fatalf("❌ %s: restored %d rows, the backup holds %d", table, restored.Rows[table], rows)
+		}
+	}
+	if restored.Files != summary.Files {
+		log.Fatalf("❌ Restored %d files, the backup holds %d", restored.Files, summary.Files)
+	}
+	log.Printf("✅ Restored %d files (%d bytes)", restored.Files, restored.Bytes)
+
+	// The folders were copied after the consistency point, so the index is rebuilt from
+	// the messages actually restored
+	runReindexMessages(cfg)
+	log.Printf("✅ Node restored; start it with the same master key, JWT secret and confusion salt as the backed-up node")
+}
+
+// restoreNodeFile writes one file of the archive, replacing any file at path
+func restoreNodeFile(name string, r io.Reader, header *tar.Header) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.FileMode(header.Mode).Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		file.Close()
+		os.Remove(name + ".tmp")
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	os.Chtimes(name+".tmp", header.ModTime, header.ModTime)
+	return os.Rename(name+".tmp", name)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"wave_capacitor/config"
+	"wave_capacitor/nodeca"
+)
+
+// Default validity of the node CA and of the certificates it issues
+const (
+	nodeCADays   = 3650
+	nodeCertDays = 365
+)
+
+// runNodeCA runs the CA of node-to-node mutual TLS. Issued files are written per node
+// under the CA directory, to be copied to that node's NODE_TLS_DIR; after a revocation
+// the revocation list has to be copied to every node.
+func runNodeCA(cfg *config.Config, args []string) {
+	flags := commandFlags("node-ca")
+	if len(args) == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	action := args[0]
+	dir := flags.String("dir", filepath.Join(config.CertsDir, "node-ca"), "Directory of the CA")
+	days := flags.Int("days", 0, "Validity in days (default 3650 for the CA, 365 for node certificates)")
+	revokePrevious := flags.Bool("revoke-previous", false, "Revoke the node's earlier certificates (rotate only)")
+	flags.Parse(args[1:])
+
+	validity := func(defaultDays int) time.Duration {
+		if *days > 0 {
+			return time.Duration(*days) * 24 * time.Hour
+		}
+		return time.Duration(defaultDays) * 24 * time.Hour
+	}
+
+	if action == "init" {
+		if flags.NArg() != 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+		if _, err := nodeca.Init(*dir, validity(nodeCADays)); err != nil {
+			log.Fatalf("❌ Failed to create the node CA: %v", err)
+		}
+		log.Printf("✅ Created the node CA in %s; keep %s there, off the other nodes", *dir, nodeca.CAKeyFile)
+		return
+	}
+
+	ca, err := nodeca.Open(*dir)
+	if errors.Is(err, nodeca.ErrNoCA) {
+		log.Fatalf("❌ No node CA in %s, create one with node-ca init", *dir)
+	}
+	if err != nil {
+		log.Fatalf("❌ Failed to open the node CA: %v", err)
+	}
+
+	switch {
+	case action == "issue" && flags.NArg() >= 2:
+		name := flags.Arg(0)
+		issued, err := ca.Issue(name, flags.Args()[1:], validity(nodeCertDays))
+		if err != nil {
+			log.Fatalf("❌ Failed to issue a certificate to %s: %v", name, err)
+		}
+		log.Printf("✅ Issued certificate %s to %s for %s, valid until %s", issued.Serial, name, strings.Join(issued.Hosts, ", "), issued.NotAfter.Format(time.RFC3339))
+		log.Printf("   Copy %s to NODE_TLS_DIR on %s", ca.NodeDir(name), name)
+
+	case action == "rotate" && flags.NArg() == 1:
+		name := flags.Arg(0)
+		issued, revoked, err := ca.Rotate(name, validity(nodeCertDays), *revokePrevious)
+		if err != nil {
+			log.Fatalf("❌ Failed to rotate the certificate of %s: %v", name, err)
+		}
+		log.Printf("✅ Issued certificate %s to %s, valid until %s", issued.Serial, name, issued.NotAfter.Format(time.RFC3339))
+		log.Printf("   Copy %s to NODE_TLS_DIR on %s; the node picks it up without a restart", ca.NodeDir(name), name)
+		for _, entry := range revoked {
+			log.Printf("🚫 Revoked certificate %s", entry.Serial)
+		}
+		if len(revoked) > 0 {
+			log.Printf("   Copy %s to NODE_TLS_DIR on every node", nodeca.RevokedFile)
+		}
+
+	case action == "revoke" && flags.NArg() == 1:
+		revoked, err := ca.Revoke(flags.Arg(0))
+		if err != nil {
+			log.Fatalf("❌ Failed to revoke %s: %v", flags.Arg(0), err)
+		}
+		if len(revoked) == 0 {
+			log.Printf("✅ %s was revoked already", flags.Arg(0))
+			return
+		}
+		for _, entry := range revoked {
+			log.Printf("🚫 Revoked certificate %s of %s", entry.Serial, entry.Name)
+		}
+		log.Printf("   Copy %s from %s to NODE_TLS_DIR on every node", nodeca.RevokedFile, *dir)
+
+	case action == "list" && flags.NArg() == 0:
+		issued, err := ca.List()
+		if err != nil {
+			log.Fatalf("❌ Failed to list node certificates: %v", err)
+		}
+		for _, cert := range issued {
+			status := "valid"
+			switch {
+			case cert.Revoked:
+				status = "revoked"
+			case time.Now().After(cert.NotAfter):
+				status = "expired"
+			}
+			log.Printf("%s %s %s until %s (%s)", cert.Serial, cert.Name, status, cert.NotAfter.Format(time.RFC3339), strings.Join(cert.Hosts, ", "))
+		}
+		log.Printf("✅ %d node certificates issued", len(issued))
+
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
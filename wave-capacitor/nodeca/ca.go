@@ -0,0 +1,432 @@
+// Package nodeca is the certificate authority of node-to-node mutual TLS: it issues,
+// rotates and revokes the certificates nodes present to each other, and builds the TLS
+// configurations that require them (see tls.go).
+//
+// The CA lives in one directory, on the machine the operator runs the node-ca command on.
+// Each node gets a copy of the CA certificate, the revocation list and its own certificate
+// and key, which it reloads when they change; only the CA certificate needs a restart.
+package nodeca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// Files of the CA directory; a node's own directory holds CAFile, CertFile, KeyFile and
+// RevokedFile under the same names
+const (
+	CAFile      = "ca.pem"
+	CAKeyFile   = "ca-key.pem"
+	RevokedFile = "revoked.json"
+	IndexFile   = "issued.json"
+	CertFile    = "node.pem"
+	KeyFile     = "node-key.pem"
+
+	// IssuedDir holds, per node name, the files to copy to that node
+	IssuedDir = "issued"
+)
+
+// ErrNoCA is returned when the directory holds no CA yet
+var ErrNoCA = errors.New("no node CA in this directory, run node-ca init first")
+
+// namePattern restricts node names, which name directories, to DNS-like labels
+var namePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]{0,62}[a-z0-9])?$`)
+
+// Issued is a certificate the CA issued
+type Issued struct {
+	Name     string    `json:"name"`
+	Serial   string    `json:"serial"` // hex
+	Hosts    []string  `json:"hosts"`
+	IssuedAt time.Time `json:"issued_at"`
+	NotAfter time.Time `json:"not_after"`
+	Revoked  bool      `json:"revoked,omitempty"` // filled in by List
+}
+
+// Revocation is an entry of the revocation list nodes check peer certificates against
+type Revocation struct {
+	Serial    string    `json:"serial"`
+	Name      string    `json:"name"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// Authority issues node certificates from the CA in dir
+type Authority struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// Init creates a CA valid for validity in dir, refusing to replace an existing one
+func Init(dir string, validity time.Duration) (*Authority, error) {
+	if _, err := os.Stat(filepath.Join(dir, CAKeyFile)); err == nil {
+		return nil, fmt.Errorf("%s already holds a node CA", dir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Wave Capacitor node CA"},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePEM(filepath.Join(dir, CAKeyFile), "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return nil, err
+	}
+	if err := writePEM(filepath.Join(dir, CAFile), "CERTIFICATE", der, 0644); err != nil {
+		return nil, err
+	}
+	return &Authority{dir: dir, cert: cert, key: key}, nil
+}
+
+// Open loads the CA in dir
+func Open(dir string) (*Authority, error) {
+	keyPEM, err := os.ReadFile(filepath.Join(dir, CAKeyFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoCA
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no PEM key", CAKeyFile)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", CAKeyFile, err)
+	}
+	cert, err := readCertificate(filepath.Join(dir, CAFile))
+	if err != nil {
+		return nil, err
+	}
+	return &Authority{dir: dir, cert: cert, key: key}, nil
+}
+
+// NodeDir is where the files of the named node are written
+func (a *Authority) NodeDir(name string) string {
+	return filepath.Join(a.dir, IssuedDir, name)
+}
+
+// Issue issues a certificate to the named node for hosts (DNS names or IP addresses it is
+// reached at) and writes it to NodeDir(name) with its key, the CA certificate and the
+// current revocation list. A certificate the node had before stays valid until revoked.
+func (a *Authority) Issue(name string, hosts []string, validity time.Duration) (Issued, error) {
+	if !namePattern.MatchString(name) {
+		return Issued{}, fmt.Errorf("node name %q must be lowercase letters, digits, dots and dashes", name)
+	}
+	if len(hosts) == 0 {
+		return Issued{}, errors.New("a node certificate needs at least one host")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return Issued{}, err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return Issued{}, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if template.NotAfter.After(a.cert.NotAfter) {
+		template.NotAfter = a.cert.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		return Issued{}, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return Issued{}, err
+	}
+
+	issued := Issued{Name: name, Serial: serialHex(serial), Hosts: hosts, IssuedAt: now.UTC(), NotAfter: template.NotAfter.UTC()}
+	index, err := a.index()
+	if err != nil {
+		return Issued{}, err
+	}
+	if err := writeJSON(filepath.Join(a.dir, IndexFile), append(index, issued)); err != nil {
+		return Issued{}, err
+	}
+
+	dir := a.NodeDir(name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return Issued{}, err
+	}
+	if err := writePEM(filepath.Join(dir, KeyFile), "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return Issued{}, err
+	}
+	if err := writePEM(filepath.Join(dir, CertFile), "CERTIFICATE", der, 0644); err != nil {
+		return Issued{}, err
+	}
+	if err := writePEM(filepath.Join(dir, CAFile), "CERTIFICATE", a.cert.Raw, 0644); err != nil {
+		return Issued{}, err
+	}
+	return issued, a.copyRevocations(dir)
+}
+
+// Rotate issues the named node a new certificate for the hosts of its latest one. With
+// revokePrevious its earlier certificates are revoked, which cuts the node off until the
+// new files are in place.
+func (a *Authority) Rotate(name string, validity time.Duration, revokePrevious bool) (Issued, []Revocation, error) {
+	index, err := a.index()
+	if err != nil {
+		return Issued{}, nil, err
+	}
+	var latest *Issued
+	for i := range index {
+		if index[i].Name == name {
+			latest = &index[i]
+		}
+	}
+	if latest == nil {
+		return Issued{}, nil, fmt.Errorf("no certificate was issued to %s", name)
+	}
+
+	issued, err := a.Issue(name, latest.Hosts, validity)
+	if err != nil || !revokePrevious {
+		return issued, nil, err
+	}
+	var revoked []Revocation
+	for _, previous := range index {
+		if previous.Name != name {
+			continue
+		}
+		entries, err := a.Revoke(previous.Serial)
+		if err != nil {
+			return issued, revoked, err
+		}
+		revoked = append(revoked, entries...)
+	}
+	return issued, revoked, nil
+}
+
+// Revoke revokes the certificate with the given serial, or every certificate of the node
+// with that name, and updates the revocation list of the CA and of every issued node
+// directory. Nodes pick the list up once it is copied to them.
+func (a *Authority) Revoke(nameOrSerial string) ([]Revocation, error) {
+	index, err := a.index()
+	if err != nil {
+		return nil, err
+	}
+	list, err := ReadRevocations(filepath.Join(a.dir, RevokedFile))
+	if err != nil {
+		return nil, err
+	}
+	already := make(map[string]bool, len(list))
+	for _, entry := range list {
+		already[entry.Serial] = true
+	}
+
+	// A serial is matched first, so a node named like a serial can't be revoked by accident
+	var matches []Issued
+	for _, issued := range index {
+		if issued.Serial == nameOrSerial {
+			matches = append(matches, issued)
+		}
+	}
+	if len(matches) == 0 {
+		for _, issued := range index {
+			if issued.Name == nameOrSerial {
+				matches = append(matches, issued)
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no certificate was issued with serial or name %s", nameOrSerial)
+	}
+
+	var revoked []Revocation
+	for _, issued := range matches {
+		if already[issued.Serial] {
+			continue
+		}
+		entry := Revocation{Serial: issued.Serial, Name: issued.Name, RevokedAt: time.Now().UTC()}
+		list = append(list, entry)
+		revoked = append(revoked, entry)
+		already[issued.Serial] = true
+	}
+	if len(revoked) == 0 {
+		return nil, nil
+	}
+
+	if err := writeJSON(filepath.Join(a.dir, RevokedFile), list); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, issued := range index {
+		if !names[issued.Name] {
+			names[issued.Name] = true
+			if err := a.copyRevocations(a.NodeDir(issued.Name)); err != nil {
+				return revoked, err
+			}
+		}
+	}
+	return revoked, nil
+}
+
+// List returns the certificates the CA issued, oldest first
+func (a *Authority) List() ([]Issued, error) {
+	index, err := a.index()
+	if err != nil {
+		return nil, err
+	}
+	list, err := ReadRevocations(filepath.Join(a.dir, RevokedFile))
+	if err != nil {
+		return nil, err
+	}
+	revoked := make(map[string]bool, len(list))
+	for _, entry := range list {
+		revoked[entry.Serial] = true
+	}
+	for i := range index {
+		index[i].Revoked = revoked[index[i].Serial]
+	}
+	return index, nil
+}
+
+// index reads the list of issued certificates
+func (a *Authority) index() ([]Issued, error) {
+	var index []Issued
+	data, err := os.ReadFile(filepath.Join(a.dir, IndexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", IndexFile, err)
+	}
+	return index, nil
+}
+
+// copyRevocations writes the CA's revocation list to a node directory
+func (a *Authority) copyRevocations(dir string) error {
+	list, err := ReadRevocations(filepath.Join(a.dir, RevokedFile))
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		list = []Revocation{}
+	}
+	return writeJSON(filepath.Join(dir, RevokedFile), list)
+}
+
+// ReadRevocations reads a revocation list; a missing file revokes nothing
+func ReadRevocations(path string) ([]Revocation, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []Revocation
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", path, err)
+	}
+	return list, nil
+}
+
+// readCertificate parses the first certificate of a PEM file
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s holds no PEM certificate", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// newSerial returns a random 128-bit certificate serial number
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// serialHex formats a serial number as revocation lists and the index hold it
+func serialHex(serial *big.Int) string {
+	return fmt.Sprintf("%x", serial)
+}
+
+// writePEM writes one PEM block to path through a temporary file, so a node reloading it
+// never reads half of it
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	return writeFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), perm)
+}
+
+// writeJSON writes value to path as indented JSON through a temporary file
+func writeJSON(path string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(path, append(data, '\n'), 0644)
+}
+
+// writeFile replaces path with data atomically
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
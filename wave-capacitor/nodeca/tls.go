@@ -0,0 +1,223 @@
+package nodeca
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"wave_capacitor/logging"
+)
+
+// logger logs reloads of the node certificate and revocation list
+var logger = logging.Component("nodeca")
+
+// reloadInterval is how often the node's files are checked for changes, at most
+const reloadInterval = 10 * time.Second
+
+// Files are where a node finds its certificate, key, the CA and the revocation list
+type Files struct {
+	CA      string
+	Cert    string
+	Key     string
+	Revoked string
+}
+
+// NodeFiles returns the files as an issued node directory copied to dir holds them
+func NodeFiles(dir string) Files {
+	return Files{
+		CA:      filepath.Join(dir, CAFile),
+		Cert:    filepath.Join(dir, CertFile),
+		Key:     filepath.Join(dir, KeyFile),
+		Revoked: filepath.Join(dir, RevokedFile),
+	}
+}
+
+// Identity is a node's part of node-to-node mutual TLS. The certificate and revocation
+// list are reloaded when their files change, so rotating or revoking a certificate takes
+// effect without a restart.
+type Identity struct {
+	files Files
+	roots *x509.CertPool
+
+	mu          sync.Mutex
+	checkedAt   time.Time
+	certModTime time.Time
+	cert        *tls.Certificate
+	listModTime time.Time
+	revoked     map[string]bool
+}
+
+// Load reads the node's files, failing if the certificate or the CA can't be used
+func Load(files Files) (*Identity, error) {
+	ca, err := readCertificate(files.CA)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the node CA: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	id := &Identity{files: files, roots: roots}
+	if err := id.reload(); err != nil {
+		return nil, err
+	}
+	if _, err := id.cert.Leaf.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		return nil, fmt.Errorf("node certificate %s isn't valid under the node CA: %v", files.Cert, err)
+	}
+	return id, nil
+}
+
+// ServerConfig is the TLS configuration of a server only nodes talk to, which requires
+// a valid node certificate from every client
+func (id *Identity) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:            tls.VersionTLS12,
+		GetCertificate:        func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return id.certificate() },
+		ClientAuth:            tls.RequireAndVerifyClientCert,
+		ClientCAs:             id.roots,
+		VerifyPeerCertificate: id.verifyNotRevoked,
+	}
+}
+
+// ClientConfig is the TLS configuration of requests to other nodes: it presents the node
+// certificate and only trusts servers with a valid node certificate
+func (id *Identity) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:            tls.VersionTLS12,
+		RootCAs:               id.roots,
+		GetClientCertificate:  func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return id.certificate() },
+		VerifyPeerCertificate: id.verifyNotRevoked,
+	}
+}
+
+// RequestClientCertificates makes a server that also serves users, with certificates of
+// its own, ask clients for a node certificate without requiring one. Handlers tell node
+// requests apart with PeerName.
+func (id *Identity) RequestClientCertificates(config *tls.Config) {
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	config.ClientCAs = id.roots
+	config.VerifyPeerCertificate = id.verifyNotRevoked
+}
+
+// PeerName returns the name of the node that presented a valid node certificate on the
+// connection, or "" for other clients
+func PeerName(state *tls.ConnectionState) string {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+// NotAfter returns when the node certificate expires
+func (id *Identity) NotAfter() time.Time {
+	cert, err := id.certificate()
+	if err != nil {
+		return time.Time{}
+	}
+	return cert.Leaf.NotAfter
+}
+
+// verifyNotRevoked refuses peer certificates on the revocation list; chains were verified
+// against the node CA already
+func (id *Identity) verifyNotRevoked(_ [][]byte, chains [][]*x509.Certificate) error {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	id.reloadIfChanged()
+
+	for _, chain := range chains {
+		if len(chain) > 0 && id.revoked[serialHex(chain[0].SerialNumber)] {
+			return fmt.Errorf("node certificate %x of %s is revoked", chain[0].SerialNumber, chain[0].Subject.CommonName)
+		}
+	}
+	return nil
+}
+
+// certificate returns the node certificate, reloaded if its files changed
+func (id *Identity) certificate() (*tls.Certificate, error) {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	id.reloadIfChanged()
+
+	if id.cert == nil {
+		return nil, errors.New("no node certificate loaded")
+	}
+	return id.cert, nil
+}
+
+// reload reads the certificate and revocation list unconditionally
+func (id *Identity) reload() error {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+
+	certModTime, listModTime := id.modTimes()
+	cert, err := tls.LoadX509KeyPair(id.files.Cert, id.files.Key)
+	if err != nil {
+		return fmt.Errorf("error loading the node certificate: %v", err)
+	}
+	revoked, err := readRevokedSerials(id.files.Revoked)
+	if err != nil {
+		return err
+	}
+	id.cert, id.certModTime = &cert, certModTime
+	id.revoked, id.listModTime = revoked, listModTime
+	id.checkedAt = time.Now()
+	return nil
+}
+
+// reloadIfChanged reloads the files modified since they were read, at most every
+// reloadInterval. A file that fails to load is logged and the previous one kept.
+// Callers hold id.mu.
+func (id *Identity) reloadIfChanged() {
+	if time.Since(id.checkedAt) < reloadInterval {
+		return
+	}
+	id.checkedAt = time.Now()
+	certModTime, listModTime := id.modTimes()
+
+	if !certModTime.Equal(id.certModTime) {
+		if cert, err := tls.LoadX509KeyPair(id.files.Cert, id.files.Key); err != nil {
+			logger.Warn(context.Background(), "keeping the previous node certificate", "file", id.files.Cert, "error", err)
+		} else {
+			id.cert, id.certModTime = &cert, certModTime
+			logger.Info(context.Background(), "reloaded the node certificate", "file", id.files.Cert, "not_after", cert.Leaf.NotAfter)
+		}
+	}
+	if !listModTime.Equal(id.listModTime) {
+		if revoked, err := readRevokedSerials(id.files.Revoked); err != nil {
+			logger.Warn(context.Background(), "keeping the previous revocation list", "file", id.files.Revoked, "error", err)
+		} else {
+			id.revoked, id.listModTime = revoked, listModTime
+			logger.Info(context.Background(), "reloaded the node revocation list", "file", id.files.Revoked, "revoked", len(revoked))
+		}
+	}
+}
+
+// modTimes returns when the certificate or its key, and the revocation list, last changed
+func (id *Identity) modTimes() (cert, list time.Time) {
+	for _, path := range []string{id.files.Cert, id.files.Key} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(cert) {
+			cert = info.ModTime()
+		}
+	}
+	if info, err := os.Stat(id.files.Revoked); err == nil {
+		list = info.ModTime()
+	}
+	return cert, list
+}
+
+// readRevokedSerials reads the serials of a revocation list
+func readRevokedSerials(path string) (map[string]bool, error) {
+	list, err := ReadRevocations(path)
+	if err != nil {
+		return nil, err
+	}
+	revoked := make(map[string]bool, len(list))
+	for _, entry := range list {
+		revoked[entry.Serial] = true
+	}
+	return revoked, nil
+}
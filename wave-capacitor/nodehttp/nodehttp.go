@@ -0,0 +1,206 @@
+// Package nodehttp holds the HTTP transport of calls to other nodes: DHT lookups,
+// federation, replication, presence and handle lookups share its idle connections
+// rather than each dialing peers anew, and it bounds how many requests run at once
+// against any one peer.
+//
+// Hosts named by users rather than found among the nodes, such as the domains of
+// handles, are reached through a transport of its own that only dials public addresses,
+// so that a user can't make a node call services of its private network.
+package nodehttp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+	"wave_capacitor/tracing"
+)
+
+// ErrNonPublicAddress is returned when the public transport is asked to dial a loopback,
+// private, link-local or otherwise non-public address
+var ErrNonPublicAddress = errors.New("refusing to dial a non-public address")
+
+// sharedAddressSpace is the carrier-grade NAT range, which net.IP.IsPrivate leaves out
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Options tunes the shared transport
+type Options struct {
+	MaxIdleConnsPerHost int           // idle connections kept to each peer
+	DialTimeout         time.Duration // establishing a TCP connection
+	TLSHandshakeTimeout time.Duration
+	IdleConnTimeout     time.Duration // idle connections are closed after this long
+	PeerConcurrency     int           // requests in flight to one peer; 0 is unlimited
+}
+
+// DefaultOptions are used until Configure is called
+var DefaultOptions = Options{
+	MaxIdleConnsPerHost: 32,
+	DialTimeout:         5 * time.Second,
+	TLSHandshakeTimeout: 5 * time.Second,
+	IdleConnTimeout:     90 * time.Second,
+	PeerConcurrency:     16,
+}
+
+var (
+	transport = newTransport(DefaultOptions)
+	limiter   = &peerLimiter{next: transport, limit: DefaultOptions.PeerConcurrency, peers: make(map[string]chan struct{})}
+	shared    = tracing.Transport(limiter)
+
+	publicTransport = newPublicTransport(DefaultOptions)
+	public          = tracing.Transport(&swappable{get: func() http.RoundTripper { return publicTransport }})
+)
+
+// newTransport returns a transport tuned by opts
+func newTransport(opts Options) *http.Transport {
+	dialer := &net.Dialer{Timeout: opts.DialTimeout, KeepAlive: 30 * time.Second}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          max(100, opts.MaxIdleConnsPerHost*4),
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		TLSHandshakeTimeout:   opts.TLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// newPublicTransport returns a transport tuned by opts that only dials public addresses.
+// The check runs on the address dialed, after name resolution, and no proxy is used, as
+// it would dial in the node's stead.
+func newPublicTransport(opts Options) *http.Transport {
+	public := newTransport(opts)
+	dialer := &net.Dialer{Timeout: opts.DialTimeout, KeepAlive: 30 * time.Second, Control: dialPublicOnly}
+	public.Proxy = nil
+	public.DialContext = dialer.DialContext
+	return public
+}
+
+// dialPublicOnly refuses connections to non-public addresses
+func dialPublicOnly(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !PublicAddress(ip) {
+		return fmt.Errorf("%w: %s", ErrNonPublicAddress, host)
+	}
+	return nil
+}
+
+// PublicAddress reports whether ip is routable on the internet: not loopback, private,
+// link-local, multicast, unspecified or carrier-grade NAT
+func PublicAddress(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// Configure applies opts to the shared transport; call it before the first request
+func Configure(opts Options) {
+	tlsConfig := transport.TLSClientConfig
+	transport = newTransport(opts)
+	transport.TLSClientConfig = tlsConfig
+	publicTransport = newPublicTransport(opts)
+	publicTransport.TLSClientConfig = tlsConfig
+	limiter.mu.Lock()
+	limiter.next = transport
+	limiter.limit = opts.PeerConcurrency
+	limiter.peers = make(map[string]chan struct{})
+	limiter.mu.Unlock()
+}
+
+// SetTLS makes calls to other nodes present this node's certificate for mutual TLS;
+// call it before the first request
+func SetTLS(config *tls.Config) {
+	transport.TLSClientConfig = config
+	publicTransport.TLSClientConfig = config
+}
+
+// Transport returns the shared transport, traced and limited per peer
+func Transport() http.RoundTripper {
+	return shared
+}
+
+// NewClient returns a client of the shared transport whose requests time out after
+// timeout; 0 leaves them to their context
+func NewClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: shared}
+}
+
+// NewPublicClient returns a client for hosts named by users, dialing public addresses
+// only, whose requests time out after timeout
+func NewPublicClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: public}
+}
+
+// swappable routes requests to the transport get returns, which Configure may replace
+type swappable struct {
+	get func() http.RoundTripper
+}
+
+func (s *swappable) RoundTrip(req *http.Request) (*http.Response, error) {
+	return s.get().RoundTrip(req)
+}
+
+// peerLimiter holds each request to a peer until fewer than limit others to it are in
+// flight. A request counts until its response body is closed, as the connection serving
+// it is busy until then.
+type peerLimiter struct {
+	mu    sync.Mutex
+	next  http.RoundTripper
+	limit int
+	peers map[string]chan struct{} // slots by host:port
+}
+
+func (l *peerLimiter) RoundTrip(req *http.Request) (*http.Response, error) {
+	next, slots := l.slots(req.URL.Host)
+	if slots == nil {
+		return next.RoundTrip(req)
+	}
+	select {
+	case slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		<-slots
+		return nil, err
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { <-slots }}
+	return resp, nil
+}
+
+// slots returns the transport and the slots of a peer, nil when requests aren't limited
+func (l *peerLimiter) slots(host string) (http.RoundTripper, chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit <= 0 {
+		return l.next, nil
+	}
+	slots, ok := l.peers[host]
+	if !ok {
+		slots = make(chan struct{}, l.limit)
+		l.peers[host] = slots
+	}
+	return l.next, slots
+}
+
+// releasingBody frees the slot of its request once closed
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
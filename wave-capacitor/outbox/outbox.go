@@ -0,0 +1,386 @@
+// Package outbox is a durable queue of items waiting to be sent to other nodes. Each
+// destination has a directory of its own holding one file per item, named so that
+// listing the directory gives the items by priority, then in the order they were queued;
+// an item stays on disk until it is sent or given up on, across restarts.
+package outbox
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"wave_capacitor/storage"
+)
+
+// ErrFull is returned by Enqueue when the items of a destination reach the limits of the queue
+var ErrFull = errors.New("outbox full for destination")
+
+// Limits bound what a destination can have queued, so that a node that can't be reached
+// for long doesn't fill the disk; zero values leave them unbounded
+type Limits struct {
+	MaxDepth int   // items
+	MaxBytes int64 // sum of the item file sizes
+}
+
+// Priority orders the items of a destination; lower values are sent first
+type Priority int
+
+const (
+	PriorityHigh Priority = iota
+	PriorityNormal
+	PriorityLow
+)
+
+// ParsePriority returns the priority named high, normal or low; anything else is normal
+func ParsePriority(name string) Priority {
+	switch name {
+	case "high":
+		return PriorityHigh
+	case "low":
+		return PriorityLow
+	default:
+		return PriorityNormal
+	}
+}
+
+// Item is an entry of the queue
+type Item struct {
+	ID          string          `json:"id"`
+	Destination string          `json:"destination"`
+	Priority    Priority        `json:"priority"`
+	QueuedAt    time.Time       `json:"queued_at"`
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+
+	name string // file name, which orders the item
+}
+
+// Stats describes the items waiting for one destination
+type Stats struct {
+	Destination string    `json:"destination"`
+	Depth       int       `json:"depth"`
+	OldestAt    time.Time `json:"oldest_at,omitzero"`
+}
+
+// Queue is an on-disk queue shared by the processes of a node: items are written to a
+// temporary file and renamed into place, so readers only see complete items.
+type Queue struct {
+	dir       string
+	encryptor *storage.Encryptor // seals items at rest; nil writes them in the clear
+	limits    Limits
+	mu        sync.Mutex // serializes rewrites of items within the process
+}
+
+// Open opens the queue in dir, creating it if needed
+func Open(dir string, encryptor *storage.Encryptor, limits Limits) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating outbox directory: %v", err)
+	}
+	return &Queue{dir: dir, encryptor: encryptor, limits: limits}, nil
+}
+
+// Enqueue adds an item for destination; id only has to be unique within the destination.
+// It returns ErrFull when the destination has as many items or bytes queued as the limits
+// allow. The limits are checked against the disk, which the processes of a node share, so
+// processes enqueueing at the same moment can overshoot them by an item each.
+func (q *Queue) Enqueue(destination string, priority Priority, id string, payload []byte) error {
+	now := time.Now().UTC()
+	item := Item{
+		ID:          id,
+		Destination: destination,
+		Priority:    priority,
+		QueuedAt:    now,
+		Payload:     payload,
+		name:        fmt.Sprintf("%d-%020d-%s.json", priority, now.UnixNano(), hex.EncodeToString([]byte(id))),
+	}
+	if err := q.checkLimits(destination, len(payload)); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(q.destinationDir(destination), 0700); err != nil {
+		return err
+	}
+	return q.write(item)
+}
+
+// checkLimits returns ErrFull when queueing size more bytes for destination would exceed
+// the limits. Items moved from another destination aren't checked, as they were queued
+// already.
+func (q *Queue) checkLimits(destination string, size int) error {
+	if q.limits.MaxDepth <= 0 && q.limits.MaxBytes <= 0 {
+		return nil
+	}
+	depth, bytes, err := q.usage(destination)
+	if err != nil {
+		return err
+	}
+	if q.limits.MaxDepth > 0 && depth >= q.limits.MaxDepth {
+		return fmt.Errorf("%w: %d items queued", ErrFull, depth)
+	}
+	if q.limits.MaxBytes > 0 && bytes+int64(size) > q.limits.MaxBytes {
+		return fmt.Errorf("%w: %d bytes queued", ErrFull, bytes)
+	}
+	return nil
+}
+
+// usage returns the number of items of destination and the sum of their file sizes
+func (q *Queue) usage(destination string) (int, int64, error) {
+	entries, err := os.ReadDir(q.destinationDir(destination))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var depth int
+	var bytes int64
+	for _, entry := range entries {
+		if name := entry.Name(); entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue // Sent since the listing
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		depth++
+		bytes += info.Size()
+	}
+	return depth, bytes, nil
+}
+
+// Destinations returns the destinations that have, or had, items queued
+func (q *Queue) Destinations() ([]string, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var destinations []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		name, err := hex.DecodeString(entry.Name())
+		if err != nil {
+			continue
+		}
+		destinations = append(destinations, string(name))
+	}
+	return destinations, nil
+}
+
+// Pending returns up to limit items of destination in the order they are to be sent.
+// Items that can't be read are skipped until they expire; an error is only returned
+// when none could be read.
+func (q *Queue) Pending(destination string, limit int) ([]Item, error) {
+	names, err := q.itemNames(destination)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > limit {
+		names = names[:limit]
+	}
+
+	items := make([]Item, 0, len(names))
+	var readErr error
+	for _, name := range names {
+		item, err := q.read(destination, name)
+		if err != nil {
+			readErr = err
+			continue
+		}
+		items = append(items, item)
+	}
+	if len(items) == 0 && readErr != nil {
+		return nil, readErr
+	}
+	return items, nil
+}
+
+// Done removes an item that was sent or given up on
+func (q *Queue) Done(item Item) error {
+	err := os.Remove(filepath.Join(q.destinationDir(item.Destination), item.name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Failed records a failed attempt to send an item, which keeps its place in the queue
+func (q *Queue) Failed(item Item, cause error) error {
+	item.Attempts++
+	item.LastError = cause.Error()
+	return q.write(item)
+}
+
+// Move hands an item over to another destination, keeping its place in the order
+func (q *Queue) Move(item Item, destination string) error {
+	moved := item
+	moved.Destination = destination
+	if err := os.MkdirAll(q.destinationDir(destination), 0700); err != nil {
+		return err
+	}
+	if err := q.write(moved); err != nil {
+		return err
+	}
+	return q.Done(item)
+}
+
+// Expire removes the items queued before cutoff and returns them
+func (q *Queue) Expire(cutoff time.Time) ([]Item, error) {
+	destinations, err := q.Destinations()
+	if err != nil {
+		return nil, err
+	}
+	var expired []Item
+	for _, destination := range destinations {
+		names, err := q.itemNames(destination)
+		if err != nil {
+			return expired, err
+		}
+		for _, name := range names {
+			if queuedAt(name).After(cutoff) {
+				continue
+			}
+			item, err := q.read(destination, name)
+			if err != nil {
+				// An unreadable item is removed all the same
+				item = Item{Destination: destination, name: name}
+			}
+			if err := q.Done(item); err != nil {
+				return expired, err
+			}
+			expired = append(expired, item)
+		}
+	}
+	return expired, nil
+}
+
+// Stats returns the depth and oldest item of every destination with items queued
+func (q *Queue) Stats() ([]Stats, error) {
+	destinations, err := q.Destinations()
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]Stats, 0, len(destinations))
+	for _, destination := range destinations {
+		names, err := q.itemNames(destination)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) == 0 {
+			continue
+		}
+		entry := Stats{Destination: destination, Depth: len(names)}
+		for _, name := range names {
+			if at := queuedAt(name); entry.OldestAt.IsZero() || at.Before(entry.OldestAt) {
+				entry.OldestAt = at
+			}
+		}
+		stats = append(stats, entry)
+	}
+	return stats, nil
+}
+
+// destinationDir returns the directory of destination's items; the name is hex encoded
+// as destinations are host:port
+func (q *Queue) destinationDir(destination string) string {
+	return filepath.Join(q.dir, hex.EncodeToString([]byte(destination)))
+}
+
+// itemNames returns the file names of destination's items, in sending order
+func (q *Queue) itemNames(destination string) ([]string, error) {
+	entries, err := os.ReadDir(q.destinationDir(destination))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		// Temporary files of writes in progress start with a dot
+		if name := entry.Name(); !entry.IsDir() && !strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".json") {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// read reads an item
+func (q *Queue) read(destination, name string) (Item, error) {
+	data, err := os.ReadFile(filepath.Join(q.destinationDir(destination), name))
+	if err != nil {
+		return Item{}, err
+	}
+	if q.encryptor != nil {
+		if data, err = q.encryptor.Open(data, []byte(name)); err != nil {
+			return Item{}, fmt.Errorf("error decrypting outbox item %s: %v", name, err)
+		}
+	}
+	var item Item
+	if err := json.Unmarshal(data, &item); err != nil {
+		return Item{}, fmt.Errorf("error decoding outbox item %s: %v", name, err)
+	}
+	item.Destination, item.name = destination, name
+	return item, nil
+}
+
+// write writes an item to its file, replacing it atomically
+func (q *Queue) write(item Item) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	if q.encryptor != nil {
+		// Sealing to the file name keeps an item from being passed off as another
+		if data, err = q.encryptor.Seal(data, []byte(item.name)); err != nil {
+			return err
+		}
+	}
+
+	path := filepath.Join(q.destinationDir(item.Destination), item.name)
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+item.name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// queuedAt returns when the item of a file name was queued
+func queuedAt(name string) time.Time {
+	parts := strings.SplitN(name, "-", 3)
+	if len(parts) < 3 {
+		return time.Time{}
+	}
+	nanos, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos).UTC()
+}
@@ -0,0 +1,473 @@
+package routes
+
+import (
+	"sync"
+	"wave_capacitor/api/apierror"
+	"wave_capacitor/api/handlers"
+	"wave_capacitor/api/openapi"
+	"wave_capacitor/middleware"
+	"wave_capacitor/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// apiRoutes describes every endpoint registered in registerAPI for the OpenAPI document.
+// Paths are relative to the API prefix.
+// Add an entry here whenever a route is added or its request or response changes.
+var apiRoutes = []openapi.Route{
+	// Authentication
+	{Method: "POST", Path: "/register", Tag: "auth", Summary: "Register a new account",
+		Request: handlers.RegisterRequest{}, Status: 201, Response: handlers.RegisterResponse{}, ErrorCodes: []int{400, 429, 500, 503}, Idempotent: true},
+	{Method: "POST", Path: "/login", Tag: "auth", Summary: "Log in and obtain a token",
+		Request: handlers.LoginRequest{}, Response: handlers.LoginResponse{}, ErrorCodes: []int{400, 401, 403, 429, 500}},
+	{Method: "POST", Path: "/recover_account", Tag: "auth", Summary: "Restore an account from a backup",
+		Description: "Accepts a plaintext backup or an encrypted_backup together with its passphrase. " +
+			"With dry_run the response only reports the plan: what would be created, overwritten or skipped and why " +
+			"(key mismatch, existing or duplicate messages, malformed entries). Passing its plan_id as confirm restores " +
+			"only if the plan is unchanged, otherwise 409 restore_plan_changed returns the new plan. " +
+			"scopes restores only keys, contacts and/or messages, and messages_since and messages_until only the messages in that range; " +
+			"restoring an account that doesn't exist needs the keys scope. " +
+			"A restore reports the same plan, with counts per scope, and lists the entries that failed to be written. " +
+			"Restoring into an existing account, and any dry run, needs the account's token or challenge_id and proof answering " +
+			"a challenge from POST /recover_account/challenge; otherwise 401 recovery_proof_required. " +
+			"Restoring keys that aren't the account's current or former keys, which includes creating an account, needs " +
+			"challenge_id and proof answering a challenge for the backup's public_key; a key that is, or was, another " +
+			"account's is refused with 409 key_in_use. " +
+			"Messages restored without the keys scope are stored under the account's current key.",
+		Request: handlers.RecoverRequest{}, Response: handlers.RecoverResponse{}, ErrorCodes: []int{400, 401, 403, 409, 429, 500, 503}, Idempotent: true},
+	{Method: "POST", Path: "/recover_account/challenge", Tag: "auth", Summary: "Get a challenge proving ownership of an account to restore",
+		Description: "The ciphertext is a Kyber512 encapsulation to public_key, or without it to the account's public key. " +
+			"Decapsulating it with the private key gives a secret; pass base64(HMAC-SHA256(secret, challenge_id)) as proof to " +
+			"recover_account, whose backup must have that public key or be for an account with it. Challenges expire after " +
+			"five minutes and are accepted once. Unknown usernames without public_key get a challenge that can't be answered.",
+		Request: handlers.RecoveryChallengeRequest{}, Response: handlers.RecoveryChallengeResponse{}, ErrorCodes: []int{400, 429, 500}},
+
+	// User management
+	{Method: "POST", Path: "/logout", Tag: "user", Summary: "Log out", Auth: openapi.AuthJWT,
+		Response: handlers.SuccessResponse{}, ErrorCodes: []int{401}, Idempotent: true},
+	{Method: "POST", Path: "/delete_account", Tag: "user", Summary: "Delete the account and all its data", Auth: openapi.AuthJWT,
+		Description: "Removes database records, contacts and stored messages and revokes all tokens of the account.",
+		Response:    handlers.SuccessResponse{}, ErrorCodes: []int{401, 500, 503}, Idempotent: true},
+	{Method: "POST", Path: "/change_username", Tag: "user", Summary: "Change the username", Auth: openapi.AuthJWT,
+		Description: "The old username is kept as an alias. Tokens for the old username are revoked.",
+		Request:     handlers.ChangeUsernameRequest{}, Response: handlers.ChangeUsernameResponse{}, ErrorCodes: []int{400, 401, 409, 500, 503}, Idempotent: true},
+
+	// Key management
+	{Method: "GET", Path: "/get_public_key", Tag: "keys", Summary: "Get the account's public key", Auth: openapi.AuthJWT,
+		Response: handlers.PublicKeyResponse{}, ErrorCodes: []int{401, 500}, Conditional: true},
+	{Method: "GET", Path: "/get_encrypted_private_key", Tag: "keys", Summary: "Get the account's encrypted private key", Auth: openapi.AuthJWT,
+		Response: handlers.EncryptedPrivateKeyResponse{}, ErrorCodes: []int{401, 500}},
+	{Method: "POST", Path: "/rotate_keys", Tag: "keys", Summary: "Replace the account's key pair", Auth: openapi.AuthJWT,
+		Request: handlers.RotateKeysRequest{}, Response: handlers.RotateKeysResponse{}, ErrorCodes: []int{400, 401, 404, 409, 500, 503}, Idempotent: true},
+	{Method: "GET", Path: "/key_history", Tag: "keys", Summary: "List retired public keys", Auth: openapi.AuthJWT,
+		Response: handlers.KeyHistoryResponse{}, ErrorCodes: []int{401, 500}},
+	{Method: "GET", Path: "/resolve_key", Tag: "keys", Summary: "Find the account owning a public key", Auth: openapi.AuthJWT,
+		Description: "Accounts that blocked the caller are not found.",
+		Params:      []openapi.Param{{Name: "pubkey", In: "query", Required: true, Description: "Current or retired public key"}},
+		Response:    handlers.ResolveKeyResponse{}, ErrorCodes: []int{400, 401, 404, 500}},
+
+	// Prekeys
+	{Method: "POST", Path: "/upload_prekeys", Tag: "prekeys", Summary: "Upload one-time prekeys and the signed prekey", Auth: openapi.AuthJWT,
+		Request: handlers.UploadPrekeysRequest{}, Response: handlers.UploadPrekeysResponse{}, ErrorCodes: []int{400, 401, 500, 503}, Idempotent: true},
+	{Method: "POST", Path: "/claim_prekey", Tag: "prekeys", Summary: "Claim a prekey bundle of a recipient", Auth: openapi.AuthJWT,
+		Description: "Recipients that blocked the caller are not found.",
+		Request:     handlers.ClaimPrekeyRequest{}, Response: handlers.ClaimPrekeyResponse{}, ErrorCodes: []int{400, 401, 404, 500, 503}, Idempotent: true},
+	{Method: "GET", Path: "/prekey_status", Tag: "prekeys", Summary: "Count the remaining one-time prekeys", Auth: openapi.AuthJWT,
+		Response: handlers.PrekeyStatusResponse{}, ErrorCodes: []int{401, 500}},
+
+	// Sessions
+	{Method: "GET", Path: "/session", Tag: "sessions", Summary: "Get a stored ratchet session", Auth: openapi.AuthJWT,
+		Params: []openapi.Param{
+			{Name: "peer_key", In: "query", Required: true},
+			{Name: "device_id", In: "query", Required: true},
+		},
+		Response: handlers.SessionResponse{}, ErrorCodes: []int{400, 401, 404, 500}},
+	{Method: "PUT", Path: "/session", Tag: "sessions", Summary: "Store a ratchet session", Auth: openapi.AuthJWT,
+		Description: "Optimistic concurrency: the update fails with 409 unless expected_version matches the stored version.",
+		Request:     handlers.PutSessionRequest{}, Response: handlers.PutSessionResponse{}, ErrorCodes: []int{400, 401, 409, 413, 500, 503}, Idempotent: true},
+	{Method: "DELETE", Path: "/session", Tag: "sessions", Summary: "Delete a stored ratchet session", Auth: openapi.AuthJWT,
+		Params: []openapi.Param{
+			{Name: "peer_key", In: "query", Required: true},
+			{Name: "device_id", In: "query", Required: true},
+		},
+		Response: handlers.SuccessResponse{}, ErrorCodes: []int{400, 401, 404, 500, 503}, Idempotent: true},
+	{Method: "GET", Path: "/sessions", Tag: "sessions", Summary: "List the sessions of a device", Auth: openapi.AuthJWT,
+		Params:   []openapi.Param{{Name: "device_id", In: "query", Required: true}},
+		Response: handlers.SessionsResponse{}, ErrorCodes: []int{400, 401, 500}},
+
+	// Messages
+	{Method: "POST", Path: "/send_message", Tag: "messages", Summary: "Send an encrypted message", Auth: openapi.AuthJWT,
+		Description: "Messages to a recipient who blocked the sender, under any key the sender held, are not delivered. " +
+			"Depending on BLOCKED_MESSAGES the sender is answered as if they were, keeping only the sender's copy, or with 403. " +
+			"Messages to a recipient hosted on another capacitor are forwarded to it, and receipt carries its signed acknowledgement. " +
+			"When it can't be reached the message is queued and forwarded later, with queued set; 502 means the node doesn't queue messages. " +
+			"The recipient may be given as recipient_handle instead, resolved as by /resolve_handle; with both, 409 means the handle resolves to another key.",
+		Request: handlers.SendMessageRequest{}, Response: handlers.SendMessageResponse{}, ErrorCodes: []int{400, 401, 403, 404, 409, 429, 500, 502, 503, 507, 508}, Idempotent: true},
+	{Method: "GET", Path: "/resolve_handle", Tag: "messages", Summary: "Resolve a user@domain handle to a public key", Auth: openapi.AuthJWT,
+		Description: "The domain is this capacitor's address or HANDLE_DOMAIN, a capacitor's host:port or a domain found through the record a capacitor published to the DHT, " +
+			"trusted when DNS points the domain at that capacitor, or through the host:port the domain serves at https://<domain>/.well-known/wave-capacitor. " +
+			"Only public addresses are contacted, and the capacitor's signed record must name the capacitor asked. " +
+			"The key a remote capacitor answers with must be routed to it; 502 means it couldn't be reached or answered with a key it doesn't host.",
+		Params: []openapi.Param{
+			{Name: "handle", In: "query", Required: true, Description: "username@domain"},
+		},
+		Response: handlers.ResolveHandleResponse{}, ErrorCodes: []int{400, 401, 404, 500, 502}},
+	{Method: "GET", Path: "/get_messages", Tag: "messages", Summary: "Get messages", Auth: openapi.AuthJWT,
+		Description: "Without limit all messages are returned. With limit, messages are paged newest first.",
+		Params: []openapi.Param{
+			{Name: "limit", In: "query", Type: "integer", Description: "Page size, 1 to 200"},
+			{Name: "before", In: "query", Description: "next_cursor of the previous page"},
+		},
+		Response: handlers.MessagesResponse{}, ErrorCodes: []int{400, 401, 500}, Conditional: true},
+	{Method: "GET", Path: "/unread_count", Tag: "messages", Summary: "Count unread messages", Auth: openapi.AuthJWT,
+		Response: handlers.UnreadCountResponse{}, ErrorCodes: []int{401, 500}},
+	{Method: "POST", Path: "/mark_read", Tag: "messages", Summary: "Mark messages as read", Auth: openapi.AuthJWT,
+		Request: handlers.MarkReadRequest{}, Response: handlers.MarkReadResponse{}, ErrorCodes: []int{400, 401, 500, 503}, Idempotent: true},
+
+	// Contacts
+	{Method: "POST", Path: "/add_contact", Tag: "contacts", Summary: "Add or update a contact", Auth: openapi.AuthJWT,
+		Description: "The contact may be given as contact_handle instead of contact_public_key, resolved as by /resolve_handle; " +
+			"with both, 409 means the handle resolves to another key.",
+		Request: handlers.AddContactRequest{}, Response: handlers.AddContactResponse{}, ErrorCodes: []int{400, 401, 404, 409, 500, 502, 503}, Idempotent: true},
+	{Method: "GET", Path: "/get_contacts", Tag: "contacts", Summary: "List contacts", Auth: openapi.AuthJWT,
+		Description: "Each contact carries its verification state and the safety number of the caller's and the contact's public keys. " +
+			"A contact whose owner rotated away from the listed key becomes \"changed\" and carries current_public_key. " +
+			"The safety number sorts both keys; each contributes three groups of five digits, " +
+			"the first three 5-byte chunks of SHA-512(\"wave-safety-number-v1\\x00\" || key) as big-endian integers modulo 100000.",
+		Response: handlers.ContactsResponse{}, ErrorCodes: []int{401, 500}, Conditional: true},
+	{Method: "GET", Path: "/contacts_sync", Tag: "contacts", Summary: "Sync contact changes", Auth: openapi.AuthJWT,
+		Description: "Returns the contacts added, changed or removed after since, removed ones as tombstones with deleted set, " +
+			"so devices can merge changes instead of downloading the whole list. " +
+			"Without since, or with one older than CHANGE_LOG_RETENTION_DAYS, whose tombstones may be purged, full is set and the whole list returned.",
+		Params: []openapi.Param{
+			{Name: "since", In: "query", Description: "next_since of the previous sync, an RFC 3339 timestamp"},
+		},
+		Response: handlers.ContactsSyncResponse{}, ErrorCodes: []int{400, 401, 500}},
+	{Method: "GET", Path: "/export_contacts", Tag: "contacts", Summary: "Export contacts as a signed bundle", Auth: openapi.AuthJWT,
+		Description: "The bundle is JSON, or CSV with format=csv: a header comment, a public_key,nickname,verification,created_at table " +
+			"and a last \"# signature=<base64> signer_key=<base64>\" line signing every byte before it. " +
+			"Bundles are signed with the node's backup signing key.",
+		Params: []openapi.Param{
+			{Name: "format", In: "query", Description: "json (default) or csv"},
+		},
+		Response: handlers.ContactBundle{}, ErrorCodes: []int{400, 401, 500}},
+	{Method: "POST", Path: "/import_contacts", Tag: "contacts", Summary: "Import a contact bundle", Auth: openapi.AuthJWT,
+		Description: "Merges a bundle from /export_contacts, or a CSV with at least a public_key column from another client, into the contacts; " +
+			"the Content-Type, application/json or text/csv, selects the format. A bundle whose signature doesn't match is refused. " +
+			"Listed contacts are skipped, or with strategy=overwrite take the bundle's nickname. " +
+			"Only contacts of signed bundles keep a verified state.",
+		Params: []openapi.Param{
+			{Name: "strategy", In: "query", Description: "skip (default) or overwrite"},
+		},
+		Request: handlers.ContactBundle{}, Response: handlers.ContactImportResponse{}, ErrorCodes: []int{400, 401, 415, 500, 503}, Idempotent: true},
+	{Method: "POST", Path: "/block", Tag: "contacts", Summary: "Block a public key", Auth: openapi.AuthJWT,
+		Description: "Messages from the account behind the key, under any key it held, are no longer delivered, " +
+			"and the caller is hidden from its lookups. Blocking a key twice is not an error.",
+		Request: handlers.BlockRequest{}, Response: handlers.SuccessResponse{}, ErrorCodes: []int{400, 401, 409, 500, 503}, Idempotent: true},
+	{Method: "POST", Path: "/unblock", Tag: "contacts", Summary: "Unblock a public key", Auth: openapi.AuthJWT,
+		Request: handlers.BlockRequest{}, Response: handlers.SuccessResponse{}, ErrorCodes: []int{400, 401, 404, 500, 503}, Idempotent: true},
+	{Method: "GET", Path: "/blocklist", Tag: "contacts", Summary: "List blocked public keys", Auth: openapi.AuthJWT,
+		Response: handlers.BlocklistResponse{}, ErrorCodes: []int{401, 500}},
+	{Method: "GET", Path: "/discovery", Tag: "contacts", Summary: "Get the discovery opt-in", Auth: openapi.AuthJWT,
+		Response: handlers.DiscoveryResponse{}, ErrorCodes: []int{401, 500, 501}},
+	{Method: "PUT", Path: "/discovery", Tag: "contacts", Summary: "Opt in to contact discovery", Auth: openapi.AuthJWT,
+		Description: "Opts in with a blinded identifier the client derives from something its contacts know the user by, such as a phone number; " +
+			"the node never sees the identifier. Opting in again replaces the identifier.",
+		Request: handlers.DiscoveryOptInRequest{}, Response: handlers.DiscoveryResponse{}, ErrorCodes: []int{400, 401, 500, 501, 503}, Idempotent: true},
+	{Method: "DELETE", Path: "/discovery", Tag: "contacts", Summary: "Opt out of contact discovery", Auth: openapi.AuthJWT,
+		Description: "Records already published stay in the DHT until they expire.",
+		Response:    handlers.SuccessResponse{}, ErrorCodes: []int{401, 404, 500, 501, 503}, Idempotent: true},
+	{Method: "POST", Path: "/discovery/lookup", Tag: "contacts", Summary: "Look up contacts through discovery", Auth: openapi.AuthJWT,
+		Description: "Publishes the user's public key and capacitor to the DHT for each contact, sealed so only someone knowing both identifiers reads it, " +
+			"and returns the contacts that published theirs for the user. A contact is found once both sides looked each other up; " +
+			"compare safety numbers before trusting a key found this way.",
+		Request: handlers.DiscoveryLookupRequest{}, Response: handlers.DiscoveryLookupResponse{}, ErrorCodes: []int{400, 401, 409, 500, 501, 503}, Idempotent: true},
+	{Method: "POST", Path: "/presence", Tag: "contacts", Summary: "Keep a device online", Auth: openapi.AuthJWT,
+		Description: "The device stays online for timeout_seconds; send heartbeats more often than that. " +
+			"The user's contacts, on this capacitor or others, see the user online while any device is.",
+		Request: handlers.PresenceHeartbeatRequest{}, Response: handlers.PresenceHeartbeatResponse{}, ErrorCodes: []int{400, 401, 409, 500, 501, 503}, Idempotent: true},
+	{Method: "DELETE", Path: "/presence", Tag: "contacts", Summary: "Take a device offline", Auth: openapi.AuthJWT,
+		Params:   []openapi.Param{{Name: "device_id", In: "query", Required: true}},
+		Response: handlers.SuccessResponse{}, ErrorCodes: []int{400, 401, 404, 501, 503}, Idempotent: true},
+	{Method: "POST", Path: "/presence/lookup", Tag: "contacts", Summary: "Get the presence of contacts", Auth: openapi.AuthJWT,
+		Description: "Accounts that don't list the user as a contact are reported offline without last_seen, like unknown ones.",
+		Request:     handlers.PresenceLookupRequest{}, Response: handlers.PresenceResponse{}, ErrorCodes: []int{400, 401, 500, 501, 503}, Idempotent: true},
+	{Method: "POST", Path: "/remove_contact", Tag: "contacts", Summary: "Remove a contact", Auth: openapi.AuthJWT,
+		Request: handlers.RemoveContactRequest{}, Response: handlers.SuccessResponse{}, ErrorCodes: []int{400, 401, 404, 500, 503}, Idempotent: true},
+	{Method: "POST", Path: "/verify_contact", Tag: "contacts", Summary: "Mark a contact verified or unverified", Auth: openapi.AuthJWT,
+		Description: "Mark a contact verified after comparing safety numbers with it out of band. " +
+			"A contact that rotated its key can't be verified; add its current key instead.",
+		Request: handlers.VerifyContactRequest{}, Response: handlers.ContactResponse{}, ErrorCodes: []int{400, 401, 404, 409, 500, 503}, Idempotent: true},
+
+	// Backup
+	{Method: "GET", Path: "/backup_account", Tag: "backup", Summary: "Export a plaintext account backup", Auth: openapi.AuthJWT,
+		Response: handlers.BackupData{}, ErrorCodes: []int{401, 500}},
+	{Method: "POST", Path: "/backup_account", Tag: "backup", Summary: "Export a passphrase encrypted account backup", Auth: openapi.AuthJWT,
+		Request: handlers.BackupOptions{}, Response: utils.EncryptedBackup{}, ErrorCodes: []int{400, 401, 500}, Idempotent: true},
+	{Method: "GET", Path: "/backup_account/stream", Tag: "backup", Summary: "Stream a plaintext account backup", Auth: openapi.AuthJWT,
+		Description: "Streams the backup as newline-delimited JSON while it is read from storage, for accounts too large for /backup_account: " +
+			"an \"account\" record with the keys and contacts, one \"message\" record per message and an \"end\" record with the message count. " +
+			"A stream without the end record was cut off. " +
+			"With ?since= set to the backup_id of an earlier backup, only the changes after it are exported: " +
+			"added messages, \"message_deleted\" records and a \"contacts\" record if the contacts changed. " +
+			"410 means those changes are no longer tracked (CHANGE_LOG_RETENTION_DAYS) and a full backup is needed.",
+		Params: []openapi.Param{
+			{Name: "since", In: "query", Type: "integer", Description: "backup_id of the backup to export the changes after; 0 or absent for a full backup"},
+		},
+		Response: handlers.BackupRecord{}, ContentType: "application/x-ndjson", ErrorCodes: []int{400, 401, 410, 500}},
+	{Method: "GET", Path: "/backup_account/page", Tag: "backup", Summary: "Export a plaintext account backup in pages", Auth: openapi.AuthJWT,
+		Description: "Messages are paged newest first; the first page also carries the keys and contacts.",
+		Params: []openapi.Param{
+			{Name: "limit", In: "query", Type: "integer", Description: "Page size, 1 to 200, default 100"},
+			{Name: "before", In: "query", Description: "next_cursor of the previous page"},
+		},
+		Response: handlers.BackupPageResponse{}, ErrorCodes: []int{400, 401, 500}},
+	{Method: "GET", Path: "/export_data", Tag: "backup", Summary: "Export everything the node holds about the account", Auth: openapi.AuthJWT,
+		Description: "Streams a zip archive for data access requests, distinct from the restorable backup format. " +
+			"export.json names the format (wave-data-export) and its version and lists the files, which README.md documents: " +
+			"account.json, contacts.json, messages.ndjson, key_history.json, prekeys.json, sessions.json, webhooks.json, stored_backups.json, blocklist.json, discovery.json and audit.ndjson. " +
+			"An archive that fails to open was cut off by an error.",
+		ContentType: "application/zip", ErrorCodes: []int{401, 500}},
+	{Method: "POST", Path: "/backup_account/verify", Tag: "backup", Summary: "Verify a backup without restoring it", Auth: openapi.AuthJWT,
+		Description: "Checks every entry of a backup against the SHA-256 checksums of its manifest and the manifest's Ed25519 signature. " +
+			"The body is a backup from /backup_account, a recovery request wrapping an encrypted backup with its passphrase, " +
+			"or a streamed backup sent as application/x-ndjson. A damaged backup is reported with valid false, not as an error.",
+		Request: handlers.RecoverRequest{}, Response: handlers.VerifyBackupResponse{}, ErrorCodes: []int{400, 401, 413, 500}},
+	{Method: "POST", Path: "/stored_backups", Tag: "backup", Summary: "Store a client-encrypted backup on the node", Auth: openapi.AuthJWT,
+		Description: "The body is the backup as encrypted by the client, of any content type; the node keeps the bytes as they are " +
+			"and never holds a key to them. Users can store a limited number of backups, reported by GET /stored_backups.",
+		Params: []openapi.Param{
+			{Name: "label", In: "query", Description: "Shown when listing the stored backups, at most 255 characters"},
+			{Name: "sha256", In: "query", Description: "hex SHA-256 of the body; an upload that doesn't match is refused"},
+		},
+		Status: 201, Response: handlers.StoredBackupResponse{}, ErrorCodes: []int{400, 401, 409, 413, 500, 501, 503, 507}, Idempotent: true},
+	{Method: "GET", Path: "/stored_backups", Tag: "backup", Summary: "List stored backups", Auth: openapi.AuthJWT,
+		Response: handlers.StoredBackupsResponse{}, ErrorCodes: []int{401, 500, 501}},
+	{Method: "GET", Path: "/stored_backups/:id", Tag: "backup", Summary: "Retrieve a stored backup", Auth: openapi.AuthJWT,
+		Description: "Returns the backup's bytes as uploaded. The ETag is the backup's SHA-256.",
+		ContentType: "application/octet-stream", ErrorCodes: []int{401, 404, 500, 501}, Conditional: true},
+	{Method: "DELETE", Path: "/stored_backups/:id", Tag: "backup", Summary: "Delete a stored backup", Auth: openapi.AuthJWT,
+		Response: handlers.SuccessResponse{}, ErrorCodes: []int{401, 404, 500, 501, 503}, Idempotent: true},
+
+	// Webhooks
+	{Method: "POST", Path: "/webhooks", Tag: "webhooks", Summary: "Register a webhook", Auth: openapi.AuthJWT,
+		Description: "Events are POSTed as JSON with Wave-Event, Wave-Delivery and a Wave-Signature header " +
+			"\"t=<unix seconds>,v1=<hex HMAC-SHA256 of '<t>.<body>' keyed with the secret>\". Failed deliveries are retried with backoff.",
+		Request: handlers.CreateWebhookRequest{}, Status: 201, Response: handlers.WebhookCreatedResponse{}, ErrorCodes: []int{400, 401, 409, 500, 501, 503}, Idempotent: true},
+	{Method: "GET", Path: "/webhooks", Tag: "webhooks", Summary: "List webhooks", Auth: openapi.AuthJWT,
+		Response: handlers.WebhooksResponse{}, ErrorCodes: []int{401, 500, 501}},
+	{Method: "DELETE", Path: "/webhooks/:id", Tag: "webhooks", Summary: "Delete a webhook", Auth: openapi.AuthJWT,
+		Response: handlers.SuccessResponse{}, ErrorCodes: []int{401, 404, 500, 503}, Idempotent: true},
+	{Method: "GET", Path: "/webhooks/:id/deliveries", Tag: "webhooks", Summary: "Get the delivery log of a webhook", Auth: openapi.AuthJWT,
+		Response: handlers.WebhookDeliveriesResponse{}, ErrorCodes: []int{401, 404, 500}},
+
+	// Shard transfer between capacitors
+	{Method: "GET", Path: "/shards/:shard/export", Tag: "shards", Summary: "Stream the messages of a shard", Auth: openapi.AuthTransfer,
+		Params: []openapi.Param{
+			{Name: "shard", In: "path", Type: "integer", Description: "Shard index"},
+			{Name: "after", In: "query", Description: "Resume after this archive entry"},
+		},
+		ContentType: "application/x-tar", ErrorCodes: []int{400, 401, 404, 501}},
+	{Method: "POST", Path: "/shards/import", Tag: "shards", Summary: "Start pulling a shard from another capacitor", Auth: openapi.AuthTransfer,
+		Request: handlers.ImportShardRequest{}, Status: 202, Response: handlers.ShardImportStartedResponse{}, ErrorCodes: []int{400, 401, 404, 409, 501}},
+	{Method: "GET", Path: "/shards/import", Tag: "shards", Summary: "Get the progress of the shard import", Auth: openapi.AuthTransfer,
+		Response: handlers.ShardImportStatusResponse{}, ErrorCodes: []int{401, 404}},
+
+	// Node-to-node lookups; with NODE_MTLS these and the federation, replica and shard
+	// endpoints also require a node certificate, answering 401 without one. Signed requests
+	// of capacitors neither allowlisted nor holding a node certificate are answered 403.
+	{Method: "GET", Path: "/internal/route", Tag: "federation", Summary: "Find the capacitor hosting a public key",
+		Description: "Answers from the accounts hosted here, or from route records other capacitors published to the DHT, cached for ROUTE_CACHE_SECONDS. " +
+			"Records are signed by the hosting capacitor with its backup signing key; check the signature, and the capacitor through /internal/route/proof, before routing to it.",
+		Params: []openapi.Param{
+			{Name: "public_key", In: "query", Required: true},
+		},
+		Response: handlers.RouteResponse{}, ErrorCodes: []int{400, 401, 404, 500}},
+	{Method: "POST", Path: "/internal/route/proof", Tag: "federation", Summary: "Prove this capacitor holds the key of an account it routes",
+		Description: "Signed in the X-Node-Key, X-Node-Timestamp, X-Node-Nonce and X-Node-Signature headers by a trusted capacitor. " +
+			"The ciphertext is opened with the account's private key; the proof is an HMAC-SHA256 under the secret of the public key and this capacitor's signing key, separated by a NUL, after the wave-route-proof-v1 label and a NUL.",
+		Request: handlers.RouteProofRequest{}, Response: handlers.RouteProofResponse{}, ErrorCodes: []int{400, 401, 403, 404, 500}},
+	{Method: "POST", Path: "/federation/deliver", Tag: "federation", Summary: "Deliver a message forwarded by another capacitor",
+		Description: "The envelope is signed by the sender's capacitor, which the route record of the sender's public key must name. " +
+			"Messages for accounts hosted elsewhere are relayed, adding this capacitor to hops. Retried envelopes are acknowledged again with duplicate set.",
+		Request: handlers.FederatedMessage{}, Response: handlers.FederationDeliverResponse{}, ErrorCodes: []int{400, 401, 403, 404, 413, 501, 502, 503, 507, 508}},
+	{Method: "POST", Path: "/federation/presence", Tag: "federation", Summary: "Take the presence of an account hosted by another capacitor",
+		Description: "Signed in the X-Node-Key, X-Node-Timestamp, X-Node-Nonce and X-Node-Signature headers by the capacitor the public key is routed to. " +
+			"Only the accounts in audience see the presence, which is reported offline once ttl_seconds pass without a newer update.",
+		Request: handlers.PresenceUpdate{}, Response: handlers.SuccessResponse{}, ErrorCodes: []int{400, 401, 403, 501, 503}},
+	{Method: "GET", Path: "/federation/handle", Tag: "federation", Summary: "Get the signed handle record of an account hosted here",
+		Description: "Signed in the X-Node-Key, X-Node-Timestamp, X-Node-Nonce and X-Node-Signature headers by the asking capacitor. " +
+			"The record names the account's public key and is signed with this capacitor's backup signing key.",
+		Params: []openapi.Param{
+			{Name: "username", In: "query", Required: true},
+		},
+		Response: handlers.HandleResponse{}, ErrorCodes: []int{400, 401, 403, 404, 500, 501}},
+
+	// Mailbox replicas; requests carry the X-Node-Key, X-Node-Timestamp, X-Node-Nonce and
+	// X-Node-Signature headers of the capacitor the owner key is routed to
+	{Method: "POST", Path: "/replicas/write", Tag: "federation", Summary: "Store the replica of a message",
+		Request: handlers.ReplicaWriteRequest{}, Response: handlers.SuccessResponse{}, ErrorCodes: []int{400, 401, 403, 413, 500, 501, 507}},
+	{Method: "POST", Path: "/replicas/delete", Tag: "federation", Summary: "Delete the replica of a message",
+		Request: handlers.ReplicaDeleteRequest{}, Response: handlers.SuccessResponse{}, ErrorCodes: []int{400, 401, 403, 404, 500, 501}},
+	{Method: "GET", Path: "/replicas/message", Tag: "federation", Summary: "Get the replica of a message",
+		Params: []openapi.Param{
+			{Name: "owner_key", In: "query", Required: true},
+			{Name: "message_id", In: "query", Required: true},
+		},
+		Response: handlers.ReplicaMessageResponse{}, ErrorCodes: []int{400, 401, 403, 404, 500, 501}},
+	{Method: "GET", Path: "/replicas/list", Tag: "federation", Summary: "List the replicated messages of a mailbox",
+		Params: []openapi.Param{
+			{Name: "owner_key", In: "query", Required: true},
+		},
+		Response: handlers.ReplicaListResponse{}, ErrorCodes: []int{400, 401, 403, 500, 501}},
+	{Method: "GET", Path: "/replicas/digest", Tag: "federation", Summary: "Get the Merkle digest of the replicated messages of a mailbox",
+		Description: "Messages are hashed by the hex tag following the WVR1 prefix of their sealed replica, or with SHA-256 when they aren't sealed, and split into 16 buckets by the first byte of the SHA-256 of their ID, modulo 16. " +
+			"A bucket hashes \"<message_id> <hash>\\n\" of its messages in ID order, and the root hashes \"<bucket hash>\\n\" of the buckets in order. " +
+			"Without bucket the root and bucket hashes are returned, with it the hash of each message in that bucket.",
+		Params: []openapi.Param{
+			{Name: "owner_key", In: "query", Required: true},
+			{Name: "bucket", In: "query", Description: "Bucket as a hex digit, 0 to f"},
+		},
+		Response: handlers.ReplicaDigestResponse{}, ErrorCodes: []int{400, 401, 403, 500, 501}},
+
+	// Operator endpoints
+	{Method: "GET", Path: "/admin/maintenance", Tag: "admin", Summary: "Get the maintenance mode", Auth: openapi.AuthAdmin,
+		Response: handlers.MaintenanceResponse{}, ErrorCodes: []int{401, 404}},
+	{Method: "POST", Path: "/admin/maintenance", Tag: "admin", Summary: "Switch read-only maintenance mode", Auth: openapi.AuthAdmin,
+		Request: handlers.MaintenanceRequest{}, Response: handlers.MaintenanceResponse{}, ErrorCodes: []int{400, 401, 404}},
+	{Method: "GET", Path: "/admin/webhook_deliveries", Tag: "admin", Summary: "Get the delivery log of the node-wide webhook", Auth: openapi.AuthAdmin,
+		Response: handlers.WebhookDeliveriesResponse{}, ErrorCodes: []int{401, 404, 500}},
+	{Method: "GET", Path: "/admin/users", Tag: "admin", Summary: "List or search accounts", Auth: openapi.AuthAdmin,
+		Params: []openapi.Param{
+			{Name: "q", In: "query", Description: "Substring of the username"},
+			{Name: "after", In: "query", Description: "next_after of the previous page"},
+			{Name: "limit", In: "query", Type: "integer", Description: "Page size, 1 to 200, default 50"},
+		},
+		Response: handlers.AdminUsersResponse{}, ErrorCodes: []int{400, 401, 404, 500}},
+	{Method: "GET", Path: "/admin/users/:username", Tag: "admin", Summary: "Get an account and its storage usage", Auth: openapi.AuthAdmin,
+		Response: handlers.AdminUserResponse{}, ErrorCodes: []int{401, 404, 500}},
+	{Method: "POST", Path: "/admin/users/:username/disable", Tag: "admin", Summary: "Disable an account", Auth: openapi.AuthAdmin,
+		Description: "Revokes the account's tokens and refuses login and recovery until it is re-enabled. Stored data is kept.",
+		Request:     handlers.DisableUserRequest{}, Response: handlers.SuccessResponse{}, ErrorCodes: []int{400, 401, 404, 500}},
+	{Method: "POST", Path: "/admin/users/:username/enable", Tag: "admin", Summary: "Re-enable a disabled account", Auth: openapi.AuthAdmin,
+		Response: handlers.SuccessResponse{}, ErrorCodes: []int{401, 404, 500}},
+	{Method: "POST", Path: "/admin/users/:username/check_keys", Tag: "admin", Summary: "Check the key history of an account", Auth: openapi.AuthAdmin,
+		Description: "Verifies that the current and retired keys are valid, owned by no other account and have non-overlapping validity windows.",
+		Response:    handlers.KeyCheckResponse{}, ErrorCodes: []int{401, 404, 500}},
+	{Method: "GET", Path: "/admin/config", Tag: "admin", Summary: "Get the effective configuration", Auth: openapi.AuthAdmin,
+		Description: "Every setting of the node, named by its environment variable, with its resolved value and source. Secrets are redacted.",
+		Response:    handlers.AdminConfigResponse{}, ErrorCodes: []int{401, 404}},
+	{Method: "GET", Path: "/admin/shards", Tag: "admin", Summary: "Get the shard count", Auth: openapi.AuthAdmin,
+		Response: handlers.ShardsResponse{}, ErrorCodes: []int{401, 404, 501}},
+	{Method: "POST", Path: "/admin/shards", Tag: "admin", Summary: "Change the shard count", Auth: openapi.AuthAdmin,
+		Description: "Starts the rebalance job moving message folders to the new count. Messages are read from the folders of both " +
+			"counts until it finished without errors. The change lasts until the next restart, so update NUM_SHARDS as well.",
+		Request: handlers.ShardCountRequest{}, Status: 202, Response: handlers.ShardsResponse{}, ErrorCodes: []int{400, 401, 404, 409, 501}},
+	{Method: "GET", Path: "/admin/jobs", Tag: "admin", Summary: "List maintenance jobs and their last run", Auth: openapi.AuthAdmin,
+		Description: "Statuses are those of this node. leader names the capacitor that runs the scheduled retention sweeps, snapshots, " +
+			"route republishing and replica reconciliation for every capacitor sharing the database (LEADER_ELECTION).",
+		Response: handlers.AdminJobsResponse{}, ErrorCodes: []int{401, 404}},
+	{Method: "POST", Path: "/admin/jobs/:name", Tag: "admin", Summary: "Start a maintenance job", Auth: openapi.AuthAdmin,
+		Description: "Jobs run in the background: rebalance (move message folders to the current NUM_SHARDS), scrub, tiering, " +
+			"retention (MESSAGE_RETENTION_DAYS) and rehash (PREVIOUS_CONFUSION_SALT), each where configured. Poll /admin/jobs for the result.",
+		Params: []openapi.Param{{Name: "name", In: "path", Description: "rebalance, scrub, tiering, retention or rehash"}},
+		Status: 202, Response: handlers.AdminJobResponse{}, ErrorCodes: []int{401, 404, 409}},
+	{Method: "GET", Path: "/admin/runtime", Tag: "admin", Summary: "Get runtime statistics", Auth: openapi.AuthAdmin,
+		Description: "Goroutines, heap and GC figures, open file descriptors and connections, the webhook queue and uptime, for triage without a profiler.",
+		Response:    handlers.RuntimeResponse{}, ErrorCodes: []int{401, 404}},
+	{Method: "GET", Path: "/admin/federation/queue", Tag: "admin", Summary: "Get the messages queued for unreachable capacitors", Auth: openapi.AuthAdmin,
+		Description: "Depth and age of the oldest message per capacitor, and when a capacitor backing off is tried again.",
+		Response:    handlers.FederationQueueResponse{}, ErrorCodes: []int{401, 404, 500, 501}},
+	{Method: "GET", Path: "/admin/doctor", Tag: "admin", Summary: "Run diagnostics", Auth: openapi.AuthAdmin,
+		Description: "Checks database connectivity, storage writability per shard, DHT bootstrap reachability, TLS certificate expiry, " +
+			"clock skew against the database and the configuration, like the doctor command. Answers 200 whatever the results.",
+		Response: handlers.DoctorResponse{}, ErrorCodes: []int{401, 404}},
+	{Method: "GET", Path: "/admin/snapshots", Tag: "admin", Summary: "List scheduled snapshots", Auth: openapi.AuthAdmin,
+		Description: "Lists the retained snapshots of every account and the node metadata on each BACKUP_TARGET sink, oldest first; " +
+			"a sink whose index can't be read reports the error. " +
+			"The current or last run is reported by /admin/jobs as the \"snapshot\" job, which also takes one on demand.",
+		Response: handlers.SnapshotsResponse{}, ErrorCodes: []int{401, 404}},
+	{Method: "GET", Path: "/admin/debug/runtime", Tag: "admin", Summary: "Get runtime statistics", Auth: openapi.AuthAdmin,
+		Description: "Same as /admin/runtime. Only served when DEBUG_ENDPOINTS is enabled.",
+		Response:    handlers.RuntimeResponse{}, ErrorCodes: []int{401, 404}},
+	{Method: "GET", Path: "/admin/debug/pprof/:profile", Tag: "admin", Summary: "Download a pprof profile", Auth: openapi.AuthAdmin,
+		Description: "Only served when DEBUG_ENDPOINTS is enabled. The profile index is served at /admin/debug/pprof/.",
+		Params: []openapi.Param{
+			{Name: "profile", In: "path", Description: "heap, goroutine, allocs, block, mutex, threadcreate, profile (CPU), trace, cmdline or symbol"},
+			{Name: "seconds", In: "query", Type: "integer", Description: "Duration of CPU profiles and traces"},
+			{Name: "debug", In: "query", Type: "integer", Description: "Return a text profile instead of the binary format"},
+		},
+		ContentType: "application/octet-stream", ErrorCodes: []int{401, 404}},
+
+	// Status
+	{Method: "GET", Path: "/status", Tag: "status", Summary: "Node status",
+		Description: "Summarizes the readiness checks. Orchestrators should probe /healthz, /readyz and /livez at the root instead, " +
+			"which answer 503 when the node is unready or should be restarted.",
+		Response: handlers.StatusResponse{}},
+	{Method: "GET", Path: "/version", Tag: "status", Summary: "Build and features",
+		Description: "Reports the version, git commit and build date stamped into the binary, the Go version " +
+			"and the optional features the node runs with.",
+		Response: handlers.VersionResponse{}},
+	{Method: "GET", Path: "/errors", Tag: "status", Summary: "Error code catalog",
+		Description: "Lists the codes of the \"code\" field of error responses with the statuses they come with. " +
+			"Codes are stable; messages may change.",
+		Response: handlers.ErrorCatalogResponse{}},
+}
+
+var (
+	specOnce sync.Once
+	spec     *openapi.Document
+)
+
+// apiSpec builds the OpenAPI document on first use
+func apiSpec() *openapi.Document {
+	specOnce.Do(func() {
+		spec = openapi.Build(openapi.Info{
+			Title:   "Wave Capacitor API",
+			Version: "1.0.0",
+			Description: "Errors are returned as {\"success\": false, \"code\": \"...\", \"message\": \"...\", \"request_id\": \"...\"} " +
+				"with a matching HTTP status; clients should branch on the code, listed by GET /errors. " +
+				"The unversioned /api paths serve the same endpoints but are deprecated.",
+		}, middleware.CurrentAPIPrefix, apiRoutes, apierror.Response{})
+	})
+	return spec
+}
+
+// docsUI enables the Swagger UI at /api/v1/docs
+var docsUI bool
+
+// SetDocsUI enables or disables the Swagger UI; call it before SetupRoutes
+func SetDocsUI(enabled bool) {
+	docsUI = enabled
+}
+
+// swaggerUIPage renders the OpenAPI document with Swagger UI loaded from a CDN
+var swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Wave Capacitor API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "` + middleware.CurrentAPIPrefix + `/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>`
+
+// setupDocs serves the OpenAPI document and, when enabled, the Swagger UI
+func setupDocs(api fiber.Router) {
+	api.Get("/openapi.json", func(c *fiber.Ctx) error {
+		return c.JSON(apiSpec())
+	})
+
+	if docsUI {
+		api.Get("/docs", func(c *fiber.Ctx) error {
+			c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+			return c.SendString(swaggerUIPage)
+		})
+	}
+}
@@ -7,45 +7,187 @@ import (
 	"github.com/gofiber/fiber/v2"
 )
 
-// SetupRoutes configures all the API routes for the application
+// SetupRoutes configures all the API routes for the application.
+// Every endpoint is served under /api/v1 and, for existing clients, under the legacy
+// unversioned /api paths, whose responses carry deprecation headers.
 func SetupRoutes(app *fiber.App) {
+	// The versioned group must be registered first: the legacy group's middleware
+	// matches every path below /api, including /api/v1
+	registerAPI(app.Group(middleware.CurrentAPIPrefix, middleware.WithAPIVersion(middleware.APIVersion1)))
+	registerAPI(app.Group("/api", middleware.WithAPIVersion(middleware.APIVersionLegacy), middleware.Deprecated))
+
+	// Other capacitors find this one's address here when HANDLE_DOMAIN points at it
+	app.Get("/.well-known/wave-capacitor", handlers.GetWellKnownCapacitor)
+}
+
+// SetupProbes registers the orchestrator health probes. Call it before any middleware so
+// frequent probes skip logging and rate limiting.
+func SetupProbes(app *fiber.App) {
+	app.Get("/healthz", handlers.Healthz)
+	app.Get("/readyz", handlers.Readyz)
+	app.Get("/livez", handlers.Livez)
+}
+
+// debugEndpoints exposes runtime statistics and pprof profiles on the admin group
+var debugEndpoints bool
+
+// SetDebugEndpoints enables or disables the debug endpoints; call it before SetupRoutes
+func SetDebugEndpoints(enabled bool) {
+	debugEndpoints = enabled
+}
+
+// registerAPI registers all endpoints on the given API group
+func registerAPI(api fiber.Router) {
 	// Public API endpoints (no authentication required)
-	api := app.Group("/api")
-	
-	// Authentication endpoints
-	api.Post("/register", handlers.RegisterUser)
-	api.Post("/login", handlers.LoginUser)
-	api.Post("/recover_account", handlers.RecoverAccount)
+	// Authentication endpoints; account recovery uploads a whole backup and takes the
+	// account's token when the caller has one
+	api.Post("/register", middleware.DefaultBodyLimit, middleware.AuthRateLimit, middleware.MaintenanceGuard, middleware.Idempotency, handlers.RegisterUser)
+	api.Post("/login", middleware.DefaultBodyLimit, middleware.AuthRateLimit, handlers.LoginUser)
+	api.Post("/recover_account/challenge", middleware.DefaultBodyLimit, middleware.AuthRateLimit, handlers.RecoveryChallenge)
+	api.Post("/recover_account", middleware.BackupBodyLimit, middleware.AuthRateLimit, middleware.OptionalJWT, middleware.RevocationCheck, middleware.MaintenanceGuard, middleware.Idempotency, handlers.RecoverAccount)
+
+	// Backup verification and stored backups also upload a whole backup, so they are
+	// registered ahead of the protected group and its smaller body limit
+	api.Post("/backup_account/verify", middleware.BackupBodyLimit, middleware.JWTMiddleware, middleware.RevocationCheck, middleware.TrackLastSeen, middleware.UserRateLimit, handlers.VerifyBackup)
+	api.Post("/stored_backups", middleware.BackupBodyLimit, middleware.JWTMiddleware, middleware.RevocationCheck, middleware.TrackLastSeen, middleware.UserRateLimit, middleware.MaintenanceGuard, middleware.Idempotency, handlers.PushStoredBackup)
+
+	// Shard transfer between capacitors (shared transfer token, not user JWTs). Node
+	// endpoints also require a node certificate when NODE_MTLS is on.
+	shards := api.Group("/shards", middleware.DefaultBodyLimit, middleware.NodeTLS, middleware.TransferAuth)
+	shards.Get("/:shard/export", handlers.ExportShard)
+	shards.Post("/import", handlers.ImportShard)
+	shards.Get("/import", handlers.GetShardImportStatus)
+
+	// Node-to-node lookups; the answers are signed and public in the DHT anyway
+	internal := api.Group("/internal", middleware.DefaultBodyLimit, middleware.NodeTLS)
+	internal.Get("/route", handlers.GetRoute)
+	internal.Post("/route/proof", handlers.ProveRoute) // Signed in X-Node-* headers
+
+	// Messages forwarded by other capacitors, authenticated by their signatures; the
+	// bodies are as large as the users' own messages
+	federation := api.Group("/federation", middleware.UserBodyLimit, middleware.NodeTLS, middleware.MaintenanceGuard)
+	federation.Post("/deliver", handlers.DeliverFederated)
+	federation.Post("/presence", handlers.ReceivePresence) // Signed in X-Node-* headers
+	federation.Get("/handle", handlers.GetHandle)          // ?username=, signed in X-Node-* headers
 
-	// Protected API endpoints (require JWT token)
-	protected := api.Group("/", middleware.JWTMiddleware)
+	// Mailbox replicas kept for other capacitors, which sign their requests; a replica
+	// carries a whole message, encoded in JSON
+	replicas := api.Group("/replicas", middleware.BackupBodyLimit, middleware.NodeTLS)
+	replicas.Post("/write", handlers.WriteReplica)
+	replicas.Post("/delete", handlers.DeleteReplica)
+	replicas.Get("/message", handlers.GetReplica)
+	replicas.Get("/list", handlers.ListReplicas)
+	replicas.Get("/digest", handlers.GetReplicaDigest) // ?bucket= lists the hashes of one bucket
+
+	// Operator endpoints (shared admin token, not user JWTs)
+	admin := api.Group("/admin", middleware.DefaultBodyLimit, middleware.AdminAuth)
+	admin.Get("/maintenance", handlers.GetMaintenance)
+	admin.Post("/maintenance", handlers.SetMaintenance)
+	admin.Get("/webhook_deliveries", handlers.GetDeploymentWebhookDeliveries)
+	admin.Get("/users", handlers.AdminListUsers)
+	admin.Get("/users/:username", handlers.AdminGetUser)
+	admin.Post("/users/:username/disable", handlers.AdminDisableUser)
+	admin.Post("/users/:username/enable", handlers.AdminEnableUser)
+	admin.Post("/users/:username/check_keys", handlers.AdminCheckKeys)
+	admin.Get("/config", handlers.AdminGetConfig)
+	admin.Get("/shards", handlers.AdminGetShards)
+	admin.Post("/shards", handlers.AdminSetShards)
+	admin.Get("/jobs", handlers.GetAdminJobs)
+	admin.Post("/jobs/:name", handlers.RunAdminJob)
+	admin.Get("/runtime", handlers.GetRuntimeStats)
+	admin.Get("/federation/queue", handlers.GetFederationQueue)
+	admin.Get("/doctor", handlers.AdminDoctor)
+	admin.Get("/snapshots", handlers.AdminListSnapshots)
+	if debugEndpoints {
+		admin.Get("/debug/runtime", handlers.GetRuntimeStats)
+		admin.Get("/debug/pprof", handlers.Pprof)
+		admin.Get("/debug/pprof/:profile", handlers.Pprof)
+		admin.Post("/debug/pprof/symbol", handlers.Pprof)
+	}
+
+	// API description (OpenAPI document and optional Swagger UI)
+	setupDocs(api)
+
+	// Status endpoint and error code catalog (registered before the protected group so
+	// they need no token)
+	api.Get("/status", handlers.GetStatus)
+	api.Get("/version", handlers.GetVersion)
+	api.Get("/errors", handlers.GetErrorCatalog)
+
+	// Protected API endpoints (require JWT token); writes are refused in maintenance mode
+	// and replayed when retried with the same Idempotency-Key
+	protected := api.Group("/", middleware.UserBodyLimit, middleware.JWTMiddleware, middleware.RevocationCheck, middleware.TrackLastSeen, middleware.UserRateLimit, middleware.MaintenanceGuard, middleware.Idempotency)
 	
 	// User management
 	protected.Post("/logout", handlers.LogoutUser)
 	protected.Post("/delete_account", handlers.DeleteAccount)
+	protected.Post("/change_username", handlers.ChangeUsername)
 	
 	// Key management
 	protected.Get("/get_public_key", handlers.GetPublicKey)
 	protected.Get("/get_encrypted_private_key", handlers.GetEncryptedPrivateKey)
+	protected.Post("/rotate_keys", handlers.RotateKeys)
+	protected.Get("/key_history", handlers.GetKeyHistory)
+	protected.Get("/resolve_key", handlers.ResolveKey)
+	
+	// Prekeys for asynchronous key exchange
+	protected.Post("/upload_prekeys", handlers.UploadPrekeys)
+	protected.Post("/claim_prekey", handlers.ClaimPrekey)
+	protected.Get("/prekey_status", handlers.GetPrekeyStatus)
+	
+	// Ratchet session state sync
+	protected.Get("/session", handlers.GetSession)
+	protected.Put("/session", handlers.PutSession)
+	protected.Delete("/session", handlers.DeleteSession)
+	protected.Get("/sessions", handlers.ListSessions)
 	
 	// Message handling
-	protected.Post("/send_message", handlers.SendMessage)
-	protected.Get("/get_messages", handlers.GetMessages)
+	protected.Post("/send_message", middleware.SendRateLimit, handlers.SendMessage)
+	protected.Get("/resolve_handle", handlers.ResolveHandle) // ?handle=user@domain
+	protected.Get("/get_messages", handlers.GetMessages) // ?limit=&before= pages through the message index
+	protected.Get("/unread_count", handlers.GetUnreadCount)
+	protected.Post("/mark_read", handlers.MarkMessagesRead)
 	
 	// Contact management
 	protected.Post("/add_contact", handlers.AddContact)
 	protected.Get("/get_contacts", handlers.GetContacts)
+	protected.Get("/contacts_sync", handlers.SyncContacts) // ?since= returns the changes after the previous sync
 	protected.Post("/remove_contact", handlers.RemoveContact)
+	protected.Post("/verify_contact", handlers.VerifyContact)
+	protected.Get("/export_contacts", handlers.ExportContacts)  // ?format=json|csv
+	protected.Post("/import_contacts", handlers.ImportContacts) // ?strategy=skip|overwrite
+	protected.Post("/block", handlers.BlockKey)
+	protected.Post("/unblock", handlers.UnblockKey)
+	protected.Get("/blocklist", handlers.GetBlocklist)
+	
+	// Mutual-contact discovery through the DHT
+	protected.Get("/discovery", handlers.GetDiscovery)
+	protected.Put("/discovery", handlers.OptInDiscovery)
+	protected.Delete("/discovery", handlers.OptOutDiscovery)
+	protected.Post("/discovery/lookup", handlers.LookupDiscovery)
+	
+	// Presence shared with contacts, here and on their capacitors
+	protected.Post("/presence", handlers.SendPresenceHeartbeat)
+	protected.Delete("/presence", handlers.EndPresence) // ?device_id=
+	protected.Post("/presence/lookup", handlers.LookupPresence)
 	
 	// Backup and recovery
 	protected.Get("/backup_account", handlers.BackupAccount)
-	
-	// Health check and status endpoint
-	api.Get("/status", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{
-			"status":  "ok",
-			"message": "Wave Capacitor is running",
-			"version": "1.0.0",
-		})
-	})
+	protected.Post("/backup_account", handlers.BackupAccount) // Body {"passphrase": "..."} returns an encrypted archive
+	protected.Get("/backup_account/stream", handlers.StreamBackupAccount)
+	protected.Get("/backup_account/page", handlers.BackupAccountPage)
+
+	// Export of everything held about the user, for data access requests
+	protected.Get("/export_data", handlers.ExportData)
+
+	// Client-encrypted backups kept on the node; uploads are registered above
+	protected.Get("/stored_backups", handlers.GetStoredBackups)
+	protected.Get("/stored_backups/:id", handlers.GetStoredBackup)
+	protected.Delete("/stored_backups/:id", handlers.RemoveStoredBackup)
+
+	// Webhooks
+	protected.Post("/webhooks", handlers.CreateWebhook)
+	protected.Get("/webhooks", handlers.GetWebhooks)
+	protected.Delete("/webhooks/:id", handlers.RemoveWebhook)
+	protected.Get("/webhooks/:id/deliveries", handlers.GetWebhookDeliveries)
 }
@@ -0,0 +1,100 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+	"wave_capacitor/utils"
+)
+
+// AWSKMSProvider decrypts KMS-encrypted secrets supplied as <NAME>_KMS_CIPHERTEXT
+// environment variables (base64 CiphertextBlob). Only ciphertext is ever
+// present in the environment; plaintext exists solely in process memory.
+type AWSKMSProvider struct {
+	region     string
+	endpoint   string
+	creds      utils.AWSCredentials
+	httpClient *http.Client
+}
+
+// NewAWSKMSProvider creates a KMS-backed provider for the given region
+func NewAWSKMSProvider(region string) (*AWSKMSProvider, error) {
+	if region == "" {
+		return nil, errors.New("awskms provider requires AWS_REGION")
+	}
+
+	creds := utils.AWSCredentialsFromEnv()
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, errors.New("awskms provider requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	return &AWSKMSProvider{
+		region:     region,
+		endpoint:   "https://kms." + region + ".amazonaws.com/",
+		creds:      creds,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Name returns the provider identifier
+func (k *AWSKMSProvider) Name() string {
+	return "awskms"
+}
+
+// GetSecret decrypts the ciphertext stored in <name>_KMS_CIPHERTEXT
+func (k *AWSKMSProvider) GetSecret(name string) (string, error) {
+	ciphertext := os.Getenv(name + "_KMS_CIPHERTEXT")
+	if ciphertext == "" {
+		return "", ErrSecretNotFound
+	}
+
+	plaintext, err := k.Decrypt(ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %v", name, err)
+	}
+	return string(plaintext), nil
+}
+
+// Decrypt calls the KMS Decrypt API for a base64-encoded ciphertext blob
+func (k *AWSKMSProvider) Decrypt(ciphertextBase64 string) ([]byte, error) {
+	body, err := json.Marshal(map[string]string{"CiphertextBlob": ciphertextBase64})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", k.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	utils.SignAWSRequest(req, utils.SHA256Hex(body), "kms", k.region, k.creds, time.Now())
+
+	resp, err := k.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("KMS request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("KMS returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var result struct {
+		Plaintext string `json:"Plaintext"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode KMS response: %v", err)
+	}
+	return base64.StdEncoding.DecodeString(result.Plaintext)
+}
@@ -0,0 +1,186 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"wave_capacitor/logging"
+)
+
+// logger logs secret files that can't be read or changed on disk
+var logger = logging.Component("secrets")
+
+// DefaultSecretsDir is where Docker mounts secrets; Kubernetes secret volumes can be
+// mounted anywhere and pointed to with SECRETS_DIR
+const DefaultSecretsDir = "/run/secrets"
+
+// SecretsDir returns the directory of mounted secret files, one file per secret
+func SecretsDir() string {
+	if dir, exists := os.LookupEnv("SECRETS_DIR"); exists {
+		return dir
+	}
+	return DefaultSecretsDir
+}
+
+// SecretFile returns the file holding the named secret, or "" if it is not kept in a file.
+// NAME_FILE takes precedence over a file called NAME or name in the secrets directory.
+func SecretFile(name string) string {
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		return path
+	}
+	dir := SecretsDir()
+	if dir == "" {
+		return ""
+	}
+	for _, candidate := range []string{name, strings.ToLower(name)} {
+		path := filepath.Join(dir, candidate)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+	}
+	return ""
+}
+
+// ReadSecretFile reads a secret file; surrounding whitespace, such as the trailing newline
+// most tools write, is not part of the secret
+func ReadSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file: %v", err)
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+	return value, nil
+}
+
+// Lookup resolves a secret from its file (see SecretFile) or else the environment
+// variable of the same name. Returns ErrSecretNotFound when neither is set.
+func Lookup(name string) (string, error) {
+	if path := SecretFile(name); path != "" {
+		value, err := ReadSecretFile(path)
+		if err != nil {
+			return "", fmt.Errorf("%s: %v", name, err)
+		}
+		return value, nil
+	}
+	if value, exists := os.LookupEnv(name); exists && value != "" {
+		return value, nil
+	}
+	return "", ErrSecretNotFound
+}
+
+// watchedSecret is a secret file and what to do when its value changes
+type watchedSecret struct {
+	name  string
+	path  string
+	value string
+	apply func(value string) // nil when the change needs a restart
+}
+
+// Watcher re-reads secret files periodically and applies changed values, so rotating
+// a mounted secret doesn't need a restart. Files are compared by content rather than
+// modification time because Kubernetes swaps a symlink when it updates a secret volume.
+type Watcher struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	secrets []*watchedSecret
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewWatcher creates a watcher checking every interval; add secrets with Watch, then call Start
+func NewWatcher(interval time.Duration) *Watcher {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	return &Watcher{
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Watch registers the named secret if it is kept in a file and reports whether it is.
+// apply is called with each new value; with a nil apply a change is only logged, for
+// secrets that are read once at startup.
+func (w *Watcher) Watch(name string, apply func(value string)) bool {
+	path := SecretFile(name)
+	if path == "" {
+		return false
+	}
+	value, err := ReadSecretFile(path)
+	if err != nil {
+		logger.Warn(context.Background(), "reading secret file failed", "secret", name, "error", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.secrets = append(w.secrets, &watchedSecret{name: name, path: path, value: value, apply: apply})
+	return true
+}
+
+// Len returns the number of watched secrets
+func (w *Watcher) Len() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.secrets)
+}
+
+// Start checks the secret files periodically in the background
+func (w *Watcher) Start() {
+	go func() {
+		defer close(w.done)
+
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				w.Check()
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the background checks
+func (w *Watcher) Stop() {
+	close(w.stop)
+	<-w.done
+}
+
+// Check re-reads every watched file and applies the values that changed. A file that
+// is missing or empty, e.g. in the middle of an update, keeps the previous value.
+func (w *Watcher) Check() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, secret := range w.secrets {
+		value, err := ReadSecretFile(secret.path)
+		if err != nil {
+			logger.Warn(context.Background(), "secret not reloaded", "secret", secret.name, "error", err)
+			continue
+		}
+		if value == secret.value {
+			continue
+		}
+		secret.value = value
+
+		if secret.apply == nil {
+			logger.Warn(context.Background(), "secret changed on disk, restart the node to apply it", "secret", secret.name)
+			continue
+		}
+		secret.apply(value)
+		logger.Info(context.Background(), "secret reloaded", "secret", secret.name)
+	}
+}
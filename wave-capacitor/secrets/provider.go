@@ -0,0 +1,72 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Names of the node secrets resolved through a Provider
+const (
+	JWTSecret     = "JWT_SECRET"
+	NodeMasterKey = "NODE_MASTER_KEY"
+	ConfusionSalt = "CONFUSION_SALT"
+
+	// PrivateKeyWrapKey wraps the private keys stored for accounts
+	PrivateKeyWrapKey = "PRIVATE_KEY_WRAP_KEY"
+
+	// PreviousConfusionSalt is the salt being rotated away from, set until messages are re-hashed
+	PreviousConfusionSalt = "PREVIOUS_CONFUSION_SALT"
+)
+
+// ErrSecretNotFound is returned when a provider has no value for a secret
+var ErrSecretNotFound = errors.New("secret not found")
+
+// Provider resolves named secrets from a backing secret store
+type Provider interface {
+	// Name returns a short identifier for logging
+	Name() string
+	// GetSecret returns the value of the named secret or ErrSecretNotFound
+	GetSecret(name string) (string, error)
+}
+
+// Options configures the available secret providers
+type Options struct {
+	Provider string // "env", "vault" or "awskms"
+
+	// HashiCorp Vault (KV v2)
+	VaultAddr  string
+	VaultToken string
+	VaultMount string
+	VaultPath  string
+
+	// AWS KMS
+	AWSRegion string
+}
+
+// NewProvider creates the provider selected in opts
+func NewProvider(opts Options) (Provider, error) {
+	switch opts.Provider {
+	case "", "env":
+		return EnvProvider{}, nil
+	case "vault":
+		return NewVaultProvider(opts.VaultAddr, opts.VaultToken, opts.VaultMount, opts.VaultPath)
+	case "awskms":
+		return NewAWSKMSProvider(opts.AWSRegion)
+	default:
+		return nil, fmt.Errorf("unknown secrets provider: %s", opts.Provider)
+	}
+}
+
+// EnvProvider reads secrets from NAME_FILE, a file in the secrets directory, or plain
+// environment variables (see Lookup); only the files are suitable for production
+type EnvProvider struct{}
+
+// Name returns the provider identifier
+func (EnvProvider) Name() string {
+	return "env"
+}
+
+// GetSecret returns the secret from its file or environment variable
+func (EnvProvider) GetSecret(name string) (string, error) {
+	return Lookup(name)
+}
@@ -0,0 +1,106 @@
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultProvider reads secrets from a HashiCorp Vault KV v2 secret.
+// All node secrets live as keys of a single secret at <mount>/data/<path>.
+type VaultProvider struct {
+	addr       string
+	token      string
+	mount      string
+	path       string
+	httpClient *http.Client
+
+	mutex  sync.Mutex
+	cached map[string]string
+}
+
+// NewVaultProvider creates a Vault-backed provider
+func NewVaultProvider(addr, token, mount, path string) (*VaultProvider, error) {
+	if addr == "" || token == "" {
+		return nil, errors.New("vault provider requires VAULT_ADDR and VAULT_TOKEN")
+	}
+	if mount == "" {
+		mount = "secret"
+	}
+	if path == "" {
+		path = "wave-capacitor"
+	}
+
+	return &VaultProvider{
+		addr:       strings.TrimSuffix(addr, "/"),
+		token:      token,
+		mount:      strings.Trim(mount, "/"),
+		path:       strings.Trim(path, "/"),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Name returns the provider identifier
+func (v *VaultProvider) Name() string {
+	return "vault"
+}
+
+// GetSecret returns the named key from the node's Vault secret
+func (v *VaultProvider) GetSecret(name string) (string, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if v.cached == nil {
+		data, err := v.readSecret()
+		if err != nil {
+			return "", err
+		}
+		v.cached = data
+	}
+
+	value, ok := v.cached[name]
+	if !ok || value == "" {
+		return "", ErrSecretNotFound
+	}
+	return value, nil
+}
+
+// readSecret fetches the whole KV v2 secret
+func (v *VaultProvider) readSecret() (map[string]string, error) {
+	url := fmt.Sprintf("%s/v1/%s/data/%s", v.addr, v.mount, v.path)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("vault request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return map[string]string{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode vault response: %v", err)
+	}
+	if result.Data.Data == nil {
+		return map[string]string{}, nil
+	}
+	return result.Data.Data, nil
+}
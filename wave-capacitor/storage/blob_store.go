@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrBlobNotFound is returned when a blob does not exist in the store
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore persists large opaque objects such as attachments and backup archives.
+// Keys are slash-separated relative paths chosen by the caller.
+type BlobStore interface {
+	// PutBlob streams r into the blob at key; size is a hint and may be -1 if unknown
+	PutBlob(key string, r io.Reader, size int64) error
+	// GetBlob opens the blob at key; the caller must close the returned reader
+	GetBlob(key string) (io.ReadCloser, error)
+	// DeleteBlob removes the blob at key
+	DeleteBlob(key string) error
+}
+
+// FileBlobStore stores blobs as files below a base directory
+type FileBlobStore struct {
+	baseDir string
+}
+
+// NewFileBlobStore creates a file-backed blob store rooted at baseDir
+func NewFileBlobStore(baseDir string) *FileBlobStore {
+	return &FileBlobStore{baseDir: baseDir}
+}
+
+// PutBlob writes the blob to a temporary file and renames it into place
+func (s *FileBlobStore) PutBlob(key string, r io.Reader, size int64) error {
+	path, err := s.pathFor(key)
+	if err != nil {
+		return err
+	}
+	if err := EnsureDirectoryExists(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".blob-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write blob: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// GetBlob opens the blob file for reading
+func (s *FileBlobStore) GetBlob(key string) (io.ReadCloser, error) {
+	path, err := s.pathFor(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+// DeleteBlob removes the blob file
+func (s *FileBlobStore) DeleteBlob(key string) error {
+	path, err := s.pathFor(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+// pathFor maps a blob key to a file path, rejecting keys that escape the base directory
+func (s *FileBlobStore) pathFor(key string) (string, error) {
+	if err := validateBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.baseDir, filepath.FromSlash(key)), nil
+}
+
+// validateBlobKey rejects empty, absolute, or traversing blob keys
+func validateBlobKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, `\`) {
+		return fmt.Errorf("invalid blob key: %q", key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("invalid blob key: %q", key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// testKey returns a random 32-byte key
+func testKey(t testing.TB) []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testPayload returns a compressible payload of size bytes
+func testPayload(size int) []byte {
+	return bytes.Repeat([]byte(`{"ciphertext_msg":"abcdefgh"}`), size/29+1)[:size]
+}
+
+func TestChecksumRoundTrip(t *testing.T) {
+	payload := testPayload(1000)
+	framed := addChecksum(payload)
+	if !bytes.HasPrefix(framed, checksumMagic) {
+		t.Fatalf("framed data doesn't start with %q", checksumMagic)
+	}
+	got, err := verifyChecksum(framed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("payload changed in the round trip")
+	}
+
+	framed[len(framed)-1] ^= 1
+	if _, err := verifyChecksum(framed); !errors.Is(err, ErrMessageCorrupted) {
+		t.Fatalf("damaged payload: got %v, want ErrMessageCorrupted", err)
+	}
+	if _, err := verifyChecksum(framed[:len(checksumMagic)+4]); !errors.Is(err, ErrMessageCorrupted) {
+		t.Fatalf("truncated header: got %v, want ErrMessageCorrupted", err)
+	}
+
+	// Files written before checksums pass through
+	if got, err := verifyChecksum(payload); err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("legacy file: got %q, %v", got, err)
+	}
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	for _, algorithm := range []string{CompressionGzip, CompressionZstd} {
+		t.Run(algorithm, func(t *testing.T) {
+			compressor, err := NewCompressor(algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload := testPayload(4096)
+			compressed, err := compressor.Compress(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(compressed, compressedMagic) || len(compressed) >= len(payload) {
+				t.Fatalf("payload wasn't compressed: %d bytes", len(compressed))
+			}
+			got, err := decompress(compressed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatal("payload changed in the round trip")
+			}
+		})
+	}
+
+	// Small payloads and a nil compressor leave data as it is
+	zstd, _ := NewCompressor(CompressionZstd)
+	small := testPayload(minCompressSize - 1)
+	if out, err := zstd.Compress(small); err != nil || !bytes.Equal(out, small) {
+		t.Fatalf("small payload: got %q, %v", out, err)
+	}
+	var none *Compressor
+	if out, err := none.Compress(testPayload(4096)); err != nil || bytes.HasPrefix(out, compressedMagic) {
+		t.Fatalf("nil compressor: got %d bytes, %v", len(out), err)
+	}
+	if _, err := decompress(append(append([]byte{}, compressedMagic...), 9, 1, 2)); err == nil {
+		t.Fatal("unknown algorithm accepted")
+	}
+}
+
+func TestEncryptorRoundTrip(t *testing.T) {
+	encryptor, err := NewEncryptor(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := testPayload(500)
+	sealed, err := encryptor.Seal(payload, []byte("message-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed, encryptedMagic) || !IsEncrypted(sealed) {
+		t.Fatalf("sealed data doesn't start with %q", encryptedMagic)
+	}
+	got, err := encryptor.Open(sealed, []byte("message-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("payload changed in the round trip")
+	}
+
+	if _, err := encryptor.Open(sealed, []byte("message-2")); err == nil {
+		t.Fatal("opened under other associated data")
+	}
+	other, _ := NewEncryptor(testKey(t))
+	if _, err := other.Open(sealed, []byte("message-1")); err == nil {
+		t.Fatal("opened with another key")
+	}
+	if _, err := encryptor.Open(encryptedMagic, nil); err == nil {
+		t.Fatal("truncated data accepted")
+	}
+	if got, err := encryptor.Open(payload, nil); err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("plaintext file: got %q, %v", got, err)
+	}
+}
+
+func TestMessageCodecFolderBound(t *testing.T) {
+	encryptor, err := NewEncryptor(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec := messageCodec{encryptor: encryptor}
+	payload := testPayload(500)
+	sealed, err := codec.seal("folder-a", "message-1", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed, folderBoundMagic) || !IsEncrypted(sealed) {
+		t.Fatalf("sealed data doesn't start with %q", folderBoundMagic)
+	}
+	got, err := codec.open("folder-a", "message-1", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("payload changed in the round trip")
+	}
+
+	if _, err := codec.open("folder-b", "message-1", sealed); err == nil {
+		t.Fatal("opened in another folder")
+	}
+	if _, err := codec.open("folder-a", "message-2", sealed); err == nil {
+		t.Fatal("opened under another message ID")
+	}
+
+	// Files sealed before messages were bound to their folder still open
+	legacy, err := encryptor.Seal(payload, []byte("message-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := codec.open("folder-a", "message-1", legacy); err != nil || !bytes.Equal(got, payload) {
+		t.Fatalf("legacy file: %v", err)
+	}
+}
+
+// testDataKeys returns data keys under a fresh key ring, kept in a temporary folder
+func testDataKeys(t *testing.T) (*DataKeys, *KeyRing) {
+	keyRing, err := NewKeyRing(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(keyRing.Destroy)
+	return NewDataKeys(keyRing, NewFileDataKeyStore(t.TempDir())), keyRing
+}
+
+func TestDataKeysRoundTrip(t *testing.T) {
+	dataKeys, _ := testDataKeys(t)
+	id := dataKeyID("ab/cd", "message-1")
+	payload := testPayload(500)
+	sealed, err := dataKeys.Seal(id, payload, []byte("message-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(sealed, dataKeyMagic) || !IsEncrypted(sealed) {
+		t.Fatalf("sealed data doesn't start with %q", dataKeyMagic)
+	}
+	got, err := dataKeys.Open(id, sealed, []byte("message-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("payload changed in the round trip")
+	}
+
+	if _, err := dataKeys.Open(id, sealed, []byte("message-2")); err == nil {
+		t.Fatal("opened under other associated data")
+	}
+	if err := dataKeys.Shred(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dataKeys.Open(id, sealed, []byte("message-1")); !errors.Is(err, ErrDataKeyNotFound) {
+		t.Fatalf("shredded key: got %v, want ErrDataKeyNotFound", err)
+	}
+}
+
+func TestWrappedKeyRoundTrip(t *testing.T) {
+	dataKeys, _ := testDataKeys(t)
+	dataKey := testKey(t)
+	wrapped, err := dataKeys.wrap("ab/cd/message-1", dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(wrapped, wrappedKeyMagic) {
+		t.Fatalf("wrapped key doesn't start with %q", wrappedKeyMagic)
+	}
+	got, _, err := dataKeys.unwrap("ab/cd/message-1", wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, dataKey) {
+		t.Fatal("data key changed in the round trip")
+	}
+	if _, _, err := dataKeys.unwrap("ab/cd/message-2", wrapped); err == nil {
+		t.Fatal("unwrapped under another ID")
+	}
+	if _, _, err := dataKeys.unwrap("ab/cd/message-1", wrapped[:len(wrappedKeyMagic)+2]); err == nil {
+		t.Fatal("truncated key accepted")
+	}
+}
+
+func TestRewrapAfterRotation(t *testing.T) {
+	oldKey := testKey(t)
+	oldRing, err := NewKeyRing(append([]byte{}, oldKey...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldRing.Destroy()
+	keys := NewFileDataKeyStore(t.TempDir())
+	payload := testPayload(300)
+	sealed, err := NewDataKeys(oldRing, keys).Seal("ab/cd/message-1", payload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newRing, err := NewKeyRing(testKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newRing.Destroy()
+	if err := newRing.AddPreviousKey(oldKey); err != nil {
+		t.Fatal(err)
+	}
+	rotated := NewDataKeys(newRing, keys)
+	if count, err := rotated.Rewrap(); err != nil || count != 1 {
+		t.Fatalf("Rewrap: got %d, %v, want 1 key", count, err)
+	}
+	if count, err := rotated.Rewrap(); err != nil || count != 0 {
+		t.Fatalf("second Rewrap: got %d, %v, want 0 keys", count, err)
+	}
+	got, err := rotated.Open("ab/cd/message-1", sealed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("payload changed after the rotation")
+	}
+}
+
+func FuzzDecompress(f *testing.F) {
+	payload := testPayload(2048)
+	for _, algorithm := range []string{CompressionGzip, CompressionZstd} {
+		compressor, _ := NewCompressor(algorithm)
+		compressed, _ := compressor.Compress(payload)
+		f.Add(compressed)
+	}
+	f.Add(payload)
+	f.Add(compressedMagic)
+	f.Add(append(append([]byte{}, compressedMagic...), algorithmGzip))
+	f.Add(append(append([]byte{}, compressedMagic...), algorithmZstd, 0x28, 0xb5, 0x2f, 0xfd))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		out, err := decompress(data)
+		if err != nil {
+			return
+		}
+		if !bytes.HasPrefix(data, compressedMagic) && !bytes.Equal(out, data) {
+			t.Fatal("uncompressed data changed")
+		}
+		if len(out) > maxDecompressedSize {
+			t.Fatalf("decompressed %d bytes, over the limit", len(out))
+		}
+	})
+}
+
+func FuzzOpen(f *testing.F) {
+	encryptor, err := NewEncryptor(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		f.Fatal(err)
+	}
+	sealed, _ := encryptor.Seal(testPayload(100), []byte("message-1"))
+	f.Add(sealed, []byte("message-1"))
+	f.Add(encryptedMagic, []byte{})
+	f.Add(testPayload(100), []byte("message-1"))
+	f.Add(addChecksum(sealed), []byte("message-1"))
+
+	f.Fuzz(func(t *testing.T, data, associatedData []byte) {
+		out, err := encryptor.Open(data, associatedData)
+		if err != nil {
+			return
+		}
+		if !bytes.HasPrefix(data, encryptedMagic) && !bytes.Equal(out, data) {
+			t.Fatal("plaintext data changed")
+		}
+	})
+}
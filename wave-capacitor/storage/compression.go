@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Supported compression algorithms for stored messages
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// compressedMagic prefixes every compressed payload, followed by one algorithm byte.
+// Payloads without it are stored uncompressed and returned as-is.
+var compressedMagic = []byte("WVZ1")
+
+const (
+	algorithmGzip byte = 1
+	algorithmZstd byte = 2
+)
+
+// minCompressSize skips compression for payloads too small to benefit from it
+const minCompressSize = 256
+
+// maxDecompressedSize bounds decompression so a damaged file can't exhaust memory
+const maxDecompressedSize = 64 * 1024 * 1024
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize), zstd.WithDecoderConcurrency(0))
+)
+
+// Compressor compresses message payloads before they are encrypted and stored
+type Compressor struct {
+	algorithm byte
+}
+
+// NewCompressor returns a compressor for the named algorithm, or nil for "none"
+func NewCompressor(algorithm string) (*Compressor, error) {
+	switch algorithm {
+	case CompressionNone, "":
+		return nil, nil
+	case CompressionGzip:
+		return &Compressor{algorithm: algorithmGzip}, nil
+	case CompressionZstd:
+		return &Compressor{algorithm: algorithmZstd}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm: %s", algorithm)
+	}
+}
+
+// Compress returns the framed compressed payload. Small or incompressible payloads,
+// and a nil Compressor, leave data unchanged.
+func (c *Compressor) Compress(data []byte) ([]byte, error) {
+	if c == nil || len(data) < minCompressSize {
+		return data, nil
+	}
+
+	out := make([]byte, 0, len(compressedMagic)+1+len(data)/2)
+	out = append(out, compressedMagic...)
+	out = append(out, c.algorithm)
+
+	switch c.algorithm {
+	case algorithmGzip:
+		buf := bytes.NewBuffer(out)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		out = buf.Bytes()
+	case algorithmZstd:
+		out = zstdEncoder.EncodeAll(data, out)
+	}
+
+	if len(out) >= len(data) {
+		return data, nil
+	}
+	return out, nil
+}
+
+// decompress reverses Compress, detecting the algorithm from the header
+func decompress(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, compressedMagic) {
+		return data, nil
+	}
+
+	body := data[len(compressedMagic):]
+	if len(body) == 0 {
+		return nil, errors.New("compressed data is truncated")
+	}
+
+	switch body[0] {
+	case algorithmGzip:
+		r, err := gzip.NewReader(bytes.NewReader(body[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress message: %v", err)
+		}
+		defer r.Close()
+
+		out, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress message: %v", err)
+		}
+		if len(out) > maxDecompressedSize {
+			return nil, errors.New("decompressed message exceeds size limit")
+		}
+		return out, nil
+	case algorithmZstd:
+		out, err := zstdDecoder.DecodeAll(body[1:], nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress message: %v", err)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown compression algorithm %d", body[0])
+	}
+}
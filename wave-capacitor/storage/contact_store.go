@@ -0,0 +1,507 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrContactNotFound is returned when a contact is not in the user's list
+var ErrContactNotFound = errors.New("contact not found")
+
+// Verification states of a contact
+const (
+	ContactUnverified = "unverified" // the owner hasn't compared safety numbers
+	ContactVerified   = "verified"   // the owner compared safety numbers with the contact
+	ContactChanged    = "changed"    // the contact rotated away from the key since it was added
+)
+
+// Contact is a single entry of a user's contact list
+type Contact struct {
+	PublicKey    string    `json:"public_key"`
+	Nickname     string    `json:"nickname"`
+	Verification string    `json:"verification,omitempty" doc:"unverified, verified or changed; lists stored before verification have none, which is unverified"`
+	CreatedAt    time.Time `json:"created_at,omitzero"`
+	ModifiedAt   time.Time `json:"modified_at,omitzero"`
+	Deleted      bool      `json:"deleted,omitempty" doc:"Set on the tombstone of a removed contact, which carries no nickname"`
+}
+
+// ContactStore persists users' contact lists one contact at a time
+type ContactStore interface {
+	// ListContacts returns the user's contacts, oldest first
+	ListContacts(ctx context.Context, username string) ([]Contact, error)
+	// ContactChanges returns the contacts added, changed or removed after since, the
+	// removed ones as tombstones, in the order they were modified
+	ContactChanges(ctx context.Context, username string, since time.Time) ([]Contact, error)
+	// PutContact adds a contact or updates its nickname; an existing contact keeps its
+	// verification state
+	PutContact(ctx context.Context, username string, contact Contact) error
+	// SetVerification sets the verification state of a contact, returning
+	// ErrContactNotFound if it isn't listed
+	SetVerification(ctx context.Context, username, publicKey, verification string) error
+	// DeleteContact removes a contact, leaving a tombstone, and returns ErrContactNotFound
+	// if it isn't listed
+	DeleteContact(ctx context.Context, username, publicKey string) error
+	// ReplaceContacts replaces the whole list (used when restoring backups), leaving
+	// tombstones of the contacts it drops
+	ReplaceContacts(ctx context.Context, username string, contacts []Contact) error
+	// PurgeTombstones forgets the user's contacts removed before before
+	PurgeTombstones(ctx context.Context, username string, before time.Time) error
+	// DeleteContacts removes the user's whole list; a missing list is not an error
+	DeleteContacts(ctx context.Context, username string) error
+}
+
+// ContactBlobStore persists each user's serialized contact list as a single blob
+type ContactBlobStore interface {
+	// LoadContacts returns the stored contact list, or nil if the user has none
+	LoadContacts(username string) ([]byte, error)
+	// SaveContacts replaces the stored contact list
+	SaveContacts(username string, data []byte) error
+	// DeleteContacts removes the stored contact list; a missing list is not an error
+	DeleteContacts(username string) error
+}
+
+// ContactRehasher is implemented by contact stores whose files are placed by the
+// confusion salt, so a salt rotation can move them
+type ContactRehasher interface {
+	// RehashContacts moves the user's contacts file to the folder of the current salt,
+	// reporting whether it had to be moved
+	RehashContacts(username string) (bool, error)
+}
+
+// BlobContactStore implements ContactStore on top of a ContactBlobStore by rewriting
+// the user's whole list on every change. Lists are sealed with the key ring when one is set.
+type BlobContactStore struct {
+	blobs   ContactBlobStore
+	keyRing *KeyRing // nil stores plaintext lists
+	locks   *KeyedMutex
+}
+
+// NewBlobContactStore wraps blobs; keyRing may be nil to leave lists unencrypted
+func NewBlobContactStore(blobs ContactBlobStore, keyRing *KeyRing) *BlobContactStore {
+	return &BlobContactStore{blobs: blobs, keyRing: keyRing, locks: NewKeyedMutex()}
+}
+
+// load reads and decodes the user's list, keyed by public key
+func (s *BlobContactStore) load(username string) (map[string]Contact, error) {
+	contacts := make(map[string]Contact)
+
+	data, err := s.blobs.LoadContacts(username)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decrypt contacts if they were stored encrypted
+	if IsEncrypted(data) {
+		if s.keyRing == nil {
+			return nil, errors.New("contacts file is encrypted but no master key is configured")
+		}
+		data, err = s.keyRing.Open(ContactsScope(username), data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &contacts); err != nil {
+			return nil, err
+		}
+	}
+	return contacts, nil
+}
+
+// save encodes, optionally seals, and stores the user's list
+func (s *BlobContactStore) save(username string, contacts map[string]Contact) error {
+	data, err := json.MarshalIndent(contacts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if s.keyRing != nil {
+		data, err = s.keyRing.Seal(ContactsScope(username), data)
+		if err != nil {
+			return err
+		}
+	}
+	return s.blobs.SaveContacts(username, data)
+}
+
+// ListContacts returns the user's contacts, oldest first
+func (s *BlobContactStore) ListContacts(_ context.Context, username string) ([]Contact, error) {
+	contacts, err := s.load(username)
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]Contact, 0, len(contacts))
+	for _, contact := range contacts {
+		if !contact.Deleted {
+			list = append(list, contact)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].CreatedAt.Equal(list[j].CreatedAt) {
+			return list[i].CreatedAt.Before(list[j].CreatedAt)
+		}
+		return list[i].PublicKey < list[j].PublicKey
+	})
+	return list, nil
+}
+
+// ContactChanges returns the contacts and tombstones modified after since
+func (s *BlobContactStore) ContactChanges(_ context.Context, username string, since time.Time) ([]Contact, error) {
+	contacts, err := s.load(username)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []Contact{}
+	for _, contact := range contacts {
+		if contact.ModifiedAt.After(since) {
+			changes = append(changes, contact)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if !changes[i].ModifiedAt.Equal(changes[j].ModifiedAt) {
+			return changes[i].ModifiedAt.Before(changes[j].ModifiedAt)
+		}
+		return changes[i].PublicKey < changes[j].PublicKey
+	})
+	return changes, nil
+}
+
+// PutContact adds a contact or updates its nickname; an existing contact keeps its
+// verification state
+func (s *BlobContactStore) PutContact(_ context.Context, username string, contact Contact) error {
+	unlock := s.locks.Lock(username)
+	defer unlock()
+
+	contacts, err := s.load(username)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if existing, ok := contacts[contact.PublicKey]; ok && !existing.Deleted {
+		contact.CreatedAt = existing.CreatedAt
+		contact.Verification = existing.Verification
+	} else if contact.CreatedAt.IsZero() {
+		contact.CreatedAt = now
+	}
+	contact.ModifiedAt = now
+	contact.Deleted = false
+	contacts[contact.PublicKey] = contact
+	return s.save(username, contacts)
+}
+
+// SetVerification sets the verification state of a single contact
+func (s *BlobContactStore) SetVerification(_ context.Context, username, publicKey, verification string) error {
+	unlock := s.locks.Lock(username)
+	defer unlock()
+
+	contacts, err := s.load(username)
+	if err != nil {
+		return err
+	}
+	contact, ok := contacts[publicKey]
+	if !ok || contact.Deleted {
+		return ErrContactNotFound
+	}
+	contact.Verification = verification
+	contact.ModifiedAt = time.Now().UTC()
+	contacts[publicKey] = contact
+	return s.save(username, contacts)
+}
+
+// DeleteContact replaces a single contact with its tombstone
+func (s *BlobContactStore) DeleteContact(_ context.Context, username, publicKey string) error {
+	unlock := s.locks.Lock(username)
+	defer unlock()
+
+	contacts, err := s.load(username)
+	if err != nil {
+		return err
+	}
+	if contact, ok := contacts[publicKey]; !ok || contact.Deleted {
+		return ErrContactNotFound
+	}
+	contacts[publicKey] = tombstone(publicKey, time.Now().UTC())
+	return s.save(username, contacts)
+}
+
+// ReplaceContacts replaces the user's whole list
+func (s *BlobContactStore) ReplaceContacts(_ context.Context, username string, list []Contact) error {
+	unlock := s.locks.Lock(username)
+	defer unlock()
+
+	contacts, err := s.load(username)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for publicKey, contact := range contacts {
+		if !contact.Deleted {
+			contacts[publicKey] = tombstone(publicKey, now)
+		}
+	}
+	for _, contact := range list {
+		contact.ModifiedAt = now
+		contact.Deleted = false
+		contacts[contact.PublicKey] = contact
+	}
+	return s.save(username, contacts)
+}
+
+// PurgeTombstones drops the tombstones of contacts removed before before
+func (s *BlobContactStore) PurgeTombstones(_ context.Context, username string, before time.Time) error {
+	unlock := s.locks.Lock(username)
+	defer unlock()
+
+	contacts, err := s.load(username)
+	if err != nil {
+		return err
+	}
+	purged := false
+	for publicKey, contact := range contacts {
+		if contact.Deleted && contact.ModifiedAt.Before(before) {
+			delete(contacts, publicKey)
+			purged = true
+		}
+	}
+	if !purged {
+		return nil
+	}
+	return s.save(username, contacts)
+}
+
+// tombstone is what remains of a removed contact
+func tombstone(publicKey string, removedAt time.Time) Contact {
+	return Contact{PublicKey: publicKey, ModifiedAt: removedAt, Deleted: true}
+}
+
+// DeleteContacts removes the user's whole list
+func (s *BlobContactStore) DeleteContacts(_ context.Context, username string) error {
+	unlock := s.locks.Lock(username)
+	defer unlock()
+
+	return s.blobs.DeleteContacts(username)
+}
+
+// RehashContacts moves the user's list to the folder of the current salt when the
+// underlying blobs are placed by it
+func (s *BlobContactStore) RehashContacts(username string) (bool, error) {
+	rehasher, ok := s.blobs.(ContactRehasher)
+	if !ok {
+		return false, nil
+	}
+	unlock := s.locks.Lock(username)
+	defer unlock()
+	return rehasher.RehashContacts(username)
+}
+
+// contactsFileName is the name of the contacts file in a user's folder
+const contactsFileName = "contacts.json"
+
+// FileContactStore stores each user's contacts file in a folder named like a message
+// folder, after a salted hash of the username, so the directory doesn't reveal account
+// names. Files named after the username, as earlier versions wrote them, are still read
+// until MigrateFlatFiles or the next change moves them.
+type FileContactStore struct {
+	dir    string
+	shards *ShardManager
+}
+
+// NewFileContactStore creates a file-backed contact store in dir, deriving folder names
+// from the current folder derivation settings
+func NewFileContactStore(dir string) *FileContactStore {
+	return &FileContactStore{dir: dir, shards: NewShardManager(dir)}
+}
+
+// contactsFolderKey is hashed into the folder of username; the prefix keeps the folder
+// names unrelated to those of message folders
+func contactsFolderKey(username string) string {
+	return "contacts:" + username
+}
+
+// LoadContacts reads the user's contacts file
+func (s *FileContactStore) LoadContacts(username string) ([]byte, error) {
+	current, others, err := s.paths(username)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range append([]string{current}, others...) {
+		data, err := ReadFileLimited(path, maxContactsFileSize)
+		if os.IsNotExist(err) {
+			continue
+		}
+		return data, err
+	}
+	return nil, nil
+}
+
+// SaveContacts writes the user's contacts file into the user's current folder, removing
+// copies left where an earlier shard count, salt or version put it
+func (s *FileContactStore) SaveContacts(username string, data []byte) error {
+	current, others, err := s.paths(username)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(current), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(current, data, 0600); err != nil {
+		return err
+	}
+	return s.remove(others)
+}
+
+// DeleteContacts removes the user's contacts file
+func (s *FileContactStore) DeleteContacts(username string) error {
+	current, others, err := s.paths(username)
+	if err != nil {
+		return err
+	}
+	return s.remove(append([]string{current}, others...))
+}
+
+// Count returns how many contacts files the directory holds
+func (s *FileContactStore) Count() (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	count := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			if filepath.Ext(entry.Name()) == ".json" {
+				count++
+			}
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(s.dir, entry.Name(), contactsFileName)); err == nil {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// MigrateFlatFiles moves the <username>.json files of earlier versions into the users'
+// hashed folders and returns how many it moved. A file the user's folder already has a
+// newer copy of is removed.
+func (s *FileContactStore) MigrateFlatFiles() (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	moved := 0
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		username := strings.TrimSuffix(entry.Name(), ".json")
+		current, _, err := s.paths(username)
+		if err != nil {
+			continue // Not a contacts file
+		}
+		flat := filepath.Join(s.dir, entry.Name())
+		if _, err := os.Stat(current); err == nil {
+			if err := os.Remove(flat); err != nil {
+				return moved, err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(current), 0755); err != nil {
+			return moved, err
+		}
+		if err := os.Rename(flat, current); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// RehashContacts moves the user's contacts file into the user's current folder
+func (s *FileContactStore) RehashContacts(username string) (bool, error) {
+	current, others, err := s.paths(username)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(current); err == nil {
+		return false, nil
+	}
+	for _, path := range others {
+		data, err := ReadFileLimited(path, maxContactsFileSize)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		return true, s.SaveContacts(username, data)
+	}
+	return false, nil
+}
+
+// paths returns where the user's contacts file belongs, then where else it may be: the
+// folders of other shard counts and of the previous confusion salt, and the file named
+// after the username. Usernames that would escape the directory are rejected.
+func (s *FileContactStore) paths(username string) (string, []string, error) {
+	if err := validateMessageID(username); err != nil {
+		return "", nil, fmt.Errorf("invalid username: %q", username)
+	}
+	key := contactsFolderKey(username)
+	current := filepath.Join(s.shards.GetFolderForKey(key), contactsFileName)
+
+	salts := []string{s.shards.confusionSalt}
+	if s.shards.previousSalt != "" && s.shards.previousSalt != s.shards.confusionSalt {
+		salts = append(salts, s.shards.previousSalt)
+	}
+	var others []string
+	for _, salt := range salts {
+		// Without sharding the folder is the bare hash prefix, with it the prefix and a
+		// shard suffix
+		base := s.shards.folderFor(key, salt, 1)
+		folders, err := filepath.Glob(base + "_*")
+		if err != nil {
+			return "", nil, err
+		}
+		for _, folder := range append([]string{base}, folders...) {
+			if path := filepath.Join(folder, contactsFileName); path != current {
+				others = append(others, path)
+			}
+		}
+	}
+	others = append(others, filepath.Join(s.dir, username+".json"))
+	return current, others, nil
+}
+
+// remove deletes the given contacts files and the folders they leave empty
+func (s *FileContactStore) remove(paths []string) error {
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		if dir := filepath.Dir(path); dir != filepath.Clean(s.dir) {
+			os.Remove(dir) // Fails while the folder holds anything else
+		}
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"wave_capacitor/utils"
+)
+
+// dataKeyMagic prefixes message files encrypted with their own data key.
+// Layout: magic | nonce | ciphertext, with the wrapped data key kept in a DataKeyStore.
+var dataKeyMagic = []byte("WVE2")
+
+// wrappedKeyMagic prefixes a stored data key. Layout: magic | master key ID | nonce | wrapped key
+var wrappedKeyMagic = []byte("WVK1")
+
+// dataKeyScope is the key ring scope of the key-encryption key that wraps data keys
+const dataKeyScope = "data-keys"
+
+// keyIDSize is the length of the master key fingerprint stored with each wrapped data key
+const keyIDSize = 8
+
+// ErrDataKeyNotFound is returned when a message's data key is missing, e.g. after it was shredded
+var ErrDataKeyNotFound = errors.New("data key not found")
+
+// DataKeyStore persists wrapped per-message data keys, separately from the messages themselves,
+// so deleting a key makes every copy of the message (backups, cold storage) unreadable
+type DataKeyStore interface {
+	PutKey(id string, wrapped []byte) error
+	GetKey(id string) ([]byte, error)
+	DeleteKey(id string) error
+	ListKeys() ([]string, error)
+}
+
+// FileDataKeyStore stores each wrapped data key as a small file below a directory
+type FileDataKeyStore struct {
+	dir string
+}
+
+// NewFileDataKeyStore creates a file-backed data key store rooted at dir
+func NewFileDataKeyStore(dir string) *FileDataKeyStore {
+	return &FileDataKeyStore{dir: dir}
+}
+
+// PutKey writes the wrapped key atomically
+func (s *FileDataKeyStore) PutKey(id string, wrapped []byte) error {
+	path, err := s.pathFor(id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, wrapped, 0600)
+}
+
+// GetKey reads the wrapped key
+func (s *FileDataKeyStore) GetKey(id string) ([]byte, error) {
+	path, err := s.pathFor(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ReadFileLimited(path, maxDataKeyFileSize)
+	if os.IsNotExist(err) {
+		return nil, ErrDataKeyNotFound
+	}
+	return data, err
+}
+
+// DeleteKey removes the wrapped key
+func (s *FileDataKeyStore) DeleteKey(id string) error {
+	path, err := s.pathFor(id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrDataKeyNotFound
+	}
+	return err
+}
+
+// ListKeys returns the IDs of all stored keys
+func (s *FileDataKeyStore) ListKeys() ([]string, error) {
+	var ids []string
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == s.dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".key" {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, strings.TrimSuffix(filepath.ToSlash(rel), ".key"))
+		return nil
+	})
+	return ids, err
+}
+
+// pathFor maps a key ID to its file, rejecting IDs that escape the directory
+func (s *FileDataKeyStore) pathFor(id string) (string, error) {
+	if err := validateBlobKey(id); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(id)+".key"), nil
+}
+
+// DataKeys encrypts each message with its own random data key, wrapped by a key
+// derived from the node master key
+type DataKeys struct {
+	keyRing *KeyRing
+	store   DataKeyStore
+}
+
+// NewDataKeys creates a data key manager storing wrapped keys in store
+func NewDataKeys(keyRing *KeyRing, store DataKeyStore) *DataKeys {
+	return &DataKeys{keyRing: keyRing, store: store}
+}
+
+// dataKeyID returns the data key ID of a message; it is stable across storage tiers
+func dataKeyID(folder, messageID string) string {
+	return folder + "/" + messageID
+}
+
+// Seal generates a fresh data key for id, stores it wrapped, and encrypts plaintext with it
+func (d *DataKeys) Seal(id string, plaintext, associatedData []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %v", err)
+	}
+	defer utils.Zeroize(dataKey)
+
+	wrapped, err := d.wrap(id, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.store.PutKey(id, wrapped); err != nil {
+		return nil, fmt.Errorf("failed to store data key: %v", err)
+	}
+
+	aead, err := utils.NewAESGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(dataKeyMagic)+len(plaintext)+aead.Overhead())
+	out = append(out, dataKeyMagic...)
+	return aead.SealTo(out, plaintext, associatedData)
+}
+
+// Open decrypts data produced by Seal using the stored data key for id
+func (d *DataKeys) Open(id string, data, associatedData []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, dataKeyMagic) {
+		return nil, errors.New("data is not encrypted with a data key")
+	}
+
+	wrapped, err := d.store.GetKey(id)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, _, err := d.unwrap(id, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	defer utils.Zeroize(dataKey)
+
+	aead, err := utils.NewAESGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(data[len(dataKeyMagic):], associatedData)
+}
+
+// Shred deletes the data key for id, making any remaining copy of the message unrecoverable
+func (d *DataKeys) Shred(id string) error {
+	err := d.store.DeleteKey(id)
+	if err == ErrDataKeyNotFound {
+		return nil
+	}
+	return err
+}
+
+// Rewrap re-wraps every data key not wrapped with the current master key.
+// Run it after rotating the master key (with the old key registered as a previous key);
+// message files themselves are not rewritten. It returns the number of keys re-wrapped.
+func (d *DataKeys) Rewrap() (int, error) {
+	_, currentID, err := d.keyRing.wrapEncryptor()
+	if err != nil {
+		return 0, err
+	}
+
+	ids, err := d.store.ListKeys()
+	if err != nil {
+		return 0, err
+	}
+
+	rewrapped := 0
+	for _, id := range ids {
+		wrapped, err := d.store.GetKey(id)
+		if err != nil {
+			return rewrapped, fmt.Errorf("failed to read data key %s: %v", id, err)
+		}
+
+		dataKey, wrappedID, err := d.unwrap(id, wrapped)
+		if err != nil {
+			return rewrapped, fmt.Errorf("failed to unwrap data key %s: %v", id, err)
+		}
+		if bytes.Equal(wrappedID, currentID) {
+			utils.Zeroize(dataKey)
+			continue
+		}
+
+		rewrappedKey, err := d.wrap(id, dataKey)
+		utils.Zeroize(dataKey)
+		if err != nil {
+			return rewrapped, err
+		}
+		if err := d.store.PutKey(id, rewrappedKey); err != nil {
+			return rewrapped, fmt.Errorf("failed to store data key %s: %v", id, err)
+		}
+		rewrapped++
+	}
+
+	return rewrapped, nil
+}
+
+// wrap encrypts a data key under the current master key, bound to its ID
+func (d *DataKeys) wrap(id string, dataKey []byte) ([]byte, error) {
+	encryptor, masterID, err := d.keyRing.wrapEncryptor()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(wrappedKeyMagic)+keyIDSize+len(dataKey)+encryptor.aead.Overhead())
+	out = append(out, wrappedKeyMagic...)
+	out = append(out, masterID...)
+	return encryptor.aead.SealTo(out, dataKey, []byte(id))
+}
+
+// unwrap decrypts a stored data key, returning it with the ID of the master key that wrapped it
+func (d *DataKeys) unwrap(id string, wrapped []byte) ([]byte, []byte, error) {
+	if !bytes.HasPrefix(wrapped, wrappedKeyMagic) || len(wrapped) < len(wrappedKeyMagic)+keyIDSize {
+		return nil, nil, errors.New("invalid wrapped data key")
+	}
+
+	body := wrapped[len(wrappedKeyMagic):]
+	masterID := body[:keyIDSize]
+	encryptor, err := d.keyRing.unwrapEncryptor(masterID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dataKey, err := encryptor.aead.Open(body[keyIDSize:], []byte(id))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unwrap data key: %v", err)
+	}
+	return dataKey, masterID, nil
+}
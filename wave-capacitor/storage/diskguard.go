@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrInsufficientStorage is returned when a write would cross the free-space low-water mark
+var ErrInsufficientStorage = errors.New("insufficient storage")
+
+// diskCheckInterval is how long a free-space measurement is reused before statfs is called again
+const diskCheckInterval = 5 * time.Second
+
+// DiskUsage describes the space available on the filesystem holding a path
+type DiskUsage struct {
+	TotalBytes uint64 `json:"total_bytes"`
+	FreeBytes  uint64 `json:"free_bytes"`
+}
+
+// FreePercent returns the free space as a percentage of the total
+func (u DiskUsage) FreePercent() float64 {
+	if u.TotalBytes == 0 {
+		return 100
+	}
+	return float64(u.FreeBytes) / float64(u.TotalBytes) * 100
+}
+
+// DiskGuard rejects writes once free space on the data volume drops below a low-water mark,
+// so requests fail fast and clearly instead of mid-write
+type DiskGuard struct {
+	path           string
+	minFreeBytes   uint64
+	minFreePercent float64
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	usage     DiskUsage
+	low       bool
+	err       error
+}
+
+// NewDiskGuard creates a guard for the filesystem holding path. A write is refused when
+// free space falls below minFreeBytes or minFreePercent; a zero value disables that limit.
+func NewDiskGuard(path string, minFreeBytes uint64, minFreePercent float64) *DiskGuard {
+	return &DiskGuard{path: path, minFreeBytes: minFreeBytes, minFreePercent: minFreePercent}
+}
+
+// Check returns ErrInsufficientStorage if free space is below the low-water mark.
+// A nil guard never rejects writes.
+func (g *DiskGuard) Check() error {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if time.Since(g.checkedAt) >= diskCheckInterval {
+		g.refresh()
+	}
+	if g.err != nil {
+		// Measuring free space failed; don't block writes on a monitoring error
+		return nil
+	}
+	if g.low {
+		return fmt.Errorf("%w: %d bytes free (%.1f%%)", ErrInsufficientStorage, g.usage.FreeBytes, g.usage.FreePercent())
+	}
+	return nil
+}
+
+// Usage returns the most recent free-space measurement
+func (g *DiskGuard) Usage() (DiskUsage, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if time.Since(g.checkedAt) >= diskCheckInterval {
+		g.refresh()
+	}
+	return g.usage, g.err
+}
+
+// refresh measures free space and logs an alert when the low-water mark is crossed; g.mu must be held
+func (g *DiskGuard) refresh() {
+	g.checkedAt = time.Now()
+
+	usage, err := diskUsage(g.path)
+	if err != nil {
+		if g.err == nil {
+			logger.Warn(context.Background(), "unable to measure free disk space", "path", g.path, "error", err)
+		}
+		g.err = err
+		return
+	}
+	g.err = nil
+	g.usage = usage
+
+	low := (g.minFreeBytes > 0 && usage.FreeBytes < g.minFreeBytes) ||
+		(g.minFreePercent > 0 && usage.FreePercent() < g.minFreePercent)
+
+	if low && !g.low {
+		logger.Error(context.Background(), "free disk space below low-water mark, rejecting new writes",
+			"path", g.path, "free_bytes", usage.FreeBytes, "free_percent", usage.FreePercent())
+	} else if !low && g.low {
+		logger.Info(context.Background(), "free disk space recovered, accepting writes again",
+			"path", g.path, "free_bytes", usage.FreeBytes, "free_percent", usage.FreePercent())
+	}
+	g.low = low
+}
+
+// ProbeWritable checks that dir accepts writes by creating, syncing and removing a small file
+func ProbeWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write([]byte("ok")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"wave_capacitor/utils"
+)
+
+// encryptedMagic prefixes every file sealed with the node master key.
+// Files without it are treated as legacy plaintext and returned as-is.
+var encryptedMagic = []byte("WVE1")
+
+// folderBoundMagic prefixes message files sealed with the node master key whose associated
+// data binds the owner's folder as well as the message ID, so that a file copied into
+// another mailbox doesn't open. Layout as encryptedMagic; files sealed before keep it.
+var folderBoundMagic = []byte("WVE3")
+
+// Encryptor seals and opens stored files with the node master key (AES-256-GCM)
+type Encryptor struct {
+	aead *utils.AEAD
+}
+
+// NewEncryptor creates an Encryptor from a 32-byte master key
+func NewEncryptor(masterKey []byte) (*Encryptor, error) {
+	aead, err := utils.NewAESGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Encryptor{aead: aead}, nil
+}
+
+// Seal encrypts plaintext, binding it to the given associated data (e.g. the message ID)
+// Output layout: magic | nonce | ciphertext
+func (e *Encryptor) Seal(plaintext, associatedData []byte) ([]byte, error) {
+	return e.sealWith(encryptedMagic, plaintext, associatedData)
+}
+
+// Open decrypts data produced by Seal. Data without the magic header is returned unchanged
+// so that files written before encryption was enabled remain readable.
+func (e *Encryptor) Open(data, associatedData []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptedMagic) {
+		return data, nil
+	}
+	return e.openWith(encryptedMagic, data, associatedData)
+}
+
+// sealMessage seals a message file of the owner's folder
+func (e *Encryptor) sealMessage(folder, messageID string, plaintext []byte) ([]byte, error) {
+	return e.sealWith(folderBoundMagic, plaintext, messageAssociatedData(folder, messageID))
+}
+
+// openMessage opens a message file of the owner's folder sealed by sealMessage, or by
+// Seal with the message ID alone before files were bound to their folder
+func (e *Encryptor) openMessage(folder, messageID string, data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, folderBoundMagic) {
+		return e.openWith(folderBoundMagic, data, messageAssociatedData(folder, messageID))
+	}
+	return e.Open(data, []byte(messageID))
+}
+
+// messageAssociatedData binds a message file to its folder and ID; folder names never
+// hold a NUL, so the separator can't be forged
+func messageAssociatedData(folder, messageID string) []byte {
+	return []byte(folder + "\x00" + messageID)
+}
+
+// sealWith encrypts plaintext behind magic. Output layout: magic | nonce | ciphertext
+func (e *Encryptor) sealWith(magic, plaintext, associatedData []byte) ([]byte, error) {
+	out := make([]byte, 0, len(magic)+len(plaintext)+e.aead.Overhead())
+	out = append(out, magic...)
+	return e.aead.SealTo(out, plaintext, associatedData)
+}
+
+// openWith decrypts data sealed by sealWith with magic
+func (e *Encryptor) openWith(magic, data, associatedData []byte) ([]byte, error) {
+	body := data[len(magic):]
+	if len(body) < e.aead.Overhead() {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	return e.aead.Open(body, associatedData)
+}
+
+// IsEncrypted reports whether data carries an at-rest encryption header,
+// either sealed with the master key or with a per-file data key
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic) || bytes.HasPrefix(data, folderBoundMagic) ||
+		bytes.HasPrefix(data, dataKeyMagic)
+}
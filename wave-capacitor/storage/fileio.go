@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Files read whole into memory are read into buffers taken from a pool, which the
+// callers release once they are done with the bytes, and refused beyond a size cap
+// rather than read however large they grew.
+
+// maxMessageFileSize caps the message files read from disk: the largest message with the
+// checksum, encryption and compression framing around it
+const maxMessageFileSize = maxDecompressedSize + 64*1024
+
+// maxContactsFileSize caps a contacts file, stored like a message as one encrypted document
+const maxContactsFileSize = maxMessageFileSize
+
+// maxDataKeyFileSize caps a wrapped data key file, a few hundred bytes when intact
+const maxDataKeyFileSize = 64 * 1024
+
+// maxPooledBuffer is the largest buffer kept in the pool; larger ones are left to the
+// garbage collector so that one large file doesn't pin its memory
+const maxPooledBuffer = 1024 * 1024
+
+// ErrFileTooLarge is returned for files over the size cap of a read
+var ErrFileTooLarge = errors.New("file exceeds size limit")
+
+// fileBuffers pools the buffers files are read into
+var fileBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// PooledBuffer holds bytes read into a pooled buffer
+type PooledBuffer struct {
+	buf *bytes.Buffer
+}
+
+// Bytes returns the bytes read; they must not be used after Release
+func (b *PooledBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// Release returns the buffer to the pool
+func (b *PooledBuffer) Release() {
+	if b.buf == nil {
+		return
+	}
+	if b.buf.Cap() <= maxPooledBuffer {
+		b.buf.Reset()
+		fileBuffers.Put(b.buf)
+	}
+	b.buf = nil
+}
+
+// ReadFilePooled reads the file at path, of at most limit bytes, into a pooled buffer.
+// Errors opening the file are returned as they are, so os.IsNotExist applies to them.
+func ReadFilePooled(path string, limit int64) (*PooledBuffer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > limit {
+		return nil, fmt.Errorf("%w: %s has %d bytes", ErrFileTooLarge, path, info.Size())
+	}
+	return readPooled(f, limit, info.Size())
+}
+
+// ReadAllPooled reads r, up to limit bytes, into a pooled buffer
+func ReadAllPooled(r io.Reader, limit int64) (*PooledBuffer, error) {
+	return readPooled(r, limit, 0)
+}
+
+// ReadFileLimited reads the file at path, of at most limit bytes, into memory of its own
+func ReadFileLimited(path string, limit int64) ([]byte, error) {
+	pooled, err := ReadFilePooled(path, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer pooled.Release()
+	return bytes.Clone(pooled.Bytes()), nil
+}
+
+// readPooled reads r into a pooled buffer sized for the expected number of bytes
+func readPooled(r io.Reader, limit, expected int64) (*PooledBuffer, error) {
+	buf := fileBuffers.Get().(*bytes.Buffer)
+	pooled := &PooledBuffer{buf: buf}
+	// One byte more than expected lets ReadFrom see the end without growing the buffer
+	buf.Grow(int(min(expected, limit)) + bytes.MinRead)
+	n, err := buf.ReadFrom(io.LimitReader(r, limit+1))
+	if err != nil {
+		pooled.Release()
+		return nil, err
+	}
+	if n > limit {
+		pooled.Release()
+		return nil, fmt.Errorf("%w: more than %d bytes", ErrFileTooLarge, limit)
+	}
+	return pooled, nil
+}
+
+// sharesBuffer reports whether data points into buf's memory, as the slices of buf that
+// reach the end of its capacity do
+func sharesBuffer(data, buf []byte) bool {
+	if cap(data) == 0 || cap(buf) == 0 {
+		return false
+	}
+	return &data[:cap(data)][cap(data)-1] == &buf[:cap(buf)][cap(buf)-1]
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd)
+
+package storage
+
+import "os"
+
+// flock is a no-op on platforms without flock; the in-process lock still applies
+func flock(f *os.File) error {
+	return nil
+}
+
+// funlock is a no-op on platforms without flock
+func funlock(f *os.File) {}
@@ -0,0 +1,28 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// flock takes an exclusive advisory lock on f, blocking until it is available
+func flock(f *os.File) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to lock %s: %v", f.Name(), err)
+		}
+		return nil
+	}
+}
+
+// funlock releases the advisory lock on f
+func funlock(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"wave_capacitor/utils"
+)
+
+// KeyRing derives purpose-specific encryption keys from the node master key,
+// so that a key leaked for one scope (e.g. one user's contacts) reveals nothing about others.
+type KeyRing struct {
+	masterKey    *utils.LockedBuffer
+	previousKeys []*utils.LockedBuffer // Retired master keys, kept only to unwrap old data keys
+}
+
+// NewKeyRing creates a KeyRing from a 32-byte master key.
+// The key is moved into locked memory and the caller's slice is zeroized.
+func NewKeyRing(masterKey []byte) (*KeyRing, error) {
+	if len(masterKey) != 32 {
+		return nil, errors.New("master key must be exactly 32 bytes")
+	}
+	locked, err := utils.NewLockedBufferFrom(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyRing{masterKey: locked}, nil
+}
+
+// AddPreviousKey registers a retired 32-byte master key so data keys wrapped with it
+// can still be unwrapped and re-wrapped with the current key
+func (k *KeyRing) AddPreviousKey(masterKey []byte) error {
+	if len(masterKey) != 32 {
+		return errors.New("previous master key must be exactly 32 bytes")
+	}
+	locked, err := utils.NewLockedBufferFrom(masterKey)
+	if err != nil {
+		return err
+	}
+	k.previousKeys = append(k.previousKeys, locked)
+	return nil
+}
+
+// Destroy wipes the master key and any previous keys from memory once the derivations
+// using them finished; afterwards the KeyRing fails with utils.ErrBufferDestroyed
+func (k *KeyRing) Destroy() {
+	k.masterKey.Destroy()
+	for _, key := range k.previousKeys {
+		key.Destroy()
+	}
+}
+
+// MasterEncryptor returns an Encryptor keyed directly with the master key (used for message files)
+func (k *KeyRing) MasterEncryptor() (*Encryptor, error) {
+	var encryptor *Encryptor
+	err := k.masterKey.Use(func(masterKey []byte) (err error) {
+		encryptor, err = NewEncryptor(masterKey)
+		return err
+	})
+	return encryptor, err
+}
+
+// EncryptorFor returns an Encryptor keyed for the given scope
+func (k *KeyRing) EncryptorFor(scope string) (*Encryptor, error) {
+	var encryptor *Encryptor
+	err := k.masterKey.Use(func(masterKey []byte) (err error) {
+		encryptor, err = deriveEncryptor(masterKey, scope)
+		return err
+	})
+	return encryptor, err
+}
+
+// wrapEncryptor returns the Encryptor that wraps data keys under the current master key,
+// together with that key's ID
+func (k *KeyRing) wrapEncryptor() (*Encryptor, []byte, error) {
+	var encryptor *Encryptor
+	var id []byte
+	err := k.masterKey.Use(func(masterKey []byte) (err error) {
+		if id, err = keyID(masterKey); err != nil {
+			return err
+		}
+		encryptor, err = deriveEncryptor(masterKey, dataKeyScope)
+		return err
+	})
+	return encryptor, id, err
+}
+
+// unwrapEncryptor returns the data-key wrapping Encryptor for the master key with the given ID
+func (k *KeyRing) unwrapEncryptor(id []byte) (*Encryptor, error) {
+	for _, key := range append([]*utils.LockedBuffer{k.masterKey}, k.previousKeys...) {
+		var encryptor *Encryptor
+		err := key.Use(func(masterKey []byte) error {
+			candidate, err := keyID(masterKey)
+			if err != nil || !utils.ConstantTimeEqual(candidate, id) {
+				return err
+			}
+			encryptor, err = deriveEncryptor(masterKey, dataKeyScope)
+			return err
+		})
+		if err != nil || encryptor != nil {
+			return encryptor, err
+		}
+	}
+	return nil, errors.New("data key was wrapped with an unknown master key")
+}
+
+// keyID returns a short fingerprint identifying a master key without revealing it
+func keyID(masterKey []byte) ([]byte, error) {
+	return utils.DeriveKey(masterKey, nil, "wave-capacitor key-id", keyIDSize)
+}
+
+// deriveEncryptor returns an Encryptor keyed for scope under the given master key
+func deriveEncryptor(masterKey []byte, scope string) (*Encryptor, error) {
+	key, err := utils.DeriveKey(masterKey, nil, "wave-capacitor "+scope, 32)
+	if err != nil {
+		return nil, fmt.Errorf("key derivation failed: %v", err)
+	}
+	// The cipher keeps its own key schedule, so the derived key can be wiped immediately
+	defer utils.Zeroize(key)
+	return NewEncryptor(key)
+}
+
+// Seal encrypts plaintext with the scope's derived key, binding the scope as associated data
+func (k *KeyRing) Seal(scope string, plaintext []byte) ([]byte, error) {
+	encryptor, err := k.EncryptorFor(scope)
+	if err != nil {
+		return nil, err
+	}
+	return encryptor.Seal(plaintext, []byte(scope))
+}
+
+// Open decrypts data sealed for the scope; unencrypted data is returned unchanged
+func (k *KeyRing) Open(scope string, data []byte) ([]byte, error) {
+	encryptor, err := k.EncryptorFor(scope)
+	if err != nil {
+		return nil, err
+	}
+	return encryptor.Open(data, []byte(scope))
+}
+
+// MAC returns the HMAC-SHA256 of data under a key derived for the scope, so that values
+// kept sealed can still be looked up by equality
+func (k *KeyRing) MAC(scope string, data []byte) ([]byte, error) {
+	var key []byte
+	err := k.masterKey.Use(func(masterKey []byte) (err error) {
+		key, err = utils.DeriveKey(masterKey, nil, "wave-capacitor mac "+scope, 32)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("key derivation failed: %v", err)
+	}
+	defer utils.Zeroize(key)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// ContactsScope returns the key scope used for a user's contacts file
+func ContactsScope(username string) string {
+	return "contacts/" + username
+}
+
+// EncryptContacts encrypts the plaintext contacts files of the given users in place.
+// It returns the number of files that were converted.
+func EncryptContacts(files *FileContactStore, usernames []string, keyRing *KeyRing) (int, error) {
+	converted := 0
+	for _, username := range usernames {
+		data, err := files.LoadContacts(username)
+		if err != nil {
+			return converted, fmt.Errorf("failed to read contacts of %s: %v", username, err)
+		}
+		if data == nil || IsEncrypted(data) {
+			continue
+		}
+
+		sealed, err := keyRing.Seal(ContactsScope(username), data)
+		if err != nil {
+			return converted, fmt.Errorf("failed to encrypt contacts of %s: %v", username, err)
+		}
+		// SaveContacts replaces the file atomically, so a crash never leaves it half-written
+		if err := files.SaveContacts(username, sealed); err != nil {
+			return converted, fmt.Errorf("failed to write contacts of %s: %v", username, err)
+		}
+		converted++
+	}
+
+	return converted, nil
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// lockFileName is the per-folder lock file used to serialize writers across processes
+const lockFileName = ".lock"
+
+// KeyedMutex hands out one mutex per key, so writers to different folders never block each other.
+// Entries are reference counted and removed once no goroutine holds or waits on them.
+type KeyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// NewKeyedMutex creates an empty KeyedMutex
+func NewKeyedMutex() *KeyedMutex {
+	return &KeyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+// Lock acquires the mutex for key and returns the function that releases it
+func (k *KeyedMutex) Lock(key string) func() {
+	k.mu.Lock()
+	lock, ok := k.locks[key]
+	if !ok {
+		lock = &keyedLock{}
+		k.locks[key] = lock
+	}
+	lock.refs++
+	k.mu.Unlock()
+
+	lock.mu.Lock()
+
+	return func() {
+		lock.mu.Unlock()
+
+		k.mu.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// folderLocks serializes writers to the same folder within this process
+var folderLocks = NewKeyedMutex()
+
+// LockFolder takes an exclusive lock on folder, both in-process and via an advisory
+// file lock so that several capacitor processes sharing a volume don't race.
+// The folder is created if needed. Call the returned function to release the lock.
+func LockFolder(folder string) (func(), error) {
+	unlockLocal := folderLocks.Lock(folder)
+
+	if err := EnsureDirectoryExists(folder); err != nil {
+		unlockLocal()
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(folder, lockFileName), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		unlockLocal()
+		return nil, err
+	}
+	if err := flock(f); err != nil {
+		f.Close()
+		unlockLocal()
+		return nil, err
+	}
+
+	return func() {
+		funlock(f)
+		f.Close()
+		unlockLocal()
+	}, nil
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory and renames it
+// into place, so readers never observe a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Locker is a Wave locker node offering blob storage
+type Locker struct {
+	ID  string // stable node ID, used to place blobs
+	URL string // base URL of its API, e.g. https://10.0.0.5:8080
+}
+
+// LockerBlobStore stores blobs on Wave locker nodes through their blob API
+// (PUT, GET and DELETE /api/blobs/<key>). Each blob goes to the locker ranking first for
+// its key by rendezvous hashing, so placement only moves for the blobs of lockers that
+// join or leave; reads try every locker in rank order to find blobs placed before.
+type LockerBlobStore struct {
+	discover   func() ([]Locker, error)
+	token      string
+	httpClient *http.Client
+}
+
+// NewLockerBlobStore creates a store on the lockers returned by discover, which is
+// called for every operation. token is sent as a bearer token.
+func NewLockerBlobStore(discover func() ([]Locker, error), token string, httpClient *http.Client) *LockerBlobStore {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 5 * time.Minute}
+	}
+	return &LockerBlobStore{discover: discover, token: token, httpClient: httpClient}
+}
+
+// ranked returns the lockers ordered by their rendezvous weight for key
+func (s *LockerBlobStore) ranked(key string) ([]Locker, error) {
+	lockers, err := s.discover()
+	if err != nil {
+		return nil, fmt.Errorf("discovering lockers: %v", err)
+	}
+	if len(lockers) == 0 {
+		return nil, errors.New("no locker nodes found")
+	}
+
+	weights := make(map[string]string, len(lockers))
+	for _, locker := range lockers {
+		sum := sha256.Sum256([]byte(locker.ID + "/" + key))
+		weights[locker.ID] = string(sum[:])
+	}
+	sort.Slice(lockers, func(i, j int) bool { return weights[lockers[i].ID] > weights[lockers[j].ID] })
+	return lockers, nil
+}
+
+func (s *LockerBlobStore) request(method string, locker Locker, key string, body io.Reader, size int64) (*http.Response, error) {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(locker.URL, "/")+"/api/blobs/"+strings.Join(segments, "/"), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	return s.httpClient.Do(req)
+}
+
+// lockerError turns an unexpected response into an error
+func lockerError(locker Locker, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("locker %s: status %d: %s", locker.ID, resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// PutBlob uploads the blob to the first ranked locker. The reader can't be replayed, so
+// a failed upload is not retried on the next locker.
+func (s *LockerBlobStore) PutBlob(key string, r io.Reader, size int64) error {
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+	lockers, err := s.ranked(key)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.request(http.MethodPut, lockers[0], key, r, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return lockerError(lockers[0], resp)
+	}
+	return nil
+}
+
+// PutBlobCopies uploads data to the first copies lockers in rank order that take it,
+// moving on to the next locker after a failure. It returns the lockers holding the blob,
+// and an error if fewer than copies took it; the caller decides whether to keep those.
+func (s *LockerBlobStore) PutBlobCopies(key string, data []byte, copies int) ([]Locker, error) {
+	if err := validateBlobKey(key); err != nil {
+		return nil, err
+	}
+	lockers, err := s.ranked(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(lockers) < copies {
+		return nil, fmt.Errorf("%d copies asked, but only %d lockers found", copies, len(lockers))
+	}
+
+	var stored []Locker
+	var errs []error
+	for _, locker := range lockers {
+		if len(stored) == copies {
+			break
+		}
+		resp, err := s.request(http.MethodPut, locker, key, bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if resp.StatusCode/100 == 2 {
+			stored = append(stored, locker)
+		} else {
+			errs = append(errs, lockerError(locker, resp))
+		}
+		resp.Body.Close()
+	}
+	if len(stored) < copies {
+		return stored, fmt.Errorf("%d of %d copies stored: %w", len(stored), copies, errors.Join(errs...))
+	}
+	return stored, nil
+}
+
+// DeleteBlobFrom deletes the blob from the given lockers
+func (s *LockerBlobStore) DeleteBlobFrom(key string, lockers []Locker) error {
+	var errs []error
+	for _, locker := range lockers {
+		resp, err := s.request(http.MethodDelete, locker, key, nil, 0)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+			errs = append(errs, lockerError(locker, resp))
+		}
+		resp.Body.Close()
+	}
+	return errors.Join(errs...)
+}
+
+// GetBlob downloads the blob from the first locker that has it
+func (s *LockerBlobStore) GetBlob(key string) (io.ReadCloser, error) {
+	if err := validateBlobKey(key); err != nil {
+		return nil, err
+	}
+	lockers, err := s.ranked(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, locker := range lockers {
+		resp, err := s.request(http.MethodGet, locker, key, nil, 0)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp.Body, nil
+		}
+		if resp.StatusCode != http.StatusNotFound {
+			errs = append(errs, lockerError(locker, resp))
+		}
+		resp.Body.Close()
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return nil, ErrBlobNotFound
+}
+
+// DeleteBlob deletes the blob from every locker holding it
+func (s *LockerBlobStore) DeleteBlob(key string) error {
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+	lockers, err := s.ranked(key)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	found := false
+	for _, locker := range lockers {
+		resp, err := s.request(http.MethodDelete, locker, key, nil, 0)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		switch {
+		case resp.StatusCode/100 == 2:
+			found = true
+		case resp.StatusCode != http.StatusNotFound:
+			errs = append(errs, lockerError(locker, resp))
+		}
+		resp.Body.Close()
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if !found {
+		return ErrBlobNotFound
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+	"wave_capacitor/logging"
+)
+
+// logger logs the storage backends' background work and failures
+var logger = logging.Component("storage")
+
+// slowScan is the duration above which folder listings are logged as slow; 0 disables it
+var slowScan atomic.Int64
+
+// SetSlowScanThreshold configures when folder listings are logged as slow, to find
+// mailboxes and shards that have grown too large
+func SetSlowScanThreshold(threshold time.Duration) {
+	slowScan.Store(int64(threshold))
+}
+
+// logIfSlowScan logs a listing of folder with entries entries, started at start, if it was slow
+func logIfSlowScan(folder string, entries int, start time.Time) {
+	elapsed := time.Since(start)
+	if threshold := time.Duration(slowScan.Load()); threshold <= 0 || elapsed < threshold {
+		return
+	}
+	name := filepath.Base(folder)
+	logger.Warn(context.Background(), "slow folder scan", "folder", name, "shard", shardIndexFromFolder(name),
+		"entries", entries, "duration_ms", elapsed.Milliseconds())
+}
+
+// ErrMessageNotFound is returned when a message does not exist in the store
+var ErrMessageNotFound = errors.New("message not found")
+
+// MessageStore abstracts where and how message files are persisted.
+// Messages are addressed by the owner's public key and the message ID;
+// the store decides the on-disk layout and any at-rest transformation.
+type MessageStore interface {
+	// Write stores the serialized message for the given owner
+	Write(ownerKey, messageID string, data []byte) error
+	// Read returns the serialized message for the given owner
+	Read(ownerKey, messageID string) ([]byte, error)
+	// List returns the IDs of all messages stored for the given owner
+	List(ownerKey string) ([]string, error)
+	// Delete removes a single message for the given owner
+	Delete(ownerKey, messageID string) error
+}
+
+// FileMessageStore stores each message as a file inside the owner's obfuscated shard folder
+type FileMessageStore struct {
+	messageCodec
+	shards        *ShardManager
+	quarantineDir string     // empty leaves corrupted files in place
+	diskGuard     *DiskGuard // nil disables free-space checks
+}
+
+// NewFileMessageStore creates a file-backed message store rooted at baseDir.
+// If encryptor is nil, messages are written as plaintext JSON.
+func NewFileMessageStore(baseDir string, encryptor *Encryptor) *FileMessageStore {
+	return &FileMessageStore{
+		messageCodec: messageCodec{encryptor: encryptor},
+		shards:       NewShardManager(baseDir),
+	}
+}
+
+// FolderFor returns the folder holding the given owner's messages
+func (s *FileMessageStore) FolderFor(ownerKey string) string {
+	return s.shards.GetFolderForKey(ownerKey)
+}
+
+// SetNumShards changes the shard count at runtime; run Rebalance to move the existing
+// folders. Messages stay readable in the meantime (see ShardManager.SetNumShards).
+func (s *FileMessageStore) SetNumShards(numShards int) error {
+	return s.shards.SetNumShards(numShards)
+}
+
+// ShardDirs returns the folders of every shard under the current shard count
+func (s *FileMessageStore) ShardDirs() []string {
+	return s.shards.GetAllShards()
+}
+
+// ShardStatus reports the shard count and, until Rebalance finished, the previous one
+func (s *FileMessageStore) ShardStatus() ShardStatus {
+	return s.shards.Status()
+}
+
+// RemoveOwnerFolders deletes every folder that may hold the owner's messages: the
+// unsharded folder and all "_<shard>" variants, which outlive changes of the shard count,
+// under the current and, during a salt rotation, the previous confusion salt
+func (s *FileMessageStore) RemoveOwnerFolders(ownerKey string) error {
+	for _, folder := range s.shards.ownerFolders(ownerKey) {
+		dir := filepath.Dir(folder)
+		prefix, _, _ := strings.Cut(filepath.Base(folder), "_")
+
+		variants, err := filepath.Glob(filepath.Join(dir, prefix+"_*"))
+		if err != nil {
+			return err
+		}
+		for _, path := range append([]string{filepath.Join(dir, prefix)}, variants...) {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetQuarantineDir makes Read and the scrubber move corrupted files into dir
+func (s *FileMessageStore) SetQuarantineDir(dir string) {
+	s.quarantineDir = dir
+}
+
+// SetDiskGuard makes writes fail with ErrInsufficientStorage once free space runs low
+func (s *FileMessageStore) SetDiskGuard(guard *DiskGuard) {
+	s.diskGuard = guard
+}
+
+// Write stores the serialized message, encrypting it when a master key is configured
+func (s *FileMessageStore) Write(ownerKey, messageID string, data []byte) error {
+	if err := validateMessageID(messageID); err != nil {
+		return err
+	}
+	return s.writeFolder(s.FolderFor(ownerKey), messageID, data)
+}
+
+// writeFolder stores a message in the given folder
+func (s *FileMessageStore) writeFolder(folder, messageID string, data []byte) error {
+	if err := s.diskGuard.Check(); err != nil {
+		return err
+	}
+
+	data, err := s.seal(filepath.Base(folder), messageID, data)
+	if err != nil {
+		return err
+	}
+
+	// Serialize concurrent writers to the same folder
+	unlock, err := LockFolder(folder)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return writeFileAtomic(filepath.Join(folder, messageID+".json"), addChecksum(data), 0600)
+}
+
+// Read returns the serialized message, transparently decrypting it
+func (s *FileMessageStore) Read(ownerKey, messageID string) ([]byte, error) {
+	if err := validateMessageID(messageID); err != nil {
+		return nil, err
+	}
+	return readRotated(s, s.shards, ownerKey, messageID)
+}
+
+// readFolder returns a message from the given folder
+func (s *FileMessageStore) readFolder(folder, messageID string) ([]byte, error) {
+	path := filepath.Join(folder, messageID+".json")
+	file, err := ReadFilePooled(path, maxMessageFileSize)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	defer file.Release()
+
+	// Quarantine corrupted files so they are reported once instead of on every read
+	data, err := verifyChecksum(file.Bytes())
+	if err != nil {
+		if s.quarantineDir != "" {
+			if qErr := quarantineFile(path, s.quarantineDir); qErr != nil {
+				logger.Error(context.Background(), "quarantining message file failed", "path", path, "error", qErr)
+			}
+		}
+		return nil, err
+	}
+
+	message, err := s.open(filepath.Base(folder), messageID, data)
+	if err != nil {
+		return nil, err
+	}
+	// Plaintext files open to the bytes read, which go back to the pool
+	if sharesBuffer(message, file.Bytes()) {
+		message = bytes.Clone(message)
+	}
+	return message, nil
+}
+
+// List returns the IDs of all messages stored for the owner
+func (s *FileMessageStore) List(ownerKey string) ([]string, error) {
+	return listRotated(s, s.shards, ownerKey)
+}
+
+// listFolder returns the IDs of the messages in the given folder
+func (s *FileMessageStore) listFolder(folder string) ([]string, error) {
+	start := time.Now()
+	entries, err := os.ReadDir(folder)
+	logIfSlowScan(folder, len(entries), start)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	return ids, nil
+}
+
+// Delete removes a single message
+func (s *FileMessageStore) Delete(ownerKey, messageID string) error {
+	if err := validateMessageID(messageID); err != nil {
+		return err
+	}
+	return deleteRotated(s, s.shards, ownerKey, messageID)
+}
+
+// RehashOwner moves the owner's messages to the folder of the current confusion salt
+// and removes the emptied folder of the previous one
+func (s *FileMessageStore) RehashOwner(ownerKey string) (int, error) {
+	moved, err := rehashOwner(s, s.shards, ownerKey)
+	if err != nil {
+		return moved, err
+	}
+	if previous := s.shards.PreviousFolderForKey(ownerKey); previous != "" {
+		os.Remove(filepath.Join(previous, lockFileName))
+		os.Remove(previous)
+	}
+	return moved, nil
+}
+
+// deleteFolder removes a message from the given folder
+func (s *FileMessageStore) deleteFolder(folder, messageID string) error {
+	unlock, err := LockFolder(folder)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = os.Remove(filepath.Join(folder, messageID+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if shredErr := s.shred(filepath.Base(folder), messageID); shredErr != nil {
+		return shredErr
+	}
+	if os.IsNotExist(err) {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+// messageCodec applies the optional compression and at-rest encryption shared by all message stores
+type messageCodec struct {
+	encryptor  *Encryptor  // nil disables at-rest encryption with the master key
+	dataKeys   *DataKeys   // per-message data keys; used instead of encryptor when set
+	compressor *Compressor // nil stores payloads uncompressed
+}
+
+// SetCompressor enables compression of newly written messages; existing data stays readable
+func (c *messageCodec) SetCompressor(compressor *Compressor) {
+	c.compressor = compressor
+}
+
+// SetDataKeys encrypts newly written messages with their own data key, allowing them to be
+// crypto-shredded on delete; messages sealed with the master key stay readable
+func (c *messageCodec) SetDataKeys(dataKeys *DataKeys) {
+	c.dataKeys = dataKeys
+}
+
+// seal compresses and then encrypts a serialized message bound to its ID
+func (c *messageCodec) seal(folder, messageID string, data []byte) ([]byte, error) {
+	data, err := c.compressor.Compress(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress message: %v", err)
+	}
+
+	var sealed []byte
+	switch {
+	case c.dataKeys != nil:
+		sealed, err = c.dataKeys.Seal(dataKeyID(folder, messageID), data, []byte(messageID))
+	case c.encryptor != nil:
+		sealed, err = c.encryptor.sealMessage(folder, messageID, data)
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt message: %v", err)
+	}
+	return sealed, nil
+}
+
+// open reverses seal, passing legacy plaintext and uncompressed data through unchanged
+func (c *messageCodec) open(folder, messageID string, data []byte) ([]byte, error) {
+	var err error
+	switch {
+	case bytes.HasPrefix(data, dataKeyMagic):
+		if c.dataKeys == nil {
+			return nil, errors.New("message uses a per-file key but data keys are not configured")
+		}
+		data, err = c.dataKeys.Open(dataKeyID(folder, messageID), data, []byte(messageID))
+	case IsEncrypted(data):
+		if c.encryptor == nil {
+			return nil, errors.New("message is encrypted but no master key is configured")
+		}
+		data, err = c.encryptor.openMessage(folder, messageID, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decompress(data)
+}
+
+// shred destroys the message's data key, if it has one
+func (c *messageCodec) shred(folder, messageID string) error {
+	if c.dataKeys == nil {
+		return nil
+	}
+	return c.dataKeys.Shred(dataKeyID(folder, messageID))
+}
+
+// validateMessageID rejects IDs that could escape the owner's folder
+func validateMessageID(messageID string) error {
+	if messageID == "" || strings.ContainsAny(messageID, `/\`) || strings.Contains(messageID, "..") {
+		return fmt.Errorf("invalid message ID: %q", messageID)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// benchMessageSize is the size of the messages written and read by the benchmarks, a
+// short text message once encrypted by the client and encoded
+const benchMessageSize = 2048
+
+// benchMessage returns a message of benchMessageSize bytes
+func benchMessage() []byte {
+	data := make([]byte, benchMessageSize)
+	for i := range data {
+		data[i] = 'a' + byte(i%26)
+	}
+	return data
+}
+
+// benchOwnerKeys returns owner keys shaped like public keys, spread over the shards
+func benchOwnerKeys(count int) []string {
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = uuid.New().String() + uuid.New().String()
+	}
+	return keys
+}
+
+// benchStore names the encryptor of a benchmarked store
+type benchStore struct {
+	name      string
+	encryptor *Encryptor
+}
+
+// benchStores returns the stores benchmarked: plaintext, and encrypted under a random
+// master key
+func benchStores(b *testing.B) []benchStore {
+	key := make([]byte, 32)
+	rand.Read(key)
+	encryptor, err := NewEncryptor(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return []benchStore{{"plain", nil}, {"encrypted", encryptor}}
+}
+
+// BenchmarkFolderForKey times hashing an owner key to its message folder, done on every
+// message read and write
+func BenchmarkFolderForKey(b *testing.B) {
+	shards := NewShardManager(b.TempDir())
+	keys := benchOwnerKeys(1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		shards.GetFolderForKey(keys[i%len(keys)])
+	}
+}
+
+// BenchmarkMessageWrite times storing a message for one of a few owners
+func BenchmarkMessageWrite(b *testing.B) {
+	for _, bench := range benchStores(b) {
+		b.Run(bench.name, func(b *testing.B) {
+			store := NewFileMessageStore(b.TempDir(), bench.encryptor)
+			owners := benchOwnerKeys(16)
+			data := benchMessage()
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := store.Write(owners[i%len(owners)], uuid.New().String(), data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkMessageRead times reading back stored messages
+func BenchmarkMessageRead(b *testing.B) {
+	for _, bench := range benchStores(b) {
+		b.Run(bench.name, func(b *testing.B) {
+			store := NewFileMessageStore(b.TempDir(), bench.encryptor)
+			owners := benchOwnerKeys(16)
+			ids := make([]string, 256)
+			data := benchMessage()
+			for i := range ids {
+				ids[i] = uuid.New().String()
+				if err := store.Write(owners[i%len(owners)], ids[i], data); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				j := i % len(ids)
+				if _, err := store.Read(owners[j%len(owners)], ids[j]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
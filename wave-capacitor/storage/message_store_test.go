@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// TestConcurrentWritesOneMailbox writes messages to one mailbox in parallel, as
+// concurrent senders do, and checks that every one of them is listed and reads back whole
+func TestConcurrentWritesOneMailbox(t *testing.T) {
+	for _, bench := range []struct {
+		name      string
+		encryptor func() *Encryptor
+	}{
+		{"plain", func() *Encryptor { return nil }},
+		{"encrypted", func() *Encryptor { e, _ := NewEncryptor(testKey(t)); return e }},
+	} {
+		t.Run(bench.name, func(t *testing.T) {
+			store := NewFileMessageStore(t.TempDir(), bench.encryptor())
+			owner := uuid.New().String() + uuid.New().String()
+
+			const writers = 64
+			messages := make(map[string][]byte, writers)
+			for i := 0; i < writers; i++ {
+				messages[uuid.New().String()] = []byte(fmt.Sprintf(`{"n":%d,"body":%q}`, i, bytes.Repeat([]byte{'a' + byte(i%26)}, 512+i)))
+			}
+			var wg sync.WaitGroup
+			for id, data := range messages {
+				wg.Add(1)
+				go func(id string, data []byte) {
+					defer wg.Done()
+					if err := store.Write(owner, id, data); err != nil {
+						t.Error(err)
+					}
+				}(id, data)
+			}
+			wg.Wait()
+			if t.Failed() {
+				return
+			}
+
+			ids, err := store.List(owner)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ids) != writers {
+				t.Fatalf("%d messages listed, want %d", len(ids), writers)
+			}
+			for _, id := range ids {
+				data, err := store.Read(owner, id)
+				if err != nil {
+					t.Fatalf("message %s: %v", id, err)
+				}
+				if !bytes.Equal(data, messages[id]) {
+					t.Fatalf("message %s changed", id)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RebalanceReport summarizes one pass moving message folders to their current shard
+type RebalanceReport struct {
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	Folders   int           `json:"folders"` // folders whose shard suffix no longer matches NUM_SHARDS
+	Moved     int           `json:"moved"`
+	Errors    int           `json:"errors"`
+}
+
+// Rebalance moves messages out of folders named for a previous shard count into the folder
+// GetFolderForKey now returns for their owner. Messages in those folders are unreachable
+// until moved, except for those of the count before SetNumShards. Each message is
+// re-sealed, since per-message data keys are bound to the folder.
+func (s *FileMessageStore) Rebalance() RebalanceReport {
+	report := RebalanceReport{StartedAt: time.Now()}
+	numShards, previousShards := s.shards.shardCounts()
+
+	folders, err := os.ReadDir(s.shards.baseDir)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Error(context.Background(), "listing message folders failed", "error", err)
+		report.Errors++
+	}
+
+	for _, folder := range folders {
+		if !folder.IsDir() {
+			continue
+		}
+		target, ok := s.shards.currentFolder(folder.Name())
+		if !ok || target == folder.Name() {
+			continue
+		}
+		report.Folders++
+		s.rebalanceFolder(folder.Name(), target, &report)
+	}
+
+	if report.Errors == 0 && previousShards != 0 {
+		s.shards.finishResharding(numShards, previousShards)
+	}
+	report.Duration = time.Since(report.StartedAt)
+	return report
+}
+
+// currentFolder maps a message folder name to the name it has under the current shard
+// count. Folder names start with the hex hash prefix whose first byte picks the shard.
+func (sm *ShardManager) currentFolder(name string) (string, bool) {
+	prefix, _, _ := strings.Cut(name, "_")
+	raw, err := hex.DecodeString(prefix)
+	if err != nil || len(raw) != 8 {
+		return "", false // Not a message folder
+	}
+
+	numShards, _ := sm.shardCounts()
+	if numShards <= 1 {
+		return prefix, true
+	}
+	return fmt.Sprintf("%s_%d", prefix, int(raw[0])%numShards), true
+}
+
+// rebalanceFolder moves every message of folder to target and removes folder once empty
+func (s *FileMessageStore) rebalanceFolder(folder, target string, report *RebalanceReport) {
+	ids, err := s.folderMessageIDs(folder)
+	if err != nil {
+		logger.Error(context.Background(), "listing folder failed", "folder", folder, "error", err)
+		report.Errors++
+		return
+	}
+
+	failed := false
+	for _, id := range ids {
+		if err := s.moveMessage(folder, target, id); err != nil {
+			logger.Error(context.Background(), "moving message failed", "message_id", id, "from", folder, "to", target, "error", err)
+			report.Errors++
+			failed = true
+			continue
+		}
+		report.Moved++
+	}
+
+	if !failed {
+		dir := filepath.Join(s.shards.baseDir, folder)
+		os.Remove(filepath.Join(dir, lockFileName))
+		if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+			logger.Warn(context.Background(), "removing rebalanced folder failed", "folder", folder, "error", err)
+		}
+	}
+}
+
+// moveMessage re-seals one message for the target folder, writes it there and removes the
+// original. A copy already present in target wins over the old one.
+func (s *FileMessageStore) moveMessage(folder, target, messageID string) error {
+	src := filepath.Join(s.shards.baseDir, folder)
+	dst := filepath.Join(s.shards.baseDir, target)
+
+	unlockSrc, err := LockFolder(src)
+	if err != nil {
+		return err
+	}
+	defer unlockSrc()
+	unlockDst, err := LockFolder(dst)
+	if err != nil {
+		return err
+	}
+	defer unlockDst()
+
+	srcPath := filepath.Join(src, messageID+".json")
+	dstPath := filepath.Join(dst, messageID+".json")
+	if _, err := os.Stat(dstPath); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+
+		file, err := ReadFilePooled(srcPath, maxMessageFileSize)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // Deleted since the folder was listed
+			}
+			return err
+		}
+		defer file.Release()
+		payload, err := verifyChecksum(file.Bytes())
+		if err != nil {
+			if errors.Is(err, ErrMessageCorrupted) {
+				return fmt.Errorf("not moving corrupted file: %v", err)
+			}
+			return err
+		}
+		plaintext, err := s.open(folder, messageID, payload)
+		if err != nil {
+			return err
+		}
+		sealed, err := s.seal(target, messageID, plaintext)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(dstPath, addChecksum(sealed), 0600); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(srcPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.shred(folder, messageID)
+}
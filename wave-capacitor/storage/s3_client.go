@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"wave_capacitor/utils"
+)
+
+// ErrObjectNotFound is returned when an S3 object does not exist
+var ErrObjectNotFound = errors.New("object not found")
+
+// S3Client is a minimal S3-compatible (AWS S3, MinIO) client signing requests with SigV4
+type S3Client struct {
+	endpoint   *url.URL
+	region     string
+	pathStyle  bool
+	creds      utils.AWSCredentials
+	httpClient *http.Client
+}
+
+// NewS3Client creates an S3 client. An empty endpoint targets AWS S3 in the given region.
+// pathStyle must be true for MinIO and most self-hosted S3 implementations.
+func NewS3Client(endpoint, region string, pathStyle bool, creds utils.AWSCredentials) (*S3Client, error) {
+	if region == "" {
+		region = "us-east-1"
+	}
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %v", err)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, errors.New("S3 credentials are required")
+	}
+
+	return &S3Client{
+		endpoint:   u,
+		region:     region,
+		pathStyle:  pathStyle,
+		creds:      creds,
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// objectURL builds the request URL for a bucket/key pair
+func (c *S3Client) objectURL(bucket, key string, query url.Values) *url.URL {
+	u := *c.endpoint
+
+	escapedKey := ""
+	if key != "" {
+		segments := strings.Split(key, "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		escapedKey = strings.Join(segments, "/")
+	}
+
+	if c.pathStyle {
+		u.Path = "/" + bucket + "/" + key
+		u.RawPath = "/" + bucket + "/" + escapedKey
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+		u.RawPath = "/" + escapedKey
+	}
+	u.RawQuery = query.Encode()
+	return &u
+}
+
+// do sends a signed request with an in-memory body and returns the response
+func (c *S3Client) do(method, bucket, key string, query url.Values, body []byte, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.objectURL(bucket, key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	utils.SignAWSRequest(req, utils.SHA256Hex(body), "s3", c.region, c.creds, time.Now())
+
+	return c.httpClient.Do(req)
+}
+
+// checkResponse converts S3 error responses into Go errors and closes the body on failure
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrObjectNotFound
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("S3 returned status %d: %s", resp.StatusCode, string(msg))
+}
+
+// PutObject uploads a small object in a single request
+func (c *S3Client) PutObject(bucket, key string, data []byte) error {
+	resp, err := c.do("PUT", bucket, key, nil, data, map[string]string{"Content-Type": "application/octet-stream"})
+	if err != nil {
+		return err
+	}
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// GetObjectStream returns the body of an object; the caller must close it
+func (c *S3Client) GetObjectStream(bucket, key string) (io.ReadCloser, error) {
+	resp, err := c.do("GET", bucket, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// GetObject downloads a whole object into memory
+func (c *S3Client) GetObject(bucket, key string) ([]byte, error) {
+	body, err := c.GetObjectStream(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// DeleteObject removes an object; deleting a missing object is not an error in S3
+func (c *S3Client) DeleteObject(bucket, key string) error {
+	resp, err := c.do("DELETE", bucket, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListObjects returns all keys under prefix, following continuation tokens
+func (c *S3Client) ListObjects(bucket, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := c.do("GET", bucket, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkResponse(resp); err != nil {
+			if err == ErrObjectNotFound {
+				return nil, fmt.Errorf("bucket %s does not exist", bucket)
+			}
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode list response: %v", err)
+		}
+
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// UploadMultipart streams r to S3 in parts of partSize bytes (minimum 5 MiB except the last part)
+func (c *S3Client) UploadMultipart(bucket, key string, r io.Reader, partSize int) error {
+	if partSize < 5*1024*1024 {
+		partSize = 5 * 1024 * 1024
+	}
+
+	// Initiate the upload
+	resp, err := c.do("POST", bucket, key, url.Values{"uploads": {""}}, nil, map[string]string{"Content-Type": "application/octet-stream"})
+	if err != nil {
+		return err
+	}
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil || initiated.UploadID == "" {
+		return fmt.Errorf("failed to initiate multipart upload: %v", err)
+	}
+
+	abort := func() {
+		if resp, err := c.do("DELETE", bucket, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil); err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []completedPart
+
+	buf := make([]byte, partSize)
+	for partNumber := 1; ; partNumber++ {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			query := url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {initiated.UploadID}}
+			resp, err := c.do("PUT", bucket, key, query, buf[:n], nil)
+			if err == nil {
+				err = checkResponse(resp)
+			}
+			if err != nil {
+				abort()
+				return fmt.Errorf("failed to upload part %d: %v", partNumber, err)
+			}
+			parts = append(parts, completedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+			resp.Body.Close()
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			abort()
+			return fmt.Errorf("failed to read upload data: %v", readErr)
+		}
+	}
+
+	// Complete the upload
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	completeBody, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		abort()
+		return err
+	}
+
+	resp, err = c.do("POST", bucket, key, url.Values{"uploadId": {initiated.UploadID}}, completeBody, map[string]string{"Content-Type": "application/xml"})
+	if err == nil {
+		err = checkResponse(resp)
+	}
+	if err != nil {
+		abort()
+		return fmt.Errorf("failed to complete multipart upload: %v", err)
+	}
+	resp.Body.Close()
+	return nil
+}
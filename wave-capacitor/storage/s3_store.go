@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// multipartThreshold is the blob size above which uploads are split into parts
+const multipartThreshold = 16 * 1024 * 1024
+
+// S3Options configures the object layout of the S3 stores
+type S3Options struct {
+	Bucket string
+	// Prefix is prepended to every object key (e.g. a node name)
+	Prefix string
+	// BucketPerShard stores each shard in its own bucket named "<Bucket>-<index>"
+	BucketPerShard bool
+}
+
+// S3MessageStore stores each message as an object under the owner's obfuscated folder name,
+// so capacitor nodes can run without local message state.
+type S3MessageStore struct {
+	messageCodec
+	client *S3Client
+	opts   S3Options
+	shards *ShardManager
+}
+
+// NewS3MessageStore creates an S3-backed message store.
+// If encryptor is nil, messages are uploaded as plaintext JSON.
+func NewS3MessageStore(client *S3Client, opts S3Options, encryptor *Encryptor) *S3MessageStore {
+	return &S3MessageStore{
+		client: client,
+		opts:   opts,
+		// The base directory is irrelevant here; only the folder names are used as key prefixes
+		shards:       NewShardManager(""),
+		messageCodec: messageCodec{encryptor: encryptor},
+	}
+}
+
+// folderName returns the obfuscated folder name of the owner's messages
+func (s *S3MessageStore) folderName(ownerKey string) string {
+	return filepath.Base(s.shards.GetFolderForKey(ownerKey))
+}
+
+// folderLocation returns the bucket and key prefix for an obfuscated folder name
+func (s *S3MessageStore) folderLocation(folder string) (string, string) {
+	bucket := s.opts.Bucket
+	if s.opts.BucketPerShard {
+		bucket = fmt.Sprintf("%s-%d", s.opts.Bucket, shardIndexFromFolder(folder))
+	}
+	return bucket, path.Join(s.opts.Prefix, "messages", folder) + "/"
+}
+
+// putSealed uploads an already sealed message into the given folder (used by tiering)
+func (s *S3MessageStore) putSealed(folder, messageID string, data []byte) error {
+	bucket, prefix := s.folderLocation(folder)
+	return s.client.PutObject(bucket, prefix+messageID+".json", data)
+}
+
+// Write uploads the serialized message, encrypting it when a master key is configured
+func (s *S3MessageStore) Write(ownerKey, messageID string, data []byte) error {
+	if err := validateMessageID(messageID); err != nil {
+		return err
+	}
+	return s.writeFolder(s.folderName(ownerKey), messageID, data)
+}
+
+// writeFolder uploads a message into the given folder
+func (s *S3MessageStore) writeFolder(folder, messageID string, data []byte) error {
+	data, err := s.seal(folder, messageID, data)
+	if err != nil {
+		return err
+	}
+
+	bucket, prefix := s.folderLocation(folder)
+	return s.client.PutObject(bucket, prefix+messageID+".json", data)
+}
+
+// Read downloads the serialized message, transparently decrypting it
+func (s *S3MessageStore) Read(ownerKey, messageID string) ([]byte, error) {
+	if err := validateMessageID(messageID); err != nil {
+		return nil, err
+	}
+	return readRotated(s, s.shards, ownerKey, messageID)
+}
+
+// readFolder downloads a message from the given folder
+func (s *S3MessageStore) readFolder(folder, messageID string) ([]byte, error) {
+	bucket, prefix := s.folderLocation(folder)
+	data, err := s.client.GetObject(bucket, prefix+messageID+".json")
+	if err != nil {
+		if err == ErrObjectNotFound {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+
+	return s.open(folder, messageID, data)
+}
+
+// List returns the IDs of all messages stored for the owner
+func (s *S3MessageStore) List(ownerKey string) ([]string, error) {
+	return listRotated(s, s.shards, ownerKey)
+}
+
+// listFolder returns the IDs of the messages in the given folder
+func (s *S3MessageStore) listFolder(folder string) ([]string, error) {
+	bucket, prefix := s.folderLocation(folder)
+	keys, err := s.client.ListObjects(bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		if strings.Contains(name, "/") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, ".json"))
+	}
+	return ids, nil
+}
+
+// Delete removes a single message
+func (s *S3MessageStore) Delete(ownerKey, messageID string) error {
+	if err := validateMessageID(messageID); err != nil {
+		return err
+	}
+	return deleteRotated(s, s.shards, ownerKey, messageID)
+}
+
+// RehashOwner moves the owner's messages to the folder of the current confusion salt
+func (s *S3MessageStore) RehashOwner(ownerKey string) (int, error) {
+	return rehashOwner(s, s.shards, ownerKey)
+}
+
+// deleteFolder removes a message from the given folder
+func (s *S3MessageStore) deleteFolder(folder, messageID string) error {
+	bucket, prefix := s.folderLocation(folder)
+	if err := s.client.DeleteObject(bucket, prefix+messageID+".json"); err != nil {
+		return err
+	}
+	return s.shred(folder, messageID)
+}
+
+// S3BlobStore stores blobs as objects, using multipart uploads for large or unsized blobs
+type S3BlobStore struct {
+	client *S3Client
+	opts   S3Options
+}
+
+// NewS3BlobStore creates an S3-backed blob store. Blobs always live in opts.Bucket.
+func NewS3BlobStore(client *S3Client, opts S3Options) *S3BlobStore {
+	return &S3BlobStore{client: client, opts: opts}
+}
+
+// objectKey maps a blob key to its object key
+func (s *S3BlobStore) objectKey(key string) (string, error) {
+	if err := validateBlobKey(key); err != nil {
+		return "", err
+	}
+	return path.Join(s.opts.Prefix, "blobs", key), nil
+}
+
+// PutBlob uploads the blob, switching to a multipart upload above multipartThreshold
+func (s *S3BlobStore) PutBlob(key string, r io.Reader, size int64) error {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return err
+	}
+
+	if size >= 0 && size <= multipartThreshold {
+		data, err := io.ReadAll(io.LimitReader(r, size+1))
+		if err != nil {
+			return err
+		}
+		if int64(len(data)) != size {
+			return fmt.Errorf("blob size mismatch: expected %d bytes, got %d", size, len(data))
+		}
+		return s.client.PutObject(s.opts.Bucket, objectKey, data)
+	}
+
+	return s.client.UploadMultipart(s.opts.Bucket, objectKey, r, multipartThreshold)
+}
+
+// GetBlob streams the blob from S3
+func (s *S3BlobStore) GetBlob(key string) (io.ReadCloser, error) {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return nil, err
+	}
+	body, err := s.client.GetObjectStream(s.opts.Bucket, objectKey)
+	if err == ErrObjectNotFound {
+		return nil, ErrBlobNotFound
+	}
+	return body, err
+}
+
+// DeleteBlob removes the blob object
+func (s *S3BlobStore) DeleteBlob(key string) error {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return err
+	}
+	return s.client.DeleteObject(s.opts.Bucket, objectKey)
+}
@@ -0,0 +1,105 @@
+package storage
+
+// SaltRotator is implemented by message stores that can move an owner's messages from
+// the folder derived from PreviousConfusionSalt to the folder of the current salt
+type SaltRotator interface {
+	// RehashOwner moves the owner's messages and returns how many were moved
+	RehashOwner(ownerKey string) (int, error)
+}
+
+// folderStore is implemented by the message stores on top of the folders returned by
+// their ShardManager, so the lookups below can include the previous salt's folder
+type folderStore interface {
+	writeFolder(folder, messageID string, data []byte) error
+	readFolder(folder, messageID string) ([]byte, error)
+	listFolder(folder string) ([]string, error)
+	deleteFolder(folder, messageID string) error
+}
+
+// readRotated reads a message from the owner's current folder, falling back to the
+// folders of the previous salt during a rotation and the previous shard count while
+// resharding (see ShardManager.ownerFolders)
+func readRotated(s folderStore, sm *ShardManager, ownerKey, messageID string) ([]byte, error) {
+	for _, folder := range sm.ownerFolders(ownerKey) {
+		data, err := s.readFolder(folder, messageID)
+		if err != ErrMessageNotFound {
+			return data, err
+		}
+	}
+	return nil, ErrMessageNotFound
+}
+
+// listRotated lists the messages in the owner's current and previous folders
+func listRotated(s folderStore, sm *ShardManager, ownerKey string) ([]string, error) {
+	ids := []string{}
+	seen := make(map[string]bool)
+	for _, folder := range sm.ownerFolders(ownerKey) {
+		folderIDs, err := s.listFolder(folder)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range folderIDs {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// deleteRotated removes a message from the owner's current and previous folders; it is
+// only ErrMessageNotFound when the message was in neither
+func deleteRotated(s folderStore, sm *ShardManager, ownerKey, messageID string) error {
+	result := ErrMessageNotFound
+	for _, folder := range sm.ownerFolders(ownerKey) {
+		err := s.deleteFolder(folder, messageID)
+		if err == nil {
+			result = nil
+		} else if err != ErrMessageNotFound {
+			return err
+		}
+	}
+	return result
+}
+
+// rehashOwner moves the owner's messages from the previous salt's folder to the current
+// one. Each message is re-sealed, since per-message data keys are bound to the folder.
+// A copy already in the current folder wins over the old one.
+func rehashOwner(s folderStore, sm *ShardManager, ownerKey string) (int, error) {
+	previous := sm.PreviousFolderForKey(ownerKey)
+	if previous == "" {
+		return 0, nil
+	}
+	current := sm.GetFolderForKey(ownerKey)
+
+	ids, err := s.listFolder(previous)
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, id := range ids {
+		_, err := s.readFolder(current, id)
+		if err == ErrMessageNotFound {
+			data, err := s.readFolder(previous, id)
+			if err == ErrMessageNotFound {
+				continue // Deleted since the folder was listed
+			}
+			if err != nil {
+				return moved, err
+			}
+			if err := s.writeFolder(current, id, data); err != nil {
+				return moved, err
+			}
+		} else if err != nil {
+			return moved, err
+		}
+
+		if err := s.deleteFolder(previous, id); err != nil && err != ErrMessageNotFound {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"wave_capacitor/utils"
+)
+
+// sealedBlobMagic prefixes every blob written by a SealedBlobStore
+var sealedBlobMagic = []byte("WVB1")
+
+// sealedChunkSize is the plaintext size of each sealed chunk
+const sealedChunkSize = 64 * 1024
+
+// ErrSealedBlobTruncated is returned when a sealed blob ends before its final chunk
+var ErrSealedBlobTruncated = errors.New("sealed blob is truncated")
+
+// SealedBlobStore encrypts blobs with its own key (AES-256-GCM) before handing them to
+// another store, so a backup sink never sees plaintext. Blobs are sealed in chunks as
+// they stream: magic | (length | nonce | ciphertext)*. Each chunk is bound to the blob
+// key, its index and whether it is the last one, so chunks can't be reordered, moved
+// between blobs or cut off without Open failing.
+type SealedBlobStore struct {
+	store BlobStore
+	aead  *utils.AEAD
+}
+
+// NewSealedBlobStore wraps store, sealing blobs with a 32-byte key
+func NewSealedBlobStore(store BlobStore, key []byte) (*SealedBlobStore, error) {
+	aead, err := utils.NewAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &SealedBlobStore{store: store, aead: aead}, nil
+}
+
+// PutBlob seals r chunk by chunk into the wrapped store. The sealed size isn't known
+// up front, so the wrapped store always receives size -1.
+func (s *SealedBlobStore) PutBlob(key string, r io.Reader, size int64) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(s.seal(writer, key, r))
+	}()
+	err := s.store.PutBlob(key, reader, -1)
+	reader.CloseWithError(err) // unblocks the sealing if the upload stopped early
+	return err
+}
+
+func (s *SealedBlobStore) seal(w io.Writer, key string, r io.Reader) error {
+	if _, err := w.Write(sealedBlobMagic); err != nil {
+		return err
+	}
+
+	// Read one chunk ahead so the last chunk is known when it is sealed
+	br := bufio.NewReaderSize(r, sealedChunkSize)
+	chunk := make([]byte, sealedChunkSize)
+	var header [4]byte
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(br, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		final := err != nil
+		if !final {
+			_, peekErr := br.Peek(1)
+			final = peekErr == io.EOF
+		}
+
+		sealed, err := s.aead.Seal(chunk[:n], sealedChunkData(key, index, final))
+		if err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(header[:], uint32(len(sealed)))
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if final {
+			return nil
+		}
+	}
+}
+
+// GetBlob returns a reader decrypting the blob as it is read
+func (s *SealedBlobStore) GetBlob(key string) (io.ReadCloser, error) {
+	blob, err := s.store.GetBlob(key)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, len(sealedBlobMagic))
+	if _, err := io.ReadFull(blob, magic); err != nil || !bytes.Equal(magic, sealedBlobMagic) {
+		blob.Close()
+		return nil, fmt.Errorf("blob %s is not sealed with a backup key", key)
+	}
+	return &sealedBlobReader{store: s, key: key, blob: blob}, nil
+}
+
+// DeleteBlob deletes the sealed blob
+func (s *SealedBlobStore) DeleteBlob(key string) error {
+	return s.store.DeleteBlob(key)
+}
+
+// sealedChunkData is the associated data binding a chunk to its blob and position
+func sealedChunkData(key string, index uint64, final bool) []byte {
+	data := make([]byte, 0, len(key)+9)
+	data = append(data, key...)
+	data = binary.BigEndian.AppendUint64(data, index)
+	if final {
+		return append(data, 1)
+	}
+	return append(data, 0)
+}
+
+// sealedBlobReader opens a sealed blob one chunk at a time
+type sealedBlobReader struct {
+	store   *SealedBlobStore
+	key     string
+	blob    io.ReadCloser
+	index   uint64
+	pending []byte
+	done    bool
+}
+
+func (r *sealedBlobReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// next opens the following chunk; a chunk only authenticates as final if it was sealed
+// as the last one
+func (r *sealedBlobReader) next() error {
+	var header [4]byte
+	if _, err := io.ReadFull(r.blob, header[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrSealedBlobTruncated
+		}
+		return err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length > sealedChunkSize+uint32(r.store.aead.Overhead()) {
+		return fmt.Errorf("sealed chunk of %d bytes is too large", length)
+	}
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(r.blob, sealed); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrSealedBlobTruncated
+		}
+		return err
+	}
+
+	plaintext, err := r.store.aead.Open(sealed, sealedChunkData(r.key, r.index, false))
+	if err != nil {
+		if plaintext, err = r.store.aead.Open(sealed, sealedChunkData(r.key, r.index, true)); err != nil {
+			return fmt.Errorf("chunk %d of %s: %v", r.index, r.key, err)
+		}
+		r.done = true
+	}
+	r.index++
+	r.pending = plaintext
+	return nil
+}
+
+func (r *sealedBlobReader) Close() error {
+	return r.blob.Close()
+}
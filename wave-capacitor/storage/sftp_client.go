@@ -0,0 +1,433 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTP protocol version 3 packet types (draft-ietf-secsh-filexfer-02)
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpExtended = 200
+)
+
+// SFTP open flags and status codes
+const (
+	sftpFlagRead  = 0x01
+	sftpFlagWrite = 0x02
+	sftpFlagCreat = 0x08
+	sftpFlagTrunc = 0x10
+
+	sftpStatusOK     = 0
+	sftpStatusEOF    = 1
+	sftpStatusNoFile = 2
+)
+
+// sftpChunkSize is the payload of each read and write request; servers must accept 32KB
+const sftpChunkSize = 32 * 1024
+
+// posixRename is the OpenSSH extension replacing the target of a rename, which plain
+// SFTP v3 refuses to do
+const posixRename = "posix-rename@openssh.com"
+
+// SFTPOptions configures an SFTP connection
+type SFTPOptions struct {
+	Addr     string // host:port
+	User     string
+	Password string
+	// PrivateKey is a PEM-encoded SSH private key; used instead of or with Password
+	PrivateKey []byte
+	// HostKey is the server's public key in authorized_keys format; connections to a
+	// server presenting another key are refused
+	HostKey string
+	Timeout time.Duration
+}
+
+// sftpStatusError is a failure status returned by the server
+type sftpStatusError struct {
+	code    uint32
+	message string
+}
+
+func (e *sftpStatusError) Error() string {
+	return fmt.Sprintf("sftp: %s (status %d)", e.message, e.code)
+}
+
+// SFTPClient is a minimal SFTP client over an SSH connection, covering what a blob
+// store needs. Requests are sent one at a time.
+type SFTPClient struct {
+	conn    *ssh.Client
+	session *ssh.Session
+	in      io.WriteCloser
+	out     io.Reader
+
+	mutex       sync.Mutex
+	nextID      uint32
+	posixRename bool
+}
+
+// DialSFTP connects to the server and starts its sftp subsystem
+func DialSFTP(opts SFTPOptions) (*SFTPClient, error) {
+	if opts.HostKey == "" {
+		return nil, errors.New("the SFTP server's host key is required")
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(opts.HostKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SFTP host key: %v", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if len(opts.PrivateKey) > 0 {
+		signer, err := ssh.ParsePrivateKey(opts.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SFTP private key: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if opts.Password != "" {
+		auth = append(auth, ssh.Password(opts.Password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("an SFTP password or private key is required")
+	}
+
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	conn, err := ssh.Dial("tcp", opts.Addr, &ssh.ClientConfig{
+		User:            opts.User,
+		Auth:            auth,
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+		Timeout:         timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := newSFTPClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func newSFTPClient(conn *ssh.Client) (*SFTPClient, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	in, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return nil, fmt.Errorf("sftp subsystem: %v", err)
+	}
+
+	c := &SFTPClient{conn: conn, session: session, in: in, out: out}
+	if err := c.send(sftpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		return nil, err
+	}
+	typ, data, err := c.receive()
+	if err != nil {
+		return nil, err
+	}
+	if typ != sftpVersion || len(data) < 4 {
+		return nil, fmt.Errorf("sftp: unexpected packet %d during handshake", typ)
+	}
+	// Extensions follow the version as name/data string pairs
+	data = data[4:]
+	for len(data) > 0 {
+		var name string
+		if name, data, err = sftpString(data); err != nil {
+			return nil, err
+		}
+		if _, data, err = sftpString(data); err != nil {
+			return nil, err
+		}
+		if name == posixRename {
+			c.posixRename = true
+		}
+	}
+	return c, nil
+}
+
+// Close ends the SFTP session and the SSH connection
+func (c *SFTPClient) Close() error {
+	c.session.Close()
+	return c.conn.Close()
+}
+
+// send writes one packet: length | type | payload
+func (c *SFTPClient) send(typ byte, payload []byte) error {
+	packet := make([]byte, 0, 5+len(payload))
+	packet = binary.BigEndian.AppendUint32(packet, uint32(1+len(payload)))
+	packet = append(packet, typ)
+	packet = append(packet, payload...)
+	_, err := c.in.Write(packet)
+	return err
+}
+
+// receive reads one packet
+func (c *SFTPClient) receive() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.out, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > 256*1024 {
+		return 0, nil, fmt.Errorf("sftp: invalid packet length %d", length)
+	}
+	data := make([]byte, length-1)
+	if _, err := io.ReadFull(c.out, data); err != nil {
+		return 0, nil, err
+	}
+	return header[4], data, nil
+}
+
+// request sends a packet carrying a fresh request ID followed by fields and returns the
+// reply's type and the payload after its ID. Failure statuses are returned as errors.
+func (c *SFTPClient) request(typ byte, fields ...[]byte) (byte, []byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.nextID++
+	id := c.nextID
+	payload := binary.BigEndian.AppendUint32(nil, id)
+	for _, field := range fields {
+		payload = append(payload, field...)
+	}
+	if err := c.send(typ, payload); err != nil {
+		return 0, nil, err
+	}
+
+	reply, data, err := c.receive()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != id {
+		return 0, nil, errors.New("sftp: reply does not match the request")
+	}
+	data = data[4:]
+	if reply == sftpStatus {
+		if len(data) < 4 {
+			return 0, nil, errors.New("sftp: truncated status")
+		}
+		code := binary.BigEndian.Uint32(data)
+		if code != sftpStatusOK {
+			message, _, _ := sftpString(data[4:])
+			return 0, nil, &sftpStatusError{code: code, message: message}
+		}
+	}
+	return reply, data, nil
+}
+
+// sftpStr encodes a protocol string
+func sftpStr(s string) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(s))), s...)
+}
+
+// sftpString decodes a protocol string and returns the rest of data
+func sftpString(data []byte) (string, []byte, error) {
+	if len(data) < 4 {
+		return "", nil, errors.New("sftp: truncated string")
+	}
+	n := binary.BigEndian.Uint32(data)
+	if uint32(len(data)-4) < n {
+		return "", nil, errors.New("sftp: truncated string")
+	}
+	return string(data[4 : 4+n]), data[4+n:], nil
+}
+
+// noAttrs is an empty attribute block
+var noAttrs = binary.BigEndian.AppendUint32(nil, 0)
+
+// open opens path with the given flags and returns its handle
+func (c *SFTPClient) open(path string, flags uint32) (string, error) {
+	reply, data, err := c.request(sftpOpen, sftpStr(path), binary.BigEndian.AppendUint32(nil, flags), noAttrs)
+	if err != nil {
+		return "", err
+	}
+	if reply != sftpHandle {
+		return "", fmt.Errorf("sftp: unexpected reply %d to open", reply)
+	}
+	handle, _, err := sftpString(data)
+	return handle, err
+}
+
+func (c *SFTPClient) closeHandle(handle string) error {
+	_, _, err := c.request(sftpClose, sftpStr(handle))
+	return err
+}
+
+// WriteFile creates or truncates path and copies r into it
+func (c *SFTPClient) WriteFile(path string, r io.Reader) error {
+	handle, err := c.open(path, sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, sftpChunkSize)
+	var offset uint64
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, _, err := c.request(sftpWrite, sftpStr(handle), binary.BigEndian.AppendUint64(nil, offset), sftpStr(string(buf[:n]))); err != nil {
+				c.closeHandle(handle)
+				return err
+			}
+			offset += uint64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			c.closeHandle(handle)
+			return readErr
+		}
+	}
+	return c.closeHandle(handle)
+}
+
+// OpenFile opens path for reading; a missing file returns os.ErrNotExist
+func (c *SFTPClient) OpenFile(path string) (io.ReadCloser, error) {
+	handle, err := c.open(path, sftpFlagRead)
+	if err != nil {
+		return nil, notExist(err)
+	}
+	return &sftpFile{client: c, handle: handle}, nil
+}
+
+// Remove deletes the file at path; a missing file returns os.ErrNotExist
+func (c *SFTPClient) Remove(path string) error {
+	_, _, err := c.request(sftpRemove, sftpStr(path))
+	return notExist(err)
+}
+
+// Rename moves oldPath to newPath, replacing newPath
+func (c *SFTPClient) Rename(oldPath, newPath string) error {
+	if c.posixRename {
+		_, _, err := c.request(sftpExtended, sftpStr(posixRename), sftpStr(oldPath), sftpStr(newPath))
+		return err
+	}
+	// Plain SFTP fails when the target exists; the file is briefly missing in between
+	if err := c.Remove(newPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	_, _, err := c.request(sftpRename, sftpStr(oldPath), sftpStr(newPath))
+	return err
+}
+
+// MkdirAll creates dir and its missing parents
+func (c *SFTPClient) MkdirAll(dir string) error {
+	if dir == "" || dir == "." || dir == "/" {
+		return nil
+	}
+	if _, _, err := c.request(sftpStat, sftpStr(dir)); err == nil {
+		return nil
+	}
+	if parent := parentDir(dir); parent != dir {
+		if err := c.MkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	_, _, err := c.request(sftpMkdir, sftpStr(dir), noAttrs)
+	if err != nil {
+		// Another writer may have created it meanwhile
+		if _, _, statErr := c.request(sftpStat, sftpStr(dir)); statErr == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// parentDir returns the parent of a slash-separated path
+func parentDir(p string) string {
+	for i := len(p) - 1; i > 0; i-- {
+		if p[i] == '/' {
+			return p[:i]
+		}
+	}
+	return p
+}
+
+// notExist maps the SFTP "no such file" status to os.ErrNotExist
+func notExist(err error) error {
+	var status *sftpStatusError
+	if errors.As(err, &status) && status.code == sftpStatusNoFile {
+		return fmt.Errorf("%w: %s", os.ErrNotExist, status.message)
+	}
+	return err
+}
+
+// sftpServerError reports whether err is a status returned by the server, after which
+// the connection is still usable
+func sftpServerError(err error) bool {
+	var status *sftpStatusError
+	return errors.As(err, &status)
+}
+
+// sftpFile reads a remote file sequentially
+type sftpFile struct {
+	client *SFTPClient
+	handle string
+	offset uint64
+	eof    bool
+}
+
+func (f *sftpFile) Read(p []byte) (int, error) {
+	if f.eof {
+		return 0, io.EOF
+	}
+	if len(p) > sftpChunkSize {
+		p = p[:sftpChunkSize]
+	}
+	reply, data, err := f.client.request(sftpRead, sftpStr(f.handle), binary.BigEndian.AppendUint64(nil, f.offset), binary.BigEndian.AppendUint32(nil, uint32(len(p))))
+	var status *sftpStatusError
+	if errors.As(err, &status) && status.code == sftpStatusEOF {
+		f.eof = true
+		return 0, io.EOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	if reply != sftpData {
+		return 0, fmt.Errorf("sftp: unexpected reply %d to read", reply)
+	}
+	chunk, _, err := sftpString(data)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, chunk)
+	f.offset += uint64(n)
+	return n, nil
+}
+
+func (f *sftpFile) Close() error {
+	return f.client.closeHandle(f.handle)
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// SFTPBlobStore stores blobs as files below a directory of an SFTP server. The
+// connection is opened on first use and again after it breaks.
+type SFTPBlobStore struct {
+	opts SFTPOptions
+	dir  string
+
+	mutex  sync.Mutex
+	client *SFTPClient
+}
+
+// NewSFTPBlobStore creates a blob store rooted at dir on the server; a relative dir is
+// relative to the login directory
+func NewSFTPBlobStore(opts SFTPOptions, dir string) *SFTPBlobStore {
+	return &SFTPBlobStore{opts: opts, dir: dir}
+}
+
+// connection returns the open client, dialing the server if needed
+func (s *SFTPBlobStore) connection() (*SFTPClient, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client == nil {
+		client, err := DialSFTP(s.opts)
+		if err != nil {
+			return nil, err
+		}
+		s.client = client
+	}
+	return s.client, nil
+}
+
+// check drops the connection when err came from it rather than from the server, so the
+// next call reconnects
+func (s *SFTPBlobStore) check(client *SFTPClient, err error) error {
+	if err == nil || sftpServerError(err) || errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	s.mutex.Lock()
+	if s.client == client {
+		s.client = nil
+		client.Close()
+	}
+	s.mutex.Unlock()
+	return err
+}
+
+// pathFor maps a blob key to a remote path
+func (s *SFTPBlobStore) pathFor(key string) (string, error) {
+	if err := validateBlobKey(key); err != nil {
+		return "", err
+	}
+	return path.Join(s.dir, key), nil
+}
+
+// PutBlob uploads the blob to a temporary file and renames it into place
+func (s *SFTPBlobStore) PutBlob(key string, r io.Reader, size int64) error {
+	remote, err := s.pathFor(key)
+	if err != nil {
+		return err
+	}
+	client, err := s.connection()
+	if err != nil {
+		return err
+	}
+	if err := client.MkdirAll(path.Dir(remote)); err != nil {
+		return s.check(client, err)
+	}
+
+	tmp := remote + ".part"
+	if err := client.WriteFile(tmp, r); err != nil {
+		client.Remove(tmp)
+		return s.check(client, err)
+	}
+	return s.check(client, client.Rename(tmp, remote))
+}
+
+// GetBlob opens the remote file for reading
+func (s *SFTPBlobStore) GetBlob(key string) (io.ReadCloser, error) {
+	remote, err := s.pathFor(key)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.connection()
+	if err != nil {
+		return nil, err
+	}
+	blob, err := client.OpenFile(remote)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return blob, s.check(client, err)
+}
+
+// DeleteBlob removes the remote file
+func (s *SFTPBlobStore) DeleteBlob(key string) error {
+	remote, err := s.pathFor(key)
+	if err != nil {
+		return err
+	}
+	client, err := s.connection()
+	if err != nil {
+		return err
+	}
+	err = client.Remove(remote)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrBlobNotFound
+	}
+	return s.check(client, err)
+}
+
+// Close closes the connection, if open
+func (s *SFTPBlobStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Close()
+	s.client = nil
+	return err
+}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Shard transfer streams are tar archives with one entry per stored file:
+//
+//	keys/<folder>/<id>.key       wrapped data key (only with per-file keys)
+//	messages/<folder>/<id>.json  sealed message file, byte for byte
+//	MANIFEST.json                trailer with entry counts, marks the stream complete
+//
+// Each file entry carries its SHA-256 in a PAX record. Entries are ordered by folder and
+// message ID, and the cursor "<folder>/<id>" of the last imported message lets an interrupted
+// transfer resume. Both nodes must share the confusion salt, shard count, and master key.
+
+const (
+	transferChecksumRecord = "WAVE.sha256"
+	transferManifestName   = "MANIFEST.json"
+)
+
+// ShardManifest is the trailer of a shard transfer stream
+type ShardManifest struct {
+	Shard    int       `json:"shard"`
+	After    string    `json:"after,omitempty"`
+	Messages int       `json:"messages"`
+	Keys     int       `json:"keys"`
+	Created  time.Time `json:"created"`
+}
+
+// ShardImportStats summarizes an import
+type ShardImportStats struct {
+	Messages int    `json:"messages"`
+	Keys     int    `json:"keys"`
+	Cursor   string `json:"cursor"`
+	Complete bool   `json:"complete"`
+}
+
+// ExportShard streams every message folder of the shard to w, starting after cursor after
+func (s *FileMessageStore) ExportShard(w io.Writer, shard int, after string) error {
+	folders, err := s.shardFolders(shard)
+	if err != nil {
+		return err
+	}
+
+	afterFolder, afterID := splitCursor(after)
+	manifest := ShardManifest{Shard: shard, After: after, Created: time.Now().UTC()}
+	tw := tar.NewWriter(w)
+
+	for _, folder := range folders {
+		if folder < afterFolder {
+			continue
+		}
+
+		ids, err := s.folderMessageIDs(folder)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if folder == afterFolder && id <= afterID {
+				continue
+			}
+
+			// Send the data key first so the message is readable as soon as it lands
+			if s.dataKeys != nil {
+				wrapped, err := s.dataKeys.store.GetKey(dataKeyID(folder, id))
+				if err == nil {
+					if err := writeTransferEntry(tw, "keys/"+folder+"/"+id+".key", wrapped); err != nil {
+						return err
+					}
+					manifest.Keys++
+				} else if err != ErrDataKeyNotFound {
+					return err
+				}
+			}
+
+			file, err := ReadFilePooled(filepath.Join(s.shards.baseDir, folder, id+".json"), maxMessageFileSize)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue // Deleted during the export
+				}
+				return err
+			}
+			err = writeTransferEntry(tw, "messages/"+folder+"/"+id+".json", file.Bytes())
+			file.Release()
+			if err != nil {
+				return err
+			}
+			manifest.Messages++
+		}
+	}
+
+	trailer, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if err := writeTransferEntry(tw, transferManifestName, trailer); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ImportShard writes the entries of a stream produced by ExportShard, verifying each checksum.
+// onMessage is called with the new cursor after every committed message so callers can persist
+// a resume point. The import is complete only if the manifest trailer was received.
+func (s *FileMessageStore) ImportShard(r io.Reader, onMessage func(cursor string)) (ShardImportStats, error) {
+	var stats ShardImportStats
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return stats, errors.New("transfer stream ended without a manifest")
+		}
+		if err != nil {
+			return stats, fmt.Errorf("failed to read transfer stream: %v", err)
+		}
+
+		data, err := readTransferEntry(tr, hdr)
+		if err != nil {
+			return stats, err
+		}
+
+		if hdr.Name == transferManifestName {
+			var manifest ShardManifest
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return stats, fmt.Errorf("invalid transfer manifest: %v", err)
+			}
+			if manifest.Messages != stats.Messages || manifest.Keys != stats.Keys {
+				return stats, fmt.Errorf("transfer incomplete: manifest lists %d messages and %d keys, received %d and %d",
+					manifest.Messages, manifest.Keys, stats.Messages, stats.Keys)
+			}
+			stats.Complete = true
+			return stats, nil
+		}
+
+		kind, folder, name, err := parseTransferName(hdr.Name)
+		if err != nil {
+			return stats, err
+		}
+
+		switch kind {
+		case "keys":
+			if s.dataKeys == nil {
+				return stats, errors.New("stream contains data keys but per-file keys are not enabled on this node")
+			}
+			id := strings.TrimSuffix(name, ".key")
+			if err := s.dataKeys.store.PutKey(dataKeyID(folder, id), data); err != nil {
+				return stats, err
+			}
+			stats.Keys++
+		case "messages":
+			if err := s.importMessageFile(folder, name, data); err != nil {
+				return stats, err
+			}
+			stats.Messages++
+			stats.Cursor = folder + "/" + strings.TrimSuffix(name, ".json")
+			if onMessage != nil {
+				onMessage(stats.Cursor)
+			}
+		}
+	}
+}
+
+// importMessageFile stores a transferred message file in its folder
+func (s *FileMessageStore) importMessageFile(folder, name string, data []byte) error {
+	if _, err := verifyChecksum(data); err != nil {
+		return fmt.Errorf("refusing corrupted message %s/%s: %v", folder, name, err)
+	}
+	if err := s.diskGuard.Check(); err != nil {
+		return err
+	}
+
+	dir := filepath.Join(s.shards.baseDir, folder)
+	unlock, err := LockFolder(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return writeFileAtomic(filepath.Join(dir, name), data, 0600)
+}
+
+// shardFolders returns the sorted names of the message folders belonging to shard
+func (s *FileMessageStore) shardFolders(shard int) ([]string, error) {
+	entries, err := os.ReadDir(s.shards.baseDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	numShards, _ := s.shards.shardCounts()
+	var folders []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		index := 0
+		if numShards > 1 {
+			index = shardIndexFromFolder(entry.Name())
+		}
+		if index == shard {
+			folders = append(folders, entry.Name())
+		}
+	}
+	sort.Strings(folders)
+	return folders, nil
+}
+
+// folderMessageIDs returns the sorted message IDs stored in a folder
+func (s *FileMessageStore) folderMessageIDs(folder string) ([]string, error) {
+	start := time.Now()
+	entries, err := os.ReadDir(filepath.Join(s.shards.baseDir, folder))
+	logIfSlowScan(folder, len(entries), start)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// writeTransferEntry writes one file entry with its checksum record
+func writeTransferEntry(tw *tar.Writer, name string, data []byte) error {
+	sum := sha256.Sum256(data)
+	hdr := &tar.Header{
+		Name:       name,
+		Mode:       0600,
+		Size:       int64(len(data)),
+		ModTime:    time.Now(),
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{transferChecksumRecord: hex.EncodeToString(sum[:])},
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// readTransferEntry reads one file entry and verifies its checksum record
+func readTransferEntry(tr *tar.Reader, hdr *tar.Header) ([]byte, error) {
+	if hdr.Typeflag != tar.TypeReg || hdr.Size > maxDecompressedSize {
+		return nil, fmt.Errorf("unexpected transfer entry %q", hdr.Name)
+	}
+
+	data := make([]byte, hdr.Size)
+	if _, err := io.ReadFull(tr, data); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", hdr.Name, err)
+	}
+
+	sum := sha256.Sum256(data)
+	if hdr.PAXRecords[transferChecksumRecord] != hex.EncodeToString(sum[:]) {
+		return nil, fmt.Errorf("checksum mismatch for %s", hdr.Name)
+	}
+	return data, nil
+}
+
+// parseTransferName splits and validates "<kind>/<folder>/<file>"
+func parseTransferName(name string) (string, string, string, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 3 || (parts[0] != "keys" && parts[0] != "messages") {
+		return "", "", "", fmt.Errorf("unexpected transfer entry %q", name)
+	}
+	for _, part := range parts[1:] {
+		if err := validateMessageID(part); err != nil {
+			return "", "", "", fmt.Errorf("unexpected transfer entry %q", name)
+		}
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// splitCursor splits a "<folder>/<id>" resume cursor; an empty cursor starts from the beginning
+func splitCursor(cursor string) (string, string) {
+	folder, id, _ := strings.Cut(cursor, "/")
+	return folder, id
+}
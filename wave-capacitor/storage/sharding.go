@@ -3,30 +3,50 @@ package storage
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 )
 
-// Configuration values that should be imported from your config package
-// If these aren't defined in your config package, you'll need to add them
+// Folder derivation settings. main sets them from the configuration before creating a
+// message store; every ShardManager copies them when it is created.
 var (
-	// GetNumShards should be defined in your config package
-	// If not available, you can define it directly in this file
+	// GetNumShards returns the configured shard count
 	GetNumShards = func() int {
-		// Default to 1 if not configured elsewhere
 		return 1
 	}
 
-	// ConfusionSalt should be defined in your config package
-	// If not available, define it here
-	ConfusionSalt = "my_super_secret_salt" // This should match your config value
+	// ConfusionSalt is mixed into every key before hashing it into a folder name
+	ConfusionSalt = ""
+
+	// PreviousConfusionSalt is the salt being rotated away from; while it is set, messages
+	// are still found in the folders it derived until they are re-hashed (see SaltRotator)
+	PreviousConfusionSalt = ""
 )
 
+// ErrReshardInProgress is returned when the shard count is changed again before the
+// folders of the previous change have all been rebalanced
+var ErrReshardInProgress = errors.New("the previous shard count change is still being rebalanced")
+
+// ShardStatus reports the shard count and, until rebalancing finished, the previous one
+type ShardStatus struct {
+	NumShards         int `json:"num_shards"`
+	PreviousNumShards int `json:"previous_num_shards,omitempty"`
+}
+
 // ShardManager handles the logic for distributing data across multiple shards
 type ShardManager struct {
-	numShards     int
+	mu             sync.RWMutex
+	numShards      int
+	previousShards int // shard count before SetNumShards, 0 once its folders are rebalanced
+
 	confusionSalt string
+	previousSalt  string
 	baseDir       string
 }
 
@@ -35,13 +55,55 @@ func NewShardManager(baseDir string) *ShardManager {
 	return &ShardManager{
 		numShards:     GetNumShards(),
 		confusionSalt: ConfusionSalt,
+		previousSalt:  PreviousConfusionSalt,
 		baseDir:       baseDir,
 	}
 }
 
+// shardCounts returns the current shard count and the previous one while resharding
+func (sm *ShardManager) shardCounts() (int, int) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.numShards, sm.previousShards
+}
+
+// Status reports the shard count and, while resharding, the previous one
+func (sm *ShardManager) Status() ShardStatus {
+	current, previous := sm.shardCounts()
+	return ShardStatus{NumShards: current, PreviousNumShards: previous}
+}
+
+// SetNumShards changes the shard count at runtime. New messages go to the folders of the
+// new count right away; existing ones are still found in the folders of the previous
+// count until finishResharding is called after they have been rebalanced.
+func (sm *ShardManager) SetNumShards(numShards int) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if numShards == sm.numShards {
+		return nil
+	}
+	if sm.previousShards != 0 {
+		return ErrReshardInProgress
+	}
+	sm.previousShards = sm.numShards
+	sm.numShards = numShards
+	return nil
+}
+
+// finishResharding stops looking up the folders of the previous shard count, unless the
+// count changed since the rebalance that moved them started
+func (sm *ShardManager) finishResharding(numShards, previousShards int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.numShards == numShards && sm.previousShards == previousShards {
+		sm.previousShards = 0
+	}
+}
+
 // GetShardIndexForKey calculates which shard a particular key belongs to
 func (sm *ShardManager) GetShardIndexForKey(key string) int {
-	if sm.numShards <= 1 {
+	numShards, _ := sm.shardCounts()
+	if numShards <= 1 {
 		return 0
 	}
 
@@ -50,35 +112,91 @@ func (sm *ShardManager) GetShardIndexForKey(key string) int {
 	hash := sha256.Sum256([]byte(data))
 
 	// Use the first byte of the hash to determine the shard
-	return int(hash[0]) % sm.numShards
+	return int(hash[0]) % numShards
 }
 
 // GetFolderForKey returns the folder path for storing data associated with a key
 func (sm *ShardManager) GetFolderForKey(key string) string {
+	numShards, _ := sm.shardCounts()
+	return sm.folderFor(key, sm.confusionSalt, numShards)
+}
+
+// PreviousFolderForKey returns the folder the key had under the previous confusion salt,
+// or "" when no salt rotation is in progress
+func (sm *ShardManager) PreviousFolderForKey(key string) string {
+	if sm.previousSalt == "" || sm.previousSalt == sm.confusionSalt {
+		return ""
+	}
+	numShards, _ := sm.shardCounts()
+	return sm.folderFor(key, sm.previousSalt, numShards)
+}
+
+// ownerFolders returns the current folder of the key, followed by the folders it had
+// under the previous shard count while resharding and under the previous salt during a
+// salt rotation
+func (sm *ShardManager) ownerFolders(key string) []string {
+	salts := []string{sm.confusionSalt}
+	if sm.previousSalt != "" && sm.previousSalt != sm.confusionSalt {
+		salts = append(salts, sm.previousSalt)
+	}
+	current, previous := sm.shardCounts()
+	counts := []int{current}
+	if previous != 0 {
+		counts = append(counts, previous)
+	}
+
+	var folders []string
+	for _, salt := range salts {
+		for _, numShards := range counts {
+			// Both counts can map a key to the same shard
+			if folder := sm.folderFor(key, salt, numShards); !slices.Contains(folders, folder) {
+				folders = append(folders, folder)
+			}
+		}
+	}
+	return folders
+}
+
+// folderFor derives the key's folder from the given confusion salt and shard count
+func (sm *ShardManager) folderFor(key, salt string, numShards int) string {
 	// Hash the key with the confusion salt
-	data := key + sm.confusionSalt
+	data := key + salt
 	hash := sha256.Sum256([]byte(data))
 	hashPrefix := hex.EncodeToString(hash[:])[:16]
 
-	if sm.numShards <= 1 {
+	if numShards <= 1 {
 		// No sharding, just use the hash prefix
 		return filepath.Join(sm.baseDir, hashPrefix)
 	}
 
-	// With sharding, include the shard index in the folder name
-	shardIndex := sm.GetShardIndexForKey(key)
-	folderName := fmt.Sprintf("%s_%d", hashPrefix, shardIndex)
+	// With sharding, include the shard index in the folder name; the first byte of the
+	// hash picks the shard (see GetShardIndexForKey)
+	folderName := fmt.Sprintf("%s_%d", hashPrefix, int(hash[0])%numShards)
 	return filepath.Join(sm.baseDir, folderName)
 }
 
+// shardIndexFromFolder recovers the shard index from a folder name produced by GetFolderForKey
+func shardIndexFromFolder(folder string) int {
+	i := strings.LastIndex(folder, "_")
+	if i < 0 {
+		return 0
+	}
+	index, err := strconv.Atoi(folder[i+1:])
+	if err != nil {
+		return 0
+	}
+	return index
+}
+
 // GetAllShards returns paths to all possible shard folders
 func (sm *ShardManager) GetAllShards() []string {
-	if sm.numShards <= 1 {
+	numShards, _ := sm.shardCounts()
+	if numShards <= 1 {
 		return []string{sm.baseDir}
 	}
 
-	shards := make([]string, sm.numShards)
-	for i := 0; i < sm.numShards; i++ {
+	shards := make([]string, numShards)
+	for i := 0; i < numShards; i++ {
 		shards[i] = filepath.Join(sm.baseDir, fmt.Sprintf("shard_%d", i))
 	}
 	return shards
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	_ "modernc.org/sqlite" // Pure-Go SQLite driver, no cgo required
+)
+
+// SQLiteStore keeps messages and contacts in a single embedded database file.
+// It is intended for small self-hosted capacitors that don't want thousands of
+// small JSON files on disk.
+type SQLiteStore struct {
+	messageCodec
+	db        *sql.DB
+	shards    *ShardManager
+	diskGuard *DiskGuard // nil disables free-space checks
+}
+
+// OpenSQLiteStore opens (or creates) the database at path and prepares its schema
+func OpenSQLiteStore(path string, encryptor *Encryptor) (*SQLiteStore, error) {
+	if err := EnsureDirectoryExists(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SQLite database: %v", err)
+	}
+	// SQLite allows a single writer; serializing access avoids SQLITE_BUSY under load
+	db.SetMaxOpenConns(1)
+
+	schema := []string{
+		`CREATE TABLE IF NOT EXISTS messages (
+			owner_folder TEXT NOT NULL,
+			message_id TEXT NOT NULL,
+			data BLOB NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (owner_folder, message_id)
+		)`,
+		`CREATE TABLE IF NOT EXISTS contacts (
+			username TEXT PRIMARY KEY,
+			data BLOB NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+	}
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to create SQLite schema: %v", err)
+		}
+	}
+
+	// The database holds message payloads, keep it private to the node user
+	if err := os.Chmod(path, 0600); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{
+		messageCodec: messageCodec{encryptor: encryptor},
+		db:           db,
+		shards:       NewShardManager(""),
+	}, nil
+}
+
+// SetDiskGuard makes writes fail with ErrInsufficientStorage once free space runs low
+func (s *SQLiteStore) SetDiskGuard(guard *DiskGuard) {
+	s.diskGuard = guard
+}
+
+// Close closes the underlying database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// ownerFolder returns the obfuscated folder name used to key the owner's messages,
+// so the database never stores raw public keys
+func (s *SQLiteStore) ownerFolder(ownerKey string) string {
+	return filepath.Base(s.shards.GetFolderForKey(ownerKey))
+}
+
+// Write stores the serialized message, encrypting it when a master key is configured
+func (s *SQLiteStore) Write(ownerKey, messageID string, data []byte) error {
+	if err := validateMessageID(messageID); err != nil {
+		return err
+	}
+	return s.writeFolder(s.ownerFolder(ownerKey), messageID, data)
+}
+
+// writeFolder stores a message under the given folder name
+func (s *SQLiteStore) writeFolder(folder, messageID string, data []byte) error {
+	if err := s.diskGuard.Check(); err != nil {
+		return err
+	}
+
+	data, err := s.seal(folder, messageID, data)
+	if err != nil {
+		return err
+	}
+	return s.putSealed(folder, messageID, data)
+}
+
+// putSealed stores an already sealed message under the given folder name (used by tiering)
+func (s *SQLiteStore) putSealed(folder, messageID string, data []byte) error {
+	_, err := s.db.Exec(
+		`INSERT INTO messages (owner_folder, message_id, data) VALUES (?, ?, ?)
+		 ON CONFLICT (owner_folder, message_id) DO UPDATE SET data = excluded.data`,
+		folder, messageID, data,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store message: %v", err)
+	}
+	return nil
+}
+
+// Read returns the serialized message, transparently decrypting it
+func (s *SQLiteStore) Read(ownerKey, messageID string) ([]byte, error) {
+	return readRotated(s, s.shards, ownerKey, messageID)
+}
+
+// readFolder returns a message stored under the given folder name
+func (s *SQLiteStore) readFolder(folder, messageID string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow(
+		"SELECT data FROM messages WHERE owner_folder = ? AND message_id = ?",
+		folder, messageID,
+	).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.open(folder, messageID, data)
+}
+
+// List returns the IDs of all messages stored for the owner, oldest first
+func (s *SQLiteStore) List(ownerKey string) ([]string, error) {
+	return listRotated(s, s.shards, ownerKey)
+}
+
+// listFolder returns the IDs of the messages stored under the given folder name, oldest first
+func (s *SQLiteStore) listFolder(folder string) ([]string, error) {
+	rows, err := s.db.Query(
+		"SELECT message_id FROM messages WHERE owner_folder = ? ORDER BY created_at",
+		folder,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Delete removes a single message
+func (s *SQLiteStore) Delete(ownerKey, messageID string) error {
+	return deleteRotated(s, s.shards, ownerKey, messageID)
+}
+
+// RehashOwner moves the owner's messages to the folder of the current confusion salt
+func (s *SQLiteStore) RehashOwner(ownerKey string) (int, error) {
+	return rehashOwner(s, s.shards, ownerKey)
+}
+
+// deleteFolder removes a message stored under the given folder name
+func (s *SQLiteStore) deleteFolder(folder, messageID string) error {
+	result, err := s.db.Exec(
+		"DELETE FROM messages WHERE owner_folder = ? AND message_id = ?",
+		folder, messageID,
+	)
+	if err != nil {
+		return err
+	}
+	if err := s.shred(folder, messageID); err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+// LoadContacts returns the user's stored contact list, or nil if none exists
+func (s *SQLiteStore) LoadContacts(username string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow("SELECT data FROM contacts WHERE username = ?", username).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return data, err
+}
+
+// SaveContacts replaces the user's stored contact list
+func (s *SQLiteStore) SaveContacts(username string, data []byte) error {
+	_, err := s.db.Exec(
+		`INSERT INTO contacts (username, data, updated_at) VALUES (?, ?, CURRENT_TIMESTAMP)
+		 ON CONFLICT (username) DO UPDATE SET data = excluded.data, updated_at = excluded.updated_at`,
+		username, data,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to store contacts: %v", err)
+	}
+	return nil
+}
+
+// DeleteContacts removes the user's stored contact list
+func (s *SQLiteStore) DeleteContacts(username string) error {
+	if _, err := s.db.Exec("DELETE FROM contacts WHERE username = ?", username); err != nil {
+		return fmt.Errorf("failed to delete contacts: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ColdStore is a message store that can also accept already sealed payloads addressed by
+// obfuscated folder name, so messages can be migrated without knowing their owner's key
+type ColdStore interface {
+	MessageStore
+	putSealed(folder, messageID string, data []byte) error
+}
+
+// TieringReport summarizes one migration pass from the hot to the cold tier
+type TieringReport struct {
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	Migrated  int           `json:"migrated"`
+	Errors    int           `json:"errors"`
+}
+
+// TieredMessageStore keeps recent messages on local disk and moves older ones to a cold store.
+// Reads fall through to the cold tier, so callers see a single MessageStore.
+type TieredMessageStore struct {
+	hot    *FileMessageStore
+	cold   ColdStore
+	maxAge time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+
+	mu   sync.Mutex
+	last TieringReport
+}
+
+// NewTieredMessageStore creates a tiered store migrating hot messages older than maxAge to cold
+func NewTieredMessageStore(hot *FileMessageStore, cold ColdStore, maxAge time.Duration) *TieredMessageStore {
+	return &TieredMessageStore{
+		hot:    hot,
+		cold:   cold,
+		maxAge: maxAge,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Hot returns the local tier
+func (s *TieredMessageStore) Hot() *FileMessageStore {
+	return s.hot
+}
+
+// Write always stores new messages in the hot tier
+func (s *TieredMessageStore) Write(ownerKey, messageID string, data []byte) error {
+	return s.hot.Write(ownerKey, messageID, data)
+}
+
+// Read looks in the hot tier first and fetches from the cold tier on a miss
+func (s *TieredMessageStore) Read(ownerKey, messageID string) ([]byte, error) {
+	data, err := s.hot.Read(ownerKey, messageID)
+	if err != ErrMessageNotFound {
+		return data, err
+	}
+	return s.cold.Read(ownerKey, messageID)
+}
+
+// List returns the IDs stored in either tier
+func (s *TieredMessageStore) List(ownerKey string) ([]string, error) {
+	ids, err := s.hot.List(ownerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	coldIDs, err := s.cold.List(ownerKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cold messages: %v", err)
+	}
+
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+	for _, id := range coldIDs {
+		if !seen[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Delete removes the message from both tiers
+func (s *TieredMessageStore) Delete(ownerKey, messageID string) error {
+	hotErr := s.hot.Delete(ownerKey, messageID)
+	if hotErr != nil && hotErr != ErrMessageNotFound {
+		return hotErr
+	}
+
+	coldErr := s.cold.Delete(ownerKey, messageID)
+	if coldErr == ErrMessageNotFound && hotErr == nil {
+		return nil
+	}
+	return coldErr
+}
+
+// RehashOwner moves the owner's messages to the current confusion salt's folder in both tiers
+func (s *TieredMessageStore) RehashOwner(ownerKey string) (int, error) {
+	moved, err := s.hot.RehashOwner(ownerKey)
+	if err != nil {
+		return moved, err
+	}
+	if cold, ok := s.cold.(SaltRotator); ok {
+		coldMoved, err := cold.RehashOwner(ownerKey)
+		return moved + coldMoved, err
+	}
+	return moved, nil
+}
+
+// RemoveOwnerFolders removes the owner's folders from the hot tier; cold objects are
+// removed through Delete
+func (s *TieredMessageStore) RemoveOwnerFolders(ownerKey string) error {
+	return s.hot.RemoveOwnerFolders(ownerKey)
+}
+
+// Start migrates old messages to the cold tier every interval until Stop is called
+func (s *TieredMessageStore) Start(interval time.Duration) {
+	if interval <= 0 {
+		close(s.done) // Migration only runs when Migrate is called explicitly
+		return
+	}
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				report := s.Migrate()
+				if report.Migrated > 0 || report.Errors > 0 {
+					logger.Info(context.Background(), "storage tiering finished", "migrated", report.Migrated,
+						"errors", report.Errors, "duration_ms", report.Duration.Milliseconds())
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts background migration and waits for the current pass to finish
+func (s *TieredMessageStore) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+// Close releases the cold tier if it holds resources such as a database handle
+func (s *TieredMessageStore) Close() error {
+	if closer, ok := s.cold.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// LastReport returns the result of the most recent migration pass
+func (s *TieredMessageStore) LastReport() TieringReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// Migrate moves every hot message older than maxAge to the cold tier
+func (s *TieredMessageStore) Migrate() TieringReport {
+	report := TieringReport{StartedAt: time.Now()}
+	cutoff := time.Now().Add(-s.maxAge)
+
+	folders, err := os.ReadDir(s.hot.shards.baseDir)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Error(context.Background(), "listing message folders failed", "error", err)
+		report.Errors++
+	}
+
+	for _, folder := range folders {
+		if !folder.IsDir() {
+			continue
+		}
+		if s.stopping() {
+			break
+		}
+		s.migrateFolder(filepath.Join(s.hot.shards.baseDir, folder.Name()), cutoff, &report)
+	}
+
+	report.Duration = time.Since(report.StartedAt)
+
+	s.mu.Lock()
+	s.last = report
+	s.mu.Unlock()
+	return report
+}
+
+// migrateFolder moves the folder's messages last modified before cutoff
+func (s *TieredMessageStore) migrateFolder(folder string, cutoff time.Time, report *TieringReport) {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		report.Errors++
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		if s.stopping() {
+			return
+		}
+
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		if err := s.migrateFile(folder, entry.Name()); err != nil {
+			logger.Error(context.Background(), "migrating message file to cold storage failed", "path", filepath.Join(folder, entry.Name()), "error", err)
+			report.Errors++
+			continue
+		}
+		report.Migrated++
+	}
+}
+
+// migrateFile copies one sealed message to the cold tier and removes the local copy
+func (s *TieredMessageStore) migrateFile(folder, name string) error {
+	unlock, err := LockFolder(folder)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	path := filepath.Join(folder, name)
+	file, err := ReadFilePooled(path, maxMessageFileSize)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // Deleted since the folder was listed
+		}
+		return err
+	}
+	defer file.Release()
+
+	// The checksum frame is local to the file store; the cold tier gets the sealed payload
+	payload, err := verifyChecksum(file.Bytes())
+	if err != nil {
+		if errors.Is(err, ErrMessageCorrupted) {
+			return fmt.Errorf("not migrating corrupted file: %v", err)
+		}
+		return err
+	}
+
+	messageID := strings.TrimSuffix(name, ".json")
+	if err := s.cold.putSealed(filepath.Base(folder), messageID, payload); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// stopping reports whether Stop has been called
+func (s *TieredMessageStore) stopping() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,160 @@
+// Package telemetry periodically sends anonymous usage statistics to the project when the
+// operator opts in. Reports hold no identifiers, addresses or user data: only the version,
+// the platform and coarse buckets of the message throughput and the DHT size, so the
+// project can see how the capacitor is deployed without learning who deploys it.
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+	"wave_capacitor/logging"
+)
+
+// sendTimeout bounds one report
+const sendTimeout = 30 * time.Second
+
+var logger = logging.Component("telemetry")
+
+// Report is everything sent; it has no field that identifies the node or its users
+type Report struct {
+	Version     string `json:"version"`
+	GoVersion   string `json:"go_version"`
+	OS          string `json:"os"`
+	Arch        string `json:"arch"`
+	Period      string `json:"period"`            // the reporting interval the buckets cover, e.g. "24h0m0s"
+	Messages    string `json:"messages"`          // messages delivered during the period, bucketed
+	DHTNodes    string `json:"dht_nodes"`         // nodes in the DHT routing table, bucketed
+	StorageKind string `json:"storage,omitempty"` // the storage backend, e.g. "file" or "s3"
+}
+
+// Options configures a Reporter
+type Options struct {
+	Endpoint    string        // receives each report as a JSON POST
+	Interval    time.Duration // between reports; the first is sent one interval after Start
+	Version     string
+	StorageKind string
+	Messages    func() int64 // total messages delivered since the process started
+	DHTNodes    func() int   // nodes currently known through the DHT; nil reports "0"
+}
+
+// Reporter sends a report every interval until it is stopped
+type Reporter struct {
+	opts   Options
+	client *http.Client
+
+	lastMessages int64
+	stop         chan struct{}
+	wg           sync.WaitGroup
+}
+
+// NewReporter creates a reporter; call Start to begin reporting
+func NewReporter(opts Options) *Reporter {
+	r := &Reporter{
+		opts:   opts,
+		client: &http.Client{Timeout: sendTimeout},
+		stop:   make(chan struct{}),
+	}
+	if opts.Messages != nil {
+		r.lastMessages = opts.Messages()
+	}
+	return r
+}
+
+// Start sends a report every interval until Stop is called
+func (r *Reporter) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.send()
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the reporting, waiting for a report in flight
+func (r *Reporter) Stop() {
+	close(r.stop)
+	r.wg.Wait()
+}
+
+// Collect builds the report for the period since the previous one
+func (r *Reporter) Collect() Report {
+	report := Report{
+		Version:     r.opts.Version,
+		GoVersion:   runtime.Version(),
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		Period:      r.opts.Interval.String(),
+		Messages:    bucket(0),
+		DHTNodes:    bucket(0),
+		StorageKind: r.opts.StorageKind,
+	}
+	if r.opts.Messages != nil {
+		total := r.opts.Messages()
+		report.Messages = bucket(total - r.lastMessages)
+		r.lastMessages = total
+	}
+	if r.opts.DHTNodes != nil {
+		report.DHTNodes = bucket(int64(r.opts.DHTNodes()))
+	}
+	return report
+}
+
+// send posts one report; failures are logged and the report is dropped
+func (r *Reporter) send() {
+	report := r.Collect()
+	body, err := json.Marshal(report)
+	if err != nil {
+		logger.Warn(context.Background(), "encoding usage report failed", "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		logger.Warn(ctx, "sending usage report failed", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		logger.Warn(ctx, "sending usage report failed", "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode/100 != 2 {
+		logger.Warn(ctx, "sending usage report failed", "status", resp.StatusCode)
+		return
+	}
+	logger.Debug(ctx, "usage report sent", "report", string(body))
+}
+
+// bucket rounds n down to a power of ten so reports cannot single out a deployment by
+// its exact figures: "0", "1-9", "10-99", "100-999", ...
+func bucket(n int64) string {
+	if n <= 0 {
+		return "0"
+	}
+	low := int64(1)
+	for low*10 <= n && low < 1e15 {
+		low *= 10
+	}
+	return fmt.Sprintf("%d-%d", low, low*10-1)
+}
@@ -0,0 +1,295 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// exportQueueSize bounds the spans waiting for export; more are dropped
+	exportQueueSize = 4096
+	// exportBatchSize is the most spans sent in one request
+	exportBatchSize = 512
+	// exportInterval is how long finished spans wait for a batch to fill up
+	exportInterval = 5 * time.Second
+	// exportTimeout bounds one export request
+	exportTimeout = 10 * time.Second
+)
+
+// Options configures the export of spans
+type Options struct {
+	Endpoint      string            // Base URL of the OTLP/HTTP collector, e.g. http://otel-collector:4318
+	Headers       map[string]string // Sent with every export, e.g. the collector's API key
+	ServiceName   string
+	SamplePercent int               // Share of new traces recorded; incoming traces keep the caller's decision
+	Resource      map[string]string // Further resource attributes, e.g. service.instance.id
+}
+
+// exporter batches finished spans and posts them to the collector in the OTLP JSON encoding
+type exporter struct {
+	url           string
+	headers       map[string]string
+	resource      []otlpAttribute
+	samplePercent int
+	client        *http.Client
+
+	queue   chan *Span
+	dropped atomic.Int64
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// current is the exporter configured by Setup, nil while tracing is off
+var current atomic.Pointer[exporter]
+
+// Setup starts exporting spans to the collector at opts.Endpoint. Call it once at startup,
+// before serving; the returned function flushes the remaining spans and stops the export.
+func Setup(opts Options) (shutdown func(), err error) {
+	if !strings.HasPrefix(opts.Endpoint, "http://") && !strings.HasPrefix(opts.Endpoint, "https://") {
+		return nil, fmt.Errorf("OTLP endpoint %q is not an http(s) URL", opts.Endpoint)
+	}
+	if opts.SamplePercent < 0 || opts.SamplePercent > 100 {
+		return nil, fmt.Errorf("sample percentage %d is not between 0 and 100", opts.SamplePercent)
+	}
+
+	resource := []otlpAttribute{newOTLPAttribute("service.name", opts.ServiceName)}
+	for key, value := range opts.Resource {
+		resource = append(resource, newOTLPAttribute(key, value))
+	}
+
+	e := &exporter{
+		url:           strings.TrimSuffix(opts.Endpoint, "/") + "/v1/traces",
+		headers:       opts.Headers,
+		resource:      resource,
+		samplePercent: opts.SamplePercent,
+		// Not traced itself, or every export would produce spans to export
+		client: &http.Client{Timeout: exportTimeout},
+		queue:  make(chan *Span, exportQueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go e.run()
+	current.Store(e)
+
+	return func() {
+		current.Store(nil)
+		close(e.stop)
+		<-e.done
+	}, nil
+}
+
+// ParseHeaders parses headers in the OTEL_EXPORTER_OTLP_HEADERS format, "key1=value1,key2=value2"
+func ParseHeaders(s string) map[string]string {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if key = strings.TrimSpace(key); ok && key != "" {
+			headers[key] = strings.TrimSpace(value)
+		}
+	}
+	return headers
+}
+
+// sample decides whether a new trace is recorded
+func (e *exporter) sample(id TraceID) bool {
+	return sampleBucket(id) < e.samplePercent
+}
+
+// enqueue hands a finished span to the export loop, dropping it when the queue is full
+// rather than slowing down the request that produced it
+func (e *exporter) enqueue(span *Span) {
+	select {
+	case e.queue <- span:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+// run exports full batches right away and partial ones every exportInterval
+func (e *exporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, exportBatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			e.export(batch)
+			batch = batch[:0]
+		}
+		if dropped := e.dropped.Swap(0); dropped > 0 {
+			log.Printf("⚠️ Dropped %d spans, the export queue was full", dropped)
+		}
+	}
+
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) == exportBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.stop:
+			for {
+				select {
+				case span := <-e.queue:
+					batch = append(batch, span)
+					if len(batch) == exportBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// export posts one batch; failed batches are logged and dropped
+func (e *exporter) export(batch []*Span) {
+	body, err := json.Marshal(e.request(batch))
+	if err != nil {
+		log.Printf("⚠️ Failed to encode %d spans: %v", len(batch), err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("⚠️ Failed to export %d spans: %v", len(batch), err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		log.Printf("⚠️ Failed to export %d spans: %v", len(batch), err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode/100 != 2 {
+		log.Printf("⚠️ Failed to export %d spans: collector returned status %d", len(batch), resp.StatusCode)
+	}
+}
+
+// OTLP JSON encoding of an export request; IDs are hex and 64-bit integers strings
+// (see the OTLP specification's JSON protobuf encoding)
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 is an error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func newOTLPAttribute(key string, value interface{}) otlpAttribute {
+	attr := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case int:
+		s := strconv.Itoa(v)
+		attr.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		attr.Value.IntValue = &s
+	case float64:
+		attr.Value.DoubleValue = &v
+	case bool:
+		attr.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		attr.Value.StringValue = &s
+	}
+	return attr
+}
+
+// request encodes a batch of spans
+func (e *exporter) request(batch []*Span) otlpRequest {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(batch))}
+	scope.Scope.Name = "wave_capacitor"
+	for _, span := range batch {
+		scope.Spans = append(scope.Spans, span.otlp())
+	}
+
+	resourceSpans := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resourceSpans.Resource.Attributes = e.resource
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{resourceSpans}}
+}
+
+// otlp encodes a finished span
+func (s *Span) otlp() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	span := otlpSpan{
+		TraceID:           s.context.TraceID.String(),
+		SpanID:            s.context.SpanID.String(),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parent != (SpanID{}) {
+		span.ParentSpanID = s.parent.String()
+	}
+	for _, attr := range s.attrs {
+		span.Attributes = append(span.Attributes, newOTLPAttribute(attr.key, attr.value))
+	}
+	if s.err != "" {
+		span.Status = &otlpStatus{Code: 2, Message: s.err}
+	}
+	return span
+}
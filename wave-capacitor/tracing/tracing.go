@@ -0,0 +1,244 @@
+// Package tracing records OpenTelemetry spans along the request path and exports them to
+// an OTLP/HTTP collector. Spans continue across nodes through the W3C traceparent header.
+// Until Setup is called Start returns nil spans, and every Span method accepts a nil
+// receiver, so instrumented code costs next to nothing with tracing off.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceParentHeader carries the trace context on HTTP requests and gRPC metadata
+const TraceParentHeader = "traceparent"
+
+// TraceID identifies a trace across all nodes it touches
+type TraceID [16]byte
+
+// SpanID identifies a span within its trace
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// SpanKind is the OTLP span kind
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2 // an incoming request
+	KindClient   SpanKind = 3 // an outgoing request or query
+)
+
+// SpanContext is what a span passes on to its children, in process or in a traceparent
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+type spanContextKey struct{}
+
+// attribute is a span attribute; values are strings, integers, floats or booleans
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// Span is one timed operation of a trace. A nil Span records nothing.
+type Span struct {
+	context SpanContext
+	parent  SpanID
+	kind    SpanKind
+	start   time.Time
+
+	mu    sync.Mutex
+	name  string
+	attrs []attribute
+	end   time.Time
+	err   string
+	ended bool
+}
+
+// Start begins a span named name as a child of the span in ctx, or of a new trace. The
+// returned context carries the span, also when it is not sampled, so the decision
+// propagates to its children and to other nodes.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	e := current.Load()
+	if e == nil {
+		return ctx, nil
+	}
+
+	sc := SpanContext{SpanID: newSpanID()}
+	parent, hasParent := FromContext(ctx)
+	if hasParent {
+		sc.TraceID = parent.TraceID
+		sc.Sampled = parent.Sampled
+	} else {
+		sc.TraceID = newTraceID()
+		sc.Sampled = e.sample(sc.TraceID)
+	}
+	ctx = context.WithValue(ctx, spanContextKey{}, sc)
+	if !sc.Sampled {
+		return ctx, nil
+	}
+
+	span := &Span{context: sc, kind: kind, start: time.Now(), name: name}
+	if hasParent {
+		span.parent = parent.SpanID
+	}
+	return ctx, span
+}
+
+// Enabled reports whether spans are exported
+func Enabled() bool {
+	return current.Load() != nil
+}
+
+// FromContext returns the span context carried by ctx
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	if ctx == nil {
+		return SpanContext{}, false
+	}
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// TraceIDFromContext returns the ID of the sampled trace ctx belongs to, or "" when there
+// is none, for correlating log lines with traces
+func TraceIDFromContext(ctx context.Context) string {
+	if sc, ok := FromContext(ctx); ok && sc.Sampled {
+		return sc.TraceID.String()
+	}
+	return ""
+}
+
+// SetName renames the span, e.g. once the route of a request is known
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.name = name
+}
+
+// SetAttribute records an attribute; values other than strings, integers, floats and
+// booleans are recorded as their fmt representation
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	switch value.(type) {
+	case string, int, int64, float64, bool:
+	default:
+		value = fmt.Sprint(value)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attribute{key: key, value: value})
+}
+
+// End finishes the span and queues it for export; a non-nil err marks it as failed
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	s.mu.Unlock()
+
+	if e := current.Load(); e != nil {
+		e.enqueue(s)
+	}
+}
+
+// Extract returns ctx carrying the remote span context of a traceparent header value, or
+// ctx itself when the value is missing or malformed
+func Extract(ctx context.Context, traceparent string) context.Context {
+	// version "-" trace-id "-" parent-id "-" trace-flags
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return ctx
+	}
+	var sc SpanContext
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return ctx
+	}
+	if n, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || n != len(sc.TraceID) || sc.TraceID == (TraceID{}) {
+		return ctx
+	}
+	if n, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || n != len(sc.SpanID) || sc.SpanID == (SpanID{}) {
+		return ctx
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// TraceParent returns the traceparent header value continuing the span in ctx, or ""
+func TraceParent(ctx context.Context) string {
+	sc, ok := FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// Inject sets the traceparent header of an outgoing request from ctx
+func Inject(ctx context.Context, header http.Header) {
+	if traceparent := TraceParent(ctx); traceparent != "" {
+		header.Set(TraceParentHeader, traceparent)
+	}
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	randomID(id[:])
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	randomID(id[:])
+	return id
+}
+
+// randomID fills b with random bytes, never all zero (an invalid ID)
+func randomID(b []byte) {
+	for {
+		if _, err := rand.Read(b); err != nil {
+			// crypto/rand does not fail on supported platforms
+			panic(err)
+		}
+		for _, c := range b {
+			if c != 0 {
+				return
+			}
+		}
+	}
+}
+
+// sampleBucket maps a trace ID to 0-99; every node derives the same bucket for a trace
+func sampleBucket(id TraceID) int {
+	return int(binary.BigEndian.Uint64(id[8:]) % 100)
+}
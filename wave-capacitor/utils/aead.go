@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// maxRandomNonceSeals bounds how many messages may be sealed under one key with
+// random 96-bit nonces before the collision probability becomes unacceptable (NIST SP 800-38D).
+const maxRandomNonceSeals = 1 << 32
+
+// ErrNonceExhausted is returned when a key has been used for too many encryptions
+var ErrNonceExhausted = errors.New("nonce space exhausted for this key; rotate the key")
+
+// DeriveKey derives a subkey of the given length from secret using HKDF-SHA256.
+// info must be unique per purpose so derived keys never overlap.
+func DeriveKey(secret, salt []byte, info string, length int) ([]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("Key derivation requires a non-empty secret")
+	}
+	if info == "" {
+		return nil, errors.New("Key derivation requires a purpose string")
+	}
+	return hkdf.Key(sha256.New, secret, salt, info, length)
+}
+
+// RandomNonce returns a fresh random nonce of the given size
+func RandomNonce(size int) ([]byte, error) {
+	if size < 12 {
+		return nil, fmt.Errorf("Nonce size %d is too small for random nonces", size)
+	}
+	nonce, err := GenerateRandomBytes(size)
+	if err != nil {
+		return nil, fmt.Errorf("Nonce generation failed: %v", err)
+	}
+	return nonce, nil
+}
+
+// AEAD wraps AES-256-GCM with nonce management. Sealed output is nonce || ciphertext.
+type AEAD struct {
+	aead  cipher.AEAD
+	mutex sync.Mutex
+	seals uint64
+}
+
+// NewAESGCM creates an AEAD from a 32-byte key
+func NewAESGCM(key []byte) (*AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("AES key must be exactly 32 bytes")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("AES cipher creation failed: %v", err)
+	}
+
+	aesGCM, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("GCM mode initialization failed: %v", err)
+	}
+	return &AEAD{aead: aesGCM}, nil
+}
+
+// NonceSize returns the nonce length prepended to sealed output
+func (a *AEAD) NonceSize() int {
+	return a.aead.NonceSize()
+}
+
+// Overhead returns the total bytes added to the plaintext by Seal
+func (a *AEAD) Overhead() int {
+	return a.aead.NonceSize() + a.aead.Overhead()
+}
+
+// Seal encrypts plaintext under a fresh random nonce and returns nonce || ciphertext
+func (a *AEAD) Seal(plaintext, associatedData []byte) ([]byte, error) {
+	return a.SealTo(nil, plaintext, associatedData)
+}
+
+// SealTo is like Seal but appends the result to dst
+func (a *AEAD) SealTo(dst, plaintext, associatedData []byte) ([]byte, error) {
+	a.mutex.Lock()
+	if a.seals >= maxRandomNonceSeals {
+		a.mutex.Unlock()
+		return nil, ErrNonceExhausted
+	}
+	a.seals++
+	a.mutex.Unlock()
+
+	nonce, err := RandomNonce(a.aead.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+
+	dst = append(dst, nonce...)
+	return a.aead.Seal(dst, nonce, plaintext, associatedData), nil
+}
+
+// Open decrypts nonce || ciphertext produced by Seal
+func (a *AEAD) Open(sealed, associatedData []byte) ([]byte, error) {
+	nonceSize := a.aead.NonceSize()
+	if len(sealed) < nonceSize+a.aead.Overhead() {
+		return nil, errors.New("Ciphertext is truncated")
+	}
+
+	plaintext, err := a.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("Decryption failed: %v", err)
+	}
+	return plaintext, nil
+}
+
+// OpenWithNonce decrypts a ciphertext whose nonce is stored separately
+func (a *AEAD) OpenWithNonce(nonce, ciphertext, associatedData []byte) ([]byte, error) {
+	if len(nonce) != a.aead.NonceSize() {
+		return nil, errors.New("Invalid nonce length")
+	}
+	plaintext, err := a.aead.Open(nil, nonce, ciphertext, associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("Decryption failed: %v", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// testAEAD returns an AEAD under a random key
+func testAEAD(t testing.TB) *AEAD {
+	key, err := GenerateRandomBytes(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := NewAESGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func TestAEADRoundTrip(t *testing.T) {
+	aead := testAEAD(t)
+	for _, plaintext := range [][]byte{nil, []byte("x"), bytes.Repeat([]byte("wave"), 4096)} {
+		sealed, err := aead.Seal(plaintext, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sealed) != len(plaintext)+aead.Overhead() {
+			t.Fatalf("sealed %d bytes into %d, want overhead %d", len(plaintext), len(sealed), aead.Overhead())
+		}
+		got, err := aead.Open(sealed, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatal("plaintext changed in the round trip")
+		}
+
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		if got, err := aead.OpenWithNonce(nonce, ciphertext, []byte("data")); err != nil || !bytes.Equal(got, plaintext) {
+			t.Fatalf("OpenWithNonce: got %q, %v", got, err)
+		}
+		if _, err := aead.Open(sealed, []byte("other")); err == nil {
+			t.Fatal("opened with the wrong associated data")
+		}
+	}
+
+	// SealTo appends to dst
+	sealed, err := aead.SealTo([]byte("prefix"), []byte("payload"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := aead.Open(bytes.TrimPrefix(sealed, []byte("prefix")), nil); err != nil || string(got) != "payload" {
+		t.Fatalf("SealTo: got %q, %v", got, err)
+	}
+}
+
+func TestAEADNoncesAreUnique(t *testing.T) {
+	aead := testAEAD(t)
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		sealed, err := aead.Seal([]byte("same plaintext"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := string(sealed[:aead.NonceSize()])
+		if seen[nonce] {
+			t.Fatalf("nonce repeated after %d seals", i)
+		}
+		seen[nonce] = true
+	}
+}
+
+func TestAEADNonceExhaustion(t *testing.T) {
+	aead := testAEAD(t)
+	aead.seals = maxRandomNonceSeals - 1
+	if _, err := aead.Seal([]byte("last"), nil); err != nil {
+		t.Fatalf("last seal under the limit: %v", err)
+	}
+	if _, err := aead.Seal([]byte("one too many"), nil); !errors.Is(err, ErrNonceExhausted) {
+		t.Fatalf("got %v, want ErrNonceExhausted", err)
+	}
+}
+
+func TestNewAESGCMKeySize(t *testing.T) {
+	for _, size := range []int{0, 16, 31, 33} {
+		if _, err := NewAESGCM(make([]byte, size)); err == nil {
+			t.Fatalf("accepted a %d-byte key", size)
+		}
+	}
+}
+
+func TestOpenRejectsMalformedInput(t *testing.T) {
+	aead := testAEAD(t)
+	if _, err := aead.Open(make([]byte, aead.Overhead()-1), nil); err == nil {
+		t.Fatal("opened a truncated ciphertext")
+	}
+	if _, err := aead.OpenWithNonce(make([]byte, aead.NonceSize()-1), make([]byte, 16), nil); err == nil {
+		t.Fatal("opened with a short nonce")
+	}
+	if _, err := RandomNonce(8); err == nil {
+		t.Fatal("RandomNonce accepted an 8-byte nonce")
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	secret := []byte("secret")
+	key, err := DeriveKey(secret, nil, "purpose", 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 32 {
+		t.Fatalf("got %d bytes, want 32", len(key))
+	}
+	again, err := DeriveKey(secret, nil, "purpose", 32)
+	if err != nil || !bytes.Equal(key, again) {
+		t.Fatal("derivation is not deterministic")
+	}
+	other, err := DeriveKey(secret, nil, "other purpose", 32)
+	if err != nil || bytes.Equal(key, other) {
+		t.Fatal("different purposes derived the same key")
+	}
+	salted, err := DeriveKey(secret, []byte("salt"), "purpose", 32)
+	if err != nil || bytes.Equal(key, salted) {
+		t.Fatal("different salts derived the same key")
+	}
+
+	tests := []struct {
+		name   string
+		secret []byte
+		info   string
+		length int
+	}{
+		{"empty secret", nil, "purpose", 32},
+		{"empty purpose", secret, "", 32},
+		{"too long", secret, "purpose", 255*32 + 1},
+	}
+	for _, tt := range tests {
+		if _, err := DeriveKey(tt.secret, nil, tt.info, tt.length); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+// FuzzOpen checks that any change to a sealed message or its associated data is
+// detected: Open either returns the original plaintext or fails.
+func FuzzOpen(f *testing.F) {
+	f.Add([]byte("plaintext"), []byte("data"), 0, byte(1))
+	f.Add([]byte{}, []byte{}, 12, byte(0x80))
+	f.Add(bytes.Repeat([]byte{0}, 64), []byte("data"), -1, byte(0))
+
+	aead := testAEAD(f)
+	f.Fuzz(func(t *testing.T, plaintext, associatedData []byte, position int, flip byte) {
+		sealed, err := aead.Seal(plaintext, associatedData)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A negative position cuts the message short instead of flipping bits
+		tampered := bytes.Clone(sealed)
+		if position < 0 {
+			tampered = tampered[:len(tampered)+position%len(tampered)]
+		} else {
+			tampered[position%len(tampered)] ^= flip
+		}
+
+		got, err := aead.Open(tampered, associatedData)
+		if bytes.Equal(tampered, sealed) {
+			if err != nil || !bytes.Equal(got, plaintext) {
+				t.Fatalf("untampered message: got %q, %v", got, err)
+			}
+			return
+		}
+		if err == nil {
+			t.Fatalf("tampered message opened to %q", got)
+		}
+	})
+}
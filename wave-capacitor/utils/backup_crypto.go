@@ -0,0 +1,122 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// EncryptedBackupFormat identifies passphrase-encrypted backup archives
+const EncryptedBackupFormat = "wave-backup-encrypted"
+
+// Argon2id parameters used for new backups (OWASP recommended baseline)
+const (
+	backupArgonTime    = 3
+	backupArgonMemory  = 64 * 1024 // KiB
+	backupArgonThreads = 4
+)
+
+// maxBackupArgonTime bounds the Argon2id passes a backup may ask for
+const maxBackupArgonTime = 10
+
+// backupKDFSlots bounds the backup keys derived at once, each taking up to
+// backupArgonMemory, so that a burst of restores can't exhaust the node's memory
+var backupKDFSlots = make(chan struct{}, 2)
+
+// KDFParams records the Argon2id parameters used to derive a backup key
+type KDFParams struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+}
+
+// EncryptedBackup is a self-describing, passphrase-encrypted backup archive
+type EncryptedBackup struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	KDF        string    `json:"kdf"`
+	KDFParams  KDFParams `json:"kdf_params"`
+	Salt       string    `json:"salt"`
+	Nonce      string    `json:"nonce"`
+	Ciphertext string    `json:"ciphertext"`
+}
+
+// EncryptBackup encrypts a serialized backup with AES-256-GCM under an Argon2id key derived from passphrase
+func EncryptBackup(plaintext []byte, passphrase string) (*EncryptedBackup, error) {
+	if passphrase == "" {
+		return nil, errors.New("Passphrase is required")
+	}
+
+	salt, err := GenerateRandomBytes(16)
+	if err != nil {
+		return nil, fmt.Errorf("Salt generation failed: %v", err)
+	}
+
+	params := KDFParams{Time: backupArgonTime, Memory: backupArgonMemory, Threads: backupArgonThreads}
+	aesGCM, err := backupCipher(passphrase, salt, params)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := aesGCM.Seal(plaintext, []byte(EncryptedBackupFormat))
+	if err != nil {
+		return nil, err
+	}
+	nonce, ciphertext := sealed[:aesGCM.NonceSize()], sealed[aesGCM.NonceSize():]
+
+	return &EncryptedBackup{
+		Format:     EncryptedBackupFormat,
+		Version:    1,
+		KDF:        "argon2id",
+		KDFParams:  params,
+		Salt:       Base64Encode(salt),
+		Nonce:      Base64Encode(nonce),
+		Ciphertext: Base64Encode(ciphertext),
+	}, nil
+}
+
+// DecryptBackup reverses EncryptBackup; it fails if the passphrase is wrong or the archive was modified
+func DecryptBackup(backup *EncryptedBackup, passphrase string) ([]byte, error) {
+	if backup.Format != EncryptedBackupFormat || backup.Version != 1 || backup.KDF != "argon2id" {
+		return nil, errors.New("Unsupported encrypted backup format")
+	}
+	// Archives only come from EncryptBackup, so nothing costlier than it uses is accepted
+	params := backup.KDFParams
+	if params.Time < 1 || params.Time > maxBackupArgonTime || params.Memory < 8*uint32(params.Threads) ||
+		params.Memory > backupArgonMemory || params.Threads < 1 || params.Threads > backupArgonThreads {
+		return nil, errors.New("Encrypted backup KDF parameters out of range")
+	}
+
+	salt, err := Base64Decode(backup.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid salt: %v", err)
+	}
+	nonce, err := Base64Decode(backup.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid nonce: %v", err)
+	}
+	ciphertext, err := Base64Decode(backup.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ciphertext: %v", err)
+	}
+
+	aesGCM, err := backupCipher(passphrase, salt, backup.KDFParams)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aesGCM.OpenWithNonce(nonce, ciphertext, []byte(EncryptedBackupFormat))
+	if err != nil {
+		return nil, errors.New("Wrong passphrase or corrupted backup")
+	}
+	return plaintext, nil
+}
+
+// backupCipher derives the backup key from the passphrase and returns an AES-GCM AEAD,
+// waiting for one of the backupKDFSlots
+func backupCipher(passphrase string, salt []byte, params KDFParams) (*AEAD, error) {
+	backupKDFSlots <- struct{}{}
+	defer func() { <-backupKDFSlots }()
+	key := argon2.IDKey([]byte(passphrase), salt, params.Time, params.Memory, params.Threads, 32)
+	return NewAESGCM(key)
+}
@@ -1,12 +1,10 @@
 package utils
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/cloudflare/circl/kem"
 	"github.com/cloudflare/circl/kem/kyber/kyber512"
@@ -37,39 +35,76 @@ func GenerateKyber512Keys() ([]byte, []byte, error) {
 	return publicKeyBytes, privateKeyBytes, nil
 }
 
+// privateKeyWrapKeys holds the 32-byte AES keys (AES-256) wrapping private keys server-side:
+// the current key first, then retired keys that are only used to unwrap
+var privateKeyWrapKeys struct {
+	mutex sync.RWMutex
+	keys  []*LockedBuffer
+}
+
+// errNoPrivateKeyWrapKey is returned when private keys are wrapped before a key is set
+var errNoPrivateKeyWrapKey = errors.New("No private key wrap key is configured")
+
+// SetPrivateKeyWrapKeys sets the key wrapping private keys and the retired keys still
+// accepted when unwrapping them. The keys are moved into locked memory and the caller's
+// slices are zeroized.
+func SetPrivateKeyWrapKeys(current []byte, previous ...[]byte) error {
+	secrets := append([][]byte{current}, previous...)
+	for _, key := range secrets {
+		if len(key) != 32 {
+			return errors.New("Private key wrap key must be exactly 32 bytes")
+		}
+	}
+	keys := make([]*LockedBuffer, 0, len(secrets))
+	for _, key := range secrets {
+		locked, err := NewLockedBufferFrom(key)
+		if err != nil {
+			for _, key := range keys {
+				key.Destroy()
+			}
+			return err
+		}
+		keys = append(keys, locked)
+	}
+
+	privateKeyWrapKeys.mutex.Lock()
+	defer privateKeyWrapKeys.mutex.Unlock()
+	for _, key := range privateKeyWrapKeys.keys {
+		key.Destroy()
+	}
+	privateKeyWrapKeys.keys = keys
+	return nil
+}
+
 // EncryptPrivateKey encrypts a private key using AES-GCM and returns a Base64 string.
 func EncryptPrivateKey(privateKey []byte) (string, error) {
 	fmt.Println("🔹 EncryptPrivateKey: Started encryption process")
 
-	// 32-byte AES key (AES-256)
-	aesKey := []byte("12345678901234567890123456789012")
-
-	if len(aesKey) != 32 {
-		return "", errors.New("AES key must be exactly 32 bytes")
-	}
 	if len(privateKey) == 0 {
 		return "", errors.New("Private key is empty")
 	}
 
-	block, err := aes.NewCipher(aesKey)
-	if err != nil {
-		return "", fmt.Errorf("AES cipher creation failed: %v", err)
+	privateKeyWrapKeys.mutex.RLock()
+	if len(privateKeyWrapKeys.keys) == 0 {
+		privateKeyWrapKeys.mutex.RUnlock()
+		return "", errNoPrivateKeyWrapKey
 	}
-
-	nonce := make([]byte, 12)
-	if _, err := rand.Read(nonce); err != nil {
-		return "", fmt.Errorf("Nonce generation failed: %v", err)
+	var aesGCM *AEAD
+	err := privateKeyWrapKeys.keys[0].Use(func(key []byte) (err error) {
+		aesGCM, err = NewAESGCM(key)
+		return err
+	})
+	privateKeyWrapKeys.mutex.RUnlock()
+	if err != nil {
+		return "", err
 	}
 
-	aesGCM, err := cipher.NewGCM(block)
+	// Encrypt private key; output is nonce || ciphertext
+	finalCiphertext, err := aesGCM.Seal(privateKey, nil)
 	if err != nil {
-		return "", fmt.Errorf("GCM mode initialization failed: %v", err)
+		return "", err
 	}
 
-	// Encrypt private key.
-	ciphertext := aesGCM.Seal(nil, nonce, privateKey, nil)
-	finalCiphertext := append(nonce, ciphertext...)
-
 	return base64.StdEncoding.EncodeToString(finalCiphertext), nil
 }
 
@@ -93,6 +128,32 @@ func EncryptWithKyber(recipientPublicKeyBytes []byte) ([]byte, []byte, error) {
 	return ciphertext, sharedSecret, nil
 }
 
+// EncapsulateWithKyberSeed encapsulates a shared secret to a public key as
+// EncryptWithKyber does, but derived from seed, so that whoever holds the seed can
+// compute the same secret again instead of storing it.
+func EncapsulateWithKyberSeed(recipientPublicKeyBytes, seed []byte) ([]byte, []byte, error) {
+	scheme := kyber512.Scheme()
+	if len(seed) != scheme.EncapsulationSeedSize() {
+		return nil, nil, fmt.Errorf("Kyber encapsulation seed must be %d bytes", scheme.EncapsulationSeedSize())
+	}
+
+	publicKey, err := scheme.UnmarshalBinaryPublicKey(recipientPublicKeyBytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to unmarshal public key: %v", err)
+	}
+
+	ciphertext, sharedSecret, err := scheme.EncapsulateDeterministically(publicKey, seed)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Kyber encapsulation failed: %v", err)
+	}
+	return ciphertext, sharedSecret, nil
+}
+
+// KyberCiphertextSize returns the size of a Kyber512 encapsulation
+func KyberCiphertextSize() int {
+	return kyber512.Scheme().CiphertextSize()
+}
+
 // DecryptWithKyber decrypts a ciphertext using Kyber KEM.
 func DecryptWithKyber(privateKeyBytes, ciphertextBytes []byte) ([]byte, error) {
 	// Use Kyber512 from Cloudflare's CIRCL library
@@ -113,7 +174,89 @@ func DecryptWithKyber(privateKeyBytes, ciphertextBytes []byte) ([]byte, error) {
 	return sharedSecret, nil
 }
 
-// DecryptPrivateKey is not used server-side in this minimal example.
+// DecryptPrivateKey reverses EncryptPrivateKey, returning the raw private key bytes.
 func DecryptPrivateKey(encryptedPrivateKey string) ([]byte, error) {
-	return nil, errors.New("Server-side decryption not implemented")
+	finalCiphertext, err := base64.StdEncoding.DecodeString(encryptedPrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Encrypted private key is not valid base64: %v", err)
+	}
+
+	// Private keys wrapped before a key change are unwrapped with the retired key
+	privateKeyWrapKeys.mutex.RLock()
+	defer privateKeyWrapKeys.mutex.RUnlock()
+	var privateKey []byte
+	err = errNoPrivateKeyWrapKey
+	for _, key := range privateKeyWrapKeys.keys {
+		var aesGCM *AEAD
+		if err = key.Use(func(key []byte) (err error) {
+			aesGCM, err = NewAESGCM(key)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		if privateKey, err = aesGCM.Open(finalCiphertext, nil); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Private key decryption failed: %v", err)
+	}
+	if len(privateKey) == 0 {
+		return nil, errors.New("Decrypted private key is empty")
+	}
+	return privateKey, nil
+}
+
+// CryptoSelfTest exercises the full key lifecycle (keygen → wrap → unwrap → encapsulate/decapsulate)
+// so a broken crypto setup is detected at startup rather than on the first user request.
+func CryptoSelfTest() error {
+	publicKey, privateKey, err := GenerateKyber512Keys()
+	if err != nil {
+		return fmt.Errorf("key generation: %v", err)
+	}
+	defer Zeroize(privateKey)
+
+	wrapped, err := EncryptPrivateKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("private key wrap: %v", err)
+	}
+
+	unwrapped, err := DecryptPrivateKey(wrapped)
+	if err != nil {
+		return fmt.Errorf("private key unwrap: %v", err)
+	}
+	defer Zeroize(unwrapped)
+	if !ConstantTimeEqual(unwrapped, privateKey) {
+		return errors.New("private key unwrap: round trip mismatch")
+	}
+
+	ciphertext, sharedSecret, err := EncryptWithKyber(publicKey)
+	if err != nil {
+		return fmt.Errorf("encapsulation: %v", err)
+	}
+
+	recovered, err := DecryptWithKyber(unwrapped, ciphertext)
+	if err != nil {
+		return fmt.Errorf("decapsulation: %v", err)
+	}
+	defer Zeroize(sharedSecret)
+	defer Zeroize(recovered)
+	if !ConstantTimeEqual(recovered, sharedSecret) {
+		return errors.New("decapsulation: shared secret mismatch")
+	}
+
+	return nil
+}
+
+// ValidateKyber512PublicKey checks that a base64-encoded public key is a well-formed Kyber512 key.
+func ValidateKyber512PublicKey(publicKeyBase64 string) error {
+	publicKeyBytes, err := base64.StdEncoding.DecodeString(publicKeyBase64)
+	if err != nil {
+		return fmt.Errorf("Public key is not valid base64: %v", err)
+	}
+
+	if _, err := kyber512.Scheme().UnmarshalBinaryPublicKey(publicKeyBytes); err != nil {
+		return fmt.Errorf("Invalid Kyber512 public key: %v", err)
+	}
+	return nil
 }
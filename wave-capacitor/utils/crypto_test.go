@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+// testWrapKey returns a random 32-byte key and a copy of it, as SetPrivateKeyWrapKeys
+// zeroizes the keys it is given
+func testWrapKey(t *testing.T) ([]byte, []byte) {
+	key, err := GenerateRandomBytes(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, bytes.Clone(key)
+}
+
+func TestPrivateKeyWrapKeyChange(t *testing.T) {
+	oldKey, oldCopy := testWrapKey(t)
+	if err := SetPrivateKeyWrapKeys(oldKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := CryptoSelfTest(); err != nil {
+		t.Fatal(err)
+	}
+	privateKey := []byte("private key")
+	wrapped, err := EncryptPrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys wrapped before a key change unwrap with the retired key
+	newKey, newCopy := testWrapKey(t)
+	if err := SetPrivateKeyWrapKeys(newKey, oldCopy); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := DecryptPrivateKey(wrapped); err != nil || !bytes.Equal(got, privateKey) {
+		t.Fatalf("with the retired key: got %q, %v", got, err)
+	}
+
+	if err := SetPrivateKeyWrapKeys(newCopy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptPrivateKey(wrapped); err == nil {
+		t.Fatal("unwrapped without the key it was wrapped with")
+	}
+
+	if err := SetPrivateKeyWrapKeys(make([]byte, 16)); err == nil {
+		t.Fatal("accepted a 16-byte wrap key")
+	}
+}
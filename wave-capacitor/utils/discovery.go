@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Contexts separating the hashes of discovery from other uses of SHA-256
+const (
+	discoveryIdentifierContext = "wave-discovery-id-v1\x00"
+	discoveryLookupContext     = "wave-discovery-lookup-v1\x00"
+	discoverySealContext       = "wave-discovery-seal-v1\x00"
+	discoverySlotContext       = "wave-discovery-slot-v1\x00"
+)
+
+// DiscoveryIdentifier blinds an identifier two users know about each other, such as a
+// normalized phone number or email address: the hex SHA-256 of it. Clients compute it
+// themselves, so the node never sees the identifier.
+func DiscoveryIdentifier(identifier string) string {
+	sum := sha256.Sum256([]byte(discoveryIdentifierContext + identifier))
+	return hex.EncodeToString(sum[:])
+}
+
+// DiscoveryPairKeys derives, from the blinded identifiers of two users, the 160-bit DHT
+// key their discovery records are stored under and the key sealing the records. Both are
+// the same whichever side derives them, and reveal neither identifier.
+func DiscoveryPairKeys(identifierA, identifierB string) (lookup [20]byte, seal [32]byte) {
+	if identifierB < identifierA {
+		identifierA, identifierB = identifierB, identifierA
+	}
+	pair := identifierA + "\x00" + identifierB
+
+	digest := sha256.Sum256([]byte(discoveryLookupContext + pair))
+	copy(lookup[:], digest[:])
+	seal = sha256.Sum256([]byte(discoverySealContext + pair))
+	return lookup, seal
+}
+
+// DiscoverySlot returns the slot the owner of identifier publishes its record of a pair
+// in, so publishing again replaces it. Without the pair's seal key the slot can't be tied
+// to the identifier.
+func DiscoverySlot(seal [32]byte, identifier string) string {
+	sum := sha256.Sum256([]byte(discoverySlotContext + string(seal[:]) + identifier))
+	return hex.EncodeToString(sum[:16])
+}
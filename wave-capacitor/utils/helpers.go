@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"strings"
 )
@@ -82,23 +81,6 @@ func Base64Decode(s string) ([]byte, error) {
 	return base64.StdEncoding.DecodeString(s)
 }
 
-// LogInfo logs informational messages
-func LogInfo(format string, v ...interface{}) {
-	log.Printf("INFO: "+format, v...)
-}
-
-// LogError logs error messages
-func LogError(format string, v ...interface{}) {
-	log.Printf("ERROR: "+format, v...)
-}
-
-// LogDebug logs debug messages (only when DEBUG environment variable is set)
-func LogDebug(format string, v ...interface{}) {
-	if os.Getenv("DEBUG") == "true" {
-		log.Printf("DEBUG: "+format, v...)
-	}
-}
-
 // IsProduction checks if the application is running in production mode
 func IsProduction() bool {
 	return os.Getenv("ENVIRONMENT") == "production"
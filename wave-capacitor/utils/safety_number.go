@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// safetyNumberContext separates safety number digests from other uses of SHA-512
+const safetyNumberContext = "wave-safety-number-v1\x00"
+
+// SafetyNumber returns the number two users compare, out of band, to verify each other's
+// public keys: six groups of five digits, the same whichever side computes it. The keys
+// are sorted; each contributes three groups, taken from its SHA-512 digest five bytes at
+// a time modulo 100000.
+func SafetyNumber(publicKeyA, publicKeyB string) string {
+	if publicKeyB < publicKeyA {
+		publicKeyA, publicKeyB = publicKeyB, publicKeyA
+	}
+
+	groups := make([]string, 0, 6)
+	for _, key := range []string{publicKeyA, publicKeyB} {
+		digest := sha512.Sum512([]byte(safetyNumberContext + key))
+		for i := 0; i < 3; i++ {
+			var chunk [8]byte
+			copy(chunk[3:], digest[i*5:i*5+5])
+			groups = append(groups, fmt.Sprintf("%05d", binary.BigEndian.Uint64(chunk[:])%100000))
+		}
+	}
+	return strings.Join(groups, " ")
+}
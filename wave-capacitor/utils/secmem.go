@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// ConstantTimeEqual compares two byte slices without leaking timing information about their contents
+func ConstantTimeEqual(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// ConstantTimeEqualString compares two strings (tokens, keys) in constant time
+func ConstantTimeEqualString(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// Zeroize overwrites a byte slice holding secret material
+func Zeroize(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	// Keep the slice alive until the writes above have happened
+	runtime.KeepAlive(b)
+}
+
+// ErrBufferDestroyed is returned when a LockedBuffer is used after it was destroyed
+var ErrBufferDestroyed = errors.New("secure buffer was destroyed")
+
+// LockedBuffer holds secret material in memory that is excluded from swap where the
+// platform supports it, and is wiped when destroyed. Destroy waits for the callers
+// using the contents, so it is safe while background jobs may still read them.
+type LockedBuffer struct {
+	mutex  sync.RWMutex
+	data   []byte
+	locked bool
+}
+
+// NewLockedBufferFrom copies secret into a locked buffer and zeroizes the source slice
+func NewLockedBufferFrom(secret []byte) (*LockedBuffer, error) {
+	buf, err := newLockedBuffer(len(secret))
+	if err != nil {
+		return nil, err
+	}
+	copy(buf.data, secret)
+	Zeroize(secret)
+	return buf, nil
+}
+
+// Use calls fn with the protected contents, which can't be destroyed until fn returns.
+// fn must not retain the slice. Once the buffer is destroyed it returns ErrBufferDestroyed.
+func (b *LockedBuffer) Use(fn func(data []byte) error) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if b.data == nil {
+		return ErrBufferDestroyed
+	}
+	return fn(b.data)
+}
+
+// Len returns the size of the buffer
+func (b *LockedBuffer) Len() int {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return len(b.data)
+}
+
+// Destroy wipes and releases the buffer once no caller is using it
+func (b *LockedBuffer) Destroy() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.data == nil {
+		return
+	}
+	Zeroize(b.data)
+	b.release()
+	b.data = nil
+}
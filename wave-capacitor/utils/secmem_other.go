@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd)
+
+package utils
+
+// newLockedBuffer falls back to ordinary heap memory on platforms without mlock
+func newLockedBuffer(size int) (*LockedBuffer, error) {
+	return &LockedBuffer{data: make([]byte, size)}, nil
+}
+
+// release is a no-op for heap-backed buffers
+func (b *LockedBuffer) release() {}
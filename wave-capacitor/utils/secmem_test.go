@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockedBufferDestroyWaitsForUse(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	buf, err := NewLockedBufferFrom(bytes.Clone(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	using, release := make(chan struct{}), make(chan struct{})
+	used := make(chan error)
+	go func() {
+		used <- buf.Use(func(data []byte) error {
+			close(using)
+			<-release
+			if !bytes.Equal(data, secret) {
+				return errors.New("contents changed while in use")
+			}
+			return nil
+		})
+	}()
+	<-using
+
+	destroyed := make(chan struct{})
+	go func() {
+		buf.Destroy()
+		close(destroyed)
+	}()
+	select {
+	case <-destroyed:
+		t.Fatal("Destroy returned while the buffer was in use")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-used; err != nil {
+		t.Fatal(err)
+	}
+	<-destroyed
+
+	if err := buf.Use(func([]byte) error { return nil }); !errors.Is(err, ErrBufferDestroyed) {
+		t.Fatalf("Use after Destroy: got %v, want ErrBufferDestroyed", err)
+	}
+	buf.Destroy()
+}
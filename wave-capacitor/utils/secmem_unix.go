@@ -0,0 +1,41 @@
+//go:build linux || darwin || freebsd
+
+package utils
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+)
+
+// newLockedBuffer allocates an anonymous mapping and locks it into RAM
+func newLockedBuffer(size int) (*LockedBuffer, error) {
+	if size == 0 {
+		return &LockedBuffer{data: []byte{}}, nil
+	}
+
+	data, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate secure memory: %v", err)
+	}
+
+	buf := &LockedBuffer{data: data}
+	if err := syscall.Mlock(data); err != nil {
+		// Locking commonly fails under low RLIMIT_MEMLOCK; keep going with unlocked memory
+		log.Printf("Warning: Failed to lock secure memory (%v); secrets may be swapped to disk", err)
+	} else {
+		buf.locked = true
+	}
+	return buf, nil
+}
+
+// release unlocks and unmaps the buffer
+func (b *LockedBuffer) release() {
+	if len(b.data) == 0 {
+		return
+	}
+	if b.locked {
+		syscall.Munlock(b.data)
+	}
+	syscall.Munmap(b.data)
+}
@@ -0,0 +1,69 @@
+// Package version describes the build of the running binary. Release builds set the
+// variables through the linker, e.g.
+//
+//	go build -ldflags "-X wave_capacitor/version.Version=1.2.0 \
+//		-X wave_capacitor/version.Commit=$(git rev-parse HEAD) \
+//		-X wave_capacitor/version.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Builds without them fall back to the VCS stamp the go command embeds.
+package version
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Set with -ldflags "-X wave_capacitor/version.<Name>=<value>"
+var (
+	Version   = "1.0.0"
+	Commit    = ""
+	BuildDate = ""
+)
+
+// Info is the build of the running binary
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit" doc:"git commit, suffixed with -dirty for modified trees; unknown if not stamped"`
+	BuildDate string `json:"build_date" doc:"RFC 3339; unknown if not stamped"`
+	GoVersion string `json:"go_version"`
+}
+
+var (
+	infoOnce sync.Once
+	info     Info
+)
+
+// Get returns the build information, resolved once
+func Get() Info {
+	infoOnce.Do(func() {
+		info = Info{Version: Version, Commit: Commit, BuildDate: BuildDate, GoVersion: runtime.Version()}
+		if build, ok := debug.ReadBuildInfo(); ok {
+			var modified bool
+			for _, setting := range build.Settings {
+				switch setting.Key {
+				case "vcs.revision":
+					if info.Commit == "" {
+						info.Commit = setting.Value
+					}
+				case "vcs.time":
+					if info.BuildDate == "" {
+						info.BuildDate = setting.Value
+					}
+				case "vcs.modified":
+					modified = setting.Value == "true"
+				}
+			}
+			if modified && Commit == "" && info.Commit != "" {
+				info.Commit += "-dirty"
+			}
+		}
+		if info.Commit == "" {
+			info.Commit = "unknown"
+		}
+		if info.BuildDate == "" {
+			info.BuildDate = "unknown"
+		}
+	})
+	return info
+}
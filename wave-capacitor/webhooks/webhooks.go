@@ -0,0 +1,401 @@
+// Package webhooks POSTs signed JSON events about messages, contacts and accounts to the
+// endpoints users register and to an optional node-wide endpoint set by the operator.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"wave_capacitor/logging"
+	"wave_capacitor/models"
+
+	"github.com/google/uuid"
+)
+
+// Event types
+const (
+	EventMessageReceived = "message.received"
+	EventContactAdded    = "contact.added"
+	EventContactRemoved  = "contact.removed"
+	EventAccountCreated  = "account.created"
+	EventKeysRotated     = "account.keys_rotated"
+	EventUsernameChanged = "account.username_changed"
+	EventAccountDeleted  = "account.deleted"
+)
+
+// EventTypes lists every event type a webhook can subscribe to
+var EventTypes = []string{
+	EventMessageReceived,
+	EventContactAdded,
+	EventContactRemoved,
+	EventAccountCreated,
+	EventKeysRotated,
+	EventUsernameChanged,
+	EventAccountDeleted,
+}
+
+// ValidEventType reports whether eventType is one of EventTypes
+func ValidEventType(eventType string) bool {
+	for _, t := range EventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery headers. The signature is "t=<unix seconds>,v1=<hex HMAC-SHA256>" computed
+// over "<t>.<body>" with the webhook secret; receivers should reject stale timestamps.
+const (
+	SignatureHeader = "Wave-Signature"
+	EventHeader     = "Wave-Event"
+	DeliveryHeader  = "Wave-Delivery"
+)
+
+// Event is the JSON body of a delivery
+type Event struct {
+	ID        string      `json:"id"` // the same for every attempt and endpoint
+	Type      string      `json:"type"`
+	Username  string      `json:"username,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// Options configures a Dispatcher
+type Options struct {
+	URL    string // node-wide endpoint receiving every event; empty disables it
+	Secret string // signs deliveries to the node-wide endpoint
+
+	// AllowPrivateNetworks lets user webhooks reach loopback, private and link-local
+	// addresses. Keep it off unless every user is trusted with access to the node's network.
+	AllowPrivateNetworks bool
+
+	Workers   int // concurrent deliveries
+	QueueSize int // events and retries waiting for a worker; further events are dropped
+}
+
+// retryDelays are the waits before the second and later attempts of a failed delivery
+var retryDelays = []time.Duration{30 * time.Second, 2 * time.Minute, 10 * time.Minute, time.Hour}
+
+const (
+	// deliveryTimeout bounds a single attempt including the response
+	deliveryTimeout = 10 * time.Second
+	// deliveryLogRetention is how long attempts stay in the delivery log
+	deliveryLogRetention = 7 * 24 * time.Hour
+	// maxLoggedError truncates error messages stored in the delivery log
+	maxLoggedError = 512
+)
+
+// errPrivateAddress is returned when a user webhook resolves to a non-public address
+var errPrivateAddress = errors.New("webhook address is not public")
+
+// target is one endpoint an event is delivered to
+type target struct {
+	id     string // webhook ID, or models.DeploymentWebhookID
+	url    string
+	secret string
+	public bool // registered by a user, so only public addresses may be dialed
+}
+
+// job is an event waiting to be fanned out (target nil) or one delivery attempt
+type job struct {
+	ctx       context.Context // carries the request ID of the request that emitted the event
+	event     Event
+	publicKey string // resolved to the username when the event has none
+	target    *target
+	attempt   int
+}
+
+// Dispatcher queues events and delivers them in the background with retries.
+// Pending deliveries live in memory and are lost when the node stops; the delivery log
+// shows which attempts were made. A nil *Dispatcher drops all events.
+type Dispatcher struct {
+	opts         Options
+	queue        chan job
+	client       *http.Client // node-wide endpoint, trusted by the operator
+	publicClient *http.Client // user endpoints
+	done         chan struct{}
+	wg           sync.WaitGroup
+
+	secretMu sync.RWMutex
+	secret   string // opts.Secret, replaced by SetSecret
+}
+
+// NewDispatcher creates a dispatcher; call Start to begin delivering
+func NewDispatcher(opts Options) *Dispatcher {
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1024
+	}
+
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !opts.AllowPrivateNetworks {
+		dialer.Control = refusePrivateAddress
+	}
+
+	return &Dispatcher{
+		opts:   opts,
+		queue:  make(chan job, opts.QueueSize),
+		client: &http.Client{Timeout: deliveryTimeout},
+		publicClient: &http.Client{
+			Timeout: deliveryTimeout,
+			// No proxy: the address check must see the endpoint itself
+			Transport: &http.Transport{DialContext: dialer.DialContext, ResponseHeaderTimeout: deliveryTimeout},
+		},
+		done:   make(chan struct{}),
+		secret: opts.Secret,
+	}
+}
+
+// SetSecret replaces the secret signing deliveries to the node-wide endpoint, e.g. after
+// it was rotated; deliveries and retries already queued are still signed with the old one
+func (d *Dispatcher) SetSecret(secret string) {
+	if d == nil {
+		return
+	}
+	d.secretMu.Lock()
+	defer d.secretMu.Unlock()
+	d.secret = secret
+}
+
+// Start launches the delivery workers and the delivery log cleanup
+func (d *Dispatcher) Start() {
+	for i := 0; i < d.opts.Workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.done:
+				return
+			case <-ticker.C:
+				if _, err := models.PurgeWebhookDeliveries(context.Background(), time.Now().Add(-deliveryLogRetention)); err != nil {
+					logging.Errorf(context.Background(), "Error purging webhook deliveries: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop waits for in-flight deliveries to finish; queued events and pending retries are dropped
+func (d *Dispatcher) Stop() {
+	close(d.done)
+	d.wg.Wait()
+}
+
+// Emit queues an event concerning username
+func (d *Dispatcher) Emit(ctx context.Context, username, eventType string, data interface{}) {
+	d.emit(ctx, username, "", eventType, data)
+}
+
+// EmitForKey queues an event concerning the account owning publicKey, which is looked up
+// in the background so the caller doesn't pay for it
+func (d *Dispatcher) EmitForKey(ctx context.Context, publicKey, eventType string, data interface{}) {
+	d.emit(ctx, "", publicKey, eventType, data)
+}
+
+func (d *Dispatcher) emit(ctx context.Context, username, publicKey, eventType string, data interface{}) {
+	if d == nil {
+		return
+	}
+	d.enqueue(job{
+		ctx: logging.Detach(ctx),
+		event: Event{
+			ID:        uuid.New().String(),
+			Type:      eventType,
+			Username:  username,
+			CreatedAt: time.Now().UTC(),
+			Data:      data,
+		},
+		publicKey: publicKey,
+	})
+}
+
+// QueueLength returns the deliveries waiting for a worker
+func (d *Dispatcher) QueueLength() int {
+	if d == nil {
+		return 0
+	}
+	return len(d.queue)
+}
+
+// enqueue hands a job to the workers without blocking the caller
+func (d *Dispatcher) enqueue(j job) {
+	select {
+	case <-d.done:
+	case d.queue <- j:
+	default:
+		logging.Warnf(j.ctx, "⚠️ Webhook queue full, dropping %s event %s", j.event.Type, j.event.ID)
+	}
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.done:
+			return
+		case j := <-d.queue:
+			if j.target == nil {
+				d.fanOut(j)
+			} else {
+				d.deliver(j)
+			}
+		}
+	}
+}
+
+// fanOut queues one delivery per endpoint subscribed to the event
+func (d *Dispatcher) fanOut(j job) {
+	if j.event.Username == "" && j.publicKey != "" {
+		user, err := models.GetUserByPublicKey(j.ctx, j.publicKey)
+		if err != nil && !errors.Is(err, models.ErrUserNotFound) {
+			logging.Errorf(j.ctx, "Error resolving webhook event %s recipient: %v", j.event.ID, err)
+		}
+		if user != nil {
+			j.event.Username = user.Username
+		}
+	}
+
+	targets := []*target{}
+	if d.opts.URL != "" {
+		d.secretMu.RLock()
+		secret := d.secret
+		d.secretMu.RUnlock()
+		targets = append(targets, &target{id: models.DeploymentWebhookID, url: d.opts.URL, secret: secret})
+	}
+	if j.event.Username != "" {
+		hooks, err := models.ListWebhooks(j.ctx, j.event.Username)
+		if err != nil {
+			logging.Errorf(j.ctx, "Error loading webhooks of %s: %v", j.event.Username, err)
+		}
+		for _, hook := range hooks {
+			if hook.Subscribed(j.event.Type) {
+				targets = append(targets, &target{id: hook.ID, url: hook.URL, secret: hook.Secret, public: true})
+			}
+		}
+	}
+
+	for _, t := range targets {
+		d.enqueue(job{ctx: j.ctx, event: j.event, target: t, attempt: 1})
+	}
+}
+
+// deliver makes one attempt, logs it and schedules a retry if it may still succeed
+func (d *Dispatcher) deliver(j job) {
+	start := time.Now()
+	status, err := d.post(j)
+	record := models.WebhookDelivery{
+		WebhookID:  j.target.id,
+		EventID:    j.event.ID,
+		EventType:  j.event.Type,
+		Attempt:    j.attempt,
+		StatusCode: status,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+		if len(record.Error) > maxLoggedError {
+			record.Error = record.Error[:maxLoggedError]
+		}
+	}
+	if logErr := models.RecordWebhookDelivery(j.ctx, record); logErr != nil {
+		logging.Errorf(j.ctx, "Error recording webhook delivery: %v", logErr)
+	}
+
+	if err == nil {
+		return
+	}
+	// Other client errors mean the endpoint rejected the event; resending won't change that
+	retryable := status == 0 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+	if !retryable || j.attempt > len(retryDelays) {
+		logging.Warnf(j.ctx, "⚠️ Giving up on webhook %s for event %s after %d attempts: %v", j.target.id, j.event.ID, j.attempt, err)
+		return
+	}
+
+	delay := retryDelays[j.attempt-1]
+	j.attempt++
+	time.AfterFunc(delay, func() { d.enqueue(j) })
+}
+
+// post sends the signed event and returns the response status
+func (d *Dispatcher) post(j job) (int, error) {
+	body, err := json.Marshal(j.event)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(j.ctx, deliveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, j.target.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Wave-Capacitor-Webhooks/1.0")
+	req.Header.Set(EventHeader, j.event.Type)
+	req.Header.Set(DeliveryHeader, j.event.ID)
+	req.Header.Set(SignatureHeader, Sign(j.target.secret, time.Now().Unix(), body))
+	logging.Propagate(j.ctx, req.Header)
+
+	client := d.client
+	if j.target.public {
+		client = d.publicClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign returns the Wave-Signature header value for body sent at timestamp
+func Sign(secret string, timestamp int64, body []byte) string {
+	t := strconv.FormatInt(timestamp, 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// refusePrivateAddress is a dialer Control function rejecting loopback, private,
+// link-local and unspecified addresses. It runs after DNS resolution, so a public name
+// pointing at an internal address is refused too.
+func refusePrivateAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%w: %s", errPrivateAddress, host)
+	}
+	return nil
+}